@@ -0,0 +1,59 @@
+// Package checksum computes and verifies the payload checksums carried by broker messages
+package checksum
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+)
+
+// ErrMismatch is returned when a message's data does not match its checksum
+var ErrMismatch = errors.New("checksum mismatch")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Compute returns the checksum of data for the given algorithm, or nil for NO_CHECKSUM
+func Compute(algorithm pb.ChecksumType, data []byte) ([]byte, error) {
+	switch algorithm {
+	case pb.ChecksumType_NO_CHECKSUM:
+		return nil, nil
+	case pb.ChecksumType_CRC32C:
+		return binary.BigEndian.AppendUint32(nil, crc32.Checksum(data, castagnoli)), nil
+	case pb.ChecksumType_SHA256:
+		sum := sha256.Sum256(data)
+		return sum[:], nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum type %v", algorithm)
+	}
+}
+
+// Set computes the checksum of msg.Data and stores it in the message
+func Set(msg *pb.Message, algorithm pb.ChecksumType) error {
+	sum, err := Compute(algorithm, msg.Data)
+	if err != nil {
+		return err
+	}
+	msg.Checksum = sum
+	msg.ChecksumType = algorithm
+	return nil
+}
+
+// Verify checks msg.Data against its checksum. Messages without a checksum always pass.
+func Verify(msg *pb.Message) error {
+	if msg.ChecksumType == pb.ChecksumType_NO_CHECKSUM && len(msg.Checksum) == 0 {
+		return nil
+	}
+	sum, err := Compute(msg.ChecksumType, msg.Data)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, msg.Checksum) {
+		return fmt.Errorf("%w: %v of data is %x, message carries %x", ErrMismatch, msg.ChecksumType, sum, msg.Checksum)
+	}
+	return nil
+}
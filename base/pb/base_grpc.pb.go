@@ -19,9 +19,26 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type BrokerClient interface {
 	Ping(ctx context.Context, in *Identity, opts ...grpc.CallOption) (*Status, error)
+	Hello(ctx context.Context, in *HelloRequest, opts ...grpc.CallOption) (*HelloResponse, error)
 	Send(ctx context.Context, in *Message, opts ...grpc.CallOption) (*Status, error)
+	SendBatch(ctx context.Context, in *Batch, opts ...grpc.CallOption) (*Status, error)
 	Receive(ctx context.Context, in *Identity, opts ...grpc.CallOption) (Broker_ReceiveClient, error)
 	Cleanup(ctx context.Context, in *Identity, opts ...grpc.CallOption) (*Status, error)
+	Ack(ctx context.Context, in *AckRequest, opts ...grpc.CallOption) (*Status, error)
+	Nack(ctx context.Context, in *NackRequest, opts ...grpc.CallOption) (*Status, error)
+	Fetch(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (*FetchResponse, error)
+	ExtendVisibility(ctx context.Context, in *ExtendVisibilityRequest, opts ...grpc.CallOption) (*ExtendVisibilityResponse, error)
+	PauseDelivery(ctx context.Context, in *Identity, opts ...grpc.CallOption) (*Status, error)
+	ResumeDelivery(ctx context.Context, in *Identity, opts ...grpc.CallOption) (*Status, error)
+	SetReadOnly(ctx context.Context, in *ReadOnlyRequest, opts ...grpc.CallOption) (*Status, error)
+	WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (Broker_WatchEventsClient, error)
+	Tap(ctx context.Context, in *TapRequest, opts ...grpc.CallOption) (Broker_TapClient, error)
+	GetQuotaUsage(ctx context.Context, in *QuotaUsageRequest, opts ...grpc.CallOption) (*QuotaUsageResponse, error)
+	SetLogLevel(ctx context.Context, in *LogLevelRequest, opts ...grpc.CallOption) (*Status, error)
+	SetPayloadLogging(ctx context.Context, in *PayloadLoggingRequest, opts ...grpc.CallOption) (*Status, error)
+	SetSlowLogging(ctx context.Context, in *SlowLoggingRequest, opts ...grpc.CallOption) (*Status, error)
+	GetStats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsResponse, error)
+	Federate(ctx context.Context, opts ...grpc.CallOption) (Broker_FederateClient, error)
 }
 
 type brokerClient struct {
@@ -41,6 +58,15 @@ func (c *brokerClient) Ping(ctx context.Context, in *Identity, opts ...grpc.Call
 	return out, nil
 }
 
+func (c *brokerClient) Hello(ctx context.Context, in *HelloRequest, opts ...grpc.CallOption) (*HelloResponse, error) {
+	out := new(HelloResponse)
+	err := c.cc.Invoke(ctx, "/base.proto.Broker/Hello", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *brokerClient) Send(ctx context.Context, in *Message, opts ...grpc.CallOption) (*Status, error) {
 	out := new(Status)
 	err := c.cc.Invoke(ctx, "/base.proto.Broker/Send", in, out, opts...)
@@ -50,6 +76,15 @@ func (c *brokerClient) Send(ctx context.Context, in *Message, opts ...grpc.CallO
 	return out, nil
 }
 
+func (c *brokerClient) SendBatch(ctx context.Context, in *Batch, opts ...grpc.CallOption) (*Status, error) {
+	out := new(Status)
+	err := c.cc.Invoke(ctx, "/base.proto.Broker/SendBatch", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *brokerClient) Receive(ctx context.Context, in *Identity, opts ...grpc.CallOption) (Broker_ReceiveClient, error) {
 	stream, err := c.cc.NewStream(ctx, &Broker_ServiceDesc.Streams[0], "/base.proto.Broker/Receive", opts...)
 	if err != nil {
@@ -91,14 +126,234 @@ func (c *brokerClient) Cleanup(ctx context.Context, in *Identity, opts ...grpc.C
 	return out, nil
 }
 
+func (c *brokerClient) Ack(ctx context.Context, in *AckRequest, opts ...grpc.CallOption) (*Status, error) {
+	out := new(Status)
+	err := c.cc.Invoke(ctx, "/base.proto.Broker/Ack", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *brokerClient) Nack(ctx context.Context, in *NackRequest, opts ...grpc.CallOption) (*Status, error) {
+	out := new(Status)
+	err := c.cc.Invoke(ctx, "/base.proto.Broker/Nack", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *brokerClient) Fetch(ctx context.Context, in *FetchRequest, opts ...grpc.CallOption) (*FetchResponse, error) {
+	out := new(FetchResponse)
+	err := c.cc.Invoke(ctx, "/base.proto.Broker/Fetch", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *brokerClient) ExtendVisibility(ctx context.Context, in *ExtendVisibilityRequest, opts ...grpc.CallOption) (*ExtendVisibilityResponse, error) {
+	out := new(ExtendVisibilityResponse)
+	err := c.cc.Invoke(ctx, "/base.proto.Broker/ExtendVisibility", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *brokerClient) PauseDelivery(ctx context.Context, in *Identity, opts ...grpc.CallOption) (*Status, error) {
+	out := new(Status)
+	err := c.cc.Invoke(ctx, "/base.proto.Broker/PauseDelivery", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *brokerClient) ResumeDelivery(ctx context.Context, in *Identity, opts ...grpc.CallOption) (*Status, error) {
+	out := new(Status)
+	err := c.cc.Invoke(ctx, "/base.proto.Broker/ResumeDelivery", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *brokerClient) SetReadOnly(ctx context.Context, in *ReadOnlyRequest, opts ...grpc.CallOption) (*Status, error) {
+	out := new(Status)
+	err := c.cc.Invoke(ctx, "/base.proto.Broker/SetReadOnly", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *brokerClient) WatchEvents(ctx context.Context, in *WatchEventsRequest, opts ...grpc.CallOption) (Broker_WatchEventsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Broker_ServiceDesc.Streams[1], "/base.proto.Broker/WatchEvents", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &brokerWatchEventsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Broker_WatchEventsClient interface {
+	Recv() (*BrokerEvent, error)
+	grpc.ClientStream
+}
+
+type brokerWatchEventsClient struct {
+	grpc.ClientStream
+}
+
+func (x *brokerWatchEventsClient) Recv() (*BrokerEvent, error) {
+	m := new(BrokerEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *brokerClient) Tap(ctx context.Context, in *TapRequest, opts ...grpc.CallOption) (Broker_TapClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Broker_ServiceDesc.Streams[2], "/base.proto.Broker/Tap", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &brokerTapClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Broker_TapClient interface {
+	Recv() (*Message, error)
+	grpc.ClientStream
+}
+
+type brokerTapClient struct {
+	grpc.ClientStream
+}
+
+func (x *brokerTapClient) Recv() (*Message, error) {
+	m := new(Message)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *brokerClient) GetQuotaUsage(ctx context.Context, in *QuotaUsageRequest, opts ...grpc.CallOption) (*QuotaUsageResponse, error) {
+	out := new(QuotaUsageResponse)
+	err := c.cc.Invoke(ctx, "/base.proto.Broker/GetQuotaUsage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *brokerClient) SetLogLevel(ctx context.Context, in *LogLevelRequest, opts ...grpc.CallOption) (*Status, error) {
+	out := new(Status)
+	err := c.cc.Invoke(ctx, "/base.proto.Broker/SetLogLevel", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *brokerClient) SetPayloadLogging(ctx context.Context, in *PayloadLoggingRequest, opts ...grpc.CallOption) (*Status, error) {
+	out := new(Status)
+	err := c.cc.Invoke(ctx, "/base.proto.Broker/SetPayloadLogging", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *brokerClient) SetSlowLogging(ctx context.Context, in *SlowLoggingRequest, opts ...grpc.CallOption) (*Status, error) {
+	out := new(Status)
+	err := c.cc.Invoke(ctx, "/base.proto.Broker/SetSlowLogging", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *brokerClient) GetStats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsResponse, error) {
+	out := new(StatsResponse)
+	err := c.cc.Invoke(ctx, "/base.proto.Broker/GetStats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *brokerClient) Federate(ctx context.Context, opts ...grpc.CallOption) (Broker_FederateClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Broker_ServiceDesc.Streams[3], "/base.proto.Broker/Federate", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &brokerFederateClient{stream}
+	return x, nil
+}
+
+type Broker_FederateClient interface {
+	Send(*Message) error
+	Recv() (*FederationAck, error)
+	grpc.ClientStream
+}
+
+type brokerFederateClient struct {
+	grpc.ClientStream
+}
+
+func (x *brokerFederateClient) Send(m *Message) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *brokerFederateClient) Recv() (*FederationAck, error) {
+	m := new(FederationAck)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // BrokerServer is the server API for Broker service.
 // All implementations must embed UnimplementedBrokerServer
 // for forward compatibility
 type BrokerServer interface {
 	Ping(context.Context, *Identity) (*Status, error)
+	Hello(context.Context, *HelloRequest) (*HelloResponse, error)
 	Send(context.Context, *Message) (*Status, error)
+	SendBatch(context.Context, *Batch) (*Status, error)
 	Receive(*Identity, Broker_ReceiveServer) error
 	Cleanup(context.Context, *Identity) (*Status, error)
+	Ack(context.Context, *AckRequest) (*Status, error)
+	Nack(context.Context, *NackRequest) (*Status, error)
+	Fetch(context.Context, *FetchRequest) (*FetchResponse, error)
+	ExtendVisibility(context.Context, *ExtendVisibilityRequest) (*ExtendVisibilityResponse, error)
+	PauseDelivery(context.Context, *Identity) (*Status, error)
+	ResumeDelivery(context.Context, *Identity) (*Status, error)
+	SetReadOnly(context.Context, *ReadOnlyRequest) (*Status, error)
+	WatchEvents(*WatchEventsRequest, Broker_WatchEventsServer) error
+	Tap(*TapRequest, Broker_TapServer) error
+	GetQuotaUsage(context.Context, *QuotaUsageRequest) (*QuotaUsageResponse, error)
+	SetLogLevel(context.Context, *LogLevelRequest) (*Status, error)
+	SetPayloadLogging(context.Context, *PayloadLoggingRequest) (*Status, error)
+	SetSlowLogging(context.Context, *SlowLoggingRequest) (*Status, error)
+	GetStats(context.Context, *StatsRequest) (*StatsResponse, error)
+	Federate(Broker_FederateServer) error
 	mustEmbedUnimplementedBrokerServer()
 }
 
@@ -109,15 +364,66 @@ type UnimplementedBrokerServer struct {
 func (UnimplementedBrokerServer) Ping(context.Context, *Identity) (*Status, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Ping not implemented")
 }
+func (UnimplementedBrokerServer) Hello(context.Context, *HelloRequest) (*HelloResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Hello not implemented")
+}
 func (UnimplementedBrokerServer) Send(context.Context, *Message) (*Status, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Send not implemented")
 }
+func (UnimplementedBrokerServer) SendBatch(context.Context, *Batch) (*Status, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendBatch not implemented")
+}
 func (UnimplementedBrokerServer) Receive(*Identity, Broker_ReceiveServer) error {
 	return status.Errorf(codes.Unimplemented, "method Receive not implemented")
 }
 func (UnimplementedBrokerServer) Cleanup(context.Context, *Identity) (*Status, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Cleanup not implemented")
 }
+func (UnimplementedBrokerServer) Ack(context.Context, *AckRequest) (*Status, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Ack not implemented")
+}
+func (UnimplementedBrokerServer) Nack(context.Context, *NackRequest) (*Status, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Nack not implemented")
+}
+func (UnimplementedBrokerServer) Fetch(context.Context, *FetchRequest) (*FetchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Fetch not implemented")
+}
+func (UnimplementedBrokerServer) ExtendVisibility(context.Context, *ExtendVisibilityRequest) (*ExtendVisibilityResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ExtendVisibility not implemented")
+}
+func (UnimplementedBrokerServer) PauseDelivery(context.Context, *Identity) (*Status, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PauseDelivery not implemented")
+}
+func (UnimplementedBrokerServer) ResumeDelivery(context.Context, *Identity) (*Status, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResumeDelivery not implemented")
+}
+func (UnimplementedBrokerServer) SetReadOnly(context.Context, *ReadOnlyRequest) (*Status, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetReadOnly not implemented")
+}
+func (UnimplementedBrokerServer) WatchEvents(*WatchEventsRequest, Broker_WatchEventsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchEvents not implemented")
+}
+func (UnimplementedBrokerServer) Tap(*TapRequest, Broker_TapServer) error {
+	return status.Errorf(codes.Unimplemented, "method Tap not implemented")
+}
+func (UnimplementedBrokerServer) GetQuotaUsage(context.Context, *QuotaUsageRequest) (*QuotaUsageResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetQuotaUsage not implemented")
+}
+func (UnimplementedBrokerServer) SetLogLevel(context.Context, *LogLevelRequest) (*Status, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetLogLevel not implemented")
+}
+func (UnimplementedBrokerServer) SetPayloadLogging(context.Context, *PayloadLoggingRequest) (*Status, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetPayloadLogging not implemented")
+}
+func (UnimplementedBrokerServer) SetSlowLogging(context.Context, *SlowLoggingRequest) (*Status, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetSlowLogging not implemented")
+}
+func (UnimplementedBrokerServer) GetStats(context.Context, *StatsRequest) (*StatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStats not implemented")
+}
+func (UnimplementedBrokerServer) Federate(Broker_FederateServer) error {
+	return status.Errorf(codes.Unimplemented, "method Federate not implemented")
+}
 func (UnimplementedBrokerServer) mustEmbedUnimplementedBrokerServer() {}
 
 // UnsafeBrokerServer may be embedded to opt out of forward compatibility for this service.
@@ -149,6 +455,24 @@ func _Broker_Ping_Handler(srv interface{}, ctx context.Context, dec func(interfa
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Broker_Hello_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HelloRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerServer).Hello(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/base.proto.Broker/Hello",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).Hello(ctx, req.(*HelloRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _Broker_Send_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(Message)
 	if err := dec(in); err != nil {
@@ -167,6 +491,24 @@ func _Broker_Send_Handler(srv interface{}, ctx context.Context, dec func(interfa
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Broker_SendBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Batch)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerServer).SendBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/base.proto.Broker/SendBatch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).SendBatch(ctx, req.(*Batch))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _Broker_Receive_Handler(srv interface{}, stream grpc.ServerStream) error {
 	m := new(Identity)
 	if err := stream.RecvMsg(m); err != nil {
@@ -206,6 +548,290 @@ func _Broker_Cleanup_Handler(srv interface{}, ctx context.Context, dec func(inte
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Broker_Ack_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AckRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerServer).Ack(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/base.proto.Broker/Ack",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).Ack(ctx, req.(*AckRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Broker_Nack_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(NackRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerServer).Nack(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/base.proto.Broker/Nack",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).Nack(ctx, req.(*NackRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Broker_Fetch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FetchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerServer).Fetch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/base.proto.Broker/Fetch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).Fetch(ctx, req.(*FetchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Broker_ExtendVisibility_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExtendVisibilityRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerServer).ExtendVisibility(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/base.proto.Broker/ExtendVisibility",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).ExtendVisibility(ctx, req.(*ExtendVisibilityRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Broker_PauseDelivery_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Identity)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerServer).PauseDelivery(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/base.proto.Broker/PauseDelivery",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).PauseDelivery(ctx, req.(*Identity))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Broker_ResumeDelivery_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Identity)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerServer).ResumeDelivery(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/base.proto.Broker/ResumeDelivery",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).ResumeDelivery(ctx, req.(*Identity))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Broker_SetReadOnly_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReadOnlyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerServer).SetReadOnly(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/base.proto.Broker/SetReadOnly",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).SetReadOnly(ctx, req.(*ReadOnlyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Broker_WatchEvents_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchEventsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(BrokerServer).WatchEvents(m, &brokerWatchEventsServer{stream})
+}
+
+type Broker_WatchEventsServer interface {
+	Send(*BrokerEvent) error
+	grpc.ServerStream
+}
+
+type brokerWatchEventsServer struct {
+	grpc.ServerStream
+}
+
+func (x *brokerWatchEventsServer) Send(m *BrokerEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Broker_Tap_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(TapRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(BrokerServer).Tap(m, &brokerTapServer{stream})
+}
+
+type Broker_TapServer interface {
+	Send(*Message) error
+	grpc.ServerStream
+}
+
+type brokerTapServer struct {
+	grpc.ServerStream
+}
+
+func (x *brokerTapServer) Send(m *Message) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Broker_GetQuotaUsage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QuotaUsageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerServer).GetQuotaUsage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/base.proto.Broker/GetQuotaUsage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).GetQuotaUsage(ctx, req.(*QuotaUsageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Broker_SetLogLevel_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LogLevelRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerServer).SetLogLevel(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/base.proto.Broker/SetLogLevel",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).SetLogLevel(ctx, req.(*LogLevelRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Broker_SetPayloadLogging_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PayloadLoggingRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerServer).SetPayloadLogging(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/base.proto.Broker/SetPayloadLogging",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).SetPayloadLogging(ctx, req.(*PayloadLoggingRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Broker_SetSlowLogging_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SlowLoggingRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerServer).SetSlowLogging(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/base.proto.Broker/SetSlowLogging",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).SetSlowLogging(ctx, req.(*SlowLoggingRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Broker_GetStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BrokerServer).GetStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/base.proto.Broker/GetStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BrokerServer).GetStats(ctx, req.(*StatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Broker_Federate_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(BrokerServer).Federate(&brokerFederateServer{stream})
+}
+
+type Broker_FederateServer interface {
+	Send(*FederationAck) error
+	Recv() (*Message, error)
+	grpc.ServerStream
+}
+
+type brokerFederateServer struct {
+	grpc.ServerStream
+}
+
+func (x *brokerFederateServer) Send(m *FederationAck) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *brokerFederateServer) Recv() (*Message, error) {
+	m := new(Message)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // Broker_ServiceDesc is the grpc.ServiceDesc for Broker service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -217,14 +843,70 @@ var Broker_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Ping",
 			Handler:    _Broker_Ping_Handler,
 		},
+		{
+			MethodName: "Hello",
+			Handler:    _Broker_Hello_Handler,
+		},
 		{
 			MethodName: "Send",
 			Handler:    _Broker_Send_Handler,
 		},
+		{
+			MethodName: "SendBatch",
+			Handler:    _Broker_SendBatch_Handler,
+		},
 		{
 			MethodName: "Cleanup",
 			Handler:    _Broker_Cleanup_Handler,
 		},
+		{
+			MethodName: "Ack",
+			Handler:    _Broker_Ack_Handler,
+		},
+		{
+			MethodName: "Nack",
+			Handler:    _Broker_Nack_Handler,
+		},
+		{
+			MethodName: "Fetch",
+			Handler:    _Broker_Fetch_Handler,
+		},
+		{
+			MethodName: "ExtendVisibility",
+			Handler:    _Broker_ExtendVisibility_Handler,
+		},
+		{
+			MethodName: "PauseDelivery",
+			Handler:    _Broker_PauseDelivery_Handler,
+		},
+		{
+			MethodName: "ResumeDelivery",
+			Handler:    _Broker_ResumeDelivery_Handler,
+		},
+		{
+			MethodName: "SetReadOnly",
+			Handler:    _Broker_SetReadOnly_Handler,
+		},
+		{
+			MethodName: "GetQuotaUsage",
+			Handler:    _Broker_GetQuotaUsage_Handler,
+		},
+		{
+			MethodName: "SetLogLevel",
+			Handler:    _Broker_SetLogLevel_Handler,
+		},
+		{
+			MethodName: "SetPayloadLogging",
+			Handler:    _Broker_SetPayloadLogging_Handler,
+		},
+		{
+			MethodName: "SetSlowLogging",
+			Handler:    _Broker_SetSlowLogging_Handler,
+		},
+		{
+			MethodName: "GetStats",
+			Handler:    _Broker_GetStats_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -232,6 +914,22 @@ var Broker_ServiceDesc = grpc.ServiceDesc{
 			Handler:       _Broker_Receive_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "WatchEvents",
+			Handler:       _Broker_WatchEvents_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Tap",
+			Handler:       _Broker_Tap_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Federate",
+			Handler:       _Broker_Federate_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
 	},
 	Metadata: "base.proto",
 }
@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// InstanceSeparator separates the service name from the instance id in an address
+const InstanceSeparator = "@"
+
+// InstanceAddress returns the address of one instance of a service, e.g. "orders@pod-7".
+// Messages sent to it reach only the Receive stream opened with that instance id.
+func InstanceAddress(service, instance string) string {
+	if instance == "" {
+		return service
+	}
+	return service + InstanceSeparator + instance
+}
+
+// SplitAddress splits an address into its service name and instance id, which is
+// empty for plain service addresses
+func SplitAddress(address string) (service, instance string) {
+	service, instance, _ = strings.Cut(address, InstanceSeparator)
+	return service, instance
+}
+
+// Service names are hierarchical, with segments separated by NameSeparator, e.g.
+// "payments.eu.billing". In a name pattern a segment is matched as a glob, so "*"
+// matches any one segment and "billing-*" any segment starting with "billing-", and
+// a last segment of WildcardRest matches one or more segments.
+const (
+	NameSeparator = "."
+	WildcardRest  = ">"
+)
+
+// IsPattern reports whether a service name or address is a name pattern
+func IsPattern(name string) bool {
+	return strings.ContainsAny(name, "*?[") || name == WildcardRest || strings.HasSuffix(name, NameSeparator+WildcardRest)
+}
+
+// CheckPattern reports whether pattern is a valid name pattern
+func CheckPattern(pattern string) error {
+	segments := strings.Split(pattern, NameSeparator)
+	for i, segment := range segments {
+		if segment == WildcardRest && i == len(segments)-1 {
+			continue
+		}
+		if segment == "" {
+			return fmt.Errorf("name pattern %q has an empty segment", pattern)
+		}
+		if _, err := path.Match(segment, ""); err != nil || strings.Contains(segment, WildcardRest) {
+			return fmt.Errorf("invalid name pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// MatchName reports whether the service name matches pattern. A name matches a
+// pattern without wildcards only when they are equal.
+func MatchName(pattern, name string) bool {
+	for {
+		segment, rest, more := strings.Cut(pattern, NameSeparator)
+		if segment == WildcardRest && !more {
+			return name != ""
+		}
+		part, nameRest, nameMore := strings.Cut(name, NameSeparator)
+		if ok, _ := path.Match(segment, part); !ok || more != nameMore {
+			return false
+		}
+		if !more {
+			return true
+		}
+		pattern, name = rest, nameRest
+	}
+}
@@ -0,0 +1,16 @@
+package protocol
+
+// Headers of messages whose payload the broker keeps in object storage. The queued
+// message carries the object key instead of its data; on delivery the broker adds a
+// presigned URL, from which the client library downloads the payload.
+const (
+	ClaimCheckKeyHeader  = "x-broker-claim-check"
+	ClaimCheckURLHeader  = "x-broker-claim-check-url"
+	ClaimCheckSizeHeader = "x-broker-claim-check-size" // payload bytes
+)
+
+// IsClaimCheck reports whether the payload of a message with these headers is kept in
+// object storage
+func IsClaimCheck(headers map[string]string) bool {
+	return headers[ClaimCheckKeyHeader] != ""
+}
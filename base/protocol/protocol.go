@@ -0,0 +1,40 @@
+// Package protocol defines the broker wire protocol version and the optional
+// features clients and brokers negotiate with the Hello RPC
+package protocol
+
+// Version is the protocol version spoken by this release
+const Version uint32 = 1
+
+// MinVersion is the oldest protocol version a broker of this release accepts
+const MinVersion uint32 = 1
+
+// Optional features. A feature is only used when both sides announce it.
+const (
+	FeatureBatch     = "batch"      // SendBatch
+	FeatureManualAck = "manual-ack" // ReceiveWithAck, Ack and Nack
+	FeatureChecksum  = "checksum"   // Message.checksum verification
+	FeaturePause     = "pause"      // PauseDelivery and ResumeDelivery
+	FeatureReadOnly  = "read-only"  // SetReadOnly and READ_ONLY errors
+	FeatureKeepalive = "keepalive"  // KEEPALIVE events on Receive streams
+	FeatureInstances = "instances"  // messages addressed to "<service>@<instance>"
+	FeatureFetch     = "fetch"      // Fetch
+	FeatureWildcards = "wildcards"  // name patterns as Send recipients and Receive identities
+)
+
+// Features lists the features implemented by this release
+var Features = []string{FeatureBatch, FeatureManualAck, FeatureChecksum, FeaturePause, FeatureReadOnly, FeatureKeepalive, FeatureInstances, FeatureFetch, FeatureWildcards}
+
+// Negotiate returns the features present in both lists, in the order of ours
+func Negotiate(ours, theirs []string) []string {
+	offered := make(map[string]bool, len(theirs))
+	for _, f := range theirs {
+		offered[f] = true
+	}
+	var common []string
+	for _, f := range ours {
+		if offered[f] {
+			common = append(common, f)
+		}
+	}
+	return common
+}
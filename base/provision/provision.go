@@ -0,0 +1,60 @@
+// Package provision describes the services YAML written by `broker auth
+// provision-broker-yaml`: the API keys of services and how their clients reach the
+// broker.
+package provision
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Connection tells clients how to reach the broker
+type Connection struct {
+	Address string `yaml:"address"`
+	// AuthMethod is "apikey" (default) or "hmac"
+	AuthMethod string `yaml:"auth_method,omitempty"`
+	TLS        bool   `yaml:"tls,omitempty"`
+	// CAFile verifies the broker's certificate; the system roots when empty
+	CAFile string `yaml:"ca_file,omitempty"`
+	// ServerName overrides the name the broker's certificate is checked against
+	ServerName string `yaml:"server_name,omitempty"`
+}
+
+// File is a provisioned services YAML, e.g.
+//
+//	connection:
+//	  address: broker.internal:9000
+//	  tls: true
+//	services:
+//	  billing: 3f9a...
+type File struct {
+	Connection Connection        `yaml:"connection"`
+	Services   map[string]string `yaml:"services"` // service name -> API key
+}
+
+// Load reads a provisioned services YAML
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	var f File
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return &f, nil
+}
+
+// Service returns the API key of a service and the connection settings
+func (f *File) Service(name string) (Connection, string, error) {
+	key, ok := f.Services[name]
+	if !ok || key == "" {
+		return Connection{}, "", fmt.Errorf("service '%s' is not provisioned", name)
+	}
+	if f.Connection.Address == "" {
+		return Connection{}, "", fmt.Errorf("no broker address provisioned")
+	}
+	return f.Connection, key, nil
+}
@@ -0,0 +1,116 @@
+// Package shard splits service names between broker instances. Every shard owns a
+// range of the 32-bit hash space; a service, its instance addresses and its
+// dead-letter queue live on the shard owning the hash of the service name.
+package shard
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+)
+
+// deadLetterSuffix is appended to a service name to form its dead-letter queue
+const deadLetterSuffix = ".dlq"
+
+// Shard is one broker instance and the inclusive hash range it owns
+type Shard struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Start   uint32 `json:"start"`
+	End     uint32 `json:"end"`
+}
+
+// Map assigns service names to shards
+type Map struct {
+	shards []Shard // sorted by Start
+}
+
+// New returns the map of shards. When no shard has a range, the hash space is split
+// evenly in the given order; otherwise the ranges must cover it without gaps or overlaps.
+func New(shards []Shard) (*Map, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("no shards")
+	}
+	shards = append([]Shard(nil), shards...)
+	names := make(map[string]bool, len(shards))
+	ranged := false
+	for _, s := range shards {
+		if s.Name == "" || s.Address == "" {
+			return nil, errors.New("every shard needs a name and an address")
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("duplicate shard name %q", s.Name)
+		}
+		names[s.Name] = true
+		ranged = ranged || s.Start != 0 || s.End != 0
+	}
+	if !ranged {
+		split(shards)
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i].Start < shards[j].Start })
+	next := uint64(0)
+	for _, s := range shards {
+		if s.End < s.Start {
+			return nil, fmt.Errorf("shard %s: range end %d is below its start %d", s.Name, s.End, s.Start)
+		}
+		if uint64(s.Start) != next {
+			return nil, fmt.Errorf("shard %s: range starts at %d, expected %d", s.Name, s.Start, next)
+		}
+		next = uint64(s.End) + 1
+	}
+	if next != math.MaxUint32+1 {
+		return nil, fmt.Errorf("shard ranges end at %d instead of %d", next-1, uint32(math.MaxUint32))
+	}
+	return &Map{shards: shards}, nil
+}
+
+// split gives each shard an equal part of the hash space
+func split(shards []Shard) {
+	size := (uint64(math.MaxUint32) + 1) / uint64(len(shards))
+	for i := range shards {
+		shards[i].Start = uint32(uint64(i) * size)
+		shards[i].End = uint32(uint64(i+1)*size - 1)
+	}
+	shards[len(shards)-1].End = math.MaxUint32
+}
+
+// Key returns the name an address is routed by: the service name without the
+// instance id or dead-letter suffix
+func Key(address string) string {
+	service, _ := protocol.SplitAddress(address)
+	return strings.TrimSuffix(service, deadLetterSuffix)
+}
+
+// Hash returns the position of an address in the hash space
+func Hash(address string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(Key(address)))
+	return h.Sum32()
+}
+
+// Owner returns the shard owning an address
+func (m *Map) Owner(address string) Shard {
+	h := Hash(address)
+	i := sort.Search(len(m.shards), func(i int) bool { return m.shards[i].End >= h })
+	return m.shards[i]
+}
+
+// Shards returns the shards ordered by range
+func (m *Map) Shards() []Shard {
+	return append([]Shard(nil), m.shards...)
+}
+
+// Get returns the shard called name
+func (m *Map) Get(name string) (Shard, bool) {
+	for _, s := range m.shards {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return Shard{}, false
+}
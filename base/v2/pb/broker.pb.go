@@ -0,0 +1,2730 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.35.2
+// 	protoc        v3.14.0
+// source: v2/broker.proto
+
+// broker.v2 is the canonical broker API. Field and enum numbers match base.proto
+// (v1), so messages are wire compatible and both versions are served side by side.
+
+package pbv2
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	durationpb "google.golang.org/protobuf/types/known/durationpb"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+	reflect "reflect"
+	sync "sync"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// Type is the content type of Message.data.
+type Type int32
+
+const (
+	Type_TYPE_MP4   Type = 0
+	Type_TYPE_MP3   Type = 1
+	Type_TYPE_JPG   Type = 2
+	Type_TYPE_PNG   Type = 3
+	Type_TYPE_JSON  Type = 4
+	Type_TYPE_XML   Type = 5
+	Type_TYPE_HTML  Type = 6
+	Type_TYPE_TEXT  Type = 7
+	Type_TYPE_OTHER Type = 8
+)
+
+// Enum value maps for Type.
+var (
+	Type_name = map[int32]string{
+		0: "TYPE_MP4",
+		1: "TYPE_MP3",
+		2: "TYPE_JPG",
+		3: "TYPE_PNG",
+		4: "TYPE_JSON",
+		5: "TYPE_XML",
+		6: "TYPE_HTML",
+		7: "TYPE_TEXT",
+		8: "TYPE_OTHER",
+	}
+	Type_value = map[string]int32{
+		"TYPE_MP4":   0,
+		"TYPE_MP3":   1,
+		"TYPE_JPG":   2,
+		"TYPE_PNG":   3,
+		"TYPE_JSON":  4,
+		"TYPE_XML":   5,
+		"TYPE_HTML":  6,
+		"TYPE_TEXT":  7,
+		"TYPE_OTHER": 8,
+	}
+)
+
+func (x Type) Enum() *Type {
+	p := new(Type)
+	*p = x
+	return p
+}
+
+func (x Type) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Type) Descriptor() protoreflect.EnumDescriptor {
+	return file_v2_broker_proto_enumTypes[0].Descriptor()
+}
+
+func (Type) Type() protoreflect.EnumType {
+	return &file_v2_broker_proto_enumTypes[0]
+}
+
+func (x Type) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Type.Descriptor instead.
+func (Type) EnumDescriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{0}
+}
+
+// Event is the kind of a delivered message.
+type Event int32
+
+const (
+	Event_EVENT_STREAM    Event = 0
+	Event_EVENT_MESSAGE   Event = 1
+	Event_EVENT_ERROR     Event = 2
+	Event_EVENT_EXPIRED   Event = 3 // a queued message expired undelivered and was returned to its sender
+	Event_EVENT_KEEPALIVE Event = 4 // liveness probe of a Receive stream, carries no data; clients ignore it
+)
+
+// Enum value maps for Event.
+var (
+	Event_name = map[int32]string{
+		0: "EVENT_STREAM",
+		1: "EVENT_MESSAGE",
+		2: "EVENT_ERROR",
+		3: "EVENT_EXPIRED",
+		4: "EVENT_KEEPALIVE",
+	}
+	Event_value = map[string]int32{
+		"EVENT_STREAM":    0,
+		"EVENT_MESSAGE":   1,
+		"EVENT_ERROR":     2,
+		"EVENT_EXPIRED":   3,
+		"EVENT_KEEPALIVE": 4,
+	}
+)
+
+func (x Event) Enum() *Event {
+	p := new(Event)
+	*p = x
+	return p
+}
+
+func (x Event) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Event) Descriptor() protoreflect.EnumDescriptor {
+	return file_v2_broker_proto_enumTypes[1].Descriptor()
+}
+
+func (Event) Type() protoreflect.EnumType {
+	return &file_v2_broker_proto_enumTypes[1]
+}
+
+func (x Event) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Event.Descriptor instead.
+func (Event) EnumDescriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{1}
+}
+
+// ChecksumType selects the algorithm of Message.checksum.
+type ChecksumType int32
+
+const (
+	ChecksumType_CHECKSUM_TYPE_NONE   ChecksumType = 0
+	ChecksumType_CHECKSUM_TYPE_CRC32C ChecksumType = 1 // Castagnoli CRC-32, big endian
+	ChecksumType_CHECKSUM_TYPE_SHA256 ChecksumType = 2
+)
+
+// Enum value maps for ChecksumType.
+var (
+	ChecksumType_name = map[int32]string{
+		0: "CHECKSUM_TYPE_NONE",
+		1: "CHECKSUM_TYPE_CRC32C",
+		2: "CHECKSUM_TYPE_SHA256",
+	}
+	ChecksumType_value = map[string]int32{
+		"CHECKSUM_TYPE_NONE":   0,
+		"CHECKSUM_TYPE_CRC32C": 1,
+		"CHECKSUM_TYPE_SHA256": 2,
+	}
+)
+
+func (x ChecksumType) Enum() *ChecksumType {
+	p := new(ChecksumType)
+	*p = x
+	return p
+}
+
+func (x ChecksumType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ChecksumType) Descriptor() protoreflect.EnumDescriptor {
+	return file_v2_broker_proto_enumTypes[2].Descriptor()
+}
+
+func (ChecksumType) Type() protoreflect.EnumType {
+	return &file_v2_broker_proto_enumTypes[2]
+}
+
+func (x ChecksumType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ChecksumType.Descriptor instead.
+func (ChecksumType) EnumDescriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{2}
+}
+
+// Error is the broker error carried by Status.
+type Error int32
+
+const (
+	Error_ERROR_NONE              Error = 0
+	Error_ERROR_UNKNOWN           Error = 1
+	Error_ERROR_INVALID_REQUEST   Error = 2
+	Error_ERROR_SERVER_ERROR      Error = 3
+	Error_ERROR_RECIPIENT_OFFLINE Error = 4  // recipient not connected and the message was not queued
+	Error_ERROR_READ_ONLY         Error = 5  // the broker is in read-only mode and rejects sends
+	Error_ERROR_CHECKSUM_MISMATCH Error = 6  // the message data does not match its checksum
+	Error_ERROR_QUOTA_EXCEEDED    Error = 7  // the sending service used up its hourly or daily quota
+	Error_ERROR_PERMISSION_DENIED Error = 8  // the caller's credentials do not allow acting for the service it named
+	Error_ERROR_UNKNOWN_SERVICE   Error = 9  // the sender or a destination is not in the strict service registry
+	Error_ERROR_VALIDATION_FAILED Error = 10 // the message failed a validation rule of its recipient
+)
+
+// Enum value maps for Error.
+var (
+	Error_name = map[int32]string{
+		0:  "ERROR_NONE",
+		1:  "ERROR_UNKNOWN",
+		2:  "ERROR_INVALID_REQUEST",
+		3:  "ERROR_SERVER_ERROR",
+		4:  "ERROR_RECIPIENT_OFFLINE",
+		5:  "ERROR_READ_ONLY",
+		6:  "ERROR_CHECKSUM_MISMATCH",
+		7:  "ERROR_QUOTA_EXCEEDED",
+		8:  "ERROR_PERMISSION_DENIED",
+		9:  "ERROR_UNKNOWN_SERVICE",
+		10: "ERROR_VALIDATION_FAILED",
+	}
+	Error_value = map[string]int32{
+		"ERROR_NONE":              0,
+		"ERROR_UNKNOWN":           1,
+		"ERROR_INVALID_REQUEST":   2,
+		"ERROR_SERVER_ERROR":      3,
+		"ERROR_RECIPIENT_OFFLINE": 4,
+		"ERROR_READ_ONLY":         5,
+		"ERROR_CHECKSUM_MISMATCH": 6,
+		"ERROR_QUOTA_EXCEEDED":    7,
+		"ERROR_PERMISSION_DENIED": 8,
+		"ERROR_UNKNOWN_SERVICE":   9,
+		"ERROR_VALIDATION_FAILED": 10,
+	}
+)
+
+func (x Error) Enum() *Error {
+	p := new(Error)
+	*p = x
+	return p
+}
+
+func (x Error) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Error) Descriptor() protoreflect.EnumDescriptor {
+	return file_v2_broker_proto_enumTypes[3].Descriptor()
+}
+
+func (Error) Type() protoreflect.EnumType {
+	return &file_v2_broker_proto_enumTypes[3]
+}
+
+func (x Error) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Error.Descriptor instead.
+func (Error) EnumDescriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{3}
+}
+
+// BrokerEventType is the kind of a broker lifecycle event.
+type BrokerEventType int32
+
+const (
+	BrokerEventType_BROKER_EVENT_TYPE_UNSPECIFIED       BrokerEventType = 0
+	BrokerEventType_BROKER_EVENT_TYPE_ENQUEUED          BrokerEventType = 1 // a message was stored in a queue
+	BrokerEventType_BROKER_EVENT_TYPE_DELIVERED         BrokerEventType = 2 // a message was sent to a Receive stream
+	BrokerEventType_BROKER_EVENT_TYPE_ACKED             BrokerEventType = 3
+	BrokerEventType_BROKER_EVENT_TYPE_NACKED            BrokerEventType = 4
+	BrokerEventType_BROKER_EVENT_TYPE_EXPIRED           BrokerEventType = 5  // a queued message expired undelivered
+	BrokerEventType_BROKER_EVENT_TYPE_DEAD_LETTERED     BrokerEventType = 6  // a message ran out of attempts and moved to the dead-letter queue
+	BrokerEventType_BROKER_EVENT_TYPE_QUARANTINED       BrokerEventType = 7  // a corrupted or poison message was moved to quarantine
+	BrokerEventType_BROKER_EVENT_TYPE_CONNECTED         BrokerEventType = 8  // a Receive stream was opened
+	BrokerEventType_BROKER_EVENT_TYPE_DISCONNECTED      BrokerEventType = 9  // a Receive stream ended, was replaced or was reaped
+	BrokerEventType_BROKER_EVENT_TYPE_AUTH_FAILED       BrokerEventType = 10 // a call presented missing or invalid credentials
+	BrokerEventType_BROKER_EVENT_TYPE_AUTH_LOCKED_OUT   BrokerEventType = 11 // a client address or credential was locked out after repeated failures
+	BrokerEventType_BROKER_EVENT_TYPE_EGRESS_DENIED     BrokerEventType = 12 // a send to a destination the egress matrix does not allow its sender was refused
+	BrokerEventType_BROKER_EVENT_TYPE_UNKNOWN_SERVICE   BrokerEventType = 13 // a message from or to a service missing from the registry was refused or quarantined
+	BrokerEventType_BROKER_EVENT_TYPE_VALIDATION_FAILED BrokerEventType = 14 // a message failed a validation rule and was refused or annotated
+)
+
+// Enum value maps for BrokerEventType.
+var (
+	BrokerEventType_name = map[int32]string{
+		0:  "BROKER_EVENT_TYPE_UNSPECIFIED",
+		1:  "BROKER_EVENT_TYPE_ENQUEUED",
+		2:  "BROKER_EVENT_TYPE_DELIVERED",
+		3:  "BROKER_EVENT_TYPE_ACKED",
+		4:  "BROKER_EVENT_TYPE_NACKED",
+		5:  "BROKER_EVENT_TYPE_EXPIRED",
+		6:  "BROKER_EVENT_TYPE_DEAD_LETTERED",
+		7:  "BROKER_EVENT_TYPE_QUARANTINED",
+		8:  "BROKER_EVENT_TYPE_CONNECTED",
+		9:  "BROKER_EVENT_TYPE_DISCONNECTED",
+		10: "BROKER_EVENT_TYPE_AUTH_FAILED",
+		11: "BROKER_EVENT_TYPE_AUTH_LOCKED_OUT",
+		12: "BROKER_EVENT_TYPE_EGRESS_DENIED",
+		13: "BROKER_EVENT_TYPE_UNKNOWN_SERVICE",
+		14: "BROKER_EVENT_TYPE_VALIDATION_FAILED",
+	}
+	BrokerEventType_value = map[string]int32{
+		"BROKER_EVENT_TYPE_UNSPECIFIED":       0,
+		"BROKER_EVENT_TYPE_ENQUEUED":          1,
+		"BROKER_EVENT_TYPE_DELIVERED":         2,
+		"BROKER_EVENT_TYPE_ACKED":             3,
+		"BROKER_EVENT_TYPE_NACKED":            4,
+		"BROKER_EVENT_TYPE_EXPIRED":           5,
+		"BROKER_EVENT_TYPE_DEAD_LETTERED":     6,
+		"BROKER_EVENT_TYPE_QUARANTINED":       7,
+		"BROKER_EVENT_TYPE_CONNECTED":         8,
+		"BROKER_EVENT_TYPE_DISCONNECTED":      9,
+		"BROKER_EVENT_TYPE_AUTH_FAILED":       10,
+		"BROKER_EVENT_TYPE_AUTH_LOCKED_OUT":   11,
+		"BROKER_EVENT_TYPE_EGRESS_DENIED":     12,
+		"BROKER_EVENT_TYPE_UNKNOWN_SERVICE":   13,
+		"BROKER_EVENT_TYPE_VALIDATION_FAILED": 14,
+	}
+)
+
+func (x BrokerEventType) Enum() *BrokerEventType {
+	p := new(BrokerEventType)
+	*p = x
+	return p
+}
+
+func (x BrokerEventType) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (BrokerEventType) Descriptor() protoreflect.EnumDescriptor {
+	return file_v2_broker_proto_enumTypes[4].Descriptor()
+}
+
+func (BrokerEventType) Type() protoreflect.EnumType {
+	return &file_v2_broker_proto_enumTypes[4]
+}
+
+func (x BrokerEventType) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use BrokerEventType.Descriptor instead.
+func (BrokerEventType) EnumDescriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{4}
+}
+
+// Identity names the calling service.
+type Identity struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	From      string `protobuf:"bytes,1,opt,name=from,proto3" json:"from,omitempty"`
+	ManualAck bool   `protobuf:"varint,2,opt,name=manual_ack,json=manualAck,proto3" json:"manual_ack,omitempty"` // Receive only: keep messages until acknowledged with Ack/Nack
+	Instance  string `protobuf:"bytes,3,opt,name=instance,proto3" json:"instance,omitempty"`                     // Receive only: instance id, receives messages sent to "<from>@<instance>"
+}
+
+func (x *Identity) Reset() {
+	*x = Identity{}
+	mi := &file_v2_broker_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Identity) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Identity) ProtoMessage() {}
+
+func (x *Identity) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Identity.ProtoReflect.Descriptor instead.
+func (*Identity) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *Identity) GetFrom() string {
+	if x != nil {
+		return x.From
+	}
+	return ""
+}
+
+func (x *Identity) GetManualAck() bool {
+	if x != nil {
+		return x.ManualAck
+	}
+	return false
+}
+
+func (x *Identity) GetInstance() string {
+	if x != nil {
+		return x.Instance
+	}
+	return ""
+}
+
+// Message is a payload routed from one service to another.
+type Message struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Data         []byte                 `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	Type         Type                   `protobuf:"varint,2,opt,name=type,proto3,enum=broker.v2.Type" json:"type,omitempty"`
+	Seq          *timestamppb.Timestamp `protobuf:"bytes,5,opt,name=seq,proto3" json:"seq,omitempty"`
+	From         string                 `protobuf:"bytes,6,opt,name=from,proto3" json:"from,omitempty"`
+	To           string                 `protobuf:"bytes,7,opt,name=to,proto3" json:"to,omitempty"`
+	Event        Event                  `protobuf:"varint,8,opt,name=event,proto3,enum=broker.v2.Event" json:"event,omitempty"`
+	Queue        bool                   `protobuf:"varint,9,opt,name=queue,proto3" json:"queue,omitempty"`        // store the message when the recipient is offline
+	Id           string                 `protobuf:"bytes,10,opt,name=id,proto3" json:"id,omitempty"`              // set on delivery, used to Ack/Nack queued messages
+	Attempts     uint32                 `protobuf:"varint,11,opt,name=attempts,proto3" json:"attempts,omitempty"` // delivery attempts so far, including this one
+	Checksum     []byte                 `protobuf:"bytes,12,opt,name=checksum,proto3" json:"checksum,omitempty"`  // checksum of data, computed by the sender
+	ChecksumType ChecksumType           `protobuf:"varint,13,opt,name=checksum_type,json=checksumType,proto3,enum=broker.v2.ChecksumType" json:"checksum_type,omitempty"`
+	Headers      map[string]string      `protobuf:"bytes,14,rep,name=headers,proto3" json:"headers,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"` // application metadata, carried unchanged
+	TraceId      string                 `protobuf:"bytes,15,opt,name=trace_id,json=traceId,proto3" json:"trace_id,omitempty"`                                                                          // set at ingress unless the sender chose one, appears in broker logs
+	Via          []string               `protobuf:"bytes,16,rep,name=via,proto3" json:"via,omitempty"`                                                                                                 // federated brokers the message passed through, for loop prevention
+	PartitionKey string                 `protobuf:"bytes,17,opt,name=partition_key,json=partitionKey,proto3" json:"partition_key,omitempty"`                                                           // messages with the same key are delivered in order, to a single instance of the recipient
+	RoutingSlip  []string               `protobuf:"bytes,18,rep,name=routing_slip,json=routingSlip,proto3" json:"routing_slip,omitempty"`                                                              // services the message visits after its recipient, in order: each ack forwards it to the next
+	Mirrored     bool                   `protobuf:"varint,19,opt,name=mirrored,proto3" json:"mirrored,omitempty"`                                                                                      // a shadow copy made by a mirror rule: it does not count against quotas, report expiry or follow a routing slip
+	Chunk        uint32                 `protobuf:"varint,20,opt,name=chunk,proto3" json:"chunk,omitempty"`                                                                                            // set on the parts of a message too large for one frame: index of the part, from 1
+	Done         bool                   `protobuf:"varint,21,opt,name=done,proto3" json:"done,omitempty"`                                                                                              // set on the last part of a chunked message
+}
+
+func (x *Message) Reset() {
+	*x = Message{}
+	mi := &file_v2_broker_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Message) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Message) ProtoMessage() {}
+
+func (x *Message) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Message.ProtoReflect.Descriptor instead.
+func (*Message) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Message) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+func (x *Message) GetType() Type {
+	if x != nil {
+		return x.Type
+	}
+	return Type_TYPE_MP4
+}
+
+func (x *Message) GetSeq() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Seq
+	}
+	return nil
+}
+
+func (x *Message) GetFrom() string {
+	if x != nil {
+		return x.From
+	}
+	return ""
+}
+
+func (x *Message) GetTo() string {
+	if x != nil {
+		return x.To
+	}
+	return ""
+}
+
+func (x *Message) GetEvent() Event {
+	if x != nil {
+		return x.Event
+	}
+	return Event_EVENT_STREAM
+}
+
+func (x *Message) GetQueue() bool {
+	if x != nil {
+		return x.Queue
+	}
+	return false
+}
+
+func (x *Message) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *Message) GetAttempts() uint32 {
+	if x != nil {
+		return x.Attempts
+	}
+	return 0
+}
+
+func (x *Message) GetChecksum() []byte {
+	if x != nil {
+		return x.Checksum
+	}
+	return nil
+}
+
+func (x *Message) GetChecksumType() ChecksumType {
+	if x != nil {
+		return x.ChecksumType
+	}
+	return ChecksumType_CHECKSUM_TYPE_NONE
+}
+
+func (x *Message) GetHeaders() map[string]string {
+	if x != nil {
+		return x.Headers
+	}
+	return nil
+}
+
+func (x *Message) GetTraceId() string {
+	if x != nil {
+		return x.TraceId
+	}
+	return ""
+}
+
+func (x *Message) GetVia() []string {
+	if x != nil {
+		return x.Via
+	}
+	return nil
+}
+
+func (x *Message) GetPartitionKey() string {
+	if x != nil {
+		return x.PartitionKey
+	}
+	return ""
+}
+
+func (x *Message) GetRoutingSlip() []string {
+	if x != nil {
+		return x.RoutingSlip
+	}
+	return nil
+}
+
+func (x *Message) GetMirrored() bool {
+	if x != nil {
+		return x.Mirrored
+	}
+	return false
+}
+
+func (x *Message) GetChunk() uint32 {
+	if x != nil {
+		return x.Chunk
+	}
+	return 0
+}
+
+func (x *Message) GetDone() bool {
+	if x != nil {
+		return x.Done
+	}
+	return false
+}
+
+// Status is the result of an operation.
+type Status struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Message string `protobuf:"bytes,1,opt,name=message,proto3" json:"message,omitempty"`
+	Success bool   `protobuf:"varint,2,opt,name=success,proto3" json:"success,omitempty"`
+	Error   Error  `protobuf:"varint,3,opt,name=error,proto3,enum=broker.v2.Error" json:"error,omitempty"`
+	TraceId string `protobuf:"bytes,4,opt,name=trace_id,json=traceId,proto3" json:"trace_id,omitempty"` // trace id of the message the call was about
+}
+
+func (x *Status) Reset() {
+	*x = Status{}
+	mi := &file_v2_broker_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Status) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Status) ProtoMessage() {}
+
+func (x *Status) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Status.ProtoReflect.Descriptor instead.
+func (*Status) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *Status) GetMessage() string {
+	if x != nil {
+		return x.Message
+	}
+	return ""
+}
+
+func (x *Status) GetSuccess() bool {
+	if x != nil {
+		return x.Success
+	}
+	return false
+}
+
+func (x *Status) GetError() Error {
+	if x != nil {
+		return x.Error
+	}
+	return Error_ERROR_NONE
+}
+
+func (x *Status) GetTraceId() string {
+	if x != nil {
+		return x.TraceId
+	}
+	return ""
+}
+
+// Batch groups several messages sent in a single call.
+type Batch struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Messages []*Message `protobuf:"bytes,1,rep,name=messages,proto3" json:"messages,omitempty"`
+}
+
+func (x *Batch) Reset() {
+	*x = Batch{}
+	mi := &file_v2_broker_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Batch) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Batch) ProtoMessage() {}
+
+func (x *Batch) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Batch.ProtoReflect.Descriptor instead.
+func (*Batch) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *Batch) GetMessages() []*Message {
+	if x != nil {
+		return x.Messages
+	}
+	return nil
+}
+
+// AckRequest acknowledges a message delivered in manual-ack mode.
+type AckRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	From string `protobuf:"bytes,1,opt,name=from,proto3" json:"from,omitempty"`
+	Id   string `protobuf:"bytes,2,opt,name=id,proto3" json:"id,omitempty"`
+}
+
+func (x *AckRequest) Reset() {
+	*x = AckRequest{}
+	mi := &file_v2_broker_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AckRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AckRequest) ProtoMessage() {}
+
+func (x *AckRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AckRequest.ProtoReflect.Descriptor instead.
+func (*AckRequest) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *AckRequest) GetFrom() string {
+	if x != nil {
+		return x.From
+	}
+	return ""
+}
+
+func (x *AckRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+// NackRequest rejects a message delivered in manual-ack mode.
+type NackRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	From         string               `protobuf:"bytes,1,opt,name=from,proto3" json:"from,omitempty"`
+	Id           string               `protobuf:"bytes,2,opt,name=id,proto3" json:"id,omitempty"`
+	RequeueDelay *durationpb.Duration `protobuf:"bytes,3,opt,name=requeue_delay,json=requeueDelay,proto3" json:"requeue_delay,omitempty"` // how long the message stays invisible
+}
+
+func (x *NackRequest) Reset() {
+	*x = NackRequest{}
+	mi := &file_v2_broker_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *NackRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*NackRequest) ProtoMessage() {}
+
+func (x *NackRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use NackRequest.ProtoReflect.Descriptor instead.
+func (*NackRequest) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *NackRequest) GetFrom() string {
+	if x != nil {
+		return x.From
+	}
+	return ""
+}
+
+func (x *NackRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *NackRequest) GetRequeueDelay() *durationpb.Duration {
+	if x != nil {
+		return x.RequeueDelay
+	}
+	return nil
+}
+
+// ReadOnlyRequest switches the broker's read-only mode.
+type ReadOnlyRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Enabled bool `protobuf:"varint,1,opt,name=enabled,proto3" json:"enabled,omitempty"`
+}
+
+func (x *ReadOnlyRequest) Reset() {
+	*x = ReadOnlyRequest{}
+	mi := &file_v2_broker_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ReadOnlyRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReadOnlyRequest) ProtoMessage() {}
+
+func (x *ReadOnlyRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReadOnlyRequest.ProtoReflect.Descriptor instead.
+func (*ReadOnlyRequest) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *ReadOnlyRequest) GetEnabled() bool {
+	if x != nil {
+		return x.Enabled
+	}
+	return false
+}
+
+// HelloRequest announces the client's protocol version and the features it supports.
+type HelloRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	From            string   `protobuf:"bytes,1,opt,name=from,proto3" json:"from,omitempty"`
+	ProtocolVersion uint32   `protobuf:"varint,2,opt,name=protocol_version,json=protocolVersion,proto3" json:"protocol_version,omitempty"`
+	Features        []string `protobuf:"bytes,3,rep,name=features,proto3" json:"features,omitempty"`
+}
+
+func (x *HelloRequest) Reset() {
+	*x = HelloRequest{}
+	mi := &file_v2_broker_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HelloRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HelloRequest) ProtoMessage() {}
+
+func (x *HelloRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HelloRequest.ProtoReflect.Descriptor instead.
+func (*HelloRequest) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *HelloRequest) GetFrom() string {
+	if x != nil {
+		return x.From
+	}
+	return ""
+}
+
+func (x *HelloRequest) GetProtocolVersion() uint32 {
+	if x != nil {
+		return x.ProtocolVersion
+	}
+	return 0
+}
+
+func (x *HelloRequest) GetFeatures() []string {
+	if x != nil {
+		return x.Features
+	}
+	return nil
+}
+
+// HelloResponse carries the negotiated protocol version and the features both sides support.
+type HelloResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	ProtocolVersion    uint32   `protobuf:"varint,1,opt,name=protocol_version,json=protocolVersion,proto3" json:"protocol_version,omitempty"`
+	MinProtocolVersion uint32   `protobuf:"varint,2,opt,name=min_protocol_version,json=minProtocolVersion,proto3" json:"min_protocol_version,omitempty"` // oldest protocol version the broker still accepts
+	Features           []string `protobuf:"bytes,3,rep,name=features,proto3" json:"features,omitempty"`
+}
+
+func (x *HelloResponse) Reset() {
+	*x = HelloResponse{}
+	mi := &file_v2_broker_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *HelloResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*HelloResponse) ProtoMessage() {}
+
+func (x *HelloResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use HelloResponse.ProtoReflect.Descriptor instead.
+func (*HelloResponse) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *HelloResponse) GetProtocolVersion() uint32 {
+	if x != nil {
+		return x.ProtocolVersion
+	}
+	return 0
+}
+
+func (x *HelloResponse) GetMinProtocolVersion() uint32 {
+	if x != nil {
+		return x.MinProtocolVersion
+	}
+	return 0
+}
+
+func (x *HelloResponse) GetFeatures() []string {
+	if x != nil {
+		return x.Features
+	}
+	return nil
+}
+
+// BrokerEvent is a broker lifecycle event streamed by WatchEvents.
+type BrokerEvent struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Type      BrokerEventType        `protobuf:"varint,1,opt,name=type,proto3,enum=broker.v2.BrokerEventType" json:"type,omitempty"`
+	Time      *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=time,proto3" json:"time,omitempty"`
+	Service   string                 `protobuf:"bytes,3,opt,name=service,proto3" json:"service,omitempty"`                      // queue or consumer the event is about
+	MessageId string                 `protobuf:"bytes,4,opt,name=message_id,json=messageId,proto3" json:"message_id,omitempty"` // queue key of the message, empty for live deliveries
+	TraceId   string                 `protobuf:"bytes,5,opt,name=trace_id,json=traceId,proto3" json:"trace_id,omitempty"`
+	From      string                 `protobuf:"bytes,6,opt,name=from,proto3" json:"from,omitempty"`
+	To        string                 `protobuf:"bytes,7,opt,name=to,proto3" json:"to,omitempty"`
+	Attempts  uint32                 `protobuf:"varint,8,opt,name=attempts,proto3" json:"attempts,omitempty"`
+	Detail    string                 `protobuf:"bytes,9,opt,name=detail,proto3" json:"detail,omitempty"` // human readable context, e.g. why a stream was disconnected
+}
+
+func (x *BrokerEvent) Reset() {
+	*x = BrokerEvent{}
+	mi := &file_v2_broker_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BrokerEvent) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BrokerEvent) ProtoMessage() {}
+
+func (x *BrokerEvent) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BrokerEvent.ProtoReflect.Descriptor instead.
+func (*BrokerEvent) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *BrokerEvent) GetType() BrokerEventType {
+	if x != nil {
+		return x.Type
+	}
+	return BrokerEventType_BROKER_EVENT_TYPE_UNSPECIFIED
+}
+
+func (x *BrokerEvent) GetTime() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Time
+	}
+	return nil
+}
+
+func (x *BrokerEvent) GetService() string {
+	if x != nil {
+		return x.Service
+	}
+	return ""
+}
+
+func (x *BrokerEvent) GetMessageId() string {
+	if x != nil {
+		return x.MessageId
+	}
+	return ""
+}
+
+func (x *BrokerEvent) GetTraceId() string {
+	if x != nil {
+		return x.TraceId
+	}
+	return ""
+}
+
+func (x *BrokerEvent) GetFrom() string {
+	if x != nil {
+		return x.From
+	}
+	return ""
+}
+
+func (x *BrokerEvent) GetTo() string {
+	if x != nil {
+		return x.To
+	}
+	return ""
+}
+
+func (x *BrokerEvent) GetAttempts() uint32 {
+	if x != nil {
+		return x.Attempts
+	}
+	return 0
+}
+
+func (x *BrokerEvent) GetDetail() string {
+	if x != nil {
+		return x.Detail
+	}
+	return ""
+}
+
+// WatchEventsRequest filters the events streamed by WatchEvents; empty lists match everything.
+type WatchEventsRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Services []string          `protobuf:"bytes,1,rep,name=services,proto3" json:"services,omitempty"`
+	Types    []BrokerEventType `protobuf:"varint,2,rep,packed,name=types,proto3,enum=broker.v2.BrokerEventType" json:"types,omitempty"`
+}
+
+func (x *WatchEventsRequest) Reset() {
+	*x = WatchEventsRequest{}
+	mi := &file_v2_broker_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *WatchEventsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*WatchEventsRequest) ProtoMessage() {}
+
+func (x *WatchEventsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use WatchEventsRequest.ProtoReflect.Descriptor instead.
+func (*WatchEventsRequest) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *WatchEventsRequest) GetServices() []string {
+	if x != nil {
+		return x.Services
+	}
+	return nil
+}
+
+func (x *WatchEventsRequest) GetTypes() []BrokerEventType {
+	if x != nil {
+		return x.Types
+	}
+	return nil
+}
+
+// QuotaLimits caps a service's traffic per hour and per day; 0 means unlimited.
+type QuotaLimits struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	HourlyMessages int64 `protobuf:"varint,1,opt,name=hourly_messages,json=hourlyMessages,proto3" json:"hourly_messages,omitempty"`
+	HourlyBytes    int64 `protobuf:"varint,2,opt,name=hourly_bytes,json=hourlyBytes,proto3" json:"hourly_bytes,omitempty"`
+	DailyMessages  int64 `protobuf:"varint,3,opt,name=daily_messages,json=dailyMessages,proto3" json:"daily_messages,omitempty"`
+	DailyBytes     int64 `protobuf:"varint,4,opt,name=daily_bytes,json=dailyBytes,proto3" json:"daily_bytes,omitempty"`
+}
+
+func (x *QuotaLimits) Reset() {
+	*x = QuotaLimits{}
+	mi := &file_v2_broker_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *QuotaLimits) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*QuotaLimits) ProtoMessage() {}
+
+func (x *QuotaLimits) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use QuotaLimits.ProtoReflect.Descriptor instead.
+func (*QuotaLimits) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *QuotaLimits) GetHourlyMessages() int64 {
+	if x != nil {
+		return x.HourlyMessages
+	}
+	return 0
+}
+
+func (x *QuotaLimits) GetHourlyBytes() int64 {
+	if x != nil {
+		return x.HourlyBytes
+	}
+	return 0
+}
+
+func (x *QuotaLimits) GetDailyMessages() int64 {
+	if x != nil {
+		return x.DailyMessages
+	}
+	return 0
+}
+
+func (x *QuotaLimits) GetDailyBytes() int64 {
+	if x != nil {
+		return x.DailyBytes
+	}
+	return 0
+}
+
+// QuotaUsage is the traffic a service sent in the current hour and day.
+type QuotaUsage struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Service      string                 `protobuf:"bytes,1,opt,name=service,proto3" json:"service,omitempty"`
+	HourMessages int64                  `protobuf:"varint,2,opt,name=hour_messages,json=hourMessages,proto3" json:"hour_messages,omitempty"`
+	HourBytes    int64                  `protobuf:"varint,3,opt,name=hour_bytes,json=hourBytes,proto3" json:"hour_bytes,omitempty"`
+	DayMessages  int64                  `protobuf:"varint,4,opt,name=day_messages,json=dayMessages,proto3" json:"day_messages,omitempty"`
+	DayBytes     int64                  `protobuf:"varint,5,opt,name=day_bytes,json=dayBytes,proto3" json:"day_bytes,omitempty"`
+	Limits       *QuotaLimits           `protobuf:"bytes,6,opt,name=limits,proto3" json:"limits,omitempty"`
+	HourReset    *timestamppb.Timestamp `protobuf:"bytes,7,opt,name=hour_reset,json=hourReset,proto3" json:"hour_reset,omitempty"` // when the hourly counters start over
+	DayReset     *timestamppb.Timestamp `protobuf:"bytes,8,opt,name=day_reset,json=dayReset,proto3" json:"day_reset,omitempty"`    // when the daily counters start over
+}
+
+func (x *QuotaUsage) Reset() {
+	*x = QuotaUsage{}
+	mi := &file_v2_broker_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *QuotaUsage) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*QuotaUsage) ProtoMessage() {}
+
+func (x *QuotaUsage) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use QuotaUsage.ProtoReflect.Descriptor instead.
+func (*QuotaUsage) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *QuotaUsage) GetService() string {
+	if x != nil {
+		return x.Service
+	}
+	return ""
+}
+
+func (x *QuotaUsage) GetHourMessages() int64 {
+	if x != nil {
+		return x.HourMessages
+	}
+	return 0
+}
+
+func (x *QuotaUsage) GetHourBytes() int64 {
+	if x != nil {
+		return x.HourBytes
+	}
+	return 0
+}
+
+func (x *QuotaUsage) GetDayMessages() int64 {
+	if x != nil {
+		return x.DayMessages
+	}
+	return 0
+}
+
+func (x *QuotaUsage) GetDayBytes() int64 {
+	if x != nil {
+		return x.DayBytes
+	}
+	return 0
+}
+
+func (x *QuotaUsage) GetLimits() *QuotaLimits {
+	if x != nil {
+		return x.Limits
+	}
+	return nil
+}
+
+func (x *QuotaUsage) GetHourReset() *timestamppb.Timestamp {
+	if x != nil {
+		return x.HourReset
+	}
+	return nil
+}
+
+func (x *QuotaUsage) GetDayReset() *timestamppb.Timestamp {
+	if x != nil {
+		return x.DayReset
+	}
+	return nil
+}
+
+// QuotaUsageRequest selects the services to report; empty reports every service with usage or a quota.
+type QuotaUsageRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Services []string `protobuf:"bytes,1,rep,name=services,proto3" json:"services,omitempty"`
+}
+
+func (x *QuotaUsageRequest) Reset() {
+	*x = QuotaUsageRequest{}
+	mi := &file_v2_broker_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *QuotaUsageRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*QuotaUsageRequest) ProtoMessage() {}
+
+func (x *QuotaUsageRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use QuotaUsageRequest.ProtoReflect.Descriptor instead.
+func (*QuotaUsageRequest) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *QuotaUsageRequest) GetServices() []string {
+	if x != nil {
+		return x.Services
+	}
+	return nil
+}
+
+type QuotaUsageResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Usage []*QuotaUsage `protobuf:"bytes,1,rep,name=usage,proto3" json:"usage,omitempty"`
+}
+
+func (x *QuotaUsageResponse) Reset() {
+	*x = QuotaUsageResponse{}
+	mi := &file_v2_broker_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *QuotaUsageResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*QuotaUsageResponse) ProtoMessage() {}
+
+func (x *QuotaUsageResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use QuotaUsageResponse.ProtoReflect.Descriptor instead.
+func (*QuotaUsageResponse) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{14}
+}
+
+func (x *QuotaUsageResponse) GetUsage() []*QuotaUsage {
+	if x != nil {
+		return x.Usage
+	}
+	return nil
+}
+
+// TapRequest selects the messages mirrored by Tap.
+type TapRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Service    string  `protobuf:"bytes,1,opt,name=service,proto3" json:"service,omitempty"`                           // destination service, including its instances
+	SampleRate float64 `protobuf:"fixed64,2,opt,name=sample_rate,json=sampleRate,proto3" json:"sample_rate,omitempty"` // fraction of the messages mirrored, above 0 and at most 1
+}
+
+func (x *TapRequest) Reset() {
+	*x = TapRequest{}
+	mi := &file_v2_broker_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *TapRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*TapRequest) ProtoMessage() {}
+
+func (x *TapRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use TapRequest.ProtoReflect.Descriptor instead.
+func (*TapRequest) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *TapRequest) GetService() string {
+	if x != nil {
+		return x.Service
+	}
+	return ""
+}
+
+func (x *TapRequest) GetSampleRate() float64 {
+	if x != nil {
+		return x.SampleRate
+	}
+	return 0
+}
+
+// FederationAck reports what the receiving broker did with a federated message.
+type FederationAck struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id     string  `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"` // id of the forwarded message
+	Status *Status `protobuf:"bytes,2,opt,name=status,proto3" json:"status,omitempty"`
+}
+
+func (x *FederationAck) Reset() {
+	*x = FederationAck{}
+	mi := &file_v2_broker_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FederationAck) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FederationAck) ProtoMessage() {}
+
+func (x *FederationAck) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FederationAck.ProtoReflect.Descriptor instead.
+func (*FederationAck) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *FederationAck) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *FederationAck) GetStatus() *Status {
+	if x != nil {
+		return x.Status
+	}
+	return nil
+}
+
+// FetchRequest pulls queued messages without a Receive stream. Fetched messages stay
+// invisible for visibility_timeout and are redelivered unless acknowledged with Ack.
+type FetchRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	From              string               `protobuf:"bytes,1,opt,name=from,proto3" json:"from,omitempty"`
+	MaxMessages       uint32               `protobuf:"varint,2,opt,name=max_messages,json=maxMessages,proto3" json:"max_messages,omitempty"`                  // 0 = the service's delivery batch size
+	VisibilityTimeout *durationpb.Duration `protobuf:"bytes,3,opt,name=visibility_timeout,json=visibilityTimeout,proto3" json:"visibility_timeout,omitempty"` // 0 = the broker's ack timeout
+	Instance          string               `protobuf:"bytes,4,opt,name=instance,proto3" json:"instance,omitempty"`                                            // also fetch messages sent to "<from>@<instance>"
+	WaitSeconds       uint32               `protobuf:"varint,5,opt,name=wait_seconds,json=waitSeconds,proto3" json:"wait_seconds,omitempty"`                  // long polling: hold an empty fetch up to this long (at most 20) until a message arrives
+}
+
+func (x *FetchRequest) Reset() {
+	*x = FetchRequest{}
+	mi := &file_v2_broker_proto_msgTypes[17]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FetchRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FetchRequest) ProtoMessage() {}
+
+func (x *FetchRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[17]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FetchRequest.ProtoReflect.Descriptor instead.
+func (*FetchRequest) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *FetchRequest) GetFrom() string {
+	if x != nil {
+		return x.From
+	}
+	return ""
+}
+
+func (x *FetchRequest) GetMaxMessages() uint32 {
+	if x != nil {
+		return x.MaxMessages
+	}
+	return 0
+}
+
+func (x *FetchRequest) GetVisibilityTimeout() *durationpb.Duration {
+	if x != nil {
+		return x.VisibilityTimeout
+	}
+	return nil
+}
+
+func (x *FetchRequest) GetInstance() string {
+	if x != nil {
+		return x.Instance
+	}
+	return ""
+}
+
+func (x *FetchRequest) GetWaitSeconds() uint32 {
+	if x != nil {
+		return x.WaitSeconds
+	}
+	return 0
+}
+
+type FetchResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Messages []*Message `protobuf:"bytes,1,rep,name=messages,proto3" json:"messages,omitempty"`
+}
+
+func (x *FetchResponse) Reset() {
+	*x = FetchResponse{}
+	mi := &file_v2_broker_proto_msgTypes[18]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FetchResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FetchResponse) ProtoMessage() {}
+
+func (x *FetchResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[18]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FetchResponse.ProtoReflect.Descriptor instead.
+func (*FetchResponse) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{18}
+}
+
+func (x *FetchResponse) GetMessages() []*Message {
+	if x != nil {
+		return x.Messages
+	}
+	return nil
+}
+
+// ExtendVisibilityRequest keeps a message delivered in manual-ack mode or fetched invisible
+// for duration from now, for consumers whose processing outlasts the visibility timeout.
+type ExtendVisibilityRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	From     string               `protobuf:"bytes,1,opt,name=from,proto3" json:"from,omitempty"`
+	Id       string               `protobuf:"bytes,2,opt,name=id,proto3" json:"id,omitempty"`
+	Duration *durationpb.Duration `protobuf:"bytes,3,opt,name=duration,proto3" json:"duration,omitempty"`
+}
+
+func (x *ExtendVisibilityRequest) Reset() {
+	*x = ExtendVisibilityRequest{}
+	mi := &file_v2_broker_proto_msgTypes[19]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ExtendVisibilityRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ExtendVisibilityRequest) ProtoMessage() {}
+
+func (x *ExtendVisibilityRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[19]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ExtendVisibilityRequest.ProtoReflect.Descriptor instead.
+func (*ExtendVisibilityRequest) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{19}
+}
+
+func (x *ExtendVisibilityRequest) GetFrom() string {
+	if x != nil {
+		return x.From
+	}
+	return ""
+}
+
+func (x *ExtendVisibilityRequest) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *ExtendVisibilityRequest) GetDuration() *durationpb.Duration {
+	if x != nil {
+		return x.Duration
+	}
+	return nil
+}
+
+// ExtendVisibilityResponse carries the message's new id, which replaces the old one for Ack and Nack.
+type ExtendVisibilityResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Id        string                 `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	VisibleAt *timestamppb.Timestamp `protobuf:"bytes,2,opt,name=visible_at,json=visibleAt,proto3" json:"visible_at,omitempty"`
+}
+
+func (x *ExtendVisibilityResponse) Reset() {
+	*x = ExtendVisibilityResponse{}
+	mi := &file_v2_broker_proto_msgTypes[20]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ExtendVisibilityResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ExtendVisibilityResponse) ProtoMessage() {}
+
+func (x *ExtendVisibilityResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[20]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ExtendVisibilityResponse.ProtoReflect.Descriptor instead.
+func (*ExtendVisibilityResponse) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{20}
+}
+
+func (x *ExtendVisibilityResponse) GetId() string {
+	if x != nil {
+		return x.Id
+	}
+	return ""
+}
+
+func (x *ExtendVisibilityResponse) GetVisibleAt() *timestamppb.Timestamp {
+	if x != nil {
+		return x.VisibleAt
+	}
+	return nil
+}
+
+// LogLevelRequest sets the verbosity of the broker log: "debug", "info" or "warn".
+type LogLevelRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Level string `protobuf:"bytes,1,opt,name=level,proto3" json:"level,omitempty"`
+}
+
+func (x *LogLevelRequest) Reset() {
+	*x = LogLevelRequest{}
+	mi := &file_v2_broker_proto_msgTypes[21]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LogLevelRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LogLevelRequest) ProtoMessage() {}
+
+func (x *LogLevelRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[21]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LogLevelRequest.ProtoReflect.Descriptor instead.
+func (*LogLevelRequest) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{21}
+}
+
+func (x *LogLevelRequest) GetLevel() string {
+	if x != nil {
+		return x.Level
+	}
+	return ""
+}
+
+// PayloadLoggingRequest logs the payloads of the messages a service sends or is sent
+// for duration; a zero duration stops it.
+type PayloadLoggingRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Service  string               `protobuf:"bytes,1,opt,name=service,proto3" json:"service,omitempty"`
+	Duration *durationpb.Duration `protobuf:"bytes,2,opt,name=duration,proto3" json:"duration,omitempty"`
+}
+
+func (x *PayloadLoggingRequest) Reset() {
+	*x = PayloadLoggingRequest{}
+	mi := &file_v2_broker_proto_msgTypes[22]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PayloadLoggingRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PayloadLoggingRequest) ProtoMessage() {}
+
+func (x *PayloadLoggingRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[22]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PayloadLoggingRequest.ProtoReflect.Descriptor instead.
+func (*PayloadLoggingRequest) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{22}
+}
+
+func (x *PayloadLoggingRequest) GetService() string {
+	if x != nil {
+		return x.Service
+	}
+	return ""
+}
+
+func (x *PayloadLoggingRequest) GetDuration() *durationpb.Duration {
+	if x != nil {
+		return x.Duration
+	}
+	return nil
+}
+
+// SlowLoggingRequest logs calls slower than threshold; a zero threshold stops it.
+type SlowLoggingRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Threshold *durationpb.Duration `protobuf:"bytes,1,opt,name=threshold,proto3" json:"threshold,omitempty"`
+}
+
+func (x *SlowLoggingRequest) Reset() {
+	*x = SlowLoggingRequest{}
+	mi := &file_v2_broker_proto_msgTypes[23]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SlowLoggingRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SlowLoggingRequest) ProtoMessage() {}
+
+func (x *SlowLoggingRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[23]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SlowLoggingRequest.ProtoReflect.Descriptor instead.
+func (*SlowLoggingRequest) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{23}
+}
+
+func (x *SlowLoggingRequest) GetThreshold() *durationpb.Duration {
+	if x != nil {
+		return x.Threshold
+	}
+	return nil
+}
+
+// LatencyStats summarizes a latency histogram. Quantiles are estimated from its buckets.
+type LatencyStats struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Count int64                `protobuf:"varint,1,opt,name=count,proto3" json:"count,omitempty"`
+	Sum   *durationpb.Duration `protobuf:"bytes,2,opt,name=sum,proto3" json:"sum,omitempty"`
+	P50   *durationpb.Duration `protobuf:"bytes,3,opt,name=p50,proto3" json:"p50,omitempty"`
+	P90   *durationpb.Duration `protobuf:"bytes,4,opt,name=p90,proto3" json:"p90,omitempty"`
+	P99   *durationpb.Duration `protobuf:"bytes,5,opt,name=p99,proto3" json:"p99,omitempty"`
+}
+
+func (x *LatencyStats) Reset() {
+	*x = LatencyStats{}
+	mi := &file_v2_broker_proto_msgTypes[24]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *LatencyStats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*LatencyStats) ProtoMessage() {}
+
+func (x *LatencyStats) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[24]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use LatencyStats.ProtoReflect.Descriptor instead.
+func (*LatencyStats) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{24}
+}
+
+func (x *LatencyStats) GetCount() int64 {
+	if x != nil {
+		return x.Count
+	}
+	return 0
+}
+
+func (x *LatencyStats) GetSum() *durationpb.Duration {
+	if x != nil {
+		return x.Sum
+	}
+	return nil
+}
+
+func (x *LatencyStats) GetP50() *durationpb.Duration {
+	if x != nil {
+		return x.P50
+	}
+	return nil
+}
+
+func (x *LatencyStats) GetP90() *durationpb.Duration {
+	if x != nil {
+		return x.P90
+	}
+	return nil
+}
+
+func (x *LatencyStats) GetP99() *durationpb.Duration {
+	if x != nil {
+		return x.P99
+	}
+	return nil
+}
+
+// DestinationStats holds the delivery latencies of a destination service.
+type DestinationStats struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Service          string        `protobuf:"bytes,1,opt,name=service,proto3" json:"service,omitempty"`
+	EnqueueToDeliver *LatencyStats `protobuf:"bytes,2,opt,name=enqueue_to_deliver,json=enqueueToDeliver,proto3" json:"enqueue_to_deliver,omitempty"` // from queueing to first delivery; live sends count their hand-off to the stream
+	DeliverToAck     *LatencyStats `protobuf:"bytes,3,opt,name=deliver_to_ack,json=deliverToAck,proto3" json:"deliver_to_ack,omitempty"`             // from delivery to Ack, for manual-ack and fetched messages
+}
+
+func (x *DestinationStats) Reset() {
+	*x = DestinationStats{}
+	mi := &file_v2_broker_proto_msgTypes[25]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DestinationStats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DestinationStats) ProtoMessage() {}
+
+func (x *DestinationStats) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[25]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DestinationStats.ProtoReflect.Descriptor instead.
+func (*DestinationStats) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{25}
+}
+
+func (x *DestinationStats) GetService() string {
+	if x != nil {
+		return x.Service
+	}
+	return ""
+}
+
+func (x *DestinationStats) GetEnqueueToDeliver() *LatencyStats {
+	if x != nil {
+		return x.EnqueueToDeliver
+	}
+	return nil
+}
+
+func (x *DestinationStats) GetDeliverToAck() *LatencyStats {
+	if x != nil {
+		return x.DeliverToAck
+	}
+	return nil
+}
+
+// StatsRequest selects the destinations to report; empty reports every destination with deliveries.
+type StatsRequest struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Services []string `protobuf:"bytes,1,rep,name=services,proto3" json:"services,omitempty"`
+}
+
+func (x *StatsRequest) Reset() {
+	*x = StatsRequest{}
+	mi := &file_v2_broker_proto_msgTypes[26]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatsRequest) ProtoMessage() {}
+
+func (x *StatsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[26]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatsRequest.ProtoReflect.Descriptor instead.
+func (*StatsRequest) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{26}
+}
+
+func (x *StatsRequest) GetServices() []string {
+	if x != nil {
+		return x.Services
+	}
+	return nil
+}
+
+type StatsResponse struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Destinations []*DestinationStats `protobuf:"bytes,1,rep,name=destinations,proto3" json:"destinations,omitempty"`
+}
+
+func (x *StatsResponse) Reset() {
+	*x = StatsResponse{}
+	mi := &file_v2_broker_proto_msgTypes[27]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatsResponse) ProtoMessage() {}
+
+func (x *StatsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_v2_broker_proto_msgTypes[27]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatsResponse.ProtoReflect.Descriptor instead.
+func (*StatsResponse) Descriptor() ([]byte, []int) {
+	return file_v2_broker_proto_rawDescGZIP(), []int{27}
+}
+
+func (x *StatsResponse) GetDestinations() []*DestinationStats {
+	if x != nil {
+		return x.Destinations
+	}
+	return nil
+}
+
+var File_v2_broker_proto protoreflect.FileDescriptor
+
+var file_v2_broker_proto_rawDesc = []byte{
+	0x0a, 0x0f, 0x76, 0x32, 0x2f, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x12, 0x09, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x1a, 0x1f, 0x67, 0x6f,
+	0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2f, 0x74, 0x69,
+	0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x1a, 0x1e, 0x67,
+	0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2f, 0x64,
+	0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x22, 0x59, 0x0a,
+	0x08, 0x49, 0x64, 0x65, 0x6e, 0x74, 0x69, 0x74, 0x79, 0x12, 0x12, 0x0a, 0x04, 0x66, 0x72, 0x6f,
+	0x6d, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x66, 0x72, 0x6f, 0x6d, 0x12, 0x1d, 0x0a,
+	0x0a, 0x6d, 0x61, 0x6e, 0x75, 0x61, 0x6c, 0x5f, 0x61, 0x63, 0x6b, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x08, 0x52, 0x09, 0x6d, 0x61, 0x6e, 0x75, 0x61, 0x6c, 0x41, 0x63, 0x6b, 0x12, 0x1a, 0x0a, 0x08,
+	0x69, 0x6e, 0x73, 0x74, 0x61, 0x6e, 0x63, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08,
+	0x69, 0x6e, 0x73, 0x74, 0x61, 0x6e, 0x63, 0x65, 0x22, 0x8a, 0x05, 0x0a, 0x07, 0x4d, 0x65, 0x73,
+	0x73, 0x61, 0x67, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x61, 0x74, 0x61, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x0c, 0x52, 0x04, 0x64, 0x61, 0x74, 0x61, 0x12, 0x23, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x0f, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e,
+	0x76, 0x32, 0x2e, 0x54, 0x79, 0x70, 0x65, 0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x2c, 0x0a,
+	0x03, 0x73, 0x65, 0x71, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f,
+	0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d,
+	0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x03, 0x73, 0x65, 0x71, 0x12, 0x12, 0x0a, 0x04, 0x66,
+	0x72, 0x6f, 0x6d, 0x18, 0x06, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x66, 0x72, 0x6f, 0x6d, 0x12,
+	0x0e, 0x0a, 0x02, 0x74, 0x6f, 0x18, 0x07, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x74, 0x6f, 0x12,
+	0x26, 0x0a, 0x05, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x18, 0x08, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x10,
+	0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x45, 0x76, 0x65, 0x6e, 0x74,
+	0x52, 0x05, 0x65, 0x76, 0x65, 0x6e, 0x74, 0x12, 0x14, 0x0a, 0x05, 0x71, 0x75, 0x65, 0x75, 0x65,
+	0x18, 0x09, 0x20, 0x01, 0x28, 0x08, 0x52, 0x05, 0x71, 0x75, 0x65, 0x75, 0x65, 0x12, 0x0e, 0x0a,
+	0x02, 0x69, 0x64, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x1a, 0x0a,
+	0x08, 0x61, 0x74, 0x74, 0x65, 0x6d, 0x70, 0x74, 0x73, 0x18, 0x0b, 0x20, 0x01, 0x28, 0x0d, 0x52,
+	0x08, 0x61, 0x74, 0x74, 0x65, 0x6d, 0x70, 0x74, 0x73, 0x12, 0x1a, 0x0a, 0x08, 0x63, 0x68, 0x65,
+	0x63, 0x6b, 0x73, 0x75, 0x6d, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x08, 0x63, 0x68, 0x65,
+	0x63, 0x6b, 0x73, 0x75, 0x6d, 0x12, 0x3c, 0x0a, 0x0d, 0x63, 0x68, 0x65, 0x63, 0x6b, 0x73, 0x75,
+	0x6d, 0x5f, 0x74, 0x79, 0x70, 0x65, 0x18, 0x0d, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x17, 0x2e, 0x62,
+	0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x43, 0x68, 0x65, 0x63, 0x6b, 0x73, 0x75,
+	0x6d, 0x54, 0x79, 0x70, 0x65, 0x52, 0x0c, 0x63, 0x68, 0x65, 0x63, 0x6b, 0x73, 0x75, 0x6d, 0x54,
+	0x79, 0x70, 0x65, 0x12, 0x39, 0x0a, 0x07, 0x68, 0x65, 0x61, 0x64, 0x65, 0x72, 0x73, 0x18, 0x0e,
+	0x20, 0x03, 0x28, 0x0b, 0x32, 0x1f, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32,
+	0x2e, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x2e, 0x48, 0x65, 0x61, 0x64, 0x65, 0x72, 0x73,
+	0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x07, 0x68, 0x65, 0x61, 0x64, 0x65, 0x72, 0x73, 0x12, 0x19,
+	0x0a, 0x08, 0x74, 0x72, 0x61, 0x63, 0x65, 0x5f, 0x69, 0x64, 0x18, 0x0f, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x07, 0x74, 0x72, 0x61, 0x63, 0x65, 0x49, 0x64, 0x12, 0x10, 0x0a, 0x03, 0x76, 0x69, 0x61,
+	0x18, 0x10, 0x20, 0x03, 0x28, 0x09, 0x52, 0x03, 0x76, 0x69, 0x61, 0x12, 0x23, 0x0a, 0x0d, 0x70,
+	0x61, 0x72, 0x74, 0x69, 0x74, 0x69, 0x6f, 0x6e, 0x5f, 0x6b, 0x65, 0x79, 0x18, 0x11, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x0c, 0x70, 0x61, 0x72, 0x74, 0x69, 0x74, 0x69, 0x6f, 0x6e, 0x4b, 0x65, 0x79,
+	0x12, 0x21, 0x0a, 0x0c, 0x72, 0x6f, 0x75, 0x74, 0x69, 0x6e, 0x67, 0x5f, 0x73, 0x6c, 0x69, 0x70,
+	0x18, 0x12, 0x20, 0x03, 0x28, 0x09, 0x52, 0x0b, 0x72, 0x6f, 0x75, 0x74, 0x69, 0x6e, 0x67, 0x53,
+	0x6c, 0x69, 0x70, 0x12, 0x1a, 0x0a, 0x08, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x65, 0x64, 0x18,
+	0x13, 0x20, 0x01, 0x28, 0x08, 0x52, 0x08, 0x6d, 0x69, 0x72, 0x72, 0x6f, 0x72, 0x65, 0x64, 0x12,
+	0x14, 0x0a, 0x05, 0x63, 0x68, 0x75, 0x6e, 0x6b, 0x18, 0x14, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x05,
+	0x63, 0x68, 0x75, 0x6e, 0x6b, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x6f, 0x6e, 0x65, 0x18, 0x15, 0x20,
+	0x01, 0x28, 0x08, 0x52, 0x04, 0x64, 0x6f, 0x6e, 0x65, 0x1a, 0x3a, 0x0a, 0x0c, 0x48, 0x65, 0x61,
+	0x64, 0x65, 0x72, 0x73, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x14, 0x0a, 0x05, 0x76,
+	0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75,
+	0x65, 0x3a, 0x02, 0x38, 0x01, 0x22, 0x7f, 0x0a, 0x06, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x12,
+	0x18, 0x0a, 0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x07, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x73, 0x75, 0x63,
+	0x63, 0x65, 0x73, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07, 0x73, 0x75, 0x63, 0x63,
+	0x65, 0x73, 0x73, 0x12, 0x26, 0x0a, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x03, 0x20, 0x01,
+	0x28, 0x0e, 0x32, 0x10, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x45,
+	0x72, 0x72, 0x6f, 0x72, 0x52, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x12, 0x19, 0x0a, 0x08, 0x74,
+	0x72, 0x61, 0x63, 0x65, 0x5f, 0x69, 0x64, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x74,
+	0x72, 0x61, 0x63, 0x65, 0x49, 0x64, 0x22, 0x37, 0x0a, 0x05, 0x42, 0x61, 0x74, 0x63, 0x68, 0x12,
+	0x2e, 0x0a, 0x08, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28,
+	0x0b, 0x32, 0x12, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x4d, 0x65,
+	0x73, 0x73, 0x61, 0x67, 0x65, 0x52, 0x08, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x73, 0x22,
+	0x30, 0x0a, 0x0a, 0x41, 0x63, 0x6b, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x12, 0x0a,
+	0x04, 0x66, 0x72, 0x6f, 0x6d, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x66, 0x72, 0x6f,
+	0x6d, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69,
+	0x64, 0x22, 0x71, 0x0a, 0x0b, 0x4e, 0x61, 0x63, 0x6b, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x12, 0x12, 0x0a, 0x04, 0x66, 0x72, 0x6f, 0x6d, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04,
+	0x66, 0x72, 0x6f, 0x6d, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x02, 0x69, 0x64, 0x12, 0x3e, 0x0a, 0x0d, 0x72, 0x65, 0x71, 0x75, 0x65, 0x75, 0x65, 0x5f,
+	0x64, 0x65, 0x6c, 0x61, 0x79, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x67, 0x6f,
+	0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x44, 0x75,
+	0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x0c, 0x72, 0x65, 0x71, 0x75, 0x65, 0x75, 0x65, 0x44,
+	0x65, 0x6c, 0x61, 0x79, 0x22, 0x2b, 0x0a, 0x0f, 0x52, 0x65, 0x61, 0x64, 0x4f, 0x6e, 0x6c, 0x79,
+	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x18, 0x0a, 0x07, 0x65, 0x6e, 0x61, 0x62, 0x6c,
+	0x65, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x08, 0x52, 0x07, 0x65, 0x6e, 0x61, 0x62, 0x6c, 0x65,
+	0x64, 0x22, 0x69, 0x0a, 0x0c, 0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x12, 0x12, 0x0a, 0x04, 0x66, 0x72, 0x6f, 0x6d, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x04, 0x66, 0x72, 0x6f, 0x6d, 0x12, 0x29, 0x0a, 0x10, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x63, 0x6f,
+	0x6c, 0x5f, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52,
+	0x0f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x63, 0x6f, 0x6c, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e,
+	0x12, 0x1a, 0x0a, 0x08, 0x66, 0x65, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x18, 0x03, 0x20, 0x03,
+	0x28, 0x09, 0x52, 0x08, 0x66, 0x65, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x22, 0x88, 0x01, 0x0a,
+	0x0d, 0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x29,
+	0x0a, 0x10, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x63, 0x6f, 0x6c, 0x5f, 0x76, 0x65, 0x72, 0x73, 0x69,
+	0x6f, 0x6e, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x63,
+	0x6f, 0x6c, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x30, 0x0a, 0x14, 0x6d, 0x69, 0x6e,
+	0x5f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x63, 0x6f, 0x6c, 0x5f, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f,
+	0x6e, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x12, 0x6d, 0x69, 0x6e, 0x50, 0x72, 0x6f, 0x74,
+	0x6f, 0x63, 0x6f, 0x6c, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x1a, 0x0a, 0x08, 0x66,
+	0x65, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x09, 0x52, 0x08, 0x66,
+	0x65, 0x61, 0x74, 0x75, 0x72, 0x65, 0x73, 0x22, 0x99, 0x02, 0x0a, 0x0b, 0x42, 0x72, 0x6f, 0x6b,
+	0x65, 0x72, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x12, 0x2e, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x1a, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76,
+	0x32, 0x2e, 0x42, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x54, 0x79, 0x70,
+	0x65, 0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x2e, 0x0a, 0x04, 0x74, 0x69, 0x6d, 0x65, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d,
+	0x70, 0x52, 0x04, 0x74, 0x69, 0x6d, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x73, 0x65, 0x72, 0x76, 0x69,
+	0x63, 0x65, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63,
+	0x65, 0x12, 0x1d, 0x0a, 0x0a, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x5f, 0x69, 0x64, 0x18,
+	0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x09, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x49, 0x64,
+	0x12, 0x19, 0x0a, 0x08, 0x74, 0x72, 0x61, 0x63, 0x65, 0x5f, 0x69, 0x64, 0x18, 0x05, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x07, 0x74, 0x72, 0x61, 0x63, 0x65, 0x49, 0x64, 0x12, 0x12, 0x0a, 0x04, 0x66,
+	0x72, 0x6f, 0x6d, 0x18, 0x06, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x66, 0x72, 0x6f, 0x6d, 0x12,
+	0x0e, 0x0a, 0x02, 0x74, 0x6f, 0x18, 0x07, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x74, 0x6f, 0x12,
+	0x1a, 0x0a, 0x08, 0x61, 0x74, 0x74, 0x65, 0x6d, 0x70, 0x74, 0x73, 0x18, 0x08, 0x20, 0x01, 0x28,
+	0x0d, 0x52, 0x08, 0x61, 0x74, 0x74, 0x65, 0x6d, 0x70, 0x74, 0x73, 0x12, 0x16, 0x0a, 0x06, 0x64,
+	0x65, 0x74, 0x61, 0x69, 0x6c, 0x18, 0x09, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x64, 0x65, 0x74,
+	0x61, 0x69, 0x6c, 0x22, 0x62, 0x0a, 0x12, 0x57, 0x61, 0x74, 0x63, 0x68, 0x45, 0x76, 0x65, 0x6e,
+	0x74, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x1a, 0x0a, 0x08, 0x73, 0x65, 0x72,
+	0x76, 0x69, 0x63, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x08, 0x73, 0x65, 0x72,
+	0x76, 0x69, 0x63, 0x65, 0x73, 0x12, 0x30, 0x0a, 0x05, 0x74, 0x79, 0x70, 0x65, 0x73, 0x18, 0x02,
+	0x20, 0x03, 0x28, 0x0e, 0x32, 0x1a, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32,
+	0x2e, 0x42, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x54, 0x79, 0x70, 0x65,
+	0x52, 0x05, 0x74, 0x79, 0x70, 0x65, 0x73, 0x22, 0xa1, 0x01, 0x0a, 0x0b, 0x51, 0x75, 0x6f, 0x74,
+	0x61, 0x4c, 0x69, 0x6d, 0x69, 0x74, 0x73, 0x12, 0x27, 0x0a, 0x0f, 0x68, 0x6f, 0x75, 0x72, 0x6c,
+	0x79, 0x5f, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x03,
+	0x52, 0x0e, 0x68, 0x6f, 0x75, 0x72, 0x6c, 0x79, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x73,
+	0x12, 0x21, 0x0a, 0x0c, 0x68, 0x6f, 0x75, 0x72, 0x6c, 0x79, 0x5f, 0x62, 0x79, 0x74, 0x65, 0x73,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0b, 0x68, 0x6f, 0x75, 0x72, 0x6c, 0x79, 0x42, 0x79,
+	0x74, 0x65, 0x73, 0x12, 0x25, 0x0a, 0x0e, 0x64, 0x61, 0x69, 0x6c, 0x79, 0x5f, 0x6d, 0x65, 0x73,
+	0x73, 0x61, 0x67, 0x65, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0d, 0x64, 0x61, 0x69,
+	0x6c, 0x79, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x73, 0x12, 0x1f, 0x0a, 0x0b, 0x64, 0x61,
+	0x69, 0x6c, 0x79, 0x5f, 0x62, 0x79, 0x74, 0x65, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52,
+	0x0a, 0x64, 0x61, 0x69, 0x6c, 0x79, 0x42, 0x79, 0x74, 0x65, 0x73, 0x22, 0xce, 0x02, 0x0a, 0x0a,
+	0x51, 0x75, 0x6f, 0x74, 0x61, 0x55, 0x73, 0x61, 0x67, 0x65, 0x12, 0x18, 0x0a, 0x07, 0x73, 0x65,
+	0x72, 0x76, 0x69, 0x63, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x73, 0x65, 0x72,
+	0x76, 0x69, 0x63, 0x65, 0x12, 0x23, 0x0a, 0x0d, 0x68, 0x6f, 0x75, 0x72, 0x5f, 0x6d, 0x65, 0x73,
+	0x73, 0x61, 0x67, 0x65, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0c, 0x68, 0x6f, 0x75,
+	0x72, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x73, 0x12, 0x1d, 0x0a, 0x0a, 0x68, 0x6f, 0x75,
+	0x72, 0x5f, 0x62, 0x79, 0x74, 0x65, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x68,
+	0x6f, 0x75, 0x72, 0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x21, 0x0a, 0x0c, 0x64, 0x61, 0x79, 0x5f,
+	0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x73, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0b,
+	0x64, 0x61, 0x79, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x73, 0x12, 0x1b, 0x0a, 0x09, 0x64,
+	0x61, 0x79, 0x5f, 0x62, 0x79, 0x74, 0x65, 0x73, 0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x52, 0x08,
+	0x64, 0x61, 0x79, 0x42, 0x79, 0x74, 0x65, 0x73, 0x12, 0x2e, 0x0a, 0x06, 0x6c, 0x69, 0x6d, 0x69,
+	0x74, 0x73, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x16, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65,
+	0x72, 0x2e, 0x76, 0x32, 0x2e, 0x51, 0x75, 0x6f, 0x74, 0x61, 0x4c, 0x69, 0x6d, 0x69, 0x74, 0x73,
+	0x52, 0x06, 0x6c, 0x69, 0x6d, 0x69, 0x74, 0x73, 0x12, 0x39, 0x0a, 0x0a, 0x68, 0x6f, 0x75, 0x72,
+	0x5f, 0x72, 0x65, 0x73, 0x65, 0x74, 0x18, 0x07, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67,
+	0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54,
+	0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x09, 0x68, 0x6f, 0x75, 0x72, 0x52, 0x65,
+	0x73, 0x65, 0x74, 0x12, 0x37, 0x0a, 0x09, 0x64, 0x61, 0x79, 0x5f, 0x72, 0x65, 0x73, 0x65, 0x74,
+	0x18, 0x08, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e,
+	0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61,
+	0x6d, 0x70, 0x52, 0x08, 0x64, 0x61, 0x79, 0x52, 0x65, 0x73, 0x65, 0x74, 0x22, 0x2f, 0x0a, 0x11,
+	0x51, 0x75, 0x6f, 0x74, 0x61, 0x55, 0x73, 0x61, 0x67, 0x65, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73,
+	0x74, 0x12, 0x1a, 0x0a, 0x08, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x73, 0x18, 0x01, 0x20,
+	0x03, 0x28, 0x09, 0x52, 0x08, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x73, 0x22, 0x41, 0x0a,
+	0x12, 0x51, 0x75, 0x6f, 0x74, 0x61, 0x55, 0x73, 0x61, 0x67, 0x65, 0x52, 0x65, 0x73, 0x70, 0x6f,
+	0x6e, 0x73, 0x65, 0x12, 0x2b, 0x0a, 0x05, 0x75, 0x73, 0x61, 0x67, 0x65, 0x18, 0x01, 0x20, 0x03,
+	0x28, 0x0b, 0x32, 0x15, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x51,
+	0x75, 0x6f, 0x74, 0x61, 0x55, 0x73, 0x61, 0x67, 0x65, 0x52, 0x05, 0x75, 0x73, 0x61, 0x67, 0x65,
+	0x22, 0x47, 0x0a, 0x0a, 0x54, 0x61, 0x70, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x18,
+	0x0a, 0x07, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x07, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x1f, 0x0a, 0x0b, 0x73, 0x61, 0x6d, 0x70,
+	0x6c, 0x65, 0x5f, 0x72, 0x61, 0x74, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x01, 0x52, 0x0a, 0x73,
+	0x61, 0x6d, 0x70, 0x6c, 0x65, 0x52, 0x61, 0x74, 0x65, 0x22, 0x4a, 0x0a, 0x0d, 0x46, 0x65, 0x64,
+	0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x41, 0x63, 0x6b, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x29, 0x0a, 0x06, 0x73, 0x74,
+	0x61, 0x74, 0x75, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x11, 0x2e, 0x62, 0x72, 0x6f,
+	0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x52, 0x06, 0x73,
+	0x74, 0x61, 0x74, 0x75, 0x73, 0x22, 0xce, 0x01, 0x0a, 0x0c, 0x46, 0x65, 0x74, 0x63, 0x68, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x12, 0x0a, 0x04, 0x66, 0x72, 0x6f, 0x6d, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x66, 0x72, 0x6f, 0x6d, 0x12, 0x21, 0x0a, 0x0c, 0x6d, 0x61,
+	0x78, 0x5f, 0x6d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x73, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0d,
+	0x52, 0x0b, 0x6d, 0x61, 0x78, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x73, 0x12, 0x48, 0x0a,
+	0x12, 0x76, 0x69, 0x73, 0x69, 0x62, 0x69, 0x6c, 0x69, 0x74, 0x79, 0x5f, 0x74, 0x69, 0x6d, 0x65,
+	0x6f, 0x75, 0x74, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x67, 0x6f, 0x6f, 0x67,
+	0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x44, 0x75, 0x72, 0x61,
+	0x74, 0x69, 0x6f, 0x6e, 0x52, 0x11, 0x76, 0x69, 0x73, 0x69, 0x62, 0x69, 0x6c, 0x69, 0x74, 0x79,
+	0x54, 0x69, 0x6d, 0x65, 0x6f, 0x75, 0x74, 0x12, 0x1a, 0x0a, 0x08, 0x69, 0x6e, 0x73, 0x74, 0x61,
+	0x6e, 0x63, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x69, 0x6e, 0x73, 0x74, 0x61,
+	0x6e, 0x63, 0x65, 0x12, 0x21, 0x0a, 0x0c, 0x77, 0x61, 0x69, 0x74, 0x5f, 0x73, 0x65, 0x63, 0x6f,
+	0x6e, 0x64, 0x73, 0x18, 0x05, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x0b, 0x77, 0x61, 0x69, 0x74, 0x53,
+	0x65, 0x63, 0x6f, 0x6e, 0x64, 0x73, 0x22, 0x3f, 0x0a, 0x0d, 0x46, 0x65, 0x74, 0x63, 0x68, 0x52,
+	0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x2e, 0x0a, 0x08, 0x6d, 0x65, 0x73, 0x73, 0x61,
+	0x67, 0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x12, 0x2e, 0x62, 0x72, 0x6f, 0x6b,
+	0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x52, 0x08, 0x6d,
+	0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x73, 0x22, 0x74, 0x0a, 0x17, 0x45, 0x78, 0x74, 0x65, 0x6e,
+	0x64, 0x56, 0x69, 0x73, 0x69, 0x62, 0x69, 0x6c, 0x69, 0x74, 0x79, 0x52, 0x65, 0x71, 0x75, 0x65,
+	0x73, 0x74, 0x12, 0x12, 0x0a, 0x04, 0x66, 0x72, 0x6f, 0x6d, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x04, 0x66, 0x72, 0x6f, 0x6d, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x35, 0x0a, 0x08, 0x64, 0x75, 0x72, 0x61, 0x74, 0x69,
+	0x6f, 0x6e, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c,
+	0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x44, 0x75, 0x72, 0x61, 0x74,
+	0x69, 0x6f, 0x6e, 0x52, 0x08, 0x64, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x22, 0x65, 0x0a,
+	0x18, 0x45, 0x78, 0x74, 0x65, 0x6e, 0x64, 0x56, 0x69, 0x73, 0x69, 0x62, 0x69, 0x6c, 0x69, 0x74,
+	0x79, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18,
+	0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x69, 0x64, 0x12, 0x39, 0x0a, 0x0a, 0x76, 0x69, 0x73,
+	0x69, 0x62, 0x6c, 0x65, 0x5f, 0x61, 0x74, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a, 0x2e,
+	0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e,
+	0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x09, 0x76, 0x69, 0x73, 0x69, 0x62,
+	0x6c, 0x65, 0x41, 0x74, 0x22, 0x27, 0x0a, 0x0f, 0x4c, 0x6f, 0x67, 0x4c, 0x65, 0x76, 0x65, 0x6c,
+	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x14, 0x0a, 0x05, 0x6c, 0x65, 0x76, 0x65, 0x6c,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x6c, 0x65, 0x76, 0x65, 0x6c, 0x22, 0x68, 0x0a,
+	0x15, 0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x4c, 0x6f, 0x67, 0x67, 0x69, 0x6e, 0x67, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x18, 0x0a, 0x07, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63,
+	0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65,
+	0x12, 0x35, 0x0a, 0x08, 0x64, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x19, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74,
+	0x6f, 0x62, 0x75, 0x66, 0x2e, 0x44, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x08, 0x64,
+	0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x22, 0x4d, 0x0a, 0x12, 0x53, 0x6c, 0x6f, 0x77, 0x4c,
+	0x6f, 0x67, 0x67, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x37, 0x0a,
+	0x09, 0x74, 0x68, 0x72, 0x65, 0x73, 0x68, 0x6f, 0x6c, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b,
+	0x32, 0x19, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62,
+	0x75, 0x66, 0x2e, 0x44, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x09, 0x74, 0x68, 0x72,
+	0x65, 0x73, 0x68, 0x6f, 0x6c, 0x64, 0x22, 0xd8, 0x01, 0x0a, 0x0c, 0x4c, 0x61, 0x74, 0x65, 0x6e,
+	0x63, 0x79, 0x53, 0x74, 0x61, 0x74, 0x73, 0x12, 0x14, 0x0a, 0x05, 0x63, 0x6f, 0x75, 0x6e, 0x74,
+	0x18, 0x01, 0x20, 0x01, 0x28, 0x03, 0x52, 0x05, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x12, 0x2b, 0x0a,
+	0x03, 0x73, 0x75, 0x6d, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x67, 0x6f, 0x6f,
+	0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x44, 0x75, 0x72,
+	0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x03, 0x73, 0x75, 0x6d, 0x12, 0x2b, 0x0a, 0x03, 0x70, 0x35,
+	0x30, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65,
+	0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x44, 0x75, 0x72, 0x61, 0x74, 0x69,
+	0x6f, 0x6e, 0x52, 0x03, 0x70, 0x35, 0x30, 0x12, 0x2b, 0x0a, 0x03, 0x70, 0x39, 0x30, 0x18, 0x04,
+	0x20, 0x01, 0x28, 0x0b, 0x32, 0x19, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72,
+	0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x44, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52,
+	0x03, 0x70, 0x39, 0x30, 0x12, 0x2b, 0x0a, 0x03, 0x70, 0x39, 0x39, 0x18, 0x05, 0x20, 0x01, 0x28,
+	0x0b, 0x32, 0x19, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f,
+	0x62, 0x75, 0x66, 0x2e, 0x44, 0x75, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52, 0x03, 0x70, 0x39,
+	0x39, 0x22, 0xb2, 0x01, 0x0a, 0x10, 0x44, 0x65, 0x73, 0x74, 0x69, 0x6e, 0x61, 0x74, 0x69, 0x6f,
+	0x6e, 0x53, 0x74, 0x61, 0x74, 0x73, 0x12, 0x18, 0x0a, 0x07, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63,
+	0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65,
+	0x12, 0x45, 0x0a, 0x12, 0x65, 0x6e, 0x71, 0x75, 0x65, 0x75, 0x65, 0x5f, 0x74, 0x6f, 0x5f, 0x64,
+	0x65, 0x6c, 0x69, 0x76, 0x65, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x17, 0x2e, 0x62,
+	0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x4c, 0x61, 0x74, 0x65, 0x6e, 0x63, 0x79,
+	0x53, 0x74, 0x61, 0x74, 0x73, 0x52, 0x10, 0x65, 0x6e, 0x71, 0x75, 0x65, 0x75, 0x65, 0x54, 0x6f,
+	0x44, 0x65, 0x6c, 0x69, 0x76, 0x65, 0x72, 0x12, 0x3d, 0x0a, 0x0e, 0x64, 0x65, 0x6c, 0x69, 0x76,
+	0x65, 0x72, 0x5f, 0x74, 0x6f, 0x5f, 0x61, 0x63, 0x6b, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0b, 0x32,
+	0x17, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x4c, 0x61, 0x74, 0x65,
+	0x6e, 0x63, 0x79, 0x53, 0x74, 0x61, 0x74, 0x73, 0x52, 0x0c, 0x64, 0x65, 0x6c, 0x69, 0x76, 0x65,
+	0x72, 0x54, 0x6f, 0x41, 0x63, 0x6b, 0x22, 0x2a, 0x0a, 0x0c, 0x53, 0x74, 0x61, 0x74, 0x73, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x12, 0x1a, 0x0a, 0x08, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63,
+	0x65, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x08, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63,
+	0x65, 0x73, 0x22, 0x50, 0x0a, 0x0d, 0x53, 0x74, 0x61, 0x74, 0x73, 0x52, 0x65, 0x73, 0x70, 0x6f,
+	0x6e, 0x73, 0x65, 0x12, 0x3f, 0x0a, 0x0c, 0x64, 0x65, 0x73, 0x74, 0x69, 0x6e, 0x61, 0x74, 0x69,
+	0x6f, 0x6e, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x1b, 0x2e, 0x62, 0x72, 0x6f, 0x6b,
+	0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x44, 0x65, 0x73, 0x74, 0x69, 0x6e, 0x61, 0x74, 0x69, 0x6f,
+	0x6e, 0x53, 0x74, 0x61, 0x74, 0x73, 0x52, 0x0c, 0x64, 0x65, 0x73, 0x74, 0x69, 0x6e, 0x61, 0x74,
+	0x69, 0x6f, 0x6e, 0x73, 0x2a, 0x89, 0x01, 0x0a, 0x04, 0x54, 0x79, 0x70, 0x65, 0x12, 0x0c, 0x0a,
+	0x08, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x4d, 0x50, 0x34, 0x10, 0x00, 0x12, 0x0c, 0x0a, 0x08, 0x54,
+	0x59, 0x50, 0x45, 0x5f, 0x4d, 0x50, 0x33, 0x10, 0x01, 0x12, 0x0c, 0x0a, 0x08, 0x54, 0x59, 0x50,
+	0x45, 0x5f, 0x4a, 0x50, 0x47, 0x10, 0x02, 0x12, 0x0c, 0x0a, 0x08, 0x54, 0x59, 0x50, 0x45, 0x5f,
+	0x50, 0x4e, 0x47, 0x10, 0x03, 0x12, 0x0d, 0x0a, 0x09, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x4a, 0x53,
+	0x4f, 0x4e, 0x10, 0x04, 0x12, 0x0c, 0x0a, 0x08, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x58, 0x4d, 0x4c,
+	0x10, 0x05, 0x12, 0x0d, 0x0a, 0x09, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x48, 0x54, 0x4d, 0x4c, 0x10,
+	0x06, 0x12, 0x0d, 0x0a, 0x09, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x54, 0x45, 0x58, 0x54, 0x10, 0x07,
+	0x12, 0x0e, 0x0a, 0x0a, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x4f, 0x54, 0x48, 0x45, 0x52, 0x10, 0x08,
+	0x2a, 0x65, 0x0a, 0x05, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x12, 0x10, 0x0a, 0x0c, 0x45, 0x56, 0x45,
+	0x4e, 0x54, 0x5f, 0x53, 0x54, 0x52, 0x45, 0x41, 0x4d, 0x10, 0x00, 0x12, 0x11, 0x0a, 0x0d, 0x45,
+	0x56, 0x45, 0x4e, 0x54, 0x5f, 0x4d, 0x45, 0x53, 0x53, 0x41, 0x47, 0x45, 0x10, 0x01, 0x12, 0x0f,
+	0x0a, 0x0b, 0x45, 0x56, 0x45, 0x4e, 0x54, 0x5f, 0x45, 0x52, 0x52, 0x4f, 0x52, 0x10, 0x02, 0x12,
+	0x11, 0x0a, 0x0d, 0x45, 0x56, 0x45, 0x4e, 0x54, 0x5f, 0x45, 0x58, 0x50, 0x49, 0x52, 0x45, 0x44,
+	0x10, 0x03, 0x12, 0x13, 0x0a, 0x0f, 0x45, 0x56, 0x45, 0x4e, 0x54, 0x5f, 0x4b, 0x45, 0x45, 0x50,
+	0x41, 0x4c, 0x49, 0x56, 0x45, 0x10, 0x04, 0x2a, 0x5a, 0x0a, 0x0c, 0x43, 0x68, 0x65, 0x63, 0x6b,
+	0x73, 0x75, 0x6d, 0x54, 0x79, 0x70, 0x65, 0x12, 0x16, 0x0a, 0x12, 0x43, 0x48, 0x45, 0x43, 0x4b,
+	0x53, 0x55, 0x4d, 0x5f, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x4e, 0x4f, 0x4e, 0x45, 0x10, 0x00, 0x12,
+	0x18, 0x0a, 0x14, 0x43, 0x48, 0x45, 0x43, 0x4b, 0x53, 0x55, 0x4d, 0x5f, 0x54, 0x59, 0x50, 0x45,
+	0x5f, 0x43, 0x52, 0x43, 0x33, 0x32, 0x43, 0x10, 0x01, 0x12, 0x18, 0x0a, 0x14, 0x43, 0x48, 0x45,
+	0x43, 0x4b, 0x53, 0x55, 0x4d, 0x5f, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x53, 0x48, 0x41, 0x32, 0x35,
+	0x36, 0x10, 0x02, 0x2a, 0x9b, 0x02, 0x0a, 0x05, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x12, 0x0e, 0x0a,
+	0x0a, 0x45, 0x52, 0x52, 0x4f, 0x52, 0x5f, 0x4e, 0x4f, 0x4e, 0x45, 0x10, 0x00, 0x12, 0x11, 0x0a,
+	0x0d, 0x45, 0x52, 0x52, 0x4f, 0x52, 0x5f, 0x55, 0x4e, 0x4b, 0x4e, 0x4f, 0x57, 0x4e, 0x10, 0x01,
+	0x12, 0x19, 0x0a, 0x15, 0x45, 0x52, 0x52, 0x4f, 0x52, 0x5f, 0x49, 0x4e, 0x56, 0x41, 0x4c, 0x49,
+	0x44, 0x5f, 0x52, 0x45, 0x51, 0x55, 0x45, 0x53, 0x54, 0x10, 0x02, 0x12, 0x16, 0x0a, 0x12, 0x45,
+	0x52, 0x52, 0x4f, 0x52, 0x5f, 0x53, 0x45, 0x52, 0x56, 0x45, 0x52, 0x5f, 0x45, 0x52, 0x52, 0x4f,
+	0x52, 0x10, 0x03, 0x12, 0x1b, 0x0a, 0x17, 0x45, 0x52, 0x52, 0x4f, 0x52, 0x5f, 0x52, 0x45, 0x43,
+	0x49, 0x50, 0x49, 0x45, 0x4e, 0x54, 0x5f, 0x4f, 0x46, 0x46, 0x4c, 0x49, 0x4e, 0x45, 0x10, 0x04,
+	0x12, 0x13, 0x0a, 0x0f, 0x45, 0x52, 0x52, 0x4f, 0x52, 0x5f, 0x52, 0x45, 0x41, 0x44, 0x5f, 0x4f,
+	0x4e, 0x4c, 0x59, 0x10, 0x05, 0x12, 0x1b, 0x0a, 0x17, 0x45, 0x52, 0x52, 0x4f, 0x52, 0x5f, 0x43,
+	0x48, 0x45, 0x43, 0x4b, 0x53, 0x55, 0x4d, 0x5f, 0x4d, 0x49, 0x53, 0x4d, 0x41, 0x54, 0x43, 0x48,
+	0x10, 0x06, 0x12, 0x18, 0x0a, 0x14, 0x45, 0x52, 0x52, 0x4f, 0x52, 0x5f, 0x51, 0x55, 0x4f, 0x54,
+	0x41, 0x5f, 0x45, 0x58, 0x43, 0x45, 0x45, 0x44, 0x45, 0x44, 0x10, 0x07, 0x12, 0x1b, 0x0a, 0x17,
+	0x45, 0x52, 0x52, 0x4f, 0x52, 0x5f, 0x50, 0x45, 0x52, 0x4d, 0x49, 0x53, 0x53, 0x49, 0x4f, 0x4e,
+	0x5f, 0x44, 0x45, 0x4e, 0x49, 0x45, 0x44, 0x10, 0x08, 0x12, 0x19, 0x0a, 0x15, 0x45, 0x52, 0x52,
+	0x4f, 0x52, 0x5f, 0x55, 0x4e, 0x4b, 0x4e, 0x4f, 0x57, 0x4e, 0x5f, 0x53, 0x45, 0x52, 0x56, 0x49,
+	0x43, 0x45, 0x10, 0x09, 0x12, 0x1b, 0x0a, 0x17, 0x45, 0x52, 0x52, 0x4f, 0x52, 0x5f, 0x56, 0x41,
+	0x4c, 0x49, 0x44, 0x41, 0x54, 0x49, 0x4f, 0x4e, 0x5f, 0x46, 0x41, 0x49, 0x4c, 0x45, 0x44, 0x10,
+	0x0a, 0x2a, 0x9b, 0x04, 0x0a, 0x0f, 0x42, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x45, 0x76, 0x65, 0x6e,
+	0x74, 0x54, 0x79, 0x70, 0x65, 0x12, 0x21, 0x0a, 0x1d, 0x42, 0x52, 0x4f, 0x4b, 0x45, 0x52, 0x5f,
+	0x45, 0x56, 0x45, 0x4e, 0x54, 0x5f, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x55, 0x4e, 0x53, 0x50, 0x45,
+	0x43, 0x49, 0x46, 0x49, 0x45, 0x44, 0x10, 0x00, 0x12, 0x1e, 0x0a, 0x1a, 0x42, 0x52, 0x4f, 0x4b,
+	0x45, 0x52, 0x5f, 0x45, 0x56, 0x45, 0x4e, 0x54, 0x5f, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x45, 0x4e,
+	0x51, 0x55, 0x45, 0x55, 0x45, 0x44, 0x10, 0x01, 0x12, 0x1f, 0x0a, 0x1b, 0x42, 0x52, 0x4f, 0x4b,
+	0x45, 0x52, 0x5f, 0x45, 0x56, 0x45, 0x4e, 0x54, 0x5f, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x44, 0x45,
+	0x4c, 0x49, 0x56, 0x45, 0x52, 0x45, 0x44, 0x10, 0x02, 0x12, 0x1b, 0x0a, 0x17, 0x42, 0x52, 0x4f,
+	0x4b, 0x45, 0x52, 0x5f, 0x45, 0x56, 0x45, 0x4e, 0x54, 0x5f, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x41,
+	0x43, 0x4b, 0x45, 0x44, 0x10, 0x03, 0x12, 0x1c, 0x0a, 0x18, 0x42, 0x52, 0x4f, 0x4b, 0x45, 0x52,
+	0x5f, 0x45, 0x56, 0x45, 0x4e, 0x54, 0x5f, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x4e, 0x41, 0x43, 0x4b,
+	0x45, 0x44, 0x10, 0x04, 0x12, 0x1d, 0x0a, 0x19, 0x42, 0x52, 0x4f, 0x4b, 0x45, 0x52, 0x5f, 0x45,
+	0x56, 0x45, 0x4e, 0x54, 0x5f, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x45, 0x58, 0x50, 0x49, 0x52, 0x45,
+	0x44, 0x10, 0x05, 0x12, 0x23, 0x0a, 0x1f, 0x42, 0x52, 0x4f, 0x4b, 0x45, 0x52, 0x5f, 0x45, 0x56,
+	0x45, 0x4e, 0x54, 0x5f, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x44, 0x45, 0x41, 0x44, 0x5f, 0x4c, 0x45,
+	0x54, 0x54, 0x45, 0x52, 0x45, 0x44, 0x10, 0x06, 0x12, 0x21, 0x0a, 0x1d, 0x42, 0x52, 0x4f, 0x4b,
+	0x45, 0x52, 0x5f, 0x45, 0x56, 0x45, 0x4e, 0x54, 0x5f, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x51, 0x55,
+	0x41, 0x52, 0x41, 0x4e, 0x54, 0x49, 0x4e, 0x45, 0x44, 0x10, 0x07, 0x12, 0x1f, 0x0a, 0x1b, 0x42,
+	0x52, 0x4f, 0x4b, 0x45, 0x52, 0x5f, 0x45, 0x56, 0x45, 0x4e, 0x54, 0x5f, 0x54, 0x59, 0x50, 0x45,
+	0x5f, 0x43, 0x4f, 0x4e, 0x4e, 0x45, 0x43, 0x54, 0x45, 0x44, 0x10, 0x08, 0x12, 0x22, 0x0a, 0x1e,
+	0x42, 0x52, 0x4f, 0x4b, 0x45, 0x52, 0x5f, 0x45, 0x56, 0x45, 0x4e, 0x54, 0x5f, 0x54, 0x59, 0x50,
+	0x45, 0x5f, 0x44, 0x49, 0x53, 0x43, 0x4f, 0x4e, 0x4e, 0x45, 0x43, 0x54, 0x45, 0x44, 0x10, 0x09,
+	0x12, 0x21, 0x0a, 0x1d, 0x42, 0x52, 0x4f, 0x4b, 0x45, 0x52, 0x5f, 0x45, 0x56, 0x45, 0x4e, 0x54,
+	0x5f, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x41, 0x55, 0x54, 0x48, 0x5f, 0x46, 0x41, 0x49, 0x4c, 0x45,
+	0x44, 0x10, 0x0a, 0x12, 0x25, 0x0a, 0x21, 0x42, 0x52, 0x4f, 0x4b, 0x45, 0x52, 0x5f, 0x45, 0x56,
+	0x45, 0x4e, 0x54, 0x5f, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x41, 0x55, 0x54, 0x48, 0x5f, 0x4c, 0x4f,
+	0x43, 0x4b, 0x45, 0x44, 0x5f, 0x4f, 0x55, 0x54, 0x10, 0x0b, 0x12, 0x23, 0x0a, 0x1f, 0x42, 0x52,
+	0x4f, 0x4b, 0x45, 0x52, 0x5f, 0x45, 0x56, 0x45, 0x4e, 0x54, 0x5f, 0x54, 0x59, 0x50, 0x45, 0x5f,
+	0x45, 0x47, 0x52, 0x45, 0x53, 0x53, 0x5f, 0x44, 0x45, 0x4e, 0x49, 0x45, 0x44, 0x10, 0x0c, 0x12,
+	0x25, 0x0a, 0x21, 0x42, 0x52, 0x4f, 0x4b, 0x45, 0x52, 0x5f, 0x45, 0x56, 0x45, 0x4e, 0x54, 0x5f,
+	0x54, 0x59, 0x50, 0x45, 0x5f, 0x55, 0x4e, 0x4b, 0x4e, 0x4f, 0x57, 0x4e, 0x5f, 0x53, 0x45, 0x52,
+	0x56, 0x49, 0x43, 0x45, 0x10, 0x0d, 0x12, 0x27, 0x0a, 0x23, 0x42, 0x52, 0x4f, 0x4b, 0x45, 0x52,
+	0x5f, 0x45, 0x56, 0x45, 0x4e, 0x54, 0x5f, 0x54, 0x59, 0x50, 0x45, 0x5f, 0x56, 0x41, 0x4c, 0x49,
+	0x44, 0x41, 0x54, 0x49, 0x4f, 0x4e, 0x5f, 0x46, 0x41, 0x49, 0x4c, 0x45, 0x44, 0x10, 0x0e, 0x32,
+	0xa9, 0x0a, 0x0a, 0x06, 0x42, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x12, 0x3c, 0x0a, 0x05, 0x48, 0x65,
+	0x6c, 0x6c, 0x6f, 0x12, 0x17, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e,
+	0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x18, 0x2e, 0x62,
+	0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x48, 0x65, 0x6c, 0x6c, 0x6f, 0x52, 0x65,
+	0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x30, 0x0a, 0x04, 0x50, 0x69, 0x6e, 0x67,
+	0x12, 0x13, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x49, 0x64, 0x65,
+	0x6e, 0x74, 0x69, 0x74, 0x79, 0x1a, 0x11, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76,
+	0x32, 0x2e, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x22, 0x00, 0x12, 0x2f, 0x0a, 0x04, 0x53, 0x65,
+	0x6e, 0x64, 0x12, 0x12, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x4d,
+	0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x1a, 0x11, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e,
+	0x76, 0x32, 0x2e, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x22, 0x00, 0x12, 0x32, 0x0a, 0x09, 0x53,
+	0x65, 0x6e, 0x64, 0x42, 0x61, 0x74, 0x63, 0x68, 0x12, 0x10, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65,
+	0x72, 0x2e, 0x76, 0x32, 0x2e, 0x42, 0x61, 0x74, 0x63, 0x68, 0x1a, 0x11, 0x2e, 0x62, 0x72, 0x6f,
+	0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x22, 0x00, 0x12,
+	0x36, 0x0a, 0x07, 0x52, 0x65, 0x63, 0x65, 0x69, 0x76, 0x65, 0x12, 0x13, 0x2e, 0x62, 0x72, 0x6f,
+	0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x49, 0x64, 0x65, 0x6e, 0x74, 0x69, 0x74, 0x79, 0x1a,
+	0x12, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x4d, 0x65, 0x73, 0x73,
+	0x61, 0x67, 0x65, 0x22, 0x00, 0x30, 0x01, 0x12, 0x33, 0x0a, 0x07, 0x43, 0x6c, 0x65, 0x61, 0x6e,
+	0x75, 0x70, 0x12, 0x13, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x49,
+	0x64, 0x65, 0x6e, 0x74, 0x69, 0x74, 0x79, 0x1a, 0x11, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72,
+	0x2e, 0x76, 0x32, 0x2e, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x22, 0x00, 0x12, 0x31, 0x0a, 0x03,
+	0x41, 0x63, 0x6b, 0x12, 0x15, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e,
+	0x41, 0x63, 0x6b, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x11, 0x2e, 0x62, 0x72, 0x6f,
+	0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x22, 0x00, 0x12,
+	0x33, 0x0a, 0x04, 0x4e, 0x61, 0x63, 0x6b, 0x12, 0x16, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72,
+	0x2e, 0x76, 0x32, 0x2e, 0x4e, 0x61, 0x63, 0x6b, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a,
+	0x11, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x53, 0x74, 0x61, 0x74,
+	0x75, 0x73, 0x22, 0x00, 0x12, 0x3c, 0x0a, 0x05, 0x46, 0x65, 0x74, 0x63, 0x68, 0x12, 0x17, 0x2e,
+	0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x46, 0x65, 0x74, 0x63, 0x68, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x18, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e,
+	0x76, 0x32, 0x2e, 0x46, 0x65, 0x74, 0x63, 0x68, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65,
+	0x22, 0x00, 0x12, 0x5d, 0x0a, 0x10, 0x45, 0x78, 0x74, 0x65, 0x6e, 0x64, 0x56, 0x69, 0x73, 0x69,
+	0x62, 0x69, 0x6c, 0x69, 0x74, 0x79, 0x12, 0x22, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e,
+	0x76, 0x32, 0x2e, 0x45, 0x78, 0x74, 0x65, 0x6e, 0x64, 0x56, 0x69, 0x73, 0x69, 0x62, 0x69, 0x6c,
+	0x69, 0x74, 0x79, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x23, 0x2e, 0x62, 0x72, 0x6f,
+	0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x45, 0x78, 0x74, 0x65, 0x6e, 0x64, 0x56, 0x69, 0x73,
+	0x69, 0x62, 0x69, 0x6c, 0x69, 0x74, 0x79, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22,
+	0x00, 0x12, 0x39, 0x0a, 0x0d, 0x50, 0x61, 0x75, 0x73, 0x65, 0x44, 0x65, 0x6c, 0x69, 0x76, 0x65,
+	0x72, 0x79, 0x12, 0x13, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x49,
+	0x64, 0x65, 0x6e, 0x74, 0x69, 0x74, 0x79, 0x1a, 0x11, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72,
+	0x2e, 0x76, 0x32, 0x2e, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x22, 0x00, 0x12, 0x3a, 0x0a, 0x0e,
+	0x52, 0x65, 0x73, 0x75, 0x6d, 0x65, 0x44, 0x65, 0x6c, 0x69, 0x76, 0x65, 0x72, 0x79, 0x12, 0x13,
+	0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x49, 0x64, 0x65, 0x6e, 0x74,
+	0x69, 0x74, 0x79, 0x1a, 0x11, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e,
+	0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x22, 0x00, 0x12, 0x3e, 0x0a, 0x0b, 0x53, 0x65, 0x74, 0x52,
+	0x65, 0x61, 0x64, 0x4f, 0x6e, 0x6c, 0x79, 0x12, 0x1a, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72,
+	0x2e, 0x76, 0x32, 0x2e, 0x52, 0x65, 0x61, 0x64, 0x4f, 0x6e, 0x6c, 0x79, 0x52, 0x65, 0x71, 0x75,
+	0x65, 0x73, 0x74, 0x1a, 0x11, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e,
+	0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x22, 0x00, 0x12, 0x48, 0x0a, 0x0b, 0x57, 0x61, 0x74, 0x63,
+	0x68, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x73, 0x12, 0x1d, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72,
+	0x2e, 0x76, 0x32, 0x2e, 0x57, 0x61, 0x74, 0x63, 0x68, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x73, 0x52,
+	0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x16, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e,
+	0x76, 0x32, 0x2e, 0x42, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x45, 0x76, 0x65, 0x6e, 0x74, 0x22, 0x00,
+	0x30, 0x01, 0x12, 0x34, 0x0a, 0x03, 0x54, 0x61, 0x70, 0x12, 0x15, 0x2e, 0x62, 0x72, 0x6f, 0x6b,
+	0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x54, 0x61, 0x70, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74,
+	0x1a, 0x12, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x4d, 0x65, 0x73,
+	0x73, 0x61, 0x67, 0x65, 0x22, 0x00, 0x30, 0x01, 0x12, 0x4e, 0x0a, 0x0d, 0x47, 0x65, 0x74, 0x51,
+	0x75, 0x6f, 0x74, 0x61, 0x55, 0x73, 0x61, 0x67, 0x65, 0x12, 0x1c, 0x2e, 0x62, 0x72, 0x6f, 0x6b,
+	0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x51, 0x75, 0x6f, 0x74, 0x61, 0x55, 0x73, 0x61, 0x67, 0x65,
+	0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x1d, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72,
+	0x2e, 0x76, 0x32, 0x2e, 0x51, 0x75, 0x6f, 0x74, 0x61, 0x55, 0x73, 0x61, 0x67, 0x65, 0x52, 0x65,
+	0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x3e, 0x0a, 0x0b, 0x53, 0x65, 0x74, 0x4c,
+	0x6f, 0x67, 0x4c, 0x65, 0x76, 0x65, 0x6c, 0x12, 0x1a, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72,
+	0x2e, 0x76, 0x32, 0x2e, 0x4c, 0x6f, 0x67, 0x4c, 0x65, 0x76, 0x65, 0x6c, 0x52, 0x65, 0x71, 0x75,
+	0x65, 0x73, 0x74, 0x1a, 0x11, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e,
+	0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x22, 0x00, 0x12, 0x4a, 0x0a, 0x11, 0x53, 0x65, 0x74, 0x50,
+	0x61, 0x79, 0x6c, 0x6f, 0x61, 0x64, 0x4c, 0x6f, 0x67, 0x67, 0x69, 0x6e, 0x67, 0x12, 0x20, 0x2e,
+	0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x50, 0x61, 0x79, 0x6c, 0x6f, 0x61,
+	0x64, 0x4c, 0x6f, 0x67, 0x67, 0x69, 0x6e, 0x67, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a,
+	0x11, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x53, 0x74, 0x61, 0x74,
+	0x75, 0x73, 0x22, 0x00, 0x12, 0x44, 0x0a, 0x0e, 0x53, 0x65, 0x74, 0x53, 0x6c, 0x6f, 0x77, 0x4c,
+	0x6f, 0x67, 0x67, 0x69, 0x6e, 0x67, 0x12, 0x1d, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e,
+	0x76, 0x32, 0x2e, 0x53, 0x6c, 0x6f, 0x77, 0x4c, 0x6f, 0x67, 0x67, 0x69, 0x6e, 0x67, 0x52, 0x65,
+	0x71, 0x75, 0x65, 0x73, 0x74, 0x1a, 0x11, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76,
+	0x32, 0x2e, 0x53, 0x74, 0x61, 0x74, 0x75, 0x73, 0x22, 0x00, 0x12, 0x3f, 0x0a, 0x08, 0x47, 0x65,
+	0x74, 0x53, 0x74, 0x61, 0x74, 0x73, 0x12, 0x17, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e,
+	0x76, 0x32, 0x2e, 0x53, 0x74, 0x61, 0x74, 0x73, 0x52, 0x65, 0x71, 0x75, 0x65, 0x73, 0x74, 0x1a,
+	0x18, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x53, 0x74, 0x61, 0x74,
+	0x73, 0x52, 0x65, 0x73, 0x70, 0x6f, 0x6e, 0x73, 0x65, 0x22, 0x00, 0x12, 0x3e, 0x0a, 0x08, 0x46,
+	0x65, 0x64, 0x65, 0x72, 0x61, 0x74, 0x65, 0x12, 0x12, 0x2e, 0x62, 0x72, 0x6f, 0x6b, 0x65, 0x72,
+	0x2e, 0x76, 0x32, 0x2e, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x1a, 0x18, 0x2e, 0x62, 0x72,
+	0x6f, 0x6b, 0x65, 0x72, 0x2e, 0x76, 0x32, 0x2e, 0x46, 0x65, 0x64, 0x65, 0x72, 0x61, 0x74, 0x69,
+	0x6f, 0x6e, 0x41, 0x63, 0x6b, 0x22, 0x00, 0x28, 0x01, 0x30, 0x01, 0x42, 0x13, 0x5a, 0x11, 0x2e,
+	0x2f, 0x62, 0x61, 0x73, 0x65, 0x2f, 0x76, 0x32, 0x2f, 0x70, 0x62, 0x3b, 0x70, 0x62, 0x76, 0x32,
+	0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+}
+
+var (
+	file_v2_broker_proto_rawDescOnce sync.Once
+	file_v2_broker_proto_rawDescData = file_v2_broker_proto_rawDesc
+)
+
+func file_v2_broker_proto_rawDescGZIP() []byte {
+	file_v2_broker_proto_rawDescOnce.Do(func() {
+		file_v2_broker_proto_rawDescData = protoimpl.X.CompressGZIP(file_v2_broker_proto_rawDescData)
+	})
+	return file_v2_broker_proto_rawDescData
+}
+
+var file_v2_broker_proto_enumTypes = make([]protoimpl.EnumInfo, 5)
+var file_v2_broker_proto_msgTypes = make([]protoimpl.MessageInfo, 29)
+var file_v2_broker_proto_goTypes = []any{
+	(Type)(0),                        // 0: broker.v2.Type
+	(Event)(0),                       // 1: broker.v2.Event
+	(ChecksumType)(0),                // 2: broker.v2.ChecksumType
+	(Error)(0),                       // 3: broker.v2.Error
+	(BrokerEventType)(0),             // 4: broker.v2.BrokerEventType
+	(*Identity)(nil),                 // 5: broker.v2.Identity
+	(*Message)(nil),                  // 6: broker.v2.Message
+	(*Status)(nil),                   // 7: broker.v2.Status
+	(*Batch)(nil),                    // 8: broker.v2.Batch
+	(*AckRequest)(nil),               // 9: broker.v2.AckRequest
+	(*NackRequest)(nil),              // 10: broker.v2.NackRequest
+	(*ReadOnlyRequest)(nil),          // 11: broker.v2.ReadOnlyRequest
+	(*HelloRequest)(nil),             // 12: broker.v2.HelloRequest
+	(*HelloResponse)(nil),            // 13: broker.v2.HelloResponse
+	(*BrokerEvent)(nil),              // 14: broker.v2.BrokerEvent
+	(*WatchEventsRequest)(nil),       // 15: broker.v2.WatchEventsRequest
+	(*QuotaLimits)(nil),              // 16: broker.v2.QuotaLimits
+	(*QuotaUsage)(nil),               // 17: broker.v2.QuotaUsage
+	(*QuotaUsageRequest)(nil),        // 18: broker.v2.QuotaUsageRequest
+	(*QuotaUsageResponse)(nil),       // 19: broker.v2.QuotaUsageResponse
+	(*TapRequest)(nil),               // 20: broker.v2.TapRequest
+	(*FederationAck)(nil),            // 21: broker.v2.FederationAck
+	(*FetchRequest)(nil),             // 22: broker.v2.FetchRequest
+	(*FetchResponse)(nil),            // 23: broker.v2.FetchResponse
+	(*ExtendVisibilityRequest)(nil),  // 24: broker.v2.ExtendVisibilityRequest
+	(*ExtendVisibilityResponse)(nil), // 25: broker.v2.ExtendVisibilityResponse
+	(*LogLevelRequest)(nil),          // 26: broker.v2.LogLevelRequest
+	(*PayloadLoggingRequest)(nil),    // 27: broker.v2.PayloadLoggingRequest
+	(*SlowLoggingRequest)(nil),       // 28: broker.v2.SlowLoggingRequest
+	(*LatencyStats)(nil),             // 29: broker.v2.LatencyStats
+	(*DestinationStats)(nil),         // 30: broker.v2.DestinationStats
+	(*StatsRequest)(nil),             // 31: broker.v2.StatsRequest
+	(*StatsResponse)(nil),            // 32: broker.v2.StatsResponse
+	nil,                              // 33: broker.v2.Message.HeadersEntry
+	(*timestamppb.Timestamp)(nil),    // 34: google.protobuf.Timestamp
+	(*durationpb.Duration)(nil),      // 35: google.protobuf.Duration
+}
+var file_v2_broker_proto_depIdxs = []int32{
+	0,  // 0: broker.v2.Message.type:type_name -> broker.v2.Type
+	34, // 1: broker.v2.Message.seq:type_name -> google.protobuf.Timestamp
+	1,  // 2: broker.v2.Message.event:type_name -> broker.v2.Event
+	2,  // 3: broker.v2.Message.checksum_type:type_name -> broker.v2.ChecksumType
+	33, // 4: broker.v2.Message.headers:type_name -> broker.v2.Message.HeadersEntry
+	3,  // 5: broker.v2.Status.error:type_name -> broker.v2.Error
+	6,  // 6: broker.v2.Batch.messages:type_name -> broker.v2.Message
+	35, // 7: broker.v2.NackRequest.requeue_delay:type_name -> google.protobuf.Duration
+	4,  // 8: broker.v2.BrokerEvent.type:type_name -> broker.v2.BrokerEventType
+	34, // 9: broker.v2.BrokerEvent.time:type_name -> google.protobuf.Timestamp
+	4,  // 10: broker.v2.WatchEventsRequest.types:type_name -> broker.v2.BrokerEventType
+	16, // 11: broker.v2.QuotaUsage.limits:type_name -> broker.v2.QuotaLimits
+	34, // 12: broker.v2.QuotaUsage.hour_reset:type_name -> google.protobuf.Timestamp
+	34, // 13: broker.v2.QuotaUsage.day_reset:type_name -> google.protobuf.Timestamp
+	17, // 14: broker.v2.QuotaUsageResponse.usage:type_name -> broker.v2.QuotaUsage
+	7,  // 15: broker.v2.FederationAck.status:type_name -> broker.v2.Status
+	35, // 16: broker.v2.FetchRequest.visibility_timeout:type_name -> google.protobuf.Duration
+	6,  // 17: broker.v2.FetchResponse.messages:type_name -> broker.v2.Message
+	35, // 18: broker.v2.ExtendVisibilityRequest.duration:type_name -> google.protobuf.Duration
+	34, // 19: broker.v2.ExtendVisibilityResponse.visible_at:type_name -> google.protobuf.Timestamp
+	35, // 20: broker.v2.PayloadLoggingRequest.duration:type_name -> google.protobuf.Duration
+	35, // 21: broker.v2.SlowLoggingRequest.threshold:type_name -> google.protobuf.Duration
+	35, // 22: broker.v2.LatencyStats.sum:type_name -> google.protobuf.Duration
+	35, // 23: broker.v2.LatencyStats.p50:type_name -> google.protobuf.Duration
+	35, // 24: broker.v2.LatencyStats.p90:type_name -> google.protobuf.Duration
+	35, // 25: broker.v2.LatencyStats.p99:type_name -> google.protobuf.Duration
+	29, // 26: broker.v2.DestinationStats.enqueue_to_deliver:type_name -> broker.v2.LatencyStats
+	29, // 27: broker.v2.DestinationStats.deliver_to_ack:type_name -> broker.v2.LatencyStats
+	30, // 28: broker.v2.StatsResponse.destinations:type_name -> broker.v2.DestinationStats
+	12, // 29: broker.v2.Broker.Hello:input_type -> broker.v2.HelloRequest
+	5,  // 30: broker.v2.Broker.Ping:input_type -> broker.v2.Identity
+	6,  // 31: broker.v2.Broker.Send:input_type -> broker.v2.Message
+	8,  // 32: broker.v2.Broker.SendBatch:input_type -> broker.v2.Batch
+	5,  // 33: broker.v2.Broker.Receive:input_type -> broker.v2.Identity
+	5,  // 34: broker.v2.Broker.Cleanup:input_type -> broker.v2.Identity
+	9,  // 35: broker.v2.Broker.Ack:input_type -> broker.v2.AckRequest
+	10, // 36: broker.v2.Broker.Nack:input_type -> broker.v2.NackRequest
+	22, // 37: broker.v2.Broker.Fetch:input_type -> broker.v2.FetchRequest
+	24, // 38: broker.v2.Broker.ExtendVisibility:input_type -> broker.v2.ExtendVisibilityRequest
+	5,  // 39: broker.v2.Broker.PauseDelivery:input_type -> broker.v2.Identity
+	5,  // 40: broker.v2.Broker.ResumeDelivery:input_type -> broker.v2.Identity
+	11, // 41: broker.v2.Broker.SetReadOnly:input_type -> broker.v2.ReadOnlyRequest
+	15, // 42: broker.v2.Broker.WatchEvents:input_type -> broker.v2.WatchEventsRequest
+	20, // 43: broker.v2.Broker.Tap:input_type -> broker.v2.TapRequest
+	18, // 44: broker.v2.Broker.GetQuotaUsage:input_type -> broker.v2.QuotaUsageRequest
+	26, // 45: broker.v2.Broker.SetLogLevel:input_type -> broker.v2.LogLevelRequest
+	27, // 46: broker.v2.Broker.SetPayloadLogging:input_type -> broker.v2.PayloadLoggingRequest
+	28, // 47: broker.v2.Broker.SetSlowLogging:input_type -> broker.v2.SlowLoggingRequest
+	31, // 48: broker.v2.Broker.GetStats:input_type -> broker.v2.StatsRequest
+	6,  // 49: broker.v2.Broker.Federate:input_type -> broker.v2.Message
+	13, // 50: broker.v2.Broker.Hello:output_type -> broker.v2.HelloResponse
+	7,  // 51: broker.v2.Broker.Ping:output_type -> broker.v2.Status
+	7,  // 52: broker.v2.Broker.Send:output_type -> broker.v2.Status
+	7,  // 53: broker.v2.Broker.SendBatch:output_type -> broker.v2.Status
+	6,  // 54: broker.v2.Broker.Receive:output_type -> broker.v2.Message
+	7,  // 55: broker.v2.Broker.Cleanup:output_type -> broker.v2.Status
+	7,  // 56: broker.v2.Broker.Ack:output_type -> broker.v2.Status
+	7,  // 57: broker.v2.Broker.Nack:output_type -> broker.v2.Status
+	23, // 58: broker.v2.Broker.Fetch:output_type -> broker.v2.FetchResponse
+	25, // 59: broker.v2.Broker.ExtendVisibility:output_type -> broker.v2.ExtendVisibilityResponse
+	7,  // 60: broker.v2.Broker.PauseDelivery:output_type -> broker.v2.Status
+	7,  // 61: broker.v2.Broker.ResumeDelivery:output_type -> broker.v2.Status
+	7,  // 62: broker.v2.Broker.SetReadOnly:output_type -> broker.v2.Status
+	14, // 63: broker.v2.Broker.WatchEvents:output_type -> broker.v2.BrokerEvent
+	6,  // 64: broker.v2.Broker.Tap:output_type -> broker.v2.Message
+	19, // 65: broker.v2.Broker.GetQuotaUsage:output_type -> broker.v2.QuotaUsageResponse
+	7,  // 66: broker.v2.Broker.SetLogLevel:output_type -> broker.v2.Status
+	7,  // 67: broker.v2.Broker.SetPayloadLogging:output_type -> broker.v2.Status
+	7,  // 68: broker.v2.Broker.SetSlowLogging:output_type -> broker.v2.Status
+	32, // 69: broker.v2.Broker.GetStats:output_type -> broker.v2.StatsResponse
+	21, // 70: broker.v2.Broker.Federate:output_type -> broker.v2.FederationAck
+	50, // [50:71] is the sub-list for method output_type
+	29, // [29:50] is the sub-list for method input_type
+	29, // [29:29] is the sub-list for extension type_name
+	29, // [29:29] is the sub-list for extension extendee
+	0,  // [0:29] is the sub-list for field type_name
+}
+
+func init() { file_v2_broker_proto_init() }
+func file_v2_broker_proto_init() {
+	if File_v2_broker_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: file_v2_broker_proto_rawDesc,
+			NumEnums:      5,
+			NumMessages:   29,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_v2_broker_proto_goTypes,
+		DependencyIndexes: file_v2_broker_proto_depIdxs,
+		EnumInfos:         file_v2_broker_proto_enumTypes,
+		MessageInfos:      file_v2_broker_proto_msgTypes,
+	}.Build()
+	File_v2_broker_proto = out.File
+	file_v2_broker_proto_rawDesc = nil
+	file_v2_broker_proto_goTypes = nil
+	file_v2_broker_proto_depIdxs = nil
+}
@@ -0,0 +1,231 @@
+// Package broker runs the Microservices Broker in-process, for tests and small
+// deployments that do not want to manage the CLI binary:
+//
+//	b := broker.New(broker.Options{DBPath: dir, Address: "127.0.0.1:0"})
+//	if err := b.Start(ctx); err != nil { ... }
+//	defer b.Stop()
+//	c, err := b.Client("billing")
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	pbv2 "github.com/ispapp/Microservices-Broker/base/v2/pb"
+	"github.com/ispapp/Microservices-Broker/client"
+	"github.com/ispapp/Microservices-Broker/cmd/lib"
+
+	"google.golang.org/grpc"
+)
+
+// Options configures an embedded broker. Zero values fall back to the CLI defaults.
+type Options struct {
+	// DBPath is the bitcask directory holding queued messages (required)
+	DBPath string
+	// Address is the gRPC listen address, e.g. "127.0.0.1:0" for a free port.
+	// Empty serves no network listener; queues are still available programmatically.
+	Address string
+	// Listener serves gRPC on an existing listener instead of Address
+	Listener net.Listener
+
+	TickSeconds int16
+	MaxStored   int32
+	MaxAge      time.Duration
+
+	// Auth enables authentication; nil serves without it
+	Auth *lib.AuthConfig
+	// Interceptors is the gRPC middleware pipeline, outermost first (lib.DefaultInterceptors when empty)
+	Interceptors []string
+	// ServerOptions and GRPCOptions are passed to lib.NewServer and grpc.NewServer
+	ServerOptions []lib.ServerOption
+	GRPCOptions   []grpc.ServerOption
+}
+
+// Broker is an embedded broker instance
+type Broker struct {
+	opts     Options
+	server   *lib.Server
+	auth     *lib.AuthManager
+	grpc     *grpc.Server
+	listener net.Listener
+	serveErr chan error
+	stopOnce sync.Once
+	stopErr  error
+}
+
+// ErrNotStarted is returned by methods that need a running broker
+var ErrNotStarted = errors.New("broker not started")
+
+// New returns a broker configured with opts. Call Start to open the database and serve.
+func New(opts Options) *Broker {
+	if opts.TickSeconds <= 0 {
+		opts.TickSeconds = 60
+	}
+	if opts.MaxStored <= 0 {
+		opts.MaxStored = 100
+	}
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = 24 * time.Hour
+	}
+	return &Broker{opts: opts}
+}
+
+// Start opens the database and serves gRPC in the background. The broker stops when
+// ctx is done or Stop is called.
+func (b *Broker) Start(ctx context.Context) error {
+	if b.server != nil {
+		return errors.New("broker already started")
+	}
+	if b.opts.DBPath == "" {
+		return errors.New("broker: DBPath is required")
+	}
+	server, err := lib.NewServer(b.opts.DBPath, b.opts.TickSeconds, b.opts.MaxStored, b.opts.MaxAge, b.opts.ServerOptions...)
+	if err != nil {
+		return fmt.Errorf("failed to create server: %w", err)
+	}
+	b.server = server
+	opts, err := b.grpcOptions()
+	if err != nil {
+		server.Close()
+		return fmt.Errorf("invalid interceptor pipeline: %w", err)
+	}
+
+	lis := b.opts.Listener
+	if lis == nil && b.opts.Address != "" {
+		if lis, err = net.Listen("tcp", b.opts.Address); err != nil {
+			server.Close()
+			return fmt.Errorf("failed to listen: %w", err)
+		}
+	}
+	if lis != nil {
+		b.listener = lis
+		b.grpc = grpc.NewServer(opts...)
+		pb.RegisterBrokerServer(b.grpc, server)
+		pbv2.RegisterBrokerServer(b.grpc, lib.NewV2Server(server))
+		b.serveErr = make(chan error, 1)
+		go func() {
+			b.serveErr <- b.grpc.Serve(lis)
+		}()
+	}
+
+	go func() {
+		<-ctx.Done()
+		b.Stop()
+	}()
+	return nil
+}
+
+// grpcOptions chains the configured interceptors like `broker serve`
+func (b *Broker) grpcOptions() ([]grpc.ServerOption, error) {
+	var auth *lib.AuthManager
+	if b.opts.Auth != nil && b.opts.Auth.EnableAuth {
+		b.auth = lib.NewAuthManager(b.opts.Auth)
+		b.server.AuditAuth(b.auth)
+		auth = b.auth
+	}
+	opts, err := b.server.GRPCOptions(b.opts.Interceptors, auth)
+	if err != nil {
+		return nil, err
+	}
+	return append(opts, b.opts.GRPCOptions...), nil
+}
+
+// Stop stops serving and closes the database. It is safe to call more than once.
+func (b *Broker) Stop() error {
+	if b.server == nil {
+		return ErrNotStarted
+	}
+	b.stopOnce.Do(func() {
+		if b.grpc != nil {
+			// Receive streams only end when their clients disconnect
+			b.grpc.Stop()
+			if err := <-b.serveErr; err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+				b.stopErr = err
+			}
+		}
+		if err := b.server.Close(); err != nil && b.stopErr == nil {
+			b.stopErr = err
+		}
+	})
+	return b.stopErr
+}
+
+// Addr returns the address gRPC is served on, or nil without a listener
+func (b *Broker) Addr() net.Addr {
+	if b.listener == nil {
+		return nil
+	}
+	return b.listener.Addr()
+}
+
+// Server returns the underlying server, e.g. to call RPC handlers directly
+func (b *Broker) Server() *lib.Server {
+	return b.server
+}
+
+// AuthManager returns the authentication manager, or nil when authentication is disabled
+func (b *Broker) AuthManager() *lib.AuthManager {
+	return b.auth
+}
+
+// Client connects a Go client for service to the broker. With authentication
+// enabled, an API key is generated for the service.
+func (b *Broker) Client(service string) (*client.AuthenticatedClient, error) {
+	if b.listener == nil {
+		return nil, ErrNotStarted
+	}
+	c, err := client.NewAuthenticatedClient(b.Addr().String(), service, "apikey", false, "")
+	if err != nil {
+		return nil, err
+	}
+	if b.auth != nil {
+		c.SetAPIKey(b.auth.GenerateAPIKey(service))
+	}
+	return c, nil
+}
+
+// Send delivers or queues a message as if it was sent over gRPC
+func (b *Broker) Send(ctx context.Context, msg *pb.Message) (*pb.Status, error) {
+	if b.server == nil {
+		return nil, ErrNotStarted
+	}
+	return b.server.Send(ctx, msg)
+}
+
+// Queue returns up to limit messages queued for service, oldest first, without delivering them
+func (b *Broker) Queue(service string, limit int) ([]*pb.Message, error) {
+	if b.server == nil {
+		return nil, ErrNotStarted
+	}
+	return b.server.QueuedMessages(service, limit)
+}
+
+// QueueLength returns the number of messages queued for service
+func (b *Broker) QueueLength(service string) (int, error) {
+	if b.server == nil {
+		return 0, ErrNotStarted
+	}
+	return b.server.QueueLength(service)
+}
+
+// Queues returns the number of queued messages per service
+func (b *Broker) Queues() (map[string]int, error) {
+	if b.server == nil {
+		return nil, ErrNotStarted
+	}
+	return b.server.Queues()
+}
+
+// Purge deletes every message queued for service
+func (b *Broker) Purge(ctx context.Context, service string) error {
+	if b.server == nil {
+		return ErrNotStarted
+	}
+	_, err := b.server.Cleanup(ctx, &pb.Identity{From: service})
+	return err
+}
@@ -0,0 +1,98 @@
+// Package brokertest provides a broker served over an in-memory connection and
+// fake clients, so services can test their messaging code without running the
+// broker binary or opening ports:
+//
+//	func TestBilling(t *testing.T) {
+//		b := brokertest.New(t)
+//		producer := b.Client(t, "orders")
+//		consumer := b.Client(t, "billing")
+//		...
+//	}
+package brokertest
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/broker"
+	"github.com/ispapp/Microservices-Broker/client"
+	"github.com/ispapp/Microservices-Broker/cmd/lib"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// bufferSize is the in-memory connection buffer
+const bufferSize = 1 << 20
+
+// Broker is a broker served over bufconn. Queued messages live in a temporary
+// directory that is removed when the test ends.
+type Broker struct {
+	*broker.Broker
+	listener *bufconn.Listener
+}
+
+// New starts a broker for the duration of the test. Messages never expire and
+// opts are applied on top of the defaults.
+func New(tb testing.TB, opts ...lib.ServerOption) *Broker {
+	tb.Helper()
+	return NewWithOptions(tb, broker.Options{
+		TickSeconds:   3600,
+		MaxAge:        100 * 365 * 24 * time.Hour,
+		ServerOptions: opts,
+	})
+}
+
+// NewWithOptions starts a broker configured with opts for the duration of the
+// test. DBPath, Address and Listener are replaced.
+func NewWithOptions(tb testing.TB, opts broker.Options) *Broker {
+	tb.Helper()
+	listener := bufconn.Listen(bufferSize)
+	opts.DBPath = tb.TempDir()
+	opts.Address = ""
+	opts.Listener = listener
+	b := &Broker{Broker: broker.New(opts), listener: listener}
+	if err := b.Start(context.Background()); err != nil {
+		tb.Fatalf("brokertest: failed to start broker: %v", err)
+	}
+	tb.Cleanup(func() {
+		if err := b.Stop(); err != nil {
+			tb.Errorf("brokertest: failed to stop broker: %v", err)
+		}
+	})
+	return b
+}
+
+// DialOptions returns the options that connect a gRPC client to the broker
+func (b *Broker) DialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return b.listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}
+}
+
+// Dial opens an in-memory connection to the broker, for custom dialers such as
+// one routing between several test brokers
+func (b *Broker) Dial(ctx context.Context) (net.Conn, error) {
+	return b.listener.DialContext(ctx)
+}
+
+// Client connects a Go client for service, closed when the test ends. With
+// authentication enabled, an API key is generated for the service.
+func (b *Broker) Client(tb testing.TB, service string) *client.AuthenticatedClient {
+	tb.Helper()
+	c, err := client.NewAuthenticatedClientWithOptions("passthrough:///bufconn", service, "apikey", b.DialOptions()...)
+	if err != nil {
+		tb.Fatalf("brokertest: failed to connect %s: %v", service, err)
+	}
+	if auth := b.AuthManager(); auth != nil {
+		c.SetAPIKey(auth.GenerateAPIKey(service))
+	}
+	tb.Cleanup(func() { c.Close() })
+	return c
+}
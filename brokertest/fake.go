@@ -0,0 +1,186 @@
+package brokertest
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/client"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// FakeNetwork routes messages between fake clients in memory
+type FakeNetwork struct {
+	mu      sync.Mutex
+	clients map[string]*FakeClient
+}
+
+// NewFakeNetwork returns an empty network
+func NewFakeNetwork() *FakeNetwork {
+	return &FakeNetwork{clients: make(map[string]*FakeClient)}
+}
+
+// Client returns the fake client of a service, creating it on first use
+func (n *FakeNetwork) Client(service string) *FakeClient {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if c, ok := n.clients[service]; ok {
+		return c
+	}
+	c := NewFakeClient(service)
+	c.network = n
+	n.clients[service] = c
+	return c
+}
+
+// lookup returns the fake client of a service, if any
+func (n *FakeNetwork) lookup(service string) (*FakeClient, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	c, ok := n.clients[service]
+	return c, ok
+}
+
+// FakeClient is an in-memory client.Client. It records sent messages and
+// delivers messages passed to Deliver, or sent to it over its FakeNetwork, to Receive.
+type FakeClient struct {
+	Service string
+	// SendErr, when set, is returned by Send instead of sending
+	SendErr error
+
+	network *FakeNetwork
+	mu      sync.Mutex
+	sent    []*pb.Message
+	inbox   []*pb.Message
+	notify  chan struct{}
+	closed  bool
+}
+
+var _ client.Client = (*FakeClient)(nil)
+
+// NewFakeClient returns a standalone fake client for service
+func NewFakeClient(service string) *FakeClient {
+	return &FakeClient{Service: service, notify: make(chan struct{})}
+}
+
+// Ping always succeeds
+func (f *FakeClient) Ping(ctx context.Context) (*pb.Status, error) {
+	return &pb.Status{Message: "Pong", Success: true, Error: pb.Error_NONE}, nil
+}
+
+// Send records the message and, on a FakeNetwork, delivers it to the recipient.
+// Like the broker, it fails with RECIPIENT_OFFLINE for an unknown recipient unless queue is set.
+func (f *FakeClient) Send(ctx context.Context, to string, data []byte, msgType pb.Type, queue bool) (*pb.Status, error) {
+	if f.SendErr != nil {
+		return nil, f.SendErr
+	}
+	msg := &pb.Message{Data: data, Type: msgType, From: f.Service, To: to, Queue: queue, Event: pb.Event_MESSAGE, Seq: timestamppb.Now()}
+	f.mu.Lock()
+	f.sent = append(f.sent, msg)
+	f.mu.Unlock()
+	if f.network == nil {
+		return &pb.Status{Message: "Message sent", Success: true, Error: pb.Error_NONE}, nil
+	}
+	recipient, ok := f.network.lookup(to)
+	if !ok && !queue {
+		return &pb.Status{Message: "Recipient offline", Success: false, Error: pb.Error_RECIPIENT_OFFLINE}, client.ErrRecipientOffline
+	}
+	if !ok {
+		recipient = f.network.Client(to)
+	}
+	recipient.Deliver(msg)
+	return &pb.Status{Message: "Message sent", Success: true, Error: pb.Error_NONE}, nil
+}
+
+// Sent returns the messages sent so far
+func (f *FakeClient) Sent() []*pb.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*pb.Message(nil), f.sent...)
+}
+
+// Deliver queues a message for Receive
+func (f *FakeClient) Deliver(msg *pb.Message) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inbox = append(f.inbox, msg)
+	close(f.notify)
+	f.notify = make(chan struct{})
+}
+
+// Receive returns a stream of delivered messages. Recv blocks until a message
+// arrives, ctx is done or the client is closed (io.EOF).
+func (f *FakeClient) Receive(ctx context.Context) (pb.Broker_ReceiveClient, error) {
+	return &fakeStream{ctx: ctx, client: f}, nil
+}
+
+// Cleanup drops undelivered messages
+func (f *FakeClient) Cleanup(ctx context.Context) (*pb.Status, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inbox = nil
+	return &pb.Status{Message: "Cleanup completed", Success: true, Error: pb.Error_NONE}, nil
+}
+
+// Close ends open Receive streams
+func (f *FakeClient) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.closed {
+		f.closed = true
+		close(f.notify)
+	}
+	return nil
+}
+
+// next pops the next delivered message, waiting for one
+func (f *FakeClient) next(ctx context.Context) (*pb.Message, error) {
+	for {
+		f.mu.Lock()
+		if len(f.inbox) > 0 {
+			msg := f.inbox[0]
+			f.inbox = f.inbox[1:]
+			f.mu.Unlock()
+			return msg, nil
+		}
+		if f.closed {
+			f.mu.Unlock()
+			return nil, io.EOF
+		}
+		notify := f.notify
+		f.mu.Unlock()
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// fakeStream implements pb.Broker_ReceiveClient on top of a FakeClient
+type fakeStream struct {
+	ctx    context.Context
+	client *FakeClient
+}
+
+func (s *fakeStream) Recv() (*pb.Message, error)   { return s.client.next(s.ctx) }
+func (s *fakeStream) Header() (metadata.MD, error) { return metadata.MD{}, nil }
+func (s *fakeStream) Trailer() metadata.MD         { return metadata.MD{} }
+func (s *fakeStream) CloseSend() error             { return nil }
+func (s *fakeStream) Context() context.Context     { return s.ctx }
+func (s *fakeStream) SendMsg(m any) error          { return nil }
+
+func (s *fakeStream) RecvMsg(m any) error {
+	msg, err := s.Recv()
+	if err != nil {
+		return err
+	}
+	out := m.(*pb.Message)
+	proto.Reset(out)
+	proto.Merge(out, msg)
+	return nil
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+)
+
+// Defaults for the asynchronous send pool
+const (
+	DefaultAsyncWorkers     = 16
+	DefaultAsyncMaxInFlight = 1024
+)
+
+// ErrClientClosed is reported for sends issued after Close, and for sends and Receive
+// streams once Shutdown has started
+var ErrClientClosed = errors.New("client is closed")
+
+// SendResult is the outcome of an asynchronous send
+type SendResult struct {
+	Status *pb.Status
+	Err    error
+}
+
+// asyncJob is a queued asynchronous send
+type asyncJob struct {
+	ctx    context.Context
+	msg    *pb.Message
+	result chan SendResult
+}
+
+// asyncPool runs asynchronous sends on a fixed number of workers with a bounded number in flight
+type asyncPool struct {
+	mu          sync.RWMutex
+	workers     int
+	maxInFlight int
+	jobs        chan asyncJob
+	slots       chan struct{}
+	closed      bool
+	wg          sync.WaitGroup
+}
+
+// SetAsyncLimits configures the worker count and the maximum number of sends
+// queued or running at once. It must be called before the first SendAsync.
+func (ac *AuthenticatedClient) SetAsyncLimits(workers, maxInFlight int) {
+	ac.async.mu.Lock()
+	defer ac.async.mu.Unlock()
+	ac.async.workers = workers
+	ac.async.maxInFlight = maxInFlight
+}
+
+// SendAsync queues msg and returns immediately; the result is delivered on the returned channel.
+// When the in-flight limit is reached it blocks until a slot frees up or ctx ends.
+func (ac *AuthenticatedClient) SendAsync(ctx context.Context, msg *pb.Message) <-chan SendResult {
+	result := make(chan SendResult, 1)
+	if ac.life.isDraining() {
+		result <- SendResult{Err: ErrClientClosed}
+		return result
+	}
+	if msg.From == "" {
+		msg.From = ac.address()
+	}
+
+	p := &ac.async
+	p.mu.RLock()
+	if p.jobs == nil {
+		// Start the workers on first use
+		p.mu.RUnlock()
+		ac.startAsync()
+		p.mu.RLock()
+	}
+	defer p.mu.RUnlock()
+	if p.closed {
+		result <- SendResult{Err: ErrClientClosed}
+		return result
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+		p.jobs <- asyncJob{ctx: ctx, msg: msg, result: result}
+	case <-ctx.Done():
+		result <- SendResult{Err: ctx.Err()}
+	}
+	return result
+}
+
+// startAsync starts the send workers once
+func (ac *AuthenticatedClient) startAsync() {
+	p := &ac.async
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.jobs != nil || p.closed {
+		return
+	}
+	if p.workers <= 0 {
+		p.workers = DefaultAsyncWorkers
+	}
+	if p.maxInFlight <= 0 {
+		p.maxInFlight = DefaultAsyncMaxInFlight
+	}
+	p.jobs = make(chan asyncJob, p.maxInFlight)
+	p.slots = make(chan struct{}, p.maxInFlight)
+	for i := 0; i < p.workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				status, err := ac.sendMessage(job.ctx, job.msg)
+				<-p.slots
+				job.result <- SendResult{Status: status, Err: err}
+			}
+		}()
+	}
+}
+
+// stopAsync waits for queued sends to finish and stops the workers
+func (ac *AuthenticatedClient) stopAsync() {
+	p := &ac.async
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	if p.jobs != nil {
+		close(p.jobs)
+	}
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+// SendAsync queues msg on the next connection
+func (p *PooledClient) SendAsync(ctx context.Context, msg *pb.Message) <-chan SendResult {
+	return p.Pick().SendAsync(ctx, msg)
+}
+
+// SetAsyncLimits configures the asynchronous send pool of every connection
+func (p *PooledClient) SetAsyncLimits(workers, maxInFlight int) {
+	for _, conn := range p.conns {
+		conn.SetAsyncLimits(workers, maxInFlight)
+	}
+}
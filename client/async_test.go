@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSendAsyncInFlightLimit(t *testing.T) {
+	f := &fakeBroker{sendGate: make(chan struct{})}
+	c := newFakeClient(t, f, "orders", WithRetry(NoRetry))
+	c.SetAsyncLimits(2, 3)
+	ctx := testContext(t)
+
+	var results []<-chan SendResult
+	for range 3 {
+		results = append(results, c.SendAsync(ctx, &pb.Message{To: "billing", Data: []byte("x"), Queue: true}))
+	}
+	// The limit is reached: the next send waits for a slot until its context ends
+	short, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	blocked := <-c.SendAsync(short, &pb.Message{To: "billing", Data: []byte("x"), Queue: true})
+	if !errors.Is(blocked.Err, context.DeadlineExceeded) {
+		t.Fatalf("expected the send over the limit to give up with its context, got %v", blocked.Err)
+	}
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Fatalf("expected the send over the limit to wait for a slot, returned after %s", elapsed)
+	}
+
+	// Two workers run the three sends, two at a time
+	for range 3 {
+		f.sendGate <- struct{}{}
+	}
+	for i, result := range results {
+		if r := <-result; r.Err != nil || !r.Status.Success {
+			t.Fatalf("send %d: expected success, got %v (%v)", i, r.Status, r.Err)
+		}
+	}
+	f.mu.Lock()
+	peak, sent := f.peak, len(f.sent)
+	f.mu.Unlock()
+	if peak != 2 || sent != 3 {
+		t.Fatalf("expected 3 sends at most 2 at a time, got %d with %d at once", sent, peak)
+	}
+
+	// A freed slot takes the next send
+	close(f.sendGate)
+	if r := <-c.SendAsync(ctx, &pb.Message{To: "billing", Data: []byte("x")}); r.Err != nil {
+		t.Fatalf("expected a send after the limit cleared to succeed, got %v", r.Err)
+	}
+}
+
+func TestSendAsyncResults(t *testing.T) {
+	f := &fakeBroker{sendErrors: []error{status.Error(codes.InvalidArgument, "bad message")}}
+	c := newFakeClient(t, f, "orders", WithRetry(NoRetry))
+	ctx := testContext(t)
+
+	if r := <-c.SendAsync(ctx, &pb.Message{To: "billing", Data: []byte("x")}); status.Code(r.Err) != codes.InvalidArgument {
+		t.Fatalf("expected the broker's error, got %v", r.Err)
+	}
+	if r := <-c.SendAsync(ctx, &pb.Message{To: "billing", Data: []byte("x")}); r.Err != nil {
+		t.Fatalf("SendAsync failed: %v", r.Err)
+	}
+	if from := f.sent[1].From; from != "orders" {
+		t.Fatalf("expected the client's service as sender, got %q", from)
+	}
+
+	c.Close()
+	if r := <-c.SendAsync(ctx, &pb.Message{To: "billing", Data: []byte("x")}); !errors.Is(r.Err, ErrClientClosed) {
+		t.Fatalf("expected ErrClientClosed after Close, got %v", r.Err)
+	}
+}
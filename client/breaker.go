@@ -0,0 +1,159 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrCircuitOpen is returned without contacting the broker while the circuit breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// BreakerState is the state of a circuit breaker
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // calls flow normally
+	BreakerOpen                         // calls fail fast with ErrCircuitOpen
+	BreakerHalfOpen                     // a single probe call decides whether to close again
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// BreakerConfig configures a circuit breaker
+type BreakerConfig struct {
+	FailureThreshold int                         // consecutive failures that open the circuit (default 5)
+	OpenTimeout      time.Duration               // time spent open before a probe is let through (default 10s)
+	IsFailure        func(error) bool            // errors that count as failures (default: broker unavailable or overloaded)
+	OnStateChange    func(from, to BreakerState) // called on every transition, outside the breaker lock
+}
+
+// CircuitBreaker fails calls fast after repeated failures and probes the broker periodically
+type CircuitBreaker struct {
+	mu       sync.Mutex
+	config   BreakerConfig
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	// generation counts state changes; outcomes of calls admitted in an earlier
+	// generation are ignored
+	generation uint64
+}
+
+// NewCircuitBreaker creates a closed circuit breaker
+func NewCircuitBreaker(config BreakerConfig) *CircuitBreaker {
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = 5
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = 10 * time.Second
+	}
+	if config.IsFailure == nil {
+		config.IsFailure = isBrokerFailure
+	}
+	return &CircuitBreaker{config: config}
+}
+
+// isBrokerFailure reports errors that indicate the broker, not the request, is at fault
+func isBrokerFailure(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Internal, codes.Unknown:
+		return true
+	default:
+		return false
+	}
+}
+
+// State returns the current state
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// setState moves to state and starts a new generation; b.mu must be held
+func (b *CircuitBreaker) setState(state BreakerState) {
+	b.state = state
+	b.generation++
+	b.failures = 0
+	b.probing = false
+	if state == BreakerOpen {
+		b.openedAt = time.Now()
+	}
+}
+
+// Allow reports whether a call may proceed, returning ErrCircuitOpen if not. Every
+// allowed call must be followed by Record with the returned generation.
+func (b *CircuitBreaker) Allow() (uint64, error) {
+	b.mu.Lock()
+	from := b.state
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.config.OpenTimeout {
+			b.mu.Unlock()
+			return 0, ErrCircuitOpen
+		}
+		b.setState(BreakerHalfOpen)
+		b.probing = true
+	case BreakerHalfOpen:
+		if b.probing {
+			b.mu.Unlock()
+			return 0, ErrCircuitOpen
+		}
+		b.probing = true
+	}
+	to, generation := b.state, b.generation
+	b.mu.Unlock()
+	b.notify(from, to)
+	return generation, nil
+}
+
+// Record reports the outcome of a call allowed in generation. Outcomes of calls
+// admitted before the last state change are stale and ignored: a call that started
+// before the circuit opened neither closes it nor takes the place of the probe.
+func (b *CircuitBreaker) Record(generation uint64, err error) {
+	b.mu.Lock()
+	if generation != b.generation {
+		b.mu.Unlock()
+		return
+	}
+	from := b.state
+	failed := err != nil && b.config.IsFailure(err)
+	switch {
+	case b.state == BreakerHalfOpen && failed:
+		b.setState(BreakerOpen)
+	case b.state == BreakerHalfOpen:
+		b.setState(BreakerClosed)
+	case failed:
+		b.failures++
+		if b.failures >= b.config.FailureThreshold {
+			b.setState(BreakerOpen)
+		}
+	default:
+		b.failures = 0
+	}
+	to := b.state
+	b.mu.Unlock()
+	b.notify(from, to)
+}
+
+func (b *CircuitBreaker) notify(from, to BreakerState) {
+	if from != to && b.config.OnStateChange != nil {
+		b.config.OnStateChange(from, to)
+	}
+}
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var errBrokerDown = status.Error(codes.Unavailable, "broker down")
+
+// call runs a call through b that ends with err
+func call(t *testing.T, b *CircuitBreaker, err error) {
+	t.Helper()
+	generation, allowErr := b.Allow()
+	if allowErr != nil {
+		t.Fatalf("expected the call to be allowed in state %s, got %v", b.State(), allowErr)
+	}
+	b.Record(generation, err)
+}
+
+func TestBreakerOpensAfterThreshold(t *testing.T) {
+	b := NewCircuitBreaker(BreakerConfig{FailureThreshold: 3, OpenTimeout: time.Hour})
+
+	// A success resets the count, and so does an error of the request
+	call(t, b, errBrokerDown)
+	call(t, b, errBrokerDown)
+	call(t, b, nil)
+	call(t, b, errBrokerDown)
+	call(t, b, errBrokerDown)
+	call(t, b, status.Error(codes.InvalidArgument, "bad message"))
+	call(t, b, errBrokerDown)
+	call(t, b, errBrokerDown)
+	if b.State() != BreakerClosed {
+		t.Fatalf("expected the breaker to stay closed, got %s", b.State())
+	}
+	call(t, b, errBrokerDown)
+	if b.State() != BreakerOpen {
+		t.Fatalf("expected the breaker to open after 3 failures in a row, got %s", b.State())
+	}
+	if _, err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+}
+
+func TestBreakerHalfOpenProbe(t *testing.T) {
+	var mu sync.Mutex
+	var changes []BreakerState
+	b := NewCircuitBreaker(BreakerConfig{
+		FailureThreshold: 1,
+		OpenTimeout:      20 * time.Millisecond,
+		OnStateChange: func(from, to BreakerState) {
+			mu.Lock()
+			changes = append(changes, to)
+			mu.Unlock()
+		},
+	})
+	call(t, b, errBrokerDown)
+
+	// A single probe is let through once the open timeout has passed
+	time.Sleep(30 * time.Millisecond)
+	probe, err := b.Allow()
+	if err != nil || b.State() != BreakerHalfOpen {
+		t.Fatalf("expected a probe in the half-open state, got %s (%v)", b.State(), err)
+	}
+	if _, err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected a second call during the probe to fail fast, got %v", err)
+	}
+	b.Record(probe, errBrokerDown)
+	if b.State() != BreakerOpen {
+		t.Fatalf("expected a failed probe to open the breaker again, got %s", b.State())
+	}
+	if _, err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected the open timeout to start over, got %v", err)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	call(t, b, nil)
+	if b.State() != BreakerClosed {
+		t.Fatalf("expected a successful probe to close the breaker, got %s", b.State())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []BreakerState{BreakerOpen, BreakerHalfOpen, BreakerOpen, BreakerHalfOpen, BreakerClosed}
+	if !slices.Equal(changes, want) {
+		t.Fatalf("expected transitions %v, got %v", want, changes)
+	}
+}
+
+func TestBreakerIgnoresStaleOutcomes(t *testing.T) {
+	b := NewCircuitBreaker(BreakerConfig{FailureThreshold: 2, OpenTimeout: 20 * time.Millisecond})
+
+	// Calls admitted while closed finish after the breaker opened
+	slow, _ := b.Allow()
+	slower, _ := b.Allow()
+	call(t, b, errBrokerDown)
+	call(t, b, errBrokerDown)
+	b.Record(slow, nil)
+	if b.State() != BreakerOpen {
+		t.Fatalf("expected a success admitted before the breaker opened not to close it, got %s", b.State())
+	}
+
+	// Nor does it stand in for the probe
+	time.Sleep(30 * time.Millisecond)
+	probe, err := b.Allow()
+	if err != nil {
+		t.Fatalf("expected a probe, got %v", err)
+	}
+	b.Record(slower, errBrokerDown)
+	if b.State() != BreakerHalfOpen {
+		t.Fatalf("expected a stale failure not to end the probe, got %s", b.State())
+	}
+	if _, err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected a single probe at a time, got %v", err)
+	}
+	b.Record(probe, nil)
+	if b.State() != BreakerClosed {
+		t.Fatalf("expected the probe to close the breaker, got %s", b.State())
+	}
+
+	// Recording the probe twice counts once
+	b.Record(probe, errBrokerDown)
+	call(t, b, errBrokerDown)
+	if b.State() != BreakerClosed {
+		t.Fatalf("expected a single failure after closing, got %s", b.State())
+	}
+}
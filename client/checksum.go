@@ -0,0 +1,76 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/ispapp/Microservices-Broker/base/checksum"
+	"github.com/ispapp/Microservices-Broker/base/pb"
+)
+
+// ErrChecksumMismatch is matched (errors.Is) by Send errors when the broker received
+// corrupted data, and by Recv errors when a delivered message fails verification
+var ErrChecksumMismatch = checksum.ErrMismatch
+
+// SetChecksum makes Send attach a checksum of the data to every message (NO_CHECKSUM disables)
+func (ac *AuthenticatedClient) SetChecksum(algorithm pb.ChecksumType) {
+	ac.checksum = algorithm
+}
+
+// verifyingStream reassembles chunked messages, redeems the claim checks and checks the
+// checksum of every received message, and drops the broker's keepalive probes and
+// heartbeats
+type verifyingStream struct {
+	pb.Broker_ReceiveClient
+	chunked *pb.Message // the parts of a chunked message received so far
+}
+
+// Recv returns the next message, with its payload downloaded when the broker kept it in
+// object storage. A message that fails verification is returned together with an error
+// matching ErrChecksumMismatch, or ErrClaimCheck when its payload cannot be downloaded,
+// so manual-ack consumers can Nack it.
+func (s *verifyingStream) Recv() (*pb.Message, error) {
+	for {
+		msg, err := s.Broker_ReceiveClient.Recv()
+		if err != nil {
+			return msg, err
+		}
+		if msg.Event == pb.Event_KEEPALIVE || isHeartbeat(msg) {
+			continue
+		}
+		if msg.Chunk > 0 {
+			if msg, err = s.reassemble(msg); err != nil {
+				return nil, err
+			}
+			if msg == nil {
+				continue
+			}
+		}
+		if err := redeem(s.Context(), msg); err != nil {
+			return msg, err
+		}
+		return msg, checksum.Verify(msg)
+	}
+}
+
+// reassemble collects the parts of a message the broker delivered in chunks and returns
+// the message once its last part arrived. The broker sends the parts of a message one
+// after the other, a gap means the stream lost some.
+func (s *verifyingStream) reassemble(part *pb.Message) (*pb.Message, error) {
+	switch {
+	case part.Chunk == 1:
+		s.chunked = part
+	case s.chunked == nil || part.Chunk != s.chunked.Chunk+1:
+		s.chunked = nil
+		return nil, fmt.Errorf("part %d of chunked message %s arrived out of order", part.Chunk, part.Id)
+	default:
+		s.chunked.Data = append(s.chunked.Data, part.Data...)
+		s.chunked.Chunk = part.Chunk
+	}
+	if !part.Done {
+		return nil, nil
+	}
+	msg := s.chunked
+	s.chunked = nil
+	msg.Chunk, msg.Done = 0, false
+	return msg, nil
+}
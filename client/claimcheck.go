@@ -0,0 +1,60 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+)
+
+// ErrClaimCheck is matched (errors.Is) by Recv and Fetch errors when the payload of a
+// message the broker kept in object storage cannot be downloaded
+var ErrClaimCheck = errors.New("claim check")
+
+// redeem downloads the payload of a message the broker kept in object storage and
+// puts it back in the message, without the claim check headers
+func redeem(ctx context.Context, msg *pb.Message) error {
+	if !protocol.IsClaimCheck(msg.Headers) {
+		return nil
+	}
+	url := msg.Headers[protocol.ClaimCheckURLHeader]
+	if url == "" {
+		return fmt.Errorf("%w: message %s has no download url", ErrClaimCheck, msg.Id)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrClaimCheck, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrClaimCheck, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: object store answered %s", ErrClaimCheck, resp.Status)
+	}
+	size, err := strconv.Atoi(msg.Headers[protocol.ClaimCheckSizeHeader])
+	if err != nil {
+		return fmt.Errorf("%w: invalid size %q", ErrClaimCheck, msg.Headers[protocol.ClaimCheckSizeHeader])
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(size)+1))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrClaimCheck, err)
+	}
+	if len(data) != size {
+		return fmt.Errorf("%w: expected %d bytes, got %d", ErrClaimCheck, size, len(data))
+	}
+	msg.Data = data
+	delete(msg.Headers, protocol.ClaimCheckKeyHeader)
+	delete(msg.Headers, protocol.ClaimCheckURLHeader)
+	delete(msg.Headers, protocol.ClaimCheckSizeHeader)
+	if len(msg.Headers) == 0 {
+		msg.Headers = nil
+	}
+	return nil
+}
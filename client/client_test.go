@@ -0,0 +1,275 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeBroker records the calls it gets and answers them from its fields
+type fakeBroker struct {
+	pb.UnimplementedBrokerServer
+
+	mu   sync.Mutex
+	md   []metadata.MD
+	sent []*pb.Message
+	// sendErrors are returned by the next calls to Send, one each
+	sendErrors []error
+	// pingErr fails every Ping while set
+	pingErr error
+	// sendGate, when set, holds every Send until it receives from it; active and peak
+	// count the Sends held
+	sendGate     chan struct{}
+	active, peak int
+	// receiveErrors end the next Receive streams before they deliver, one each
+	receiveErrors []error
+	// deliver is sent to every Receive stream
+	deliver []*pb.Message
+	// acked holds the ids of the acknowledged messages
+	acked []string
+}
+
+func (f *fakeBroker) record(ctx context.Context) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	f.mu.Lock()
+	f.md = append(f.md, md)
+	f.mu.Unlock()
+}
+
+// lastMetadata returns the metadata of the last call
+func (f *fakeBroker) lastMetadata() metadata.MD {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.md[len(f.md)-1]
+}
+
+func (f *fakeBroker) Ping(ctx context.Context, id *pb.Identity) (*pb.Status, error) {
+	f.record(ctx)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.pingErr != nil {
+		return nil, f.pingErr
+	}
+	return &pb.Status{Success: true, Message: "pong " + id.From}, nil
+}
+
+func (f *fakeBroker) Send(ctx context.Context, msg *pb.Message) (*pb.Status, error) {
+	f.record(ctx)
+	if f.sendGate != nil {
+		f.mu.Lock()
+		f.active++
+		f.peak = max(f.peak, f.active)
+		f.mu.Unlock()
+		<-f.sendGate
+		f.mu.Lock()
+		f.active--
+		f.mu.Unlock()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = append(f.sent, msg)
+	if len(f.sendErrors) > 0 {
+		err := f.sendErrors[0]
+		f.sendErrors = f.sendErrors[1:]
+		return nil, err
+	}
+	return &pb.Status{Success: true}, nil
+}
+
+func (f *fakeBroker) Receive(id *pb.Identity, stream pb.Broker_ReceiveServer) error {
+	f.record(stream.Context())
+	f.mu.Lock()
+	if len(f.receiveErrors) > 0 {
+		err := f.receiveErrors[0]
+		f.receiveErrors = f.receiveErrors[1:]
+		f.mu.Unlock()
+		return err
+	}
+	f.mu.Unlock()
+	for _, msg := range f.deliver {
+		if err := stream.Send(msg); err != nil {
+			return err
+		}
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+// serveFake serves a fake broker on an in-memory listener until the test ends
+func serveFake(t *testing.T, f *fakeBroker) (*bufconn.Listener, *grpc.Server) {
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	pb.RegisterBrokerServer(srv, f)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return lis, srv
+}
+
+func (f *fakeBroker) Ack(ctx context.Context, req *pb.AckRequest) (*pb.Status, error) {
+	f.record(ctx)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.acked = append(f.acked, req.Id)
+	return &pb.Status{Success: true}, nil
+}
+
+// newFakeClient connects a client of service to a fake broker over an in-memory connection
+func newFakeClient(t *testing.T, f *fakeBroker, service string, opts ...Option) *AuthenticatedClient {
+	t.Helper()
+	lis, _ := serveFake(t, f)
+
+	opts = append([]Option{WithDialOptions(
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)}, opts...)
+	c, err := New(Config{Address: "passthrough:///bufconn", Service: service}, opts...)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestClientAuthMetadata(t *testing.T) {
+	f := &fakeBroker{}
+
+	apiKey := newFakeClient(t, f, "orders", WithAPIKey("secret"))
+	st, err := apiKey.Ping(testContext(t))
+	if err != nil || st.Message != "pong orders" {
+		t.Fatalf("Ping = %v, %v", st, err)
+	}
+	if got := f.lastMetadata().Get("x-api-key"); len(got) != 1 || got[0] != "secret" {
+		t.Fatalf("expected the API key to be sent, got %v", got)
+	}
+
+	jwt := newFakeClient(t, f, "orders", WithJWT("token"))
+	if _, err := jwt.Ping(testContext(t)); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	md := f.lastMetadata()
+	if got := md.Get("authorization"); len(got) != 1 || got[0] != "Bearer token" {
+		t.Fatalf("expected a bearer token, got %v", got)
+	}
+	if len(md.Get("x-api-key")) != 0 {
+		t.Fatal("JWT client sent an API key")
+	}
+
+	hmac := newFakeClient(t, f, "orders", WithHMAC("secret"))
+	if _, err := hmac.Ping(testContext(t)); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	md = f.lastMetadata()
+	if len(md.Get("x-api-key")) != 0 {
+		t.Fatal("HMAC client sent its key")
+	}
+	if got := md.Get(protocol.SignatureKeyIDHeader); len(got) != 1 || got[0] != protocol.SignatureKeyID("secret") {
+		t.Fatalf("expected the key id of the signing key, got %v", got)
+	}
+	if len(md.Get(protocol.SignatureHeader)) != 1 || len(md.Get(protocol.SignatureNonceHeader)) != 1 {
+		t.Fatalf("expected a signature and a nonce, got %v", md)
+	}
+}
+
+func TestClientSend(t *testing.T) {
+	f := &fakeBroker{}
+	c := newFakeClient(t, f, "orders", WithAPIKey("secret"), WithInstance("a"))
+
+	if _, err := c.Send(testContext(t), "billing", []byte("hello"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	msg := f.sent[0]
+	if msg.To != "billing" || msg.From != "orders@a" || string(msg.Data) != "hello" || !msg.Queue || msg.Type != pb.Type_TEXT {
+		t.Fatalf("unexpected message %v", msg)
+	}
+
+	// The broker's Status is matched by the client's sentinels
+	st, _ := status.New(codes.Unavailable, "billing is offline").WithDetails(&pb.Status{Error: pb.Error_RECIPIENT_OFFLINE})
+	f.sendErrors = []error{st.Err()}
+	sent, err := c.Send(testContext(t), "billing", []byte("hello"), pb.Type_TEXT, false)
+	if !errors.Is(err, ErrRecipientOffline) {
+		t.Fatalf("expected ErrRecipientOffline, got %v", err)
+	}
+	if sent == nil || sent.Error != pb.Error_RECIPIENT_OFFLINE {
+		t.Fatalf("expected the broker's Status alongside the error, got %v", sent)
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	f := &fakeBroker{}
+	c := newFakeClient(t, f, "orders", WithRetry(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, RetryNonIdempotent: true}))
+
+	unavailable := status.Error(codes.Unavailable, "restarting")
+	f.sendErrors = []error{unavailable, unavailable}
+	if _, err := c.Send(testContext(t), "billing", nil, pb.Type_TEXT, true); err != nil {
+		t.Fatalf("expected the third attempt to succeed, got %v", err)
+	}
+	if len(f.sent) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(f.sent))
+	}
+
+	f.sent = nil
+	f.sendErrors = []error{status.Error(codes.InvalidArgument, "bad message")}
+	if _, err := c.Send(testContext(t), "billing", nil, pb.Type_TEXT, true); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument, got %v", err)
+	}
+	if len(f.sent) != 1 {
+		t.Fatalf("expected no retry of a non-retryable error, got %d attempts", len(f.sent))
+	}
+}
+
+func TestClientReceive(t *testing.T) {
+	f := &fakeBroker{deliver: []*pb.Message{
+		{From: "orders", To: "billing", Data: []byte("one")},
+		{From: "orders", To: "billing", Data: []byte("two")},
+	}}
+	c := newFakeClient(t, f, "billing", WithAPIKey("secret"))
+
+	stream, err := c.Receive(testContext(t))
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	for _, want := range []string{"one", "two"} {
+		msg, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if string(msg.Data) != want {
+			t.Fatalf("expected %q, got %q", want, msg.Data)
+		}
+	}
+	if got := f.lastMetadata().Get("x-api-key"); len(got) != 1 || got[0] != "secret" {
+		t.Fatalf("expected the stream to be authenticated, got %v", got)
+	}
+}
+
+func TestClientConfigErrors(t *testing.T) {
+	for name, config := range map[string]Config{
+		"no address":  {Service: "orders"},
+		"no service":  {Address: "localhost:9000"},
+		"auth method": {Address: "localhost:9000", Service: "orders", AuthMethod: "basic"},
+		"timeout":     {Address: "localhost:9000", Service: "orders", Timeout: -time.Second},
+	} {
+		if _, err := New(config); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+
+	// Registers the gzip and zstd compressors
+	_ "github.com/ispapp/Microservices-Broker/transport"
+)
+
+type compressionKey struct{}
+
+// WithCallCompression compresses the calls made with the returned context with
+// compressor ("gzip" or "zstd", "" for none), overriding the client's compression
+func WithCallCompression(ctx context.Context, compressor string) context.Context {
+	return context.WithValue(ctx, compressionKey{}, compressor)
+}
+
+// SetCompression compresses every call with compressor, "gzip" or "zstd", on the wire;
+// "" disables compression (default). The broker answers with the same compressor.
+// Compression pays off for text payloads such as JSON crossing slow links.
+func (ac *AuthenticatedClient) SetCompression(compressor string) error {
+	if err := checkCompressor(compressor); err != nil {
+		return err
+	}
+	ac.compression.Store(&compressor)
+	return nil
+}
+
+func checkCompressor(compressor string) error {
+	if compressor != "" && encoding.GetCompressor(compressor) == nil {
+		return fmt.Errorf("unknown compressor %q", compressor)
+	}
+	return nil
+}
+
+// compression resolves the compressor of calls: a context override wins over the
+// client's
+type compression struct {
+	atomic.Pointer[string]
+}
+
+func (c *compression) compressorFor(ctx context.Context) string {
+	if compressor, ok := ctx.Value(compressionKey{}).(string); ok {
+		return compressor
+	}
+	if compressor := c.Load(); compressor != nil {
+		return *compressor
+	}
+	return ""
+}
+
+// unaryInterceptor compresses unary calls with the resolved compressor
+func (c *compression) unaryInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if compressor := c.compressorFor(ctx); compressor != "" {
+			opts = append(opts, grpc.UseCompressor(compressor))
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// streamInterceptor compresses streams with the resolved compressor
+func (c *compression) streamInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if compressor := c.compressorFor(ctx); compressor != "" {
+			opts = append(opts, grpc.UseCompressor(compressor))
+		}
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+}
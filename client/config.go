@@ -0,0 +1,311 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"gopkg.in/yaml.v3"
+)
+
+// Environment variables read by ConfigFromEnv
+const (
+	EnvAddress        = "BROKER_ADDRESS"
+	EnvService        = "BROKER_SERVICE"
+	EnvAuthMethod     = "BROKER_AUTH_METHOD"
+	EnvAPIKey         = "BROKER_API_KEY"
+	EnvJWTToken       = "BROKER_JWT_TOKEN"
+	EnvTLS            = "BROKER_TLS"
+	EnvCAFile         = "BROKER_CA_FILE"
+	EnvServerName     = "BROKER_SERVER_NAME"
+	EnvTimeout        = "BROKER_TIMEOUT"
+	EnvSendTimeout    = "BROKER_SEND_TIMEOUT"
+	EnvConnectTimeout = "BROKER_CONNECT_TIMEOUT"
+	EnvRedialTimeout  = "BROKER_REDIAL_TIMEOUT"
+	EnvMaxRecvMsgSize = "BROKER_MAX_RECV_MSG_SIZE"
+	EnvMaxSendMsgSize = "BROKER_MAX_SEND_MSG_SIZE"
+	EnvCompression    = "BROKER_COMPRESSION"
+)
+
+// Config describes a connection to the broker
+type Config struct {
+	Address string `json:"address" yaml:"address"`
+	Service string `json:"service" yaml:"service"`
+	// Instance is the instance id of the client, see SetInstance
+	Instance string `json:"instance,omitempty" yaml:"instance,omitempty"`
+	// AuthMethod is "jwt", "apikey" or "hmac"; "jwt" when only JWTToken is set, "apikey" otherwise
+	AuthMethod string `json:"auth_method,omitempty" yaml:"auth_method,omitempty"`
+	// APIKey is sent with the "apikey" method and signs requests with "hmac"
+	APIKey   string `json:"api_key,omitempty" yaml:"api_key,omitempty"`
+	JWTToken string `json:"jwt_token,omitempty" yaml:"jwt_token,omitempty"`
+	TLS      bool   `json:"tls,omitempty" yaml:"tls,omitempty"`
+	// CAFile verifies the broker's certificate; the system roots when empty
+	CAFile string `json:"ca_file,omitempty" yaml:"ca_file,omitempty"`
+	// ServerName overrides the name the broker's certificate is checked against
+	ServerName string `json:"server_name,omitempty" yaml:"server_name,omitempty"`
+	// Timeout bounds unary calls whose context has no deadline, retries included (0 = none)
+	Timeout time.Duration `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+	// SendTimeout replaces Timeout for Send and SendBatch (default Timeout or 30s).
+	// ConnectTimeout bounds the wait for the connection before a stream is opened
+	// (default 10s). RedialTimeout bounds re-establishing a Receive stream that failed
+	// before its first message (default 1m). They apply to calls whose context has no
+	// deadline; negative disables them.
+	SendTimeout    time.Duration `json:"send_timeout,omitempty" yaml:"send_timeout,omitempty"`
+	ConnectTimeout time.Duration `json:"connect_timeout,omitempty" yaml:"connect_timeout,omitempty"`
+	RedialTimeout  time.Duration `json:"redial_timeout,omitempty" yaml:"redial_timeout,omitempty"`
+	// Retry is the retry policy of every call; retries are disabled when nil
+	Retry *RetryPolicy `json:"retry,omitempty" yaml:"retry,omitempty"`
+	// MaxRecvMsgSize and MaxSendMsgSize are the largest messages in bytes the client
+	// receives and sends (0 = the gRPC defaults, 4MiB and 2GiB). They should match the
+	// max_send_msg_size and max_recv_msg_size of the broker.
+	MaxRecvMsgSize int `json:"max_recv_msg_size,omitempty" yaml:"max_recv_msg_size,omitempty"`
+	MaxSendMsgSize int `json:"max_send_msg_size,omitempty" yaml:"max_send_msg_size,omitempty"`
+	// Compression is the compressor of every call on the wire, "gzip" or "zstd" (none
+	// when empty), see SetCompression
+	Compression string `json:"compression,omitempty" yaml:"compression,omitempty"`
+
+	// dialOptions are added to the options the client dials with
+	dialOptions []grpc.DialOption
+}
+
+// Option changes a Config before the client connects
+type Option func(*Config)
+
+// WithAPIKey authenticates with an API key, sent or used for signing depending on the method
+func WithAPIKey(key string) Option {
+	return func(c *Config) { c.APIKey = key }
+}
+
+// WithJWT authenticates with a JWT
+func WithJWT(token string) Option {
+	return func(c *Config) { c.AuthMethod, c.JWTToken = "jwt", token }
+}
+
+// WithHMAC signs requests with an API key instead of sending it
+func WithHMAC(key string) Option {
+	return func(c *Config) { c.AuthMethod, c.APIKey = "hmac", key }
+}
+
+// WithTLS connects over TLS, verifying the broker with caFile or the system roots when empty
+func WithTLS(caFile string) Option {
+	return func(c *Config) { c.TLS, c.CAFile = true, caFile }
+}
+
+// WithInstance sets the instance id of the client
+func WithInstance(instance string) Option {
+	return func(c *Config) { c.Instance = instance }
+}
+
+// WithTimeout bounds unary calls whose context has no deadline
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Config) { c.Timeout = timeout }
+}
+
+// WithSendTimeout bounds sends whose context has no deadline; negative disables the default
+func WithSendTimeout(timeout time.Duration) Option {
+	return func(c *Config) { c.SendTimeout = timeout }
+}
+
+// WithConnectTimeout bounds the wait for the connection before opening a stream
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(c *Config) { c.ConnectTimeout = timeout }
+}
+
+// WithRedialTimeout bounds re-establishing a failed Receive stream
+func WithRedialTimeout(timeout time.Duration) Option {
+	return func(c *Config) { c.RedialTimeout = timeout }
+}
+
+// WithRetry sets the retry policy of every call
+func WithRetry(policy RetryPolicy) Option {
+	return func(c *Config) { c.Retry = &policy }
+}
+
+// WithMaxMessageSizes sets the largest messages the client receives and sends (0 keeps
+// the gRPC default)
+func WithMaxMessageSizes(recv, send int) Option {
+	return func(c *Config) { c.MaxRecvMsgSize, c.MaxSendMsgSize = recv, send }
+}
+
+// WithCompression compresses every call with compressor, "gzip" or "zstd"
+func WithCompression(compressor string) Option {
+	return func(c *Config) { c.Compression = compressor }
+}
+
+// WithDialOptions adds gRPC dial options, such as a custom dialer
+func WithDialOptions(opts ...grpc.DialOption) Option {
+	return func(c *Config) { c.dialOptions = append(c.dialOptions, opts...) }
+}
+
+// LoadConfig reads a Config from a JSON or, with a .yaml or .yml extension, YAML file
+func LoadConfig(path string) (Config, error) {
+	var c Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &c)
+	default:
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil {
+		return c, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// ConfigFromEnv reads a Config from the BROKER_* environment variables. Timeouts are
+// durations such as "5s".
+func ConfigFromEnv() (Config, error) {
+	c := Config{
+		Address:     os.Getenv(EnvAddress),
+		Service:     os.Getenv(EnvService),
+		AuthMethod:  os.Getenv(EnvAuthMethod),
+		APIKey:      os.Getenv(EnvAPIKey),
+		JWTToken:    os.Getenv(EnvJWTToken),
+		CAFile:      os.Getenv(EnvCAFile),
+		ServerName:  os.Getenv(EnvServerName),
+		Compression: os.Getenv(EnvCompression),
+	}
+	if v := os.Getenv(EnvTLS); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return c, fmt.Errorf("invalid %s: %w", EnvTLS, err)
+		}
+		c.TLS = enabled
+	}
+	for _, timeout := range []struct {
+		env   string
+		value *time.Duration
+	}{
+		{EnvTimeout, &c.Timeout},
+		{EnvSendTimeout, &c.SendTimeout},
+		{EnvConnectTimeout, &c.ConnectTimeout},
+		{EnvRedialTimeout, &c.RedialTimeout},
+	} {
+		if v := os.Getenv(timeout.env); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return c, fmt.Errorf("invalid %s: %w", timeout.env, err)
+			}
+			*timeout.value = d
+		}
+	}
+	for _, size := range []struct {
+		env   string
+		value *int
+	}{
+		{EnvMaxRecvMsgSize, &c.MaxRecvMsgSize},
+		{EnvMaxSendMsgSize, &c.MaxSendMsgSize},
+	} {
+		if v := os.Getenv(size.env); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return c, fmt.Errorf("invalid %s: %w", size.env, err)
+			}
+			*size.value = n
+		}
+	}
+	return c, nil
+}
+
+// New connects to the broker as described by config, changed by opts
+func New(config Config, opts ...Option) (*AuthenticatedClient, error) {
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if config.Address == "" {
+		return nil, fmt.Errorf("broker address is required")
+	}
+	if config.Service == "" {
+		return nil, fmt.Errorf("service name is required")
+	}
+	switch config.AuthMethod {
+	case "":
+		config.AuthMethod = "apikey"
+		if config.APIKey == "" && config.JWTToken != "" {
+			config.AuthMethod = "jwt"
+		}
+	case "jwt", "apikey", "hmac":
+	default:
+		return nil, fmt.Errorf("unsupported auth method %q", config.AuthMethod)
+	}
+	if config.Timeout < 0 {
+		return nil, fmt.Errorf("timeout must not be negative")
+	}
+	if config.MaxRecvMsgSize < 0 || config.MaxSendMsgSize < 0 {
+		return nil, fmt.Errorf("message sizes must not be negative")
+	}
+	if err := checkCompressor(config.Compression); err != nil {
+		return nil, err
+	}
+	creds, err := config.transportCredentials()
+	if err != nil {
+		return nil, err
+	}
+
+	dialOptions := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if callOptions := config.messageSizeOptions(); len(callOptions) > 0 {
+		dialOptions = append(dialOptions, grpc.WithDefaultCallOptions(callOptions...))
+	}
+	ac, err := newAuthenticatedClient(config.Address, config.Service, config.AuthMethod,
+		append(dialOptions, config.dialOptions...)...)
+	if err != nil {
+		return nil, err
+	}
+	ac.deadlines = deadlines{
+		call:    config.Timeout,
+		send:    orDefault(config.SendTimeout, orDefault(config.Timeout, DefaultSendTimeout)),
+		connect: orDefault(config.ConnectTimeout, DefaultConnectTimeout),
+		redial:  orDefault(config.RedialTimeout, DefaultRedialTimeout),
+	}
+	ac.SetAPIKey(config.APIKey)
+	ac.SetJWTToken(config.JWTToken)
+	ac.SetInstance(config.Instance)
+	ac.compression.Store(&config.Compression)
+	if config.Retry != nil {
+		ac.SetRetryPolicy(*config.Retry)
+	}
+	return ac, nil
+}
+
+// messageSizeOptions returns the call options of the configured message sizes
+func (c *Config) messageSizeOptions() []grpc.CallOption {
+	var opts []grpc.CallOption
+	if c.MaxRecvMsgSize > 0 {
+		opts = append(opts, grpc.MaxCallRecvMsgSize(c.MaxRecvMsgSize))
+	}
+	if c.MaxSendMsgSize > 0 {
+		opts = append(opts, grpc.MaxCallSendMsgSize(c.MaxSendMsgSize))
+	}
+	return opts
+}
+
+// transportCredentials returns the credentials of the TLS settings
+func (c *Config) transportCredentials() (credentials.TransportCredentials, error) {
+	if !c.TLS {
+		return insecure.NewCredentials(), nil
+	}
+	config := &tls.Config{ServerName: c.ServerName}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS credentials: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("failed to load TLS credentials: no certificates in %s", c.CAFile)
+		}
+	}
+	return credentials.NewTLS(config), nil
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestConfigFile(t *testing.T) {
+	yml := filepath.Join(t.TempDir(), "broker.yaml")
+	if err := os.WriteFile(yml, []byte("address: passthrough:///bufconn\nservice: billing\napi_key: secret\ntimeout: 200ms\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(yml)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if config.Timeout != 200*time.Millisecond || config.APIKey != "secret" {
+		t.Fatalf("unexpected config: %+v", config)
+	}
+
+	f := &fakeBroker{}
+	lis, _ := serveFake(t, f)
+	c, err := New(config, WithDialOptions(grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	})))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Send(testContext(t), "orders", []byte("x"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if got := f.lastMetadata().Get("x-api-key"); len(got) != 1 || got[0] != "secret" {
+		t.Fatalf("expected the configured API key to be sent, got %v", got)
+	}
+
+	// A call without a deadline gets the configured timeout
+	f.mu.Lock()
+	f.sendGate = make(chan struct{})
+	f.mu.Unlock()
+	defer close(f.sendGate)
+	start := time.Now()
+	_, err = c.Send(context.Background(), "orders", []byte("x"), pb.Type_TEXT, true)
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the send to end within the timeout, took %s", elapsed)
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv(EnvAddress, "localhost:9000")
+	t.Setenv(EnvService, "orders")
+	t.Setenv(EnvJWTToken, "token")
+	t.Setenv(EnvTimeout, "5s")
+	if config, err := ConfigFromEnv(); err != nil || config.Address != "localhost:9000" || config.Timeout != 5*time.Second {
+		t.Fatalf("unexpected config from env: %+v (%v)", config, err)
+	}
+	t.Setenv(EnvTimeout, "soon")
+	if _, err := ConfigFromEnv(); err == nil {
+		t.Fatal("expected an invalid timeout to be refused")
+	}
+	if _, err := New(Config{Address: "localhost:9000"}); err == nil {
+		t.Fatal("expected a config without a service to be refused")
+	}
+	if _, err := New(Config{Address: "localhost:9000", Service: "orders", AuthMethod: "basic"}); err == nil {
+		t.Fatal("expected an unknown auth method to be refused")
+	}
+}
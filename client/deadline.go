@@ -0,0 +1,90 @@
+package client
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/status"
+)
+
+// Default deadlines of calls whose context has none
+const (
+	DefaultSendTimeout    = 30 * time.Second
+	DefaultConnectTimeout = 10 * time.Second
+	DefaultRedialTimeout  = time.Minute
+)
+
+// deadlines are the deadlines given to calls whose context has none; 0 means none
+type deadlines struct {
+	call    time.Duration // unary calls other than sends
+	send    time.Duration // Send and SendBatch, retries included
+	connect time.Duration // waiting for the connection before opening a stream
+	redial  time.Duration // re-establishing a failed Receive stream
+}
+
+var defaultDeadlines = deadlines{send: DefaultSendTimeout, connect: DefaultConnectTimeout, redial: DefaultRedialTimeout}
+
+// orDefault returns d, the default when d is 0 and none when d is negative
+func orDefault(d, def time.Duration) time.Duration {
+	switch {
+	case d < 0:
+		return 0
+	case d == 0:
+		return def
+	default:
+		return d
+	}
+}
+
+// unaryInterceptor gives unary calls without a deadline the one of their kind
+func (d *deadlines) unaryInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		timeout := d.call
+		if name := path.Base(method); name == "Send" || name == "SendBatch" {
+			timeout = d.send
+		}
+		if _, ok := ctx.Deadline(); ok || timeout <= 0 {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// streamInterceptor bounds the wait for the connection before a stream without a
+// deadline is opened. The stream itself may last as long as it likes.
+func (d *deadlines) streamInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if _, ok := ctx.Deadline(); !ok && d.connect > 0 {
+			if err := awaitConnection(ctx, cc, d.connect); err != nil {
+				return nil, err
+			}
+		}
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+}
+
+// awaitConnection waits up to timeout while cc is connecting. A connection that is
+// ready or failing returns at once, failing calls fail fast as usual.
+func awaitConnection(ctx context.Context, cc *grpc.ClientConn, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cc.Connect()
+	for {
+		state := cc.GetState()
+		if state == connectivity.Ready || state == connectivity.TransientFailure || state == connectivity.Shutdown {
+			return nil
+		}
+		if !cc.WaitForStateChange(ctx, state) {
+			if ctx.Err() == context.DeadlineExceeded {
+				return status.Errorf(codes.DeadlineExceeded, "no connection to the broker within %s", timeout)
+			}
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDeadlineDefaults(t *testing.T) {
+	// A broker that never answers the connection
+	hang := grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	c, err := New(Config{Address: "passthrough:///unreachable", Service: "billing"},
+		WithDialOptions(hang), WithSendTimeout(100*time.Millisecond), WithConnectTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer c.Close()
+
+	// Calls without a deadline get the default of their kind
+	start := time.Now()
+	if _, err := c.Send(context.Background(), "orders", []byte("x"), pb.Type_TEXT, true); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("expected Send to hit the send timeout, got %v", err)
+	}
+	if _, err := c.Receive(context.Background()); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("expected Receive to hit the connect timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the calls to give up after their timeouts, took %s", elapsed)
+	}
+	// A deadline of the caller wins
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if _, err := c.Send(ctx, "orders", []byte("x"), pb.Type_TEXT, true); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Fatalf("expected the caller's deadline to replace the send timeout, gave up after %s", elapsed)
+	}
+}
@@ -0,0 +1,187 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+)
+
+// Discovery schemes: pass "srv:///_broker._tcp.example.com" or
+// "consul://127.0.0.1:8500/broker?tag=eu&dc=dc1" as the address of any client constructor.
+// Either target also takes a refresh query parameter such as refresh=10s.
+const (
+	SRVScheme    = "srv"
+	ConsulScheme = "consul"
+)
+
+// DefaultDiscoveryRefresh is how often discovered broker addresses are looked up again
+const DefaultDiscoveryRefresh = 30 * time.Second
+
+// defaultConsulAgent is queried when a consul target names no agent
+const defaultConsulAgent = "127.0.0.1:8500"
+
+func init() {
+	resolver.Register(&discoveryBuilder{scheme: SRVScheme, lookup: lookupSRV})
+	resolver.Register(&discoveryBuilder{scheme: ConsulScheme, lookup: lookupConsul})
+}
+
+// lookupFunc returns the broker addresses a target currently resolves to
+type lookupFunc func(ctx context.Context, target resolver.Target) ([]string, error)
+
+// discoveryBuilder builds resolvers that poll a lookup function
+type discoveryBuilder struct {
+	scheme string
+	lookup lookupFunc
+}
+
+func (b *discoveryBuilder) Scheme() string { return b.scheme }
+
+func (b *discoveryBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	refresh := DefaultDiscoveryRefresh
+	if value := target.URL.Query().Get("refresh"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid refresh %q in %s target", value, b.scheme)
+		}
+		refresh = d
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &discoveryResolver{target: target, cc: cc, lookup: b.lookup, refresh: refresh, now: make(chan struct{}, 1), cancel: cancel}
+	r.wg.Add(1)
+	go r.watch(ctx)
+	return r, nil
+}
+
+// discoveryResolver looks the target up on start, every refresh interval and whenever
+// gRPC asks, e.g. after losing its connection
+type discoveryResolver struct {
+	target  resolver.Target
+	cc      resolver.ClientConn
+	lookup  lookupFunc
+	refresh time.Duration
+	now     chan struct{}
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func (r *discoveryResolver) watch(ctx context.Context) {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.refresh)
+	defer ticker.Stop()
+	for {
+		r.resolve(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.now:
+		}
+	}
+}
+
+// resolve hands the current addresses to gRPC, keeping the previous ones when the lookup fails
+func (r *discoveryResolver) resolve(ctx context.Context) {
+	lookupCtx, cancel := context.WithTimeout(ctx, r.refresh)
+	defer cancel()
+	addresses, err := r.lookup(lookupCtx, r.target)
+	if err == nil && len(addresses) == 0 {
+		err = fmt.Errorf("no brokers found for %s", r.target.URL.String())
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			r.cc.ReportError(err)
+		}
+		return
+	}
+	state := resolver.State{}
+	for _, address := range addresses {
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: address})
+	}
+	r.cc.UpdateState(state)
+}
+
+func (r *discoveryResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.now <- struct{}{}:
+	default:
+	}
+}
+
+func (r *discoveryResolver) Close() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+// lookupSRV resolves the SRV record named by the target path, ordered by priority and weight
+func lookupSRV(ctx context.Context, target resolver.Target) ([]string, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", target.Endpoint())
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]string, 0, len(records))
+	for _, srv := range records {
+		addresses = append(addresses, net.JoinHostPort(srv.Target, strconv.Itoa(int(srv.Port))))
+	}
+	return addresses, nil
+}
+
+// consulEntry is the part of a Consul health API entry that locates a service instance
+type consulEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string `json:"Address"`
+		Port    int    `json:"Port"`
+	} `json:"Service"`
+}
+
+// lookupConsul returns the passing instances of the service named by the target path
+// from the Consul agent named by its host. The tag and dc query parameters are passed on.
+func lookupConsul(ctx context.Context, target resolver.Target) ([]string, error) {
+	agent := target.URL.Host
+	if agent == "" {
+		agent = defaultConsulAgent
+	}
+	query := url.Values{"passing": {"true"}}
+	for _, key := range []string{"tag", "dc"} {
+		if value := target.URL.Query().Get(key); value != "" {
+			query.Set(key, value)
+		}
+	}
+	endpoint := url.URL{Scheme: "http", Host: agent, Path: "/v1/health/service/" + target.Endpoint(), RawQuery: query.Encode()}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul returned %s", resp.Status)
+	}
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("failed to decode consul response: %w", err)
+	}
+	addresses := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		// Services registered without an address use their node's
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		addresses = append(addresses, net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)))
+	}
+	return addresses, nil
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestDiscoveryConsul(t *testing.T) {
+	ctx := testContext(t)
+	brokers := map[string]*fakeBroker{"broker-a:9000": {}, "broker-b:9000": {}}
+	listeners := make(map[string]*bufconn.Listener)
+	servers := make(map[string]*grpc.Server)
+	for address, f := range brokers {
+		listeners[address], servers[address] = serveFake(t, f)
+	}
+	var mu sync.Mutex
+	current := "broker-a"
+	consul := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/broker" || r.URL.Query().Get("passing") != "true" {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintf(w, `[{"Node": {"Address": "10.0.0.1"}, "Service": {"Address": %q, "Port": 9000}}]`, current)
+	}))
+	defer consul.Close()
+
+	c, err := NewAuthenticatedClientWithOptions("consul://"+consul.Listener.Addr().String()+"/broker?refresh=50ms", "orders", "apikey",
+		grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+			return listeners[address].DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Send(ctx, "billing", []byte("first"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if n := brokers["broker-a:9000"].sentCount(); n != 1 {
+		t.Fatalf("expected the message on the discovered broker, it has %d", n)
+	}
+
+	// The broker is rescheduled: Consul now lists another address
+	mu.Lock()
+	current = "broker-b"
+	mu.Unlock()
+	servers["broker-a:9000"].Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		sendCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		_, err := c.Send(sendCtx, "billing", []byte("second"), pb.Type_TEXT, true)
+		cancel()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("client did not follow the broker: %v", err)
+		}
+	}
+	if n := brokers["broker-b:9000"].sentCount(); n != 1 {
+		t.Fatalf("expected the message on the new broker, it has %d", n)
+	}
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrRecipientOffline is matched (errors.Is) by Send errors when the recipient
+// is not connected and the message was not marked for queueing
+var ErrRecipientOffline = errors.New("recipient offline")
+
+// ErrReadOnly is matched (errors.Is) by Send errors while the broker is in read-only mode
+var ErrReadOnly = errors.New("broker is read-only")
+
+// ErrQuotaExceeded is matched (errors.Is) by Send errors once the sending service used up
+// its hourly or daily quota
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// ErrPermissionDenied is matched (errors.Is) by errors of calls that name another
+// service than the one the client's credentials belong to
+var ErrPermissionDenied = errors.New("permission denied")
+
+// ErrUnknownService is matched (errors.Is) by Send errors when the sender or a
+// destination is missing from the broker's strict service registry
+var ErrUnknownService = errors.New("unknown service")
+
+// ErrValidationFailed is matched (errors.Is) by Send errors when the message failed a
+// validation rule of its recipient
+var ErrValidationFailed = errors.New("validation failed")
+
+// brokerError keeps the gRPC status of a failed call while matching a client sentinel
+type brokerError struct {
+	err      error
+	sentinel error
+}
+
+func (e *brokerError) Error() string   { return e.err.Error() }
+func (e *brokerError) Unwrap() []error { return []error{e.err, e.sentinel} }
+
+// StatusFromError returns the broker Status carried by a failed call, if any
+func StatusFromError(err error) (*pb.Status, bool) {
+	if err == nil {
+		return nil, false
+	}
+	for _, detail := range status.Convert(err).Details() {
+		if st, ok := detail.(*pb.Status); ok {
+			return st, true
+		}
+	}
+	return nil, false
+}
+
+// IsRetryable reports whether a failed call may succeed when retried after a backoff
+func IsRetryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+// withStatus fills in the broker Status from the error details when the call failed
+func withStatus(st *pb.Status, err error) (*pb.Status, error) {
+	if err != nil && st == nil {
+		st, _ = StatusFromError(err)
+	}
+	if st != nil && err != nil {
+		switch st.Error {
+		case pb.Error_RECIPIENT_OFFLINE:
+			err = &brokerError{err: err, sentinel: ErrRecipientOffline}
+		case pb.Error_READ_ONLY:
+			err = &brokerError{err: err, sentinel: ErrReadOnly}
+		case pb.Error_CHECKSUM_MISMATCH:
+			err = &brokerError{err: err, sentinel: ErrChecksumMismatch}
+		case pb.Error_QUOTA_EXCEEDED:
+			err = &brokerError{err: err, sentinel: ErrQuotaExceeded}
+		case pb.Error_PERMISSION_DENIED:
+			err = &brokerError{err: err, sentinel: ErrPermissionDenied}
+		case pb.Error_UNKNOWN_SERVICE:
+			err = &brokerError{err: err, sentinel: ErrUnknownService}
+		case pb.Error_VALIDATION_FAILED:
+			err = &brokerError{err: err, sentinel: ErrValidationFailed}
+		}
+	}
+	return st, err
+}
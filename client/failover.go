@@ -0,0 +1,318 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/grpc"
+)
+
+// DefaultFailoverHealthInterval is how often a FailoverClient pings its endpoints
+const DefaultFailoverHealthInterval = 5 * time.Second
+
+// failoverMaxBackoff caps the wait between rounds over the endpoints while none answers
+const failoverMaxBackoff = 5 * time.Second
+
+// endpoint is one broker of a FailoverClient and its last health check result
+type endpoint struct {
+	*AuthenticatedClient
+	address string
+	// healthy is false once the broker failed a call or a ping; writable is false while it is read-only
+	healthy  atomic.Bool
+	writable atomic.Bool
+}
+
+// FailoverClient talks to one broker of a list at a time, the active endpoint, and moves to
+// the next healthy one when it disappears. Read-only brokers are skipped for sends, and
+// the client returns to an earlier endpoint in the list once it is healthy again.
+//
+// Sends that fail because the broker is unreachable are retried on the next endpoint; a
+// send the broker accepted just before failing may be delivered twice. Receive streams
+// are reopened on the next endpoint, but message ids are per broker: Ack and Nack for
+// messages received before a failover fail.
+type FailoverClient struct {
+	endpoints []*endpoint
+	active    atomic.Int32
+	receiving atomic.Int32 // endpoint of the latest Receive stream, which acks go to
+	mu        sync.Mutex   // serializes changes of the active endpoint
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	once      sync.Once
+}
+
+var _ Client = (*FailoverClient)(nil)
+
+// NewFailoverClient connects to every address with opts, which must at least set transport
+// credentials, and health checks them in the background. The first address is preferred.
+func NewFailoverClient(addresses []string, serviceName, authMethod string, opts ...grpc.DialOption) (*FailoverClient, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("no broker addresses")
+	}
+	fc := &FailoverClient{stop: make(chan struct{})}
+	for _, address := range addresses {
+		ac, err := NewAuthenticatedClientWithOptions(address, serviceName, authMethod, opts...)
+		if err != nil {
+			fc.Close()
+			return nil, err
+		}
+		e := &endpoint{AuthenticatedClient: ac, address: address}
+		e.healthy.Store(true)
+		e.writable.Store(true)
+		fc.endpoints = append(fc.endpoints, e)
+	}
+	fc.wg.Add(1)
+	go fc.healthLoop(DefaultFailoverHealthInterval)
+	return fc, nil
+}
+
+// healthLoop pings every endpoint and moves back to the preferred healthy one
+func (fc *FailoverClient) healthLoop(interval time.Duration) {
+	defer fc.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-fc.stop:
+			return
+		case <-ticker.C:
+			fc.CheckHealth(context.Background(), interval/2)
+		}
+	}
+}
+
+// CheckHealth pings every endpoint, each within timeout, and makes the first healthy
+// writable one active. It runs in the background; calling it directly forces a check.
+func (fc *FailoverClient) CheckHealth(ctx context.Context, timeout time.Duration) {
+	for _, e := range fc.endpoints {
+		pingCtx, cancel := context.WithTimeout(ctx, timeout)
+		st, err := e.Ping(WithRetryPolicy(pingCtx, NoRetry))
+		cancel()
+		// Rejected credentials say nothing about the broker itself
+		e.healthy.Store(err == nil || !isBrokerFailure(err))
+		e.writable.Store(err != nil || st.GetError() != pb.Error_READ_ONLY)
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if i, ok := fc.preferred(-1); ok {
+		fc.active.Store(int32(i))
+	}
+}
+
+// preferred returns the first healthy endpoint other than skip, writable ones first
+func (fc *FailoverClient) preferred(skip int) (int, bool) {
+	fallback := -1
+	for i, e := range fc.endpoints {
+		if i == skip || !e.healthy.Load() {
+			continue
+		}
+		if e.writable.Load() {
+			return i, true
+		}
+		if fallback < 0 {
+			fallback = i
+		}
+	}
+	return fallback, fallback >= 0
+}
+
+// failed takes endpoint i out of rotation after a broker failure and returns the
+// endpoint to try next
+func (fc *FailoverClient) failed(i int) int {
+	return fc.moveOn(i, func(e *endpoint) { e.healthy.Store(false) })
+}
+
+// readOnly records that endpoint i rejects sends and returns the endpoint to try next
+func (fc *FailoverClient) readOnly(i int) int {
+	return fc.moveOn(i, func(e *endpoint) { e.writable.Store(false) })
+}
+
+// moveOn marks endpoint i and moves the active endpoint away from it
+func (fc *FailoverClient) moveOn(i int, mark func(*endpoint)) int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	mark(fc.endpoints[i])
+	next, ok := fc.preferred(i)
+	if !ok {
+		// Nothing is known to be healthy, go round the list
+		next = (i + 1) % len(fc.endpoints)
+	}
+	if int(fc.active.Load()) == i {
+		fc.active.Store(int32(next))
+	}
+	return next
+}
+
+// Active returns the address of the broker calls currently go to
+func (fc *FailoverClient) Active() string {
+	return fc.endpoints[fc.active.Load()].address
+}
+
+// each applies set to the client of every endpoint
+func (fc *FailoverClient) each(set func(*AuthenticatedClient)) {
+	for _, e := range fc.endpoints {
+		set(e.AuthenticatedClient)
+	}
+}
+
+// SetAPIKey sets the API key used with every broker
+func (fc *FailoverClient) SetAPIKey(apiKey string) {
+	fc.each(func(ac *AuthenticatedClient) { ac.SetAPIKey(apiKey) })
+}
+
+// SetJWTToken sets the JWT token used with every broker
+func (fc *FailoverClient) SetJWTToken(token string) {
+	fc.each(func(ac *AuthenticatedClient) { ac.SetJWTToken(token) })
+}
+
+// SetRetryPolicy sets the retry policy used with each broker before failing over
+func (fc *FailoverClient) SetRetryPolicy(policy RetryPolicy) {
+	fc.each(func(ac *AuthenticatedClient) { ac.SetRetryPolicy(policy) })
+}
+
+// SetInstance sets the instance id of this client on every broker
+func (fc *FailoverClient) SetInstance(instance string) {
+	fc.each(func(ac *AuthenticatedClient) { ac.SetInstance(instance) })
+}
+
+// SetChecksum makes sends to every broker attach checksums
+func (fc *FailoverClient) SetChecksum(algorithm pb.ChecksumType) {
+	fc.each(func(ac *AuthenticatedClient) { ac.SetChecksum(algorithm) })
+}
+
+// call runs f against the active endpoint, failing over to the others while f reports
+// a broker failure, or a read-only broker when write is set. Each endpoint is tried once.
+func (fc *FailoverClient) call(write bool, f func(*AuthenticatedClient) (*pb.Status, error)) (*pb.Status, error) {
+	i := int(fc.active.Load())
+	var st *pb.Status
+	var err error
+	for range fc.endpoints {
+		st, err = f(fc.endpoints[i].AuthenticatedClient)
+		switch {
+		case err == nil:
+			return st, nil
+		case write && errors.Is(err, ErrReadOnly):
+			i = fc.readOnly(i)
+		case isBrokerFailure(err):
+			i = fc.failed(i)
+		default:
+			return st, err
+		}
+	}
+	return st, err
+}
+
+// Ping pings the active broker
+func (fc *FailoverClient) Ping(ctx context.Context) (*pb.Status, error) {
+	return fc.call(false, func(ac *AuthenticatedClient) (*pb.Status, error) { return ac.Ping(ctx) })
+}
+
+// Send sends a message through the active broker, failing over while brokers are unreachable or read-only
+func (fc *FailoverClient) Send(ctx context.Context, to string, data []byte, msgType pb.Type, queue bool) (*pb.Status, error) {
+	return fc.call(true, func(ac *AuthenticatedClient) (*pb.Status, error) { return ac.Send(ctx, to, data, msgType, queue) })
+}
+
+// Cleanup cleans up messages for the service on the active broker
+func (fc *FailoverClient) Cleanup(ctx context.Context) (*pb.Status, error) {
+	return fc.call(false, func(ac *AuthenticatedClient) (*pb.Status, error) { return ac.Cleanup(ctx) })
+}
+
+// Receive receives this client's messages from the active broker. The stream is reopened
+// on another broker when its broker goes away, until ctx ends.
+func (fc *FailoverClient) Receive(ctx context.Context) (pb.Broker_ReceiveClient, error) {
+	return fc.receive(ctx, (*AuthenticatedClient).Receive)
+}
+
+// ReceiveWithAck receives in manual-ack mode like Receive; see FailoverClient for the
+// limits of acknowledging across a failover
+func (fc *FailoverClient) ReceiveWithAck(ctx context.Context) (pb.Broker_ReceiveClient, error) {
+	return fc.receive(ctx, (*AuthenticatedClient).ReceiveWithAck)
+}
+
+// Ack acknowledges a message on the broker the latest Receive stream is connected to
+func (fc *FailoverClient) Ack(ctx context.Context, id string) (*pb.Status, error) {
+	return fc.endpoints[fc.receiving.Load()].Ack(ctx, id)
+}
+
+// Nack rejects a message on the broker the latest Receive stream is connected to
+func (fc *FailoverClient) Nack(ctx context.Context, id string, delay time.Duration) (*pb.Status, error) {
+	return fc.endpoints[fc.receiving.Load()].Nack(ctx, id, delay)
+}
+
+// receive opens a failover stream and its first underlying stream
+func (fc *FailoverClient) receive(ctx context.Context, open func(*AuthenticatedClient, context.Context) (pb.Broker_ReceiveClient, error)) (pb.Broker_ReceiveClient, error) {
+	s := &failoverStream{fc: fc, ctx: ctx, open: open}
+	if err := s.reopen(int(fc.active.Load()), false); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// failoverStream is a Receive stream that moves to another broker when its broker fails
+type failoverStream struct {
+	pb.Broker_ReceiveClient
+	fc       *FailoverClient
+	ctx      context.Context
+	open     func(*AuthenticatedClient, context.Context) (pb.Broker_ReceiveClient, error)
+	endpoint int
+}
+
+// reopen opens the stream on endpoint i or, when that fails, on the next ones. With wait
+// set it keeps going round the list with a backoff until ctx ends.
+func (s *failoverStream) reopen(i int, wait bool) error {
+	backoff := 100 * time.Millisecond
+	for {
+		var err error
+		for range s.fc.endpoints {
+			var stream pb.Broker_ReceiveClient
+			if stream, err = s.open(s.fc.endpoints[i].AuthenticatedClient, s.ctx); err == nil {
+				s.Broker_ReceiveClient, s.endpoint = stream, i
+				s.fc.receiving.Store(int32(i))
+				return nil
+			}
+			if !isBrokerFailure(err) || s.ctx.Err() != nil {
+				return err
+			}
+			i = s.fc.failed(i)
+		}
+		if !wait {
+			return err
+		}
+		select {
+		case <-s.ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, failoverMaxBackoff)
+	}
+}
+
+// Recv returns the next message, reopening the stream on another broker when its broker fails
+func (s *failoverStream) Recv() (*pb.Message, error) {
+	for {
+		msg, err := s.Broker_ReceiveClient.Recv()
+		if err == nil || errors.Is(err, ErrChecksumMismatch) || !isBrokerFailure(err) || s.ctx.Err() != nil {
+			return msg, err
+		}
+		if err := s.reopen(s.fc.failed(s.endpoint), true); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Close stops health checking and closes the connection to every broker
+func (fc *FailoverClient) Close() error {
+	var errs []error
+	fc.once.Do(func() {
+		close(fc.stop)
+		fc.wg.Wait()
+		for _, e := range fc.endpoints {
+			errs = append(errs, e.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
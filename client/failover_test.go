@@ -0,0 +1,70 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestFailover(t *testing.T) {
+	ctx := testContext(t)
+	brokers := map[string]*fakeBroker{"a": {}, "b": {}}
+	listeners := make(map[string]*bufconn.Listener)
+	servers := make(map[string]*grpc.Server)
+	for address, f := range brokers {
+		listeners[address], servers[address] = serveFake(t, f)
+	}
+	dial := []grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+			return listeners[address].DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}
+	addresses := []string{"passthrough:///a", "passthrough:///b"}
+	producer, err := NewFailoverClient(addresses, "orders", "apikey", dial...)
+	if err != nil {
+		t.Fatalf("NewFailoverClient failed: %v", err)
+	}
+	defer producer.Close()
+
+	// A read-only broker is skipped for sends
+	readOnly, _ := status.New(codes.FailedPrecondition, "broker is read-only").WithDetails(&pb.Status{Error: pb.Error_READ_ONLY})
+	brokers["a"].sendErrors = []error{readOnly.Err()}
+	if _, err := producer.Send(ctx, "billing", []byte("x"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send did not fail over: %v", err)
+	}
+	if n := len(brokers["b"].sent); n != 1 || producer.Active() != addresses[1] {
+		t.Fatalf("expected the message on b and b active, b has %d and %s is active", n, producer.Active())
+	}
+	// The preferred broker is used again once its health check passes
+	producer.CheckHealth(ctx, time.Second)
+	if producer.Active() != addresses[0] {
+		t.Fatalf("expected a to be active again, %s is", producer.Active())
+	}
+
+	// A Receive stream moves to the other broker when its broker goes away
+	brokers["b"].deliver = []*pb.Message{{Data: []byte("x"), From: "orders", To: "billing", Event: pb.Event_MESSAGE}}
+	consumer, err := NewFailoverClient(addresses, "billing", "apikey", dial...)
+	if err != nil {
+		t.Fatalf("NewFailoverClient failed: %v", err)
+	}
+	defer consumer.Close()
+	stream, err := consumer.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	servers["a"].Stop()
+	msg, err := stream.Recv()
+	if err != nil || string(msg.Data) != "x" {
+		t.Fatalf("expected the message delivered by b, got %v (%v)", msg, err)
+	}
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrHeartbeatMissed is returned by Recv when the broker sent neither a message nor a
+// heartbeat within the heartbeat timeout. It carries codes.Unavailable, so reconnecting
+// consumers and the FailoverClient treat it like a lost connection.
+var ErrHeartbeatMissed = status.Error(codes.Unavailable, "missed broker heartbeats")
+
+// SetHeartbeatTimeout makes Receive streams fail with ErrHeartbeatMissed when Recv waits
+// for timeout without anything, not even a heartbeat, arriving (0 disables). Use at least twice the broker's
+// server.heartbeat_interval.
+func (ac *AuthenticatedClient) SetHeartbeatTimeout(timeout time.Duration) {
+	ac.heartbeatTimeout = timeout
+}
+
+// SetHeartbeatTimeout sets the heartbeat timeout of every connection
+func (p *PooledClient) SetHeartbeatTimeout(timeout time.Duration) {
+	for _, conn := range p.conns {
+		conn.SetHeartbeatTimeout(timeout)
+	}
+}
+
+// SetHeartbeatTimeout sets the heartbeat timeout of the Receive streams on every broker
+func (fc *FailoverClient) SetHeartbeatTimeout(timeout time.Duration) {
+	fc.each(func(ac *AuthenticatedClient) { ac.SetHeartbeatTimeout(timeout) })
+}
+
+// isHeartbeat reports whether msg is a broker heartbeat rather than a delivery
+func isHeartbeat(msg *pb.Message) bool {
+	return msg.Event == pb.Event_STREAM && msg.From == "broker" && msg.Id == "" && len(msg.Data) == 0
+}
+
+// heartbeatStream cancels the stream through its watchdog when Recv waits for longer
+// than the timeout, and reports that as ErrHeartbeatMissed. The watchdog only runs
+// inside Recv, so a consumer busy with a message does not lose its stream.
+type heartbeatStream struct {
+	pb.Broker_ReceiveClient
+	timeout  time.Duration
+	watchdog *time.Timer
+	missed   *atomic.Bool
+}
+
+// watchHeartbeats wraps stream so that cancel is called once it stays silent for timeout
+func watchHeartbeats(stream pb.Broker_ReceiveClient, timeout time.Duration, cancel func()) *heartbeatStream {
+	missed := new(atomic.Bool)
+	watchdog := time.AfterFunc(timeout, func() {
+		missed.Store(true)
+		cancel()
+	})
+	watchdog.Stop()
+	return &heartbeatStream{Broker_ReceiveClient: stream, timeout: timeout, watchdog: watchdog, missed: missed}
+}
+
+func (s *heartbeatStream) Recv() (*pb.Message, error) {
+	s.watchdog.Reset(s.timeout)
+	msg, err := s.Broker_ReceiveClient.Recv()
+	s.watchdog.Stop()
+	if err != nil && s.missed.Load() {
+		return nil, ErrHeartbeatMissed
+	}
+	return msg, err
+}
@@ -0,0 +1,49 @@
+package client
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// negotiation holds the result of the last Hello
+type negotiation struct {
+	mu       sync.RWMutex
+	response *pb.HelloResponse
+}
+
+// Hello negotiates the protocol version and features with the broker. Brokers that
+// predate Hello report protocol version 0 and no features.
+func (ac *AuthenticatedClient) Hello(ctx context.Context) (*pb.HelloResponse, error) {
+	authCtx := ac.createAuthContext(ctx)
+	resp, err := ac.client.Hello(authCtx, &pb.HelloRequest{
+		From:            ac.serviceName,
+		ProtocolVersion: protocol.Version,
+		Features:        protocol.Features,
+	})
+	if status.Code(err) == codes.Unimplemented {
+		resp, err = &pb.HelloResponse{}, nil
+	}
+	if err != nil {
+		_, err = withStatus(nil, err)
+		return nil, err
+	}
+	ac.negotiated.mu.Lock()
+	ac.negotiated.response = resp
+	ac.negotiated.mu.Unlock()
+	return resp, nil
+}
+
+// Supports reports whether the broker agreed to a feature (see the protocol package)
+// in the last Hello. It is false until Hello succeeds.
+func (ac *AuthenticatedClient) Supports(feature string) bool {
+	ac.negotiated.mu.RLock()
+	defer ac.negotiated.mu.RUnlock()
+	return ac.negotiated.response != nil && slices.Contains(ac.negotiated.response.Features, feature)
+}
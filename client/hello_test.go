@@ -0,0 +1,22 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+)
+
+func TestHelloBrokerWithoutHello(t *testing.T) {
+	// The fake broker does not implement Hello, like brokers that predate it
+	c := newFakeClient(t, &fakeBroker{}, "orders")
+	resp, err := c.Hello(testContext(t))
+	if err != nil {
+		t.Fatalf("Hello failed: %v", err)
+	}
+	if resp.ProtocolVersion != 0 || len(resp.Features) != 0 {
+		t.Fatalf("expected version 0 and no features, got %v", resp)
+	}
+	if c.Supports(protocol.FeatureBatch) {
+		t.Fatalf("feature reported as supported by a broker without Hello")
+	}
+}
@@ -0,0 +1,22 @@
+package client
+
+import (
+	"context"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+)
+
+// Client is the part of the client API that application code typically depends on.
+// AuthenticatedClient, PooledClient, ShardedClient, FailoverClient and brokertest.FakeClient implement it.
+type Client interface {
+	Ping(ctx context.Context) (*pb.Status, error)
+	Send(ctx context.Context, to string, data []byte, msgType pb.Type, queue bool) (*pb.Status, error)
+	Receive(ctx context.Context) (pb.Broker_ReceiveClient, error)
+	Cleanup(ctx context.Context) (*pb.Status, error)
+	Close() error
+}
+
+var (
+	_ Client = (*AuthenticatedClient)(nil)
+	_ Client = (*PooledClient)(nil)
+)
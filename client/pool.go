@@ -0,0 +1,204 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/grpc/connectivity"
+)
+
+// DefaultPoolHealthInterval is how often pooled connections are pinged
+const DefaultPoolHealthInterval = 10 * time.Second
+
+// pooledConn is a pool member and its last health check result
+type pooledConn struct {
+	*AuthenticatedClient
+	healthy atomic.Bool
+}
+
+// usable reports whether the connection may take calls
+func (c *pooledConn) usable() bool {
+	switch c.conn.GetState() {
+	case connectivity.TransientFailure, connectivity.Shutdown:
+		return false
+	}
+	return c.healthy.Load()
+}
+
+// PooledClient spreads calls over several gRPC connections, since a single
+// HTTP/2 connection caps the throughput of very chatty producers
+type PooledClient struct {
+	conns []*pooledConn
+	next  atomic.Uint64
+	stop  chan struct{}
+	wg    sync.WaitGroup
+	once  sync.Once
+}
+
+// NewPooledClient opens size authenticated connections to the broker and health checks them in the background
+func NewPooledClient(address, serviceName, authMethod string, useTLS bool, certFile string, size int) (*PooledClient, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("pool size must be positive, got %d", size)
+	}
+	p := &PooledClient{stop: make(chan struct{})}
+	for i := 0; i < size; i++ {
+		ac, err := NewAuthenticatedClient(address, serviceName, authMethod, useTLS, certFile)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		conn := &pooledConn{AuthenticatedClient: ac}
+		conn.healthy.Store(true)
+		p.conns = append(p.conns, conn)
+	}
+	p.wg.Add(1)
+	go p.healthLoop(DefaultPoolHealthInterval)
+	return p, nil
+}
+
+// healthLoop pings every connection and takes failing ones out of rotation
+func (p *PooledClient) healthLoop(interval time.Duration) {
+	defer p.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			for _, conn := range p.conns {
+				ctx, cancel := context.WithTimeout(context.Background(), interval/2)
+				_, err := conn.Ping(WithRetryPolicy(ctx, NoRetry))
+				cancel()
+				// Rejected credentials say nothing about the connection itself
+				conn.healthy.Store(err == nil || !isBrokerFailure(err))
+			}
+		}
+	}
+}
+
+// Pick returns the next usable connection in round-robin order. When none is
+// usable every connection is tried in turn so calls still report the real error.
+func (p *PooledClient) Pick() *AuthenticatedClient {
+	n := uint64(len(p.conns))
+	start := p.next.Add(1)
+	for i := uint64(0); i < n; i++ {
+		if conn := p.conns[(start+i)%n]; conn.usable() {
+			return conn.AuthenticatedClient
+		}
+	}
+	return p.conns[start%n].AuthenticatedClient
+}
+
+// Healthy returns the number of connections currently in rotation
+func (p *PooledClient) Healthy() int {
+	healthy := 0
+	for _, conn := range p.conns {
+		if conn.usable() {
+			healthy++
+		}
+	}
+	return healthy
+}
+
+// SetAPIKey sets the API key on every connection
+func (p *PooledClient) SetAPIKey(apiKey string) {
+	for _, conn := range p.conns {
+		conn.SetAPIKey(apiKey)
+	}
+}
+
+// SetJWTToken sets the JWT token on every connection
+func (p *PooledClient) SetJWTToken(token string) {
+	for _, conn := range p.conns {
+		conn.SetJWTToken(token)
+	}
+}
+
+// SetRetryPolicy sets the retry policy on every connection
+func (p *PooledClient) SetRetryPolicy(policy RetryPolicy) {
+	for _, conn := range p.conns {
+		conn.SetRetryPolicy(policy)
+	}
+}
+
+// SetCircuitBreaker shares one circuit breaker between all connections
+func (p *PooledClient) SetCircuitBreaker(b *CircuitBreaker) {
+	for _, conn := range p.conns {
+		conn.SetCircuitBreaker(b)
+	}
+}
+
+// SetInstance sets the instance id on every connection (see AuthenticatedClient.SetInstance)
+func (p *PooledClient) SetInstance(instance string) {
+	for _, conn := range p.conns {
+		conn.SetInstance(instance)
+	}
+}
+
+// SetChecksum makes every connection attach checksums to sent messages
+func (p *PooledClient) SetChecksum(algorithm pb.ChecksumType) {
+	for _, conn := range p.conns {
+		conn.SetChecksum(algorithm)
+	}
+}
+
+// Hello negotiates with the broker on every connection and returns the first result
+func (p *PooledClient) Hello(ctx context.Context) (*pb.HelloResponse, error) {
+	var first *pb.HelloResponse
+	for _, conn := range p.conns {
+		resp, err := conn.Hello(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if first == nil {
+			first = resp
+		}
+	}
+	return first, nil
+}
+
+// Supports reports whether the broker agreed to a feature in the last Hello
+func (p *PooledClient) Supports(feature string) bool {
+	return p.conns[0].Supports(feature)
+}
+
+// Ping sends a ping request over the next connection
+func (p *PooledClient) Ping(ctx context.Context) (*pb.Status, error) {
+	return p.Pick().Ping(ctx)
+}
+
+// Send sends a message over the next connection
+func (p *PooledClient) Send(ctx context.Context, to string, data []byte, msgType pb.Type, queue bool) (*pb.Status, error) {
+	return p.Pick().Send(ctx, to, data, msgType, queue)
+}
+
+// Receive starts receiving messages over the next connection
+func (p *PooledClient) Receive(ctx context.Context) (pb.Broker_ReceiveClient, error) {
+	return p.Pick().Receive(ctx)
+}
+
+// Cleanup cleans up messages for the service
+func (p *PooledClient) Cleanup(ctx context.Context) (*pb.Status, error) {
+	return p.Pick().Cleanup(ctx)
+}
+
+// Close stops health checking and closes every connection
+func (p *PooledClient) Close() error {
+	var firstErr error
+	p.once.Do(func() {
+		close(p.stop)
+		p.wg.Wait()
+		for _, conn := range p.conns {
+			if err := conn.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	})
+	return firstErr
+}
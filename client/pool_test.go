@@ -0,0 +1,125 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newFakePool pools a client of each fake broker, health checked every interval
+func newFakePool(t *testing.T, interval time.Duration, brokers ...*fakeBroker) *PooledClient {
+	t.Helper()
+	p := &PooledClient{stop: make(chan struct{})}
+	for _, f := range brokers {
+		conn := &pooledConn{AuthenticatedClient: newFakeClient(t, f, "orders", WithRetry(NoRetry))}
+		conn.healthy.Store(true)
+		p.conns = append(p.conns, conn)
+	}
+	p.wg.Add(1)
+	go p.healthLoop(interval)
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+// setPingErr makes the pings of f fail with err, or succeed when err is nil
+func (f *fakeBroker) setPingErr(err error) {
+	f.mu.Lock()
+	f.pingErr = err
+	f.mu.Unlock()
+}
+
+// sentCount returns the number of messages f got
+func (f *fakeBroker) sentCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.sent)
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	brokers := []*fakeBroker{{}, {}, {}}
+	p := newFakePool(t, time.Hour, brokers...)
+
+	// Consecutive picks visit every connection once per round
+	seen := make(map[*AuthenticatedClient]int)
+	for range 3 * len(brokers) {
+		seen[p.Pick()]++
+	}
+	if len(seen) != len(brokers) {
+		t.Fatalf("expected every connection to be picked, got %d", len(seen))
+	}
+	for _, n := range seen {
+		if n != 3 {
+			t.Fatalf("expected 3 picks of each connection, got %v", seen)
+		}
+	}
+
+	for range 6 {
+		if _, err := p.Send(testContext(t), "billing", []byte("x"), pb.Type_TEXT, true); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	for i, f := range brokers {
+		if n := f.sentCount(); n != 2 {
+			t.Fatalf("expected 2 sends over connection %d, got %d", i, n)
+		}
+	}
+	if _, err := NewPooledClient("localhost:9000", "orders", "apikey", false, "", 0); err == nil {
+		t.Fatal("expected an empty pool to be refused")
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	brokers := []*fakeBroker{{}, {}, {}}
+	p := newFakePool(t, 20*time.Millisecond, brokers...)
+	waitHealthy := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for p.Healthy() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d healthy connections, got %d", want, p.Healthy())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// A connection failing its pings is taken out of rotation
+	brokers[1].setPingErr(status.Error(codes.Unavailable, "overloaded"))
+	waitHealthy(2)
+	for range 10 {
+		if _, err := p.Send(testContext(t), "billing", []byte("x"), pb.Type_TEXT, true); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	if n := brokers[1].sentCount(); n != 0 {
+		t.Fatalf("expected no sends over the unhealthy connection, got %d", n)
+	}
+	if brokers[0].sentCount()+brokers[2].sentCount() != 10 {
+		t.Fatal("expected the healthy connections to take every send")
+	}
+
+	// Rejected credentials say nothing about the connection
+	brokers[0].setPingErr(status.Error(codes.Unauthenticated, "bad key"))
+	time.Sleep(60 * time.Millisecond)
+	if p.Healthy() != 2 {
+		t.Fatalf("expected an authentication failure to leave the connection in rotation, got %d healthy", p.Healthy())
+	}
+
+	// Without a healthy connection calls still go out and report the real error
+	for _, f := range brokers {
+		f.setPingErr(status.Error(codes.Unavailable, "down"))
+	}
+	waitHealthy(0)
+	if p.Pick() == nil {
+		t.Fatal("expected a connection even when none is healthy")
+	}
+
+	// Connections whose pings succeed again come back
+	for _, f := range brokers {
+		f.setPingErr(nil)
+	}
+	waitHealthy(3)
+}
@@ -0,0 +1,35 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/ispapp/Microservices-Broker/base/provision"
+)
+
+// NewFromYAML connects serviceName with the broker address, API key and TLS settings
+// of a services YAML written by `broker auth provision-broker-yaml`. opts change the
+// loaded settings, e.g. WithTimeout or WithDialOptions.
+func NewFromYAML(path, serviceName string, opts ...Option) (*AuthenticatedClient, error) {
+	f, err := provision.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	conn, key, err := f.Service(serviceName)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	switch conn.AuthMethod {
+	case "", "apikey", "hmac":
+	default:
+		return nil, fmt.Errorf("%s: unsupported auth method %q for a provisioned key", path, conn.AuthMethod)
+	}
+	return New(Config{
+		Address:    conn.Address,
+		Service:    serviceName,
+		AuthMethod: conn.AuthMethod,
+		APIKey:     key,
+		TLS:        conn.TLS,
+		CAFile:     conn.CAFile,
+		ServerName: conn.ServerName,
+	}, opts...)
+}
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/ispapp/Microservices-Broker/transport"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// NewAuthenticatedQUICClient creates an authenticated client that reaches a
+// broker "grpc-quic" listener over QUIC (experimental). QUIC always uses TLS;
+// certFile optionally names a CA certificate, otherwise system roots are used.
+func NewAuthenticatedQUICClient(address, serviceName, authMethod, certFile string) (*AuthenticatedClient, error) {
+	tlsConfig := &tls.Config{}
+	if certFile != "" {
+		pem, err := os.ReadFile(certFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS credentials: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("failed to load TLS credentials: no certificates in %s", certFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	dialer := func(ctx context.Context, addr string) (net.Conn, error) {
+		return transport.DialQUIC(ctx, addr, tlsConfig)
+	}
+	// Encryption is provided by QUIC, gRPC itself runs in plaintext over the stream
+	return newAuthenticatedClient("passthrough:///"+address, serviceName, authMethod,
+		grpc.WithContextDialer(dialer),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+}
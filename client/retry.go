@@ -0,0 +1,227 @@
+package client
+
+import (
+	"context"
+	"io"
+	"math"
+	"math/rand"
+	"path"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy describes how failed calls are retried. Send, SendBatch and Nack are
+// not idempotent: a call failing with e.g. Unavailable may have reached the broker,
+// and retrying it queues the message twice. They are retried only with
+// RetryNonIdempotent, for callers whose consumers tolerate duplicates.
+type RetryPolicy struct {
+	MaxAttempts    int           // total attempts including the first, <= 1 disables retries
+	InitialBackoff time.Duration // delay before the first retry
+	MaxBackoff     time.Duration // upper bound for the delay
+	Multiplier     float64       // growth factor between retries
+	Jitter         float64       // random +/- fraction applied to each delay (0..1)
+	RetryableCodes []codes.Code  // codes worth retrying, defaults to those accepted by IsRetryable
+	// RetryNonIdempotent also retries Send, SendBatch and Nack, at the risk of duplicates
+	RetryNonIdempotent bool
+}
+
+// nonIdempotent are the methods a retry may apply twice
+var nonIdempotent = map[string]bool{"Send": true, "SendBatch": true, "Nack": true}
+
+// DefaultRetryPolicy retries transient failures of idempotent calls three times with
+// exponential backoff
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+	RetryableCodes: []codes.Code{codes.Unavailable, codes.ResourceExhausted, codes.Aborted},
+}
+
+// NoRetry disables retries, e.g. as a per-call override
+var NoRetry = RetryPolicy{MaxAttempts: 1}
+
+// retries reports whether p retries calls of method
+func (p *RetryPolicy) retries(method string) bool {
+	return p.RetryNonIdempotent || !nonIdempotent[path.Base(method)]
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if len(p.RetryableCodes) == 0 {
+		return IsRetryable(err)
+	}
+	code := status.Code(err)
+	for _, c := range p.RetryableCodes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before the given retry (1 for the first retry)
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	delay := float64(p.InitialBackoff) * math.Pow(multiplier, float64(retry-1))
+	if p.MaxBackoff > 0 && delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(delay)
+}
+
+// wait sleeps before a retry, giving up early when ctx ends
+func (p *RetryPolicy) wait(ctx context.Context, retry int) error {
+	timer := time.NewTimer(p.backoff(retry))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type retryPolicyKey struct{}
+
+// WithRetryPolicy overrides the client's retry policy for calls made with the returned context
+func WithRetryPolicy(ctx context.Context, policy RetryPolicy) context.Context {
+	return context.WithValue(ctx, retryPolicyKey{}, &policy)
+}
+
+// retryPolicyHolder resolves the policy for a call: a context override wins over the client default
+type retryPolicyHolder struct {
+	policy atomic.Pointer[RetryPolicy]
+	// deadlines bound re-establishing streams, none when nil
+	deadlines *deadlines
+}
+
+func (h *retryPolicyHolder) policyFor(ctx context.Context) *RetryPolicy {
+	if p, ok := ctx.Value(retryPolicyKey{}).(*RetryPolicy); ok {
+		return p
+	}
+	return h.policy.Load()
+}
+
+// unaryInterceptor retries unary calls according to the resolved policy
+func (h *retryPolicyHolder) unaryInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		policy := h.policyFor(ctx)
+		if policy != nil && !policy.retries(method) {
+			policy = nil
+		}
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		for retry := 1; policy != nil && err != nil && retry < policy.MaxAttempts && policy.retryable(err); retry++ {
+			if policy.wait(ctx, retry) != nil {
+				return err
+			}
+			err = invoker(ctx, method, req, reply, cc, opts...)
+		}
+		return err
+	}
+}
+
+// streamInterceptor retries opening a stream. Server-streaming calls are also
+// re-established when they fail before the first message arrives.
+func (h *retryPolicyHolder) streamInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		policy := h.policyFor(ctx)
+		open := func() (grpc.ClientStream, error) {
+			return streamer(ctx, desc, cc, method, opts...)
+		}
+		stream, err := open()
+		retry := 1
+		for ; policy != nil && err != nil && retry < policy.MaxAttempts && policy.retryable(err); retry++ {
+			if policy.wait(ctx, retry) != nil {
+				return nil, err
+			}
+			stream, err = open()
+		}
+		if err != nil || policy == nil || desc.ClientStreams {
+			return stream, err
+		}
+		rs := &retryStream{ClientStream: stream, ctx: ctx, cc: cc, policy: policy, open: open, retry: retry}
+		if _, ok := ctx.Deadline(); !ok && h.deadlines != nil {
+			rs.redial = h.deadlines.redial
+		}
+		return rs, nil
+	}
+}
+
+// retryStream replays the request of a server-streaming call on a new stream
+// when the first receive fails with a retryable code
+type retryStream struct {
+	grpc.ClientStream
+	ctx      context.Context
+	cc       *grpc.ClientConn
+	policy   *RetryPolicy
+	open     func() (grpc.ClientStream, error)
+	sent     []interface{}
+	closed   bool
+	received bool
+	retry    int
+	// redial bounds re-establishing the stream from its first failure (0 = unbounded)
+	redial   time.Duration
+	redialBy time.Time
+}
+
+func (s *retryStream) SendMsg(m interface{}) error {
+	s.sent = append(s.sent, m)
+	return s.ClientStream.SendMsg(m)
+}
+
+func (s *retryStream) CloseSend() error {
+	s.closed = true
+	return s.ClientStream.CloseSend()
+}
+
+func (s *retryStream) RecvMsg(m interface{}) error {
+	for {
+		err := s.ClientStream.RecvMsg(m)
+		if err == nil {
+			s.received = true
+			return nil
+		}
+		if s.received || err == io.EOF || s.retry >= s.policy.MaxAttempts || !s.policy.retryable(err) {
+			return err
+		}
+		if s.redial > 0 && s.redialBy.IsZero() {
+			s.redialBy = time.Now().Add(s.redial)
+		}
+		if s.policy.wait(s.ctx, s.retry) != nil {
+			return err
+		}
+		if !s.redialBy.IsZero() {
+			remaining := time.Until(s.redialBy)
+			if remaining <= 0 || awaitConnection(s.ctx, s.cc, remaining) != nil {
+				return err
+			}
+		}
+		s.retry++
+		stream, openErr := s.open()
+		if openErr != nil {
+			return err
+		}
+		for _, sent := range s.sent {
+			if err := stream.SendMsg(sent); err != nil {
+				return err
+			}
+		}
+		if s.closed {
+			if err := stream.CloseSend(); err != nil {
+				return err
+			}
+		}
+		s.ClientStream = stream
+	}
+}
@@ -0,0 +1,168 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second, Multiplier: 2}
+	for retry, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		if got := policy.backoff(retry + 1); got != want*time.Millisecond {
+			t.Errorf("retry %d: expected %s, got %s", retry+1, want*time.Millisecond, got)
+		}
+	}
+	// A multiplier below 1 keeps the delay constant
+	policy.Multiplier = 0.5
+	if got := policy.backoff(4); got != 100*time.Millisecond {
+		t.Errorf("expected a constant delay, got %s", got)
+	}
+
+	policy = RetryPolicy{InitialBackoff: 100 * time.Millisecond, Multiplier: 1, Jitter: 0.2}
+	for range 100 {
+		if got := policy.backoff(1); got < 80*time.Millisecond || got > 120*time.Millisecond {
+			t.Fatalf("expected the delay within 20%% of 100ms, got %s", got)
+		}
+	}
+}
+
+func TestRetryableCodes(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "restarting")
+	aborted := status.Error(codes.Aborted, "conflict")
+	invalid := status.Error(codes.InvalidArgument, "bad message")
+
+	defaults := RetryPolicy{}
+	if !defaults.retryable(unavailable) || !defaults.retryable(aborted) || defaults.retryable(invalid) {
+		t.Fatal("expected an empty code list to retry what IsRetryable accepts")
+	}
+	custom := RetryPolicy{RetryableCodes: []codes.Code{codes.InvalidArgument}}
+	if custom.retryable(unavailable) || !custom.retryable(invalid) {
+		t.Fatal("expected only the listed codes to be retried")
+	}
+	if defaults.retryable(errors.New("not a status")) {
+		t.Fatal("expected errors without a status not to be retried")
+	}
+}
+
+func TestRetryWaitContext(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if err := policy.wait(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the wait to end with the context, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the wait to end right away, took %s", elapsed)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	f := &fakeBroker{}
+	c := newFakeClient(t, f, "orders", WithRetry(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, RetryNonIdempotent: true}))
+	unavailable := status.Error(codes.Unavailable, "restarting")
+
+	f.sendErrors = []error{unavailable, unavailable, unavailable, unavailable}
+	if _, err := c.Send(testContext(t), "billing", nil, pb.Type_TEXT, true); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected Unavailable once the attempts are used up, got %v", err)
+	}
+	if len(f.sent) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(f.sent))
+	}
+
+	// A per-call policy replaces the client's
+	f.sent = nil
+	f.sendErrors = []error{unavailable}
+	if _, err := c.Send(WithRetryPolicy(testContext(t), NoRetry), "billing", nil, pb.Type_TEXT, true); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected Unavailable without retries, got %v", err)
+	}
+	if len(f.sent) != 1 {
+		t.Fatalf("expected a single attempt, got %d", len(f.sent))
+	}
+
+	// Backoff stops at the caller's deadline
+	slow := newFakeClient(t, f, "orders", WithRetry(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour, RetryNonIdempotent: true}))
+	f.sent = nil
+	f.sendErrors = []error{unavailable}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := slow.Send(ctx, "billing", nil, pb.Type_TEXT, true); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected the last error once the deadline passed, got %v", err)
+	}
+	if len(f.sent) != 1 {
+		t.Fatalf("expected no retry after the deadline, got %d attempts", len(f.sent))
+	}
+}
+
+func TestRetrySkipsNonIdempotent(t *testing.T) {
+	f := &fakeBroker{}
+	c := newFakeClient(t, f, "orders", WithRetry(DefaultRetryPolicy))
+	unavailable := status.Error(codes.Unavailable, "restarting")
+
+	// The broker may have queued the message before the call failed
+	f.sendErrors = []error{unavailable}
+	if _, err := c.Send(testContext(t), "billing", nil, pb.Type_TEXT, true); status.Code(err) != codes.Unavailable {
+		t.Fatalf("expected Unavailable without retries, got %v", err)
+	}
+	if len(f.sent) != 1 {
+		t.Fatalf("expected a single attempt, got %d", len(f.sent))
+	}
+
+	for method, want := range map[string]bool{
+		"/base.proto.Broker/Send":      false,
+		"/base.proto.Broker/SendBatch": false,
+		"/base.proto.Broker/Nack":      false,
+		"/base.proto.Broker/Ping":      true,
+		"/base.proto.Broker/Ack":       true,
+	} {
+		if got := DefaultRetryPolicy.retries(method); got != want {
+			t.Errorf("%s: expected retries %t, got %t", method, want, got)
+		}
+	}
+	optIn := DefaultRetryPolicy
+	optIn.RetryNonIdempotent = true
+	if !optIn.retries("/base.proto.Broker/Send") {
+		t.Errorf("expected Send to be retried with RetryNonIdempotent")
+	}
+}
+
+func TestRetryReceiveStream(t *testing.T) {
+	f := &fakeBroker{
+		receiveErrors: []error{status.Error(codes.Unavailable, "restarting")},
+		deliver:       []*pb.Message{{From: "orders", To: "billing", Data: []byte("one")}},
+	}
+	c := newFakeClient(t, f, "billing", WithRetry(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}))
+
+	// The stream failing before its first message is opened again
+	stream, err := c.Receive(testContext(t))
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	msg, err := stream.Recv()
+	if err != nil || string(msg.Data) != "one" {
+		t.Fatalf("expected the message of the re-established stream, got %v (%v)", msg, err)
+	}
+	f.mu.Lock()
+	calls := len(f.md)
+	f.mu.Unlock()
+	if calls != 2 {
+		t.Fatalf("expected 2 Receive calls, got %d", calls)
+	}
+
+	// Non-retryable failures end the stream
+	f.receiveErrors = []error{status.Error(codes.PermissionDenied, "denied")}
+	stream, err = c.Receive(testContext(t))
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied, got %v", err)
+	}
+}
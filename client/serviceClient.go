@@ -2,17 +2,17 @@ package client
 
 import (
 	"context"
-	"crypto/tls"
+	"errors"
 	"fmt"
-	"testing"
 	"time"
 
+	"github.com/ispapp/Microservices-Broker/base/checksum"
 	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
 
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 // AuthenticatedClient demonstrates how to use the broker with authentication
@@ -22,47 +22,88 @@ type AuthenticatedClient struct {
 	serviceName string
 	apiKey      string
 	jwtToken    string
-	authMethod  string // "jwt" or "apikey"
+	authMethod  string // "jwt", "apikey" or "hmac"
+	retry       retryPolicyHolder
+	deadlines   deadlines
+	breaker     *CircuitBreaker
+	async       asyncPool
+	checksum    pb.ChecksumType
+	compression compression
+	negotiated  negotiation
+	instance    string
+	life        lifecycle
+	// heartbeatTimeout fails Receive streams that stay silent that long (0 = never)
+	heartbeatTimeout time.Duration
 }
 
-// NewAuthenticatedClient creates a new authenticated client
+// NewAuthenticatedClient creates a new authenticated client. New takes a Config with
+// more settings, such as timeouts and the retry policy.
 func NewAuthenticatedClient(address, serviceName, authMethod string, useTLS bool, certFile string) (*AuthenticatedClient, error) {
-	var opts []grpc.DialOption
-
-	if useTLS {
-		if certFile != "" {
-			// Use custom certificate
-			creds, err := credentials.NewClientTLSFromFile(certFile, "")
-			if err != nil {
-				return nil, fmt.Errorf("failed to load TLS credentials: %w", err)
-			}
-			opts = append(opts, grpc.WithTransportCredentials(creds))
-		} else {
-			// Use system certificates
-			opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{})))
-		}
-	} else {
-		opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	return New(Config{Address: address, Service: serviceName, AuthMethod: authMethod, TLS: useTLS, CAFile: certFile})
+}
+
+// NewAuthenticatedClientWithOptions connects with caller-supplied dial options, such as
+// transport credentials or a custom dialer. At least transport credentials must be set.
+func NewAuthenticatedClientWithOptions(address, serviceName, authMethod string, opts ...grpc.DialOption) (*AuthenticatedClient, error) {
+	return newAuthenticatedClient(address, serviceName, authMethod, opts...)
+}
+
+// newAuthenticatedClient connects to address and installs the client-side interceptors
+func newAuthenticatedClient(address, serviceName, authMethod string, opts ...grpc.DialOption) (*AuthenticatedClient, error) {
+	ac := &AuthenticatedClient{
+		serviceName: serviceName,
+		authMethod:  authMethod,
+		deadlines:   defaultDeadlines,
 	}
+	ac.retry.deadlines = &ac.deadlines
+	// Deadlines come first, so that they bound retries too
+	opts = append([]grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(ac.deadlines.unaryInterceptor()),
+		grpc.WithChainStreamInterceptor(ac.deadlines.streamInterceptor()),
+	}, opts...)
+	opts = append(opts,
+		grpc.WithChainUnaryInterceptor(ac.retry.unaryInterceptor(), ac.signingUnaryInterceptor(), ac.compression.unaryInterceptor()),
+		grpc.WithChainStreamInterceptor(ac.retry.streamInterceptor(), ac.signingStreamInterceptor(), ac.compression.streamInterceptor()),
+	)
 
 	conn, err := grpc.NewClient(address, opts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect: %w", err)
 	}
-
-	return &AuthenticatedClient{
-		conn:        conn,
-		client:      pb.NewBrokerClient(conn),
-		serviceName: serviceName,
-		authMethod:  authMethod,
-	}, nil
+	ac.conn = conn
+	ac.client = pb.NewBrokerClient(conn)
+	return ac, nil
 }
 
-// SetAPIKey sets the API key for authentication
+// SetAPIKey sets the API key for authentication. With the "hmac" method it signs
+// requests instead of being sent.
 func (ac *AuthenticatedClient) SetAPIKey(apiKey string) {
 	ac.apiKey = apiKey
 }
 
+// SetRetryPolicy sets the retry policy used by every call; per-call overrides use WithRetryPolicy.
+// Retries are disabled until a policy is set.
+func (ac *AuthenticatedClient) SetRetryPolicy(policy RetryPolicy) {
+	ac.retry.policy.Store(&policy)
+}
+
+// SetCircuitBreaker guards Send with b so producers fail fast with ErrCircuitOpen while the broker is down
+func (ac *AuthenticatedClient) SetCircuitBreaker(b *CircuitBreaker) {
+	ac.breaker = b
+}
+
+// SetInstance sets the instance id of this client. Its Receive streams then also get the
+// messages sent to "<service>@<instance>", and its messages carry that address as From,
+// so replies reach this instance rather than any instance of the service.
+func (ac *AuthenticatedClient) SetInstance(instance string) {
+	ac.instance = instance
+}
+
+// address returns the address replies to this client are sent to
+func (ac *AuthenticatedClient) address() string {
+	return protocol.InstanceAddress(ac.serviceName, ac.instance)
+}
+
 // SetJWTToken sets the JWT token for authentication
 func (ac *AuthenticatedClient) SetJWTToken(token string) {
 	ac.jwtToken = token
@@ -89,125 +130,268 @@ func (ac *AuthenticatedClient) createAuthContext(ctx context.Context) context.Co
 // Ping sends a ping request to the broker
 func (ac *AuthenticatedClient) Ping(ctx context.Context) (*pb.Status, error) {
 	authCtx := ac.createAuthContext(ctx)
-	return ac.client.Ping(authCtx, &pb.Identity{From: ac.serviceName})
+	return withStatus(ac.client.Ping(authCtx, &pb.Identity{From: ac.serviceName}))
 }
 
-// Send sends a message through the broker
+// Send sends a message through the broker. On failure the returned error carries a gRPC
+// code (see IsRetryable) and the Status, when the broker sent one, is returned alongside it.
 func (ac *AuthenticatedClient) Send(ctx context.Context, to string, data []byte, msgType pb.Type, queue bool) (*pb.Status, error) {
-	authCtx := ac.createAuthContext(ctx)
+	return ac.SendPartitioned(ctx, to, "", data, msgType, queue)
+}
 
+// SendPartitioned sends a message of a partition: messages with the same partitionKey
+// are delivered in order and to a single instance of the recipient
+func (ac *AuthenticatedClient) SendPartitioned(ctx context.Context, to, partitionKey string, data []byte, msgType pb.Type, queue bool) (*pb.Status, error) {
+	if err := ac.life.begin(true); err != nil {
+		return nil, err
+	}
+	defer ac.life.end("")
 	msg := &pb.Message{
-		Data:  data,
-		Type:  msgType,
-		From:  ac.serviceName,
-		To:    to,
-		Queue: queue,
+		Data:         data,
+		Type:         msgType,
+		From:         ac.address(),
+		To:           to,
+		Queue:        queue,
+		PartitionKey: partitionKey,
 	}
+	return ac.sendMessage(ctx, msg)
+}
 
-	return ac.client.Send(authCtx, msg)
+// SendRouted queues a message for the first service of route. Each service passes it on
+// to the next one in route when it acks the message (or when it is delivered to a plain
+// Receive stream), so the steps of a workflow run in order without an orchestrator.
+func (ac *AuthenticatedClient) SendRouted(ctx context.Context, route []string, data []byte, msgType pb.Type) (*pb.Status, error) {
+	if len(route) == 0 {
+		return nil, errors.New("empty route")
+	}
+	if err := ac.life.begin(true); err != nil {
+		return nil, err
+	}
+	defer ac.life.end("")
+	msg := &pb.Message{
+		Data:        data,
+		Type:        msgType,
+		From:        ac.address(),
+		To:          route[0],
+		Queue:       true,
+		RoutingSlip: route[1:],
+	}
+	return ac.sendMessage(ctx, msg)
 }
 
-// Receive starts receiving messages from the broker
-func (ac *AuthenticatedClient) Receive(ctx context.Context) (pb.Broker_ReceiveClient, error) {
+// sendMessage sends msg through the circuit breaker, if any
+func (ac *AuthenticatedClient) sendMessage(ctx context.Context, msg *pb.Message) (*pb.Status, error) {
+	stampTrace(ctx, msg)
+	if ac.checksum != pb.ChecksumType_NO_CHECKSUM && msg.ChecksumType == pb.ChecksumType_NO_CHECKSUM {
+		if err := checksum.Set(msg, ac.checksum); err != nil {
+			return nil, err
+		}
+	}
 	authCtx := ac.createAuthContext(ctx)
-	return ac.client.Receive(authCtx, &pb.Identity{From: ac.serviceName})
+	if ac.breaker == nil {
+		return withStatus(ac.client.Send(authCtx, msg))
+	}
+	generation, err := ac.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+	status, err := withStatus(ac.client.Send(authCtx, msg))
+	ac.breaker.Record(generation, err)
+	return status, err
 }
 
-// Cleanup cleans up messages for the service
-func (ac *AuthenticatedClient) Cleanup(ctx context.Context) (*pb.Status, error) {
-	authCtx := ac.createAuthContext(ctx)
-	return ac.client.Cleanup(authCtx, &pb.Identity{From: ac.serviceName})
+// Receive starts receiving messages from the broker
+func (ac *AuthenticatedClient) Receive(ctx context.Context) (pb.Broker_ReceiveClient, error) {
+	return ac.receive(ctx, &pb.Identity{From: ac.serviceName, Instance: ac.instance})
 }
 
-// Close closes the connection
-func (ac *AuthenticatedClient) Close() error {
-	return ac.conn.Close()
+// ReceiveWithAck starts receiving messages that stay queued until acknowledged with Ack,
+// or are redelivered after the broker's ack timeout
+func (ac *AuthenticatedClient) ReceiveWithAck(ctx context.Context) (pb.Broker_ReceiveClient, error) {
+	return ac.receive(ctx, &pb.Identity{From: ac.serviceName, Instance: ac.instance, ManualAck: true})
 }
 
-// Example usage
-func TestAuthentication(t *testing.T) {
-	// Example 1: Using API Key authentication
-	fmt.Println("=== API Key Authentication Example ===")
-	apiKeyClient, err := NewAuthenticatedClient("localhost:50011", "service-1", "apikey", false, "")
+// receive opens a Receive stream that verifies message checksums
+func (ac *AuthenticatedClient) receive(ctx context.Context, identity *pb.Identity) (pb.Broker_ReceiveClient, error) {
+	// Shutdown closes the stream through its own cancel
+	ctx, cancel := context.WithCancel(ctx)
+	tracked := &trackedStream{life: &ac.life, manualAck: identity.ManualAck}
+	if err := ac.life.track(tracked, cancel); err != nil {
+		cancel()
+		return nil, err
+	}
+	authCtx := ac.createAuthContext(ctx)
+	stream, err := ac.client.Receive(authCtx, identity)
 	if err != nil {
-		t.Fatalf("Failed to create API key client: %v", err)
+		ac.life.untrack(tracked)
+		return nil, err
+	}
+	if ac.heartbeatTimeout > 0 {
+		stream = watchHeartbeats(stream, ac.heartbeatTimeout, cancel)
 	}
-	defer apiKeyClient.Close()
+	tracked.Broker_ReceiveClient = &verifyingStream{Broker_ReceiveClient: stream}
+	return tracked, nil
+}
 
-	// Set API key (you would get this from your configuration)
-	apiKeyClient.SetAPIKey("your-api-key-here")
+// Ack acknowledges a message received with ReceiveWithAck
+func (ac *AuthenticatedClient) Ack(ctx context.Context, id string) (*pb.Status, error) {
+	if err := ac.life.begin(false); err != nil {
+		return nil, err
+	}
+	defer ac.life.end(id)
+	authCtx := ac.createAuthContext(ctx)
+	return withStatus(ac.client.Ack(authCtx, &pb.AckRequest{From: ac.serviceName, Id: id}))
+}
 
-	// Test ping
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// Nack rejects a message received with ReceiveWithAck; it is redelivered after delay
+func (ac *AuthenticatedClient) Nack(ctx context.Context, id string, delay time.Duration) (*pb.Status, error) {
+	if err := ac.life.begin(false); err != nil {
+		return nil, err
+	}
+	defer ac.life.end(id)
+	authCtx := ac.createAuthContext(ctx)
+	return withStatus(ac.client.Nack(authCtx, &pb.NackRequest{From: ac.serviceName, Id: id, RequeueDelay: durationpb.New(delay)}))
+}
+
+// Fetch pulls up to maxMessages queued messages (0 = the broker's batch size) without a
+// Receive stream, downloading the payloads the broker kept in object storage. Each has to be acknowledged with Ack, or is redelivered once visibility
+// (0 = the broker's ack timeout) lapses.
+func (ac *AuthenticatedClient) Fetch(ctx context.Context, maxMessages int, visibility time.Duration) ([]*pb.Message, error) {
+	return ac.FetchWait(ctx, maxMessages, visibility, 0)
+}
 
-	status, err := apiKeyClient.Ping(ctx)
+// FetchWait is Fetch with long polling: when no message is visible, the broker holds the
+// call for up to wait (whole seconds, at most 20s) until one arrives, and returns an empty
+// batch only once wait has passed
+func (ac *AuthenticatedClient) FetchWait(ctx context.Context, maxMessages int, visibility, wait time.Duration) ([]*pb.Message, error) {
+	if err := ac.life.begin(true); err != nil {
+		return nil, err
+	}
+	defer ac.life.end("")
+	authCtx := ac.createAuthContext(ctx)
+	resp, err := ac.client.Fetch(authCtx, &pb.FetchRequest{
+		From:              ac.serviceName,
+		MaxMessages:       uint32(maxMessages),
+		VisibilityTimeout: durationpb.New(visibility),
+		Instance:          ac.instance,
+		WaitSeconds:       uint32((wait + time.Second - 1) / time.Second),
+	})
 	if err != nil {
-		t.Logf("API Key Ping failed: %v", err)
-	} else {
-		fmt.Printf("API Key Ping response: %s (Success: %t)\n", status.Message, status.Success)
+		_, err = withStatus(nil, err)
+		return nil, err
+	}
+	// Messages whose payload cannot be downloaded are redelivered once visibility lapses
+	for _, msg := range resp.Messages {
+		if err := redeem(ctx, msg); err != nil {
+			return nil, err
+		}
+	}
+	for _, msg := range resp.Messages {
+		ac.life.received(msg.Id)
 	}
+	return resp.Messages, nil
+}
 
-	// Example 2: Using JWT authentication
-	fmt.Println("\n=== JWT Authentication Example ===")
-	jwtClient, err := NewAuthenticatedClient("localhost:50011", "service-2", "jwt", false, "")
+// ExtendVisibility keeps a message received with ReceiveWithAck or Fetch invisible for
+// duration from now, while its processing takes longer than the visibility timeout.
+// The message gets a new id, which must be used to Ack or Nack it from then on.
+func (ac *AuthenticatedClient) ExtendVisibility(ctx context.Context, id string, duration time.Duration) (string, error) {
+	if err := ac.life.begin(false); err != nil {
+		return "", err
+	}
+	defer ac.life.end("")
+	authCtx := ac.createAuthContext(ctx)
+	resp, err := ac.client.ExtendVisibility(authCtx, &pb.ExtendVisibilityRequest{From: ac.serviceName, Id: id, Duration: durationpb.New(duration)})
 	if err != nil {
-		t.Fatalf("Failed to create JWT client: %v", err)
+		_, err = withStatus(nil, err)
+		return "", err
 	}
-	defer jwtClient.Close()
+	ac.life.moved(id, resp.Id)
+	return resp.Id, nil
+}
 
-	// Set JWT token (you would get this from your authentication service)
-	jwtClient.SetJWTToken("your-jwt-token-here")
+// Cleanup cleans up messages for the service
+func (ac *AuthenticatedClient) Cleanup(ctx context.Context) (*pb.Status, error) {
+	authCtx := ac.createAuthContext(ctx)
+	return withStatus(ac.client.Cleanup(authCtx, &pb.Identity{From: ac.serviceName}))
+}
+
+// PauseDelivery holds delivery of a service's queue while sends keep queueing
+func (ac *AuthenticatedClient) PauseDelivery(ctx context.Context, service string) (*pb.Status, error) {
+	authCtx := ac.createAuthContext(ctx)
+	return withStatus(ac.client.PauseDelivery(authCtx, &pb.Identity{From: service}))
+}
 
-	// Test ping
-	ctx2, cancel2 := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel2()
+// ResumeDelivery resumes delivery of a paused service
+func (ac *AuthenticatedClient) ResumeDelivery(ctx context.Context, service string) (*pb.Status, error) {
+	authCtx := ac.createAuthContext(ctx)
+	return withStatus(ac.client.ResumeDelivery(authCtx, &pb.Identity{From: service}))
+}
 
-	status2, err := jwtClient.Ping(ctx2)
-	if err != nil {
-		t.Logf("JWT Ping failed: %v", err)
-	} else {
-		fmt.Printf("JWT Ping response: %s (Success: %t)\n", status2.Message, status2.Success)
-	}
+// SetReadOnly switches the broker's read-only mode
+func (ac *AuthenticatedClient) SetReadOnly(ctx context.Context, enabled bool) (*pb.Status, error) {
+	authCtx := ac.createAuthContext(ctx)
+	return withStatus(ac.client.SetReadOnly(authCtx, &pb.ReadOnlyRequest{Enabled: enabled}))
+}
 
-	// Example 3: Send and receive messages
-	fmt.Println("\n=== Message Exchange Example ===")
+// SetLogLevel changes the broker's log level: "debug", "info" or "warn"
+func (ac *AuthenticatedClient) SetLogLevel(ctx context.Context, level string) (*pb.Status, error) {
+	authCtx := ac.createAuthContext(ctx)
+	return withStatus(ac.client.SetLogLevel(authCtx, &pb.LogLevelRequest{Level: level}))
+}
 
-	// Send a message
-	sendCtx, sendCancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer sendCancel()
+// LogPayloads makes the broker log the payloads of the messages service sends or is
+// sent for duration, or stops it when duration is 0
+func (ac *AuthenticatedClient) LogPayloads(ctx context.Context, service string, duration time.Duration) (*pb.Status, error) {
+	authCtx := ac.createAuthContext(ctx)
+	return withStatus(ac.client.SetPayloadLogging(authCtx, &pb.PayloadLoggingRequest{Service: service, Duration: durationpb.New(duration)}))
+}
 
-	sendStatus, err := apiKeyClient.Send(sendCtx, "service-2", []byte("Hello from service-1"), pb.Type_TEXT, true)
-	if err != nil {
-		t.Logf("Send failed: %v", err)
-	} else {
-		fmt.Printf("Send response: %s (Success: %t)\n", sendStatus.Message, sendStatus.Success)
-	}
+// SetSlowLogging makes the broker log the calls slower than threshold, or stops it
+// when threshold is 0
+func (ac *AuthenticatedClient) SetSlowLogging(ctx context.Context, threshold time.Duration) (*pb.Status, error) {
+	authCtx := ac.createAuthContext(ctx)
+	return withStatus(ac.client.SetSlowLogging(authCtx, &pb.SlowLoggingRequest{Threshold: durationpb.New(threshold)}))
+}
+
+// WatchEvents streams broker lifecycle events for services (all when empty), optionally
+// limited to the given event types
+func (ac *AuthenticatedClient) WatchEvents(ctx context.Context, services []string, types ...pb.BrokerEventType) (pb.Broker_WatchEventsClient, error) {
+	authCtx := ac.createAuthContext(ctx)
+	return ac.client.WatchEvents(authCtx, &pb.WatchEventsRequest{Services: services, Types: types})
+}
 
-	// Start receiving messages
-	recvCtx, recvCancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer recvCancel()
+// Tap streams copies of a sample of the messages sent to service, sampleRate being the
+// fraction in (0, 1] to mirror. The mirrored messages are delivered as usual.
+func (ac *AuthenticatedClient) Tap(ctx context.Context, service string, sampleRate float64) (pb.Broker_TapClient, error) {
+	authCtx := ac.createAuthContext(ctx)
+	return ac.client.Tap(authCtx, &pb.TapRequest{Service: service, SampleRate: sampleRate})
+}
 
-	stream, err := jwtClient.Receive(recvCtx)
+// QuotaUsage reports the quota usage of services, or of every service with usage or a quota
+func (ac *AuthenticatedClient) QuotaUsage(ctx context.Context, services ...string) ([]*pb.QuotaUsage, error) {
+	authCtx := ac.createAuthContext(ctx)
+	resp, err := ac.client.GetQuotaUsage(authCtx, &pb.QuotaUsageRequest{Services: services})
 	if err != nil {
-		t.Logf("Receive failed: %v", err)
-		return
-	}
-
-	// Listen for messages
-	go func() {
-		for {
-			msg, err := stream.Recv()
-			if err != nil {
-				t.Logf("Receive stream error: %v", err)
-				return
-			}
-			fmt.Printf("Received message: %s (from: %s, type: %s)\n", string(msg.Data), msg.From, msg.Type)
-		}
-	}()
+		return nil, err
+	}
+	return resp.Usage, nil
+}
 
-	// Wait for messages
-	time.Sleep(2 * time.Second)
+// Stats reports the delivery latencies of services, or of every destination with
+// deliveries since the broker started
+func (ac *AuthenticatedClient) Stats(ctx context.Context, services ...string) ([]*pb.DestinationStats, error) {
+	authCtx := ac.createAuthContext(ctx)
+	resp, err := ac.client.GetStats(authCtx, &pb.StatsRequest{Services: services})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Destinations, nil
+}
 
-	fmt.Println("\nExample completed!")
+// Close waits for pending asynchronous sends and closes the connection, dropping Receive
+// streams and unacknowledged messages; Shutdown drains them first
+func (ac *AuthenticatedClient) Close() error {
+	ac.stopAsync()
+	return ac.conn.Close()
 }
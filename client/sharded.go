@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/shard"
+
+	"google.golang.org/grpc"
+)
+
+// ShardedClient routes calls to the broker shard owning the service they are about,
+// so producers and consumers talk to a sharded deployment without a proxying broker
+type ShardedClient struct {
+	shards      *shard.Map
+	serviceName string
+	clients     map[string]*AuthenticatedClient
+}
+
+var _ Client = (*ShardedClient)(nil)
+
+// NewShardedClient connects to every shard of shards with opts, which must at least
+// set transport credentials
+func NewShardedClient(shards *shard.Map, serviceName, authMethod string, opts ...grpc.DialOption) (*ShardedClient, error) {
+	sc := &ShardedClient{shards: shards, serviceName: serviceName, clients: make(map[string]*AuthenticatedClient)}
+	for _, s := range shards.Shards() {
+		ac, err := NewAuthenticatedClientWithOptions(s.Address, serviceName, authMethod, opts...)
+		if err != nil {
+			sc.Close()
+			return nil, err
+		}
+		sc.clients[s.Name] = ac
+	}
+	return sc, nil
+}
+
+// For returns the client connected to the shard owning address, for calls
+// ShardedClient does not route itself
+func (sc *ShardedClient) For(address string) *AuthenticatedClient {
+	return sc.clients[sc.shards.Owner(address).Name]
+}
+
+// each applies set to the client of every shard
+func (sc *ShardedClient) each(set func(*AuthenticatedClient)) {
+	for _, ac := range sc.clients {
+		set(ac)
+	}
+}
+
+// SetAPIKey sets the API key used with every shard
+func (sc *ShardedClient) SetAPIKey(apiKey string) {
+	sc.each(func(ac *AuthenticatedClient) { ac.SetAPIKey(apiKey) })
+}
+
+// SetJWTToken sets the JWT token used with every shard
+func (sc *ShardedClient) SetJWTToken(token string) {
+	sc.each(func(ac *AuthenticatedClient) { ac.SetJWTToken(token) })
+}
+
+// SetRetryPolicy sets the retry policy of every shard connection
+func (sc *ShardedClient) SetRetryPolicy(policy RetryPolicy) {
+	sc.each(func(ac *AuthenticatedClient) { ac.SetRetryPolicy(policy) })
+}
+
+// SetInstance sets the instance id of this client on every shard connection
+func (sc *ShardedClient) SetInstance(instance string) {
+	sc.each(func(ac *AuthenticatedClient) { ac.SetInstance(instance) })
+}
+
+// Ping pings the shard owning this client's service
+func (sc *ShardedClient) Ping(ctx context.Context) (*pb.Status, error) {
+	return sc.For(sc.serviceName).Ping(ctx)
+}
+
+// Send sends a message through the shard owning the recipient
+func (sc *ShardedClient) Send(ctx context.Context, to string, data []byte, msgType pb.Type, queue bool) (*pb.Status, error) {
+	return sc.For(to).Send(ctx, to, data, msgType, queue)
+}
+
+// Receive receives this client's messages from the shard owning its service
+func (sc *ShardedClient) Receive(ctx context.Context) (pb.Broker_ReceiveClient, error) {
+	return sc.For(sc.serviceName).Receive(ctx)
+}
+
+// ReceiveWithAck receives this client's messages in manual-ack mode from the shard owning its service
+func (sc *ShardedClient) ReceiveWithAck(ctx context.Context) (pb.Broker_ReceiveClient, error) {
+	return sc.For(sc.serviceName).ReceiveWithAck(ctx)
+}
+
+// Ack acknowledges a message received with ReceiveWithAck
+func (sc *ShardedClient) Ack(ctx context.Context, id string) (*pb.Status, error) {
+	return sc.For(sc.serviceName).Ack(ctx, id)
+}
+
+// Nack rejects a message received with ReceiveWithAck; it is redelivered after delay
+func (sc *ShardedClient) Nack(ctx context.Context, id string, delay time.Duration) (*pb.Status, error) {
+	return sc.For(sc.serviceName).Nack(ctx, id, delay)
+}
+
+// Cleanup cleans up messages for the service on the shard owning it
+func (sc *ShardedClient) Cleanup(ctx context.Context) (*pb.Status, error) {
+	return sc.For(sc.serviceName).Cleanup(ctx)
+}
+
+// Close closes the connections to every shard
+func (sc *ShardedClient) Close() error {
+	var errs []error
+	for _, ac := range sc.clients {
+		errs = append(errs, ac.Close())
+	}
+	return errors.Join(errs...)
+}
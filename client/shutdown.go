@@ -0,0 +1,230 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+)
+
+// lifecycle tracks the work Shutdown waits for
+type lifecycle struct {
+	mu       sync.Mutex
+	draining bool
+	calls    int                 // Sends, Acks and Nacks in progress
+	unacked  map[string]struct{} // ids received in manual-ack mode or fetched, and not yet acked or nacked
+	streams  map[*trackedStream]context.CancelFunc
+	changed  chan struct{} // closed and replaced whenever calls or unacked shrink
+}
+
+// begin registers a call; sends and fetches are refused once Shutdown has started
+func (l *lifecycle) begin(send bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.draining && send {
+		return ErrClientClosed
+	}
+	l.calls++
+	return nil
+}
+
+// end unregisters a call, settling id when it acknowledged a message
+func (l *lifecycle) end(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls--
+	delete(l.unacked, id)
+	l.notify()
+}
+
+// notify wakes Shutdown; l.mu must be held
+func (l *lifecycle) notify() {
+	if l.changed != nil {
+		close(l.changed)
+		l.changed = nil
+	}
+}
+
+// received records a message a manual-ack consumer has to settle
+func (l *lifecycle) received(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.unacked == nil {
+		l.unacked = make(map[string]struct{})
+	}
+	l.unacked[id] = struct{}{}
+}
+
+// moved follows an unsettled message to the id it got from ExtendVisibility
+func (l *lifecycle) moved(id, newID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.unacked[id]; ok {
+		delete(l.unacked, id)
+		l.unacked[newID] = struct{}{}
+	}
+}
+
+// track registers a Receive stream so Shutdown can close it
+func (l *lifecycle) track(s *trackedStream, cancel context.CancelFunc) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.draining {
+		return ErrClientClosed
+	}
+	if l.streams == nil {
+		l.streams = make(map[*trackedStream]context.CancelFunc)
+	}
+	l.streams[s] = cancel
+	return nil
+}
+
+// untrack forgets a stream that ended on its own
+func (l *lifecycle) untrack(s *trackedStream) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if cancel, ok := l.streams[s]; ok {
+		cancel()
+		delete(l.streams, s)
+	}
+}
+
+// isDraining reports whether Shutdown has started
+func (l *lifecycle) isDraining() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.draining
+}
+
+// idle returns nil once no call is in progress and every received message is settled,
+// or a channel that is closed when that may have changed
+func (l *lifecycle) idle() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.calls == 0 && len(l.unacked) == 0 {
+		return nil
+	}
+	if l.changed == nil {
+		l.changed = make(chan struct{})
+	}
+	return l.changed
+}
+
+// closeStreams cancels every tracked Receive stream
+func (l *lifecycle) closeStreams() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for s, cancel := range l.streams {
+		cancel()
+		delete(l.streams, s)
+	}
+}
+
+// trackedStream records the messages of a manual-ack stream until they are settled and
+// stops handing out messages once Shutdown has started
+type trackedStream struct {
+	pb.Broker_ReceiveClient
+	life      *lifecycle
+	manualAck bool
+}
+
+func (s *trackedStream) Recv() (*pb.Message, error) {
+	if s.life.isDraining() {
+		return nil, ErrClientClosed
+	}
+	msg, err := s.Broker_ReceiveClient.Recv()
+	if err != nil && msg == nil {
+		s.life.untrack(s)
+		return nil, err
+	}
+	if s.manualAck && msg.Id != "" {
+		s.life.received(msg.Id)
+	}
+	return msg, err
+}
+
+// Shutdown closes the client gracefully. It refuses new sends and Receive streams right
+// away, then waits until queued asynchronous sends have finished and every message
+// received with ReceiveWithAck or Fetch has been acked or nacked. Only then are the Receive
+// streams and the connection closed. Receive streams return ErrClientClosed from Recv
+// once Shutdown has started, so consumers stop after settling the message at hand.
+// When ctx ends first, everything is closed anyway and ctx's error is returned; unsettled
+// messages are redelivered after the broker's ack timeout.
+func (ac *AuthenticatedClient) Shutdown(ctx context.Context) error {
+	ac.life.mu.Lock()
+	ac.life.draining = true
+	ac.life.mu.Unlock()
+
+	asyncDone := make(chan struct{})
+	go func() {
+		ac.stopAsync()
+		close(asyncDone)
+	}()
+	err := func() error {
+		select {
+		case <-asyncDone:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		for {
+			changed := ac.life.idle()
+			if changed == nil {
+				return nil
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}()
+	ac.life.closeStreams()
+	return errors.Join(err, ac.conn.Close())
+}
+
+// Shutdown shuts every connection down gracefully (see AuthenticatedClient.Shutdown)
+func (p *PooledClient) Shutdown(ctx context.Context) error {
+	var errs []error
+	p.once.Do(func() {
+		close(p.stop)
+		p.wg.Wait()
+		errs = shutdownAll(ctx, len(p.conns), func(i int) *AuthenticatedClient { return p.conns[i].AuthenticatedClient })
+	})
+	return errors.Join(errs...)
+}
+
+// Shutdown shuts the connection to every shard down gracefully (see AuthenticatedClient.Shutdown)
+func (sc *ShardedClient) Shutdown(ctx context.Context) error {
+	clients := make([]*AuthenticatedClient, 0, len(sc.clients))
+	for _, ac := range sc.clients {
+		clients = append(clients, ac)
+	}
+	return errors.Join(shutdownAll(ctx, len(clients), func(i int) *AuthenticatedClient { return clients[i] })...)
+}
+
+// Shutdown shuts the connection to every broker down gracefully (see AuthenticatedClient.Shutdown)
+func (fc *FailoverClient) Shutdown(ctx context.Context) error {
+	var errs []error
+	fc.once.Do(func() {
+		close(fc.stop)
+		fc.wg.Wait()
+		errs = shutdownAll(ctx, len(fc.endpoints), func(i int) *AuthenticatedClient { return fc.endpoints[i].AuthenticatedClient })
+	})
+	return errors.Join(errs...)
+}
+
+// shutdownAll shuts n clients down concurrently, so they share ctx's deadline
+func shutdownAll(ctx context.Context, n int, client func(int) *AuthenticatedClient) []error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = client(i).Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+)
+
+func TestShutdown(t *testing.T) {
+	ctx := testContext(t)
+	f := &fakeBroker{deliver: []*pb.Message{
+		{Id: "1", Data: []byte("first"), From: "orders", To: "billing", Event: pb.Event_MESSAGE},
+		{Id: "2", Data: []byte("second"), From: "orders", To: "billing", Event: pb.Event_MESSAGE},
+	}}
+	billing := newFakeClient(t, f, "billing")
+	stream, err := billing.ReceiveWithAck(ctx)
+	if err != nil {
+		t.Fatalf("ReceiveWithAck failed: %v", err)
+	}
+	msg, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- billing.Shutdown(ctx) }()
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := billing.Send(ctx, "orders", []byte("late"), pb.Type_TEXT, true)
+		if errors.Is(err, ErrClientClosed) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected sends to be refused, got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The received message is still being processed
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned before the message was acked: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := billing.Ack(ctx, msg.Id); err != nil {
+		t.Fatalf("Ack during shutdown failed: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+	if _, err := stream.Recv(); !errors.Is(err, ErrClientClosed) {
+		t.Fatalf("expected ErrClientClosed from Recv after Shutdown, got %v", err)
+	}
+	f.mu.Lock()
+	acked := slices.Clone(f.acked)
+	f.mu.Unlock()
+	if !slices.Equal(acked, []string{"1"}) {
+		t.Fatalf("expected only the processed message to be acked, got %v", acked)
+	}
+
+	// Shutdown gives up on unsettled messages at the deadline
+	other := newFakeClient(t, f, "billing")
+	if stream, err = other.ReceiveWithAck(ctx); err != nil {
+		t.Fatalf("ReceiveWithAck failed: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	shortCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := other.Shutdown(shortCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to end Shutdown, got %v", err)
+	}
+}
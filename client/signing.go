@@ -0,0 +1,61 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// signRequest adds the signature of a call to its outgoing metadata. With the "hmac"
+// auth method the API key set with SetAPIKey signs every call and is never sent.
+func (ac *AuthenticatedClient) signRequest(ctx context.Context, method string, req any) (context.Context, error) {
+	if ac.authMethod != "hmac" || ac.apiKey == "" {
+		return ctx, nil
+	}
+	body, err := protocol.SignedBody(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to create nonce: %w", err)
+	}
+	timestamp := time.Now().Unix()
+	n := hex.EncodeToString(nonce)
+	return metadata.AppendToOutgoingContext(ctx,
+		protocol.SignatureKeyIDHeader, protocol.SignatureKeyID(ac.apiKey),
+		protocol.SignatureTimestampHeader, strconv.FormatInt(timestamp, 10),
+		protocol.SignatureNonceHeader, n,
+		protocol.SignatureHeader, protocol.Sign(ac.apiKey, method, timestamp, n, body),
+	), nil
+}
+
+// signingUnaryInterceptor signs each attempt of a unary call, retries included
+func (ac *AuthenticatedClient) signingUnaryInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, err := ac.signRequest(ctx, method, req)
+		if err != nil {
+			return err
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// signingStreamInterceptor signs the opening of streams, which cover an empty body
+func (ac *AuthenticatedClient) signingStreamInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		ctx, err := ac.signRequest(ctx, method, nil)
+		if err != nil {
+			return nil, err
+		}
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+}
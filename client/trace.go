@@ -0,0 +1,22 @@
+package client
+
+import (
+	"context"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+)
+
+type traceIDKey struct{}
+
+// WithTraceID makes messages sent with ctx carry id as their trace id instead of one
+// assigned by the broker, e.g. to reuse the trace id of an incoming request
+func WithTraceID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, traceIDKey{}, id)
+}
+
+// stampTrace sets the trace id chosen with WithTraceID on msg
+func stampTrace(ctx context.Context, msg *pb.Message) {
+	if id, ok := ctx.Value(traceIDKey{}).(string); ok && msg.TraceId == "" {
+		msg.TraceId = id
+	}
+}
@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"github.com/urfave/cli/v2"
+)
+
+// NewApp returns the broker command line application
+func NewApp() *cli.App {
+	return &cli.App{
+		Name:           "Microservices Broker",
+		Usage:          "Simple Microservices Broker",
+		DefaultCommand: "serve",
+		Flags:          []cli.Flag{OutputFlag, QuietFlag, YesFlag},
+		Commands: []*cli.Command{
+			ServerCommand,
+			ConfigCommand,
+			AuthCommand,
+			BenchCommand,
+			TapCommand,
+			DBCommand,
+			ServiceCommand,
+			K8sCommand,
+			ProfileCommand,
+		},
+	}
+}
@@ -2,9 +2,14 @@ package cmd
 
 import (
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/ispapp/Microservices-Broker/base/provision"
 	"github.com/ispapp/Microservices-Broker/cmd/lib"
 	"github.com/urfave/cli/v2"
 )
@@ -16,7 +21,7 @@ var AuthCommand = &cli.Command{
 		{
 			Name:  "generate-key",
 			Usage: "Generate a new API key for a service",
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				&cli.StringFlag{
 					Name:     "service",
 					Aliases:  []string{"s"},
@@ -29,7 +34,7 @@ var AuthCommand = &cli.Command{
 					Usage:   "Configuration file path",
 					Value:   "config.json",
 				},
-			},
+			}, keyInfoFlags...),
 			Action: func(c *cli.Context) error {
 				serviceName := c.String("service")
 				configPath := c.String("config")
@@ -38,16 +43,21 @@ var AuthCommand = &cli.Command{
 				if err != nil {
 					return fmt.Errorf("failed to load config: %w", err)
 				}
+				info := lib.APIKeyInfo{CreatedAt: time.Now().UTC()}
+				if err := applyKeyInfoFlags(c, &info); err != nil {
+					return err
+				}
 
 				authManager := lib.NewAuthManager(&config.Auth)
 				apiKey := authManager.GenerateAPIKey(serviceName)
+				config.Auth.SetKeyInfo(apiKey, info)
 
 				// Save the updated config
 				if err := config.SaveConfig(configPath); err != nil {
 					return fmt.Errorf("failed to save config: %w", err)
 				}
 
-				fmt.Printf("Generated API key for service '%s': %s\n", serviceName, apiKey)
+				result(c, fmt.Sprintf("Generated API key for service '%s'", serviceName), apiKey)
 				return nil
 			},
 		},
@@ -77,20 +87,34 @@ var AuthCommand = &cli.Command{
 					return fmt.Errorf("failed to load config: %w", err)
 				}
 
-				authManager := lib.NewAuthManager(&config.Auth)
+				authConfig, err := config.Auth.ResolveSecrets(c.Context)
+				if err != nil {
+					return fmt.Errorf("failed to resolve auth secrets: %w", err)
+				}
+
+				authManager := lib.NewAuthManager(authConfig)
 				token, err := authManager.GenerateJWT(serviceName)
 				if err != nil {
 					return fmt.Errorf("failed to generate JWT: %w", err)
 				}
 
-				fmt.Printf("Generated JWT token for service '%s': %s\n", serviceName, token)
+				result(c, fmt.Sprintf("Generated JWT token for service '%s'", serviceName), token)
 				return nil
 			},
 		},
 		{
-			Name:  "list-keys",
-			Usage: "List all API keys and their associated services",
+			Name:  "revoke-jwt",
+			Usage: "Revoke a JWT token before it expires",
 			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "token",
+					Aliases: []string{"t"},
+					Usage:   "Token to revoke",
+				},
+				&cli.StringFlag{
+					Name:  "id",
+					Usage: "Id (jti) of the token to revoke, when the token itself is not at hand",
+				},
 				&cli.StringFlag{
 					Name:    "config",
 					Aliases: []string{"c"},
@@ -100,22 +124,151 @@ var AuthCommand = &cli.Command{
 			},
 			Action: func(c *cli.Context) error {
 				configPath := c.String("config")
+				if (c.String("token") == "") == (c.String("id") == "") {
+					return fmt.Errorf("either --token or --id is required")
+				}
 
 				config, err := lib.LoadConfig(configPath)
 				if err != nil {
 					return fmt.Errorf("failed to load config: %w", err)
 				}
 
-				if len(config.Auth.APIKeys) == 0 {
-					fmt.Println("No API keys found")
-					return nil
+				id := c.String("id")
+				// Without the token, keep the revocation as long as any token may live
+				expires := time.Now().Add(config.Auth.TokenExpiry)
+				if config.Auth.TokenExpiry == 0 {
+					expires = time.Now().Add(24 * time.Hour)
+				}
+				if token := c.String("token"); token != "" {
+					authConfig, err := config.Auth.ResolveSecrets(c.Context)
+					if err != nil {
+						return fmt.Errorf("failed to resolve auth secrets: %w", err)
+					}
+					if id, expires, err = lib.NewAuthManager(authConfig).TokenClaims(token); err != nil {
+						return fmt.Errorf("cannot revoke token: %w", err)
+					}
 				}
 
-				fmt.Println("API Keys:")
-				fmt.Println("=========")
+				if err := lib.RevokeToken(lib.RevocationsPath(configPath), id, expires); err != nil {
+					return err
+				}
+				say(c, "Revoked token %s until %s", id, expires.UTC().Format(time.RFC3339))
+				return nil
+			},
+		},
+		{
+			Name:  "list-keys",
+			Usage: "List all API keys with their services, owners and last use",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "config",
+					Aliases: []string{"c"},
+					Usage:   "Configuration file path",
+					Value:   "config.json",
+				},
+				&cli.StringFlag{
+					Name:  "usage",
+					Usage: "File the broker records key usage in (defaults to <config>.key-usage.json)",
+				},
+				&cli.DurationFlag{
+					Name:  "unused-for",
+					Usage: "Only list keys that have not been used for this long (e.g. 720h)",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				configPath := c.String("config")
+
+				config, err := lib.LoadConfig(configPath)
+				if err != nil {
+					return fmt.Errorf("failed to load config: %w", err)
+				}
+				usagePath := c.String("usage")
+				if usagePath == "" {
+					usagePath = lib.KeyUsagePath(configPath)
+				}
+				usage, err := lib.LoadKeyUsage(usagePath)
+				if err != nil {
+					return err
+				}
+
+				cutoff := time.Now().Add(-c.Duration("unused-for"))
+				keys := make([]apiKeyEntry, 0, len(config.Auth.APIKeys))
 				for key, service := range config.Auth.APIKeys {
-					fmt.Printf("Service: %s\nAPI Key: %s\n\n", service, key)
+					entry := apiKeyEntry{ID: lib.KeyID(key), Service: service, Key: key}
+					if info := config.Auth.KeyInfo[key]; info != nil {
+						entry.Description, entry.Owner, entry.Labels = info.Description, info.Owner, info.Labels
+						if !info.CreatedAt.IsZero() {
+							entry.CreatedAt = &info.CreatedAt
+						}
+					}
+					if used, ok := usage[entry.ID]; ok {
+						entry.LastUsed = &used
+					}
+					if c.IsSet("unused-for") && !entry.unusedSince(cutoff) {
+						continue
+					}
+					keys = append(keys, entry)
+				}
+				sort.Slice(keys, func(i, j int) bool {
+					if keys[i].Service != keys[j].Service {
+						return keys[i].Service < keys[j].Service
+					}
+					return keys[i].Key < keys[j].Key
+				})
+				return printOutput(c, keys, func(w io.Writer) {
+					if len(keys) == 0 {
+						fmt.Fprintln(w, "No API keys found")
+						return
+					}
+					fmt.Fprintln(w, "SERVICE\tAPI KEY\tOWNER\tDESCRIPTION\tLABELS\tCREATED\tLAST USED")
+					for _, k := range keys {
+						fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", k.Service, k.Key, orDash(k.Owner), orDash(k.Description),
+							orDash(formatLabels(k.Labels)), formatTime(k.CreatedAt, "-"), formatTime(k.LastUsed, "never"))
+					}
+				})
+			},
+		},
+		{
+			Name:  "update-key",
+			Usage: "Change the description, owner or labels of an API key",
+			Flags: append([]cli.Flag{
+				&cli.StringFlag{
+					Name:     "key",
+					Aliases:  []string{"k"},
+					Usage:    "API key to update",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:    "config",
+					Aliases: []string{"c"},
+					Usage:   "Configuration file path",
+					Value:   "config.json",
+				},
+			}, keyInfoFlags...),
+			Action: func(c *cli.Context) error {
+				apiKey := c.String("key")
+				configPath := c.String("config")
+
+				config, err := lib.LoadConfig(configPath)
+				if err != nil {
+					return fmt.Errorf("failed to load config: %w", err)
+				}
+				serviceName, exists := config.Auth.APIKeys[apiKey]
+				if !exists {
+					return fmt.Errorf("API key not found in '%s'", configPath)
+				}
+				var info lib.APIKeyInfo
+				if existing := config.Auth.KeyInfo[apiKey]; existing != nil {
+					info = *existing
+				}
+				if err := applyKeyInfoFlags(c, &info); err != nil {
+					return err
 				}
+				config.Auth.SetKeyInfo(apiKey, info)
+				if err := config.SaveConfig(configPath); err != nil {
+					return fmt.Errorf("failed to save config: %w", err)
+				}
+				say(c, "Updated API key %s of service '%s'", lib.KeyID(apiKey), serviceName)
 				return nil
 			},
 		},
@@ -145,14 +298,146 @@ var AuthCommand = &cli.Command{
 					return fmt.Errorf("failed to load config: %w", err)
 				}
 
-				if serviceName, exists := config.Auth.APIKeys[apiKey]; exists {
-					delete(config.Auth.APIKeys, apiKey)
-					if err := config.SaveConfig(configPath); err != nil {
-						return fmt.Errorf("failed to save config: %w", err)
+				serviceName, exists := config.Auth.APIKeys[apiKey]
+				if !exists {
+					return fmt.Errorf("API key not found in '%s'", configPath)
+				}
+				if err := confirm(c, fmt.Sprintf("Remove the API key of service '%s'?", serviceName)); err != nil {
+					return err
+				}
+				delete(config.Auth.APIKeys, apiKey)
+				delete(config.Auth.KeyInfo, apiKey)
+				delete(config.Auth.KeyNetworks, apiKey)
+				delete(config.Auth.Policy.Keys, apiKey)
+				config.Auth.Policy.AdminKeys = slices.DeleteFunc(config.Auth.Policy.AdminKeys, func(key string) bool { return key == apiKey })
+				if err := config.SaveConfig(configPath); err != nil {
+					return fmt.Errorf("failed to save config: %w", err)
+				}
+				say(c, "Removed API key for service '%s'", serviceName)
+				return nil
+			},
+		},
+		{
+			Name:  "export",
+			Usage: "Export the API keys and JWT secret for backup or another broker",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "out",
+					Usage:    "File to write the credentials to ('-' for standard output)",
+					Required: true,
+				},
+				&cli.BoolFlag{
+					Name:  "passphrase",
+					Usage: "Encrypt the export with the passphrase in " + lib.EnvExportPassphrase,
+				},
+				&cli.StringFlag{
+					Name:    "config",
+					Aliases: []string{"c"},
+					Usage:   "Configuration file path",
+					Value:   "config.json",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				out := c.String("out")
+
+				config, err := lib.LoadConfig(c.String("config"))
+				if err != nil {
+					return fmt.Errorf("failed to load config: %w", err)
+				}
+				passphrase := ""
+				if c.Bool("passphrase") {
+					if passphrase = os.Getenv(lib.EnvExportPassphrase); passphrase == "" {
+						return fmt.Errorf("--passphrase needs %s to be set", lib.EnvExportPassphrase)
 					}
-					fmt.Printf("Removed API key for service '%s'\n", serviceName)
+				}
+				data, err := lib.ExportCredentials(config.Auth, passphrase)
+				if err != nil {
+					return fmt.Errorf("failed to export credentials: %w", err)
+				}
+
+				if out == "-" {
+					fmt.Fprintln(c.App.Writer, string(data))
+					return nil
+				}
+				if _, err := os.Stat(out); err == nil {
+					if err := confirm(c, fmt.Sprintf("'%s' already exists, overwrite it?", out)); err != nil {
+						return err
+					}
+				}
+				if err := os.WriteFile(out, append(data, '\n'), 0600); err != nil {
+					return fmt.Errorf("failed to write credentials: %w", err)
+				}
+				say(c, "Exported %d API keys to %s", len(config.Auth.APIKeys), out)
+				if passphrase == "" {
+					say(c, "Note: The export is not encrypted, keep it as safe as the config or use --passphrase")
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "import",
+			Usage: "Import credentials written by 'auth export'",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:     "in",
+					Usage:    "File to read the credentials from ('-' for standard input)",
+					Required: true,
+				},
+				&cli.StringFlag{
+					Name:  "mode",
+					Usage: "merge (add the imported API keys) or replace (take the imported auth section as is)",
+					Value: lib.ImportMerge,
+				},
+				&cli.StringFlag{
+					Name:    "config",
+					Aliases: []string{"c"},
+					Usage:   "Configuration file path",
+					Value:   "config.json",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				in := c.String("in")
+				configPath := c.String("config")
+
+				var data []byte
+				var err error
+				if in == "-" {
+					data, err = io.ReadAll(c.App.Reader)
 				} else {
-					fmt.Println("API key not found")
+					data, err = os.ReadFile(in)
+				}
+				if err != nil {
+					return fmt.Errorf("failed to read credentials: %w", err)
+				}
+				imported, err := lib.ReadCredentials(data, os.Getenv(lib.EnvExportPassphrase))
+				if err != nil {
+					return err
+				}
+
+				config, err := lib.LoadConfig(configPath)
+				if err != nil {
+					return fmt.Errorf("failed to load config: %w", err)
+				}
+				if c.String("mode") == lib.ImportReplace {
+					if err := confirm(c, fmt.Sprintf("Replace the auth section of '%s'?", configPath)); err != nil {
+						return err
+					}
+				}
+				report, err := config.ImportCredentials(imported, c.String("mode"))
+				if err != nil {
+					return err
+				}
+				if err := config.SaveConfig(configPath); err != nil {
+					return fmt.Errorf("failed to save config: %w", err)
+				}
+
+				if report.Replaced {
+					say(c, "Replaced the auth section of '%s' (%d API keys)", configPath, report.Added)
+					return nil
+				}
+				say(c, "Imported %d API keys into '%s' (%d already present)", report.Added, configPath, report.Unchanged)
+				if report.JWTSecret {
+					say(c, "Took over the imported JWT secret")
 				}
 				return nil
 			},
@@ -184,6 +469,18 @@ var AuthCommand = &cli.Command{
 					Usage:   "Broker JSON config file for key lookup/generation",
 					Value:   "config.json",
 				},
+				&cli.StringFlag{
+					Name:  "address",
+					Usage: "Address clients reach the broker on (default: the first gRPC listener of the config)",
+				},
+				&cli.StringFlag{
+					Name:  "ca-file",
+					Usage: "CA certificate clients verify the broker with (default: the listener's certificate)",
+				},
+				&cli.StringFlag{
+					Name:  "server-name",
+					Usage: "Name clients check the broker's certificate against",
+				},
 			},
 			Action: func(c *cli.Context) error {
 				name := c.String("name")
@@ -192,22 +489,43 @@ var AuthCommand = &cli.Command{
 				configPath := c.String("config")
 				var authConfig *lib.AuthConfig
 				var cfg *lib.Config
-				var err error
 				if configPath != "" {
-					cfg, err = lib.LoadConfig(configPath)
-					if err == nil {
-						authConfig = &cfg.Auth
+					var err error
+					if cfg, err = lib.LoadConfig(configPath); err != nil {
+						return fmt.Errorf("failed to load config: %w", err)
 					}
+					authConfig = &cfg.Auth
 				}
 				finalKey, err := lib.WriteOrUpdateBrokerKeyYAMLWithAutoKey(output, name, key, authConfig)
 				if err != nil {
 					return fmt.Errorf("failed to write/update YAML config: %w", err)
 				}
-				// Save the updated config
-				if err := cfg.SaveConfig(configPath); err != nil {
-					return fmt.Errorf("failed to save config: %w", err)
+				// Tell clients how to reach the broker, for client.NewFromYAML
+				var conn provision.Connection
+				if cfg != nil {
+					conn = cfg.ProvisionedConnection()
+				}
+				if address := c.String("address"); address != "" {
+					conn.Address = address
+				}
+				if caFile := c.String("ca-file"); caFile != "" {
+					conn.TLS, conn.CAFile = true, caFile
+				}
+				if serverName := c.String("server-name"); serverName != "" {
+					conn.TLS, conn.ServerName = true, serverName
 				}
-				fmt.Printf("Provisioned/updated broker YAML config at %s for service '%s' with key: %s\n", output, name, finalKey)
+				if conn.Address != "" {
+					if err := lib.WriteProvisionedConnection(output, conn); err != nil {
+						return fmt.Errorf("failed to write/update YAML config: %w", err)
+					}
+				}
+				// Save the updated config, which holds a generated key now
+				if cfg != nil {
+					if err := cfg.SaveConfig(configPath); err != nil {
+						return fmt.Errorf("failed to save config: %w", err)
+					}
+				}
+				result(c, fmt.Sprintf("Provisioned/updated broker YAML config at %s for service '%s' with key", output, name), finalKey)
 				return nil
 			},
 		},
@@ -234,15 +552,16 @@ var ConfigCommand = &cli.Command{
 
 				// Check if file already exists
 				if _, err := os.Stat(configPath); err == nil {
-					fmt.Printf("Configuration file '%s' already exists\n", configPath)
-					return nil
+					if err := confirm(c, fmt.Sprintf("Configuration file '%s' already exists, overwrite it?", configPath)); err != nil {
+						return err
+					}
 				}
 
 				if err := lib.GenerateDefaultConfig(configPath); err != nil {
 					return fmt.Errorf("failed to generate config: %w", err)
 				}
 
-				fmt.Printf("Generated default configuration file: %s\n", configPath)
+				say(c, "Generated default configuration file: %s", configPath)
 				return nil
 			},
 		},
@@ -256,44 +575,194 @@ var ConfigCommand = &cli.Command{
 					Usage:   "Configuration file path",
 					Value:   "config.json",
 				},
+				profileFlag(),
 			},
 			Action: func(c *cli.Context) error {
 				configPath := c.String("config")
 
+				config, err := lib.LoadConfigProfile(configPath, c.String("profile"))
+				if err != nil {
+					return fmt.Errorf("failed to load config: %w", err)
+				}
+
+				summary := summarizeConfig(config)
+				return printOutput(c, summary, func(w io.Writer) {
+					if summary.Profile != "" {
+						fmt.Fprintf(w, "Profile: %s\n\n", summary.Profile)
+					}
+					fmt.Fprintf(w, "Server Configuration:\n")
+					fmt.Fprintf(w, "  Host:\t%s\n", summary.Server.Host)
+					fmt.Fprintf(w, "  Port:\t%s\n", summary.Server.Port)
+					fmt.Fprintf(w, "  TLS Enabled:\t%t\n", summary.Server.TLSEnabled)
+					fmt.Fprintf(w, "  TLS Cert File:\t%s\n", summary.Server.TLSCertFile)
+					fmt.Fprintf(w, "  TLS Key File:\t%s\n", summary.Server.TLSKeyFile)
+					fmt.Fprintf(w, "  Tick Seconds:\t%d\n", summary.Server.TickSeconds)
+					fmt.Fprintf(w, "  Max Stored:\t%d\n", summary.Server.MaxStored)
+					fmt.Fprintf(w, "  Max Age:\t%s\n", summary.Server.MaxAge)
+					fmt.Fprintf(w, "  Batch Size:\t%d\n", summary.Server.BatchSize)
+					fmt.Fprintf(w, "  Durability:\t%s\n", summary.Server.Durability)
+
+					fmt.Fprintf(w, "\nAuthentication Configuration:\n")
+					fmt.Fprintf(w, "  Enabled:\t%t\n", summary.Auth.Enabled)
+					fmt.Fprintf(w, "  Method:\t%s\n", summary.Auth.Method)
+					fmt.Fprintf(w, "  Number of API Keys:\t%d\n", summary.Auth.APIKeys)
+
+					fmt.Fprintf(w, "\nDatabase Configuration:\n")
+					fmt.Fprintf(w, "  Path:\t%s\n", summary.Database.Path)
+				})
+			},
+		},
+		{
+			Name:  "validate",
+			Usage: "Check the configuration for contradictions and risky settings",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "config",
+					Aliases: []string{"c"},
+					Usage:   "Configuration file path",
+					Value:   "config.json",
+				},
+				profileFlag(),
+				&cli.BoolFlag{
+					Name:  "strict",
+					Usage: "Treat warnings as errors",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				configPath := c.String("config")
+				if _, err := os.Stat(configPath); err != nil {
+					return fmt.Errorf("configuration file '%s' not found", configPath)
+				}
+
+				config, err := lib.LoadConfigProfile(configPath, c.String("profile"))
+				if err != nil {
+					return fmt.Errorf("failed to load config: %w", err)
+				}
+
+				issues := config.Validate()
+				valid := !lib.HasErrors(issues, c.Bool("strict"))
+				report := validationReport{Config: configPath, Valid: valid, Issues: make([]validationIssue, 0, len(issues))}
+				for _, issue := range issues {
+					report.Issues = append(report.Issues, validationIssue{Severity: string(issue.Severity), Field: issue.Field, Message: issue.Message})
+				}
+				err = printOutput(c, report, func(w io.Writer) {
+					for _, issue := range issues {
+						fmt.Fprintln(w, issue)
+					}
+					if valid {
+						fmt.Fprintf(w, "Configuration '%s' is valid\n", configPath)
+					}
+				})
+				if err != nil {
+					return err
+				}
+				if !valid {
+					return fmt.Errorf("configuration '%s' is invalid (%d issues)", configPath, len(issues))
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "encrypt",
+			Usage: "Encrypt the auth section at rest with a master key or passphrase",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "config",
+					Aliases: []string{"c"},
+					Usage:   "Configuration file path",
+					Value:   "config.json",
+				},
+				&cli.BoolFlag{
+					Name:  "passphrase",
+					Usage: "Derive the key from " + lib.EnvConfigPassphrase + " instead of a master key",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				configPath := c.String("config")
+				if _, err := os.Stat(configPath); err != nil {
+					return fmt.Errorf("configuration file '%s' not found", configPath)
+				}
+
 				config, err := lib.LoadConfig(configPath)
 				if err != nil {
 					return fmt.Errorf("failed to load config: %w", err)
 				}
 
-				fmt.Printf("Server Configuration:\n")
-				fmt.Printf("  Host: %s\n", config.Server.Host)
-				fmt.Printf("  Port: %s\n", config.Server.Port)
-				fmt.Printf("  TLS Enabled: %t\n", config.Server.TLSEnabled)
-				fmt.Printf("  TLS Cert File: %s\n", config.Server.TLSCertFile)
-				fmt.Printf("  TLS Key File: %s\n", config.Server.TLSKeyFile)
-				fmt.Printf("  Tick Seconds: %d\n", config.Server.TickSeconds)
-				fmt.Printf("  Max Stored: %d\n", config.Server.MaxStored)
-				fmt.Printf("  Max Age: %s\n", config.Server.MaxAge)
+				var key *lib.ConfigKey
+				generated := ""
+				switch {
+				case c.Bool("passphrase"):
+					key, err = lib.PassphraseKey(os.Getenv(lib.EnvConfigPassphrase))
+				case os.Getenv(lib.EnvMasterKey) != "":
+					key, err = lib.MasterKey(os.Getenv(lib.EnvMasterKey))
+				case os.Getenv(lib.EnvMasterKeyFile) != "":
+					var data []byte
+					if data, err = os.ReadFile(os.Getenv(lib.EnvMasterKeyFile)); err == nil {
+						key, err = lib.MasterKey(string(data))
+					}
+				default:
+					generated = lib.NewMasterKey()
+					key, err = lib.MasterKey(generated)
+				}
+				if err != nil {
+					return fmt.Errorf("failed to prepare key: %w", err)
+				}
+
+				config.EncryptAuth(key)
+				if err := config.SaveConfig(configPath); err != nil {
+					return fmt.Errorf("failed to save config: %w", err)
+				}
+
+				say(c, "Auth section of '%s' encrypted", configPath)
+				if generated != "" {
+					result(c, "Generated master key (store it safely, it is not saved anywhere)", generated)
+					say(c, "Set %s to this value when starting the broker", lib.EnvMasterKey)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "decrypt",
+			Usage: "Store the auth section in plain text again",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "config",
+					Aliases: []string{"c"},
+					Usage:   "Configuration file path",
+					Value:   "config.json",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				configPath := c.String("config")
 
-				fmt.Printf("\nAuthentication Configuration:\n")
-				fmt.Printf("  Enabled: %t\n", config.Auth.EnableAuth)
-				fmt.Printf("  Method: %d (0=JWT, 1=API Key)\n", config.Auth.AuthMethod)
-				fmt.Printf("  Number of API Keys: %d\n", len(config.Auth.APIKeys))
+				config, err := lib.LoadConfig(configPath)
+				if err != nil {
+					return fmt.Errorf("failed to load config: %w", err)
+				}
+				if !config.AuthEncrypted() {
+					return fmt.Errorf("auth section of '%s' is not encrypted", configPath)
+				}
 
-				fmt.Printf("\nDatabase Configuration:\n")
-				fmt.Printf("  Path: %s\n", config.DB.Path)
+				if err := confirm(c, fmt.Sprintf("Store the auth section of '%s' in plain text?", configPath)); err != nil {
+					return err
+				}
+				config.DecryptAuth()
+				if err := config.SaveConfig(configPath); err != nil {
+					return fmt.Errorf("failed to save config: %w", err)
+				}
 
+				say(c, "Auth section of '%s' decrypted", configPath)
 				return nil
 			},
 		},
 		{
 			Name:  "set-auth-method",
-			Usage: "Set authentication method (jwt or apikey)",
+			Usage: "Set authentication method (jwt, apikey or hmac)",
 			Flags: []cli.Flag{
 				&cli.StringFlag{
 					Name:     "method",
 					Aliases:  []string{"m"},
-					Usage:    "Authentication method (jwt or apikey)",
+					Usage:    "Authentication method (jwt, apikey or hmac)",
 					Required: true,
 				},
 				&cli.StringFlag{
@@ -317,15 +786,17 @@ var ConfigCommand = &cli.Command{
 					config.Auth.AuthMethod = lib.AuthMethodJWT
 				case "apikey":
 					config.Auth.AuthMethod = lib.AuthMethodAPIKey
+				case "hmac":
+					config.Auth.AuthMethod = lib.AuthMethodHMAC
 				default:
-					return fmt.Errorf("invalid authentication method: %s (use 'jwt' or 'apikey')", method)
+					return fmt.Errorf("invalid authentication method: %s (use 'jwt', 'apikey' or 'hmac')", method)
 				}
 
 				if err := config.SaveConfig(configPath); err != nil {
 					return fmt.Errorf("failed to save config: %w", err)
 				}
 
-				fmt.Printf("Authentication method set to: %s\n", method)
+				say(c, "Authentication method set to: %s", method)
 				return nil
 			},
 		},
@@ -368,10 +839,159 @@ var ConfigCommand = &cli.Command{
 					return fmt.Errorf("failed to save config: %w", err)
 				}
 
-				fmt.Printf("TLS enabled with cert: %s, key: %s\n", certFile, keyFile)
-				log.Printf("Note: Make sure the certificate and key files exist and are properly configured")
+				say(c, "TLS enabled with cert: %s, key: %s", certFile, keyFile)
+				say(c, "Note: Make sure the certificate and key files exist and are properly configured")
 				return nil
 			},
 		},
 	},
 }
+
+// apiKeyEntry is one row of `auth list-keys`
+type apiKeyEntry struct {
+	ID          string            `json:"id" yaml:"id"`
+	Service     string            `json:"service" yaml:"service"`
+	Key         string            `json:"key" yaml:"key"`
+	Description string            `json:"description,omitempty" yaml:"description,omitempty"`
+	Owner       string            `json:"owner,omitempty" yaml:"owner,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	CreatedAt   *time.Time        `json:"created_at,omitempty" yaml:"created_at,omitempty"`
+	LastUsed    *time.Time        `json:"last_used,omitempty" yaml:"last_used,omitempty"`
+}
+
+// unusedSince reports whether the key has not been used since cutoff. A key that was
+// never used counts once it is older than cutoff, or when its age is unknown.
+func (e apiKeyEntry) unusedSince(cutoff time.Time) bool {
+	if e.LastUsed != nil {
+		return e.LastUsed.Before(cutoff)
+	}
+	return e.CreatedAt == nil || e.CreatedAt.Before(cutoff)
+}
+
+// keyInfoFlags set the description, owner and labels of an API key
+var keyInfoFlags = []cli.Flag{
+	&cli.StringFlag{
+		Name:  "description",
+		Usage: "What the key is used for",
+	},
+	&cli.StringFlag{
+		Name:  "owner",
+		Usage: "Team or person responsible for the key",
+	},
+	&cli.StringSliceFlag{
+		Name:  "label",
+		Usage: "Label as key=value, repeatable; an empty value removes the label",
+	},
+}
+
+func applyKeyInfoFlags(c *cli.Context, info *lib.APIKeyInfo) error {
+	if c.IsSet("description") {
+		info.Description = c.String("description")
+	}
+	if c.IsSet("owner") {
+		info.Owner = c.String("owner")
+	}
+	for _, label := range c.StringSlice("label") {
+		name, value, ok := strings.Cut(label, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("invalid label %q (use key=value)", label)
+		}
+		if value == "" {
+			delete(info.Labels, name)
+			continue
+		}
+		if info.Labels == nil {
+			info.Labels = make(map[string]string)
+		}
+		info.Labels[name] = value
+	}
+	return nil
+}
+
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func formatTime(t *time.Time, none string) string {
+	if t == nil {
+		return none
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// configSummary is what `config show` reports; secrets and keys are left out
+type configSummary struct {
+	Profile string `json:"profile,omitempty" yaml:"profile,omitempty"`
+	Server  struct {
+		Host        string `json:"host" yaml:"host"`
+		Port        string `json:"port" yaml:"port"`
+		TLSEnabled  bool   `json:"tls_enabled" yaml:"tls_enabled"`
+		TLSCertFile string `json:"tls_cert_file" yaml:"tls_cert_file"`
+		TLSKeyFile  string `json:"tls_key_file" yaml:"tls_key_file"`
+		TickSeconds int16  `json:"tick_seconds" yaml:"tick_seconds"`
+		MaxStored   int32  `json:"max_stored" yaml:"max_stored"`
+		MaxAge      string `json:"max_age" yaml:"max_age"`
+		BatchSize   int    `json:"batch_size" yaml:"batch_size"`
+		Durability  string `json:"durability" yaml:"durability"`
+	} `json:"server" yaml:"server"`
+	Auth struct {
+		Enabled bool   `json:"enabled" yaml:"enabled"`
+		Method  string `json:"method" yaml:"method"`
+		APIKeys int    `json:"api_keys" yaml:"api_keys"`
+	} `json:"auth" yaml:"auth"`
+	Database struct {
+		Path string `json:"path" yaml:"path"`
+	} `json:"database" yaml:"database"`
+}
+
+func summarizeConfig(config *lib.Config) configSummary {
+	var summary configSummary
+	summary.Profile = config.Profile()
+	summary.Server.Host = config.Server.Host
+	summary.Server.Port = config.Server.Port
+	summary.Server.TLSEnabled = config.Server.TLSEnabled
+	summary.Server.TLSCertFile = config.Server.TLSCertFile
+	summary.Server.TLSKeyFile = config.Server.TLSKeyFile
+	summary.Server.TickSeconds = config.Server.TickSeconds
+	summary.Server.MaxStored = config.Server.MaxStored
+	summary.Server.MaxAge = config.Server.MaxAge.String()
+	summary.Server.BatchSize = config.Server.BatchSize
+	summary.Server.Durability = config.Server.Durability
+	summary.Auth.Enabled = config.Auth.EnableAuth
+	switch config.Auth.AuthMethod {
+	case lib.AuthMethodAPIKey:
+		summary.Auth.Method = "apikey"
+	case lib.AuthMethodHMAC:
+		summary.Auth.Method = "hmac"
+	default:
+		summary.Auth.Method = "jwt"
+	}
+	summary.Auth.APIKeys = len(config.Auth.APIKeys)
+	summary.Database.Path = config.DB.Path
+	return summary
+}
+
+// validationReport is what `config validate` reports
+type validationReport struct {
+	Config string            `json:"config" yaml:"config"`
+	Valid  bool              `json:"valid" yaml:"valid"`
+	Issues []validationIssue `json:"issues" yaml:"issues"`
+}
+
+type validationIssue struct {
+	Severity string `json:"severity" yaml:"severity"`
+	Field    string `json:"field" yaml:"field"`
+	Message  string `json:"message" yaml:"message"`
+}
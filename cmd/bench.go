@@ -0,0 +1,276 @@
+package cmd
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/client"
+
+	"github.com/urfave/cli/v2"
+)
+
+var BenchCommand = &cli.Command{
+	Name:  "bench",
+	Usage: "Run a synthetic load test against a running broker",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "address",
+			Aliases: []string{"a"},
+			Usage:   "Broker address",
+			Value:   "localhost:9000",
+		},
+		&cli.IntFlag{
+			Name:  "producers",
+			Usage: "Number of producing clients",
+			Value: 10,
+		},
+		&cli.IntFlag{
+			Name:  "connections",
+			Usage: "gRPC connections per producer (pooled client when > 1)",
+			Value: 1,
+		},
+		&cli.IntFlag{
+			Name:  "consumers",
+			Usage: "Number of consuming clients",
+			Value: 10,
+		},
+		&cli.StringFlag{
+			Name:  "size",
+			Usage: "Payload size (e.g. 512, 1kb, 4mb)",
+			Value: "1kb",
+		},
+		&cli.IntFlag{
+			Name:  "rate",
+			Usage: "Target messages per second across all producers (0 = unlimited)",
+			Value: 5000,
+		},
+		&cli.DurationFlag{
+			Name:    "duration",
+			Aliases: []string{"d"},
+			Usage:   "How long to produce messages",
+			Value:   10 * time.Second,
+		},
+		&cli.StringFlag{
+			Name:  "auth-method",
+			Usage: "Authentication method (jwt, apikey or hmac)",
+			Value: "apikey",
+		},
+		&cli.StringFlag{
+			Name:  "credential",
+			Usage: "API key or JWT token used by all synthetic clients",
+		},
+		&cli.BoolFlag{
+			Name:  "tls",
+			Usage: "Connect using TLS",
+		},
+		&cli.StringFlag{
+			Name:  "cert",
+			Usage: "TLS CA certificate file",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		size, err := parseSize(c.String("size"))
+		if err != nil {
+			return err
+		}
+		producers, consumers := c.Int("producers"), c.Int("consumers")
+		if producers <= 0 || consumers <= 0 {
+			return fmt.Errorf("producers and consumers must be positive")
+		}
+		if size < 8 {
+			size = 8 // room for the send timestamp
+		}
+
+		newClient := func(name string) (*client.AuthenticatedClient, error) {
+			ac, err := client.NewAuthenticatedClient(c.String("address"), name, c.String("auth-method"), c.Bool("tls"), c.String("cert"))
+			if err != nil {
+				return nil, err
+			}
+			ac.SetAPIKey(c.String("credential"))
+			ac.SetJWTToken(c.String("credential"))
+			return ac, nil
+		}
+
+		// Producers only need Send, so they can use a pooled client
+		newProducer := func(name string) (benchProducer, error) {
+			if c.Int("connections") <= 1 {
+				return newClient(name)
+			}
+			pool, err := client.NewPooledClient(c.String("address"), name, c.String("auth-method"), c.Bool("tls"), c.String("cert"), c.Int("connections"))
+			if err != nil {
+				return nil, err
+			}
+			pool.SetAPIKey(c.String("credential"))
+			pool.SetJWTToken(c.String("credential"))
+			return pool, nil
+		}
+
+		stats := &benchStats{}
+		ctx, cancel := context.WithCancel(c.Context)
+		defer cancel()
+
+		// Consumers record end-to-end latency from the timestamp embedded in each payload
+		var consumerWG sync.WaitGroup
+		for i := 0; i < consumers; i++ {
+			ac, err := newClient(fmt.Sprintf("bench-consumer-%d", i))
+			if err != nil {
+				return fmt.Errorf("failed to create consumer: %w", err)
+			}
+			defer ac.Close()
+			stream, err := ac.Receive(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to open receive stream: %w", err)
+			}
+			consumerWG.Add(1)
+			go func() {
+				defer consumerWG.Done()
+				for {
+					msg, err := stream.Recv()
+					if err != nil {
+						return
+					}
+					if msg.Event != pb.Event_MESSAGE || len(msg.Data) < 8 {
+						continue
+					}
+					sent := time.Unix(0, int64(binary.BigEndian.Uint64(msg.Data)))
+					stats.recordDelivery(time.Since(sent))
+				}
+			}()
+		}
+
+		var interval time.Duration
+		if rate := c.Int("rate"); rate > 0 {
+			interval = time.Duration(float64(time.Second) * float64(producers) / float64(rate))
+		}
+
+		fmt.Printf("Running bench: %d producers, %d consumers, %d byte payloads for %s\n", producers, consumers, size, c.Duration("duration"))
+		start := time.Now()
+		deadline := start.Add(c.Duration("duration"))
+		var producerWG sync.WaitGroup
+		for i := 0; i < producers; i++ {
+			ac, err := newProducer(fmt.Sprintf("bench-producer-%d", i))
+			if err != nil {
+				return fmt.Errorf("failed to create producer: %w", err)
+			}
+			defer ac.Close()
+			producerWG.Add(1)
+			go func(i int) {
+				defer producerWG.Done()
+				payload := make([]byte, size)
+				var ticker *time.Ticker
+				if interval > 0 {
+					ticker = time.NewTicker(interval)
+					defer ticker.Stop()
+				}
+				for n := 0; time.Now().Before(deadline); n++ {
+					if ticker != nil {
+						<-ticker.C
+					}
+					binary.BigEndian.PutUint64(payload, uint64(time.Now().UnixNano()))
+					to := fmt.Sprintf("bench-consumer-%d", (i+n)%consumers)
+					sendStart := time.Now()
+					status, err := ac.Send(ctx, to, payload, pb.Type_OTHER, true)
+					stats.recordSend(time.Since(sendStart), err == nil && status.Success)
+				}
+			}(i)
+		}
+		producerWG.Wait()
+		elapsed := time.Since(start)
+
+		// Give consumers a moment to drain queued messages
+		time.Sleep(2 * time.Second)
+		cancel()
+		consumerWG.Wait()
+
+		stats.report(elapsed, size)
+		return nil
+	},
+}
+
+// benchProducer is the part of the client API used by producers
+type benchProducer interface {
+	Send(ctx context.Context, to string, data []byte, msgType pb.Type, queue bool) (*pb.Status, error)
+	Close() error
+}
+
+// benchStats collects latencies and counters from synthetic clients
+type benchStats struct {
+	mu        sync.Mutex
+	sends     []time.Duration
+	delivers  []time.Duration
+	errors    atomic.Int64
+	delivered atomic.Int64
+}
+
+func (b *benchStats) recordSend(latency time.Duration, ok bool) {
+	if !ok {
+		b.errors.Add(1)
+	}
+	b.mu.Lock()
+	b.sends = append(b.sends, latency)
+	b.mu.Unlock()
+}
+
+func (b *benchStats) recordDelivery(latency time.Duration) {
+	b.delivered.Add(1)
+	b.mu.Lock()
+	b.delivers = append(b.delivers, latency)
+	b.mu.Unlock()
+}
+
+func (b *benchStats) report(elapsed time.Duration, size int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	total := len(b.sends)
+	errs := b.errors.Load()
+	throughput := float64(total) / elapsed.Seconds()
+	fmt.Printf("\nSent:        %d messages in %s\n", total, elapsed.Round(time.Millisecond))
+	fmt.Printf("Throughput:  %.1f msg/s (%.2f MB/s)\n", throughput, throughput*float64(size)/(1<<20))
+	if total > 0 {
+		fmt.Printf("Errors:      %d (%.2f%%)\n", errs, float64(errs)*100/float64(total))
+	}
+	fmt.Printf("Delivered:   %d messages\n", b.delivered.Load())
+	printPercentiles("Send latency", b.sends)
+	printPercentiles("End-to-end latency", b.delivers)
+}
+
+func printPercentiles(name string, samples []time.Duration) {
+	if len(samples) == 0 {
+		fmt.Printf("%s: no samples\n", name)
+		return
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	pct := func(p float64) time.Duration {
+		return samples[int(float64(len(samples)-1)*p)]
+	}
+	fmt.Printf("%s: p50=%s p90=%s p99=%s max=%s\n", name, pct(0.50), pct(0.90), pct(0.99), samples[len(samples)-1])
+}
+
+// parseSize parses human readable sizes such as 512, 1kb or 4mb
+func parseSize(value string) (int, error) {
+	v := strings.ToLower(strings.TrimSpace(value))
+	multiplier := 1
+	for _, unit := range []struct {
+		suffix string
+		factor int
+	}{{"kb", 1 << 10}, {"mb", 1 << 20}, {"k", 1 << 10}, {"m", 1 << 20}, {"b", 1}} {
+		if strings.HasSuffix(v, unit.suffix) {
+			v = strings.TrimSuffix(v, unit.suffix)
+			multiplier = unit.factor
+			break
+		}
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", value)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/ispapp/Microservices-Broker/cmd/lib"
+	"github.com/urfave/cli/v2"
+)
+
+var DBCommand = &cli.Command{
+	Name:  "db",
+	Usage: "Database maintenance commands",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "verify",
+			Usage: "Walk the database, validate every record and report per-service counts",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "input",
+					Aliases: []string{"i"},
+					Usage:   "Input db folder (defaults to the configured path)",
+				},
+				&cli.StringFlag{
+					Name:    "config",
+					Aliases: []string{"c"},
+					Usage:   "Configuration file path",
+					Value:   "config.json",
+				},
+				&cli.BoolFlag{
+					Name:  "repair",
+					Usage: "Quarantine corrupted records and merge datafiles to rebuild the index",
+				},
+				&cli.BoolFlag{
+					Name:  "auto-recovery",
+					Usage: "Let bitcask repair damaged datafiles when opening the database",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				config, err := lib.LoadConfig(c.String("config"))
+				if err != nil {
+					return fmt.Errorf("failed to load config: %w", err)
+				}
+				dbPath := config.DB.Path
+				if c.IsSet("input") {
+					dbPath = c.String("input")
+				}
+				autoRecovery := config.DB.AutoRecovery || c.Bool("auto-recovery")
+				if c.Bool("repair") {
+					if err := confirm(c, fmt.Sprintf("Quarantine corrupted records of '%s' and rebuild its index?", dbPath)); err != nil {
+						return err
+					}
+				}
+
+				report, err := lib.VerifyPath(dbPath, config.Server.MaxAge, c.Bool("repair"), autoRecovery, config.DB.MaxValueSize)
+				if err != nil {
+					return fmt.Errorf("verification failed: %w", err)
+				}
+
+				services := make([]string, 0, len(report.Services))
+				for service := range report.Services {
+					services = append(services, service)
+				}
+				sort.Strings(services)
+				out := verifyOutput{
+					Database:  dbPath,
+					Records:   report.Total,
+					Internal:  report.Internal,
+					Expired:   report.Expired,
+					Corrupted: report.Corrupted,
+					Pending:   report.Services,
+				}
+				if c.Bool("repair") {
+					out.Quarantined, out.IndexRebuilt = &report.Quarantined, &report.Merged
+				}
+				err = printOutput(c, out, func(w io.Writer) {
+					fmt.Fprintf(w, "Database: %s\n", dbPath)
+					fmt.Fprintf(w, "  Records:\t%d\n", report.Total)
+					fmt.Fprintf(w, "  Internal:\t%d\n", report.Internal)
+					fmt.Fprintf(w, "  Expired:\t%d\n", report.Expired)
+					fmt.Fprintf(w, "  Corrupted:\t%d\n", report.Corrupted)
+					if c.Bool("repair") {
+						fmt.Fprintf(w, "  Quarantined:\t%d\n", report.Quarantined)
+						fmt.Fprintf(w, "  Index rebuilt:\t%t\n", report.Merged)
+					}
+					fmt.Fprintf(w, "\nPending messages per service:\n")
+					for _, service := range services {
+						fmt.Fprintf(w, "  %s:\t%d\n", service, report.Services[service])
+					}
+				})
+				if err != nil {
+					return err
+				}
+
+				if report.Corrupted > 0 && !c.Bool("repair") {
+					return fmt.Errorf("found %d corrupted records (rerun with --repair to quarantine them)", report.Corrupted)
+				}
+				return nil
+			},
+		},
+	},
+}
+
+// verifyOutput is what `db verify` reports
+type verifyOutput struct {
+	Database     string         `json:"database" yaml:"database"`
+	Records      int            `json:"records" yaml:"records"`
+	Internal     int            `json:"internal" yaml:"internal"`
+	Expired      int            `json:"expired" yaml:"expired"`
+	Corrupted    int            `json:"corrupted" yaml:"corrupted"`
+	Quarantined  *int           `json:"quarantined,omitempty" yaml:"quarantined,omitempty"`
+	IndexRebuilt *bool          `json:"index_rebuilt,omitempty" yaml:"index_rebuilt,omitempty"`
+	Pending      map[string]int `json:"pending" yaml:"pending"`
+}
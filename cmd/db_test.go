@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/cmd/lib"
+
+	"go.mills.io/bitcask/v2"
+)
+
+// corruptDB returns a database holding two messages for billing, one of them corrupt
+func corruptDB(t *testing.T) string {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "broker.db")
+	server, err := lib.NewServer(dir, 1, 100, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	for _, data := range []string{"one", "two"} {
+		if _, err := server.Send(context.Background(), &pb.Message{From: "orders", To: "billing", Data: []byte(data), Queue: true}); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	server.Close()
+
+	db, err := lib.OpenDB(dir, false, 0)
+	if err != nil {
+		t.Fatalf("OpenDB failed: %v", err)
+	}
+	defer db.Close()
+	var corrupted bitcask.Key
+	if err := db.Scan(bitcask.Key("billing"), bitcask.KeyFunc(func(key bitcask.Key) error {
+		if corrupted == nil {
+			corrupted = append(bitcask.Key(nil), key...)
+		}
+		return nil
+	})); err != nil || corrupted == nil {
+		t.Fatalf("no queued message found (%v)", err)
+	}
+	// An envelope header followed by bytes that are not a protobuf message
+	if err := db.Put(corrupted, []byte{0x00, 0x01, 0, 0, 0, 0, 0, 0, 0, 1, 0xff, 0xff}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	return dir
+}
+
+// runVerify runs `db verify` on dir with args and decodes its JSON report
+func runVerify(t *testing.T, dir string, args ...string) (verifyOutput, error) {
+	t.Helper()
+	config := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(config, []byte(`{}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	app := NewApp()
+	app.Writer = &out
+	app.ErrWriter = &out
+	err := app.Run(append([]string{"broker", "--output", "json", "--yes", "db", "verify", "-c", config, "-i", dir}, args...))
+	var report verifyOutput
+	if decodeErr := json.Unmarshal(out.Bytes(), &report); decodeErr != nil {
+		t.Fatalf("invalid report %q: %v", out.String(), decodeErr)
+	}
+	return report, err
+}
+
+func TestDBVerify(t *testing.T) {
+	dir := corruptDB(t)
+
+	// Corruption fails the command, so scripts see a non-zero exit status
+	report, err := runVerify(t, dir)
+	if err == nil || !strings.Contains(err.Error(), "found 1 corrupted records") {
+		t.Fatalf("expected verify to fail on the corrupt record, got %v", err)
+	}
+	if report.Corrupted != 1 || report.Pending["billing"] != 1 || report.Quarantined != nil {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	report, err = runVerify(t, dir, "--repair")
+	if err != nil {
+		t.Fatalf("verify --repair failed: %v", err)
+	}
+	if report.Corrupted != 1 || report.Quarantined == nil || *report.Quarantined != 1 || report.IndexRebuilt == nil || !*report.IndexRebuilt {
+		t.Fatalf("unexpected repair report %+v", report)
+	}
+
+	report, err = runVerify(t, dir)
+	if err != nil {
+		t.Fatalf("verify after repair failed: %v", err)
+	}
+	if report.Corrupted != 0 || report.Pending["billing"] != 1 {
+		t.Fatalf("unexpected report after repair %+v", report)
+	}
+}
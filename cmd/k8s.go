@@ -0,0 +1,385 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/ispapp/Microservices-Broker/cmd/lib"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Paths inside the broker container
+const (
+	k8sConfigDir = "/etc/broker"
+	k8sDataDir   = "/var/lib/broker"
+)
+
+// k8sPort is a listener exposed by the container and the Service
+type k8sPort struct {
+	Name     string
+	Port     string
+	Protocol string
+}
+
+// k8sProbe is the check used for the liveness and readiness probes
+type k8sProbe struct {
+	HTTPPath string // empty for a TCP check
+	Port     string
+}
+
+// k8sBundle is everything the manifests and the Helm values are rendered from
+type k8sBundle struct {
+	Name         string
+	Namespace    string
+	Image        string
+	StorageSize  string
+	Ports        []k8sPort
+	Probe        k8sProbe
+	Files        map[string]string // Secret keys, mounted in k8sConfigDir
+	MetricsPort  string
+	EncryptedKey bool
+}
+
+// newK8sBundle rewrites cfg for the container: listeners bind every interface, the
+// database lives on the volume and TLS files are moved into the Secret
+func newK8sBundle(cfg *lib.Config, name, namespace, image, storage string) (*k8sBundle, []string, error) {
+	var warnings []string
+	b := &k8sBundle{Name: name, Namespace: namespace, Image: image, StorageSize: storage, Files: make(map[string]string), EncryptedKey: cfg.EncryptedAuth != nil}
+	secretFile := func(path string) (string, error) {
+		if path == "" || lib.IsSecretRef(path) {
+			return path, nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s for the Secret: %w", path, err)
+		}
+		key := filepath.Base(path)
+		b.Files[key] = string(data)
+		return k8sConfigDir + "/" + key, nil
+	}
+
+	rendered := *cfg
+	rendered.DB.Path = k8sDataDir + "/db"
+	rendered.Server.Host = "0.0.0.0"
+	var err error
+	if rendered.Server.TLSEnabled {
+		if rendered.Server.TLSCertFile, err = secretFile(cfg.Server.TLSCertFile); err != nil {
+			return nil, nil, err
+		}
+		if rendered.Server.TLSKeyFile, err = secretFile(cfg.Server.TLSKeyFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	rendered.Server.Listeners = make([]lib.ListenerConfig, len(cfg.Server.Listeners))
+	for i, l := range cfg.Server.Listeners {
+		l.Host = ""
+		if l.TLSEnabled || l.Kind == lib.ListenerGRPCTLS || l.Kind == lib.ListenerGRPCQUIC {
+			if l.TLSCertFile, err = secretFile(l.TLSCertFile); err != nil {
+				return nil, nil, err
+			}
+			if l.TLSKeyFile, err = secretFile(l.TLSKeyFile); err != nil {
+				return nil, nil, err
+			}
+		}
+		rendered.Server.Listeners[i] = l
+	}
+	data, err := json.MarshalIndent(&rendered, "", "  ")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal config: %w", err)
+	}
+	b.Files["config.json"] = string(data)
+
+	names := make(map[string]bool)
+	for _, l := range rendered.Server.EffectiveListeners() {
+		port := k8sPort{Name: l.Kind, Port: l.Port, Protocol: "TCP"}
+		if l.Kind == lib.ListenerGRPCQUIC {
+			port.Protocol = "UDP"
+		}
+		// Port names must be unique and at most 15 characters
+		for i := 2; names[port.Name]; i++ {
+			port.Name = fmt.Sprintf("%.12s-%d", l.Kind, i)
+		}
+		names[port.Name] = true
+		b.Ports = append(b.Ports, port)
+		switch l.Kind {
+		case lib.ListenerAdmin:
+			b.Probe = k8sProbe{HTTPPath: "/healthz", Port: port.Name}
+			b.MetricsPort = port.Port
+		case lib.ListenerMetrics:
+			b.MetricsPort = port.Port
+		}
+	}
+	if b.Probe.Port == "" {
+		for _, port := range b.Ports {
+			if port.Protocol == "TCP" {
+				b.Probe = k8sProbe{Port: port.Name}
+				break
+			}
+		}
+		warnings = append(warnings, "no admin listener: probes only check that the gRPC port accepts connections, add an admin listener to probe /healthz")
+	}
+	if b.EncryptedKey {
+		warnings = append(warnings, "auth is encrypted: add the config key to the broker container's environment")
+	}
+	return b, warnings, nil
+}
+
+var k8sFuncs = template.FuncMap{
+	"indent": func(n int, s string) string {
+		pad := strings.Repeat(" ", n)
+		return pad + strings.ReplaceAll(strings.TrimRight(s, "\n"), "\n", "\n"+pad)
+	},
+	"list": func(items ...string) []string { return items },
+	"quote": func(s string) string {
+		data, _ := json.Marshal(s)
+		return string(data)
+	},
+}
+
+// k8sManifests renders a Secret holding the config, a volume claim for the database,
+// a single-replica Deployment (bitcask allows one writer) and a Service
+var k8sManifests = template.Must(template.New("manifests").Funcs(k8sFuncs).Parse(`apiVersion: v1
+kind: Secret
+metadata:
+  name: {{.Name}}-config
+  namespace: {{.Namespace}}
+  labels:
+    app.kubernetes.io/name: {{.Name}}
+type: Opaque
+stringData:
+{{- range $key, $value := .Files}}
+  {{$key}}: |
+{{indent 4 $value}}
+{{- end}}
+---
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: {{.Name}}-data
+  namespace: {{.Namespace}}
+  labels:
+    app.kubernetes.io/name: {{.Name}}
+spec:
+  accessModes: [ReadWriteOnce]
+  resources:
+    requests:
+      storage: {{.StorageSize}}
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+  labels:
+    app.kubernetes.io/name: {{.Name}}
+spec:
+  replicas: 1
+  strategy:
+    type: Recreate
+  selector:
+    matchLabels:
+      app.kubernetes.io/name: {{.Name}}
+  template:
+    metadata:
+      labels:
+        app.kubernetes.io/name: {{.Name}}
+{{- if .MetricsPort}}
+      annotations:
+        prometheus.io/scrape: "true"
+        prometheus.io/port: {{quote .MetricsPort}}
+{{- end}}
+    spec:
+      containers:
+        - name: broker
+          image: {{.Image}}
+          args: [serve, --config, {{.ConfigPath}}]
+          ports:
+{{- range .Ports}}
+            - name: {{.Name}}
+              containerPort: {{.Port}}
+              protocol: {{.Protocol}}
+{{- end}}
+{{- range $probe := list "livenessProbe" "readinessProbe"}}
+          {{$probe}}:
+{{- if $.Probe.HTTPPath}}
+            httpGet:
+              path: {{$.Probe.HTTPPath}}
+              port: {{$.Probe.Port}}
+{{- else}}
+            tcpSocket:
+              port: {{$.Probe.Port}}
+{{- end}}
+            periodSeconds: 10
+{{- end}}
+          volumeMounts:
+            - name: config
+              mountPath: ` + k8sConfigDir + `
+              readOnly: true
+            - name: data
+              mountPath: ` + k8sDataDir + `
+      volumes:
+        - name: config
+          secret:
+            secretName: {{.Name}}-config
+        - name: data
+          persistentVolumeClaim:
+            claimName: {{.Name}}-data
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+  labels:
+    app.kubernetes.io/name: {{.Name}}
+spec:
+  selector:
+    app.kubernetes.io/name: {{.Name}}
+  ports:
+{{- range .Ports}}
+    - name: {{.Name}}
+      port: {{.Port}}
+      targetPort: {{.Name}}
+      protocol: {{.Protocol}}
+{{- end}}
+`))
+
+// k8sValues renders the same bundle as Helm values
+var k8sValues = template.Must(template.New("values").Funcs(k8sFuncs).Parse(`# Helm values rendered by broker k8s render --format helm
+nameOverride: {{.Name}}
+namespace: {{.Namespace}}
+replicaCount: 1
+image:
+  repository: {{.Repository}}
+  tag: {{quote .Tag}}
+persistence:
+  size: {{.StorageSize}}
+  mountPath: ` + k8sDataDir + `
+service:
+  ports:
+{{- range .Ports}}
+    - name: {{.Name}}
+      port: {{.Port}}
+      protocol: {{.Protocol}}
+{{- end}}
+probes:
+{{- if .Probe.HTTPPath}}
+  httpGet:
+    path: {{.Probe.HTTPPath}}
+    port: {{.Probe.Port}}
+{{- else}}
+  tcpSocket:
+    port: {{.Probe.Port}}
+{{- end}}
+{{- if .MetricsPort}}
+metrics:
+  port: {{.MetricsPort}}
+{{- end}}
+config:
+  mountPath: ` + k8sConfigDir + `
+  files:
+{{- range $key, $value := .Files}}
+    {{$key}}: |
+{{indent 6 $value}}
+{{- end}}
+`))
+
+// ConfigPath is where the container reads its configuration
+func (b *k8sBundle) ConfigPath() string {
+	return k8sConfigDir + "/config.json"
+}
+
+// Repository and Tag split the image reference for Helm values
+func (b *k8sBundle) Repository() string {
+	repository, _ := b.splitImage()
+	return repository
+}
+
+func (b *k8sBundle) Tag() string {
+	_, tag := b.splitImage()
+	return tag
+}
+
+func (b *k8sBundle) splitImage() (string, string) {
+	// A colon after the last slash separates the tag, one before it a registry port
+	if i := strings.LastIndex(b.Image, ":"); i > strings.LastIndex(b.Image, "/") {
+		return b.Image[:i], b.Image[i+1:]
+	}
+	return b.Image, "latest"
+}
+
+// render writes the bundle as manifests or Helm values
+func (b *k8sBundle) render(w io.Writer, format string) error {
+	switch format {
+	case "manifests":
+		return k8sManifests.Execute(w, b)
+	case "helm":
+		return k8sValues.Execute(w, b)
+	default:
+		return fmt.Errorf("unknown format %q (use 'manifests' or 'helm')", format)
+	}
+}
+
+var K8sCommand = &cli.Command{
+	Name:  "k8s",
+	Usage: "Kubernetes deployment helpers",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "render",
+			Usage: "Render Deployment, Service, Secret and volume manifests (or Helm values) from the config",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "config",
+					Aliases: []string{"c"},
+					Usage:   "Configuration file path",
+					Value:   "config.json",
+				},
+				&cli.StringFlag{
+					Name:  "name",
+					Usage: "Name of the Kubernetes objects",
+					Value: defaultServiceName,
+				},
+				&cli.StringFlag{
+					Name:  "namespace",
+					Usage: "Namespace of the Kubernetes objects",
+					Value: "default",
+				},
+				&cli.StringFlag{
+					Name:  "image",
+					Usage: "Broker container image",
+					Value: "ispapp/microservices-broker:latest",
+				},
+				&cli.StringFlag{
+					Name:  "storage",
+					Usage: "Size of the database volume",
+					Value: "10Gi",
+				},
+				&cli.StringFlag{
+					Name:  "format",
+					Usage: "Output format: manifests or helm",
+					Value: "manifests",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				config, err := lib.LoadConfig(c.String("config"))
+				if err != nil {
+					return fmt.Errorf("failed to load config: %w", err)
+				}
+				bundle, warnings, err := newK8sBundle(config, c.String("name"), c.String("namespace"), c.String("image"), c.String("storage"))
+				if err != nil {
+					return err
+				}
+				for _, warning := range warnings {
+					fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+				}
+				return bundle.render(c.App.Writer, c.String("format"))
+			},
+		},
+	},
+}
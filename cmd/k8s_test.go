@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// renderK8s runs `k8s render` on config with args and decodes the YAML documents it prints
+func renderK8s(t *testing.T, config string, args ...string) []map[string]any {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	app := NewApp()
+	app.Writer = &out
+	if err := app.Run(append([]string{"broker", "k8s", "render", "-c", path}, args...)); err != nil {
+		t.Fatalf("k8s render failed: %v", err)
+	}
+	var docs []map[string]any
+	decoder := yaml.NewDecoder(&out)
+	for {
+		var doc map[string]any
+		if err := decoder.Decode(&doc); errors.Is(err, io.EOF) {
+			return docs
+		} else if err != nil {
+			t.Fatalf("invalid YAML: %v", err)
+		}
+		docs = append(docs, doc)
+	}
+}
+
+// field walks doc along keys and list indexes
+func field(t *testing.T, doc any, path ...any) any {
+	t.Helper()
+	for _, step := range path {
+		switch step := step.(type) {
+		case string:
+			m, ok := doc.(map[string]any)
+			if !ok {
+				t.Fatalf("no %q in %v", step, doc)
+			}
+			doc = m[step]
+		case int:
+			l, ok := doc.([]any)
+			if !ok || step >= len(l) {
+				t.Fatalf("no item %d in %v", step, doc)
+			}
+			doc = l[step]
+		}
+	}
+	return doc
+}
+
+func TestK8sRenderManifests(t *testing.T) {
+	dir := t.TempDir()
+	cert := filepath.Join(dir, "tls.crt")
+	key := filepath.Join(dir, "tls.key")
+	for path, data := range map[string]string{cert: "CERT\n", key: "KEY\n"} {
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config, err := json.Marshal(map[string]any{
+		"server": map[string]any{"host": "127.0.0.1", "listeners": []map[string]any{
+			{"kind": "grpc-tls", "port": "9443", "tls_cert_file": cert, "tls_key_file": key},
+			{"kind": "grpc-quic", "port": "9443", "tls_cert_file": cert, "tls_key_file": key},
+			{"kind": "admin", "port": "8081"},
+		}},
+		"database": map[string]any{"path": "/home/me/broker.db"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := renderK8s(t, string(config), "--name", "mq", "--namespace", "prod")
+
+	var kinds []string
+	for _, doc := range docs {
+		kinds = append(kinds, doc["kind"].(string))
+		if ns := field(t, doc, "metadata", "namespace"); ns != "prod" {
+			t.Fatalf("%s rendered in namespace %v", doc["kind"], ns)
+		}
+	}
+	if want := []string{"Secret", "PersistentVolumeClaim", "Deployment", "Service"}; !slices.Equal(kinds, want) {
+		t.Fatalf("expected %v, got %v", want, kinds)
+	}
+	secret, deployment, service := docs[0], docs[2], docs[3]
+
+	// The Secret carries the TLS files and a config pointing at their mounted copies
+	if got := field(t, secret, "stringData", "tls.crt"); got != "CERT\n" {
+		t.Fatalf("expected the certificate in the Secret, got %q", got)
+	}
+	var rendered struct {
+		Server struct {
+			Host      string `json:"host"`
+			Listeners []struct {
+				Host        string `json:"host"`
+				TLSCertFile string `json:"tls_cert_file"`
+			} `json:"listeners"`
+		} `json:"server"`
+		Database struct {
+			Path string `json:"path"`
+		} `json:"database"`
+	}
+	if err := json.Unmarshal([]byte(field(t, secret, "stringData", "config.json").(string)), &rendered); err != nil {
+		t.Fatalf("invalid config.json in the Secret: %v", err)
+	}
+	if rendered.Server.Host != "0.0.0.0" || rendered.Database.Path != k8sDataDir+"/db" ||
+		rendered.Server.Listeners[0].Host != "" || rendered.Server.Listeners[0].TLSCertFile != k8sConfigDir+"/tls.crt" {
+		t.Fatalf("config not rewritten for the container: %+v", rendered)
+	}
+
+	// Ports keep unique names, QUIC goes over UDP and the probes hit the admin listener
+	container := field(t, deployment, "spec", "template", "spec", "containers", 0)
+	ports := []struct{ name, protocol string }{{"grpc-tls", "TCP"}, {"grpc-quic", "UDP"}, {"admin", "TCP"}}
+	for i, want := range ports {
+		port := field(t, container, "ports", i)
+		if field(t, port, "name") != want.name || field(t, port, "protocol") != want.protocol {
+			t.Fatalf("container port %d is %v, want %s/%s", i, port, want.name, want.protocol)
+		}
+		if field(t, service, "spec", "ports", i, "targetPort") != want.name {
+			t.Fatalf("service port %d does not target %s", i, want.name)
+		}
+	}
+	for _, probe := range []string{"livenessProbe", "readinessProbe"} {
+		if path, port := field(t, container, probe, "httpGet", "path"), field(t, container, probe, "httpGet", "port"); path != "/healthz" || port != "admin" {
+			t.Fatalf("%s checks %v on %v", probe, path, port)
+		}
+	}
+	if port := field(t, deployment, "spec", "template", "metadata", "annotations", "prometheus.io/port"); port != "8081" {
+		t.Fatalf("expected metrics scraped on 8081, got %v", port)
+	}
+	if replicas := field(t, deployment, "spec", "replicas"); replicas != 1 {
+		t.Fatalf("expected a single replica, got %v", replicas)
+	}
+}
+
+func TestK8sRenderHelmValues(t *testing.T) {
+	// Without an admin listener the probes fall back to a TCP check of the gRPC port
+	docs := renderK8s(t, `{"server": {"port": "9000"}}`, "--format", "helm", "--image", "registry:5000/team/broker:1.4")
+	if len(docs) != 1 {
+		t.Fatalf("expected a single values document, got %d", len(docs))
+	}
+	values := docs[0]
+	if repo, tag := field(t, values, "image", "repository"), field(t, values, "image", "tag"); repo != "registry:5000/team/broker" || tag != "1.4" {
+		t.Fatalf("image split into %v and %v", repo, tag)
+	}
+	if port := field(t, values, "probes", "tcpSocket", "port"); port != "grpc" {
+		t.Fatalf("expected a TCP probe of the grpc port, got %v", port)
+	}
+	if port := field(t, values, "service", "ports", 0, "port"); port != 9000 {
+		t.Fatalf("expected the service on 9000, got %v", port)
+	}
+	if _, ok := field(t, values, "config", "files").(map[string]any)["config.json"]; !ok {
+		t.Fatalf("config.json missing from the values")
+	}
+}
@@ -0,0 +1,253 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Access log formats
+const (
+	AccessLogCommon = "common" // one line per call in the spirit of the Common Log Format
+	AccessLogJSON   = "json"   // one JSON object per call
+)
+
+// AccessLogConfig writes a line per gRPC call to a log of its own, apart from the
+// application log
+type AccessLogConfig struct {
+	// File receives the access log, "-" for standard output
+	File string `json:"file,omitempty"`
+	// Format is "common" (default) or "json"
+	Format string `json:"format,omitempty"`
+	// SampleRate is the fraction of calls logged, all of them when 0
+	SampleRate float64 `json:"sample_rate,omitempty"`
+}
+
+// check validates the format and sample rate
+func (c AccessLogConfig) check() error {
+	switch c.Format {
+	case "", AccessLogCommon, AccessLogJSON:
+	default:
+		return fmt.Errorf("unknown format %q (use 'common' or 'json')", c.Format)
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("sample_rate must be between 0 and 1")
+	}
+	return nil
+}
+
+// AccessEntry is a call as written to the access log
+type AccessEntry struct {
+	Time    time.Time `json:"time"`
+	Method  string    `json:"method"`
+	Peer    string    `json:"peer"`
+	Service string    `json:"service,omitempty"`
+	// Duration is in seconds
+	Duration      float64 `json:"duration"`
+	RequestBytes  int64   `json:"request_bytes"`
+	ResponseBytes int64   `json:"response_bytes"`
+	Code          string  `json:"code"`
+}
+
+// AccessLog writes sampled gRPC calls to a writer
+type AccessLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	json   bool
+	sample float64
+}
+
+// OpenAccessLog opens the access log of config, nil when it has no file
+func OpenAccessLog(config AccessLogConfig) (*AccessLog, error) {
+	if config.File == "" {
+		return nil, nil
+	}
+	if err := config.check(); err != nil {
+		return nil, err
+	}
+	if config.File == "-" {
+		return NewAccessLog(os.Stdout, config), nil
+	}
+	f, err := os.OpenFile(config.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open access log: %w", err)
+	}
+	l := NewAccessLog(f, config)
+	l.closer = f
+	return l, nil
+}
+
+// NewAccessLog returns an access log writing to w in the format of config. The File of
+// config is ignored.
+func NewAccessLog(w io.Writer, config AccessLogConfig) *AccessLog {
+	sample := config.SampleRate
+	if sample <= 0 {
+		sample = 1
+	}
+	return &AccessLog{w: w, json: config.Format == AccessLogJSON, sample: sample}
+}
+
+// Close closes the file of the access log
+func (l *AccessLog) Close() error {
+	if l == nil || l.closer == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closer.Close()
+}
+
+// WithAccessLog logs gRPC calls to l when the access_log interceptor is in the
+// pipeline. The server closes l when it closes.
+func WithAccessLog(l *AccessLog) ServerOption {
+	return func(s *Server) {
+		s.accessLog = l
+	}
+}
+
+// sampled reports whether the next call is logged
+func (l *AccessLog) sampled() bool {
+	return l.sample >= 1 || rand.Float64() < l.sample
+}
+
+// write appends entry to the log
+func (l *AccessLog) write(entry AccessEntry) error {
+	var line []byte
+	if l.json {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		line = append(data, '\n')
+	} else {
+		service := entry.Service
+		if service == "" {
+			service = "-"
+		}
+		line = fmt.Appendf(nil, "%s - %s [%s] %q %s %d %d %.6f\n", entry.Peer, service,
+			entry.Time.Format("02/Jan/2006:15:04:05 -0700"), entry.Method, entry.Code,
+			entry.RequestBytes, entry.ResponseBytes, entry.Duration)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.w.Write(line)
+	return err
+}
+
+// accessCtxKey carries the *accessCall of a logged call
+type accessCtxKey struct{}
+
+// accessCall collects what inner interceptors learn about a logged call
+type accessCall struct {
+	service atomic.Value // string
+}
+
+// noteAccessService records the authenticated service of a call for the access log
+func noteAccessService(ctx context.Context, service string) {
+	if call, ok := ctx.Value(accessCtxKey{}).(*accessCall); ok {
+		call.service.Store(service)
+	}
+}
+
+// logAccess writes a finished call to the access log
+func (s *Server) logAccess(ctx context.Context, call *accessCall, method string, start time.Time, in, out int64, err error) {
+	entry := AccessEntry{
+		Time:          start,
+		Method:        method,
+		Peer:          "unknown",
+		Duration:      time.Since(start).Seconds(),
+		RequestBytes:  in,
+		ResponseBytes: out,
+		Code:          status.Code(err).String(),
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		entry.Peer = p.Addr.String()
+	}
+	if service, ok := call.service.Load().(string); ok {
+		entry.Service = service
+	}
+	if err := s.accessLog.write(entry); err != nil {
+		s.metrics.Inc("broker_access_log_failures_total")
+	}
+}
+
+// messageSize returns the encoded size of a protobuf message, 0 for anything else
+func messageSize(m any) int64 {
+	if msg, ok := m.(proto.Message); ok && msg != nil {
+		return int64(proto.Size(msg))
+	}
+	return 0
+}
+
+// AccessLogUnaryInterceptor writes sampled unary calls to the access log
+func (s *Server) AccessLogUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !s.accessLog.sampled() {
+			return handler(ctx, req)
+		}
+		start := time.Now()
+		call := &accessCall{}
+		resp, err := handler(context.WithValue(ctx, accessCtxKey{}, call), req)
+		var out int64
+		if err == nil {
+			out = messageSize(resp)
+		}
+		s.logAccess(ctx, call, info.FullMethod, start, messageSize(req), out, err)
+		return resp, err
+	}
+}
+
+// AccessLogStreamInterceptor writes sampled streams to the access log once they end,
+// with the bytes of every message received and sent
+func (s *Server) AccessLogStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !s.accessLog.sampled() {
+			return handler(srv, ss)
+		}
+		start := time.Now()
+		call := &accessCall{}
+		counted := &countingStream{ServerStream: ss, ctx: context.WithValue(ss.Context(), accessCtxKey{}, call)}
+		err := handler(srv, counted)
+		s.logAccess(ss.Context(), call, info.FullMethod, start, counted.in.Load(), counted.out.Load(), err)
+		return err
+	}
+}
+
+// countingStream counts the bytes of the messages of a stream
+type countingStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	in, out atomic.Int64
+}
+
+func (c *countingStream) Context() context.Context {
+	return c.ctx
+}
+
+func (c *countingStream) RecvMsg(m any) error {
+	err := c.ServerStream.RecvMsg(m)
+	if err == nil {
+		c.in.Add(messageSize(m))
+	}
+	return err
+}
+
+func (c *countingStream) SendMsg(m any) error {
+	err := c.ServerStream.SendMsg(m)
+	if err == nil {
+		c.out.Add(messageSize(m))
+	}
+	return err
+}
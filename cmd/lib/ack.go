@@ -0,0 +1,266 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	"go.mills.io/bitcask/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DefaultAckTimeout is how long a message delivered in manual-ack mode stays invisible before redelivery
+const DefaultAckTimeout = 30 * time.Second
+
+// MaxVisibilityExtension caps how far ExtendVisibility and Nack may push a message's redelivery
+const MaxVisibilityExtension = 12 * time.Hour
+
+// WithAcks configures manual-ack delivery: ackTimeout is the redelivery delay for
+// unacknowledged messages and maxAttempts (0 = unlimited) moves messages to the
+// service's dead-letter queue once exceeded
+func WithAcks(ackTimeout time.Duration, maxAttempts uint32) ServerOption {
+	return func(s *Server) {
+		if ackTimeout > 0 {
+			s.ackTimeout = ackTimeout
+		}
+		s.maxAttempts = maxAttempts
+	}
+}
+
+// DeadLetterQueue returns the service whose queue receives a service's dead letters
+func DeadLetterQueue(serviceName string) string {
+	return serviceName + ".dlq"
+}
+
+// requeue moves a message to a new key that becomes visible at visibleAt and returns the
+// stored copy. The envelope keeps the original Seq so expiry is still measured from enqueue time.
+func (s *Server) requeue(key bitcask.Key, msg *pb.Message, serviceName string, visibleAt time.Time) (*pb.Message, error) {
+	newKey := messageKeyAt(serviceName, visibleAt)
+	stored := proto.Clone(msg).(*pb.Message)
+	stored.Id = string(newKey)
+	if err := s.replace(key, newKey, stored); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// deadLetter moves a message that ran out of attempts to the dead-letter queue of its
+// service, which instances share
+func (s *Server) deadLetter(key bitcask.Key, msg *pb.Message, serviceName string) error {
+	service, _ := protocol.SplitAddress(serviceName)
+	queue := DeadLetterQueue(service)
+	stored := proto.Clone(msg).(*pb.Message)
+	stored.Id = ""
+	stored.To = queue
+	if err := s.replace(key, messageKey(queue), stored); err != nil {
+		return err
+	}
+	s.deliveries.take(string(key))
+	s.metrics.Inc("broker_messages_dead_lettered_total")
+	s.emit(pb.BrokerEventType_BROKER_EVENT_TYPE_DEAD_LETTERED, service, string(key), msg, queue)
+	log.Printf("Message %s moved to %s after %d attempts (trace %s)", key, queue, msg.Attempts, msg.TraceId)
+	return nil
+}
+
+// replace atomically stores msg under newKey and deletes key
+func (s *Server) replace(key, newKey bitcask.Key, msg *pb.Message) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	value, err := encodeEnvelope(*buf, msg)
+	if err != nil {
+		return err
+	}
+	*buf = value
+	batch := s.db.Batch()
+	if _, err := batch.Put(newKey, value); err != nil {
+		return err
+	}
+	if _, err := batch.Delete(key); err != nil {
+		return err
+	}
+	if err := s.db.WriteBatch(batch); err != nil {
+		return err
+	}
+	return s.commit()
+}
+
+// ownedMessage resolves a message id sent back by a consumer, checking it belongs to
+// serviceName or to one of its instances
+func (s *Server) ownedMessage(serviceName, id string) (bitcask.Key, *pb.Message, *pb.Status, error) {
+	if serviceName == "" || id == "" {
+		st, err := invalidRequest("missing service name or message id")
+		return nil, nil, st, err
+	}
+	key := bitcask.Key(id)
+	queue, ok := keyService(key)
+	if owner, _ := protocol.SplitAddress(queue); !ok || owner != serviceName {
+		st, err := failure(codes.PermissionDenied, &pb.Status{Message: "message does not belong to " + serviceName, Success: false, Error: pb.Error_INVALID_REQUEST})
+		return nil, nil, st, err
+	}
+	value, err := s.db.Get(key)
+	if err != nil {
+		st, err := failure(codes.NotFound, &pb.Status{Message: "unknown message id, it may have been redelivered or expired", Success: false, Error: pb.Error_INVALID_REQUEST})
+		return nil, nil, st, err
+	}
+	var msg pb.Message
+	if err := decodeStored(value, &msg); err != nil {
+		if qerr := s.quarantine(key, value, err); qerr != nil {
+			st, err := serverError(qerr)
+			return nil, nil, st, err
+		}
+		st, err := serverError(err)
+		return nil, nil, st, err
+	}
+	return key, &msg, nil, nil
+}
+
+// Ack deletes a message delivered in manual-ack mode
+func (s *Server) Ack(ctx context.Context, req *pb.AckRequest) (*pb.Status, error) {
+	if err := contextError(ctx); err != nil {
+		return serverError(err)
+	}
+	from, st, err := actingService(ctx, req.From)
+	if err != nil {
+		return st, err
+	}
+	req.From = from
+	if remote, st, err := s.routeRemote(ctx, req.From, func(ctx context.Context, c pb.BrokerClient) (*pb.Status, error) {
+		return c.Ack(ctx, req)
+	}); remote {
+		return st, err
+	}
+	return s.ack(ctx, req, true)
+}
+
+// ack deletes an acknowledged message of this broker. With route set, a message on a
+// routing slip is first sent on to the slip's next service.
+func (s *Server) ack(ctx context.Context, req *pb.AckRequest, route bool) (*pb.Status, error) {
+	key, msg, st, err := s.ownedMessage(req.From, req.Id)
+	if st != nil {
+		return st, err
+	}
+	if route {
+		if st, err := s.nextHop(ctx, msg); err != nil {
+			return st, err
+		}
+	}
+	if err := s.db.Delete(key); err != nil {
+		return serverError(err)
+	}
+	if err := s.commit(); err != nil {
+		return serverError(err)
+	}
+	s.movePartition(key, msg, "")
+	s.observeAck(key, time.Now())
+	s.metrics.Inc("broker_messages_acked_total")
+	s.emit(pb.BrokerEventType_BROKER_EVENT_TYPE_ACKED, req.From, req.Id, msg, "")
+	return &pb.Status{Message: "Message acknowledged", Success: true, Error: pb.Error_NONE}, nil
+}
+
+// Nack makes a message delivered in manual-ack mode visible again after the requested delay,
+// or dead-letters it when it has used up its attempts
+func (s *Server) Nack(ctx context.Context, req *pb.NackRequest) (*pb.Status, error) {
+	if err := contextError(ctx); err != nil {
+		return serverError(err)
+	}
+	from, st, err := actingService(ctx, req.From)
+	if err != nil {
+		return st, err
+	}
+	req.From = from
+	delay := req.RequeueDelay.AsDuration()
+	if delay < 0 || delay > MaxVisibilityExtension {
+		return invalidRequest(fmt.Sprintf("requeue delay must not be negative nor exceed %s", MaxVisibilityExtension))
+	}
+	if remote, st, err := s.routeRemote(ctx, req.From, func(ctx context.Context, c pb.BrokerClient) (*pb.Status, error) {
+		return c.Nack(ctx, req)
+	}); remote {
+		return st, err
+	}
+	return s.nack(req, delay)
+}
+
+// nack requeues or dead-letters a rejected message of this broker
+func (s *Server) nack(req *pb.NackRequest, delay time.Duration) (*pb.Status, error) {
+	key, msg, st, err := s.ownedMessage(req.From, req.Id)
+	if st != nil {
+		return st, err
+	}
+	s.metrics.Inc("broker_messages_nacked_total")
+	s.deliveries.take(string(key))
+	s.emit(pb.BrokerEventType_BROKER_EVENT_TYPE_NACKED, req.From, req.Id, msg, "")
+	if s.maxAttempts > 0 && msg.Attempts >= s.maxAttempts {
+		if err := s.deadLetter(key, msg, req.From); err != nil {
+			return serverError(err)
+		}
+		return &pb.Status{Message: "Message dead-lettered to " + DeadLetterQueue(req.From), Success: true, Error: pb.Error_NONE}, nil
+	}
+	// Messages sent to an instance stay in that instance's queue
+	queue, _ := keyService(key)
+	stored, err := s.requeue(key, msg, queue, time.Now().Add(delay))
+	if err != nil {
+		return serverError(err)
+	}
+	// The rest of its partition keeps waiting for it
+	s.movePartition(key, msg, stored.Id)
+	return &pb.Status{Message: fmt.Sprintf("Message requeued (visible in %s)", delay), Success: true, Error: pb.Error_NONE}, nil
+}
+
+// ExtendVisibility keeps an unacknowledged message invisible for the requested duration
+// from now. The message moves to a new key, so the reply carries the id to ack it by.
+// A message whose visibility already lapsed is back in the queue and cannot be extended.
+func (s *Server) ExtendVisibility(ctx context.Context, req *pb.ExtendVisibilityRequest) (*pb.ExtendVisibilityResponse, error) {
+	if err := contextError(ctx); err != nil {
+		_, err := serverError(err)
+		return nil, err
+	}
+	from, _, err := actingService(ctx, req.From)
+	if err != nil {
+		return nil, err
+	}
+	req.From = from
+	duration := req.Duration.AsDuration()
+	if duration <= 0 || duration > MaxVisibilityExtension {
+		_, err := invalidRequest(fmt.Sprintf("duration must be positive and at most %s", MaxVisibilityExtension))
+		return nil, err
+	}
+	var extended *pb.ExtendVisibilityResponse
+	if remote, _, err := s.routeRemote(ctx, req.From, func(ctx context.Context, c pb.BrokerClient) (*pb.Status, error) {
+		var err error
+		extended, err = c.ExtendVisibility(ctx, req)
+		return nil, err
+	}); remote {
+		return extended, err
+	}
+	return s.extendVisibility(req, duration)
+}
+
+// extendVisibility requeues an in-flight message of this broker further in the future
+func (s *Server) extendVisibility(req *pb.ExtendVisibilityRequest, duration time.Duration) (*pb.ExtendVisibilityResponse, error) {
+	key, msg, st, err := s.ownedMessage(req.From, req.Id)
+	if st != nil {
+		return nil, err
+	}
+	queue, _ := keyService(key)
+	now := time.Now()
+	if visibleAt, _ := keyVisibleAt(messagePrefix(queue), key); !visibleAt.After(now) {
+		_, err := failure(codes.FailedPrecondition, &pb.Status{Message: "visibility timeout already lapsed, the message is back in the queue", Success: false, Error: pb.Error_INVALID_REQUEST})
+		return nil, err
+	}
+	visibleAt := now.Add(duration)
+	stored, err := s.requeue(key, msg, queue, visibleAt)
+	if err != nil {
+		_, err := serverError(err)
+		return nil, err
+	}
+	s.movePartition(key, msg, stored.Id)
+	s.deliveries.move(string(key), stored.Id)
+	s.metrics.Inc("broker_visibility_extended_total")
+	return &pb.ExtendVisibilityResponse{Id: stored.Id, VisibleAt: timestamppb.New(visibleAt)}, nil
+}
@@ -0,0 +1,267 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Alert conditions
+const (
+	AlertQueueDepth      = "queue_depth"      // queued messages of a service (every service when unset) above Threshold
+	AlertConsumerOffline = "consumer_offline" // no Receive stream for Service for longer than For
+	AlertDiskUsage       = "disk_usage"       // used fraction of the database filesystem above Threshold
+	AlertUnknownService  = "unknown_service"  // more than Threshold messages from or to an unknown service (Service when set) since the last evaluation
+	AlertBacklogAge      = "backlog_age"      // oldest waiting message of a service (every service when unset) older than For, or its max backlog age
+)
+
+// DefaultAlertInterval is how often alert rules are evaluated when not configured
+const DefaultAlertInterval = 30 * time.Second
+
+// alertTimeout bounds a single webhook or Slack notification
+const alertTimeout = 10 * time.Second
+
+// Alert is the JSON body posted to an alert webhook
+type Alert struct {
+	Rule      string    `json:"rule"`
+	Condition string    `json:"condition"`
+	Service   string    `json:"service,omitempty"`
+	State     string    `json:"state"` // "firing" or "resolved"
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Message   string    `json:"message"`
+	Time      time.Time `json:"time"`
+}
+
+// alerter evaluates alert rules. State is only touched by the evaluation loop.
+type alerter struct {
+	interval time.Duration
+	rules    []AlertRule
+	client   *http.Client
+	firing   map[string]bool      // rule/service -> firing
+	offline  map[string]time.Time // service -> first evaluation that found it offline
+}
+
+// WithAlerts evaluates rules every interval and notifies their webhooks when they
+// start and stop firing
+func WithAlerts(interval time.Duration, rules []AlertRule) ServerOption {
+	return func(s *Server) {
+		if interval <= 0 {
+			interval = DefaultAlertInterval
+		}
+		s.alerts = &alerter{
+			interval: interval,
+			rules:    rules,
+			client:   &http.Client{Timeout: alertTimeout},
+			firing:   make(map[string]bool),
+			offline:  make(map[string]time.Time),
+		}
+	}
+}
+
+// startAlerts evaluates the alert rules until the server shuts down
+func (s *Server) startAlerts() {
+	ticker := time.NewTicker(s.alerts.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.checkAlerts(now)
+		}
+	}
+}
+
+// checkAlerts evaluates every rule once and notifies state changes
+func (s *Server) checkAlerts(now time.Time) {
+	var queues, unknown map[string]int
+	var ages map[string]time.Duration
+	for _, rule := range s.alerts.rules {
+		switch rule.Condition {
+		case AlertQueueDepth:
+			if queues == nil {
+				var err error
+				if queues, err = s.Queues(); err != nil {
+					log.Printf("Failed to evaluate alert %s: %v", rule.Name, err)
+					continue
+				}
+			}
+			if rule.Service != "" {
+				s.updateAlert(rule, rule.Service, float64(queues[rule.Service]), float64(queues[rule.Service]) > rule.Threshold,
+					fmt.Sprintf("%d messages queued for %s (threshold %g)", queues[rule.Service], rule.Service, rule.Threshold))
+				continue
+			}
+			for service, n := range queues {
+				s.updateAlert(rule, service, float64(n), float64(n) > rule.Threshold,
+					fmt.Sprintf("%d messages queued for %s (threshold %g)", n, service, rule.Threshold))
+			}
+			// Queues that drained completely no longer show up
+			for key := range s.alerts.firing {
+				if service, ok := firingService(key, rule.Name); ok && queues[service] == 0 {
+					s.updateAlert(rule, service, 0, false, fmt.Sprintf("no messages queued for %s", service))
+				}
+			}
+		case AlertConsumerOffline:
+			if s.Connected(rule.Service) {
+				delete(s.alerts.offline, rule.Service)
+				s.updateAlert(rule, rule.Service, 0, false, fmt.Sprintf("%s is connected again", rule.Service))
+				continue
+			}
+			since, ok := s.alerts.offline[rule.Service]
+			if !ok {
+				since = now
+				s.alerts.offline[rule.Service] = now
+			}
+			offline := now.Sub(since)
+			s.updateAlert(rule, rule.Service, offline.Seconds(), offline >= rule.For,
+				fmt.Sprintf("%s has had no Receive stream for %s", rule.Service, offline.Round(time.Second)))
+		case AlertDiskUsage:
+			if !s.diskLimited() {
+				// Nothing else samples the disk
+				s.checkDisk()
+			}
+			ratio, _ := s.diskSample()
+			s.updateAlert(rule, "", ratio, ratio > rule.Threshold,
+				fmt.Sprintf("disk usage %.1f%% (threshold %.1f%%)", ratio*100, rule.Threshold*100))
+		case AlertBacklogAge:
+			if ages == nil {
+				var err error
+				if ages, err = s.BacklogAges(now); err != nil {
+					log.Printf("Failed to evaluate alert %s: %v", rule.Name, err)
+					continue
+				}
+			}
+			check := func(service string) {
+				limit := rule.For
+				if limit <= 0 {
+					limit = s.backlogSLA(service)
+				}
+				if limit <= 0 {
+					return
+				}
+				age := ages[service]
+				s.updateAlert(rule, service, age.Seconds(), age > limit,
+					fmt.Sprintf("oldest message for %s has waited %s (limit %s)", service, age.Round(time.Second), limit))
+			}
+			if rule.Service != "" {
+				check(rule.Service)
+				continue
+			}
+			for service := range ages {
+				check(service)
+			}
+			// Queues that drained completely no longer show up
+			for key := range s.alerts.firing {
+				if service, ok := firingService(key, rule.Name); ok && ages[service] == 0 {
+					s.updateAlert(rule, service, 0, false, fmt.Sprintf("no messages waiting for %s", service))
+				}
+			}
+		case AlertUnknownService:
+			if s.registry == nil || !s.registry.strict {
+				continue
+			}
+			if unknown == nil {
+				unknown = s.registry.unknownServices()
+			}
+			for service, n := range unknown {
+				if rule.Service != "" && service != rule.Service {
+					continue
+				}
+				s.updateAlert(rule, service, float64(n), float64(n) > rule.Threshold,
+					fmt.Sprintf("%d messages from or to unknown service %s (threshold %g)", n, service, rule.Threshold))
+			}
+			for key := range s.alerts.firing {
+				if service, ok := firingService(key, rule.Name); ok && unknown[service] == 0 {
+					s.updateAlert(rule, service, 0, false, fmt.Sprintf("no messages from or to unknown service %s", service))
+				}
+			}
+		}
+	}
+}
+
+// firingService returns the service of a firing alert key of rule
+func firingService(key, rule string) (string, bool) {
+	prefix := rule + "/"
+	if len(key) <= len(prefix) || key[:len(prefix)] != prefix {
+		return "", false
+	}
+	return key[len(prefix):], true
+}
+
+// updateAlert records the state of rule for service and notifies when it changed
+func (s *Server) updateAlert(rule AlertRule, service string, value float64, firing bool, message string) {
+	key := rule.Name + "/" + service
+	if s.alerts.firing[key] == firing {
+		return
+	}
+	state := "resolved"
+	if firing {
+		state = "firing"
+		s.alerts.firing[key] = true
+		s.metrics.Inc("broker_alerts_fired_total", "rule", rule.Name)
+	} else {
+		delete(s.alerts.firing, key)
+	}
+	log.Printf("Alert %s %s: %s", rule.Name, state, message)
+	alert := Alert{
+		Rule:      rule.Name,
+		Condition: rule.Condition,
+		Service:   service,
+		State:     state,
+		Value:     value,
+		Threshold: rule.Threshold,
+		Message:   message,
+		Time:      time.Now(),
+	}
+	go s.notifyAlert(rule, alert)
+}
+
+// notifyAlert posts alert to the rule's webhook and Slack incoming webhook
+func (s *Server) notifyAlert(rule AlertRule, alert Alert) {
+	if rule.Webhook != "" {
+		s.postAlert(rule.Webhook, alert)
+	}
+	if rule.Slack != "" {
+		icon := ":rotating_light:"
+		if alert.State == "resolved" {
+			icon = ":white_check_mark:"
+		}
+		s.postAlert(rule.Slack, map[string]string{
+			"text": fmt.Sprintf("%s [%s] broker alert %s: %s", icon, alert.State, alert.Rule, alert.Message),
+		})
+	}
+}
+
+// postAlert posts body as JSON to url
+func (s *Server) postAlert(url string, body any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		log.Printf("Failed to encode alert: %v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		s.metrics.Inc("broker_alert_notifications_failed_total")
+		log.Printf("Failed to send alert: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.alerts.client.Do(req)
+	if err != nil {
+		s.metrics.Inc("broker_alert_notifications_failed_total")
+		log.Printf("Failed to send alert: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		s.metrics.Inc("broker_alert_notifications_failed_total")
+		log.Printf("Alert receiver answered %s", resp.Status)
+	}
+}
@@ -1,14 +1,23 @@
 package lib
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
 	"github.com/golang-jwt/jwt/v5"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -21,6 +30,8 @@ type AuthMethod int
 const (
 	AuthMethodJWT AuthMethod = iota
 	AuthMethodAPIKey
+	// AuthMethodHMAC authenticates requests signed with an API key, which is never sent
+	AuthMethodHMAC
 )
 
 // AuthConfig holds authentication configuration
@@ -30,11 +41,43 @@ type AuthConfig struct {
 	TokenExpiry time.Duration
 	EnableAuth  bool
 	AuthMethod  AuthMethod
+	// OIDC also accepts tokens of an external identity provider with the JWT method
+	OIDC *OIDCConfig `json:"oidc,omitempty"`
+	// KeyInfo describes API keys, by key as in APIKeys
+	KeyInfo map[string]*APIKeyInfo `json:"key_info,omitempty"`
+	// KeyNetworks restricts API keys, by key as in APIKeys, to client networks
+	KeyNetworks map[string]*NetworkPolicy `json:"key_networks,omitempty"`
+	// ServiceNetworks restricts every credential of a service, tokens included, to client networks
+	ServiceNetworks map[string]*NetworkPolicy `json:"service_networks,omitempty"`
+	// SignatureWindow is how far the timestamp of a signed request may be from the
+	// broker's clock with the HMAC method (default 5m)
+	SignatureWindow time.Duration `json:"signature_window,omitempty"`
+	// Throttle slows down and locks out clients guessing credentials
+	Throttle AuthThrottleConfig `json:"throttle,omitzero"`
+	// Policy restricts the RPCs each service and API key may call
+	Policy AuthPolicy `json:"policy,omitzero"`
+	// StreamRecheckInterval is how often the credentials of open streams are validated
+	// again, ending the streams of expired or revoked credentials (default 30s)
+	StreamRecheckInterval time.Duration `json:"stream_recheck_interval,omitempty"`
+
+	// keyRefs maps keys resolved from secret references back to the references
+	keyRefs map[string]string
 }
 
 // AuthManager handles authentication logic
 type AuthManager struct {
-	config *AuthConfig
+	config   *AuthConfig
+	oidc     *oidcValidator
+	usage    keyUsage
+	throttle *authThrottle
+	networks networkPolicies
+	hmac     *hmacVerifier
+	revoked  revocationList
+	// keysMu guards the API keys of config and their references, which are replaced
+	// when the config file changes
+	keysMu sync.RWMutex
+	// onFailure is called with every call rejected by authentication
+	onFailure func(AuthFailure)
 }
 
 // JWTClaims represents JWT token claims
@@ -54,13 +97,25 @@ func NewAuthManager(config *AuthConfig) *AuthManager {
 	if config.APIKeys == nil {
 		config.APIKeys = make(map[string]string)
 	}
-	return &AuthManager{config: config}
+	am := &AuthManager{config: config, throttle: newAuthThrottle(config.Throttle), networks: newNetworkPolicies(config)}
+	if config.OIDC != nil {
+		am.oidc = newOIDCValidator(*config.OIDC)
+	}
+	if config.AuthMethod == AuthMethodHMAC {
+		am.hmac = newHMACVerifier(config)
+	}
+	return am
 }
 
 // GenerateAPIKey generates a new API key for a service
 func (am *AuthManager) GenerateAPIKey(serviceName string) string {
 	apiKey := generateRandomKey(32)
+	am.keysMu.Lock()
 	am.config.APIKeys[apiKey] = serviceName
+	am.keysMu.Unlock()
+	if am.hmac != nil {
+		am.hmac.add(apiKey)
+	}
 	return apiKey
 }
 
@@ -74,6 +129,8 @@ func (am *AuthManager) GenerateJWT(serviceName string) (string, error) {
 			NotBefore: jwt.NewNumericDate(time.Now()),
 			Issuer:    "microservices-broker",
 			Subject:   serviceName,
+			// The token id lets the token be revoked before it expires
+			ID: generateRandomKey(16),
 		},
 	}
 
@@ -81,8 +138,26 @@ func (am *AuthManager) GenerateJWT(serviceName string) (string, error) {
 	return token.SignedString([]byte(am.config.JWTSecret))
 }
 
-// ValidateJWT validates a JWT token and returns the service name
+// ValidateJWT validates a JWT token, signed by the broker or by the configured identity
+// provider, and returns the service name
 func (am *AuthManager) ValidateJWT(tokenString string) (string, error) {
+	if am.oidc != nil {
+		if service, ok, err := am.oidc.validate(tokenString); ok {
+			return service, err
+		}
+	}
+	claims, err := am.parseJWT(tokenString)
+	if err != nil {
+		return "", err
+	}
+	if claims.ID != "" && am.revoked.contains(claims.ID) {
+		return "", fmt.Errorf("token has been revoked")
+	}
+	return claims.ServiceName, nil
+}
+
+// parseJWT verifies a token signed by the broker and returns its claims
+func (am *AuthManager) parseJWT(tokenString string) (*JWTClaims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
@@ -91,24 +166,33 @@ func (am *AuthManager) ValidateJWT(tokenString string) (string, error) {
 	})
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if claims, ok := token.Claims.(*JWTClaims); ok && token.Valid {
-		return claims.ServiceName, nil
+		return claims, nil
 	}
 
-	return "", fmt.Errorf("invalid token")
+	return nil, fmt.Errorf("invalid token")
 }
 
 // ValidateAPIKey validates an API key and returns the service name
 func (am *AuthManager) ValidateAPIKey(apiKey string) (string, error) {
-	if serviceName, exists := am.config.APIKeys[apiKey]; exists {
+	if serviceName, exists := am.apiKeyService(apiKey); exists {
+		am.usage.touch(KeyID(am.keyRef(apiKey)))
 		return serviceName, nil
 	}
 	return "", fmt.Errorf("invalid API key")
 }
 
+// apiKeyService returns the service an API key belongs to
+func (am *AuthManager) apiKeyService(apiKey string) (string, bool) {
+	am.keysMu.RLock()
+	defer am.keysMu.RUnlock()
+	serviceName, exists := am.config.APIKeys[apiKey]
+	return serviceName, exists
+}
+
 // UnaryInterceptor returns a gRPC unary interceptor for authentication
 func (am *AuthManager) UnaryInterceptor() grpc.UnaryServerInterceptor {
 	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
@@ -122,12 +206,21 @@ func (am *AuthManager) UnaryInterceptor() grpc.UnaryServerInterceptor {
 			return handler(ctx, req)
 		}
 
-		serviceName, err := am.authenticate(ctx)
+		call := signedCall{method: info.FullMethod}
+		if am.hmac != nil {
+			body, err := protocol.SignedBody(req)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to encode request: %v", err)
+			}
+			call.body = body
+		}
+		serviceName, _, err := am.authenticate(ctx, peerAddress(ctx), path.Base(info.FullMethod), call)
 		if err != nil {
-			return nil, status.Errorf(codes.Unauthenticated, "authentication failed: %v", err)
+			return nil, authError(err)
 		}
 
 		// Add service name to context for use in handlers
+		noteAccessService(ctx, serviceName)
 		ctx = context.WithValue(ctx, serviceNameCtxKey{}, serviceName)
 		return handler(ctx, req)
 	}
@@ -141,32 +234,143 @@ func (am *AuthManager) StreamInterceptor() grpc.StreamServerInterceptor {
 			return handler(srv, ss)
 		}
 
-		serviceName, err := am.authenticate(ss.Context())
+		serviceName, key, err := am.authenticate(ss.Context(), peerAddress(ss.Context()), path.Base(info.FullMethod), signedCall{method: info.FullMethod})
 		if err != nil {
-			return status.Errorf(codes.Unauthenticated, "authentication failed: %v", err)
+			return authError(err)
 		}
 
-		// Create a new context with service name
-		ctx := context.WithValue(ss.Context(), serviceNameCtxKey{}, serviceName)
+		noteAccessService(ss.Context(), serviceName)
+		// Create a new context with service name, ended when the credentials expire or are revoked
+		ctx, cancel := context.WithCancelCause(context.WithValue(ss.Context(), serviceNameCtxKey{}, serviceName))
+		defer cancel(nil)
+		md, _ := metadata.FromIncomingContext(ss.Context())
+		go am.recheckStream(ctx, cancel, md, key)
 		wrapped := &wrappedStream{ss, ctx}
-		return handler(srv, wrapped)
+		err = handler(srv, wrapped)
+		if cause := context.Cause(ctx); cause != nil && ss.Context().Err() == nil {
+			log.Printf("Ended %s stream of '%s': %v", path.Base(info.FullMethod), serviceName, cause)
+			return authError(cause)
+		}
+		return err
+	}
+}
+
+// authError turns an authentication failure into a gRPC status
+func authError(err error) error {
+	if isPermissionDenied(err) {
+		return status.Errorf(codes.PermissionDenied, "%v", err)
+	}
+	return status.Errorf(codes.Unauthenticated, "authentication failed: %v", err)
+}
+
+// AuthenticateHTTP validates the credentials carried by an HTTP request for the RPC
+// rpc. Requests from a locked out client fail with a *LockedOutError, valid credentials
+// used from outside their networks with a *NetworkDeniedError and calls their policy
+// does not allow with a *PolicyDeniedError. Signed requests have their body read, up
+// to limit bytes, and put back.
+func (am *AuthManager) AuthenticateHTTP(r *http.Request, rpc string, limit int64) (string, error) {
+	md := metadata.MD{}
+	for _, name := range []string{"authorization", "x-api-key", protocol.SignatureKeyIDHeader,
+		protocol.SignatureTimestampHeader, protocol.SignatureNonceHeader, protocol.SignatureHeader} {
+		if value := r.Header.Get(name); value != "" {
+			md.Set(name, value)
+		}
+	}
+	call := signedCall{method: r.Method + " " + r.URL.Path}
+	if am.hmac != nil {
+		body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+		if err != nil {
+			return "", fmt.Errorf("failed to read body: %w", err)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		call.body = body
 	}
+	serviceName, _, err := am.authenticate(metadata.NewIncomingContext(r.Context(), md), hostOnly(r.RemoteAddr), rpc, call)
+	return serviceName, err
 }
 
-// authenticate extracts and validates authentication from context
-func (am *AuthManager) authenticate(ctx context.Context) (string, error) {
-	md, ok := metadata.FromIncomingContext(ctx)
-	if !ok {
-		return "", fmt.Errorf("missing metadata")
+// authenticate validates the credentials of a call from remote to the RPC rpc.
+// It returns the service name and the API key that was used, if any. Repeated
+// failures from the address or with the credential are answered more and more
+// slowly, and then locked out for a while.
+func (am *AuthManager) authenticate(ctx context.Context, remote, rpc string, call signedCall) (string, string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	failure := AuthFailure{Peer: remote, KeyID: am.presentedKeyID(md)}
+	keys := throttleKeys(remote, failure.KeyID)
+
+	if wait := am.throttle.locked(keys); wait > 0 {
+		failure.Locked = true
+		failure.Err = &LockedOutError{RetryAfter: wait}
+		am.report(failure)
+		return "", "", failure.Err
+	}
+	serviceName, key, err := am.validate(md, call)
+	if err != nil {
+		failed := keys
+		if am.config.AuthMethod == AuthMethodHMAC && key == "" {
+			// Signed requests name their key in the clear, so only a caller whose
+			// signature shows it holds the key counts against it
+			failed = keys[:1]
+		}
+		var delay time.Duration
+		failure.Failures, failure.Lockout, delay = am.throttle.fail(failed)
+		failure.Err = err
+		am.report(failure)
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+		}
+		return "", "", err
+	}
+	if failure.KeyID != "" {
+		am.throttle.succeed(keys[len(keys)-1])
+	}
+	ref := am.keyRef(key)
+	if !am.networks.permits(serviceName, ref, remote) {
+		failure.Network = true
+		failure.Err = &NetworkDeniedError{Service: serviceName, Peer: remote}
+		am.report(failure)
+		return "", "", failure.Err
+	}
+	if err := am.config.Policy.authorize(serviceName, ref, rpc); err != nil {
+		failure.Policy = true
+		failure.Err = err
+		am.report(failure)
+		return "", "", err
+	}
+	return serviceName, key, nil
+}
+
+// keyRef returns an API key as written in the configuration, which is a secret
+// reference for keys resolved from one
+func (am *AuthManager) keyRef(key string) string {
+	am.keysMu.RLock()
+	defer am.keysMu.RUnlock()
+	if ref, ok := am.config.keyRefs[key]; ok {
+		return ref
+	}
+	return key
+}
+
+// validate checks the credentials in md with the configured method. It returns the
+// service name and the API key that was used, if any.
+func (am *AuthManager) validate(md metadata.MD, call signedCall) (string, string, error) {
+	if md == nil {
+		return "", "", fmt.Errorf("missing metadata")
 	}
 
 	switch am.config.AuthMethod {
 	case AuthMethodJWT:
-		return am.authenticateJWT(md)
+		serviceName, err := am.authenticateJWT(md)
+		return serviceName, "", err
 	case AuthMethodAPIKey:
 		return am.authenticateAPIKey(md)
+	case AuthMethodHMAC:
+		return am.authenticateHMAC(md, call)
 	default:
-		return "", fmt.Errorf("unsupported authentication method")
+		return "", "", fmt.Errorf("unsupported authentication method")
 	}
 }
 
@@ -187,13 +391,14 @@ func (am *AuthManager) authenticateJWT(md metadata.MD) (string, error) {
 }
 
 // authenticateAPIKey validates API key from metadata
-func (am *AuthManager) authenticateAPIKey(md metadata.MD) (string, error) {
+func (am *AuthManager) authenticateAPIKey(md metadata.MD) (string, string, error) {
 	values := md.Get("x-api-key")
 	if len(values) == 0 {
-		return "", fmt.Errorf("missing API key")
+		return "", "", fmt.Errorf("missing API key")
 	}
 
-	return am.ValidateAPIKey(values[0])
+	serviceName, err := am.ValidateAPIKey(values[0])
+	return serviceName, values[0], err
 }
 
 // wrappedStream wraps a grpc.ServerStream with a custom context
@@ -227,3 +432,37 @@ func GetServiceNameFromContext(ctx context.Context) string {
 	}
 	return ""
 }
+
+// actingService returns the service a call acts for: from, or the service its
+// credentials belong to when from is empty. Naming another service than the
+// credentials is refused, so that one service cannot read or change another's queue.
+func actingService(ctx context.Context, from string) (string, *pb.Status, error) {
+	authenticated := GetServiceNameFromContext(ctx)
+	if authenticated == "" {
+		return from, nil, nil
+	}
+	if from == "" {
+		return authenticated, nil, nil
+	}
+	if service, _ := protocol.SplitAddress(from); service != authenticated && !covers(authenticated, service) {
+		st, err := permissionDenied(fmt.Sprintf("credentials of '%s' cannot act for '%s'", authenticated, from))
+		return "", st, err
+	}
+	return from, nil, nil
+}
+
+// covers reports whether credentials of authenticated, a name pattern such as
+// "payments.>", may act for service
+func covers(authenticated, service string) bool {
+	return protocol.IsPattern(authenticated) && protocol.MatchName(authenticated, service)
+}
+
+// sender returns the service msg is sent by: the authenticated service, or the
+// service of its From when authentication is off or the credentials cover it
+func sender(ctx context.Context, msg *pb.Message) string {
+	from, _ := protocol.SplitAddress(msg.From)
+	if authenticated := GetServiceNameFromContext(ctx); authenticated != "" && !covers(authenticated, from) {
+		return authenticated
+	}
+	return from
+}
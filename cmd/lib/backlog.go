@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"errors"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	"go.mills.io/bitcask/v2"
+)
+
+// DefaultBacklogCheckInterval is how often backlogs are compared to the services'
+// max_backlog_age when not configured
+const DefaultBacklogCheckInterval = 30 * time.Second
+
+// BacklogStatus is the backlog of a queue as reported by the admin listener
+type BacklogStatus struct {
+	// AgeSeconds is how long the oldest waiting message has waited
+	AgeSeconds float64 `json:"age_seconds"`
+	// MaxAgeSeconds is the max backlog age of the service, 0 when it has none
+	MaxAgeSeconds float64 `json:"max_age_seconds"`
+	Breaching     bool    `json:"breaching"`
+}
+
+// backlogMonitor tracks the services whose oldest waiting message is older than their
+// max backlog age
+type backlogMonitor struct {
+	interval time.Duration
+	// breaching is only touched by the monitor loop, count is read by the gauge
+	breaching map[string]bool
+	count     atomic.Int64
+}
+
+// WithBacklogCheckInterval sets how often backlogs are compared to the services'
+// max backlog age
+func WithBacklogCheckInterval(interval time.Duration) ServerOption {
+	return func(s *Server) {
+		if interval > 0 {
+			s.backlog.interval = interval
+		}
+	}
+}
+
+// backlogSLA returns the max backlog age of the service of a queue, 0 when it has none
+func (s *Server) backlogSLA(queue string) time.Duration {
+	service, _ := protocol.SplitAddress(queue)
+	return s.services[service].MaxBacklogAge
+}
+
+// hasBacklogSLA reports whether any service has a max backlog age
+func (s *Server) hasBacklogSLA() bool {
+	for _, svc := range s.services {
+		if svc.MaxBacklogAge > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// BacklogAges returns, for each queue with messages waiting for delivery, how long
+// the oldest of them has waited at now. Delayed messages and messages in flight
+// until an ack do not wait yet.
+func (s *Server) BacklogAges(now time.Time) (map[string]time.Duration, error) {
+	oldest := make(map[string]time.Time)
+	err := s.db.Scan(nil, bitcask.KeyFunc(func(key bitcask.Key) error {
+		select {
+		case <-s.done:
+			return errServerClosed
+		default:
+		}
+		queue, ok := keyService(key)
+		if !ok {
+			return nil
+		}
+		visibleAt, _ := keyVisibleAt(messagePrefix(queue), key)
+		if visibleAt.IsZero() {
+			// Legacy keys carry no time, the record does
+			value, err := s.db.Get(key)
+			if err != nil {
+				return nil
+			}
+			if visibleAt, err = storedTime(value); err != nil {
+				return nil
+			}
+		}
+		if visibleAt.After(now) {
+			return nil
+		}
+		if t, ok := oldest[queue]; !ok || visibleAt.Before(t) {
+			oldest[queue] = visibleAt
+		}
+		return nil
+	}))
+	if err != nil {
+		return nil, err
+	}
+	ages := make(map[string]time.Duration, len(oldest))
+	for queue, t := range oldest {
+		ages[queue] = now.Sub(t)
+	}
+	return ages, nil
+}
+
+// startBacklogMonitor compares backlogs to the services' max backlog age until the
+// server shuts down
+func (s *Server) startBacklogMonitor() {
+	ticker := time.NewTicker(s.backlog.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.checkBacklog(now)
+		}
+	}
+}
+
+// checkBacklog logs and counts the services that start or stop breaching their max
+// backlog age
+func (s *Server) checkBacklog(now time.Time) {
+	ages, err := s.BacklogAges(now)
+	if err != nil {
+		if !errors.Is(err, errServerClosed) {
+			log.Printf("Failed to measure backlogs: %v", err)
+		}
+		return
+	}
+	breaching := make(map[string]bool)
+	for queue, age := range ages {
+		sla := s.backlogSLA(queue)
+		if sla <= 0 || age <= sla {
+			continue
+		}
+		breaching[queue] = true
+		if !s.backlog.breaching[queue] {
+			s.metrics.Inc("broker_backlog_sla_breaches_total", "service", queue)
+			log.Printf("WARNING: oldest message for %s has waited %s, over its max backlog age of %s", queue, age.Round(time.Second), sla)
+		}
+	}
+	for queue := range s.backlog.breaching {
+		if !breaching[queue] {
+			log.Printf("Backlog of %s back within its max backlog age", queue)
+		}
+	}
+	s.backlog.breaching = breaching
+	s.backlog.count.Store(int64(len(breaching)))
+}
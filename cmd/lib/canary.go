@@ -0,0 +1,141 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"maps"
+	"math/rand/v2"
+	"strings"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"go.mills.io/bitcask/v2"
+)
+
+// Canary splits the messages sent to a service between two destinations
+type Canary struct {
+	// Primary gets the messages that do not go to Canary, the service itself by default
+	Primary string `json:"primary,omitempty"`
+	Canary  string `json:"canary"`
+	// Weight is the percentage (0-100) of the messages sent to Canary
+	Weight float64 `json:"weight"`
+}
+
+func (c Canary) check() error {
+	if c.Canary == "" {
+		return fmt.Errorf("canary destination is required")
+	}
+	if c.Weight < 0 || c.Weight > 100 {
+		return fmt.Errorf("weight must be between 0 and 100")
+	}
+	if c.Primary == c.Canary {
+		return fmt.Errorf("primary and canary are the same")
+	}
+	return nil
+}
+
+// pick returns where msg, sent to service, goes. Messages of a partition all go
+// the same way, so they stay in order.
+func (c Canary) pick(service string, msg *pb.Message) string {
+	primary := c.Primary
+	if primary == "" {
+		primary = service
+	}
+	var roll float64
+	if msg.PartitionKey != "" {
+		h := fnv.New32a()
+		h.Write([]byte(msg.PartitionKey))
+		roll = float64(h.Sum32()%10000) / 100
+	} else {
+		roll = rand.Float64() * 100
+	}
+	if roll < c.Weight {
+		return c.Canary
+	}
+	return primary
+}
+
+// canaryKey holds a canary set at runtime, which replaces the configured one
+func canaryKey(serviceName string) bitcask.Key {
+	return bitcask.Key(internalKeyPrefix + "canary/" + serviceName)
+}
+
+// canary returns the canary of service, if any
+func (r *Router) canary(service string) (Canary, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.canaries[service]
+	return c, ok
+}
+
+// Canaries returns the canaries in effect by service
+func (s *Server) Canaries() map[string]Canary {
+	s.router.mu.RLock()
+	defer s.router.mu.RUnlock()
+	return maps.Clone(s.router.canaries)
+}
+
+// SetCanary splits the messages sent to service from now on. The split survives
+// restarts and replaces the configured one until ClearCanary is called.
+func (s *Server) SetCanary(service string, c Canary) error {
+	if service == "" {
+		return fmt.Errorf("missing service name")
+	}
+	if err := c.check(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := s.db.Put(canaryKey(service), data); err != nil {
+		return err
+	}
+	if err := s.commit(); err != nil {
+		return err
+	}
+	s.router.mu.Lock()
+	s.router.canaries[service] = c
+	s.router.mu.Unlock()
+	log.Printf("Canary for %s set: %.4g%% to %s", service, c.Weight, c.Canary)
+	return nil
+}
+
+// ClearCanary drops the canary set at runtime for service; the configured one, if
+// any, applies again
+func (s *Server) ClearCanary(service string) error {
+	if err := s.db.Delete(canaryKey(service)); err != nil {
+		return err
+	}
+	if err := s.commit(); err != nil {
+		return err
+	}
+	s.router.mu.Lock()
+	if c, ok := s.router.configured[service]; ok {
+		s.router.canaries[service] = c
+	} else {
+		delete(s.router.canaries, service)
+	}
+	s.router.mu.Unlock()
+	log.Printf("Canary for %s cleared", service)
+	return nil
+}
+
+// loadCanaries applies the canaries set at runtime before the last restart
+func (s *Server) loadCanaries() error {
+	prefix := canaryKey("")
+	return s.db.Scan(prefix, bitcask.KeyFunc(func(key bitcask.Key) error {
+		data, err := s.db.Get(key)
+		if err != nil {
+			return err
+		}
+		var c Canary
+		if err := json.Unmarshal(data, &c); err != nil {
+			return fmt.Errorf("invalid canary %s: %w", key, err)
+		}
+		s.router.canaries[strings.TrimPrefix(string(key), string(prefix))] = c
+		return nil
+	}))
+}
@@ -0,0 +1,48 @@
+package lib
+
+import (
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultMaxFrameSize is the largest message a Receive stream delivers in one piece: the
+// limit gRPC clients put on the messages they receive by default
+const DefaultMaxFrameSize = 4 << 20
+
+// chunkOverhead covers the chunk fields and the length prefix of the data of each part
+const chunkOverhead = 32
+
+// WithMaxFrameSize sets the largest message delivered in one piece on Receive streams
+// (default 4MiB, the gRPC default). Larger messages are delivered in parts carrying
+// chunk indexes, the last one marked done, which the client library reassembles.
+func WithMaxFrameSize(size int) ServerOption {
+	return func(s *Server) {
+		if size > 0 {
+			s.maxFrameSize = size
+		}
+	}
+}
+
+// chunks splits msg into parts that each encode to at most maxFrame bytes. It returns
+// nil when msg fits in one frame, or when its metadata alone does not.
+func chunks(msg *pb.Message, maxFrame int) []*pb.Message {
+	if maxFrame <= 0 || proto.Size(msg) <= maxFrame {
+		return nil
+	}
+	meta := proto.Clone(msg).(*pb.Message)
+	meta.Data = nil
+	room := maxFrame - proto.Size(meta) - chunkOverhead
+	if room <= 0 {
+		return nil
+	}
+	parts := make([]*pb.Message, 0, (len(msg.Data)+room-1)/room)
+	for start := 0; start < len(msg.Data); start += room {
+		part := proto.Clone(meta).(*pb.Message)
+		part.Data = msg.Data[start:min(start+room, len(msg.Data))]
+		part.Chunk = uint32(len(parts) + 1)
+		parts = append(parts, part)
+	}
+	parts[len(parts)-1].Done = true
+	return parts
+}
@@ -3,47 +3,323 @@ package lib
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
 	"time"
 
+	"github.com/ispapp/Microservices-Broker/base/provision"
+	"github.com/ispapp/Microservices-Broker/base/shard"
+
+	"google.golang.org/grpc"
 	"gopkg.in/yaml.v3"
 )
 
 // Config represents the broker configuration
 type Config struct {
-	Server ServerConfig `json:"server"`
-	Auth   AuthConfig   `json:"auth"`
-	DB     DBConfig     `json:"database"`
+	Server     ServerConfig             `json:"server"`
+	Auth       AuthConfig               `json:"auth"`
+	DB         DBConfig                 `json:"database"`
+	Services   map[string]ServiceConfig `json:"services,omitempty"`
+	Alerts     AlertsConfig             `json:"alerts,omitempty"`
+	Sharding   ShardingConfig           `json:"sharding,omitempty"`
+	Federation FederationConfig         `json:"federation,omitempty"`
+	// Reports periodically summarize queue depths, throughput and errors
+	Reports ReportsConfig `json:"reports,omitempty"`
+	// Egress declares which services may send to which destinations
+	Egress EgressConfig `json:"egress,omitempty"`
+	// Registry lists the known services; in strict mode messages from or to others are
+	// rejected or quarantined
+	Registry RegistryConfig `json:"registry,omitempty"`
+	// Validation checks the payloads sent to services at ingress
+	Validation []ValidationRule `json:"validation,omitempty"`
+	// Plugins are WebAssembly modules that validate, rewrite or redirect messages on Send
+	Plugins []PluginConfig `json:"plugins,omitempty"`
+	// Scripts are Lua scripts that filter messages and change their headers on Send
+	Scripts []ScriptConfig `json:"scripts,omitempty"`
+	// Offload keeps the payloads of large queued messages in S3-compatible object storage
+	Offload OffloadConfig `json:"offload,omitempty"`
+	// Routing redirects, copies or drops messages on Send
+	Routing RoutingConfig `json:"routing,omitempty"`
+	// Redaction hides parts of payloads wherever the broker shows them to operators
+	Redaction []RedactionRule `json:"redaction,omitempty"`
+	// Profiles are named partial configurations (e.g. "dev", "prod") laid over the rest
+	// of the file when selected with --profile or BROKER_PROFILE
+	Profiles map[string]json.RawMessage `json:"profiles,omitempty" yaml:"-"`
+
+	// EncryptedAuth replaces Auth on disk after `config encrypt`
+	EncryptedAuth *EncryptedSection `json:"encrypted_auth,omitempty" yaml:"encrypted_auth"`
+
+	authKey *ConfigKey
+	profile string
 }
 
 // ServerConfig holds server-specific configuration
 type ServerConfig struct {
-	Host        string        `json:"host"`
-	Port        string        `json:"port"`
-	TLSEnabled  bool          `json:"tls_enabled"`
-	TLSCertFile string        `json:"tls_cert_file"`
-	TLSKeyFile  string        `json:"tls_key_file"`
-	TickSeconds int16         `json:"tick_seconds"`
-	MaxStored   int32         `json:"max_stored"`
-	MaxAge      time.Duration `json:"max_age"`
+	Host         string        `json:"host"`
+	Port         string        `json:"port"`
+	TLSEnabled   bool          `json:"tls_enabled"`
+	TLSCertFile  string        `json:"tls_cert_file"`
+	TLSKeyFile   string        `json:"tls_key_file"`
+	TickSeconds  int16         `json:"tick_seconds"`
+	MaxStored    int32         `json:"max_stored"`
+	MaxAge       time.Duration `json:"max_age"`
+	BatchSize    int           `json:"batch_size"`
+	Durability   string        `json:"durability"`
+	SyncInterval time.Duration `json:"sync_interval"`
+	// RequestTimeout bounds unary RPC handling, StreamLifetime bounds Receive streams (0 = unlimited)
+	RequestTimeout time.Duration `json:"request_timeout"`
+	StreamLifetime time.Duration `json:"stream_lifetime"`
+	// NotifyExpired returns expired queued messages to their sender as EXPIRED events
+	NotifyExpired bool `json:"notify_expired"`
+	// AckTimeout is the redelivery delay for unacknowledged manual-ack messages,
+	// MaxAttempts moves a message to "<service>.dlq" once exceeded (0 = unlimited)
+	AckTimeout  time.Duration `json:"ack_timeout"`
+	MaxAttempts uint32        `json:"max_attempts"`
+	// PoisonThreshold quarantines a message after this many failed deliveries in a row (0 = never)
+	PoisonThreshold uint32 `json:"poison_threshold"`
+	// DiskHighWatermark/DiskLowWatermark are used fractions of the database filesystem at which
+	// queueing stops and resumes (0 = no limit), MaxDBSize caps the database in bytes (0 = no limit)
+	DiskHighWatermark float64 `json:"disk_high_watermark"`
+	DiskLowWatermark  float64 `json:"disk_low_watermark"`
+	MaxDBSize         int64   `json:"max_db_size"`
+	// MaxInflightBytes caps message bytes held by in-flight sends and deliveries (0 = unlimited)
+	MaxInflightBytes int64 `json:"max_inflight_bytes"`
+	// KeepaliveInterval probes Receive streams (0 = never) and reaps those that do not
+	// accept a probe within KeepaliveTimeout
+	KeepaliveInterval time.Duration `json:"keepalive_interval"`
+	KeepaliveTimeout  time.Duration `json:"keepalive_timeout"`
+	// HeartbeatInterval sends a heartbeat on Receive streams idle that long (0 = never)
+	HeartbeatInterval time.Duration `json:"heartbeat_interval"`
+	// DuplicateConnections is what happens when a service opens a second Receive
+	// stream: "replace" (default), "reject" or "fanout"
+	DuplicateConnections string           `json:"duplicate_connections"`
+	Listeners            []ListenerConfig `json:"listeners,omitempty"`
+	// Quota is the default traffic quota of every authenticated service
+	Quota QuotaConfig `json:"quota"`
+	// DeliveryConcurrency is how many destinations are delivered to at once (0 = unlimited);
+	// waiting destinations take turns weighted by their priority
+	DeliveryConcurrency int `json:"delivery_concurrency"`
+	// BacklogCheckInterval is how often backlogs are compared to the services' max_backlog_age
+	BacklogCheckInterval time.Duration `json:"backlog_check_interval,omitempty"`
+	// Interceptors is the gRPC middleware pipeline, outermost first: "recovery",
+	// "metrics", "logging", "access_log", "auth", "rate_limit" and "deadline". Every
+	// interceptor but logging runs, in that order, when empty.
+	Interceptors []string `json:"interceptors,omitempty"`
+	// RateLimit limits the calls of each caller when the pipeline has "rate_limit"
+	RateLimit RateLimitConfig `json:"rate_limit,omitempty"`
+	// AccessLog writes a line per gRPC call when the pipeline has "access_log"
+	AccessLog AccessLogConfig `json:"access_log,omitempty"`
+	// MaxRecvMsgSize and MaxSendMsgSize are the largest messages in bytes the gRPC
+	// listeners accept and send (0 = the gRPC defaults, 4MiB and 2GiB). Receive
+	// streams deliver larger messages in chunks of MaxSendMsgSize, or 4MiB when unset.
+	MaxRecvMsgSize int `json:"max_recv_msg_size,omitempty"`
+	MaxSendMsgSize int `json:"max_send_msg_size,omitempty"`
+	// LogLevel is the initial log level: "debug", "info" (default) or "warn". The
+	// SetLogLevel admin RPC changes it at runtime.
+	LogLevel string `json:"log_level,omitempty"`
+	// SlowLogThreshold logs the calls slower than it (0 = none), see SetSlowLogging
+	SlowLogThreshold time.Duration `json:"slow_log_threshold,omitempty"`
+}
+
+// MessageSizeOptions returns the gRPC server options of the configured message sizes
+func (c ServerConfig) MessageSizeOptions() []grpc.ServerOption {
+	var opts []grpc.ServerOption
+	if c.MaxRecvMsgSize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(c.MaxRecvMsgSize))
+	}
+	if c.MaxSendMsgSize > 0 {
+		opts = append(opts, grpc.MaxSendMsgSize(c.MaxSendMsgSize))
+	}
+	return opts
+}
+
+// Listener kinds
+const (
+	ListenerGRPC        = "grpc"
+	ListenerGRPCTLS     = "grpc-tls"
+	ListenerGRPCQUIC    = "grpc-quic" // experimental, gRPC over a QUIC stream (UDP)
+	ListenerHTTPGateway = "http-gateway"
+	ListenerMetrics     = "metrics"
+	ListenerAdmin       = "admin"
+)
+
+// ListenerConfig describes one named network listener
+type ListenerConfig struct {
+	Name        string `json:"name"`
+	Kind        string `json:"kind"`
+	Host        string `json:"host"`
+	Port        string `json:"port"`
+	TLSEnabled  bool   `json:"tls_enabled"`
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+	// Pprof serves the runtime profiles under /debug/pprof/ on a metrics or admin
+	// listener, to admins; it needs authentication and an admin
+	Pprof bool `json:"pprof,omitempty"`
+}
+
+// Address returns the host:port the listener binds to
+func (l ListenerConfig) Address() string {
+	return net.JoinHostPort(l.Host, l.Port)
+}
+
+// EffectiveListeners returns the configured listeners, falling back to a single
+// gRPC listener on Host:Port. Listeners without a host inherit the server host.
+func (c *ServerConfig) EffectiveListeners() []ListenerConfig {
+	if len(c.Listeners) == 0 {
+		return []ListenerConfig{{
+			Name:        ListenerGRPC,
+			Kind:        ListenerGRPC,
+			Host:        c.Host,
+			Port:        c.Port,
+			TLSEnabled:  c.TLSEnabled,
+			TLSCertFile: c.TLSCertFile,
+			TLSKeyFile:  c.TLSKeyFile,
+		}}
+	}
+	listeners := make([]ListenerConfig, len(c.Listeners))
+	for i, l := range c.Listeners {
+		if l.Host == "" {
+			l.Host = c.Host
+		}
+		if l.Name == "" {
+			l.Name = l.Kind
+		}
+		if l.Kind == ListenerGRPCTLS || l.Kind == ListenerGRPCQUIC {
+			l.TLSEnabled = true
+		}
+		listeners[i] = l
+	}
+	return listeners
+}
+
+// ServiceConfig holds per-service overrides
+type ServiceConfig struct {
+	BatchSize            int    `json:"batch_size,omitempty"`
+	DuplicateConnections string `json:"duplicate_connections,omitempty"`
+	// Quota replaces server.quota for the service
+	Quota *QuotaConfig `json:"quota,omitempty"`
+	// Priority weighs the service's delivery turns against other destinations (default 1)
+	Priority int `json:"priority,omitempty"`
+	// MaxBacklogAge is how long the oldest message of the service may wait for delivery
+	// before it is reported as a breach (0 = no limit)
+	MaxBacklogAge time.Duration `json:"max_backlog_age,omitempty"`
+}
+
+// QuotaConfig caps the messages and data bytes a service may send per hour and per
+// day (0 = unlimited). Windows start on the hour and at midnight UTC.
+type QuotaConfig struct {
+	HourlyMessages int64 `json:"hourly_messages,omitempty"`
+	HourlyBytes    int64 `json:"hourly_bytes,omitempty"`
+	DailyMessages  int64 `json:"daily_messages,omitempty"`
+	DailyBytes     int64 `json:"daily_bytes,omitempty"`
+}
+
+// AlertsConfig holds the alert rules the broker evaluates itself
+type AlertsConfig struct {
+	// Interval is how often the rules are evaluated
+	Interval time.Duration `json:"interval,omitempty"`
+	Rules    []AlertRule   `json:"rules,omitempty"`
+}
+
+// AlertRule fires a webhook and/or Slack message when its condition holds and again when it clears
+type AlertRule struct {
+	Name string `json:"name"`
+	// Condition is "queue_depth", "consumer_offline", "disk_usage", "unknown_service" or "backlog_age"
+	Condition string `json:"condition"`
+	// Service the rule watches; queue_depth, unknown_service and backlog_age watch every service when empty
+	Service string `json:"service,omitempty"`
+	// Threshold is a message count for queue_depth and unknown_service and a used fraction for disk_usage
+	Threshold float64 `json:"threshold,omitempty"`
+	// For is how long a consumer must be offline before consumer_offline fires, and how
+	// long the oldest message may wait before backlog_age fires (the service's
+	// max_backlog_age when 0)
+	For time.Duration `json:"for,omitempty"`
+	// Webhook receives the alert as JSON, Slack is an incoming webhook URL; either may be a secret reference
+	Webhook string `json:"webhook,omitempty"`
+	Slack   string `json:"slack,omitempty"`
+}
+
+// ShardingConfig splits services between several brokers by a hash of the service name
+type ShardingConfig struct {
+	// Self is the name of this broker in Shards
+	Self string `json:"self,omitempty"`
+	// Shards lists every broker with its address and hash range; without ranges the
+	// hash space is split evenly in list order
+	Shards []shard.Shard `json:"shards,omitempty"`
+	// Proxy forwards calls about services of other shards instead of rejecting them
+	Proxy bool `json:"proxy,omitempty"`
+	// TLSEnabled secures connections to other shards, verified against TLSCAFile or the system roots
+	TLSEnabled bool   `json:"tls_enabled,omitempty"`
+	TLSCAFile  string `json:"tls_ca_file,omitempty"`
+	// Secret is shared by the shards (or a secret reference); calls forwarded with it
+	// skip the checks the forwarding shard made, calls without it are checked again
+	Secret string `json:"secret,omitempty"`
+}
+
+// FederationConfig links this broker to brokers in other datacenters. Messages for
+// services homed on a linked broker are stored here and forwarded over the link.
+type FederationConfig struct {
+	// Name identifies this broker in the hop list of forwarded messages
+	Name  string           `json:"name,omitempty"`
+	Links []FederationLink `json:"links,omitempty"`
+	// Peers lists the services (broker credentials) allowed to forward messages here; any authenticated caller when empty
+	Peers []string `json:"peers,omitempty"`
+}
+
+// FederationLink is a remote broker and the services homed on it
+type FederationLink struct {
+	Name     string   `json:"name"`
+	Address  string   `json:"address"`
+	Services []string `json:"services"`
+	// AuthMethod is "apikey" or "jwt"; Credential may be a secret reference
+	AuthMethod string `json:"auth_method,omitempty"`
+	Credential string `json:"credential,omitempty"`
+	// TLSEnabled secures the link, verified against TLSCAFile or the system roots
+	TLSEnabled bool   `json:"tls_enabled,omitempty"`
+	TLSCAFile  string `json:"tls_ca_file,omitempty"`
 }
 
 // DBConfig holds database-specific configuration
 type DBConfig struct {
-	Path string `json:"path"`
+	Path         string `json:"path"`
+	AutoRecovery bool   `json:"auto_recovery"`
+	// MaxValueSize is the largest record in bytes, which bounds the size of queued
+	// messages (default 64KiB)
+	MaxValueSize int `json:"max_value_size,omitempty"`
 }
 
+// ProfileEnv selects a config profile when --profile is not given
+const ProfileEnv = "BROKER_PROFILE"
+
 // LoadConfig loads configuration from file
 func LoadConfig(configPath string) (*Config, error) {
+	return LoadConfigProfile(configPath, "")
+}
+
+// LoadConfigProfile loads configuration from file and lays the named profile over it.
+// Fields the profile sets replace those of the file, maps are merged key by key and
+// lists are replaced whole. An empty profile loads the file as is.
+func LoadConfigProfile(configPath, profile string) (*Config, error) {
 	// Default configuration
 	config := &Config{
 		Server: ServerConfig{
-			Host:        "0.0.0.0",
-			Port:        "9000",
-			TLSEnabled:  false,
-			TickSeconds: 60,
-			MaxStored:   100,
-			MaxAge:      time.Hour * 24,
+			Host:                 "0.0.0.0",
+			Port:                 "9000",
+			TLSEnabled:           false,
+			TickSeconds:          60,
+			MaxStored:            100,
+			MaxAge:               time.Hour * 24,
+			BatchSize:            DefaultBatchSize,
+			Durability:           string(DurabilitySync),
+			RequestTimeout:       DefaultRequestTimeout,
+			PoisonThreshold:      DefaultPoisonThreshold,
+			DiskHighWatermark:    DefaultDiskHighWatermark,
+			DiskLowWatermark:     DefaultDiskLowWatermark,
+			MaxInflightBytes:     DefaultMaxInflightBytes,
+			KeepaliveInterval:    DefaultKeepaliveInterval,
+			KeepaliveTimeout:     DefaultKeepaliveTimeout,
+			DuplicateConnections: string(DuplicateReplace),
+			DeliveryConcurrency:  DefaultDeliveryConcurrency,
 		},
 		Auth: AuthConfig{
 			EnableAuth: true,
@@ -64,18 +340,76 @@ func LoadConfig(configPath string) (*Config, error) {
 			}
 
 			// Try JSON first
-			if err := json.Unmarshal(data, config); err != nil {
+			isJSON := json.Unmarshal(data, config) == nil
+			if !isJSON {
 				// If JSON fails, try YAML
 				if err := yaml.Unmarshal(data, config); err != nil {
 					return nil, fmt.Errorf("failed to parse config file as JSON or YAML: %w", err)
 				}
 			}
+			// Decrypt before the profile is laid over, so its auth fields apply
+			if err := config.decryptAuth(); err != nil {
+				return nil, fmt.Errorf("failed to decrypt config: %w", err)
+			}
+			if isJSON {
+				if err := config.applyProfile(profile); err != nil {
+					return nil, err
+				}
+			} else if err := config.applyYAMLProfile(data, profile); err != nil {
+				return nil, err
+			}
 		}
 	}
 
+	if profile != "" && config.profile == "" {
+		return nil, fmt.Errorf("unknown config profile %q", profile)
+	}
 	return config, nil
 }
 
+// applyProfile lays a profile of a JSON config over it
+func (c *Config) applyProfile(profile string) error {
+	if profile == "" {
+		return nil
+	}
+	overlay, ok := c.Profiles[profile]
+	if !ok {
+		return fmt.Errorf("unknown config profile %q", profile)
+	}
+	if err := json.Unmarshal(overlay, c); err != nil {
+		return fmt.Errorf("failed to parse config profile %q: %w", profile, err)
+	}
+	c.profile = profile
+	return nil
+}
+
+// applyYAMLProfile lays a profile of a YAML config over it
+func (c *Config) applyYAMLProfile(data []byte, profile string) error {
+	if profile == "" {
+		return nil
+	}
+	var file struct {
+		Profiles map[string]yaml.Node `yaml:"profiles"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse config profiles: %w", err)
+	}
+	overlay, ok := file.Profiles[profile]
+	if !ok {
+		return fmt.Errorf("unknown config profile %q", profile)
+	}
+	if err := overlay.Decode(c); err != nil {
+		return fmt.Errorf("failed to parse config profile %q: %w", profile, err)
+	}
+	c.profile = profile
+	return nil
+}
+
+// Profile returns the name of the profile the config was loaded with, if any
+func (c *Config) Profile() string {
+	return c.profile
+}
+
 // SaveConfig saves configuration to file
 func (c *Config) SaveConfig(configPath string) error {
 	data, err := json.MarshalIndent(c, "", "  ")
@@ -94,14 +428,25 @@ func (c *Config) SaveConfig(configPath string) error {
 func GenerateDefaultConfig(configPath string) error {
 	config := &Config{
 		Server: ServerConfig{
-			Host:        "0.0.0.0",
-			Port:        "9000",
-			TLSEnabled:  false,
-			TLSCertFile: "server.crt",
-			TLSKeyFile:  "server.key",
-			TickSeconds: 60,
-			MaxStored:   100,
-			MaxAge:      time.Hour * 24,
+			Host:                 "0.0.0.0",
+			Port:                 "9000",
+			TLSEnabled:           false,
+			TLSCertFile:          "server.crt",
+			TLSKeyFile:           "server.key",
+			TickSeconds:          60,
+			MaxStored:            100,
+			MaxAge:               time.Hour * 24,
+			BatchSize:            DefaultBatchSize,
+			Durability:           string(DurabilitySync),
+			RequestTimeout:       DefaultRequestTimeout,
+			PoisonThreshold:      DefaultPoisonThreshold,
+			DiskHighWatermark:    DefaultDiskHighWatermark,
+			DiskLowWatermark:     DefaultDiskLowWatermark,
+			MaxInflightBytes:     DefaultMaxInflightBytes,
+			KeepaliveInterval:    DefaultKeepaliveInterval,
+			KeepaliveTimeout:     DefaultKeepaliveTimeout,
+			DuplicateConnections: string(DuplicateReplace),
+			DeliveryConcurrency:  DefaultDeliveryConcurrency,
 		},
 		Auth: AuthConfig{
 			EnableAuth: true,
@@ -231,3 +576,48 @@ func WriteOrUpdateBrokerKeyYAMLWithAutoKey(filePath, name, key string, authConfi
 	}
 	return key, nil
 }
+
+// ProvisionedConnection returns how clients reach the broker, from its first gRPC
+// listener, for provisioned services YAML. A listener without a host is reached on
+// localhost.
+func (c *Config) ProvisionedConnection() provision.Connection {
+	conn := provision.Connection{AuthMethod: "apikey"}
+	if c.Auth.AuthMethod == AuthMethodHMAC {
+		conn.AuthMethod = "hmac"
+	}
+	for _, l := range c.Server.EffectiveListeners() {
+		if l.Kind != ListenerGRPC && l.Kind != ListenerGRPCTLS {
+			continue
+		}
+		host := l.Host
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			host = "localhost"
+		}
+		conn.Address = net.JoinHostPort(host, l.Port)
+		if l.TLSEnabled {
+			conn.TLS = true
+			// A self-signed certificate is its own CA; others are checked against the system roots
+			conn.CAFile = l.TLSCertFile
+		}
+		break
+	}
+	return conn
+}
+
+// WriteProvisionedConnection sets the connection section of a services YAML. All other
+// YAML content is preserved.
+func WriteProvisionedConnection(filePath string, conn provision.Connection) error {
+	var root map[string]interface{}
+	if data, err := os.ReadFile(filePath); err == nil {
+		yaml.Unmarshal(data, &root)
+	}
+	if root == nil {
+		root = make(map[string]interface{})
+	}
+	root["connection"] = conn
+	data, err := yaml.Marshal(root)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filePath, data, 0600)
+}
@@ -0,0 +1,68 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigProfile(t *testing.T) {
+	path := writeConfig(t, "config.json", `{
+		"server": {"port": "9000", "max_age": 3600000000000, "quota": {"daily_messages": 10}},
+		"services": {"billing": {"priority": 1}},
+		"profiles": {
+			"prod": {
+				"server": {"port": "443", "quota": {"daily_messages": 1000}},
+				"services": {"shipping": {"priority": 2}}
+			}
+		}
+	}`)
+
+	base, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if base.Server.Port != "9000" || base.Profile() != "" {
+		t.Fatalf("expected the base config, got port %s and profile %q", base.Server.Port, base.Profile())
+	}
+
+	prod, err := LoadConfigProfile(path, "prod")
+	if err != nil {
+		t.Fatalf("LoadConfigProfile failed: %v", err)
+	}
+	if prod.Profile() != "prod" || prod.Server.Port != "443" || prod.Server.Quota.DailyMessages != 1000 {
+		t.Fatalf("profile not applied: %+v", prod.Server)
+	}
+	// Fields the profile leaves out keep the file's values, maps are merged
+	if prod.Server.MaxAge != time.Hour {
+		t.Fatalf("expected max_age from the file, got %s", prod.Server.MaxAge)
+	}
+	if len(prod.Services) != 2 {
+		t.Fatalf("expected billing and shipping, got %v", prod.Services)
+	}
+
+	if _, err := LoadConfigProfile(path, "staging"); err == nil {
+		t.Fatal("expected an unknown profile to be rejected")
+	}
+}
+
+func TestLoadConfigProfileYAML(t *testing.T) {
+	path := writeConfig(t, "config.yaml", "server:\n  port: \"9000\"\nprofiles:\n  dev:\n    server:\n      port: \"9100\"\n")
+	dev, err := LoadConfigProfile(path, "dev")
+	if err != nil {
+		t.Fatalf("LoadConfigProfile failed: %v", err)
+	}
+	if dev.Server.Port != "9100" {
+		t.Fatalf("expected the dev port, got %s", dev.Server.Port)
+	}
+}
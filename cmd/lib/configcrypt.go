@@ -0,0 +1,234 @@
+package lib
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Environment variables consulted when the auth section is encrypted
+const (
+	EnvMasterKey        = "BROKER_MASTER_KEY"        // base64 encoded 32 byte key
+	EnvMasterKeyFile    = "BROKER_MASTER_KEY_FILE"   // file holding the base64 encoded key
+	EnvConfigPassphrase = "BROKER_CONFIG_PASSPHRASE" // passphrase, stretched with PBKDF2
+)
+
+const (
+	configCipher     = "aes-256-gcm"
+	kdfRaw           = "raw"
+	kdfPBKDF2        = "pbkdf2-sha256"
+	pbkdf2Iterations = 600000
+	configAAD        = "ms-broker/auth"
+)
+
+// EncryptedSection holds an encrypted configuration section
+type EncryptedSection struct {
+	Cipher     string `json:"cipher"`
+	KDF        string `json:"kdf"`
+	Iterations int    `json:"iterations,omitempty"`
+	Salt       string `json:"salt,omitempty"`
+	Nonce      string `json:"nonce"`
+	Data       string `json:"data"`
+}
+
+// ConfigKey is the key material used to seal the auth section
+type ConfigKey struct {
+	key        []byte
+	kdf        string
+	salt       []byte
+	iterations int
+}
+
+// NewMasterKey generates a random base64 encoded master key
+func NewMasterKey() string {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// MasterKey builds a key from a base64 encoded 32 byte master key
+func MasterKey(encoded string) (*ConfigKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid master key: expected 32 bytes, got %d", len(key))
+	}
+	return &ConfigKey{key: key, kdf: kdfRaw}, nil
+}
+
+// PassphraseKey derives a key from a passphrase with a fresh salt
+func PassphraseKey(passphrase string) (*ConfigKey, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return derivePassphraseKey(passphrase, salt, pbkdf2Iterations)
+}
+
+func derivePassphraseKey(passphrase string, salt []byte, iterations int) (*ConfigKey, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("passphrase must not be empty")
+	}
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive key: %w", err)
+	}
+	return &ConfigKey{key: key, kdf: kdfPBKDF2, salt: salt, iterations: iterations}, nil
+}
+
+// keyFromEnv returns the key for a section using the BROKER_MASTER_KEY* or BROKER_CONFIG_PASSPHRASE environment
+func keyFromEnv(section *EncryptedSection) (*ConfigKey, error) {
+	switch section.KDF {
+	case kdfRaw:
+		encoded := os.Getenv(EnvMasterKey)
+		if encoded == "" && os.Getenv(EnvMasterKeyFile) != "" {
+			data, err := os.ReadFile(os.Getenv(EnvMasterKeyFile))
+			if err != nil {
+				return nil, fmt.Errorf("failed to read master key file: %w", err)
+			}
+			encoded = string(data)
+		}
+		if encoded == "" {
+			return nil, fmt.Errorf("auth section is encrypted with a master key, set %s or %s", EnvMasterKey, EnvMasterKeyFile)
+		}
+		return MasterKey(encoded)
+	case kdfPBKDF2:
+		passphrase := os.Getenv(EnvConfigPassphrase)
+		if passphrase == "" {
+			return nil, fmt.Errorf("auth section is encrypted with a passphrase, set %s", EnvConfigPassphrase)
+		}
+		salt, err := base64.StdEncoding.DecodeString(section.Salt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid salt: %w", err)
+		}
+		return derivePassphraseKey(passphrase, salt, section.Iterations)
+	default:
+		return nil, fmt.Errorf("unsupported key derivation %q", section.KDF)
+	}
+}
+
+func (k *ConfigKey) aead() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(k.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (k *ConfigKey) seal(auth AuthConfig) (*EncryptedSection, error) {
+	plain, err := json.Marshal(auth)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal auth section: %w", err)
+	}
+	aead, err := k.aead()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	section := &EncryptedSection{
+		Cipher:     configCipher,
+		KDF:        k.kdf,
+		Iterations: k.iterations,
+		Nonce:      base64.StdEncoding.EncodeToString(nonce),
+		Data:       base64.StdEncoding.EncodeToString(aead.Seal(nil, nonce, plain, []byte(configAAD))),
+	}
+	if k.salt != nil {
+		section.Salt = base64.StdEncoding.EncodeToString(k.salt)
+	}
+	return section, nil
+}
+
+func (k *ConfigKey) open(section *EncryptedSection) (AuthConfig, error) {
+	var auth AuthConfig
+	if section.Cipher != configCipher {
+		return auth, fmt.Errorf("unsupported cipher %q", section.Cipher)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(section.Nonce)
+	if err != nil {
+		return auth, fmt.Errorf("invalid nonce: %w", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(section.Data)
+	if err != nil {
+		return auth, fmt.Errorf("invalid ciphertext: %w", err)
+	}
+	aead, err := k.aead()
+	if err != nil {
+		return auth, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return auth, fmt.Errorf("invalid nonce length %d", len(nonce))
+	}
+	plain, err := aead.Open(nil, nonce, data, []byte(configAAD))
+	if err != nil {
+		return auth, fmt.Errorf("failed to decrypt auth section (wrong key?)")
+	}
+	if err := json.Unmarshal(plain, &auth); err != nil {
+		return auth, fmt.Errorf("failed to parse decrypted auth section: %w", err)
+	}
+	return auth, nil
+}
+
+// EncryptAuth stores the auth section encrypted with key from now on
+func (c *Config) EncryptAuth(key *ConfigKey) {
+	c.authKey = key
+}
+
+// DecryptAuth stores the auth section in plain text from now on
+func (c *Config) DecryptAuth() {
+	c.authKey = nil
+}
+
+// AuthEncrypted reports whether the auth section is stored encrypted
+func (c *Config) AuthEncrypted() bool {
+	return c.authKey != nil
+}
+
+// decryptAuth replaces the auth section with the decrypted EncryptedAuth, remembering the key for SaveConfig
+func (c *Config) decryptAuth() error {
+	if c.EncryptedAuth == nil {
+		return nil
+	}
+	key, err := keyFromEnv(c.EncryptedAuth)
+	if err != nil {
+		return err
+	}
+	auth, err := key.open(c.EncryptedAuth)
+	if err != nil {
+		return err
+	}
+	c.Auth = auth
+	c.EncryptedAuth = nil
+	c.authKey = key
+	return nil
+}
+
+// MarshalJSON writes the auth section encrypted when a key is set
+func (c Config) MarshalJSON() ([]byte, error) {
+	type plainConfig Config
+	if c.authKey == nil {
+		c.EncryptedAuth = nil
+		return json.Marshal(plainConfig(c))
+	}
+	section, err := c.authKey.seal(c.Auth)
+	if err != nil {
+		return nil, err
+	}
+	// The outer Auth shadows the embedded one so the plain text section is left out
+	return json.Marshal(struct {
+		plainConfig
+		Auth          *AuthConfig       `json:"auth,omitempty"`
+		EncryptedAuth *EncryptedSection `json:"encrypted_auth"`
+	}{plainConfig: plainConfig(c), EncryptedAuth: section})
+}
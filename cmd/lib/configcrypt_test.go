@@ -0,0 +1,205 @@
+package lib
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testAuthConfig() AuthConfig {
+	return AuthConfig{
+		JWTSecret:  "jwt-secret-value",
+		APIKeys:    map[string]string{"api-key-value": "billing"},
+		EnableAuth: true,
+		AuthMethod: AuthMethodAPIKey,
+	}
+}
+
+func TestConfigKeySealOpen(t *testing.T) {
+	master, err := MasterKey(NewMasterKey())
+	if err != nil {
+		t.Fatalf("MasterKey failed: %v", err)
+	}
+	passphrase, err := derivePassphraseKey("correct horse", []byte("0123456789abcdef"), 1000)
+	if err != nil {
+		t.Fatalf("derivePassphraseKey failed: %v", err)
+	}
+	for name, key := range map[string]*ConfigKey{"master key": master, "passphrase": passphrase} {
+		section, err := key.seal(testAuthConfig())
+		if err != nil {
+			t.Fatalf("%s: seal failed: %v", name, err)
+		}
+		if strings.Contains(section.Data, "jwt-secret-value") || section.KDF != key.kdf {
+			t.Fatalf("%s: unexpected section %+v", name, section)
+		}
+		auth, err := key.open(section)
+		if err != nil {
+			t.Fatalf("%s: open failed: %v", name, err)
+		}
+		if auth.JWTSecret != "jwt-secret-value" || auth.APIKeys["api-key-value"] != "billing" || auth.AuthMethod != AuthMethodAPIKey {
+			t.Fatalf("%s: round trip mismatch: %+v", name, auth)
+		}
+	}
+}
+
+func TestConfigKeyWrongPassphrase(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	key, err := derivePassphraseKey("correct horse", salt, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	section, err := key.seal(testAuthConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong, err := derivePassphraseKey("battery staple", salt, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrong.open(section); err == nil {
+		t.Fatal("expected a wrong passphrase to fail")
+	}
+	// Tampering is caught by the authentication tag
+	data := []byte(section.Data)
+	data[0] ^= 1
+	section.Data = string(data)
+	if _, err := key.open(section); err == nil {
+		t.Fatal("expected tampered ciphertext to fail")
+	}
+	if _, err := derivePassphraseKey("", salt, 1000); err == nil {
+		t.Fatal("expected an empty passphrase to be rejected")
+	}
+}
+
+func TestSaveConfigEncryptedAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	encoded := NewMasterKey()
+	key, err := MasterKey(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Auth: testAuthConfig()}
+	config.EncryptAuth(key)
+	if err := config.SaveConfig(path); err != nil {
+		t.Fatalf("SaveConfig failed: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"jwt-secret-value", "api-key-value", "JWTSecret", "APIKeys"} {
+		if strings.Contains(string(data), secret) {
+			t.Fatalf("saved config holds %q in plain text:\n%s", secret, data)
+		}
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fields["auth"]; ok {
+		t.Fatalf("saved config has a plain auth section:\n%s", data)
+	}
+	if _, ok := fields["encrypted_auth"]; !ok {
+		t.Fatalf("saved config has no encrypted auth section:\n%s", data)
+	}
+
+	// Loading needs the key, and saving again keeps the section encrypted
+	t.Setenv(EnvMasterKey, "")
+	t.Setenv(EnvMasterKeyFile, "")
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("expected loading without the master key to fail")
+	}
+	t.Setenv(EnvMasterKey, NewMasterKey())
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("expected loading with another master key to fail")
+	}
+	t.Setenv(EnvMasterKey, encoded)
+	loaded, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if !loaded.AuthEncrypted() || loaded.Auth.JWTSecret != "jwt-secret-value" || loaded.Auth.APIKeys["api-key-value"] != "billing" {
+		t.Fatalf("expected the decrypted auth section, got %+v", loaded.Auth)
+	}
+	if err := loaded.SaveConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); strings.Contains(string(data), "jwt-secret-value") {
+		t.Fatalf("saving a loaded config wrote the auth section in plain text:\n%s", data)
+	}
+
+	loaded.DecryptAuth()
+	if err := loaded.SaveConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); !strings.Contains(string(data), "jwt-secret-value") || strings.Contains(string(data), "encrypted_auth") {
+		t.Fatalf("expected a plain auth section after DecryptAuth:\n%s", data)
+	}
+}
+
+func TestLoadConfigPassphrase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	key, err := derivePassphraseKey("correct horse", []byte("0123456789abcdef"), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{Auth: testAuthConfig()}
+	config.EncryptAuth(key)
+	if err := config.SaveConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(EnvConfigPassphrase, "battery staple")
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("expected a wrong passphrase to fail")
+	}
+	t.Setenv(EnvConfigPassphrase, "correct horse")
+	loaded, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if loaded.Auth.JWTSecret != "jwt-secret-value" {
+		t.Fatalf("expected the decrypted auth section, got %+v", loaded.Auth)
+	}
+}
+
+func TestLoadConfigProfileEncryptedAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	encoded := NewMasterKey()
+	key, err := MasterKey(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		Auth: testAuthConfig(),
+		Profiles: map[string]json.RawMessage{
+			"prod": json.RawMessage(`{"server": {"port": "443"}, "auth": {"policy": {"admin_services": ["ops"]}}}`),
+		},
+	}
+	config.EncryptAuth(key)
+	if err := config.SaveConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(EnvMasterKey, encoded)
+
+	// The profile's auth fields are laid over the decrypted section, not dropped
+	prod, err := LoadConfigProfile(path, "prod")
+	if err != nil {
+		t.Fatalf("LoadConfigProfile failed: %v", err)
+	}
+	if prod.Server.Port != "443" || len(prod.Auth.Policy.AdminServices) != 1 || prod.Auth.Policy.AdminServices[0] != "ops" {
+		t.Fatalf("expected the profile's auth policy, got port %s and %+v", prod.Server.Port, prod.Auth.Policy)
+	}
+	if prod.Auth.JWTSecret != "jwt-secret-value" || prod.Auth.APIKeys["api-key-value"] != "billing" {
+		t.Fatalf("expected the encrypted fields the profile leaves out, got %+v", prod.Auth)
+	}
+
+	base, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if len(base.Auth.Policy.AdminServices) != 0 || base.Auth.JWTSecret != "jwt-secret-value" {
+		t.Fatalf("expected the file's auth section without the profile, got %+v", base.Auth)
+	}
+}
@@ -0,0 +1,408 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/ispapp/Microservices-Broker/base/checksum"
+	"github.com/ispapp/Microservices-Broker/base/pb"
+)
+
+// Formats convert rules turn payloads into
+const (
+	ConvertJSON    = "json"    // from XML
+	ConvertXML     = "xml"     // from JSON
+	ConvertMsgPack = "msgpack" // from JSON, the message becomes OTHER with MsgPackContentType
+	ConvertPNG     = "png"     // from JPG
+	ConvertJPG     = "jpg"     // from PNG
+)
+
+// ConvertedHeader is set on converted messages to the type they were sent as
+const ConvertedHeader = "x-broker-converted-from"
+
+// ContentTypeHeader tells consumers the encoding of OTHER payloads
+const ContentTypeHeader = "content-type"
+
+// MsgPackContentType is the content type of payloads converted to MessagePack
+const MsgPackContentType = "application/msgpack"
+
+// xmlRoot is the root element of JSON documents converted to XML
+const xmlRoot = "root"
+
+// conversions maps each format to the payload types it converts from
+var conversions = map[string][]pb.Type{
+	ConvertJSON:    {pb.Type_XML},
+	ConvertXML:     {pb.Type_JSON},
+	ConvertMsgPack: {pb.Type_JSON},
+	ConvertPNG:     {pb.Type_JPG},
+	ConvertJPG:     {pb.Type_PNG},
+}
+
+// checkFormat reports whether format is one convert rules support
+func checkFormat(format string) error {
+	if _, ok := conversions[format]; !ok {
+		return fmt.Errorf("unknown format %q (use 'json', 'xml', 'msgpack', 'png' or 'jpg')", format)
+	}
+	return nil
+}
+
+// convertible reports whether payloads of type t can be converted to format
+func convertible(t pb.Type, format string) bool {
+	return slices.Contains(conversions[format], t)
+}
+
+// convertPayload converts data of type t to format and returns its new type
+func convertPayload(t pb.Type, data []byte, format string) (pb.Type, []byte, error) {
+	switch format {
+	case ConvertXML:
+		out, err := jsonToXML(data)
+		return pb.Type_XML, out, err
+	case ConvertJSON:
+		out, err := xmlToJSON(data)
+		return pb.Type_JSON, out, err
+	case ConvertMsgPack:
+		out, err := jsonToMsgPack(data)
+		return pb.Type_OTHER, out, err
+	case ConvertPNG, ConvertJPG:
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return t, nil, fmt.Errorf("invalid %s image: %w", t, err)
+		}
+		var buf bytes.Buffer
+		if format == ConvertPNG {
+			err = png.Encode(&buf, img)
+			return pb.Type_PNG, buf.Bytes(), err
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpeg.DefaultQuality})
+		return pb.Type_JPG, buf.Bytes(), err
+	}
+	return t, nil, checkFormat(format)
+}
+
+// decodeJSON decodes a single JSON value, keeping numbers as written
+func decodeJSON(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	if decoder.More() {
+		return nil, errors.New("invalid JSON: data after the top-level value")
+	}
+	return value, nil
+}
+
+// jsonToXML writes a JSON document as XML under a root element. Object members
+// become elements in key order, array items repeat the element of their member and
+// null becomes an empty element.
+func jsonToXML(data []byte) ([]byte, error) {
+	value, err := decodeJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buf)
+	if err := encodeXML(encoder, xmlRoot, value); err != nil {
+		return nil, err
+	}
+	if err := encoder.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeXML(encoder *xml.Encoder, name string, value any) error {
+	if items, ok := value.([]any); ok {
+		for _, item := range items {
+			if err := encodeXML(encoder, name, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !validXMLName(name) {
+		return fmt.Errorf("%q is not a valid XML element name", name)
+	}
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if err := encoder.EncodeToken(start); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			if err := encodeXML(encoder, key, v[key]); err != nil {
+				return err
+			}
+		}
+	case nil:
+	default:
+		if err := encoder.EncodeToken(xml.CharData(fmt.Sprint(v))); err != nil {
+			return err
+		}
+	}
+	return encoder.EncodeToken(start.End())
+}
+
+// validXMLName reports whether name can be an element name
+func validXMLName(name string) bool {
+	if name == "" || strings.HasPrefix(strings.ToLower(name), "xml") {
+		return false
+	}
+	for i, r := range name {
+		letter := r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || r > 0x7f
+		if !letter && (i == 0 || !(r == '-' || r == '.' || (r >= '0' && r <= '9'))) {
+			return false
+		}
+	}
+	return true
+}
+
+// xmlNode is an element being read by xmlToJSON
+type xmlNode struct {
+	name    string
+	members map[string]any
+	text    strings.Builder
+}
+
+// xmlToJSON reads an XML document as JSON, the root element being the document.
+// Elements with attributes or children become objects, attributes being "@name"
+// members and the text of such elements "#text"; other elements become strings, and
+// repeated elements arrays.
+func xmlToJSON(data []byte) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var stack []*xmlNode
+	var root any
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid XML: %w", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{name: t.Name.Local, members: make(map[string]any)}
+			for _, attr := range t.Attr {
+				node.add("@"+attr.Name.Local, attr.Value)
+			}
+			stack = append(stack, node)
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		case xml.EndElement:
+			node := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			value := node.value()
+			if len(stack) == 0 {
+				root = value
+				continue
+			}
+			stack[len(stack)-1].add(node.name, value)
+		}
+	}
+	if root == nil {
+		return nil, errors.New("invalid XML: no root element")
+	}
+	return json.Marshal(root)
+}
+
+// add sets a member, turning repeated members into arrays
+func (n *xmlNode) add(name string, value any) {
+	existing, ok := n.members[name]
+	if !ok {
+		n.members[name] = value
+		return
+	}
+	if items, ok := existing.([]any); ok {
+		n.members[name] = append(items, value)
+		return
+	}
+	n.members[name] = []any{existing, value}
+}
+
+// value is the JSON value of a complete element
+func (n *xmlNode) value() any {
+	text := strings.TrimSpace(n.text.String())
+	if len(n.members) == 0 {
+		return text
+	}
+	if text != "" {
+		n.members["#text"] = text
+	}
+	return n.members
+}
+
+// jsonToMsgPack encodes a JSON document as MessagePack. Integers that fit 64 bits are
+// encoded as integers, other numbers as 64-bit floats.
+func jsonToMsgPack(data []byte) ([]byte, error) {
+	value, err := decodeJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := encodeMsgPack(&buf, value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeMsgPack(buf *bytes.Buffer, value any) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			encodeMsgPackInt(buf, i)
+			return nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return fmt.Errorf("invalid number %s", v)
+		}
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+	case string:
+		n := len(v)
+		switch {
+		case n < 32:
+			buf.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			buf.Write([]byte{0xd9, byte(n)})
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xda)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdb)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		buf.WriteString(v)
+	case []any:
+		writeMsgPackHeader(buf, len(v), 0x90, 0xdc)
+		for _, item := range v {
+			if err := encodeMsgPack(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]any:
+		writeMsgPackHeader(buf, len(v), 0x80, 0xde)
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			if err := encodeMsgPack(buf, key); err != nil {
+				return err
+			}
+			if err := encodeMsgPack(buf, v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported value %T", value)
+	}
+	return nil
+}
+
+// writeMsgPackHeader writes the length of an array or a map, fix being the type of
+// short ones and long the 16-bit one, long+1 being the 32-bit one
+func writeMsgPackHeader(buf *bytes.Buffer, n int, fix, long byte) {
+	switch {
+	case n < 16:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(long)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(long + 1)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func encodeMsgPackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= 0x7f:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt8 && i <= math.MaxInt8:
+		buf.Write([]byte{0xd0, byte(int8(i))})
+	case i >= math.MinInt16 && i <= math.MaxInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+// convertMessages applies the first convert rule matching each message routing made,
+// matched against its final recipient. A payload that cannot be converted is sent as
+// it was.
+func (s *Server) convertMessages(out *routed) {
+	for _, m := range out.msgs {
+		for _, rule := range s.router.rules {
+			if rule.Action != RouteConvert || !rule.matches(m) {
+				continue
+			}
+			// A payload failing its checksum is left for send to refuse, rather than
+			// converted under a fresh one
+			if !convertible(m.Type, rule.Format) || checksum.Verify(m) != nil {
+				break
+			}
+			from := m.Type
+			t, data, err := convertPayload(m.Type, m.Data, rule.Format)
+			if err != nil {
+				s.metrics.Inc("broker_conversion_failures_total", "rule", rule.Name)
+				log.Printf("Failed to convert message from %s to %s to %s by rule %s (trace %s): %v", m.From, m.To, rule.Format, rule.Name, m.TraceId, err)
+				break
+			}
+			m.Type, m.Data = t, data
+			if m.Headers == nil {
+				m.Headers = make(map[string]string)
+			}
+			m.Headers[ConvertedHeader] = from.String()
+			if rule.Format == ConvertMsgPack {
+				m.Headers[ContentTypeHeader] = MsgPackContentType
+			}
+			if m.ChecksumType != pb.ChecksumType_NO_CHECKSUM {
+				if err := checksum.Set(m, m.ChecksumType); err != nil {
+					m.Checksum, m.ChecksumType = nil, pb.ChecksumType_NO_CHECKSUM
+				}
+			}
+			out.rules = append(out.rules, rule.Name)
+			s.metrics.Inc("broker_messages_converted_total", "rule", rule.Name, "format", rule.Format)
+			break
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// EnvExportPassphrase encrypts credential exports and decrypts them on import
+const EnvExportPassphrase = "BROKER_EXPORT_PASSPHRASE"
+
+// credentialsVersion is the format version of credential exports
+const credentialsVersion = 1
+
+// Import modes
+const (
+	// ImportMerge adds the imported API keys and keeps the local settings
+	ImportMerge = "merge"
+	// ImportReplace replaces the auth section with the imported one
+	ImportReplace = "replace"
+)
+
+// CredentialsExport is the file written by `auth export`: the auth section, in plain
+// text or encrypted with a passphrase
+type CredentialsExport struct {
+	Version       int               `json:"version"`
+	Exported      time.Time         `json:"exported"`
+	Auth          *AuthConfig       `json:"auth,omitempty"`
+	EncryptedAuth *EncryptedSection `json:"encrypted_auth,omitempty"`
+}
+
+// ExportCredentials returns an export of auth, encrypted when passphrase is set
+func ExportCredentials(auth AuthConfig, passphrase string) ([]byte, error) {
+	export := CredentialsExport{Version: credentialsVersion, Exported: time.Now().UTC()}
+	if passphrase == "" {
+		export.Auth = &auth
+	} else {
+		key, err := PassphraseKey(passphrase)
+		if err != nil {
+			return nil, err
+		}
+		if export.EncryptedAuth, err = key.seal(auth); err != nil {
+			return nil, err
+		}
+	}
+	return json.MarshalIndent(export, "", "  ")
+}
+
+// ReadCredentials parses an export, decrypting it with passphrase when it is encrypted
+func ReadCredentials(data []byte, passphrase string) (AuthConfig, error) {
+	var export CredentialsExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return AuthConfig{}, fmt.Errorf("failed to parse credentials: %w", err)
+	}
+	if export.Version != credentialsVersion {
+		return AuthConfig{}, fmt.Errorf("unsupported credentials version %d", export.Version)
+	}
+	switch {
+	case export.EncryptedAuth != nil:
+		if passphrase == "" {
+			return AuthConfig{}, fmt.Errorf("credentials are encrypted, set %s", EnvExportPassphrase)
+		}
+		if export.EncryptedAuth.KDF != kdfPBKDF2 {
+			return AuthConfig{}, fmt.Errorf("unsupported key derivation %q", export.EncryptedAuth.KDF)
+		}
+		salt, err := base64.StdEncoding.DecodeString(export.EncryptedAuth.Salt)
+		if err != nil {
+			return AuthConfig{}, fmt.Errorf("invalid salt: %w", err)
+		}
+		key, err := derivePassphraseKey(passphrase, salt, export.EncryptedAuth.Iterations)
+		if err != nil {
+			return AuthConfig{}, err
+		}
+		return key.open(export.EncryptedAuth)
+	case export.Auth != nil:
+		return *export.Auth, nil
+	default:
+		return AuthConfig{}, fmt.Errorf("credentials hold no auth section")
+	}
+}
+
+// ImportReport tells what an import changed
+type ImportReport struct {
+	Added     int
+	Unchanged int
+	JWTSecret bool // the JWT secret was taken over
+	Replaced  bool
+}
+
+// ImportCredentials applies imported credentials to the auth section. Merging adds the
+// imported API keys and only takes over the JWT secret when there is none; a key that
+// belongs to another service locally is refused. Replacing takes the imported section as is.
+func (c *Config) ImportCredentials(imported AuthConfig, mode string) (ImportReport, error) {
+	var report ImportReport
+	switch mode {
+	case ImportReplace:
+		if imported.APIKeys == nil {
+			imported.APIKeys = make(map[string]string)
+		}
+		c.Auth = imported
+		report.Added = len(imported.APIKeys)
+		report.JWTSecret = imported.JWTSecret != ""
+		report.Replaced = true
+		return report, nil
+	case "", ImportMerge:
+	default:
+		return report, fmt.Errorf("invalid import mode: %s (use 'merge' or 'replace')", mode)
+	}
+	for key, service := range imported.APIKeys {
+		if local, ok := c.Auth.APIKeys[key]; ok && local != service {
+			return ImportReport{}, fmt.Errorf("an imported API key of service '%s' belongs to '%s' here", service, local)
+		}
+	}
+	if c.Auth.APIKeys == nil {
+		c.Auth.APIKeys = make(map[string]string)
+	}
+	for key, service := range imported.APIKeys {
+		if _, ok := c.Auth.APIKeys[key]; ok {
+			report.Unchanged++
+			continue
+		}
+		c.Auth.APIKeys[key] = service
+		if info, ok := imported.KeyInfo[key]; ok {
+			c.Auth.SetKeyInfo(key, *info)
+		}
+		if policy, ok := imported.KeyNetworks[key]; ok {
+			if c.Auth.KeyNetworks == nil {
+				c.Auth.KeyNetworks = make(map[string]*NetworkPolicy)
+			}
+			c.Auth.KeyNetworks[key] = policy
+		}
+		if policy, ok := imported.Policy.Keys[key]; ok {
+			if c.Auth.Policy.Keys == nil {
+				c.Auth.Policy.Keys = make(map[string]*MethodPolicy)
+			}
+			c.Auth.Policy.Keys[key] = policy
+		}
+		report.Added++
+	}
+	if c.Auth.JWTSecret == "" && imported.JWTSecret != "" {
+		c.Auth.JWTSecret = imported.JWTSecret
+		report.JWTSecret = true
+	}
+	return report, nil
+}
@@ -0,0 +1,153 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultRequestTimeout bounds unary RPC handling when not configured
+const DefaultRequestTimeout = 30 * time.Second
+
+// WithTimeouts bounds unary RPC handling and the lifetime of Receive streams. Zero disables a bound.
+func WithTimeouts(request, streamLifetime time.Duration) ServerOption {
+	return func(s *Server) {
+		s.requestTimeout = request
+		s.streamLifetime = streamLifetime
+	}
+}
+
+// callWithTimeout runs call under the request timeout. Handlers honor the deadline of
+// their context, while waiting for the broker lock and for storage too, so the call
+// is not abandoned: it returns once the handler has stopped.
+func (s *Server) callWithTimeout(ctx context.Context, call func(context.Context) (any, error)) (any, error) {
+	if s.requestTimeout <= 0 {
+		return call(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.requestTimeout)
+	defer cancel()
+	resp, err := call(ctx)
+	if err == nil || ctx.Err() == nil {
+		return resp, err
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		s.metrics.Inc("broker_deadline_exceeded_total", "kind", "request")
+		return nil, status.Errorf(codes.DeadlineExceeded, "request not handled within %s", s.requestTimeout)
+	}
+	return nil, status.FromContextError(ctx.Err()).Err()
+}
+
+// errStorageStuck fails writes fast while an earlier one has not returned
+var errStorageStuck = errors.New("storage is not responding")
+
+// storageGuard tracks a write that outlived the call that made it
+type storageGuard struct {
+	stuck atomic.Bool
+}
+
+// write runs op, a storage write, until ctx ends. A write still running then is left
+// to finish in the background and the caller gets the context error, so a hung store
+// pins neither the handler nor the broker lock; writes fail fast with
+// errStorageStuck until it returns.
+func (s *Server) write(ctx context.Context, op func() error) error {
+	if s.storage.stuck.Load() {
+		s.metrics.Inc("broker_storage_rejections_total")
+		return errStorageStuck
+	}
+	if ctx.Done() == nil {
+		return op()
+	}
+	done := make(chan error, 1)
+	go func() { done <- op() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	s.storage.stuck.Store(true)
+	s.metrics.Inc("broker_storage_stalls_total")
+	log.Printf("Storage write still running when its call ended, failing writes until it returns")
+	go func() {
+		err := <-done
+		s.storage.stuck.Store(false)
+		log.Printf("Stalled storage write returned (%v), accepting writes again", err)
+	}()
+	return status.FromContextError(ctx.Err()).Err()
+}
+
+// contextMutex is a mutex whose waiters give up when their context ends. The zero
+// value is unlocked.
+type contextMutex struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func (m *contextMutex) init() {
+	m.once.Do(func() { m.ch = make(chan struct{}, 1) })
+}
+
+// Lock waits for the mutex
+func (m *contextMutex) Lock() {
+	m.init()
+	m.ch <- struct{}{}
+}
+
+// LockContext waits for the mutex until ctx ends
+func (m *contextMutex) LockContext(ctx context.Context) error {
+	m.init()
+	select {
+	case m.ch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+// TryLock takes the mutex if it is free
+func (m *contextMutex) TryLock() bool {
+	m.init()
+	select {
+	case m.ch <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Unlock releases the mutex
+func (m *contextMutex) Unlock() {
+	<-m.ch
+}
+
+// DeadlineUnaryInterceptor enforces the request timeout on unary RPCs
+func (s *Server) DeadlineUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return s.callWithTimeout(ctx, func(ctx context.Context) (any, error) {
+			return handler(ctx, req)
+		})
+	}
+}
+
+// DeadlineStreamInterceptor ends streams that outlive the configured lifetime with DEADLINE_EXCEEDED
+func (s *Server) DeadlineStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if s.streamLifetime <= 0 {
+			return handler(srv, ss)
+		}
+		ctx, cancel := context.WithTimeout(ss.Context(), s.streamLifetime)
+		defer cancel()
+		err := handler(srv, &wrappedStream{ServerStream: ss, ctx: ctx})
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) && ss.Context().Err() == nil {
+			s.metrics.Inc("broker_deadline_exceeded_total", "kind", "stream")
+			return status.Errorf(codes.DeadlineExceeded, "stream lifetime of %s exceeded, reconnect to continue", s.streamLifetime)
+		}
+		return err
+	}
+}
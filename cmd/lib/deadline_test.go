@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestHungStorageReleasesTheLock(t *testing.T) {
+	s := &Server{metrics: NewMetrics(), requestTimeout: 50 * time.Millisecond}
+	// A store whose writes hang until released
+	release := make(chan struct{})
+	hung := func() error {
+		<-release
+		return nil
+	}
+
+	start := time.Now()
+	_, err := s.callWithTimeout(context.Background(), func(ctx context.Context) (any, error) {
+		if err := s.mu.LockContext(ctx); err != nil {
+			return nil, err
+		}
+		defer s.mu.Unlock()
+		return nil, s.write(ctx, hung)
+	})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("expected DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("call returned after %s", elapsed)
+	}
+	if !s.mu.TryLock() {
+		t.Fatalf("broker lock still held by the hung write")
+	}
+	s.mu.Unlock()
+
+	// Writes fail fast while the hung one has not returned
+	err = s.write(context.Background(), func() error {
+		t.Fatalf("write ran while storage is stuck")
+		return nil
+	})
+	if !errors.Is(err, errStorageStuck) || errorCode(err) != codes.Unavailable {
+		t.Fatalf("expected errStorageStuck, got %v", err)
+	}
+
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for s.storage.stuck.Load() {
+		if time.Now().After(deadline) {
+			t.Fatalf("storage still stuck after the write returned")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := s.write(context.Background(), func() error { return nil }); err != nil {
+		t.Fatalf("write after recovery failed: %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Log levels of the broker log, from the most verbose. Failures and lifecycle events
+// (connections, pauses, alerts...) are logged at every level.
+const (
+	LogLevelDebug = "debug" // info, plus every call with its caller, status and duration
+	LogLevelInfo  = "info"  // the default: a line per message received, sent or queued
+	LogLevelWarn  = "warn"  // no line per message, for busy brokers
+)
+
+// logLevels are the levels in the order of their values, the zero value being info
+var logLevels = []string{LogLevelDebug, LogLevelInfo, LogLevelWarn}
+
+// Log level values stored by the server
+const (
+	logDebug int32 = iota - 1
+	logInfo
+	logWarn
+)
+
+// Debug toggle bounds
+const (
+	// MaxPayloadLogging bounds how long the payloads of a service are logged, so a
+	// forgotten toggle does not keep copying message data into the log
+	MaxPayloadLogging = 24 * time.Hour
+	// maxLoggedPayload is the number of payload bytes logged per message
+	maxLoggedPayload = 1024
+)
+
+// parseLogLevel returns the value of a log level name
+func parseLogLevel(name string) (int32, error) {
+	i := slices.Index(logLevels, name)
+	if i < 0 {
+		return 0, fmt.Errorf("unknown log level %q (use %s)", name, strings.Join(logLevels, ", "))
+	}
+	return int32(i) + logDebug, nil
+}
+
+// checkLogLevel validates server.log_level, where empty means info
+func checkLogLevel(name string) error {
+	if name == "" {
+		return nil
+	}
+	_, err := parseLogLevel(name)
+	return err
+}
+
+// WithLogLevel sets the initial log level ("" keeps info)
+func WithLogLevel(name string) ServerOption {
+	return func(s *Server) {
+		if level, err := parseLogLevel(name); err == nil {
+			s.logLevel.Store(level)
+		}
+	}
+}
+
+// WithSlowLogThreshold logs the calls slower than threshold (0 = none)
+func WithSlowLogThreshold(threshold time.Duration) ServerOption {
+	return func(s *Server) {
+		s.slowThreshold.Store(int64(threshold))
+	}
+}
+
+// LogLevel returns the name of the current log level
+func (s *Server) LogLevel() string {
+	return logLevels[s.logLevel.Load()-logDebug]
+}
+
+// infof logs a line per message, unless the log level is above info
+func (s *Server) infof(format string, args ...any) {
+	if s.logLevel.Load() <= logInfo {
+		log.Printf(format, args...)
+	}
+}
+
+// SetLogLevel changes the log level until the next change or restart
+func (s *Server) SetLogLevel(ctx context.Context, req *pb.LogLevelRequest) (*pb.Status, error) {
+	level, err := parseLogLevel(req.Level)
+	if err != nil {
+		return invalidRequest(err.Error())
+	}
+	if err := contextError(ctx); err != nil {
+		return serverError(err)
+	}
+	if previous := s.logLevel.Swap(level); previous != level {
+		log.Printf("Log level changed from %s to %s by %s", logLevels[previous-logDebug], req.Level, caller(ctx))
+	}
+	return &pb.Status{Message: "Log level is " + req.Level, Success: true, Error: pb.Error_NONE}, nil
+}
+
+// SetSlowLogging logs the unary calls slower than the threshold of req, or stops
+// logging them when it is zero
+func (s *Server) SetSlowLogging(ctx context.Context, req *pb.SlowLoggingRequest) (*pb.Status, error) {
+	threshold := req.Threshold.AsDuration()
+	if threshold < 0 {
+		return invalidRequest("threshold must not be negative")
+	}
+	if err := contextError(ctx); err != nil {
+		return serverError(err)
+	}
+	s.slowThreshold.Store(int64(threshold))
+	if threshold == 0 {
+		log.Printf("Slow call logging disabled by %s", caller(ctx))
+		return &pb.Status{Message: "Slow calls are not logged", Success: true, Error: pb.Error_NONE}, nil
+	}
+	log.Printf("Slow call logging enabled above %s by %s", threshold, caller(ctx))
+	return &pb.Status{Message: "Calls slower than " + threshold.String() + " are logged", Success: true, Error: pb.Error_NONE}, nil
+}
+
+// payloadLogging holds the services whose payloads are logged, with when logging stops
+type payloadLogging struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+	// count of the services, checked without the lock on every message
+	count atomic.Int32
+}
+
+func (p *payloadLogging) set(service string, until time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.until == nil {
+		p.until = make(map[string]time.Time)
+	}
+	p.until[service] = until
+	p.count.Store(int32(len(p.until)))
+}
+
+// clear stops logging the payloads of service and reports whether they were logged
+func (p *payloadLogging) clear(service string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.until[service]
+	delete(p.until, service)
+	p.count.Store(int32(len(p.until)))
+	return ok
+}
+
+// active reports whether the payloads of any of services are logged at now, dropping
+// the services whose logging expired
+func (p *payloadLogging) active(now time.Time, services ...string) bool {
+	if p.count.Load() == 0 {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	found := false
+	for _, service := range services {
+		until, ok := p.until[service]
+		if !ok {
+			continue
+		}
+		if now.After(until) {
+			delete(p.until, service)
+			log.Printf("Payload logging of %s expired", service)
+			continue
+		}
+		found = true
+	}
+	p.count.Store(int32(len(p.until)))
+	return found
+}
+
+// SetPayloadLogging logs the payloads of the messages sent by or to a service for the
+// duration of req, at most MaxPayloadLogging, or stops logging them when it is zero.
+// Payloads are redacted like the messages of taps, and cut after 1KiB.
+func (s *Server) SetPayloadLogging(ctx context.Context, req *pb.PayloadLoggingRequest) (*pb.Status, error) {
+	if req.Service == "" {
+		return invalidRequest("missing service name")
+	}
+	duration := req.Duration.AsDuration()
+	if duration < 0 || duration > MaxPayloadLogging {
+		return invalidRequest(fmt.Sprintf("duration must be between 0 and %s", MaxPayloadLogging))
+	}
+	if err := contextError(ctx); err != nil {
+		return serverError(err)
+	}
+	if duration == 0 {
+		if s.payloadLogs.clear(req.Service) {
+			log.Printf("Payload logging of %s stopped by %s", req.Service, caller(ctx))
+		}
+		return &pb.Status{Message: "Payloads of " + req.Service + " are not logged", Success: true, Error: pb.Error_NONE}, nil
+	}
+	s.payloadLogs.set(req.Service, time.Now().Add(duration))
+	log.Printf("Payload logging of %s enabled for %s by %s", req.Service, duration, caller(ctx))
+	return &pb.Status{Message: "Payloads of " + req.Service + " are logged for " + duration.String(), Success: true, Error: pb.Error_NONE}, nil
+}
+
+// logPayload logs the redacted payload of msg when the payloads of its sender or
+// recipient are logged
+func (s *Server) logPayload(msg *pb.Message) {
+	to, _ := protocol.SplitAddress(msg.To)
+	if !s.payloadLogs.active(time.Now(), msg.From, to) {
+		return
+	}
+	data := s.redacted(msg).Data
+	cut := ""
+	if len(data) > maxLoggedPayload {
+		data, cut = data[:maxLoggedPayload], "..."
+	}
+	log.Printf("Payload of message from %s to %s (%s, %d bytes, trace %s): %q%s", msg.From, msg.To, msg.Type, len(msg.Data), msg.TraceId, data, cut)
+}
+
+// DebugUnaryInterceptor logs unary calls at the debug log level, and those slower
+// than the slow call threshold. It always runs, innermost, after the configured
+// pipeline.
+func (s *Server) DebugUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		elapsed := time.Since(start)
+		method := path.Base(info.FullMethod)
+		if threshold := time.Duration(s.slowThreshold.Load()); threshold > 0 && elapsed >= threshold {
+			s.metrics.Inc("broker_slow_calls_total", "method", method)
+			log.Printf("Slow call %s from %s: %s in %s (threshold %s)", method, caller(ctx), status.Code(err), elapsed.Round(time.Microsecond), threshold)
+		} else if s.logLevel.Load() <= logDebug {
+			log.Printf("%s from %s: %s in %s", method, caller(ctx), status.Code(err), elapsed.Round(time.Microsecond))
+		}
+		return resp, err
+	}
+}
+
+// DebugStreamInterceptor logs streams at the debug log level. Streams last as long as
+// their clients want, so they are never slow calls.
+func (s *Server) DebugStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if s.logLevel.Load() > logDebug {
+			return handler(srv, ss)
+		}
+		start := time.Now()
+		log.Printf("%s stream from %s opened", path.Base(info.FullMethod), caller(ss.Context()))
+		err := handler(srv, ss)
+		log.Printf("%s stream from %s: %s after %s", path.Base(info.FullMethod), caller(ss.Context()), status.Code(err), time.Since(start).Round(time.Millisecond))
+		return err
+	}
+}
@@ -0,0 +1,175 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"go.mills.io/bitcask/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// recordingStream is a Receive stream keeping what the broker sends
+type recordingStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	sent []*pb.Message
+}
+
+func (r *recordingStream) Send(msg *pb.Message) error {
+	r.sent = append(r.sent, msg)
+	return nil
+}
+
+func (r *recordingStream) Context() context.Context {
+	return r.ctx
+}
+
+// newDeliveryServer opens a broker on dir whose cron does not run during the test
+func newDeliveryServer(t *testing.T, dir string, opts ...ServerOption) *Server {
+	t.Helper()
+	s, err := NewServer(dir, 3600, 0, time.Hour, opts...)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// queueN queues n messages for billing whose payloads are their index
+func queueN(t *testing.T, s *Server, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		msg := &pb.Message{From: "orders", To: "billing", Data: []byte(fmt.Sprint(i))}
+		if err := s.storeMessage(context.Background(), "billing", msg); err != nil {
+			t.Fatalf("storeMessage failed: %v", err)
+		}
+	}
+}
+
+// deliverBatch runs one delivery pass of batch messages and returns their payloads
+func deliverBatch(t *testing.T, s *Server, batch int) []string {
+	t.Helper()
+	stream := &recordingStream{ctx: context.Background()}
+	if err := s.getMessages(&pb.Identity{From: "billing"}, stream, batch, time.Minute); err != nil {
+		t.Fatalf("getMessages failed: %v", err)
+	}
+	payloads := make([]string, len(stream.sent))
+	for i, msg := range stream.sent {
+		payloads[i] = string(msg.Data)
+	}
+	return payloads
+}
+
+// expectPayloads checks got holds the payloads from, from+1, ... up to to excluded
+func expectPayloads(t *testing.T, got []string, from, to int) {
+	t.Helper()
+	if len(got) != to-from {
+		t.Fatalf("expected messages %d to %d, got %v", from, to-1, got)
+	}
+	for i, payload := range got {
+		if payload != fmt.Sprint(from+i) {
+			t.Fatalf("expected messages %d to %d in order, got %v", from, to-1, got)
+		}
+	}
+}
+
+func TestDeliveryBatchesKeepOrder(t *testing.T) {
+	s := newDeliveryServer(t, t.TempDir())
+	queueN(t, s, 7)
+
+	expectPayloads(t, deliverBatch(t, s, 3), 0, 3)
+	if !s.db.Has(cursorKey("billing")) {
+		t.Fatalf("expected a cursor after a full batch")
+	}
+	expectPayloads(t, deliverBatch(t, s, 3), 3, 6)
+	expectPayloads(t, deliverBatch(t, s, 3), 6, 7)
+	if got := deliverBatch(t, s, 3); len(got) != 0 {
+		t.Fatalf("expected nothing left, got %v", got)
+	}
+	// A pass finding nothing after the cursor resets it to rescan from the start
+	if s.db.Has(cursorKey("billing")) {
+		t.Fatalf("expected the cursor to be reset at the end of the backlog")
+	}
+}
+
+func TestDeliveryBatchOfExactlyN(t *testing.T) {
+	s := newDeliveryServer(t, t.TempDir())
+	queueN(t, s, 4)
+
+	expectPayloads(t, deliverBatch(t, s, 4), 0, 4)
+	// The next pass starts after the cursor, finds nothing and resets it
+	if got := deliverBatch(t, s, 4); len(got) != 0 {
+		t.Fatalf("expected no redelivery, got %v", got)
+	}
+	if s.db.Has(cursorKey("billing")) {
+		t.Fatalf("expected the cursor to be reset once the backlog is drained")
+	}
+	queueN(t, s, 1)
+	expectPayloads(t, deliverBatch(t, s, 4), 0, 1)
+}
+
+func TestDeliveryResumesFromCursor(t *testing.T) {
+	dir := t.TempDir()
+	s := newDeliveryServer(t, dir)
+	queueN(t, s, 5)
+	var keys []bitcask.Key
+	if err := s.db.Scan(messagePrefix("billing"), bitcask.KeyFunc(func(key bitcask.Key) error {
+		keys = append(keys, append(bitcask.Key(nil), key...))
+		return nil
+	})); err != nil || len(keys) != 5 {
+		t.Fatalf("expected 5 queued keys, got %d (%v)", len(keys), err)
+	}
+	// A pass that stopped after the second message
+	if err := s.saveCursor("billing", keys[1]); err != nil {
+		t.Fatalf("saveCursor failed: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// A restarted broker picks up after the cursor, and the messages before it once
+	// the scan wraps around
+	s = newDeliveryServer(t, dir)
+	expectPayloads(t, deliverBatch(t, s, 2), 2, 4)
+	expectPayloads(t, deliverBatch(t, s, 2), 4, 5)
+	if got := deliverBatch(t, s, 2); len(got) != 0 {
+		t.Fatalf("expected the scan to end at the backlog's end, got %v", got)
+	}
+	expectPayloads(t, deliverBatch(t, s, 2), 0, 2)
+}
+
+func TestDeliveryQuarantinesCorruptRecords(t *testing.T) {
+	s := newDeliveryServer(t, t.TempDir())
+	queueN(t, s, 3)
+	var keys []bitcask.Key
+	if err := s.db.Scan(messagePrefix("billing"), bitcask.KeyFunc(func(key bitcask.Key) error {
+		keys = append(keys, append(bitcask.Key(nil), key...))
+		return nil
+	})); err != nil || len(keys) != 3 {
+		t.Fatalf("expected 3 queued keys, got %d (%v)", len(keys), err)
+	}
+	// An envelope whose payload is not a protobuf message
+	corrupt := append(appendHeader(nil, timestamppb.Now()), 0xff, 0xff, 0xff)
+	if err := s.db.Put(keys[1], corrupt); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// The messages around it are still delivered, in order
+	if got := deliverBatch(t, s, 10); len(got) != 2 || got[0] != "0" || got[1] != "2" {
+		t.Fatalf("expected messages 0 and 2, got %v", got)
+	}
+	if n := s.QuarantinedCount(); n != 1 {
+		t.Fatalf("expected 1 quarantined record, got %d", n)
+	}
+	if s.db.Has(keys[1]) {
+		t.Fatalf("corrupt record left in the queue")
+	}
+	if kept, err := s.db.Get(quarantineKey(keys[1])); err != nil || string(kept) != string(corrupt) {
+		t.Fatalf("expected the original bytes under the quarantine prefix, got %q (%v)", kept, err)
+	}
+}
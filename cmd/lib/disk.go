@@ -0,0 +1,133 @@
+package lib
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Default disk watermarks, as fractions of the filesystem holding the database
+const (
+	DefaultDiskHighWatermark = 0.95
+	DefaultDiskLowWatermark  = 0.90
+)
+
+// diskCheckInterval is how often disk usage is sampled
+const diskCheckInterval = 5 * time.Second
+
+// errDiskFull rejects queueing while disk usage is above the high watermark
+var errDiskFull = errors.New("disk usage above high watermark, queueing is paused")
+
+// diskState is the last disk usage sample
+type diskState struct {
+	mu        sync.Mutex
+	usedRatio float64
+	dbSize    int64
+	full      bool
+}
+
+// WithDiskWatermarks rejects queueing new messages once the filesystem holding the
+// database is more than high full (0 = no limit) or the database reaches maxDBSize
+// bytes (0 = no limit). Queueing resumes once usage drops below low and maxDBSize.
+func WithDiskWatermarks(high, low float64, maxDBSize int64) ServerOption {
+	return func(s *Server) {
+		s.diskHigh = high
+		s.diskLow = low
+		if low <= 0 || low > high {
+			s.diskLow = high
+		}
+		s.maxDBSize = maxDBSize
+	}
+}
+
+// diskLimited reports whether admission control is configured
+func (s *Server) diskLimited() bool {
+	return s.diskHigh > 0 || s.maxDBSize > 0
+}
+
+// startDiskMonitor samples disk usage until the server closes
+func (s *Server) startDiskMonitor() {
+	ticker := time.NewTicker(diskCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.checkDisk()
+		}
+	}
+}
+
+// checkDisk samples the database size and filesystem usage and updates admission control
+func (s *Server) checkDisk() {
+	dbSize, err := dirSize(s.dbPath)
+	if err != nil {
+		log.Printf("Failed to measure database size: %v", err)
+		return
+	}
+	usedRatio := 0.0
+	if total, free, err := s.diskProbe(s.dbPath); err != nil {
+		if s.diskHigh > 0 {
+			log.Printf("Failed to read disk usage: %v", err)
+		}
+	} else if total > 0 {
+		usedRatio = 1 - float64(free)/float64(total)
+	}
+
+	s.disk.mu.Lock()
+	defer s.disk.mu.Unlock()
+	s.disk.usedRatio = usedRatio
+	s.disk.dbSize = dbSize
+	wasFull := s.disk.full
+	if wasFull {
+		s.disk.full = (s.diskHigh > 0 && usedRatio >= s.diskLow) || (s.maxDBSize > 0 && dbSize >= s.maxDBSize)
+	} else {
+		s.disk.full = (s.diskHigh > 0 && usedRatio >= s.diskHigh) || (s.maxDBSize > 0 && dbSize >= s.maxDBSize)
+	}
+	switch {
+	case s.disk.full && !wasFull:
+		s.metrics.Inc("broker_disk_admission_blocked_total")
+		log.Printf("Disk usage %.1f%% (database %d bytes) above the high watermark, rejecting new queued messages", usedRatio*100, dbSize)
+	case !s.disk.full && wasFull:
+		log.Printf("Disk usage %.1f%% (database %d bytes) back below the low watermark, queueing resumed", usedRatio*100, dbSize)
+	}
+}
+
+// diskFull reports whether queueing is currently rejected
+func (s *Server) diskFull() bool {
+	s.disk.mu.Lock()
+	defer s.disk.mu.Unlock()
+	return s.disk.full
+}
+
+// diskSample returns the last sampled filesystem usage ratio and database size
+func (s *Server) diskSample() (usedRatio float64, dbSize int64) {
+	s.disk.mu.Lock()
+	defer s.disk.mu.Unlock()
+	return s.disk.usedRatio, s.disk.dbSize
+}
+
+// dirSize returns the total size of the regular files below path
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Datafiles may be merged away while walking
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size, err
+}
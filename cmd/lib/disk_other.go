@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package lib
+
+import "errors"
+
+// diskUsage is not implemented on this platform; only max_db_size is enforced
+func diskUsage(path string) (total, free uint64, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
@@ -0,0 +1,44 @@
+package lib
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDiskWatermarks(t *testing.T) {
+	s := newDeliveryServer(t, t.TempDir(), WithDiskWatermarks(0.9, 0.8, 0))
+	// A filesystem of 100 bytes with used of them taken
+	var used uint64
+	s.diskProbe = func(string) (uint64, uint64, error) {
+		return 100, 100 - used, nil
+	}
+	send := func() error {
+		_, err := s.Send(context.Background(), &pb.Message{From: "orders", To: "billing", Data: []byte("x"), Queue: true})
+		return err
+	}
+
+	used = 95
+	s.checkDisk()
+	if err := send(); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted above the high watermark, got %v", err)
+	}
+	// Between the watermarks queueing stays paused
+	used = 85
+	s.checkDisk()
+	if err := send(); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted above the low watermark, got %v", err)
+	}
+	used = 70
+	s.checkDisk()
+	if err := send(); err != nil {
+		t.Fatalf("Send below the low watermark failed: %v", err)
+	}
+	if n := s.metrics.Counter("broker_disk_admission_blocked_total"); n != 1 {
+		t.Fatalf("expected queueing to be paused once, got %d", n)
+	}
+}
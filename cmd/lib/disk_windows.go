@@ -0,0 +1,16 @@
+package lib
+
+import "golang.org/x/sys/windows"
+
+// diskUsage returns the total and available bytes of the volume holding path
+func diskUsage(path string) (total, free uint64, err error) {
+	dir, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	var available, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(dir, &available, &total, &totalFree); err != nil {
+		return 0, 0, err
+	}
+	return total, available, nil
+}
@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Durability controls when stored messages are fsynced to disk
+type Durability string
+
+const (
+	// DurabilitySync fsyncs after every write (safest, slowest)
+	DurabilitySync Durability = "sync"
+	// DurabilityGroup fsyncs pending writes every SyncInterval
+	DurabilityGroup Durability = "group"
+	// DurabilityAsync never fsyncs explicitly and leaves flushing to the OS
+	DurabilityAsync Durability = "async"
+)
+
+// DefaultSyncInterval is the group-commit interval when not configured
+const DefaultSyncInterval = 50 * time.Millisecond
+
+// ParseDurability validates a durability mode name
+func ParseDurability(mode string) (Durability, error) {
+	switch Durability(mode) {
+	case "", DurabilitySync:
+		return DurabilitySync, nil
+	case DurabilityGroup, DurabilityAsync:
+		return Durability(mode), nil
+	default:
+		return "", fmt.Errorf("invalid durability mode: %s (use 'sync', 'group' or 'async')", mode)
+	}
+}
+
+// WithDurability sets the fsync policy for stored messages
+func WithDurability(mode Durability, interval time.Duration) ServerOption {
+	return func(s *Server) {
+		s.durability = mode
+		if interval > 0 {
+			s.syncInterval = interval
+		}
+	}
+}
+
+// syncer tracks unsynced writes for group commit
+type syncer struct {
+	dirty atomic.Bool
+}
+
+// commit applies the durability policy after one or more writes
+func (s *Server) commit() error {
+	switch s.durability {
+	case DurabilityGroup:
+		s.sync.dirty.Store(true)
+		return nil
+	case DurabilityAsync:
+		return nil
+	default:
+		return s.db.Sync()
+	}
+}
+
+// startGroupCommit periodically flushes pending writes in group-commit mode
+func (s *Server) startGroupCommit() {
+	ticker := time.NewTicker(s.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if s.sync.dirty.Swap(false) {
+				if err := s.db.Sync(); err != nil {
+					log.Printf("Group commit sync failed: %v", err)
+				}
+			}
+		}
+	}
+}
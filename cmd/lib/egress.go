@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+)
+
+// EgressConfig declares which services may send to which destinations. Once Allow
+// lists any sender, a send is refused unless its destination matches one of the
+// patterns of a sender pattern matching its sender, or of "*".
+type EgressConfig struct {
+	// Allow maps a sending service or name pattern ("*" for every service) to the
+	// destinations it may send to, as name patterns such as "billing", "billing-*" or
+	// "payments.>"
+	Allow map[string][]string `json:"allow,omitempty"`
+}
+
+// check validates the patterns of the matrix
+func (c EgressConfig) check() error {
+	for from, destinations := range c.Allow {
+		if from == "" {
+			return fmt.Errorf("empty sender")
+		}
+		if err := protocol.CheckPattern(from); err != nil {
+			return fmt.Errorf("sender: %w", err)
+		}
+		for _, pattern := range destinations {
+			if err := protocol.CheckPattern(pattern); err != nil {
+				return fmt.Errorf("%s: %w", from, err)
+			}
+		}
+	}
+	return nil
+}
+
+// permits reports whether from may send to the service to. A wildcard address is
+// only permitted by a pattern that covers all of it.
+func (c EgressConfig) permits(from, to string) bool {
+	for sender, destinations := range c.Allow {
+		if sender != "*" && !protocol.MatchName(sender, from) {
+			continue
+		}
+		for _, pattern := range destinations {
+			if protocol.MatchName(pattern, to) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// WithEgress refuses sends to destinations the matrix does not allow their sender
+func WithEgress(config EgressConfig) ServerOption {
+	return func(s *Server) {
+		if len(config.Allow) > 0 {
+			s.egress = &config
+		}
+	}
+}
+
+// checkEgress refuses msgs when one of them, or a service on its routing slip, is
+// not allowed to its sender. Calls forwarded by another shard and federated messages
+// were checked by the broker that took them.
+func (s *Server) checkEgress(ctx context.Context, msgs []*pb.Message) (*pb.Status, error) {
+	if s.egress == nil {
+		return nil, nil
+	}
+	for _, msg := range msgs {
+		if s.checkedUpstream(ctx, msg) {
+			continue
+		}
+		from := sender(ctx, msg)
+		for _, address := range append([]string{msg.To}, msg.RoutingSlip...) {
+			to, _ := protocol.SplitAddress(address)
+			if s.egress.permits(from, to) {
+				continue
+			}
+			s.metrics.Inc("broker_egress_denied_total", "from", from, "to", to)
+			detail := fmt.Sprintf("'%s' may not send to '%s'", from, to)
+			log.Printf("Egress denied: %s (trace %s)", detail, msg.TraceId)
+			s.emit(pb.BrokerEventType_BROKER_EVENT_TYPE_EGRESS_DENIED, to, "", msg, detail)
+			return permissionDenied(detail)
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,225 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/client"
+
+	"google.golang.org/grpc/codes"
+)
+
+// What happens to a message when its enrichment fails
+const (
+	EnrichContinue = "continue" // send the message without the headers (default)
+	EnrichReject   = "reject"   // refuse the send, which the client may retry
+)
+
+// Enrichment defaults
+const (
+	DefaultEnrichTimeout          = 2 * time.Second
+	DefaultEnrichFailureThreshold = 5
+	DefaultEnrichOpenTimeout      = 30 * time.Second
+	// maxEnrichResponse caps the answers read from enrichment endpoints
+	maxEnrichResponse = 1 << 20
+)
+
+// Enrichment calls an HTTP endpoint with the metadata of the messages it matches and
+// merges the headers it answers into them, before the routing rules are evaluated. The
+// match fields are those of routing rules.
+type Enrichment struct {
+	Name    string            `json:"name"`
+	From    string            `json:"from,omitempty"`
+	To      string            `json:"to,omitempty"`
+	Type    string            `json:"type,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// URL receives a POST of the message metadata as JSON
+	URL string `json:"url"`
+	// Timeout bounds each call (default 2s)
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// OnError is "continue" (default) or "reject"
+	OnError string `json:"on_error,omitempty"`
+	// FailureThreshold failures in a row open the circuit breaker of the endpoint
+	// (default 5), which is not called for OpenTimeout (default 30s)
+	FailureThreshold int           `json:"failure_threshold,omitempty"`
+	OpenTimeout      time.Duration `json:"open_timeout,omitempty"`
+}
+
+// enrichRequest is the body posted to enrichment endpoints
+type enrichRequest struct {
+	From    string            `json:"from"`
+	To      string            `json:"to"`
+	Type    string            `json:"type"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Size    int               `json:"size"`
+	TraceID string            `json:"trace_id,omitempty"`
+}
+
+// enrichResponse is what enrichment endpoints answer. An empty header value removes
+// the header.
+type enrichResponse struct {
+	Headers map[string]string `json:"headers"`
+}
+
+// enricher is an enrichment with its HTTP client and circuit breaker
+type enricher struct {
+	Enrichment
+	client  *http.Client
+	breaker *client.CircuitBreaker
+}
+
+func (e Enrichment) check() error {
+	if e.Name == "" {
+		return errors.New("name is required")
+	}
+	if err := (RoutingRule{From: e.From, To: e.To, Type: e.Type, Action: RouteDrop}).check(); err != nil {
+		return err
+	}
+	u, err := url.Parse(e.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %q", e.URL)
+	}
+	if e.Timeout < 0 || e.OpenTimeout < 0 || e.FailureThreshold < 0 {
+		return errors.New("timeout, failure_threshold and open_timeout must not be negative")
+	}
+	switch e.OnError {
+	case "", EnrichContinue, EnrichReject:
+	default:
+		return fmt.Errorf("unknown on_error %q (use 'continue' or 'reject')", e.OnError)
+	}
+	return nil
+}
+
+// newEnricher sets up the client and breaker of a checked enrichment
+func newEnricher(e Enrichment) *enricher {
+	if e.Timeout == 0 {
+		e.Timeout = DefaultEnrichTimeout
+	}
+	if e.FailureThreshold == 0 {
+		e.FailureThreshold = DefaultEnrichFailureThreshold
+	}
+	if e.OpenTimeout == 0 {
+		e.OpenTimeout = DefaultEnrichOpenTimeout
+	}
+	return &enricher{
+		Enrichment: e,
+		client:     &http.Client{Timeout: e.Timeout},
+		breaker: client.NewCircuitBreaker(client.BreakerConfig{
+			FailureThreshold: e.FailureThreshold,
+			OpenTimeout:      e.OpenTimeout,
+			IsFailure:        func(error) bool { return true },
+			OnStateChange: func(from, to client.BreakerState) {
+				log.Printf("Circuit breaker of enrichment %s is %s", e.Name, to)
+			},
+		}),
+	}
+}
+
+// matches reports whether msg satisfies every match field of the enrichment
+func (e *enricher) matches(msg *pb.Message) bool {
+	return RoutingRule{From: e.From, To: e.To, Type: e.Type, Headers: e.Enrichment.Headers}.matches(msg)
+}
+
+// call posts the metadata of msg to the endpoint through the breaker and returns the
+// headers it answered
+func (e *enricher) call(ctx context.Context, msg *pb.Message) (map[string]string, error) {
+	generation, err := e.breaker.Allow()
+	if err != nil {
+		return nil, err
+	}
+	headers, err := e.post(ctx, msg)
+	e.breaker.Record(generation, err)
+	return headers, err
+}
+
+func (e *enricher) post(ctx context.Context, msg *pb.Message) (map[string]string, error) {
+	data, err := json.Marshal(enrichRequest{
+		From:    msg.From,
+		To:      msg.To,
+		Type:    msg.Type.String(),
+		Headers: msg.Headers,
+		Size:    len(msg.Data),
+		TraceID: msg.TraceId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The call is bounded by the enrichment, not by the deadline of the sender
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), e.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	var answer enrichResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxEnrichResponse)).Decode(&answer); err != nil {
+		return nil, fmt.Errorf("invalid answer: %w", err)
+	}
+	return answer.Headers, nil
+}
+
+// enrich calls the enrichments matching msgs and merges the headers they answer. An
+// enrichment with the reject policy that fails refuses the call. Calls forwarded by
+// another shard and federated messages were enriched by the broker that took them,
+// quarantined messages are not.
+func (s *Server) enrich(ctx context.Context, msgs []*pb.Message) (*pb.Status, error) {
+	if len(s.router.enrichers) == 0 {
+		return nil, nil
+	}
+	for _, msg := range msgs {
+		if s.checkedUpstream(ctx, msg) || s.quarantined(msg) {
+			continue
+		}
+		for _, e := range s.router.enrichers {
+			if !e.matches(msg) {
+				continue
+			}
+			headers, err := e.call(ctx, msg)
+			if err != nil {
+				outcome := "failed"
+				if errors.Is(err, client.ErrCircuitOpen) {
+					outcome = "open"
+				}
+				s.metrics.Inc("broker_enrichments_total", "enrichment", e.Name, "outcome", outcome)
+				log.Printf("Enrichment %s of message from %s to %s failed (trace %s): %v", e.Name, msg.From, msg.To, msg.TraceId, err)
+				if e.OnError == EnrichReject {
+					return failure(codes.Unavailable, &pb.Status{Message: "Enrichment " + e.Name + " failed: " + err.Error(), Success: false, Error: pb.Error_SERVER_ERROR})
+				}
+				continue
+			}
+			s.metrics.Inc("broker_enrichments_total", "enrichment", e.Name, "outcome", "ok")
+			for key, value := range headers {
+				if value == "" {
+					delete(msg.Headers, key)
+					continue
+				}
+				if msg.Headers == nil {
+					msg.Headers = make(map[string]string)
+				}
+				msg.Headers[key] = value
+			}
+		}
+	}
+	return nil, nil
+}
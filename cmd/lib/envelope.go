@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Stored values are wrapped in a small envelope:
+//
+//	[magic 0x00][version][8 byte enqueue time, unix nanos][protobuf wire bytes]
+//
+// The header lets sweeps check expiry without decoding the payload. A protobuf
+// message never starts with 0x00 (field number 0 is invalid), so records written
+// before the envelope existed are still decoded as plain protobuf.
+const (
+	envelopeMagic      byte = 0x00
+	envelopeVersion    byte = 0x01
+	envelopeHeaderSize      = 10
+	// maxPooledBuffer keeps huge payload buffers from being pinned by the pool
+	maxPooledBuffer = 1 << 20
+)
+
+var bufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
+}
+
+// getBuffer returns an empty buffer from the pool
+func getBuffer() *[]byte {
+	b := bufferPool.Get().(*[]byte)
+	*b = (*b)[:0]
+	return b
+}
+
+// putBuffer returns a buffer to the pool
+func putBuffer(b *[]byte) {
+	if cap(*b) > maxPooledBuffer {
+		return
+	}
+	bufferPool.Put(b)
+}
+
+// encodeEnvelope appends the envelope for msg to buf
+func encodeEnvelope(buf []byte, msg *pb.Message) ([]byte, error) {
+	return proto.MarshalOptions{}.MarshalAppend(appendHeader(buf, msg.Seq), msg)
+}
+
+// appendHeader appends the envelope header of a value enqueued at seq
+func appendHeader(buf []byte, seq *timestamppb.Timestamp) []byte {
+	buf = append(buf, envelopeMagic, envelopeVersion)
+	return binary.BigEndian.AppendUint64(buf, uint64(seq.AsTime().UnixNano()))
+}
+
+// isEnvelope reports whether a stored value carries the envelope header
+func isEnvelope(value []byte) bool {
+	return len(value) >= envelopeHeaderSize && value[0] == envelopeMagic
+}
+
+// storedTime returns the enqueue time of a stored value, decoding only legacy records
+func storedTime(value []byte) (time.Time, error) {
+	if isEnvelope(value) {
+		if value[1] != envelopeVersion {
+			return time.Time{}, fmt.Errorf("unsupported envelope version %d", value[1])
+		}
+		return time.Unix(0, int64(binary.BigEndian.Uint64(value[2:envelopeHeaderSize]))), nil
+	}
+	var msg pb.Message
+	if err := proto.Unmarshal(value, &msg); err != nil {
+		return time.Time{}, err
+	}
+	return msg.Seq.AsTime(), nil
+}
+
+// decodeStored decodes a stored value into msg. Values stored as received keep the
+// queue flag the sender set, which is not part of the stored form.
+func decodeStored(value []byte, msg *pb.Message) error {
+	if isEnvelope(value) {
+		if value[1] != envelopeVersion {
+			return fmt.Errorf("unsupported envelope version %d", value[1])
+		}
+		value = value[envelopeHeaderSize:]
+	}
+	if err := proto.Unmarshal(value, msg); err != nil {
+		return err
+	}
+	msg.Queue = false
+	return nil
+}
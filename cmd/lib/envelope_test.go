@@ -0,0 +1,82 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	enqueued := time.Date(2024, 5, 1, 12, 30, 0, 123456789, time.UTC)
+	msg := &pb.Message{
+		Data:    []byte(`{"order":42}`),
+		Type:    pb.Type_JSON,
+		From:    "orders",
+		To:      "billing",
+		Event:   pb.Event_MESSAGE,
+		Seq:     timestamppb.New(enqueued),
+		Headers: map[string]string{"tenant": "acme"},
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	value, err := encodeEnvelope(*buf, msg)
+	if err != nil {
+		t.Fatalf("encodeEnvelope failed: %v", err)
+	}
+	if !isEnvelope(value) || value[1] != envelopeVersion {
+		t.Fatalf("expected an envelope header, got % x", value[:min(len(value), envelopeHeaderSize)])
+	}
+	at, err := storedTime(value)
+	if err != nil || !at.Equal(enqueued) {
+		t.Fatalf("expected enqueue time %v, got %v (%v)", enqueued, at, err)
+	}
+	var got pb.Message
+	if err := decodeStored(value, &got); err != nil {
+		t.Fatalf("decodeStored failed: %v", err)
+	}
+	if !proto.Equal(msg, &got) {
+		t.Fatalf("round trip mismatch: %v != %v", msg, &got)
+	}
+}
+
+func TestEnvelopeReadsLegacyValues(t *testing.T) {
+	// Values written before the envelope are plain protobuf messages
+	enqueued := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+	msg := &pb.Message{Data: []byte("legacy"), From: "orders", To: "billing", Seq: timestamppb.New(enqueued)}
+	value, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if isEnvelope(value) {
+		t.Fatalf("legacy value %q taken for an envelope", value)
+	}
+	at, err := storedTime(value)
+	if err != nil || !at.Equal(enqueued) {
+		t.Fatalf("expected enqueue time %v, got %v (%v)", enqueued, at, err)
+	}
+	var got pb.Message
+	if err := decodeStored(value, &got); err != nil {
+		t.Fatalf("decodeStored failed: %v", err)
+	}
+	if !proto.Equal(msg, &got) {
+		t.Fatalf("legacy decode mismatch: %v != %v", msg, &got)
+	}
+}
+
+func TestEnvelopeUnknownVersion(t *testing.T) {
+	value, err := encodeEnvelope(nil, &pb.Message{Data: []byte("x"), Seq: timestamppb.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	value[1] = envelopeVersion + 1
+	if _, err := storedTime(value); err == nil {
+		t.Fatalf("expected an unsupported version to be rejected by storedTime")
+	}
+	if err := decodeStored(value, &pb.Message{}); err == nil {
+		t.Fatalf("expected an unsupported version to be rejected by decodeStored")
+	}
+}
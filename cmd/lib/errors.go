@@ -0,0 +1,65 @@
+package lib
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/ispapp/Microservices-Broker/base/checksum"
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// failure returns st together with a gRPC error of the given code carrying st as a detail,
+// so clients can branch on the code and still read the broker's message
+func failure(code codes.Code, st *pb.Status) (*pb.Status, error) {
+	s, err := status.New(code, st.Message).WithDetails(st)
+	if err != nil {
+		return st, status.Error(code, st.Message)
+	}
+	return st, s.Err()
+}
+
+// invalidRequest reports a malformed request
+func invalidRequest(message string) (*pb.Status, error) {
+	return failure(codes.InvalidArgument, &pb.Status{Message: message, Success: false, Error: pb.Error_INVALID_REQUEST})
+}
+
+// permissionDenied reports a call acting for a service its credentials do not belong to
+func permissionDenied(message string) (*pb.Status, error) {
+	return failure(codes.PermissionDenied, &pb.Status{Message: message, Success: false, Error: pb.Error_PERMISSION_DENIED})
+}
+
+// readOnly rejects a write while the broker is in read-only mode. Clients may retry once it is lifted.
+func readOnly() (*pb.Status, error) {
+	return failure(codes.Unavailable, &pb.Status{Message: "Broker is read-only, sends are rejected", Success: false, Error: pb.Error_READ_ONLY})
+}
+
+// checksumFailed rejects a message whose data does not match its checksum
+func checksumFailed(err error) (*pb.Status, error) {
+	if !errors.Is(err, checksum.ErrMismatch) {
+		return invalidRequest(err.Error())
+	}
+	return failure(codes.DataLoss, &pb.Status{Message: err.Error(), Success: false, Error: pb.Error_CHECKSUM_MISMATCH})
+}
+
+// serverError reports err with the code that best describes it
+func serverError(err error) (*pb.Status, error) {
+	return failure(errorCode(err), &pb.Status{Message: err.Error(), Success: false, Error: pb.Error_SERVER_ERROR})
+}
+
+// errorCode maps storage and context errors to gRPC codes
+func errorCode(err error) codes.Code {
+	if s, ok := status.FromError(err); ok {
+		return s.Code()
+	}
+	switch {
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT), errors.Is(err, errDiskFull):
+		return codes.ResourceExhausted
+	case errors.Is(err, errServerClosed), errors.Is(err, errStorageStuck):
+		return codes.Unavailable
+	default:
+		return codes.Internal
+	}
+}
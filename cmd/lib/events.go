@@ -0,0 +1,132 @@
+package lib
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// eventBuffer is the number of events a slow watcher may fall behind before events are dropped
+const eventBuffer = 1024
+
+// eventHub fans broker lifecycle events out to WatchEvents streams. Publishing never
+// blocks: events for a watcher whose buffer is full are dropped.
+type eventHub struct {
+	mu       sync.RWMutex
+	watchers map[*eventWatcher]struct{}
+	count    atomic.Int32
+}
+
+// eventWatcher is one WatchEvents subscription
+type eventWatcher struct {
+	events   chan *pb.BrokerEvent
+	services map[string]bool
+	types    map[pb.BrokerEventType]bool
+}
+
+// matches reports whether the watcher's filter selects ev
+func (w *eventWatcher) matches(ev *pb.BrokerEvent) bool {
+	return (len(w.services) == 0 || w.services[ev.Service]) && (len(w.types) == 0 || w.types[ev.Type])
+}
+
+// subscribe registers a watcher for the events selected by req
+func (h *eventHub) subscribe(req *pb.WatchEventsRequest) *eventWatcher {
+	w := &eventWatcher{
+		events:   make(chan *pb.BrokerEvent, eventBuffer),
+		services: make(map[string]bool, len(req.Services)),
+		types:    make(map[pb.BrokerEventType]bool, len(req.Types)),
+	}
+	for _, service := range req.Services {
+		w.services[service] = true
+	}
+	for _, t := range req.Types {
+		w.types[t] = true
+	}
+	h.mu.Lock()
+	if h.watchers == nil {
+		h.watchers = make(map[*eventWatcher]struct{})
+	}
+	h.watchers[w] = struct{}{}
+	h.mu.Unlock()
+	h.count.Add(1)
+	return w
+}
+
+// unsubscribe removes a watcher
+func (h *eventHub) unsubscribe(w *eventWatcher) {
+	h.mu.Lock()
+	delete(h.watchers, w)
+	h.mu.Unlock()
+	h.count.Add(-1)
+}
+
+// publish sends ev to every matching watcher and returns the number of watchers that missed it
+func (h *eventHub) publish(ev *pb.BrokerEvent) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	dropped := 0
+	for w := range h.watchers {
+		if !w.matches(ev) {
+			continue
+		}
+		select {
+		case w.events <- ev:
+		default:
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// emit publishes a lifecycle event about msg, if anyone is watching
+func (s *Server) emit(eventType pb.BrokerEventType, service, id string, msg *pb.Message, detail string) {
+	if s.events.count.Load() == 0 {
+		return
+	}
+	ev := &pb.BrokerEvent{
+		Type:      eventType,
+		Time:      timestamppb.Now(),
+		Service:   service,
+		MessageId: id,
+		Detail:    detail,
+	}
+	if msg != nil {
+		ev.TraceId = msg.TraceId
+		ev.From = msg.From
+		ev.To = msg.To
+		ev.Attempts = msg.Attempts
+	}
+	if dropped := s.events.publish(ev); dropped > 0 {
+		s.metrics.Add("broker_events_dropped_total", int64(dropped))
+	}
+}
+
+// WatchEvents streams broker lifecycle events until the client goes away. Events are
+// not persisted: a watcher only sees events that happen while it is connected, and
+// loses events if it falls more than 1024 behind.
+func (s *Server) WatchEvents(req *pb.WatchEventsRequest, stream pb.Broker_WatchEventsServer) error {
+	w := s.events.subscribe(req)
+	defer s.events.unsubscribe(w)
+	// Headers tell the client the subscription is in place
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+	ctx := stream.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.done:
+			return status.Error(codes.Unavailable, errServerClosed.Error())
+		case ev := <-w.events:
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
+		}
+	}
+}
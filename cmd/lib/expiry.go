@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"go.mills.io/bitcask/v2"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// WithExpiryNotifications returns expired queued messages to their sender as EXPIRED events
+func WithExpiryNotifications(enabled bool) ServerOption {
+	return func(s *Server) {
+		s.notifyExpired = enabled
+	}
+}
+
+// expire deletes an expired record, first queueing an EXPIRED notice for the sender when enabled
+func (s *Server) expire(key bitcask.Key, value []byte) error {
+	var msg pb.Message
+	decoded := decodeStored(value, &msg) == nil
+	if s.notifyExpired && decoded {
+		if err := s.notifyExpiry(&msg); err != nil {
+			return err
+		}
+	}
+	if err := s.db.Delete(key); err != nil {
+		return err
+	}
+	s.deliveries.take(string(key))
+	s.metrics.Inc("broker_messages_expired_total")
+	service, _ := keyService(key)
+	s.emit(pb.BrokerEventType_BROKER_EVENT_TYPE_EXPIRED, service, string(key), &msg, "")
+	s.infof("Deleted expired message %s (trace %s)", key, msg.TraceId)
+	return nil
+}
+
+// notifyExpiry queues the expired message for its sender. The notice keeps the
+// original payload, Seq and trace id so producers can correlate and compensate.
+func (s *Server) notifyExpiry(msg *pb.Message) error {
+	// Notices that expire themselves are dropped so they never bounce back and forth,
+	// and the sender does not hear about shadow copies
+	if msg.Event == pb.Event_EXPIRED || msg.From == "" || msg.Mirrored {
+		return nil
+	}
+	notice := &pb.Message{
+		Data:    msg.Data,
+		Type:    msg.Type,
+		Seq:     msg.Seq,
+		From:    msg.To,
+		To:      msg.From,
+		Event:   pb.Event_EXPIRED,
+		TraceId: msg.TraceId,
+	}
+	buf := getBuffer()
+	defer putBuffer(buf)
+	// The notice keeps the original Seq but ages from now, or it would expire at once
+	encoded, err := proto.MarshalOptions{}.MarshalAppend(appendHeader(*buf, timestamppb.Now()), notice)
+	if err != nil {
+		return err
+	}
+	*buf = encoded
+	if err := s.db.Put(messageKey(msg.From), encoded); err != nil {
+		return err
+	}
+	if err := s.commit(); err != nil {
+		return err
+	}
+	s.metrics.Inc("broker_expiry_notifications_total")
+	return nil
+}
@@ -0,0 +1,362 @@
+package lib
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// FederationOutboxPrefix starts the queues holding messages for linked brokers. Consumers
+// cannot receive from them.
+const FederationOutboxPrefix = "~federation/"
+
+// MaxFederationHops is the longest chain of brokers a message may be forwarded through
+const MaxFederationHops = 8
+
+// federationRetryDelay is how long a message the remote broker could not take waits before it is sent again
+const federationRetryDelay = 5 * time.Second
+
+// federationPollInterval is how often a connected link scans its outbox
+const federationPollInterval = time.Second
+
+// federationMaxBackoff caps the delay between attempts to reconnect a link
+const federationMaxBackoff = 30 * time.Second
+
+// FederationOutbox returns the queue holding messages waiting to cross a link
+func FederationOutbox(link string) string {
+	return FederationOutboxPrefix + link
+}
+
+// federation holds this broker's links to brokers in other datacenters
+type federation struct {
+	name     string
+	links    []FederationLink
+	homes    map[string]string // service -> link
+	peers    map[string]bool
+	dialOpts []grpc.DialOption
+	mu       sync.Mutex
+	up       map[string]bool
+}
+
+// WithFederation names this broker and links it to remote brokers. Messages for the
+// services of a link are stored in its outbox and forwarded while the link is up;
+// peers restricts which authenticated services may forward messages here. opts are
+// added to the dial options of every link.
+func WithFederation(name string, links []FederationLink, peers []string, opts ...grpc.DialOption) ServerOption {
+	return func(s *Server) {
+		f := &federation{name: name, links: links, homes: make(map[string]string), peers: make(map[string]bool), dialOpts: opts, up: make(map[string]bool)}
+		for _, link := range links {
+			for _, service := range link.Services {
+				f.homes[service] = link.Name
+			}
+		}
+		for _, peer := range peers {
+			f.peers[peer] = true
+		}
+		s.federation = f
+	}
+}
+
+// ServerOption returns the option federating this broker, which does nothing when no
+// name is configured
+func (c FederationConfig) ServerOption() ServerOption {
+	if c.Name == "" {
+		return func(*Server) {}
+	}
+	return WithFederation(c.Name, c.Links, c.Peers)
+}
+
+// homeLink returns the link to the broker a service is homed on, if it is a remote one
+func (s *Server) homeLink(address string) (string, bool) {
+	if s.federation == nil {
+		return "", false
+	}
+	service, _ := protocol.SplitAddress(address)
+	link, ok := s.federation.homes[service]
+	return link, ok
+}
+
+// queueFor returns the queue a message for address is stored in: the outbox of the
+// link to its home broker, or its own
+func (s *Server) queueFor(address string) string {
+	if link, ok := s.homeLink(address); ok {
+		return FederationOutbox(link)
+	}
+	return address
+}
+
+// linkUp records whether a link is connected
+func (f *federation) linkUp(link string, up bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.up[link] = up
+}
+
+// linksUp returns the number of connected links
+func (f *federation) linksUp() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, up := range f.up {
+		if up {
+			n++
+		}
+	}
+	return n
+}
+
+// startFederation runs a worker per link until the server closes
+func (s *Server) startFederation() {
+	for _, link := range s.federation.links {
+		go s.runLink(link)
+	}
+}
+
+// runLink keeps a link connected, backing off while the remote broker is unreachable.
+// The outbox keeps filling meanwhile and drains once the link is back.
+func (s *Server) runLink(link FederationLink) {
+	backoff := time.Second
+	for {
+		connected, err := s.pumpLink(link)
+		s.federation.linkUp(link.Name, false)
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		if connected {
+			backoff = time.Second
+		}
+		log.Printf("Federation link %s to %s down, retrying in %s: %v", link.Name, link.Address, backoff, err)
+		select {
+		case <-s.done:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, federationMaxBackoff)
+	}
+}
+
+// linkDialOptions returns the options connecting to a link's broker
+func (f *federation) linkDialOptions(link FederationLink) ([]grpc.DialOption, error) {
+	creds := insecure.NewCredentials()
+	if link.TLSEnabled {
+		creds = credentials.NewTLS(&tls.Config{})
+		if link.TLSCAFile != "" {
+			var err error
+			if creds, err = credentials.NewClientTLSFromFile(link.TLSCAFile, ""); err != nil {
+				return nil, fmt.Errorf("failed to load CA of link %s: %w", link.Name, err)
+			}
+		}
+	}
+	return append([]grpc.DialOption{grpc.WithTransportCredentials(creds)}, f.dialOpts...), nil
+}
+
+// linkContext adds a link's credentials to ctx
+func linkContext(ctx context.Context, link FederationLink) context.Context {
+	switch {
+	case link.Credential == "":
+		return ctx
+	case link.AuthMethod == "jwt":
+		return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+link.Credential)
+	default:
+		return metadata.AppendToOutgoingContext(ctx, "x-api-key", link.Credential)
+	}
+}
+
+// pumpLink forwards the outbox of a link over one Federate stream until it breaks.
+// Messages stay in the outbox, invisible, until the remote broker acknowledges them, so
+// delivery across the link is at least once.
+func (s *Server) pumpLink(link FederationLink) (connected bool, err error) {
+	opts, err := s.federation.linkDialOptions(link)
+	if err != nil {
+		return false, err
+	}
+	conn, err := grpc.NewClient(link.Address, opts...)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	stream, err := pb.NewBrokerClient(conn).Federate(linkContext(ctx, link))
+	if err != nil {
+		return false, err
+	}
+	// The header arrives once the remote broker accepted the stream
+	if _, err := stream.Header(); err != nil {
+		return false, err
+	}
+	s.federation.linkUp(link.Name, true)
+	log.Printf("Federation link %s connected to %s", link.Name, link.Address)
+	broken := make(chan error, 1)
+	go func() {
+		for {
+			ack, err := stream.Recv()
+			if err != nil {
+				broken <- err
+				return
+			}
+			s.settleFederated(link.Name, ack)
+		}
+	}()
+	outbox := &pb.Identity{From: FederationOutbox(link.Name), ManualAck: true}
+	out := &linkStream{ctx: ctx, stream: stream, self: s.federation.name}
+	for {
+		if err := s.GetMessages(outbox, out); err != nil {
+			return true, err
+		}
+		select {
+		case err := <-broken:
+			if errors.Is(err, io.EOF) {
+				err = errors.New("stream closed by the remote broker")
+			}
+			return true, err
+		case <-ctx.Done():
+			return true, ctx.Err()
+		case <-time.After(federationPollInterval):
+		}
+	}
+}
+
+// linkStream hands the messages of an outbox to a Federate stream, recording this
+// broker in their hop list. Only the methods GetMessages uses are implemented.
+type linkStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	stream pb.Broker_FederateClient
+	self   string
+}
+
+func (l *linkStream) Context() context.Context { return l.ctx }
+
+func (l *linkStream) Send(msg *pb.Message) error {
+	msg.Via = append(msg.Via, l.self)
+	return l.stream.Send(msg)
+}
+
+// settleFederated acknowledges, retries or dead-letters an outbox message the remote
+// broker answered for
+func (s *Server) settleFederated(link string, ack *pb.FederationAck) {
+	outbox := FederationOutbox(link)
+	st := ack.GetStatus()
+	switch {
+	case st.GetSuccess():
+		if _, err := s.ack(context.Background(), &pb.AckRequest{From: outbox, Id: ack.Id}, false); err != nil {
+			log.Printf("Failed to acknowledge forwarded message %s: %v", ack.Id, err)
+			return
+		}
+		s.metrics.Inc("broker_federation_forwarded_total", "link", link)
+	case st.GetError() == pb.Error_SERVER_ERROR || st.GetError() == pb.Error_READ_ONLY || st.GetError() == pb.Error_QUOTA_EXCEEDED:
+		s.metrics.Inc("broker_federation_retries_total", "link", link)
+		if _, err := s.nack(&pb.NackRequest{From: outbox, Id: ack.Id}, federationRetryDelay); err != nil {
+			log.Printf("Failed to requeue forwarded message %s: %v", ack.Id, err)
+		}
+	default:
+		// The remote broker will never take it, e.g. because it already went through there
+		key, msg, _, err := s.ownedMessage(outbox, ack.Id)
+		if err != nil {
+			log.Printf("Failed to dead-letter forwarded message %s: %v", ack.Id, err)
+			return
+		}
+		s.metrics.Inc("broker_federation_rejected_total", "link", link)
+		log.Printf("Link %s rejected message %s: %s", link, ack.Id, st.GetMessage())
+		if err := s.deadLetter(key, msg, outbox); err != nil {
+			log.Printf("Failed to dead-letter forwarded message %s: %v", ack.Id, err)
+		}
+	}
+}
+
+// Federate accepts messages forwarded by a linked broker and answers each with the
+// status of handing it to its recipient. Accepted messages are always queued.
+func (s *Server) Federate(stream pb.Broker_FederateServer) error {
+	if s.federation == nil {
+		return status.Error(codes.FailedPrecondition, "federation is not enabled on this broker")
+	}
+	ctx := context.WithValue(stream.Context(), federatedCtxKey{}, true)
+	if peer := GetServiceNameFromContext(ctx); len(s.federation.peers) > 0 && !s.federation.peers[peer] {
+		return status.Errorf(codes.PermissionDenied, "%q is not a federation peer", peer)
+	}
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+	for {
+		msg, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// acceptFederated clears the id, the sender's outbox key
+		id := msg.Id
+		if err := stream.Send(&pb.FederationAck{Id: id, Status: s.acceptFederated(ctx, msg)}); err != nil {
+			return err
+		}
+	}
+}
+
+// federatedCtxKey marks the context of messages taken from a linked broker
+type federatedCtxKey struct{}
+
+// relayed reports whether the call in ctx relays messages a linked broker federated
+// or another shard forwarded
+func (s *Server) relayed(ctx context.Context) bool {
+	federated, _ := ctx.Value(federatedCtxKey{}).(bool)
+	return federated || s.forwardedByShard(ctx)
+}
+
+// clearHops drops the hop list of msgs unless a linked broker federated them or
+// another shard forwarded them: a client setting it would skip the checks of the
+// broker that took them
+func (s *Server) clearHops(ctx context.Context, msgs []*pb.Message) {
+	if s.relayed(ctx) {
+		return
+	}
+	for _, msg := range msgs {
+		msg.Via = nil
+	}
+}
+
+// acceptFederated queues a forwarded message unless it is looping between brokers
+func (s *Server) acceptFederated(ctx context.Context, msg *pb.Message) *pb.Status {
+	if slices.Contains(msg.Via, s.federation.name) || len(msg.Via) > MaxFederationHops {
+		s.metrics.Inc("broker_federation_loops_total")
+		return &pb.Status{Message: "federation loop: " + strings.Join(msg.Via, " -> "), Success: false, Error: pb.Error_INVALID_REQUEST}
+	}
+	msg.Id = ""
+	msg.Attempts = 0
+	msg.Queue = true
+	st, err := s.Send(ctx, msg)
+	if err == nil {
+		return st
+	}
+	if detail := statusDetail(err); detail != nil {
+		return detail
+	}
+	return &pb.Status{Message: err.Error(), Success: false, Error: pb.Error_SERVER_ERROR}
+}
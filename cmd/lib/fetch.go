@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	"google.golang.org/grpc"
+)
+
+// Fetch limits
+const (
+	// MaxFetchMessages caps the messages returned by a single Fetch
+	MaxFetchMessages = 1000
+	// MaxFetchWait caps how long a long-polling Fetch is held, below the default request timeout
+	MaxFetchWait = 20 * time.Second
+)
+
+// fetchPollInterval is how often a waiting Fetch looks for messages that became visible
+// without being queued, e.g. after a Nack delay
+const fetchPollInterval = time.Second
+
+// queueWaiters wakes long-polling Fetch calls and delivery loops when a message is
+// queued for their service
+type queueWaiters struct {
+	mu      sync.Mutex
+	waiting map[string]chan struct{}
+}
+
+// wait returns a channel that is closed the next time a message is queued for service
+func (w *queueWaiters) wait(service string) <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.waiting == nil {
+		w.waiting = make(map[string]chan struct{})
+	}
+	ch, ok := w.waiting[service]
+	if !ok {
+		ch = make(chan struct{})
+		w.waiting[service] = ch
+	}
+	return ch
+}
+
+// notify wakes everyone waiting for the service of address
+func (w *queueWaiters) notify(address string) {
+	service, _ := protocol.SplitAddress(address)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if ch, ok := w.waiting[service]; ok {
+		close(ch)
+		delete(w.waiting, service)
+	}
+}
+
+// fetchStream collects the messages GetMessages delivers for a Fetch call
+type fetchStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	messages []*pb.Message
+}
+
+func (f *fetchStream) Context() context.Context { return f.ctx }
+
+func (f *fetchStream) Send(msg *pb.Message) error {
+	f.messages = append(f.messages, msg)
+	return nil
+}
+
+// Fetch returns up to req.MaxMessages visible messages of a service for consumers that
+// poll instead of holding a Receive stream. Like messages received in manual-ack mode,
+// they stay invisible for the visibility timeout and are redelivered unless acked.
+// With req.WaitSeconds an empty fetch is held until a message arrives or the wait ends.
+func (s *Server) Fetch(ctx context.Context, req *pb.FetchRequest) (*pb.FetchResponse, error) {
+	if err := contextError(ctx); err != nil {
+		_, err := serverError(err)
+		return nil, err
+	}
+	from, _, err := actingService(ctx, req.From)
+	if err != nil {
+		return nil, err
+	}
+	req.From = from
+	if req.From == "" {
+		_, err := invalidRequest("missing service name")
+		return nil, err
+	}
+	if req.MaxMessages > MaxFetchMessages {
+		_, err := invalidRequest(fmt.Sprintf("max_messages must not exceed %d", MaxFetchMessages))
+		return nil, err
+	}
+	wait := time.Duration(req.WaitSeconds) * time.Second
+	if wait > MaxFetchWait {
+		_, err := invalidRequest(fmt.Sprintf("wait_seconds must not exceed %d", int(MaxFetchWait.Seconds())))
+		return nil, err
+	}
+	visibility := req.VisibilityTimeout.AsDuration()
+	if visibility < 0 {
+		_, err := invalidRequest("visibility timeout must not be negative")
+		return nil, err
+	}
+	var fetched *pb.FetchResponse
+	if remote, _, err := s.routeRemote(ctx, req.From, func(ctx context.Context, c pb.BrokerClient) (*pb.Status, error) {
+		var err error
+		fetched, err = c.Fetch(ctx, req)
+		return nil, err
+	}); remote {
+		return fetched, err
+	}
+
+	if visibility == 0 {
+		visibility = s.ackTimeout
+	}
+	limit := int(req.MaxMessages)
+	if limit == 0 {
+		limit = s.batchSizeFor(req.From)
+	}
+	identities := []*pb.Identity{{From: req.From, ManualAck: true}}
+	if req.Instance != "" {
+		// Messages sent to the instance come first, as on a Receive stream
+		identities = []*pb.Identity{{From: protocol.InstanceAddress(req.From, req.Instance), ManualAck: true}, identities[0]}
+	}
+	// Answer empty in time rather than let the caller's deadline expire
+	until := time.Now().Add(wait)
+	if deadline, ok := ctx.Deadline(); ok && deadline.Add(-fetchPollInterval).Before(until) {
+		until = deadline.Add(-fetchPollInterval)
+	}
+	stream := &fetchStream{ctx: ctx}
+	for {
+		// Subscribe before looking, so a message queued in between is not missed
+		queued := s.waiters.wait(req.From)
+		for _, identity := range identities {
+			if len(stream.messages) >= limit {
+				break
+			}
+			if err := s.getMessages(identity, stream, limit-len(stream.messages), visibility); err != nil {
+				_, err := serverError(err)
+				return nil, err
+			}
+		}
+		remaining := time.Until(until)
+		if len(stream.messages) > 0 || remaining <= 0 {
+			break
+		}
+		select {
+		case <-queued:
+		case <-time.After(min(remaining, fetchPollInterval)):
+		case <-ctx.Done():
+			return &pb.FetchResponse{}, nil
+		case <-s.done:
+			return &pb.FetchResponse{}, nil
+		}
+	}
+	s.metrics.Add("broker_messages_fetched_total", int64(len(stream.messages)))
+	return &pb.FetchResponse{Messages: stream.messages}, nil
+}
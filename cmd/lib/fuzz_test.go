@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// FuzzDecodeStored feeds arbitrary bytes to the stored value decoders, which
+// must reject corrupted records with an error rather than panic.
+func FuzzDecodeStored(f *testing.F) {
+	legacy, _ := proto.Marshal(&pb.Message{Data: []byte("hello"), From: "a", To: "b", Seq: timestamppb.Now()})
+	enveloped, _ := encodeEnvelope(nil, &pb.Message{Data: []byte("hello"), From: "a", To: "b", Seq: timestamppb.Now()})
+	f.Add(legacy)
+	f.Add(enveloped)
+	f.Add([]byte{})
+	f.Add([]byte{envelopeMagic, 0x7f, 0, 0, 0, 0, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, value []byte) {
+		var msg pb.Message
+		_ = decodeStored(value, &msg)
+		_, _ = storedTime(value)
+	})
+}
+
+// FuzzEnvelopeRoundTrip checks that anything we encode decodes to the same message
+func FuzzEnvelopeRoundTrip(f *testing.F) {
+	f.Add([]byte("payload"), "from", "to", int64(0))
+	f.Add([]byte{}, "", "", int64(-1))
+	f.Fuzz(func(t *testing.T, data []byte, from, to string, nanos int64) {
+		msg := &pb.Message{Data: data, From: from, To: to, Seq: timestamppb.New(time.Unix(0, nanos))}
+		value, err := encodeEnvelope(nil, msg)
+		if err != nil {
+			// Invalid UTF-8 in string fields is rejected by proto
+			return
+		}
+		var got pb.Message
+		if err := decodeStored(value, &got); err != nil {
+			t.Fatalf("failed to decode envelope: %v", err)
+		}
+		if !proto.Equal(msg, &got) {
+			t.Fatalf("round trip mismatch: %v != %v", msg, &got)
+		}
+		enqueued, err := storedTime(value)
+		if err != nil || !enqueued.Equal(msg.Seq.AsTime()) {
+			t.Fatalf("stored time mismatch: %v (%v)", enqueued, err)
+		}
+	})
+}
+
+// FuzzMessageKey checks the key encoding invariants relied on by prefix and range scans
+func FuzzMessageKey(f *testing.F) {
+	f.Add("service")
+	f.Add("")
+	f.Add("a_b")
+	f.Add(internalKeyPrefix)
+	f.Fuzz(func(t *testing.T, serviceName string) {
+		key := messageKey(serviceName)
+		prefix := messagePrefix(serviceName)
+		if !bytes.HasPrefix(key, prefix) {
+			t.Fatalf("key %q does not start with prefix %q", key, prefix)
+		}
+		if bytes.Compare(key, prefixEnd(prefix)) > 0 {
+			t.Fatalf("key %q sorts after range end", key)
+		}
+		if isInternalKey(key) != bytes.HasPrefix(prefix, []byte(internalKeyPrefix)) {
+			t.Fatalf("unexpected internal key classification for %q", key)
+		}
+		if _, ok := keyVisibleAt(prefix, key); !ok {
+			t.Fatalf("key %q is not recognised as belonging to %q", key, serviceName)
+		}
+		if !isInternalKey(cursorKey(serviceName)) {
+			t.Fatalf("cursor key %q is not internal", cursorKey(serviceName))
+		}
+	})
+}
+
+// FuzzLoadConfig checks that malformed JSON or YAML config files produce errors, not panics
+func FuzzLoadConfig(f *testing.F) {
+	f.Add([]byte(`{"server":{"host":"0.0.0.0","port":"9000"},"auth":{"EnableAuth":true}}`))
+	f.Add([]byte("server:\n  host: 0.0.0.0\n  port: \"9000\"\n"))
+	f.Add([]byte("{"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, _ = LoadConfig(path)
+	})
+}
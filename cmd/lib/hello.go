@@ -0,0 +1,29 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Hello negotiates the protocol version and the features both sides support. Clients
+// older than protocol.MinVersion are refused with FAILED_PRECONDITION.
+func (s *Server) Hello(ctx context.Context, req *pb.HelloRequest) (*pb.HelloResponse, error) {
+	if req.ProtocolVersion < protocol.MinVersion {
+		_, err := failure(codes.FailedPrecondition, &pb.Status{
+			Message: fmt.Sprintf("protocol version %d is no longer supported, the broker requires %d or newer", req.ProtocolVersion, protocol.MinVersion),
+			Success: false,
+			Error:   pb.Error_INVALID_REQUEST,
+		})
+		return nil, err
+	}
+	return &pb.HelloResponse{
+		ProtocolVersion:    min(req.ProtocolVersion, protocol.Version),
+		MinProtocolVersion: protocol.MinVersion,
+		Features:           protocol.Negotiate(protocol.Features, req.Features),
+	}, nil
+}
@@ -0,0 +1,143 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// DefaultSignatureWindow is how far the timestamp of a signed request may be from the
+// broker's clock
+const DefaultSignatureWindow = 5 * time.Minute
+
+// maxSeenSignatures bounds the replay cache; signed requests are refused while it is full
+const maxSeenSignatures = 1000000
+
+// signedCall is what a request signature covers besides its timestamp and nonce
+type signedCall struct {
+	method string
+	body   []byte
+}
+
+// hmacVerifier checks signed requests against the API keys and refuses replays
+type hmacVerifier struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	keys      map[string]string    // key id -> API key
+	seen      map[string]time.Time // signature -> when it may be forgotten
+	lastSweep time.Time
+}
+
+func newHMACVerifier(config *AuthConfig) *hmacVerifier {
+	v := &hmacVerifier{
+		window: config.SignatureWindow,
+		keys:   make(map[string]string, len(config.APIKeys)),
+		seen:   make(map[string]time.Time),
+	}
+	if v.window <= 0 {
+		v.window = DefaultSignatureWindow
+	}
+	for key := range config.APIKeys {
+		v.keys[KeyID(key)] = key
+	}
+	return v
+}
+
+// add makes a key generated after start usable for signing
+func (v *hmacVerifier) add(key string) {
+	v.mu.Lock()
+	v.keys[KeyID(key)] = key
+	v.mu.Unlock()
+}
+
+// set replaces the keys, after they were reloaded
+func (v *hmacVerifier) set(keys map[string]string) {
+	ids := make(map[string]string, len(keys))
+	for key := range keys {
+		ids[KeyID(key)] = key
+	}
+	v.mu.Lock()
+	v.keys = ids
+	v.mu.Unlock()
+}
+
+// verify checks the signature in md and returns the API key that made it
+func (v *hmacVerifier) verify(md metadata.MD, call signedCall) (string, error) {
+	get := func(name string) string {
+		if values := md.Get(name); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	keyID, signature := get(protocol.SignatureKeyIDHeader), get(protocol.SignatureHeader)
+	nonce, stamp := get(protocol.SignatureNonceHeader), get(protocol.SignatureTimestampHeader)
+	if keyID == "" || signature == "" {
+		return "", fmt.Errorf("missing request signature")
+	}
+	if nonce == "" {
+		return "", fmt.Errorf("missing signature nonce")
+	}
+	timestamp, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid signature timestamp")
+	}
+	now := time.Now()
+	if skew := now.Sub(time.Unix(timestamp, 0)); skew > v.window || skew < -v.window {
+		return "", fmt.Errorf("signature timestamp is outside the %s window", v.window)
+	}
+
+	v.mu.Lock()
+	key, ok := v.keys[keyID]
+	v.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("unknown signing key")
+	}
+	expected := protocol.Sign(key, call.method, timestamp, nonce, call.body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return "", fmt.Errorf("invalid request signature")
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.sweep(now)
+	if _, replayed := v.seen[signature]; replayed {
+		return "", fmt.Errorf("replayed request signature")
+	}
+	if len(v.seen) >= maxSeenSignatures {
+		return "", fmt.Errorf("too many signed requests, try again later")
+	}
+	// A signature cannot be replayed once its timestamp is outside the window
+	v.seen[signature] = time.Unix(timestamp, 0).Add(v.window)
+	return key, nil
+}
+
+// sweep forgets signatures that can no longer be replayed, at most every few seconds
+func (v *hmacVerifier) sweep(now time.Time) {
+	if now.Sub(v.lastSweep) < 5*time.Second {
+		return
+	}
+	v.lastSweep = now
+	for signature, expires := range v.seen {
+		if now.After(expires) {
+			delete(v.seen, signature)
+		}
+	}
+}
+
+// authenticateHMAC validates a signed request and returns the service name and key.
+// The key is returned on failure too once the signature proved the caller holds it.
+func (am *AuthManager) authenticateHMAC(md metadata.MD, call signedCall) (string, string, error) {
+	key, err := am.hmac.verify(md, call)
+	if err != nil {
+		return "", "", err
+	}
+	serviceName, err := am.ValidateAPIKey(key)
+	return serviceName, key, err
+}
@@ -0,0 +1,364 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// maxGatewayBody caps JSON request bodies accepted by the HTTP gateway
+const maxGatewayBody = 4 << 20
+
+// Admin methods of the admin endpoints without an RPC, as named by auth policies
+const (
+	CanaryMethod  = "Canary"  // /canary
+	BacklogMethod = "Backlog" // /backlog
+)
+
+// MetricsHandler serves the metrics registry in the Prometheus text format
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := s.metrics.WriteText(w); err != nil {
+			log.Printf("Failed to write metrics: %v", err)
+		}
+	})
+}
+
+// AdminHandler serves operational endpoints such as health checks. With authentication
+// enabled on authManager, every endpoint but /healthz and /metrics needs the
+// credentials of a caller allowed to call the admin method it stands for.
+func (s *Server) AdminHandler(authManager *AuthManager) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "ok\n")
+	})
+	mux.Handle("/metrics", s.MetricsHandler())
+	mux.HandleFunc("/pause", adminAuth(authManager, "PauseDelivery", s.adminCall(s.PauseDelivery)))
+	mux.HandleFunc("/resume", adminAuth(authManager, "ResumeDelivery", s.adminCall(s.ResumeDelivery)))
+	mux.HandleFunc("/read-only", adminAuth(authManager, "SetReadOnly", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+			if err != nil {
+				http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+				return
+			}
+			s.SetReadOnly(r.Context(), &pb.ReadOnlyRequest{Enabled: enabled})
+		}
+		io.WriteString(w, strconv.FormatBool(s.ReadOnly())+"\n")
+	}))
+	mux.HandleFunc("/log-level", adminAuth(authManager, "SetLogLevel", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			if st, err := s.SetLogLevel(r.Context(), &pb.LogLevelRequest{Level: r.URL.Query().Get("level")}); err != nil {
+				http.Error(w, st.GetMessage(), httpStatusCode(grpcstatus.Code(err)))
+				return
+			}
+		}
+		io.WriteString(w, s.LogLevel()+"\n")
+	}))
+	mux.HandleFunc("/payload-logging", adminAuth(authManager, "SetPayloadLogging", func(w http.ResponseWriter, r *http.Request) {
+		s.debugToggle(w, r, func(ctx context.Context, d time.Duration) (*pb.Status, error) {
+			return s.SetPayloadLogging(ctx, &pb.PayloadLoggingRequest{Service: r.URL.Query().Get("service"), Duration: durationpb.New(d)})
+		})
+	}))
+	mux.HandleFunc("/slow-logging", adminAuth(authManager, "SetSlowLogging", func(w http.ResponseWriter, r *http.Request) {
+		s.debugToggle(w, r, func(ctx context.Context, d time.Duration) (*pb.Status, error) {
+			return s.SetSlowLogging(ctx, &pb.SlowLoggingRequest{Threshold: durationpb.New(d)})
+		})
+	}))
+	mux.HandleFunc("/quotas", adminAuth(authManager, "GetQuotaUsage", func(w http.ResponseWriter, r *http.Request) {
+		resp, _ := s.GetQuotaUsage(r.Context(), &pb.QuotaUsageRequest{Services: r.URL.Query()["service"]})
+		data, err := protojson.Marshal(resp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}))
+	mux.HandleFunc("/stats", adminAuth(authManager, "GetStats", func(w http.ResponseWriter, r *http.Request) {
+		resp, _ := s.GetStats(r.Context(), &pb.StatsRequest{Services: r.URL.Query()["service"]})
+		data, err := protojson.Marshal(resp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}))
+	mux.HandleFunc("/paused", adminAuth(authManager, "PauseDelivery", func(w http.ResponseWriter, r *http.Request) {
+		for _, service := range s.PausedServices() {
+			io.WriteString(w, service+"\n")
+		}
+	}))
+	mux.HandleFunc("/canary", adminAuth(authManager, CanaryMethod, s.canaryHandler))
+	mux.HandleFunc("/backlog", adminAuth(authManager, BacklogMethod, func(w http.ResponseWriter, r *http.Request) {
+		ages, err := s.BacklogAges(time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		backlog := make(map[string]BacklogStatus, len(ages))
+		for queue, age := range ages {
+			sla := s.backlogSLA(queue)
+			backlog[queue] = BacklogStatus{AgeSeconds: age.Seconds(), MaxAgeSeconds: sla.Seconds(), Breaching: sla > 0 && age > sla}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(backlog)
+	}))
+	return mux
+}
+
+// adminAuth authenticates the requests of an admin endpoint standing for the admin
+// method rpc when authentication is enabled, and passes the caller on to handler
+func adminAuth(authManager *AuthManager, rpc string, handler http.HandlerFunc) http.HandlerFunc {
+	if authManager == nil || !authManager.config.EnableAuth {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		serviceName, err := authManager.AuthenticateHTTP(r, rpc, 0)
+		if err != nil {
+			writeAuthError(w, err)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), serviceNameCtxKey{}, serviceName)))
+	}
+}
+
+// debugToggle calls set with the duration of a POST ?duration= (a Go duration such as
+// 10m, 0 switching the toggle off) and writes the status message
+func (s *Server) debugToggle(w http.ResponseWriter, r *http.Request, set func(context.Context, time.Duration) (*pb.Status, error)) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	d, err := time.ParseDuration(r.URL.Query().Get("duration"))
+	if err != nil {
+		http.Error(w, "duration must be a duration such as 10m or 0", http.StatusBadRequest)
+		return
+	}
+	st, err := set(r.Context(), d)
+	if err != nil {
+		http.Error(w, st.GetMessage(), httpStatusCode(grpcstatus.Code(err)))
+		return
+	}
+	io.WriteString(w, st.Message+"\n")
+}
+
+// canaryHandler lists the canaries (GET), sets the canary of a service
+// (POST ?service=&canary=&weight=[&primary=]) or clears it (DELETE ?service=)
+func (s *Server) canaryHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	service := query.Get("service")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		weight, err := strconv.ParseFloat(query.Get("weight"), 64)
+		if err != nil {
+			http.Error(w, "weight must be a number", http.StatusBadRequest)
+			return
+		}
+		if err := s.SetCanary(service, Canary{Primary: query.Get("primary"), Canary: query.Get("canary"), Weight: weight}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+		if service == "" {
+			http.Error(w, "missing service name", http.StatusBadRequest)
+			return
+		}
+		if err := s.ClearCanary(service); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.Canaries())
+}
+
+// adminCall adapts a per-service admin RPC to POST /<action>?service=<name>
+func (s *Server) adminCall(call func(context.Context, *pb.Identity) (*pb.Status, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		st, err := call(r.Context(), &pb.Identity{From: r.URL.Query().Get("service")})
+		if err != nil {
+			http.Error(w, st.GetMessage(), httpStatusCode(grpcstatus.Code(err)))
+			return
+		}
+		io.WriteString(w, st.Message+"\n")
+	}
+}
+
+// writeAuthError answers an HTTP request whose authentication failed
+func writeAuthError(w http.ResponseWriter, err error) {
+	var locked *LockedOutError
+	switch {
+	case errors.As(err, &locked):
+		w.Header().Set("Retry-After", strconv.Itoa(int(locked.RetryAfter.Seconds())+1))
+		http.Error(w, "authentication failed: "+err.Error(), http.StatusTooManyRequests)
+	case isPermissionDenied(err):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, "authentication failed: "+err.Error(), http.StatusUnauthorized)
+	}
+}
+
+// GatewayHandler exposes the unary broker RPCs as JSON over HTTP. Requests are
+// authenticated with the same headers as gRPC when authManager is non-nil.
+func (s *Server) GatewayHandler(authManager *AuthManager) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/ping", s.gatewayCall(authManager, "Ping", &pb.Identity{}, func(ctx context.Context, req proto.Message) (*pb.Status, error) {
+		return s.Ping(ctx, req.(*pb.Identity))
+	}))
+	mux.HandleFunc("/v1/send", s.gatewayCall(authManager, "Send", &pb.Message{}, func(ctx context.Context, req proto.Message) (*pb.Status, error) {
+		return s.Send(ctx, req.(*pb.Message))
+	}))
+	mux.HandleFunc("/v1/send-batch", s.gatewayCall(authManager, "SendBatch", &pb.Batch{}, func(ctx context.Context, req proto.Message) (*pb.Status, error) {
+		return s.SendBatch(ctx, req.(*pb.Batch))
+	}))
+	mux.HandleFunc("/v1/ack", s.gatewayCall(authManager, "Ack", &pb.AckRequest{}, func(ctx context.Context, req proto.Message) (*pb.Status, error) {
+		return s.Ack(ctx, req.(*pb.AckRequest))
+	}))
+	mux.HandleFunc("/v1/nack", s.gatewayCall(authManager, "Nack", &pb.NackRequest{}, func(ctx context.Context, req proto.Message) (*pb.Status, error) {
+		return s.Nack(ctx, req.(*pb.NackRequest))
+	}))
+	mux.HandleFunc("/v1/cleanup", s.gatewayCall(authManager, "Cleanup", &pb.Identity{}, func(ctx context.Context, req proto.Message) (*pb.Status, error) {
+		return s.Cleanup(ctx, req.(*pb.Identity))
+	}))
+	return mux
+}
+
+// gatewayCall decodes a JSON request into a fresh copy of template and invokes call,
+// which stands for the RPC rpc
+func (s *Server) gatewayCall(authManager *AuthManager, rpc string, template proto.Message, call func(context.Context, proto.Message) (*pb.Status, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx := r.Context()
+		if authManager != nil && authManager.config.EnableAuth {
+			serviceName, err := authManager.AuthenticateHTTP(r, rpc, maxGatewayBody)
+			if err != nil {
+				writeAuthError(w, err)
+				return
+			}
+			ctx = context.WithValue(ctx, serviceNameCtxKey{}, serviceName)
+		}
+		// Carry the headers gRPC calls would have, so that sends forwarded to another shard keep them
+		md := metadata.MD{}
+		for _, key := range forwardedHeaders {
+			if value := r.Header.Get(key); value != "" {
+				md.Set(key, value)
+			}
+		}
+		ctx = metadata.NewIncomingContext(ctx, md)
+		// Like gRPC calls, unauthenticated sends are charged to the client address
+		if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+			ctx = peer.NewContext(ctx, &peer.Peer{Addr: addr})
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxGatewayBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		req := proto.Clone(template)
+		proto.Reset(req)
+		if err := protojson.Unmarshal(body, req); err != nil {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := s.callWithTimeout(ctx, func(ctx context.Context) (any, error) {
+			return call(ctx, req)
+		})
+		status, _ := resp.(*pb.Status)
+		if status == nil && err != nil {
+			// Errors without a payload carry it as a status detail, if at all
+			status = statusDetail(err)
+		}
+		if status == nil {
+			http.Error(w, err.Error(), httpStatusCode(grpcstatus.Code(err)))
+			return
+		}
+		out, marshalErr := protojson.Marshal(status)
+		if marshalErr != nil {
+			http.Error(w, marshalErr.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if status.TraceId != "" {
+			w.Header().Set(TraceMetadataKey, status.TraceId)
+		}
+		if err != nil {
+			w.WriteHeader(httpStatusCode(grpcstatus.Code(err)))
+		} else if !status.Success {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		}
+		w.Write(out)
+	}
+}
+
+// statusDetail returns the broker Status attached to a gRPC error
+func statusDetail(err error) *pb.Status {
+	for _, detail := range grpcstatus.Convert(err).Details() {
+		if st, ok := detail.(*pb.Status); ok {
+			return st
+		}
+	}
+	return nil
+}
+
+// httpStatusCode maps gRPC codes to the closest HTTP status
+func httpStatusCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.DataLoss:
+		return http.StatusUnprocessableEntity
+	case codes.FailedPrecondition:
+		return http.StatusPreconditionFailed
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.Canceled:
+		return 499
+	default:
+		return http.StatusInternalServerError
+	}
+}
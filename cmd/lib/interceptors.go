@@ -0,0 +1,292 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	// Registers the gzip and zstd compressors clients may compress calls with
+	_ "github.com/ispapp/Microservices-Broker/transport"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Interceptors of the gRPC middleware pipeline
+const (
+	InterceptorRecovery  = "recovery"   // turns a panicking handler into an INTERNAL error
+	InterceptorMetrics   = "metrics"    // counts calls by method and status code
+	InterceptorLogging   = "logging"    // logs every call with its caller, status and duration
+	InterceptorAccessLog = "access_log" // writes sampled calls to server.access_log
+	InterceptorAuth      = "auth"       // authenticates the caller when authentication is enabled
+	InterceptorRateLimit = "rate_limit" // limits the calls of each caller to server.rate_limit
+	InterceptorDeadline  = "deadline"   // enforces the request timeout and stream lifetime
+)
+
+// DefaultInterceptors is the pipeline when none is configured, outermost first.
+// Logging every call is opt-in.
+var DefaultInterceptors = []string{InterceptorRecovery, InterceptorMetrics, InterceptorAccessLog, InterceptorAuth, InterceptorRateLimit, InterceptorDeadline}
+
+// knownInterceptors are the names server.interceptors accepts
+var knownInterceptors = []string{InterceptorRecovery, InterceptorMetrics, InterceptorLogging, InterceptorAccessLog, InterceptorAuth, InterceptorRateLimit, InterceptorDeadline}
+
+// RateLimitConfig limits how many calls each caller makes, the authenticated service
+// when the rate_limit interceptor runs after auth and the client address otherwise
+type RateLimitConfig struct {
+	// PerSecond is the sustained rate of calls (0 = unlimited)
+	PerSecond float64 `json:"per_second,omitempty"`
+	// Burst is how many calls may be made at once, PerSecond rounded up by default
+	Burst int `json:"burst,omitempty"`
+}
+
+// checkInterceptors validates an interceptor pipeline
+func checkInterceptors(names []string) error {
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if !slices.Contains(knownInterceptors, name) {
+			return fmt.Errorf("unknown interceptor %q (use %s)", name, strings.Join(knownInterceptors, ", "))
+		}
+		if seen[name] {
+			return fmt.Errorf("interceptor %q listed twice", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// WithRateLimit limits the calls of each caller when the rate_limit interceptor is in
+// the pipeline
+func WithRateLimit(config RateLimitConfig) ServerOption {
+	return func(s *Server) {
+		if config.PerSecond <= 0 {
+			return
+		}
+		burst := config.Burst
+		if burst <= 0 {
+			burst = int(config.PerSecond + 0.999)
+		}
+		s.rateLimit = &rateLimiter{
+			rate:    config.PerSecond,
+			burst:   float64(burst),
+			buckets: make(map[string]*tokenBucket),
+		}
+	}
+}
+
+// Interceptors returns the chain of unary and stream interceptors named by names,
+// outermost first. The default pipeline is used when names is empty. auth is the
+// authentication of the auth interceptor, which is skipped when auth is nil. The
+// debug interceptor of the log level and slow call toggles always comes last.
+func (s *Server) Interceptors(names []string, auth *AuthManager) ([]grpc.UnaryServerInterceptor, []grpc.StreamServerInterceptor, error) {
+	if len(names) == 0 {
+		names = DefaultInterceptors
+	}
+	if err := checkInterceptors(names); err != nil {
+		return nil, nil, err
+	}
+	var unary []grpc.UnaryServerInterceptor
+	var stream []grpc.StreamServerInterceptor
+	for _, name := range names {
+		switch name {
+		case InterceptorRecovery:
+			unary = append(unary, s.RecoveryUnaryInterceptor())
+			stream = append(stream, s.RecoveryStreamInterceptor())
+		case InterceptorMetrics:
+			unary = append(unary, s.MetricsUnaryInterceptor())
+			stream = append(stream, s.MetricsStreamInterceptor())
+		case InterceptorLogging:
+			unary = append(unary, LoggingUnaryInterceptor())
+			stream = append(stream, LoggingStreamInterceptor())
+		case InterceptorAccessLog:
+			if s.accessLog != nil {
+				unary = append(unary, s.AccessLogUnaryInterceptor())
+				stream = append(stream, s.AccessLogStreamInterceptor())
+			}
+		case InterceptorAuth:
+			if auth != nil {
+				unary = append(unary, auth.UnaryInterceptor())
+				stream = append(stream, auth.StreamInterceptor())
+			}
+		case InterceptorRateLimit:
+			if s.rateLimit != nil {
+				unary = append(unary, s.RateLimitUnaryInterceptor())
+				stream = append(stream, s.RateLimitStreamInterceptor())
+			}
+		case InterceptorDeadline:
+			unary = append(unary, s.DeadlineUnaryInterceptor())
+			stream = append(stream, s.DeadlineStreamInterceptor())
+		}
+	}
+	unary = append(unary, s.DebugUnaryInterceptor())
+	stream = append(stream, s.DebugStreamInterceptor())
+	return unary, stream, nil
+}
+
+// GRPCOptions chains the interceptors named by names, see Interceptors, behind the
+// codec that lets queued messages be stored as received
+func (s *Server) GRPCOptions(names []string, auth *AuthManager) ([]grpc.ServerOption, error) {
+	unary, stream, err := s.Interceptors(names, auth)
+	if err != nil {
+		return nil, err
+	}
+	unary = append([]grpc.UnaryServerInterceptor{s.wireUnaryInterceptor()}, unary...)
+	stream = append([]grpc.StreamServerInterceptor{s.wireStreamInterceptor()}, stream...)
+	return []grpc.ServerOption{s.wireCodecOption(), grpc.ChainUnaryInterceptor(unary...), grpc.ChainStreamInterceptor(stream...)}, nil
+}
+
+// recovered turns a panic of the handler of method into an INTERNAL error
+func (s *Server) recovered(method string, err *error) {
+	if r := recover(); r != nil {
+		s.metrics.Inc("broker_grpc_panics_total", "method", path.Base(method))
+		log.Printf("Recovered from panic in %s: %v\n%s", method, r, debug.Stack())
+		*err = status.Errorf(codes.Internal, "internal error handling %s", path.Base(method))
+	}
+}
+
+// RecoveryUnaryInterceptor answers unary calls whose handler panics with INTERNAL
+// instead of crashing the broker
+func (s *Server) RecoveryUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+		defer s.recovered(info.FullMethod, &err)
+		return handler(ctx, req)
+	}
+}
+
+// RecoveryStreamInterceptor ends streams whose handler panics with INTERNAL instead
+// of crashing the broker
+func (s *Server) RecoveryStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		defer s.recovered(info.FullMethod, &err)
+		return handler(srv, ss)
+	}
+}
+
+// MetricsUnaryInterceptor counts unary calls by method and status code
+func (s *Server) MetricsUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		s.metrics.Inc("broker_grpc_requests_total", "method", path.Base(info.FullMethod), "code", status.Code(err).String())
+		return resp, err
+	}
+}
+
+// MetricsStreamInterceptor counts streams by method and the status code they ended with
+func (s *Server) MetricsStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		err := handler(srv, ss)
+		s.metrics.Inc("broker_grpc_requests_total", "method", path.Base(info.FullMethod), "code", status.Code(err).String())
+		return err
+	}
+}
+
+// caller names who made a call: the authenticated service, or the client address
+func caller(ctx context.Context) string {
+	if service := GetServiceNameFromContext(ctx); service != "" {
+		return service
+	}
+	return peerAddress(ctx)
+}
+
+// LoggingUnaryInterceptor logs every unary call with its caller, status and duration
+func LoggingUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		log.Printf("%s from %s: %s in %s", path.Base(info.FullMethod), caller(ctx), status.Code(err), time.Since(start).Round(time.Microsecond))
+		return resp, err
+	}
+}
+
+// LoggingStreamInterceptor logs every stream with its caller, status and duration
+func LoggingStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		log.Printf("%s stream from %s: %s after %s", path.Base(info.FullMethod), caller(ss.Context()), status.Code(err), time.Since(start).Round(time.Millisecond))
+		return err
+	}
+}
+
+// RateLimitUnaryInterceptor refuses unary calls over the rate limit of their caller
+// with RESOURCE_EXHAUSTED. Pings are not limited.
+func (s *Server) RateLimitUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !strings.HasSuffix(info.FullMethod, "/Ping") {
+			if err := s.checkRateLimit(ctx, info.FullMethod); err != nil {
+				return nil, err
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// RateLimitStreamInterceptor refuses to open streams over the rate limit of their caller
+func (s *Server) RateLimitStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := s.checkRateLimit(ss.Context(), info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// checkRateLimit takes a call of method from the bucket of its caller
+func (s *Server) checkRateLimit(ctx context.Context, method string) error {
+	if s.rateLimit.allow(caller(ctx), time.Now()) {
+		return nil
+	}
+	s.metrics.Inc("broker_rate_limited_total", "method", path.Base(method))
+	return status.Errorf(codes.ResourceExhausted, "rate limit of %g calls per second exceeded", s.rateLimit.rate)
+}
+
+// rateLimiter keeps a token bucket per caller
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// tokenBucket holds the calls a caller may still make, as of updated
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// allow takes a token from the bucket of key, refilled since its last call
+func (r *rateLimiter) allow(key string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.buckets[key]
+	if !ok {
+		if len(r.buckets) >= maxThrottleEntries {
+			r.prune(now)
+		}
+		b = &tokenBucket{tokens: r.burst, updated: now}
+		r.buckets[key] = b
+	}
+	b.tokens = min(r.burst, b.tokens+now.Sub(b.updated).Seconds()*r.rate)
+	b.updated = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune forgets the buckets that filled up again, which behave like new ones
+func (r *rateLimiter) prune(now time.Time) {
+	for key, b := range r.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*r.rate >= r.burst {
+			delete(r.buckets, key)
+		}
+	}
+}
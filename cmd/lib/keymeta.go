@@ -0,0 +1,142 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+)
+
+// DefaultKeyUsageInterval is how often the broker writes the last use of API keys to disk
+const DefaultKeyUsageInterval = time.Minute
+
+// APIKeyInfo describes an API key for the people managing it
+type APIKeyInfo struct {
+	Description string            `json:"description,omitempty"`
+	Owner       string            `json:"owner,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	CreatedAt   time.Time         `json:"created_at,omitzero"`
+}
+
+// KeyID identifies an API key in usage records and logs without revealing it
+func KeyID(key string) string {
+	return protocol.SignatureKeyID(key)
+}
+
+// KeyUsagePath returns the file next to a config file that records when its API keys
+// were last used, e.g. config.key-usage.json for config.json
+func KeyUsagePath(configPath string) string {
+	return strings.TrimSuffix(configPath, filepath.Ext(configPath)) + ".key-usage.json"
+}
+
+// LoadKeyUsage reads the last use of API keys by key id; a missing file is empty
+func LoadKeyUsage(path string) (map[string]time.Time, error) {
+	usage := make(map[string]time.Time)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return usage, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key usage: %w", err)
+	}
+	if err := json.Unmarshal(data, &usage); err != nil {
+		return nil, fmt.Errorf("failed to parse key usage: %w", err)
+	}
+	return usage, nil
+}
+
+// keyUsage records when each API key last authenticated a call
+type keyUsage struct {
+	lastUsed sync.Map // key id -> *atomic.Int64 (unix seconds)
+	dirty    atomic.Bool
+}
+
+func (u *keyUsage) touch(id string) {
+	now := time.Now().Unix()
+	v, _ := u.lastUsed.LoadOrStore(id, new(atomic.Int64))
+	last := v.(*atomic.Int64)
+	// Second precision is plenty, and spares the flag on busy keys
+	if last.Swap(now) != now {
+		u.dirty.Store(true)
+	}
+}
+
+// save merges the recorded uses into the usage file at path
+func (u *keyUsage) save(path string) error {
+	if !u.dirty.Swap(false) {
+		return nil
+	}
+	usage, err := LoadKeyUsage(path)
+	if err != nil {
+		// Start over rather than stop recording
+		usage = make(map[string]time.Time)
+	}
+	u.lastUsed.Range(func(id, v any) bool {
+		used := time.Unix(v.(*atomic.Int64).Load(), 0).UTC()
+		if used.After(usage[id.(string)]) {
+			usage[id.(string)] = used
+		}
+		return true
+	})
+	data, err := json.MarshalIndent(usage, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		u.dirty.Store(true)
+		return fmt.Errorf("failed to write key usage: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		u.dirty.Store(true)
+		return fmt.Errorf("failed to write key usage: %w", err)
+	}
+	return nil
+}
+
+// TrackKeyUsage writes the last use of API keys to path every interval until the
+// returned function is called, which writes it a last time
+func (am *AuthManager) TrackKeyUsage(path string, interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		interval = DefaultKeyUsageInterval
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				if err := am.usage.save(path); err != nil {
+					log.Printf("Failed to record API key usage: %v", err)
+				}
+				return
+			case <-ticker.C:
+				if err := am.usage.save(path); err != nil {
+					log.Printf("Failed to record API key usage: %v", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// SetKeyInfo records what an API key is for
+func (a *AuthConfig) SetKeyInfo(key string, info APIKeyInfo) {
+	if a.KeyInfo == nil {
+		a.KeyInfo = make(map[string]*APIKeyInfo)
+	}
+	a.KeyInfo[key] = &info
+}
@@ -0,0 +1,68 @@
+package lib
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// DefaultKeyReloadInterval is how often the broker checks the config file for changed API keys
+const DefaultKeyReloadInterval = 10 * time.Second
+
+// ReloadAPIKeys replaces the API keys with those of config, whose secret references
+// must be resolved. Streams opened with a key that is gone end at their next recheck.
+func (am *AuthManager) ReloadAPIKeys(config *AuthConfig) {
+	keys := config.APIKeys
+	if keys == nil {
+		keys = make(map[string]string)
+	}
+	am.keysMu.Lock()
+	am.config.APIKeys = keys
+	am.config.keyRefs = config.keyRefs
+	am.keysMu.Unlock()
+	if am.hmac != nil {
+		am.hmac.set(keys)
+	}
+}
+
+// WatchAPIKeys reloads the API keys with load whenever the config file at path changes,
+// checking every interval until the returned function is called. Keys added or removed
+// with `auth` commands take effect without a restart.
+func (am *AuthManager) WatchAPIKeys(path string, interval time.Duration, load func() (*AuthConfig, error)) (stop func()) {
+	if interval <= 0 {
+		interval = DefaultKeyReloadInterval
+	}
+	var modTime time.Time
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime()
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				info, err := os.Stat(path)
+				if err != nil || info.ModTime().Equal(modTime) {
+					continue
+				}
+				config, err := load()
+				if err != nil {
+					log.Printf("Failed to reload API keys: %v", err)
+					continue
+				}
+				modTime = info.ModTime()
+				am.ReloadAPIKeys(config)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
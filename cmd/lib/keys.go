@@ -0,0 +1,96 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.mills.io/bitcask/v2"
+)
+
+// internalKeyPrefix marks broker bookkeeping records that are not messages
+const internalKeyPrefix = "__broker/"
+
+// messagePrefix returns the key prefix under which a service's messages are stored
+func messagePrefix(serviceName string) bitcask.Key {
+	return bitcask.Key(serviceName + "_")
+}
+
+// messageKey builds a new storage key for a service. Keys sort by enqueue time so
+// prefix scans deliver messages in order and cursors can resume from a key.
+func messageKey(serviceName string) bitcask.Key {
+	return messageKeyAt(serviceName, time.Now())
+}
+
+// messageKeyAt builds a storage key that becomes visible for delivery at t
+func messageKeyAt(serviceName string, t time.Time) bitcask.Key {
+	return bitcask.Key(fmt.Sprintf("%s_%016x%s", serviceName, t.UnixNano(), Utils.uid(8)))
+}
+
+// keyVisibleAt returns when a key under prefix becomes visible. ok is false when the
+// key belongs to another service sharing the prefix (e.g. "a_b" under "a").
+// Legacy keys without a timestamp are always visible.
+func keyVisibleAt(prefix, key bitcask.Key) (visibleAt time.Time, ok bool) {
+	if !bytes.HasPrefix(key, prefix) {
+		return time.Time{}, false
+	}
+	rest := key[len(prefix):]
+	switch len(rest) {
+	case 16:
+		return time.Time{}, true
+	case 24:
+		nanos, err := strconv.ParseUint(string(rest[:16]), 16, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(0, int64(nanos)), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// keyService returns the service a message key belongs to
+func keyService(key bitcask.Key) (string, bool) {
+	if isInternalKey(key) {
+		return "", false
+	}
+	for _, rest := range []int{24, 16} {
+		sep := len(key) - rest - 1
+		if sep < 1 || key[sep] != '_' {
+			continue
+		}
+		prefix := key[:sep+1]
+		if _, ok := keyVisibleAt(prefix, key); ok {
+			return string(key[:sep]), true
+		}
+	}
+	return "", false
+}
+
+// cursorKey returns the key holding the delivery cursor of a service
+func cursorKey(serviceName string) bitcask.Key {
+	return bitcask.Key(internalKeyPrefix + "cursor/" + serviceName)
+}
+
+// quarantineKey returns the key under which an unreadable record is kept for inspection
+func quarantineKey(key bitcask.Key) bitcask.Key {
+	return bitcask.Key(internalKeyPrefix + "quarantine/" + string(key))
+}
+
+// pausedKey marks a service whose delivery is paused
+func pausedKey(serviceName string) bitcask.Key {
+	return bitcask.Key(internalKeyPrefix + "paused/" + serviceName)
+}
+
+// isInternalKey reports whether the key belongs to broker bookkeeping
+func isInternalKey(key bitcask.Key) bool {
+	return bytes.HasPrefix(key, []byte(internalKeyPrefix))
+}
+
+// prefixEnd returns the upper bound for a range scan over a prefix
+func prefixEnd(prefix bitcask.Key) bitcask.Key {
+	end := make(bitcask.Key, len(prefix), len(prefix)+1)
+	copy(end, prefix)
+	return append(end, 0xff)
+}
@@ -0,0 +1,134 @@
+package lib
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	"go.mills.io/bitcask/v2"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Delivery latency histograms, labeled by destination service
+const (
+	deliveryLatencyMetric = "broker_delivery_latency_seconds"
+	ackLatencyMetric      = "broker_ack_latency_seconds"
+)
+
+// deliveryTimes remembers when the messages in flight were delivered, by message id,
+// for the deliver to ack latency. It is not persisted: messages delivered before a
+// restart are not measured when they are acked.
+type deliveryTimes struct {
+	mu sync.Mutex
+	at map[string]time.Time
+	// services are the destinations with latencies, reported by GetStats
+	services map[string]struct{}
+}
+
+// delivered records that the message in flight under id was delivered at t
+func (d *deliveryTimes) delivered(id string, t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.at == nil {
+		d.at = make(map[string]time.Time)
+	}
+	d.at[id] = t
+}
+
+// take forgets the message in flight under id and returns when it was delivered
+func (d *deliveryTimes) take(id string) (time.Time, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, ok := d.at[id]
+	delete(d.at, id)
+	return t, ok
+}
+
+// move follows a message in flight to its new id
+func (d *deliveryTimes) move(id, newID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if t, ok := d.at[id]; ok {
+		delete(d.at, id)
+		d.at[newID] = t
+	}
+}
+
+// seen registers service as a destination with latencies
+func (d *deliveryTimes) seen(service string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.services == nil {
+		d.services = make(map[string]struct{})
+	}
+	d.services[service] = struct{}{}
+}
+
+// destinations returns the destinations with latencies, sorted
+func (d *deliveryTimes) destinations() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	services := make([]string, 0, len(d.services))
+	for service := range d.services {
+		services = append(services, service)
+	}
+	slices.Sort(services)
+	return services
+}
+
+// observeDelivery records the enqueue to deliver latency of a message delivered from
+// queue, the queue of a service or of one of its instances
+func (s *Server) observeDelivery(queue string, latency time.Duration) {
+	service, _ := protocol.SplitAddress(queue)
+	s.deliveries.seen(service)
+	s.metrics.Observe(deliveryLatencyMetric, max(latency, 0), "service", service)
+}
+
+// observeAck records the deliver to ack latency of the message acked under key
+func (s *Server) observeAck(key bitcask.Key, now time.Time) {
+	deliveredAt, ok := s.deliveries.take(string(key))
+	if !ok {
+		return
+	}
+	queue, _ := keyService(key)
+	service, _ := protocol.SplitAddress(queue)
+	s.deliveries.seen(service)
+	s.metrics.Observe(ackLatencyMetric, max(now.Sub(deliveredAt), 0), "service", service)
+}
+
+// latencyStats summarizes a latency histogram
+func latencyStats(h HistogramSnapshot) *pb.LatencyStats {
+	return &pb.LatencyStats{
+		Count: h.Count,
+		Sum:   durationpb.New(h.Sum),
+		P50:   durationpb.New(h.Quantile(0.5)),
+		P90:   durationpb.New(h.Quantile(0.9)),
+		P99:   durationpb.New(h.Quantile(0.99)),
+	}
+}
+
+// GetStats reports the delivery latencies of the requested destination services, or
+// of every destination with deliveries since the broker started
+func (s *Server) GetStats(ctx context.Context, req *pb.StatsRequest) (*pb.StatsResponse, error) {
+	if err := contextError(ctx); err != nil {
+		_, err := serverError(err)
+		return nil, err
+	}
+	services := req.Services
+	if len(services) == 0 {
+		services = s.deliveries.destinations()
+	}
+	resp := &pb.StatsResponse{}
+	for _, service := range services {
+		resp.Destinations = append(resp.Destinations, &pb.DestinationStats{
+			Service:          service,
+			EnqueueToDeliver: latencyStats(s.metrics.Histogram(deliveryLatencyMetric, "service", service)),
+			DeliverToAck:     latencyStats(s.metrics.Histogram(ackLatencyMetric, "service", service)),
+		})
+	}
+	return resp, nil
+}
@@ -0,0 +1,62 @@
+package lib
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/grpc/codes"
+)
+
+// DefaultMaxInflightBytes is the default memory budget for message payloads being handled
+const DefaultMaxInflightBytes = 256 << 20
+
+// memoryBudget accounts for message bytes held by in-flight sends and stream deliveries
+type memoryBudget struct {
+	limit    int64
+	used     atomic.Int64
+	exceeded atomic.Bool
+}
+
+// WithMemoryBudget caps the message bytes held by in-flight requests and Receive
+// streams (0 = unlimited). Sends over budget are rejected, deliveries are deferred.
+func WithMemoryBudget(maxInflightBytes int64) ServerOption {
+	return func(s *Server) {
+		s.memory.limit = maxInflightBytes
+	}
+}
+
+// acquire reserves n bytes, failing when the budget would be exceeded. A single
+// message larger than the whole budget is admitted while nothing else is in flight.
+func (m *memoryBudget) acquire(n int64) bool {
+	if m.limit <= 0 {
+		m.used.Add(n)
+		return true
+	}
+	for {
+		used := m.used.Load()
+		if used > 0 && used+n > m.limit {
+			if !m.exceeded.Swap(true) {
+				log.Printf("Memory budget of %d bytes exceeded (%d in flight), applying backpressure", m.limit, used)
+			}
+			return false
+		}
+		if m.used.CompareAndSwap(used, used+n) {
+			return true
+		}
+	}
+}
+
+// release returns n bytes to the budget
+func (m *memoryBudget) release(n int64) {
+	if m.used.Add(-n) <= m.limit/2 && m.exceeded.Swap(false) {
+		log.Printf("Memory usage back under budget")
+	}
+}
+
+// overBudget rejects a request that does not fit in the memory budget
+func (s *Server) overBudget() (*pb.Status, error) {
+	s.metrics.Inc("broker_memory_rejections_total")
+	return failure(codes.ResourceExhausted, &pb.Status{Message: "Broker memory budget exceeded, retry later", Success: false, Error: pb.Error_SERVER_ERROR})
+}
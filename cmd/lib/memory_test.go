@@ -0,0 +1,43 @@
+package lib
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestMemoryBudgetRejectsSends(t *testing.T) {
+	s := newDeliveryServer(t, t.TempDir(), WithMemoryBudget(1024))
+	msg := func() *pb.Message {
+		return &pb.Message{From: "orders", To: "billing", Data: make([]byte, 100), Queue: true}
+	}
+
+	// Other requests hold all but a few bytes of the budget
+	if !s.memory.acquire(1000) {
+		t.Fatalf("acquire within the budget failed")
+	}
+	_, err := s.Send(context.Background(), msg())
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted, got %v", err)
+	}
+	_, err = s.SendBatch(context.Background(), &pb.Batch{Messages: []*pb.Message{msg()}})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted for the batch, got %v", err)
+	}
+	if n := s.metrics.Counter("broker_memory_rejections_total"); n != 2 {
+		t.Fatalf("expected 2 memory rejections, got %d", n)
+	}
+
+	// Once they are done sends fit again, and give back what they took
+	s.memory.release(1000)
+	if _, err := s.Send(context.Background(), msg()); err != nil {
+		t.Fatalf("Send within the budget failed: %v", err)
+	}
+	if used := s.memory.used.Load(); used != 0 {
+		t.Fatalf("expected the budget to be released, %d bytes are held", used)
+	}
+}
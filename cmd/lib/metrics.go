@@ -0,0 +1,283 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds in seconds of the buckets of latency histograms
+var LatencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+// Metrics is a minimal registry exported in the Prometheus text format
+type Metrics struct {
+	mu       sync.RWMutex
+	help     map[string]string
+	counters map[string]*atomic.Int64 // series (name{labels}) -> value
+	gauges   map[string]func() float64
+	// histograms count durations in LatencyBuckets, by series
+	histograms map[string]*histogram
+}
+
+// histogram counts the observations of each bucket of LatencyBuckets, and of the
+// observations above the last one
+type histogram struct {
+	buckets []atomic.Int64
+	count   atomic.Int64
+	sum     atomic.Int64 // nanoseconds
+}
+
+// HistogramSnapshot is the state of a latency histogram
+type HistogramSnapshot struct {
+	Count int64
+	Sum   time.Duration
+	// Buckets holds the observations of each bucket of LatencyBuckets (not cumulative),
+	// followed by those above the last bound
+	Buckets []int64
+}
+
+// Quantile estimates the q-quantile of the observations, interpolating linearly in
+// the bucket it falls in like Prometheus' histogram_quantile. Quantiles above the last
+// bound are reported as the last bound.
+func (h HistogramSnapshot) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := q * float64(h.Count)
+	var seen int64
+	for i, n := range h.Buckets {
+		if n == 0 || float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+		if i == len(LatencyBuckets) {
+			break
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = LatencyBuckets[i-1]
+		}
+		seconds := lower + (LatencyBuckets[i]-lower)*(rank-float64(seen))/float64(n)
+		return time.Duration(seconds * float64(time.Second))
+	}
+	return time.Duration(LatencyBuckets[len(LatencyBuckets)-1] * float64(time.Second))
+}
+
+// NewMetrics creates an empty registry
+func NewMetrics() *Metrics {
+	return &Metrics{
+		help:       make(map[string]string),
+		counters:   make(map[string]*atomic.Int64),
+		gauges:     make(map[string]func() float64),
+		histograms: make(map[string]*histogram),
+	}
+}
+
+// Describe sets the help text for a metric name
+func (m *Metrics) Describe(name, help string) {
+	m.mu.Lock()
+	m.help[name] = help
+	m.mu.Unlock()
+}
+
+// Inc increments a counter. Labels are given as key, value pairs.
+func (m *Metrics) Inc(name string, labels ...string) {
+	m.Add(name, 1, labels...)
+}
+
+// Add adds delta to a counter
+func (m *Metrics) Add(name string, delta int64, labels ...string) {
+	series := seriesName(name, labels)
+	m.mu.RLock()
+	counter, ok := m.counters[series]
+	m.mu.RUnlock()
+	if !ok {
+		m.mu.Lock()
+		if counter, ok = m.counters[series]; !ok {
+			counter = &atomic.Int64{}
+			m.counters[series] = counter
+		}
+		m.mu.Unlock()
+	}
+	counter.Add(delta)
+}
+
+// Counter returns the current value of a counter
+func (m *Metrics) Counter(name string, labels ...string) int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if counter, ok := m.counters[seriesName(name, labels)]; ok {
+		return counter.Load()
+	}
+	return 0
+}
+
+// Totals returns the value of every counter summed over its labels, by name
+func (m *Metrics) Totals() map[string]int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	totals := make(map[string]int64)
+	for series, counter := range m.counters {
+		name, _, _ := strings.Cut(series, "{")
+		totals[name] += counter.Load()
+	}
+	return totals
+}
+
+// Observe adds a duration to a latency histogram
+func (m *Metrics) Observe(name string, d time.Duration, labels ...string) {
+	series := seriesName(name, labels)
+	m.mu.RLock()
+	h, ok := m.histograms[series]
+	m.mu.RUnlock()
+	if !ok {
+		m.mu.Lock()
+		if h, ok = m.histograms[series]; !ok {
+			h = &histogram{buckets: make([]atomic.Int64, len(LatencyBuckets)+1)}
+			m.histograms[series] = h
+		}
+		m.mu.Unlock()
+	}
+	seconds := d.Seconds()
+	h.buckets[sort.SearchFloat64s(LatencyBuckets, seconds)].Add(1)
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+// Histogram returns the current state of a latency histogram
+func (m *Metrics) Histogram(name string, labels ...string) HistogramSnapshot {
+	m.mu.RLock()
+	h, ok := m.histograms[seriesName(name, labels)]
+	m.mu.RUnlock()
+	snapshot := HistogramSnapshot{Buckets: make([]int64, len(LatencyBuckets)+1)}
+	if !ok {
+		return snapshot
+	}
+	// Counted from the buckets so quantiles stay consistent with concurrent observations
+	for i := range h.buckets {
+		snapshot.Buckets[i] = h.buckets[i].Load()
+		snapshot.Count += snapshot.Buckets[i]
+	}
+	snapshot.Sum = time.Duration(h.sum.Load())
+	return snapshot
+}
+
+// GaugeFunc registers a gauge whose value is read at export time
+func (m *Metrics) GaugeFunc(name, help string, f func() float64) {
+	m.mu.Lock()
+	m.help[name] = help
+	m.gauges[name] = f
+	m.mu.Unlock()
+}
+
+// WriteText writes all metrics in the Prometheus text exposition format
+func (m *Metrics) WriteText(w io.Writer) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	byName := make(map[string][]string)
+	for series := range m.counters {
+		name, _, _ := strings.Cut(series, "{")
+		byName[name] = append(byName[name], series)
+	}
+	names := make([]string, 0, len(byName)+len(m.gauges))
+	for name := range byName {
+		names = append(names, name)
+	}
+	for name := range m.gauges {
+		names = append(names, name)
+	}
+	histograms := make(map[string][]string)
+	for series := range m.histograms {
+		name, _, _ := strings.Cut(series, "{")
+		if len(histograms[name]) == 0 {
+			names = append(names, name)
+		}
+		histograms[name] = append(histograms[name], series)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if help, ok := m.help[name]; ok {
+			if _, err := fmt.Fprintf(w, "# HELP %s %s\n", name, help); err != nil {
+				return err
+			}
+		}
+		if gauge, ok := m.gauges[name]; ok {
+			if _, err := fmt.Fprintf(w, "# TYPE %s gauge\n%s %g\n", name, name, gauge()); err != nil {
+				return err
+			}
+			continue
+		}
+		if series, ok := histograms[name]; ok {
+			if err := m.writeHistograms(w, name, series); err != nil {
+				return err
+			}
+			continue
+		}
+		fmt.Fprintf(w, "# TYPE %s counter\n", name)
+		series := byName[name]
+		sort.Strings(series)
+		for _, s := range series {
+			if _, err := fmt.Fprintf(w, "%s %d\n", s, m.counters[s].Load()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeHistograms writes the series of the histogram name, with cumulative buckets
+func (m *Metrics) writeHistograms(w io.Writer, name string, series []string) error {
+	if _, err := fmt.Fprintf(w, "# TYPE %s histogram\n", name); err != nil {
+		return err
+	}
+	sort.Strings(series)
+	for _, s := range series {
+		h := m.histograms[s]
+		// Labels of the series, to which le is added
+		labels := strings.TrimSuffix(strings.TrimPrefix(s, name), "}")
+		if labels == "" {
+			labels = "{"
+		} else {
+			labels += ","
+		}
+		var cumulative int64
+		for i := range h.buckets {
+			cumulative += h.buckets[i].Load()
+			le := "+Inf"
+			if i < len(LatencyBuckets) {
+				le = strconv.FormatFloat(LatencyBuckets[i], 'g', -1, 64)
+			}
+			if _, err := fmt.Fprintf(w, "%s_bucket%sle=%q} %d\n", name, labels, le, cumulative); err != nil {
+				return err
+			}
+		}
+		suffix := strings.TrimPrefix(s, name)
+		if _, err := fmt.Fprintf(w, "%s_sum%s %g\n%s_count%s %d\n", name, suffix, time.Duration(h.sum.Load()).Seconds(), name, suffix, h.count.Load()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seriesName renders name{k="v",...} for a set of label pairs
+func seriesName(name string, labels []string) string {
+	if len(labels) < 2 {
+		return name
+	}
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", labels[i], labels[i+1])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
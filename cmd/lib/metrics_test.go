@@ -0,0 +1,59 @@
+package lib
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogramQuantile(t *testing.T) {
+	m := NewMetrics()
+	for range 90 {
+		m.Observe("latency", 2*time.Millisecond, "service", "billing")
+	}
+	for range 10 {
+		m.Observe("latency", 2*time.Hour, "service", "billing")
+	}
+	h := m.Histogram("latency", "service", "billing")
+	if h.Count != 100 || h.Sum != 90*2*time.Millisecond+10*2*time.Hour {
+		t.Fatalf("unexpected count %d and sum %s", h.Count, h.Sum)
+	}
+	// 90 observations in (1ms, 5ms]: the 50th is interpolated 50/90 of the way through
+	want := time.Millisecond + 4*time.Millisecond*50/90
+	if got := h.Quantile(0.5); got < want-time.Microsecond || got > want+time.Microsecond {
+		t.Fatalf("expected a median of %s, got %s", want, got)
+	}
+	// Above the last bound quantiles are capped to it
+	if got := h.Quantile(0.99); got != time.Hour {
+		t.Fatalf("expected p99 capped to 1h, got %s", got)
+	}
+	if got := m.Histogram("latency", "service", "orders"); got.Count != 0 || got.Quantile(0.5) != 0 {
+		t.Fatalf("expected an empty histogram, got %+v", got)
+	}
+}
+
+func TestHistogramText(t *testing.T) {
+	m := NewMetrics()
+	m.Describe("latency", "Test latency")
+	m.Observe("latency", 20*time.Millisecond, "service", "billing")
+	m.Observe("latency", 2*time.Second, "service", "billing")
+	var out bytes.Buffer
+	if err := m.WriteText(&out); err != nil {
+		t.Fatalf("WriteText failed: %v", err)
+	}
+	text := out.String()
+	for _, line := range []string{
+		"# TYPE latency histogram",
+		`latency_bucket{service="billing",le="0.01"} 0`,
+		`latency_bucket{service="billing",le="0.05"} 1`,
+		`latency_bucket{service="billing",le="5"} 2`,
+		`latency_bucket{service="billing",le="+Inf"} 2`,
+		`latency_sum{service="billing"} 2.02`,
+		`latency_count{service="billing"} 2`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Fatalf("expected %q in:\n%s", line, text)
+		}
+	}
+}
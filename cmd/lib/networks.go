@@ -0,0 +1,124 @@
+package lib
+
+import (
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+)
+
+// NetworkPolicy restricts the client addresses a credential may be used from. Entries
+// are CIDR ranges, e.g. "10.0.0.0/8", or single addresses.
+type NetworkPolicy struct {
+	// Allow lists the ranges calls must come from; any address when empty
+	Allow []string `json:"allow,omitempty"`
+	// Deny lists ranges calls must not come from, even when allowed
+	Deny []string `json:"deny,omitempty"`
+}
+
+// NetworkDeniedError refuses valid credentials used from outside their allowed networks
+type NetworkDeniedError struct {
+	Service string
+	Peer    string
+}
+
+func (e *NetworkDeniedError) Error() string {
+	return fmt.Sprintf("service '%s' may not call from %s", e.Service, e.Peer)
+}
+
+// parsePrefix parses a CIDR range or a single address
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// networkPolicy is a NetworkPolicy with its ranges parsed
+type networkPolicy struct {
+	allow, deny []netip.Prefix
+	// restricted is set when Allow has entries, even invalid ones, so that a typo
+	// refuses calls rather than allowing every address
+	restricted bool
+}
+
+func newNetworkPolicy(name string, p *NetworkPolicy) *networkPolicy {
+	parse := func(entries []string) []netip.Prefix {
+		var prefixes []netip.Prefix
+		for _, entry := range entries {
+			prefix, err := parsePrefix(entry)
+			if err != nil {
+				log.Printf("Ignoring invalid network %q of %s: %v", entry, name, err)
+				continue
+			}
+			prefixes = append(prefixes, prefix)
+		}
+		return prefixes
+	}
+	return &networkPolicy{allow: parse(p.Allow), deny: parse(p.Deny), restricted: len(p.Allow) > 0}
+}
+
+// permits reports whether the policy lets remote call. An address that cannot be
+// parsed is only permitted by a policy without restrictions.
+func (p *networkPolicy) permits(remote string) bool {
+	addr, err := netip.ParseAddr(remote)
+	if err != nil {
+		return !p.restricted && len(p.deny) == 0
+	}
+	addr = addr.Unmap()
+	for _, prefix := range p.deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if !p.restricted {
+		return true
+	}
+	for _, prefix := range p.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// networkPolicies holds the parsed network policies of the auth configuration
+type networkPolicies struct {
+	keys     map[string]*networkPolicy // by API key as in the configuration
+	services map[string]*networkPolicy
+}
+
+func newNetworkPolicies(config *AuthConfig) networkPolicies {
+	policies := networkPolicies{
+		keys:     make(map[string]*networkPolicy, len(config.KeyNetworks)),
+		services: make(map[string]*networkPolicy, len(config.ServiceNetworks)),
+	}
+	for key, p := range config.KeyNetworks {
+		if p != nil {
+			policies.keys[key] = newNetworkPolicy("API key "+KeyID(key), p)
+		}
+	}
+	for service, p := range config.ServiceNetworks {
+		if p != nil {
+			policies.services[service] = newNetworkPolicy("service "+service, p)
+		}
+	}
+	return policies
+}
+
+// permits reports whether a call of service from remote, with the API key ref when
+// it used one, is allowed by the policies of both
+func (p networkPolicies) permits(service, ref, remote string) bool {
+	if policy, ok := p.services[service]; ok && !policy.permits(remote) {
+		return false
+	}
+	if policy, ok := p.keys[ref]; ok && ref != "" && !policy.permits(remote) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,243 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+)
+
+// Offload defaults
+const (
+	DefaultOffloadRegion    = "us-east-1"
+	DefaultOffloadURLExpiry = time.Hour
+	DefaultOffloadTimeout   = 30 * time.Second
+	// maxOffloadURLExpiry is the longest validity of presigned URLs in Signature Version 4
+	maxOffloadURLExpiry = 7 * 24 * time.Hour
+)
+
+// OffloadConfig moves the payloads of large queued messages to an S3-compatible object
+// store (AWS S3, MinIO...). The queue keeps a claim check referencing the object, which
+// the client library redeems on receive. The broker does not delete objects: expire
+// them with a lifecycle rule of the bucket, longer than the max age of messages.
+type OffloadConfig struct {
+	// Threshold is the payload size in bytes above which payloads are offloaded
+	// (0 disables offloading)
+	Threshold int `json:"threshold,omitempty"`
+	// Endpoint is the base URL of the store, e.g. https://s3.eu-west-1.amazonaws.com or
+	// http://minio:9000. Objects are addressed path-style; receivers download them
+	// from this endpoint too.
+	Endpoint string `json:"endpoint,omitempty"`
+	Bucket   string `json:"bucket,omitempty"`
+	// Region signs the requests (default us-east-1)
+	Region string `json:"region,omitempty"`
+	// Prefix is prepended to object keys
+	Prefix string `json:"prefix,omitempty"`
+	// AccessKey and SecretKey may be secret references
+	AccessKey string `json:"access_key,omitempty"`
+	SecretKey string `json:"secret_key,omitempty"`
+	// URLExpiry is how long the download URLs given to receivers are valid (default 1h)
+	URLExpiry time.Duration `json:"url_expiry,omitempty"`
+	// Timeout bounds each upload (default 30s)
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+func (c OffloadConfig) check() error {
+	if c.Threshold < 0 {
+		return errors.New("threshold must not be negative")
+	}
+	if c.Threshold == 0 {
+		return nil
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid endpoint %q", c.Endpoint)
+	}
+	if c.Bucket == "" {
+		return errors.New("bucket is required")
+	}
+	if c.AccessKey == "" || c.SecretKey == "" {
+		return errors.New("access_key and secret_key are required")
+	}
+	if c.URLExpiry < 0 || c.URLExpiry > maxOffloadURLExpiry {
+		return fmt.Errorf("url_expiry must be between 0 and %s", maxOffloadURLExpiry)
+	}
+	if c.Timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+	return nil
+}
+
+// Offloader stores payloads in an object store
+type Offloader struct {
+	config OffloadConfig
+	client *http.Client
+}
+
+// NewOffloader checks an offload configuration with its secrets resolved. It returns
+// nil when offloading is disabled.
+func NewOffloader(config OffloadConfig) (*Offloader, error) {
+	if err := config.check(); err != nil {
+		return nil, err
+	}
+	if config.Threshold == 0 {
+		return nil, nil
+	}
+	if config.Region == "" {
+		config.Region = DefaultOffloadRegion
+	}
+	if config.URLExpiry == 0 {
+		config.URLExpiry = DefaultOffloadURLExpiry
+	}
+	if config.Timeout == 0 {
+		config.Timeout = DefaultOffloadTimeout
+	}
+	config.Endpoint = strings.TrimRight(config.Endpoint, "/")
+	return &Offloader{config: config, client: &http.Client{Timeout: config.Timeout}}, nil
+}
+
+// WithOffload keeps the payloads of the large messages queued by the broker in the
+// object store of o
+func WithOffload(o *Offloader) ServerOption {
+	return func(s *Server) {
+		s.offloader = o
+	}
+}
+
+// objectURL returns the path-style URL of the object at key
+func (o *Offloader) objectURL(key string) (*url.URL, error) {
+	return url.Parse(o.config.Endpoint + "/" + awsEscape(o.config.Bucket, false) + "/" + awsEscape(key, true))
+}
+
+// newObjectKey returns a fresh key for a payload queued for queue
+func (o *Offloader) newObjectKey(queue string) string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return o.config.Prefix + queue + "/" + hex.EncodeToString(id)
+}
+
+// put uploads data as the object at key
+func (o *Offloader) put(ctx context.Context, key string, data []byte) error {
+	u, err := o.objectURL(key)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+	signAWSRequest(req, data, o.config.AccessKey, o.config.SecretKey, o.config.Region, "s3", time.Now().UTC())
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("object store answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// presign returns a URL downloading the object at key without credentials until the
+// URL expiry has passed
+func (o *Offloader) presign(key string, now time.Time) (string, error) {
+	u, err := o.objectURL(key)
+	if err != nil {
+		return "", err
+	}
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	scope := date + "/" + o.config.Region + "/s3/aws4_request"
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {o.config.AccessKey + "/" + scope},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {strconv.Itoa(int(o.config.URLExpiry / time.Second))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	// Encode sorts the parameters; Signature Version 4 wants spaces as %20
+	canonicalQuery := strings.ReplaceAll(query.Encode(), "+", "%20")
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet, u.EscapedPath(), canonicalQuery, "host:" + u.Host + "\n", "host", "UNSIGNED-PAYLOAD",
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	signature := hex.EncodeToString(hmacSHA256(awsSigningKey(o.config.SecretKey, date, o.config.Region, "s3"), stringToSign))
+	u.RawQuery = canonicalQuery + "&X-Amz-Signature=" + signature
+	return u.String(), nil
+}
+
+// awsEscape percent-encodes s as Signature Version 4 expects: every byte but the
+// unreserved characters, and slashes when keepSlashes is set
+func awsEscape(s string, keepSlashes bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlashes:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// offload uploads the payload of stored, the stored form of a message queued for
+// queue, when it is above the threshold, and leaves a claim check in its place. A
+// payload that cannot be uploaded is queued inline. Messages waiting for a federation
+// link keep their payload, the remote broker could not redeem the claim check.
+func (s *Server) offload(ctx context.Context, queue string, stored *pb.Message) {
+	o := s.offloader
+	if o == nil || len(stored.Data) <= o.config.Threshold || strings.HasPrefix(queue, FederationOutboxPrefix) {
+		return
+	}
+	key := o.newObjectKey(queue)
+	if err := o.put(ctx, key, stored.Data); err != nil {
+		s.metrics.Inc("broker_offload_failures_total")
+		log.Printf("Failed to offload payload for %s, queuing it inline (trace %s): %v", queue, stored.TraceId, err)
+		return
+	}
+	s.metrics.Inc("broker_payloads_offloaded_total")
+	s.metrics.Add("broker_offloaded_bytes_total", int64(len(stored.Data)))
+	headers := maps.Clone(stored.Headers)
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	headers[protocol.ClaimCheckKeyHeader] = key
+	headers[protocol.ClaimCheckSizeHeader] = strconv.Itoa(len(stored.Data))
+	stored.Headers = headers
+	stored.Data = nil
+}
+
+// presignClaim sets the download URL of a delivered message holding a claim check
+func (s *Server) presignClaim(msg *pb.Message) {
+	if s.offloader == nil || !protocol.IsClaimCheck(msg.Headers) {
+		return
+	}
+	u, err := s.offloader.presign(msg.Headers[protocol.ClaimCheckKeyHeader], time.Now().UTC())
+	if err != nil {
+		log.Printf("Failed to presign claim check of message %s: %v", msg.Id, err)
+		return
+	}
+	msg.Headers[protocol.ClaimCheckURLHeader] = u
+}
@@ -0,0 +1,265 @@
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Defaults of external identity provider validation
+const (
+	DefaultOIDCServiceClaim    = "sub"
+	DefaultJWKSRefreshInterval = time.Hour
+	// jwksRefetchInterval bounds how often a token signed with an unknown key fetches the keys again
+	jwksRefetchInterval = 30 * time.Second
+	jwksTimeout         = 10 * time.Second
+)
+
+// OIDCConfig lets the broker accept JWTs issued by an external identity provider
+// (Keycloak, Auth0, ...) next to the ones it signs itself
+type OIDCConfig struct {
+	// Issuer must match the iss claim, e.g. "https://idp.example.com/realms/prod"
+	Issuer string `json:"issuer"`
+	// JWKSURL serves the provider's signing keys; discovered from the issuer's
+	// /.well-known/openid-configuration when empty
+	JWKSURL string `json:"jwks_url,omitempty"`
+	// Audience must be one of the aud claims when set
+	Audience string `json:"audience,omitempty"`
+	// ServiceClaim names the claim holding the service name, "sub" by default;
+	// dots reach into nested objects, e.g. "ext.service"
+	ServiceClaim string `json:"service_claim,omitempty"`
+	// RefreshInterval is how long fetched keys are used before fetching them again (default 1h)
+	RefreshInterval time.Duration `json:"refresh_interval,omitempty"`
+}
+
+// oidcValidator checks tokens of an external identity provider against its JWKS
+type oidcValidator struct {
+	config OIDCConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	jwksURL     string
+	keys        map[string]any // kid -> public key
+	fetched     time.Time
+	lastAttempt time.Time
+}
+
+func newOIDCValidator(config OIDCConfig) *oidcValidator {
+	if config.ServiceClaim == "" {
+		config.ServiceClaim = DefaultOIDCServiceClaim
+	}
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = DefaultJWKSRefreshInterval
+	}
+	return &oidcValidator{
+		config:  config,
+		client:  &http.Client{Timeout: jwksTimeout},
+		jwksURL: config.JWKSURL,
+	}
+}
+
+// oidcMethods are the signing methods accepted from the identity provider
+var oidcMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// validate checks a token signed by the identity provider and returns the service
+// name it carries. ok is false for tokens signed with a shared secret, which are the
+// broker's own.
+func (v *oidcValidator) validate(tokenString string) (service string, ok bool, err error) {
+	unverified, _, err := jwt.NewParser().ParseUnverified(tokenString, jwt.MapClaims{})
+	if err != nil {
+		return "", false, nil
+	}
+	if _, hmac := unverified.Method.(*jwt.SigningMethodHMAC); hmac {
+		return "", false, nil
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(oidcMethods),
+		jwt.WithIssuer(v.config.Issuer),
+		jwt.WithExpirationRequired(),
+	}
+	if v.config.Audience != "" {
+		options = append(options, jwt.WithAudience(v.config.Audience))
+	}
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return v.key(kid)
+	}, options...)
+	if err != nil {
+		return "", true, err
+	}
+	service, err = claimString(claims, v.config.ServiceClaim)
+	return service, true, err
+}
+
+// claimString returns the string claim at a dotted path
+func claimString(claims jwt.MapClaims, path string) (string, error) {
+	var value any = map[string]any(claims)
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return "", fmt.Errorf("token has no %s claim", path)
+		}
+		value = object[name]
+	}
+	s, ok := value.(string)
+	if !ok || s == "" {
+		return "", fmt.Errorf("token has no %s claim", path)
+	}
+	return s, nil
+}
+
+// key returns the signing key kid (the only key when kid is empty), fetching the
+// keys when they are stale or do not have it yet
+func (v *oidcValidator) key(kid string) (any, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	stale := time.Since(v.fetched) > v.config.RefreshInterval
+	key, found := v.lookup(kid)
+	if (!found || stale) && time.Since(v.lastAttempt) > jwksRefetchInterval {
+		v.lastAttempt = time.Now()
+		if err := v.fetch(); err != nil {
+			// Keep using the keys we have while the provider is unreachable
+			log.Printf("Failed to fetch the identity provider's keys: %v", err)
+		} else {
+			key, found = v.lookup(kid)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func (v *oidcValidator) lookup(kid string) (any, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, true
+		}
+	}
+	key, ok := v.keys[kid]
+	return key, ok
+}
+
+// fetch replaces the keys with the provider's current JWKS
+func (v *oidcValidator) fetch() error {
+	if v.jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(strings.TrimSuffix(v.config.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return fmt.Errorf("discovery failed: %w", err)
+		}
+		if discovery.JWKSURI == "" {
+			return errors.New("discovery document has no jwks_uri")
+		}
+		v.jwksURL = discovery.JWKSURI
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := v.getJSON(v.jwksURL, &set); err != nil {
+		return err
+	}
+	keys := make(map[string]any, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Printf("Skipping signing key %q of the identity provider: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	v.keys = keys
+	v.fetched = time.Now()
+	return nil
+}
+
+func (v *oidcValidator) getJSON(url string, out any) error {
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// jwk is one key of a JSON Web Key Set
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (any, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %w", err)
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent: %w", err)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x: %w", err)
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y: %w", err)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
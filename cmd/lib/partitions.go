@@ -0,0 +1,124 @@
+package lib
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"go.mills.io/bitcask/v2"
+)
+
+// partitionSkipFactor bounds how many messages of other partitions a scan walks past,
+// as a multiple of the batch size
+const partitionSkipFactor = 10
+
+// partitionLocks remembers, per queue and partition key, the unacknowledged message
+// that has to be settled before the next message of the partition is delivered
+type partitionLocks struct {
+	mu   sync.Mutex
+	held map[string]string // queue + "\x00" + partition key -> id of the message in flight
+}
+
+func partitionLock(queue, key string) string {
+	return queue + "\x00" + key
+}
+
+// holder returns the id of the message in flight for a partition
+func (p *partitionLocks) holder(queue, key string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	id, ok := p.held[partitionLock(queue, key)]
+	return id, ok
+}
+
+// hold records id as the message in flight for a partition
+func (p *partitionLocks) hold(queue, key, id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.held == nil {
+		p.held = make(map[string]string)
+	}
+	p.held[partitionLock(queue, key)] = id
+}
+
+// release forgets a partition's message in flight, if it is still id
+func (p *partitionLocks) release(queue, key, id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.held[partitionLock(queue, key)] == id {
+		delete(p.held, partitionLock(queue, key))
+	}
+}
+
+// partitionOwner picks the instance of service that receives a partition by rendezvous
+// hashing over the instances with a live Receive stream, so a partition only moves
+// when its instance goes away. ok is false when no stream is connected.
+func (s *Server) partitionOwner(service, key string) (owner string, ok bool) {
+	var best uint64
+	for _, r := range s.liveReceivers(service) {
+		h := fnv.New64a()
+		h.Write([]byte(r.instance))
+		h.Write([]byte{0})
+		h.Write([]byte(key))
+		if score := h.Sum64(); !ok || score > best || (score == best && r.instance < owner) {
+			owner, best, ok = r.instance, score, true
+		}
+	}
+	return owner, ok
+}
+
+// partitionBlocked reports whether a queued message of a partition must wait: it belongs
+// to another instance of the service, or an earlier message of its partition is still
+// unacknowledged. A lock whose message was acked, expired or dead-lettered is released.
+func (s *Server) partitionBlocked(queue string, stream pb.Broker_ReceiveServer, key bitcask.Key, msg *pb.Message) bool {
+	if msg.PartitionKey == "" {
+		return false
+	}
+	if r, ok := stream.(*receiver); ok && r.service == queue {
+		if owner, ok := s.partitionOwner(r.service, msg.PartitionKey); ok && owner != r.instance {
+			return true
+		}
+	}
+	id, ok := s.partitionLocks.holder(queue, msg.PartitionKey)
+	if !ok || id == string(key) {
+		// A lapsed message is redelivered before the rest of its partition
+		return false
+	}
+	if !s.db.Has(bitcask.Key(id)) {
+		s.partitionLocks.release(queue, msg.PartitionKey, id)
+		return false
+	}
+	return true
+}
+
+// holdPartition makes the rest of msg's partition wait until msg is settled
+func (s *Server) holdPartition(queue string, msg *pb.Message) {
+	if msg.PartitionKey != "" {
+		s.partitionLocks.hold(queue, msg.PartitionKey, msg.Id)
+	}
+}
+
+// movePartition follows a requeued message of a partition to its new key, or releases
+// the partition when the message left the queue
+func (s *Server) movePartition(key bitcask.Key, msg *pb.Message, newID string) {
+	if msg.PartitionKey == "" {
+		return
+	}
+	queue, _ := keyService(key)
+	if id, ok := s.partitionLocks.holder(queue, msg.PartitionKey); !ok || id != string(key) {
+		return
+	}
+	if newID == "" {
+		s.partitionLocks.release(queue, msg.PartitionKey, string(key))
+		return
+	}
+	s.partitionLocks.hold(queue, msg.PartitionKey, newID)
+}
+
+// skipsLive reports whether msg goes straight to the queue: a queued message of a
+// partition could otherwise overtake the earlier ones still waiting in the queue, and a
+// message on a routing slip only moves on when it is acked
+func skipsLive(msg *pb.Message) bool {
+	return (msg.PartitionKey != "" && msg.Queue) || len(msg.RoutingSlip) > 0
+}
@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	"go.mills.io/bitcask/v2"
+)
+
+// PauseDelivery holds delivery of a service's queue. Messages sent to it are still
+// queued, and the pause survives restarts until ResumeDelivery is called.
+func (s *Server) PauseDelivery(ctx context.Context, identity *pb.Identity) (*pb.Status, error) {
+	if identity.From == "" {
+		return invalidRequest("missing service name")
+	}
+	if err := contextError(ctx); err != nil {
+		return serverError(err)
+	}
+	if remote, st, err := s.routeRemote(ctx, identity.From, func(ctx context.Context, c pb.BrokerClient) (*pb.Status, error) {
+		return c.PauseDelivery(ctx, identity)
+	}); remote {
+		return st, err
+	}
+	if err := s.db.Put(pausedKey(identity.From), []byte(time.Now().UTC().Format(time.RFC3339))); err != nil {
+		return serverError(err)
+	}
+	if err := s.commit(); err != nil {
+		return serverError(err)
+	}
+	log.Printf("Delivery to %s paused", identity.From)
+	return &pb.Status{Message: "Delivery paused for " + identity.From, Success: true, Error: pb.Error_NONE}, nil
+}
+
+// ResumeDelivery resumes delivery of a paused service
+func (s *Server) ResumeDelivery(ctx context.Context, identity *pb.Identity) (*pb.Status, error) {
+	if identity.From == "" {
+		return invalidRequest("missing service name")
+	}
+	if err := contextError(ctx); err != nil {
+		return serverError(err)
+	}
+	if remote, st, err := s.routeRemote(ctx, identity.From, func(ctx context.Context, c pb.BrokerClient) (*pb.Status, error) {
+		return c.ResumeDelivery(ctx, identity)
+	}); remote {
+		return st, err
+	}
+	if !s.IsPaused(identity.From) {
+		return &pb.Status{Message: "Delivery to " + identity.From + " was not paused", Success: true, Error: pb.Error_NONE}, nil
+	}
+	if err := s.db.Delete(pausedKey(identity.From)); err != nil {
+		return serverError(err)
+	}
+	if err := s.commit(); err != nil {
+		return serverError(err)
+	}
+	log.Printf("Delivery to %s resumed", identity.From)
+	return &pb.Status{Message: "Delivery resumed for " + identity.From, Success: true, Error: pb.Error_NONE}, nil
+}
+
+// IsPaused reports whether delivery to a service, or to the service of an instance address, is paused
+func (s *Server) IsPaused(serviceName string) bool {
+	service, _ := protocol.SplitAddress(serviceName)
+	return s.db.Has(pausedKey(service))
+}
+
+// PausedServices returns the services whose delivery is paused
+func (s *Server) PausedServices() []string {
+	prefix := pausedKey("")
+	var services []string
+	s.db.Scan(prefix, bitcask.KeyFunc(func(key bitcask.Key) error {
+		services = append(services, strings.TrimPrefix(string(key), string(prefix)))
+		return nil
+	}))
+	return services
+}
@@ -0,0 +1,354 @@
+package lib
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"google.golang.org/grpc/codes"
+)
+
+// What a plugin decided about a message
+const (
+	PluginAccept = "accept" // send the message, with the changes the plugin made (default)
+	PluginReject = "reject" // refuse the send
+	PluginDrop   = "drop"   // accept the message without delivering it
+)
+
+// Plugin limits
+const (
+	DefaultPluginTimeout   = 100 * time.Millisecond
+	DefaultPluginMaxMemory = 16 << 20
+	// wasmPageSize is the unit of WebAssembly memory
+	wasmPageSize = 64 << 10
+)
+
+// PluginConfig loads a WebAssembly plugin that sees the messages sent to some services
+// and can reject, drop, redirect or rewrite them. The module exports its memory,
+// alloc(size i32) i32 and on_message(ptr i32, len i32) i64; on_message gets the
+// message as JSON and returns the position of its JSON decision as ptr<<32|len, or 0
+// to accept the message as is.
+type PluginConfig struct {
+	Name string `json:"name"`
+	// Path is the .wasm file of the plugin
+	Path string `json:"path"`
+	// Services are the recipients the plugin sees, names or name patterns; every
+	// recipient when empty
+	Services []string `json:"services,omitempty"`
+	// Timeout bounds each call (default 100ms), MaxMemory the memory of the plugin in
+	// bytes (default 16MiB)
+	Timeout   time.Duration `json:"timeout,omitempty"`
+	MaxMemory int64         `json:"max_memory,omitempty"`
+	// OnError is what happens to a message when the plugin fails: "reject" (default)
+	// or "accept"
+	OnError string `json:"on_error,omitempty"`
+}
+
+// pluginMessage is the message a plugin gets
+type pluginMessage struct {
+	From    string            `json:"from"`
+	To      string            `json:"to"`
+	Type    string            `json:"type"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Data    []byte            `json:"data"`
+	TraceID string            `json:"trace_id,omitempty"`
+}
+
+// pluginDecision is what a plugin returns. Headers are merged into those of the
+// message, an empty value removing the header; To, Type and Data replace those of the
+// message when set.
+type pluginDecision struct {
+	Action  string            `json:"action,omitempty"`
+	Reason  string            `json:"reason,omitempty"`
+	To      string            `json:"to,omitempty"`
+	Type    string            `json:"type,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Data    []byte            `json:"data,omitempty"`
+}
+
+// plugin is a compiled plugin with its own runtime, so that its limits apply to it only
+type plugin struct {
+	PluginConfig
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+}
+
+// Plugins are the loaded WebAssembly plugins, called in order on Send
+type Plugins struct {
+	plugins []*plugin
+}
+
+// LoadPlugins checks the plugin configurations and compiles their modules
+func LoadPlugins(ctx context.Context, configs []PluginConfig) (*Plugins, error) {
+	p := &Plugins{}
+	names := make(map[string]bool)
+	for i, config := range configs {
+		if err := config.check(); err != nil {
+			p.Close()
+			return nil, fmt.Errorf("plugin %d: %w", i, err)
+		}
+		if names[config.Name] {
+			p.Close()
+			return nil, fmt.Errorf("plugin %d: duplicate name %q", i, config.Name)
+		}
+		names[config.Name] = true
+		code, err := os.ReadFile(config.Path)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("plugin %s: %w", config.Name, err)
+		}
+		loaded, err := compilePlugin(ctx, config, code)
+		if err != nil {
+			p.Close()
+			return nil, fmt.Errorf("plugin %s: %w", config.Name, err)
+		}
+		p.plugins = append(p.plugins, loaded)
+	}
+	return p, nil
+}
+
+func (c PluginConfig) check() error {
+	if c.Name == "" {
+		return errors.New("name is required")
+	}
+	if c.Path == "" {
+		return errors.New("path is required")
+	}
+	for _, service := range c.Services {
+		if err := protocol.CheckPattern(service); err != nil {
+			return err
+		}
+	}
+	if c.Timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+	if c.MaxMemory < 0 || c.MaxMemory > 4<<30 {
+		return errors.New("max_memory must be between 0 and 4GiB")
+	}
+	switch c.OnError {
+	case "", PluginReject, PluginAccept:
+	default:
+		return fmt.Errorf("unknown on_error %q (use 'reject' or 'accept')", c.OnError)
+	}
+	return nil
+}
+
+// compilePlugin compiles code in a runtime enforcing the limits of config and checks
+// its exports
+func compilePlugin(ctx context.Context, config PluginConfig, code []byte) (*plugin, error) {
+	if config.Timeout == 0 {
+		config.Timeout = DefaultPluginTimeout
+	}
+	if config.MaxMemory == 0 {
+		config.MaxMemory = DefaultPluginMaxMemory
+	}
+	pages := uint32(max(config.MaxMemory/wasmPageSize, 1))
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(pages).
+		WithCloseOnContextDone(true))
+	// Plugins built with WASI toolchains import it; they get no files, network or clock
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("failed to set up WASI: %w", err)
+	}
+	compiled, err := runtime.CompileModule(ctx, code)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("invalid module: %w", err)
+	}
+	exports := compiled.ExportedFunctions()
+	for _, name := range []string{"alloc", "on_message"} {
+		if _, ok := exports[name]; !ok {
+			runtime.Close(ctx)
+			return nil, fmt.Errorf("module does not export %s", name)
+		}
+	}
+	if _, ok := compiled.ExportedMemories()["memory"]; !ok {
+		runtime.Close(ctx)
+		return nil, errors.New("module does not export its memory")
+	}
+	return &plugin{PluginConfig: config, runtime: runtime, compiled: compiled}, nil
+}
+
+// Close releases the runtimes of the plugins
+func (p *Plugins) Close() error {
+	if p == nil {
+		return nil
+	}
+	var errs []error
+	for _, loaded := range p.plugins {
+		errs = append(errs, loaded.runtime.Close(context.Background()))
+	}
+	return errors.Join(errs...)
+}
+
+// WithPlugins calls the plugins of p on the messages sent to the broker. The server
+// closes p when it closes.
+func WithPlugins(p *Plugins) ServerOption {
+	return func(s *Server) {
+		if p != nil && len(p.plugins) > 0 {
+			s.plugins = p
+		}
+	}
+}
+
+// applies reports whether the plugin sees messages sent to service
+func (p *plugin) applies(service string) bool {
+	if len(p.Services) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(p.Services, func(pattern string) bool {
+		return protocol.MatchName(pattern, service)
+	})
+}
+
+// call runs the plugin on msg in a fresh instance, so that no state is kept between
+// messages, and returns its decision
+func (p *plugin) call(ctx context.Context, msg *pb.Message) (pluginDecision, error) {
+	var decision pluginDecision
+	input, err := json.Marshal(pluginMessage{
+		From:    msg.From,
+		To:      msg.To,
+		Type:    msg.Type.String(),
+		Headers: msg.Headers,
+		Data:    msg.Data,
+		TraceID: msg.TraceId,
+	})
+	if err != nil {
+		return decision, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+	module, err := p.runtime.InstantiateModule(ctx, p.compiled, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize"))
+	if err != nil {
+		return decision, fmt.Errorf("failed to instantiate: %w", err)
+	}
+	defer module.Close(context.Background())
+	results, err := module.ExportedFunction("alloc").Call(ctx, uint64(len(input)))
+	if err != nil {
+		return decision, fmt.Errorf("alloc failed: %w", err)
+	}
+	ptr := uint32(results[0])
+	if !module.Memory().Write(ptr, input) {
+		return decision, errors.New("alloc returned memory out of range")
+	}
+	results, err = module.ExportedFunction("on_message").Call(ctx, uint64(ptr), uint64(len(input)))
+	if err != nil {
+		return decision, fmt.Errorf("on_message failed: %w", err)
+	}
+	if results[0] == 0 {
+		return pluginDecision{Action: PluginAccept}, nil
+	}
+	output, ok := module.Memory().Read(uint32(results[0]>>32), uint32(results[0]))
+	if !ok {
+		return decision, errors.New("on_message returned memory out of range")
+	}
+	if err := json.Unmarshal(output, &decision); err != nil {
+		return decision, fmt.Errorf("invalid decision: %w", err)
+	}
+	return decision, decision.check()
+}
+
+func (d *pluginDecision) check() error {
+	switch d.Action {
+	case "":
+		d.Action = PluginAccept
+	case PluginAccept, PluginReject, PluginDrop:
+	default:
+		return fmt.Errorf("unknown action %q", d.Action)
+	}
+	if _, ok := pb.Type_value[d.Type]; d.Type != "" && !ok {
+		return fmt.Errorf("unknown type %q", d.Type)
+	}
+	return nil
+}
+
+// apply makes the changes of the decision to msg
+func (d pluginDecision) apply(msg *pb.Message) {
+	if d.To != "" {
+		msg.To = d.To
+	}
+	if d.Type != "" {
+		msg.Type = pb.Type(pb.Type_value[d.Type])
+	}
+	if d.Data != nil {
+		msg.Data = d.Data
+	}
+	for key, value := range d.Headers {
+		if value == "" {
+			delete(msg.Headers, key)
+			continue
+		}
+		if msg.Headers == nil {
+			msg.Headers = make(map[string]string)
+		}
+		msg.Headers[key] = value
+	}
+}
+
+// applyPlugins runs the plugins on msgs in order and returns the messages to send,
+// without those a plugin dropped, and the plugins that dropped messages. A message a
+// plugin rejects refuses the whole call. Calls forwarded by another shard and federated
+// messages went through the plugins of the broker that took them.
+func (s *Server) applyPlugins(ctx context.Context, msgs []*pb.Message) ([]*pb.Message, []string, *pb.Status, error) {
+	if s.plugins == nil {
+		return msgs, nil, nil, nil
+	}
+	kept := make([]*pb.Message, 0, len(msgs))
+	var droppers []string
+	for _, msg := range msgs {
+		if s.checkedUpstream(ctx, msg) {
+			kept = append(kept, msg)
+			continue
+		}
+		dropped := false
+		for _, p := range s.plugins.plugins {
+			service, _ := protocol.SplitAddress(msg.To)
+			if !p.applies(service) {
+				continue
+			}
+			decision, err := p.call(ctx, msg)
+			if err != nil {
+				s.metrics.Inc("broker_plugin_failures_total", "plugin", p.Name)
+				log.Printf("Plugin %s failed on message from %s to %s (trace %s): %v", p.Name, msg.From, msg.To, msg.TraceId, err)
+				if p.OnError == PluginAccept {
+					continue
+				}
+				decision = pluginDecision{Action: PluginReject, Reason: "plugin failed"}
+			}
+			s.metrics.Inc("broker_plugin_decisions_total", "plugin", p.Name, "action", decision.Action)
+			switch decision.Action {
+			case PluginReject:
+				detail := p.Name + ": " + cmp.Or(decision.Reason, "rejected")
+				s.emit(pb.BrokerEventType_BROKER_EVENT_TYPE_VALIDATION_FAILED, service, "", msg, detail)
+				log.Printf("Rejected message from %s to %s by plugin %s (trace %s)", msg.From, msg.To, detail, msg.TraceId)
+				st, err := failure(codes.InvalidArgument, &pb.Status{Message: "Invalid message: " + detail, Success: false, Error: pb.Error_VALIDATION_FAILED})
+				return nil, nil, st, err
+			case PluginDrop:
+				dropped = true
+				droppers = append(droppers, p.Name)
+			default:
+				decision.apply(msg)
+				continue
+			}
+			break
+		}
+		if !dropped {
+			kept = append(kept, msg)
+		}
+	}
+	return kept, droppers, nil, nil
+}
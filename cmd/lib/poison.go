@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"log"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"go.mills.io/bitcask/v2"
+)
+
+// DefaultPoisonThreshold is the number of consecutive failed deliveries after which a message is quarantined
+const DefaultPoisonThreshold = 5
+
+// WithPoisonThreshold quarantines a queued message once sending it to the consumer
+// stream has failed threshold times in a row (0 = never)
+func WithPoisonThreshold(threshold uint32) ServerOption {
+	return func(s *Server) {
+		s.poisonThreshold = threshold
+	}
+}
+
+// deliveryFailed records a failed stream send for a queued message and quarantines it
+// once the poison threshold is reached, so it cannot wedge the queue. cause is returned.
+func (s *Server) deliveryFailed(key bitcask.Key, msg *pb.Message, cause error) error {
+	if s.poisonThreshold > 0 && msg.Attempts >= s.poisonThreshold {
+		if err := s.poison(key, msg, cause); err != nil {
+			log.Printf("failed to quarantine poison message %s (trace %s): %v", key, msg.TraceId, err)
+		}
+		return cause
+	}
+	// A successful delivery deletes the message, so the stored count only holds failures in a row
+	if err := s.rewrite(key, msg); err != nil {
+		log.Printf("failed to record delivery attempt for %s (trace %s): %v", key, msg.TraceId, err)
+	}
+	return cause
+}
+
+// poison moves a message that keeps breaking its consumer stream to quarantine
+func (s *Server) poison(key bitcask.Key, msg *pb.Message, cause error) error {
+	if err := s.replace(key, quarantineKey(key), msg); err != nil {
+		return err
+	}
+	s.metrics.Inc("broker_messages_poisoned_total")
+	service, _ := keyService(key)
+	s.emit(pb.BrokerEventType_BROKER_EVENT_TYPE_QUARANTINED, service, string(key), msg, cause.Error())
+	log.Printf("Quarantined poison message %s after %d failed deliveries (trace %s): %v", key, msg.Attempts, msg.TraceId, cause)
+	return nil
+}
+
+// rewrite stores msg again under its current key
+func (s *Server) rewrite(key bitcask.Key, msg *pb.Message) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	value, err := encodeEnvelope(*buf, msg)
+	if err != nil {
+		return err
+	}
+	*buf = value
+	if err := s.db.Put(key, value); err != nil {
+		return err
+	}
+	return s.commit()
+}
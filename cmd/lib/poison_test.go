@@ -0,0 +1,66 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"go.mills.io/bitcask/v2"
+)
+
+// failingStream is a Receive stream whose sends of bad payloads fail
+type failingStream struct {
+	recordingStream
+	bad string
+}
+
+func (f *failingStream) Send(msg *pb.Message) error {
+	if string(msg.Data) == f.bad {
+		return errors.New("consumer choked on the payload")
+	}
+	return f.recordingStream.Send(msg)
+}
+
+func TestDeliveryQuarantinesPoisonMessages(t *testing.T) {
+	s := newDeliveryServer(t, t.TempDir(), WithPoisonThreshold(3))
+	queueN(t, s, 2)
+	var keys []bitcask.Key
+	if err := s.db.Scan(messagePrefix("billing"), bitcask.KeyFunc(func(key bitcask.Key) error {
+		keys = append(keys, append(bitcask.Key(nil), key...))
+		return nil
+	})); err != nil || len(keys) != 2 {
+		t.Fatalf("expected 2 queued keys, got %d (%v)", len(keys), err)
+	}
+
+	// Each failed send leaves the message queued, until the threshold is reached
+	stream := &failingStream{recordingStream: recordingStream{ctx: context.Background()}, bad: "0"}
+	for attempt := 1; attempt <= 3; attempt++ {
+		if err := s.getMessages(&pb.Identity{From: "billing"}, stream, 10, 0); err == nil {
+			t.Fatalf("attempt %d: expected the failed send to end the pass", attempt)
+		}
+		if kept := s.db.Has(keys[0]); kept != (attempt < 3) {
+			t.Fatalf("attempt %d: message still queued is %v", attempt, kept)
+		}
+	}
+	if n := s.metrics.Counter("broker_messages_poisoned_total"); n != 1 {
+		t.Fatalf("expected 1 poisoned message, got %d", n)
+	}
+	value, err := s.db.Get(quarantineKey(keys[0]))
+	if err != nil {
+		t.Fatalf("poison message not quarantined: %v", err)
+	}
+	var msg pb.Message
+	if err := decodeStored(value, &msg); err != nil || string(msg.Data) != "0" || msg.Attempts != 3 {
+		t.Fatalf("expected message 0 quarantined after 3 attempts, got %v (%v)", &msg, err)
+	}
+
+	// The message behind it is no longer wedged
+	if err := s.getMessages(&pb.Identity{From: "billing"}, stream, 10, 0); err != nil {
+		t.Fatalf("getMessages failed: %v", err)
+	}
+	if len(stream.sent) != 1 || string(stream.sent[0].Data) != "1" {
+		t.Fatalf("expected message 1 delivered, got %v", stream.sent)
+	}
+}
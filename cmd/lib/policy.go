@@ -0,0 +1,160 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+)
+
+// Method patterns of policies besides RPC names
+const (
+	PolicyAllMethods   = "*"     // every RPC
+	PolicyAdminMethods = "admin" // every admin RPC
+)
+
+// adminMethods are the RPCs that operate the broker rather than exchange messages
+var adminMethods = map[string]bool{
+	"PauseDelivery":     true,
+	"ResumeDelivery":    true,
+	"SetReadOnly":       true,
+	"WatchEvents":       true,
+	"Tap":               true,
+	"GetQuotaUsage":     true,
+	"SetLogLevel":       true,
+	"SetPayloadLogging": true,
+	"SetSlowLogging":    true,
+	"GetStats":          true,
+	ProfileMethod:       true,
+	CanaryMethod:        true,
+	BacklogMethod:       true,
+}
+
+// MethodPolicy says which RPCs a caller may use. Methods are RPC names such as
+// "Send" or "Cleanup", "*" for every RPC or "admin" for every admin RPC.
+type MethodPolicy struct {
+	// Allow lists the methods that may be called; every method when empty
+	Allow []string `json:"allow,omitempty"`
+	// Deny lists methods that may not be called, even when allowed
+	Deny []string `json:"deny,omitempty"`
+}
+
+// AuthPolicy restricts the RPCs authenticated callers may use
+type AuthPolicy struct {
+	// Services holds the policy of each service. It applies to every credential of the
+	// service. A name pattern such as "payments.>" holds the policy of the services it
+	// matches that have none of their own; the longest matching pattern applies.
+	Services map[string]*MethodPolicy `json:"services,omitempty"`
+	// Keys holds policies of API keys, by key as in APIKeys, on top of their service's
+	Keys map[string]*MethodPolicy `json:"keys,omitempty"`
+	// AdminServices (services or name patterns) and AdminKeys may call admin RPCs. While
+	// both are empty, admin RPCs are refused to every caller.
+	AdminServices []string `json:"admin_services,omitempty"`
+	AdminKeys     []string `json:"admin_keys,omitempty"`
+}
+
+// PolicyDeniedError refuses valid credentials calling a method their policy does not allow
+type PolicyDeniedError struct {
+	Service string
+	Method  string
+	Admin   bool // the method is an admin RPC and the caller is not an admin
+}
+
+func (e *PolicyDeniedError) Error() string {
+	if e.Admin {
+		return fmt.Sprintf("service '%s' may not call admin method %s", e.Service, e.Method)
+	}
+	return fmt.Sprintf("service '%s' may not call %s", e.Service, e.Method)
+}
+
+// KnownMethods returns the names of the broker's RPCs, and of the admin methods of
+// HTTP endpoints without one
+func KnownMethods() []string {
+	methods := []string{ProfileMethod, CanaryMethod, BacklogMethod}
+	for _, m := range pb.Broker_ServiceDesc.Methods {
+		methods = append(methods, m.MethodName)
+	}
+	for _, s := range pb.Broker_ServiceDesc.Streams {
+		methods = append(methods, s.StreamName)
+	}
+	return methods
+}
+
+// matchesMethod reports whether a method pattern selects method
+func matchesMethod(pattern, method string) bool {
+	switch pattern {
+	case PolicyAllMethods:
+		return true
+	case PolicyAdminMethods:
+		return adminMethods[method]
+	default:
+		return pattern == method
+	}
+}
+
+// permits reports whether the policy lets method be called
+func (p *MethodPolicy) permits(method string) bool {
+	for _, pattern := range p.Deny {
+		if matchesMethod(pattern, method) {
+			return false
+		}
+	}
+	if len(p.Allow) == 0 {
+		return true
+	}
+	for _, pattern := range p.Allow {
+		if matchesMethod(pattern, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks that a call of service to the RPC method, with the API key ref
+// when it used one, is allowed
+func (p *AuthPolicy) authorize(service, ref, method string) error {
+	if adminMethods[method] && !p.isAdminService(service) && (ref == "" || !slices.Contains(p.AdminKeys, ref)) {
+		return &PolicyDeniedError{Service: service, Method: method, Admin: true}
+	}
+	if policy := p.servicePolicy(service); policy != nil && !policy.permits(method) {
+		return &PolicyDeniedError{Service: service, Method: method}
+	}
+	if policy := p.Keys[ref]; ref != "" && policy != nil && !policy.permits(method) {
+		return &PolicyDeniedError{Service: service, Method: method}
+	}
+	return nil
+}
+
+// servicePolicy returns the policy of service, or of the longest name pattern matching it
+func (p *AuthPolicy) servicePolicy(service string) *MethodPolicy {
+	if policy, ok := p.Services[service]; ok {
+		return policy
+	}
+	var longest string
+	var policy *MethodPolicy
+	for pattern, candidate := range p.Services {
+		if !protocol.IsPattern(pattern) || !protocol.MatchName(pattern, service) {
+			continue
+		}
+		if len(pattern) > len(longest) || (len(pattern) == len(longest) && pattern < longest) {
+			longest, policy = pattern, candidate
+		}
+	}
+	return policy
+}
+
+// isAdminService reports whether service is one of AdminServices or matches one of them
+func (p *AuthPolicy) isAdminService(service string) bool {
+	return slices.ContainsFunc(p.AdminServices, func(admin string) bool {
+		return admin == service || (protocol.IsPattern(admin) && protocol.MatchName(admin, service))
+	})
+}
+
+// isPermissionDenied reports whether an authentication error refused valid credentials
+func isPermissionDenied(err error) bool {
+	var network *NetworkDeniedError
+	var policy *PolicyDeniedError
+	return errors.As(err, &network) || errors.As(err, &policy)
+}
@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAuthPolicy(t *testing.T) {
+	p := AuthPolicy{
+		Services: map[string]*MethodPolicy{
+			"billing":   {Deny: []string{"Cleanup"}},
+			"reporting": {Allow: []string{"Receive", "Fetch", "Ack"}},
+			"ops":       {Allow: []string{"*"}, Deny: []string{"SetReadOnly"}},
+		},
+		Keys: map[string]*MethodPolicy{
+			"billing-ci": {Allow: []string{"Send"}},
+		},
+		AdminServices: []string{"ops"},
+		AdminKeys:     []string{"billing-admin"},
+	}
+	for _, c := range []struct {
+		service, ref, method string
+		allowed, admin       bool
+	}{
+		{"billing", "", "Send", true, false},
+		{"billing", "", "Cleanup", false, false},
+		{"billing", "billing-ci", "Send", true, false},
+		{"billing", "billing-ci", "Ack", false, false},
+		{"reporting", "", "Fetch", true, false},
+		{"reporting", "", "Send", false, false},
+		{"inventory", "", "Cleanup", true, false},
+		// Admin RPCs are limited to the admin services and keys
+		{"inventory", "", "PauseDelivery", false, true},
+		{"billing", "", "WatchEvents", false, true},
+		{"billing", "billing-admin", "WatchEvents", true, false},
+		{"ops", "", "Tap", true, false},
+		{"ops", "", "SetReadOnly", false, false},
+	} {
+		err := p.authorize(c.service, c.ref, c.method)
+		if c.allowed {
+			if err != nil {
+				t.Errorf("%s (key %q) calling %s: unexpected error %v", c.service, c.ref, c.method, err)
+			}
+			continue
+		}
+		var denied *PolicyDeniedError
+		if !errors.As(err, &denied) {
+			t.Errorf("%s (key %q) calling %s: expected PolicyDeniedError, got %v", c.service, c.ref, c.method, err)
+			continue
+		}
+		if denied.Admin != c.admin {
+			t.Errorf("%s (key %q) calling %s: expected Admin %v, got %v", c.service, c.ref, c.method, c.admin, denied.Admin)
+		}
+	}
+}
+
+func TestAuthPolicyPatterns(t *testing.T) {
+	p := AuthPolicy{
+		Services: map[string]*MethodPolicy{
+			"payments.>":         {Deny: []string{"Cleanup"}},
+			"payments.eu.>":      {Allow: []string{"Send"}},
+			"payments.eu.ledger": {},
+		},
+		AdminServices: []string{"ops.*"},
+	}
+	for _, c := range []struct {
+		service, method string
+		allowed         bool
+	}{
+		{"payments.us.billing", "Send", true},
+		{"payments.us.billing", "Cleanup", false},
+		// The longest pattern applies, and a service's own policy beats every pattern
+		{"payments.eu.billing", "Receive", false},
+		{"payments.eu.ledger", "Cleanup", true},
+		{"payments", "Cleanup", true},
+		{"ops.oncall", "Tap", true},
+		{"ops.oncall.bot", "Tap", false},
+	} {
+		if err := p.authorize(c.service, "", c.method); (err == nil) != c.allowed {
+			t.Errorf("%s calling %s: allowed %v, got %v", c.service, c.method, c.allowed, err)
+		}
+	}
+}
+
+func TestAuthPolicyAdminGroup(t *testing.T) {
+	// Without admin lists admin RPCs are refused to everyone
+	var empty AuthPolicy
+	if err := empty.authorize("monitor", "", "GetQuotaUsage"); err == nil {
+		t.Fatal("expected admin RPCs to be refused without admin lists")
+	}
+	// The "admin" pattern selects all of them
+	p := AuthPolicy{
+		Services:      map[string]*MethodPolicy{"worker": {Deny: []string{"admin"}}},
+		AdminServices: []string{"worker", "monitor"},
+	}
+	if err := p.authorize("monitor", "", "GetQuotaUsage"); err != nil {
+		t.Fatalf("expected an admin service to call admin RPCs, got %v", err)
+	}
+	for _, method := range []string{"PauseDelivery", "ResumeDelivery", "SetReadOnly", "WatchEvents", "Tap", "GetQuotaUsage", "SetLogLevel", "SetPayloadLogging", "SetSlowLogging", "GetStats"} {
+		if err := p.authorize("worker", "", method); err == nil {
+			t.Fatalf("expected %s to be denied", method)
+		}
+	}
+	if err := p.authorize("worker", "", "Send"); err != nil {
+		t.Fatalf("expected Send to be allowed, got %v", err)
+	}
+}
+
+func TestValidatePolicy(t *testing.T) {
+	c := &Config{}
+	c.Auth.APIKeys = map[string]string{"key-1": "billing"}
+	c.Auth.Policy = AuthPolicy{
+		Services:  map[string]*MethodPolicy{"billing": {Allow: []string{"Send", "admin", "Sned"}}},
+		Keys:      map[string]*MethodPolicy{"key-1": {Deny: []string{"*"}}},
+		AdminKeys: []string{"key-2"},
+	}
+	got := map[string]bool{}
+	for _, issue := range c.Validate() {
+		got[issue.Field] = true
+	}
+	for _, field := range []string{"auth.policy.services.billing.allow[2]", "auth.policy.admin_keys[0]"} {
+		if !got[field] {
+			t.Errorf("expected an issue for %s", field)
+		}
+	}
+	for _, field := range []string{"auth.policy.services.billing.allow[0]", "auth.policy.services.billing.allow[1]", "auth.policy.keys." + KeyID("key-1")} {
+		if got[field] {
+			t.Errorf("unexpected issue for %s", field)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package lib
+
+import (
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"path"
+)
+
+// ProfileMethod is the admin method of the pprof endpoints, as named by auth policies
+const ProfileMethod = "Profile"
+
+// ProfileHandler serves the runtime profiles of the broker under /debug/pprof/ to
+// callers with the credentials of an admin (see AuthPolicy.AdminServices). Without
+// authentication nobody is served.
+func (s *Server) ProfileHandler(authManager *AuthManager) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authManager == nil || !authManager.config.EnableAuth {
+			http.Error(w, "profiles need authentication", http.StatusForbidden)
+			return
+		}
+		caller, err := authManager.AuthenticateHTTP(r, ProfileMethod, 0)
+		if err != nil {
+			writeAuthError(w, err)
+			return
+		}
+		profile := path.Base(r.URL.Path)
+		s.metrics.Inc("broker_profiles_served_total", "profile", profile)
+		log.Printf("Serving %s profile to %s (%s)", profile, caller, r.RemoteAddr)
+		mux.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,74 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProfileHandler(t *testing.T) {
+	s := &Server{metrics: NewMetrics()}
+	get := func(authManager *AuthManager, key string) int {
+		r := httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+		if key != "" {
+			r.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		s.ProfileHandler(authManager).ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// Nobody is served without authentication
+	if code := get(nil, ""); code != http.StatusForbidden {
+		t.Fatalf("expected 403 without authentication, got %d", code)
+	}
+	if code := get(NewAuthManager(&AuthConfig{}), ""); code != http.StatusForbidden {
+		t.Fatalf("expected 403 with authentication disabled, got %d", code)
+	}
+
+	// Nor any service while no admin is configured
+	noAdmin := NewAuthManager(&AuthConfig{EnableAuth: true, AuthMethod: AuthMethodAPIKey})
+	if code := get(noAdmin, noAdmin.GenerateAPIKey("billing")); code != http.StatusForbidden {
+		t.Fatalf("expected 403 without an admin, got %d", code)
+	}
+
+	am := NewAuthManager(&AuthConfig{
+		EnableAuth: true,
+		AuthMethod: AuthMethodAPIKey,
+		Policy:     AuthPolicy{AdminServices: []string{"ops"}},
+	})
+	if code := get(am, ""); code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without credentials, got %d", code)
+	}
+	if code := get(am, am.GenerateAPIKey("billing")); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for a non-admin, got %d", code)
+	}
+	if code := get(am, am.GenerateAPIKey("ops")); code != http.StatusOK {
+		t.Fatalf("expected the admin to be served, got %d", code)
+	}
+}
+
+func TestValidatePprof(t *testing.T) {
+	c := &Config{}
+	c.Server.Listeners = []ListenerConfig{{Name: "admin", Kind: ListenerAdmin, Port: "9101", Pprof: true}}
+	pprofError := func() bool {
+		for _, issue := range c.Validate() {
+			if issue.Field == "server.listeners[0].pprof" && issue.Severity == SeverityError {
+				return true
+			}
+		}
+		return false
+	}
+	// Profiles are refused without authentication, and without an admin to serve
+	if !pprofError() {
+		t.Fatal("expected pprof without authentication to be refused")
+	}
+	c.Auth.EnableAuth = true
+	if !pprofError() {
+		t.Fatal("expected pprof without an admin to be refused")
+	}
+	c.Auth.Policy.AdminServices = []string{"ops"}
+	if pprofError() {
+		t.Fatal("expected pprof with an admin to be accepted")
+	}
+}
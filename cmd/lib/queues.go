@@ -0,0 +1,65 @@
+package lib
+
+import (
+	"errors"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"go.mills.io/bitcask/v2"
+)
+
+// QueuedMessages returns up to limit messages queued for a service in delivery
+// order (limit <= 0 returns all) without delivering them. In-flight and delayed
+// messages are included.
+func (s *Server) QueuedMessages(serviceName string, limit int) ([]*pb.Message, error) {
+	prefix := messagePrefix(serviceName)
+	var msgs []*pb.Message
+	err := s.db.Range(prefix, prefixEnd(prefix), bitcask.KeyFunc(func(key bitcask.Key) error {
+		if _, ok := keyVisibleAt(prefix, key); !ok {
+			return nil
+		}
+		if limit > 0 && len(msgs) >= limit {
+			return errBatchFull
+		}
+		value, err := s.db.Get(key)
+		if err != nil {
+			return err
+		}
+		msg := new(pb.Message)
+		if err := decodeStored(value, msg); err != nil {
+			return err
+		}
+		msg.Id = string(key)
+		msgs = append(msgs, msg)
+		return nil
+	}))
+	if err != nil && !errors.Is(err, errBatchFull) {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// QueueLength returns the number of messages queued for a service
+func (s *Server) QueueLength(serviceName string) (int, error) {
+	prefix := messagePrefix(serviceName)
+	n := 0
+	err := s.db.Range(prefix, prefixEnd(prefix), bitcask.KeyFunc(func(key bitcask.Key) error {
+		if _, ok := keyVisibleAt(prefix, key); ok {
+			n++
+		}
+		return nil
+	}))
+	return n, err
+}
+
+// Queues returns the number of queued messages per service
+func (s *Server) Queues() (map[string]int, error) {
+	queues := make(map[string]int)
+	err := s.db.Scan(nil, bitcask.KeyFunc(func(key bitcask.Key) error {
+		if service, ok := keyService(key); ok {
+			queues[service]++
+		}
+		return nil
+	}))
+	return queues, err
+}
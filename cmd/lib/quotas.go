@@ -0,0 +1,212 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// quotaUsage counts a credential's traffic in the current hour and day
+type quotaUsage struct {
+	hour, day               time.Time // start of the current windows
+	hourMessages, hourBytes int64
+	dayMessages, dayBytes   int64
+	used                    time.Time // last charge
+}
+
+// roll starts new windows once now has left the current ones
+func (u *quotaUsage) roll(now time.Time) {
+	now = now.UTC()
+	if hour := now.Truncate(time.Hour); !hour.Equal(u.hour) {
+		u.hour, u.hourMessages, u.hourBytes = hour, 0, 0
+	}
+	if day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC); !day.Equal(u.day) {
+		u.day, u.dayMessages, u.dayBytes = day, 0, 0
+	}
+}
+
+// quotaIdleAfter is how long the usage of a credential that sent nothing is kept;
+// by then both of its windows have ended
+const quotaIdleAfter = 24 * time.Hour
+
+// quotas tracks usage per credential. Counters live in memory and start over on restart.
+type quotas struct {
+	mu       sync.Mutex
+	defaults QuotaConfig
+	usage    map[string]*quotaUsage
+	pruned   time.Time
+}
+
+// WithQuota sets the default hourly and daily traffic quota of every service;
+// services may override it with ServiceConfig.Quota
+func WithQuota(defaults QuotaConfig) ServerOption {
+	return func(s *Server) {
+		s.quotas.defaults = defaults
+	}
+}
+
+// quotaFor returns the quota of a service
+func (s *Server) quotaFor(service string) QuotaConfig {
+	if svc, ok := s.services[service]; ok && svc.Quota != nil {
+		return *svc.Quota
+	}
+	return s.quotas.defaults
+}
+
+// quotaCredential returns who a call is charged to: the service its credentials
+// belong to, or the client address when authentication is off. The sender a message
+// names is not a credential, anyone may name any sender.
+func quotaCredential(ctx context.Context) string {
+	if service := GetServiceNameFromContext(ctx); service != "" {
+		return service
+	}
+	return peerAddress(ctx)
+}
+
+// chargeQuota adds msgs to the usage of the credential of the call, or charges nothing
+// and returns an error when it would exceed its quota. refund takes the charge back
+// for messages the broker did not accept. Messages a linked broker or another shard
+// relays were charged by the broker that took them.
+func (s *Server) chargeQuota(ctx context.Context, msgs []*pb.Message, now time.Time) (refund func(), err error) {
+	credential := quotaCredential(ctx)
+	q := s.quotaFor(credential)
+	if q == (QuotaConfig{}) || s.relayed(ctx) {
+		return func() {}, nil
+	}
+	var messages, bytes int64
+	for _, msg := range msgs {
+		messages++
+		bytes += int64(len(msg.Data))
+	}
+
+	s.quotas.mu.Lock()
+	defer s.quotas.mu.Unlock()
+	s.quotas.prune(now)
+	u := s.quotas.get(credential)
+	u.roll(now)
+	exceeded := func(limit, used, add int64) bool { return limit > 0 && used+add > limit }
+	switch {
+	case exceeded(q.HourlyMessages, u.hourMessages, messages):
+		return nil, fmt.Errorf("%s exceeded its hourly quota of %d messages", credential, q.HourlyMessages)
+	case exceeded(q.HourlyBytes, u.hourBytes, bytes):
+		return nil, fmt.Errorf("%s exceeded its hourly quota of %d bytes", credential, q.HourlyBytes)
+	case exceeded(q.DailyMessages, u.dayMessages, messages):
+		return nil, fmt.Errorf("%s exceeded its daily quota of %d messages", credential, q.DailyMessages)
+	case exceeded(q.DailyBytes, u.dayBytes, bytes):
+		return nil, fmt.Errorf("%s exceeded its daily quota of %d bytes", credential, q.DailyBytes)
+	}
+	u.add(messages, bytes)
+	u.used = now
+	hour, day := u.hour, u.day
+	return func() {
+		s.quotas.mu.Lock()
+		defer s.quotas.mu.Unlock()
+		// A window that ended since took the charge with it
+		if u, ok := s.quotas.usage[credential]; ok {
+			if u.hour.Equal(hour) {
+				u.hourMessages -= messages
+				u.hourBytes -= bytes
+			}
+			if u.day.Equal(day) {
+				u.dayMessages -= messages
+				u.dayBytes -= bytes
+			}
+		}
+	}, nil
+}
+
+// add counts messages and bytes in both windows
+func (u *quotaUsage) add(messages, bytes int64) {
+	u.hourMessages += messages
+	u.hourBytes += bytes
+	u.dayMessages += messages
+	u.dayBytes += bytes
+}
+
+// get returns the usage of a credential, creating it; q.mu must be held
+func (q *quotas) get(credential string) *quotaUsage {
+	if q.usage == nil {
+		q.usage = make(map[string]*quotaUsage)
+	}
+	u, ok := q.usage[credential]
+	if !ok {
+		u = &quotaUsage{}
+		q.usage[credential] = u
+	}
+	return u
+}
+
+// prune forgets the credentials idle for quotaIdleAfter, checking once an hour;
+// q.mu must be held
+func (q *quotas) prune(now time.Time) {
+	if now.Sub(q.pruned) < time.Hour {
+		return
+	}
+	q.pruned = now
+	for credential, u := range q.usage {
+		if now.Sub(u.used) >= quotaIdleAfter {
+			delete(q.usage, credential)
+		}
+	}
+}
+
+// quotaExceeded rejects a send over the sender's quota. Clients may retry once the window resets.
+func (s *Server) quotaExceeded(ctx context.Context, err error) (*pb.Status, error) {
+	s.metrics.Inc("broker_quota_rejections_total", "service", quotaCredential(ctx))
+	return failure(codes.ResourceExhausted, &pb.Status{Message: err.Error(), Success: false, Error: pb.Error_QUOTA_EXCEEDED})
+}
+
+// GetQuotaUsage reports the traffic of the requested services in the current quota windows
+func (s *Server) GetQuotaUsage(ctx context.Context, req *pb.QuotaUsageRequest) (*pb.QuotaUsageResponse, error) {
+	services := req.Services
+	s.quotas.mu.Lock()
+	defer s.quotas.mu.Unlock()
+	if len(services) == 0 {
+		seen := make(map[string]bool)
+		for service := range s.quotas.usage {
+			seen[service] = true
+		}
+		for service, svc := range s.services {
+			if svc.Quota != nil {
+				seen[service] = true
+			}
+		}
+		for service := range seen {
+			services = append(services, service)
+		}
+		sort.Strings(services)
+	}
+	now := time.Now()
+	resp := &pb.QuotaUsageResponse{}
+	for _, service := range services {
+		var u quotaUsage
+		if current, ok := s.quotas.usage[service]; ok {
+			u = *current
+		}
+		u.roll(now)
+		q := s.quotaFor(service)
+		resp.Usage = append(resp.Usage, &pb.QuotaUsage{
+			Service:      service,
+			HourMessages: u.hourMessages,
+			HourBytes:    u.hourBytes,
+			DayMessages:  u.dayMessages,
+			DayBytes:     u.dayBytes,
+			Limits: &pb.QuotaLimits{
+				HourlyMessages: q.HourlyMessages,
+				HourlyBytes:    q.HourlyBytes,
+				DailyMessages:  q.DailyMessages,
+				DailyBytes:     q.DailyBytes,
+			},
+			HourReset: timestamppb.New(u.hour.Add(time.Hour)),
+			DayReset:  timestamppb.New(u.day.AddDate(0, 0, 1)),
+		})
+	}
+	return resp, nil
+}
@@ -0,0 +1,45 @@
+package lib
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+)
+
+func TestQuotaPrunesIdleCredentials(t *testing.T) {
+	s := &Server{}
+	s.quotas.defaults = QuotaConfig{HourlyMessages: 10}
+	ctx := context.WithValue(context.Background(), serviceNameCtxKey{}, "orders")
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if _, err := s.chargeQuota(ctx, []*pb.Message{{Data: []byte("x")}}, start); err != nil {
+		t.Fatalf("chargeQuota failed: %v", err)
+	}
+	other := context.WithValue(context.Background(), serviceNameCtxKey{}, "shipping")
+	if _, err := s.chargeQuota(other, []*pb.Message{{Data: []byte("x")}}, start.Add(quotaIdleAfter)); err != nil {
+		t.Fatalf("chargeQuota failed: %v", err)
+	}
+	if _, ok := s.quotas.usage["orders"]; ok || len(s.quotas.usage) != 1 {
+		t.Fatalf("expected only shipping to be kept, got %v", s.quotas.usage)
+	}
+}
+
+func TestQuotaRefund(t *testing.T) {
+	s := &Server{}
+	s.quotas.defaults = QuotaConfig{HourlyMessages: 1}
+	ctx := context.WithValue(context.Background(), serviceNameCtxKey{}, "orders")
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	msgs := []*pb.Message{{Data: []byte("x")}}
+	refund, err := s.chargeQuota(ctx, msgs, now)
+	if err != nil {
+		t.Fatalf("chargeQuota failed: %v", err)
+	}
+	if _, err := s.chargeQuota(ctx, msgs, now); err == nil {
+		t.Fatalf("expected the quota to be used up")
+	}
+	refund()
+	if _, err := s.chargeQuota(ctx, msgs, now); err != nil {
+		t.Fatalf("expected the refunded message not to count: %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package lib
+
+import (
+	"context"
+	"log"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+)
+
+// WithReadOnly starts the broker in read-only mode
+func WithReadOnly(enabled bool) ServerOption {
+	return func(s *Server) {
+		s.setReadOnly(enabled)
+	}
+}
+
+// SetReadOnly switches read-only mode. While enabled, Send and SendBatch are rejected
+// with READ_ONLY and Receive keeps draining queued messages.
+func (s *Server) SetReadOnly(ctx context.Context, req *pb.ReadOnlyRequest) (*pb.Status, error) {
+	if err := contextError(ctx); err != nil {
+		return serverError(err)
+	}
+	s.setReadOnly(req.Enabled)
+	if req.Enabled {
+		return &pb.Status{Message: "Broker is read-only", Success: true, Error: pb.Error_NONE}, nil
+	}
+	return &pb.Status{Message: "Broker accepts sends", Success: true, Error: pb.Error_NONE}, nil
+}
+
+// ReadOnly reports whether the broker rejects sends
+func (s *Server) ReadOnly() bool {
+	return s.readOnly.Load()
+}
+
+// setReadOnly switches read-only mode, logging changes
+func (s *Server) setReadOnly(enabled bool) {
+	if s.readOnly.Swap(enabled) == enabled {
+		return
+	}
+	if enabled {
+		log.Printf("Read-only mode enabled, sends are rejected")
+	} else {
+		log.Printf("Read-only mode disabled")
+	}
+}
@@ -0,0 +1,345 @@
+package lib
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Receive stream liveness probing defaults
+const (
+	DefaultKeepaliveInterval = 30 * time.Second
+	DefaultKeepaliveTimeout  = 10 * time.Second
+)
+
+// WithKeepalive probes every registered Receive stream with a KEEPALIVE event each
+// interval (0 disables) and reaps streams that fail or block for longer than timeout
+func WithKeepalive(interval, timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.keepaliveInterval = interval
+		if timeout > 0 {
+			s.keepaliveTimeout = timeout
+		}
+	}
+}
+
+// WithHeartbeat sends a lightweight STREAM event from "broker" on every Receive stream
+// that carried nothing for interval (0 disables), so clients can tell an idle stream
+// from a dead one without waiting for TCP timeouts
+func WithHeartbeat(interval time.Duration) ServerOption {
+	return func(s *Server) {
+		s.heartbeatInterval = interval
+	}
+}
+
+// DuplicatePolicy decides what happens when a service opens a Receive stream while
+// another one is registered
+type DuplicatePolicy string
+
+const (
+	// DuplicateReplace ends the previous stream and registers the new one
+	DuplicateReplace DuplicatePolicy = "replace"
+	// DuplicateReject refuses the new stream with AlreadyExists
+	DuplicateReject DuplicatePolicy = "reject"
+	// DuplicateFanOut keeps both: live messages go to every stream and the queue is shared
+	DuplicateFanOut DuplicatePolicy = "fanout"
+)
+
+// ParseDuplicatePolicy validates a duplicate connection policy name
+func ParseDuplicatePolicy(policy string) (DuplicatePolicy, error) {
+	switch DuplicatePolicy(policy) {
+	case "", DuplicateReplace:
+		return DuplicateReplace, nil
+	case DuplicateReject, DuplicateFanOut:
+		return DuplicatePolicy(policy), nil
+	default:
+		return "", fmt.Errorf("invalid duplicate connection policy: %s (use 'replace', 'reject' or 'fanout')", policy)
+	}
+}
+
+// WithDuplicatePolicy sets the default duplicate connection policy; services may override it
+func WithDuplicatePolicy(policy DuplicatePolicy) ServerOption {
+	return func(s *Server) {
+		s.duplicatePolicy = policy
+	}
+}
+
+// duplicatePolicyFor returns the duplicate connection policy of a service
+func (s *Server) duplicatePolicyFor(serviceName string) DuplicatePolicy {
+	if svc, ok := s.services[serviceName]; ok && svc.DuplicateConnections != "" {
+		return DuplicatePolicy(svc.DuplicateConnections)
+	}
+	if s.duplicatePolicy == "" {
+		return DuplicateReplace
+	}
+	return s.duplicatePolicy
+}
+
+// receiver is a registered Receive stream. Sends are serialized because live
+// Sends and the delivery loop write to the same stream.
+type receiver struct {
+	pb.Broker_ReceiveServer
+	service  string
+	instance string
+	mu       sync.Mutex
+	done     chan struct{}
+	once     sync.Once
+	reason   error        // why the receiver was closed, set before done is closed
+	lastSend atomic.Int64 // unix nanoseconds of the last successful send
+	beating  atomic.Bool  // a heartbeat is being sent
+	maxFrame int          // messages encoding to more bytes are sent in chunks
+}
+
+func newReceiver(identity *pb.Identity, stream pb.Broker_ReceiveServer, maxFrame int) *receiver {
+	r := &receiver{Broker_ReceiveServer: stream, service: identity.From, instance: identity.Instance, done: make(chan struct{}), maxFrame: maxFrame}
+	r.lastSend.Store(time.Now().UnixNano())
+	return r
+}
+
+// Send writes msg to the stream unless the receiver was closed. A message too large for
+// one frame is written in chunks, which nothing else is sent between.
+func (r *receiver) Send(msg *pb.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.done:
+		return errReceiverReaped
+	default:
+	}
+	parts := chunks(msg, r.maxFrame)
+	if parts == nil {
+		parts = []*pb.Message{msg}
+	}
+	for _, part := range parts {
+		if err := r.Broker_ReceiveServer.Send(part); err != nil {
+			return err
+		}
+	}
+	r.lastSend.Store(time.Now().UnixNano())
+	return nil
+}
+
+// idle reports how long nothing was sent on the stream
+func (r *receiver) idle() time.Duration {
+	return time.Since(time.Unix(0, r.lastSend.Load()))
+}
+
+// close ends the receiver's Receive call with reason
+func (r *receiver) close(reason error) {
+	r.once.Do(func() {
+		r.reason = reason
+		close(r.done)
+	})
+}
+
+// probe sends a keepalive event and reports whether it went through within timeout.
+// A send blocked on a half-open connection is released once the Receive call ends.
+func (r *receiver) probe(timeout time.Duration) bool {
+	result := make(chan error, 1)
+	go func() {
+		result <- r.Send(&pb.Message{Type: pb.Type_OTHER, Seq: timestamppb.Now(), From: "broker", To: r.address(), Event: pb.Event_KEEPALIVE})
+	}()
+	select {
+	case err := <-result:
+		return err == nil
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// register adds r to the live streams of its service. Streams of different instances
+// coexist; a stream of an instance that is already connected is handled according to
+// the service's duplicate connection policy.
+func (s *Server) register(r *receiver) error {
+	s.registerMu.Lock()
+	defer s.registerMu.Unlock()
+	current := s.liveReceivers(r.service)
+	var duplicates, others []*receiver
+	for _, other := range current {
+		if other.instance == r.instance {
+			duplicates = append(duplicates, other)
+		} else {
+			others = append(others, other)
+		}
+	}
+	if len(duplicates) == 0 {
+		s.clients.Store(r.service, append(append([]*receiver(nil), current...), r))
+		return nil
+	}
+	policy := s.duplicatePolicyFor(r.service)
+	s.metrics.Inc("broker_duplicate_connections_total", "policy", string(policy))
+	switch policy {
+	case DuplicateReject:
+		log.Printf("Rejected duplicate Receive stream of %s", r.address())
+		return status.Errorf(codes.AlreadyExists, "%s already has a Receive stream", r.address())
+	case DuplicateFanOut:
+		s.clients.Store(r.service, append(append([]*receiver(nil), current...), r))
+	default:
+		for _, old := range duplicates {
+			old.close(status.Error(codes.Aborted, "replaced by a newer Receive stream"))
+		}
+		log.Printf("Replaced %d Receive stream(s) of %s", len(duplicates), r.address())
+		s.clients.Store(r.service, append(others, r))
+	}
+	return nil
+}
+
+// address returns the address messages for this stream only are sent to
+func (r *receiver) address() string {
+	return protocol.InstanceAddress(r.service, r.instance)
+}
+
+// unregister removes r from the live streams of its service
+func (s *Server) unregister(r *receiver) {
+	s.registerMu.Lock()
+	defer s.registerMu.Unlock()
+	current := s.liveReceivers(r.service)
+	remaining := make([]*receiver, 0, len(current))
+	for _, other := range current {
+		if other != r {
+			remaining = append(remaining, other)
+		}
+	}
+	switch {
+	case len(remaining) == len(current):
+		// Already replaced or reaped
+	case len(remaining) == 0:
+		s.clients.Delete(r.service)
+	default:
+		s.clients.Store(r.service, remaining)
+	}
+}
+
+// liveReceivers returns the registered streams of a service
+func (s *Server) liveReceivers(service string) []*receiver {
+	receivers, ok := s.clients.Load(service)
+	if !ok {
+		return nil
+	}
+	return receivers.([]*receiver)
+}
+
+// sendLive delivers msg to the live streams of its recipient, reaping the streams
+// that fail. A message addressed to an instance only goes to that instance's streams;
+// otherwise it goes to one stream, or to every stream under the fan-out policy. A
+// message of a partition goes to the instance owning the partition.
+// It reports whether there was a stream and the last send error when none accepted it.
+func (s *Server) sendLive(msg *pb.Message) (bool, error) {
+	service, instance := protocol.SplitAddress(msg.To)
+	fanOut := s.duplicatePolicyFor(service) == DuplicateFanOut
+	only := instance != ""
+	if !only && msg.PartitionKey != "" {
+		instance, only = s.partitionOwner(service, msg.PartitionKey)
+	}
+	live := false
+	var lastErr error
+	start := time.Now()
+	for _, r := range s.liveReceivers(service) {
+		if only && r.instance != instance {
+			continue
+		}
+		live = true
+		if err := r.Send(msg); err != nil {
+			log.Printf("Failed to send message to %s (trace %s): %v", r.address(), msg.TraceId, err)
+			s.reap(r, err.Error())
+			lastErr = err
+			continue
+		}
+		lastErr = nil
+		s.observeDelivery(service, time.Since(start))
+		s.emit(pb.BrokerEventType_BROKER_EVENT_TYPE_DELIVERED, r.address(), msg.Id, msg, "live")
+		if !fanOut {
+			return true, nil
+		}
+	}
+	return live, lastErr
+}
+
+// reap unregisters a dead stream and ends its Receive call
+func (s *Server) reap(r *receiver, reason string) {
+	s.unregister(r)
+	r.close(status.Error(codes.Unavailable, "receive stream stopped responding"))
+	s.metrics.Inc("broker_receivers_reaped_total")
+	log.Printf("Reaped Receive stream of %s: %s", r.address(), reason)
+}
+
+// startKeepalive probes registered streams until the server shuts down
+func (s *Server) startKeepalive() {
+	ticker := time.NewTicker(s.keepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.probeReceivers()
+		}
+	}
+}
+
+// probeReceivers probes every registered stream concurrently and reaps the dead ones
+func (s *Server) probeReceivers() {
+	var wg sync.WaitGroup
+	s.clients.Range(func(_, value any) bool {
+		for _, r := range value.([]*receiver) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if !r.probe(s.keepaliveTimeout) {
+					s.reap(r, "keepalive failed")
+				}
+			}()
+		}
+		return true
+	})
+	wg.Wait()
+}
+
+// startHeartbeat sends heartbeats on idle streams until the server shuts down. Streams
+// are checked twice per interval, so none stays silent for much more than interval.
+func (s *Server) startHeartbeat() {
+	ticker := time.NewTicker(s.heartbeatInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.heartbeatReceivers()
+		}
+	}
+}
+
+// heartbeatReceivers sends a heartbeat on every stream idle for a full interval. Sends
+// run in the background and a blocked one is not repeated; reaping dead streams is
+// left to the keepalive probe.
+func (s *Server) heartbeatReceivers() {
+	s.clients.Range(func(_, value any) bool {
+		for _, r := range value.([]*receiver) {
+			if r.idle() < s.heartbeatInterval || !r.beating.CompareAndSwap(false, true) {
+				continue
+			}
+			go func() {
+				defer r.beating.Store(false)
+				if r.Send(&pb.Message{Type: pb.Type_OTHER, Seq: timestamppb.Now(), From: "broker", To: r.address(), Event: pb.Event_STREAM}) == nil {
+					s.metrics.Inc("broker_heartbeats_sent_total")
+				}
+			}()
+		}
+		return true
+	})
+}
+
+// Connected reports whether a Receive stream is registered for service
+func (s *Server) Connected(service string) bool {
+	return len(s.liveReceivers(service)) > 0
+}
@@ -0,0 +1,48 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// DefaultStreamRecheckInterval is how often the credentials of open streams are
+// validated again
+const DefaultStreamRecheckInterval = 30 * time.Second
+
+// stillValid checks again the credentials a stream was opened with, md and the API
+// key that was used, if any. Tokens may have expired or been revoked since.
+func (am *AuthManager) stillValid(md metadata.MD, key string) error {
+	if key != "" {
+		if _, ok := am.apiKeyService(key); !ok {
+			return fmt.Errorf("API key is no longer valid")
+		}
+		return nil
+	}
+	_, err := am.authenticateJWT(md)
+	return err
+}
+
+// recheckStream validates the credentials of a stream every StreamRecheckInterval
+// until ctx ends, and ends the stream with the reason when they are no longer valid
+func (am *AuthManager) recheckStream(ctx context.Context, cancel context.CancelCauseFunc, md metadata.MD, key string) {
+	interval := am.config.StreamRecheckInterval
+	if interval <= 0 {
+		interval = DefaultStreamRecheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := am.stillValid(md, key); err != nil {
+				cancel(fmt.Errorf("credentials are no longer valid: %w", err))
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultRedactionReplacement stands in for redacted values when a rule sets no replacement
+const DefaultRedactionReplacement = "[REDACTED]"
+
+// RedactionRule hides part of message payloads from observability surfaces (taps, and
+// any other place a payload is shown). It either names a JSON path or a pattern.
+type RedactionRule struct {
+	// Path is a JSON path whose values are replaced in JSON payloads, e.g. "$.card.number"
+	// or "$.items[*].email"; "*" matches every key of an object or element of an array
+	Path string `json:"path,omitempty"`
+	// Pattern is a regular expression whose matches are replaced in any payload
+	Pattern string `json:"pattern,omitempty"`
+	// Replacement defaults to "[REDACTED]"
+	Replacement string `json:"replacement,omitempty"`
+}
+
+// Redactor applies redaction rules to payloads
+type Redactor struct {
+	paths    []redactPath
+	patterns []redactPattern
+}
+
+type redactPath struct {
+	segments    []string
+	replacement string
+}
+
+type redactPattern struct {
+	re          *regexp.Regexp
+	replacement []byte
+}
+
+// NewRedactor compiles redaction rules
+func NewRedactor(rules []RedactionRule) (*Redactor, error) {
+	r := &Redactor{}
+	for i, rule := range rules {
+		if err := r.add(rule); err != nil {
+			return nil, fmt.Errorf("redaction rule %d: %w", i, err)
+		}
+	}
+	return r, nil
+}
+
+func (r *Redactor) add(rule RedactionRule) error {
+	replacement := rule.Replacement
+	if replacement == "" {
+		replacement = DefaultRedactionReplacement
+	}
+	switch {
+	case rule.Path != "" && rule.Pattern != "":
+		return errors.New("sets both a path and a pattern")
+	case rule.Path != "":
+		segments, err := parseRedactPath(rule.Path)
+		if err != nil {
+			return err
+		}
+		r.paths = append(r.paths, redactPath{segments: segments, replacement: replacement})
+	case rule.Pattern != "":
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern: %w", err)
+		}
+		r.patterns = append(r.patterns, redactPattern{re: re, replacement: []byte(replacement)})
+	default:
+		return errors.New("sets neither a path nor a pattern")
+	}
+	return nil
+}
+
+// parseRedactPath splits "$.a.b[*].c" into "a", "b", "*", "c"
+func parseRedactPath(path string) ([]string, error) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if rest == "" {
+		return nil, fmt.Errorf("path %q selects no field", path)
+	}
+	var segments []string
+	for _, part := range strings.Split(rest, ".") {
+		name, index, _ := strings.Cut(part, "[")
+		if name == "" && index == "" {
+			return nil, fmt.Errorf("path %q has an empty segment", path)
+		}
+		if name != "" {
+			segments = append(segments, name)
+		}
+		for index != "" {
+			var elem string
+			var ok bool
+			elem, index, ok = strings.Cut(index, "]")
+			if !ok || (elem != "*" && !isIndex(elem)) {
+				return nil, fmt.Errorf("path %q has an invalid index", path)
+			}
+			segments = append(segments, elem)
+			if index != "" {
+				if index[0] != '[' {
+					return nil, fmt.Errorf("path %q has an invalid index", path)
+				}
+				index = index[1:]
+			}
+		}
+	}
+	return segments, nil
+}
+
+func isIndex(s string) bool {
+	n, err := strconv.Atoi(s)
+	return err == nil && n >= 0
+}
+
+// Enabled reports whether the redactor has any rules
+func (r *Redactor) Enabled() bool {
+	return r != nil && (len(r.paths) > 0 || len(r.patterns) > 0)
+}
+
+// Redact returns data with the rules applied. Paths only apply to payloads that are a
+// JSON object or array, which come back re-encoded; patterns apply to any payload.
+func (r *Redactor) Redact(data []byte) []byte {
+	if !r.Enabled() {
+		return data
+	}
+	if len(r.paths) > 0 {
+		data = r.redactJSON(data)
+	}
+	for _, p := range r.patterns {
+		data = p.re.ReplaceAll(data, p.replacement)
+	}
+	return data
+}
+
+func (r *Redactor) redactJSON(data []byte) []byte {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return data
+	}
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	decoder.UseNumber()
+	var doc any
+	if err := decoder.Decode(&doc); err != nil {
+		return data
+	}
+	changed := false
+	for _, p := range r.paths {
+		doc = redactValue(doc, p.segments, p.replacement, &changed)
+	}
+	if !changed {
+		return data
+	}
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return data
+	}
+	return out
+}
+
+// redactValue replaces the values under segments in v
+func redactValue(v any, segments []string, replacement string, changed *bool) any {
+	if len(segments) == 0 {
+		*changed = true
+		return replacement
+	}
+	segment, rest := segments[0], segments[1:]
+	switch node := v.(type) {
+	case map[string]any:
+		if segment == "*" {
+			for key, child := range node {
+				node[key] = redactValue(child, rest, replacement, changed)
+			}
+		} else if child, ok := node[segment]; ok {
+			node[segment] = redactValue(child, rest, replacement, changed)
+		}
+	case []any:
+		if segment == "*" {
+			for i, child := range node {
+				node[i] = redactValue(child, rest, replacement, changed)
+			}
+		} else if i, err := strconv.Atoi(segment); err == nil && i >= 0 && i < len(node) {
+			node[i] = redactValue(node[i], rest, replacement, changed)
+		}
+	}
+	return v
+}
+
+// WithRedaction hides payload data matching the redactor's rules wherever the broker
+// shows a payload to an operator
+func WithRedaction(r *Redactor) ServerOption {
+	return func(s *Server) {
+		s.redactor = r
+	}
+}
+
+// redacted returns msg, or a copy with its payload redacted when there are redaction rules
+func (s *Server) redacted(msg *pb.Message) *pb.Message {
+	if !s.redactor.Enabled() {
+		return msg
+	}
+	out := proto.Clone(msg).(*pb.Message)
+	out.Data = s.redactor.Redact(out.Data)
+	if !bytes.Equal(out.Data, msg.Data) {
+		// The checksum was of the original payload
+		out.Checksum, out.ChecksumType = nil, pb.ChecksumType_NO_CHECKSUM
+	}
+	return out
+}
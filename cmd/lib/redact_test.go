@@ -0,0 +1,52 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestRedactorPaths(t *testing.T) {
+	r, err := NewRedactor([]RedactionRule{
+		{Path: "$.card.number"},
+		{Path: "$.items[*].email", Replacement: "***"},
+		{Path: "$.missing.field"},
+	})
+	if err != nil {
+		t.Fatalf("NewRedactor failed: %v", err)
+	}
+	got := string(r.Redact([]byte(`{"card":{"number":"4111111111111111","brand":"visa"},"items":[{"email":"a@example.com","n":1},{"email":"b@example.com","n":2}]}`)))
+	want := `{"card":{"brand":"visa","number":"[REDACTED]"},"items":[{"email":"***","n":1},{"email":"***","n":2}]}`
+	if got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+	// Payloads without a matching path, or that are not JSON, are left alone
+	for _, data := range []string{`{"card":"none"}`, `not json {`, `"a string"`} {
+		if got := string(r.Redact([]byte(data))); got != data {
+			t.Fatalf("expected %q unchanged, got %q", data, got)
+		}
+	}
+}
+
+func TestRedactorPatterns(t *testing.T) {
+	r, err := NewRedactor([]RedactionRule{{Pattern: `\b\d{3}-\d{2}-\d{4}\b`, Replacement: "XXX-XX-XXXX"}})
+	if err != nil {
+		t.Fatalf("NewRedactor failed: %v", err)
+	}
+	if got := string(r.Redact([]byte("ssn 123-45-6789 on file"))); got != "ssn XXX-XX-XXXX on file" {
+		t.Fatalf("unexpected redaction: %q", got)
+	}
+}
+
+func TestRedactorInvalidRules(t *testing.T) {
+	for _, rule := range []RedactionRule{
+		{},
+		{Path: "$.a", Pattern: "a"},
+		{Path: "$"},
+		{Path: "$.a..b"},
+		{Path: "$.a[x]"},
+		{Pattern: "("},
+	} {
+		if _, err := NewRedactor([]RedactionRule{rule}); err == nil {
+			t.Fatalf("expected %+v to be rejected", rule)
+		}
+	}
+}
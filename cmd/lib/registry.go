@@ -0,0 +1,217 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	"google.golang.org/grpc/codes"
+)
+
+// What happens to messages from or to services missing from a strict registry
+const (
+	UnknownReject     = "reject"     // refuse the send (default)
+	UnknownQuarantine = "quarantine" // accept the message into the quarantine queue
+)
+
+// DefaultQuarantineQueue receives quarantined messages when no queue is configured
+const DefaultQuarantineQueue = "broker.quarantine"
+
+// QuarantineHeader is set on quarantined messages to why they were quarantined
+const QuarantineHeader = "x-broker-quarantine"
+
+// RegistryConfig lists the services the broker knows. In strict mode a message from
+// or to any other service is rejected or quarantined.
+type RegistryConfig struct {
+	Strict bool `json:"strict,omitempty"`
+	// Services are known besides the services of API keys, of the services section
+	// and of federation links
+	Services []string `json:"services,omitempty"`
+	// Unknown is "reject" or "quarantine"
+	Unknown string `json:"unknown,omitempty"`
+	// Queue receives quarantined messages, "broker.quarantine" by default
+	Queue string `json:"queue,omitempty"`
+}
+
+// check validates the policy of the registry
+func (c RegistryConfig) check() error {
+	switch c.Unknown {
+	case "", UnknownReject, UnknownQuarantine:
+	default:
+		return fmt.Errorf("unknown policy %q (use 'reject' or 'quarantine')", c.Unknown)
+	}
+	if slices.Contains(c.Services, "") {
+		return fmt.Errorf("empty service name")
+	}
+	return nil
+}
+
+// KnownServices returns the services of the registry, of API keys, of the services
+// section and of federation links
+func (c *Config) KnownServices() []string {
+	known := slices.Clone(c.Registry.Services)
+	for _, service := range c.Auth.APIKeys {
+		known = append(known, service)
+	}
+	for service := range c.Services {
+		known = append(known, service)
+	}
+	for _, link := range c.Federation.Links {
+		known = append(known, link.Services...)
+	}
+	slices.Sort(known)
+	return slices.Compact(known)
+}
+
+// registry holds the known services, which wildcard addresses reach, and refuses
+// others when strict
+type registry struct {
+	known map[string]bool
+	// patterns are known name patterns, such as the service of a credential scoped to a prefix
+	patterns   []string
+	strict     bool
+	quarantine bool
+	queue      string
+
+	mu sync.Mutex
+	// unknown counts the messages of each unknown service since the last alert evaluation
+	unknown map[string]int
+}
+
+// WithRegistry records the known services, and rejects or quarantines messages from
+// or to other services once config is strict. Names in known may be name patterns.
+func WithRegistry(config RegistryConfig, known []string) ServerOption {
+	return func(s *Server) {
+		if !config.Strict && len(known) == 0 {
+			return
+		}
+		r := &registry{
+			known:      make(map[string]bool, len(known)),
+			strict:     config.Strict,
+			quarantine: config.Unknown == UnknownQuarantine,
+			queue:      config.Queue,
+			unknown:    make(map[string]int),
+		}
+		if r.queue == "" {
+			r.queue = DefaultQuarantineQueue
+		}
+		for _, service := range known {
+			if protocol.IsPattern(service) {
+				r.patterns = append(r.patterns, service)
+			} else {
+				r.known[service] = true
+			}
+		}
+		s.registry = r
+	}
+}
+
+// isKnown reports whether service is known or matches a known name pattern
+func (r *registry) isKnown(service string) bool {
+	if r.known[service] {
+		return true
+	}
+	for _, pattern := range r.patterns {
+		if protocol.MatchName(pattern, service) {
+			return true
+		}
+	}
+	return false
+}
+
+// unknownServices returns the counts of messages of unknown services since the last
+// call, by service
+func (r *registry) unknownServices() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	unknown := r.unknown
+	r.unknown = make(map[string]int)
+	return unknown
+}
+
+// unknownService returns a service msg names that is not known, if any: its sender,
+// its recipient or a service on its routing slip. Aliases are known, and wildcard
+// addresses only reach known services.
+func (s *Server) unknownService(ctx context.Context, msg *pb.Message) (string, string) {
+	if from := sender(ctx, msg); !s.registry.isKnown(from) {
+		return from, "sender"
+	}
+	for _, address := range append([]string{msg.To}, msg.RoutingSlip...) {
+		to, _ := protocol.SplitAddress(address)
+		if _, alias := s.router.aliases[to]; !s.registry.isKnown(to) && !alias && !protocol.IsPattern(to) {
+			return to, "destination"
+		}
+	}
+	return "", ""
+}
+
+// checkRegistry refuses msgs when one of them names an unknown service, or diverts
+// those that do to the quarantine queue. Calls forwarded by another shard and
+// federated messages were checked by the broker that took them.
+func (s *Server) checkRegistry(ctx context.Context, msgs []*pb.Message) (*pb.Status, error) {
+	if s.registry == nil || !s.registry.strict {
+		return nil, nil
+	}
+	for _, msg := range msgs {
+		if s.checkedUpstream(ctx, msg) {
+			continue
+		}
+		service, role := s.unknownService(ctx, msg)
+		if role == "" {
+			continue
+		}
+		detail := fmt.Sprintf("unknown %s '%s'", role, service)
+		if s.alerts != nil {
+			s.registry.mu.Lock()
+			s.registry.unknown[service]++
+			s.registry.mu.Unlock()
+		}
+		s.emit(pb.BrokerEventType_BROKER_EVENT_TYPE_UNKNOWN_SERVICE, service, "", msg, detail)
+		if !s.registry.quarantine {
+			s.metrics.Inc("broker_unknown_service_messages_total", "service", service, "action", UnknownReject)
+			log.Printf("Rejected message from %s to %s: %s (trace %s)", msg.From, msg.To, detail, msg.TraceId)
+			return failure(codes.NotFound, &pb.Status{Message: "Rejected message: " + detail, Success: false, Error: pb.Error_UNKNOWN_SERVICE})
+		}
+		s.metrics.Inc("broker_unknown_service_messages_total", "service", service, "action", UnknownQuarantine)
+		log.Printf("Quarantined message from %s to %s in %s: %s (trace %s)", msg.From, msg.To, s.registry.queue, detail, msg.TraceId)
+		if msg.Headers == nil {
+			msg.Headers = make(map[string]string)
+		}
+		msg.Headers[QuarantineHeader] = detail
+		msg.To = s.registry.queue
+		msg.RoutingSlip = nil
+		msg.Queue = true
+	}
+	return nil, nil
+}
+
+// quarantined reports whether msg was diverted to the quarantine queue
+func (s *Server) quarantined(msg *pb.Message) bool {
+	return s.registry != nil && s.registry.strict && s.registry.quarantine && msg.To == s.registry.queue && msg.Headers[QuarantineHeader] != ""
+}
+
+// addressable returns the services a wildcard address reaches: the known services and,
+// unless the registry is strict, the services with a Receive stream
+func (s *Server) addressable() []string {
+	var services []string
+	if s.registry != nil {
+		for service := range s.registry.known {
+			services = append(services, service)
+		}
+	}
+	if s.registry == nil || !s.registry.strict {
+		s.clients.Range(func(key, _ any) bool {
+			if service := key.(string); !protocol.IsPattern(service) {
+				services = append(services, service)
+			}
+			return true
+		})
+	}
+	slices.Sort(services)
+	return slices.Compact(services)
+}
@@ -0,0 +1,292 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultReportInterval is how often reports are made when not configured
+const DefaultReportInterval = 24 * time.Hour
+
+// reportTimeout bounds a single webhook or Slack delivery of a report
+const reportTimeout = 30 * time.Second
+
+// reportThroughput are the counters a report shows the activity of the interval with
+var reportThroughput = []string{
+	"broker_messages_received_total",
+	"broker_messages_sent_total",
+	"broker_messages_queued_total",
+	"broker_messages_delivered_total",
+	"broker_messages_acked_total",
+	"broker_messages_nacked_total",
+	"broker_messages_expired_total",
+	"broker_messages_dead_lettered_total",
+}
+
+// reportErrors are the counters a report shows the errors of the interval with
+var reportErrors = []string{
+	"broker_auth_failures_total",
+	"broker_quota_rejections_total",
+	"broker_memory_rejections_total",
+	"broker_disk_admission_blocked_total",
+	"broker_deadline_exceeded_total",
+	"broker_checksum_mismatches_total",
+	"broker_egress_denied_total",
+	"broker_unknown_service_messages_total",
+	"broker_messages_poisoned_total",
+	"broker_mirror_failures_total",
+	"broker_alias_failures_total",
+	"broker_subscription_failures_total",
+	"broker_shard_rejections_total",
+	"broker_federation_rejected_total",
+}
+
+// ReportsConfig makes the broker summarize its queues and activity every interval,
+// for teams without a metrics stack
+type ReportsConfig struct {
+	// Interval is how often a report is made, daily by default
+	Interval time.Duration `json:"interval,omitempty"`
+	// File receives every report as a line of JSON
+	File string `json:"file,omitempty"`
+	// Webhook receives the report as JSON, Slack is an incoming webhook URL; either may be a secret reference
+	Webhook string `json:"webhook,omitempty"`
+	Slack   string `json:"slack,omitempty"`
+	// Email sends the report as plain text
+	Email *ReportEmail `json:"email,omitempty"`
+}
+
+// ReportEmail is the SMTP server and recipients of emailed reports
+type ReportEmail struct {
+	// Server is the host:port of the SMTP server
+	Server string   `json:"server"`
+	From   string   `json:"from"`
+	To     []string `json:"to"`
+	// Username and Password authenticate with PLAIN auth when set; Password may be a secret reference
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// enabled reports whether reports have anywhere to go
+func (c ReportsConfig) enabled() bool {
+	return c.File != "" || c.Webhook != "" || c.Slack != "" || c.Email != nil
+}
+
+// Report summarizes the queues of the broker and its activity since the previous report
+type Report struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Queues are the messages stored for each service at the end of the interval
+	Queues map[string]int `json:"queues"`
+	// Throughput counts the messages received, sent, queued, delivered, acked, nacked,
+	// expired and dead-lettered during the interval
+	Throughput map[string]int64 `json:"throughput"`
+	// Errors counts the failures of the interval by kind; kinds without any are left out
+	Errors map[string]int64 `json:"errors"`
+}
+
+// reporter makes reports. State is only touched by the report loop.
+type reporter struct {
+	config ReportsConfig
+	client *http.Client
+	from   time.Time
+	totals map[string]int64
+}
+
+// WithReports sends a report of the queues and of the activity of the last interval
+// to the configured file, webhook, Slack channel and email recipients
+func WithReports(config ReportsConfig) ServerOption {
+	return func(s *Server) {
+		if !config.enabled() {
+			return
+		}
+		if config.Interval <= 0 {
+			config.Interval = DefaultReportInterval
+		}
+		s.reports = &reporter{
+			config: config,
+			client: &http.Client{Timeout: reportTimeout},
+			from:   time.Now(),
+			totals: s.metrics.Totals(),
+		}
+	}
+}
+
+// reportKind names a counter in a report: broker_messages_acked_total is "acked"
+func reportKind(name string) string {
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "broker_"), "_total")
+	return strings.TrimPrefix(name, "messages_")
+}
+
+// startReports makes a report every interval until the server shuts down
+func (s *Server) startReports() {
+	ticker := time.NewTicker(s.reports.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			report, err := s.makeReport(now)
+			if err != nil {
+				if !errors.Is(err, errServerClosed) {
+					log.Printf("Failed to make report: %v", err)
+				}
+				continue
+			}
+			s.sendReport(report)
+		}
+	}
+}
+
+// makeReport summarizes the queues at now and the counters since the previous report
+func (s *Server) makeReport(now time.Time) (*Report, error) {
+	queues, err := s.Queues()
+	if err != nil {
+		return nil, err
+	}
+	totals := s.metrics.Totals()
+	report := &Report{
+		From:       s.reports.from,
+		To:         now,
+		Queues:     queues,
+		Throughput: make(map[string]int64, len(reportThroughput)),
+		Errors:     make(map[string]int64),
+	}
+	for _, name := range reportThroughput {
+		report.Throughput[reportKind(name)] = totals[name] - s.reports.totals[name]
+	}
+	for _, name := range reportErrors {
+		if n := totals[name] - s.reports.totals[name]; n > 0 {
+			report.Errors[reportKind(name)] = n
+		}
+	}
+	s.reports.from = now
+	s.reports.totals = totals
+	return report, nil
+}
+
+// sendReport delivers report to every configured target
+func (s *Server) sendReport(report *Report) {
+	config := s.reports.config
+	deliver := func(target string, err error) {
+		if err != nil {
+			s.metrics.Inc("broker_reports_failed_total", "target", target)
+			log.Printf("Failed to send report to %s: %v", target, err)
+		}
+	}
+	if config.File != "" {
+		deliver("file", appendReport(config.File, report))
+	}
+	if config.Webhook != "" {
+		deliver("webhook", s.postReport(config.Webhook, report))
+	}
+	if config.Slack != "" {
+		deliver("slack", s.postReport(config.Slack, map[string]string{"text": "```\n" + report.Text() + "```"}))
+	}
+	if config.Email != nil {
+		deliver("email", config.Email.send(report))
+	}
+}
+
+// Text renders the report for people
+func (r *Report) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Broker report from %s to %s\n", r.From.UTC().Format(time.RFC3339), r.To.UTC().Format(time.RFC3339))
+	b.WriteString("\nQueues:\n")
+	if len(r.Queues) == 0 {
+		b.WriteString("  (empty)\n")
+	}
+	services := make([]string, 0, len(r.Queues))
+	for service := range r.Queues {
+		services = append(services, service)
+	}
+	slices.Sort(services)
+	for _, service := range services {
+		fmt.Fprintf(&b, "  %-30s %d\n", service, r.Queues[service])
+	}
+	b.WriteString("\nThroughput:\n")
+	for _, name := range reportThroughput {
+		fmt.Fprintf(&b, "  %-30s %d\n", reportKind(name), r.Throughput[reportKind(name)])
+	}
+	b.WriteString("\nErrors:\n")
+	if len(r.Errors) == 0 {
+		b.WriteString("  (none)\n")
+	}
+	for _, name := range reportErrors {
+		if n, ok := r.Errors[reportKind(name)]; ok {
+			fmt.Fprintf(&b, "  %-30s %d\n", reportKind(name), n)
+		}
+	}
+	return b.String()
+}
+
+// appendReport appends report to path as a line of JSON
+func appendReport(path string, report *Report) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// postReport posts body as JSON to url
+func (s *Server) postReport(url string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.reports.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
+
+// send emails report as plain text
+func (e *ReportEmail) send(report *Report) error {
+	var auth smtp.Auth
+	if e.Username != "" {
+		host, _, err := net.SplitHostPort(e.Server)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", e.Username, e.Password, host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&msg, "Subject: Broker report for %s\r\n", report.To.UTC().Format(time.DateTime))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(report.Text(), "\n", "\r\n"))
+	return smtp.SendMail(e.Server, auth, e.From, e.To, msg.Bytes())
+}
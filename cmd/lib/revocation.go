@@ -0,0 +1,176 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRevocationInterval is how often the broker checks the revocation file for changes
+const DefaultRevocationInterval = 10 * time.Second
+
+// RevocationsPath returns the file next to a config file that lists revoked tokens,
+// e.g. config.revoked.json for config.json
+func RevocationsPath(configPath string) string {
+	return strings.TrimSuffix(configPath, filepath.Ext(configPath)) + ".revoked.json"
+}
+
+// LoadRevocations reads the revoked tokens, by token id (jti) with the time the token
+// expires and can be forgotten; a missing file is empty
+func LoadRevocations(path string) (map[string]time.Time, error) {
+	revoked := make(map[string]time.Time)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return revoked, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read revocations: %w", err)
+	}
+	if err := json.Unmarshal(data, &revoked); err != nil {
+		return nil, fmt.Errorf("failed to parse revocations: %w", err)
+	}
+	return revoked, nil
+}
+
+// RevokeToken adds the token id to the revocation file at path until expires, and
+// drops the entries of tokens that expired meanwhile
+func RevokeToken(path, id string, expires time.Time) error {
+	revoked, err := LoadRevocations(path)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for jti, exp := range revoked {
+		if exp.Before(now) {
+			delete(revoked, jti)
+		}
+	}
+	revoked[id] = expires.UTC()
+	data, err := json.MarshalIndent(revoked, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write revocations: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write revocations: %w", err)
+	}
+	return nil
+}
+
+// revocationList holds the ids of revoked tokens
+type revocationList struct {
+	mu      sync.RWMutex
+	revoked map[string]time.Time
+	modTime time.Time // of the file the list was last loaded from
+}
+
+func (l *revocationList) contains(id string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	_, ok := l.revoked[id]
+	return ok
+}
+
+func (l *revocationList) add(id string, expires time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.revoked == nil {
+		l.revoked = make(map[string]time.Time)
+	}
+	l.revoked[id] = expires
+}
+
+// reload reads the revocation file at path when it changed since the last load.
+// Revocations added with add are kept until their token expires.
+func (l *revocationList) reload(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read revocations: %w", err)
+	}
+	l.mu.RLock()
+	unchanged := info.ModTime().Equal(l.modTime)
+	l.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+	revoked, err := LoadRevocations(path)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for id, expires := range l.revoked {
+		if _, ok := revoked[id]; !ok && expires.After(now) {
+			revoked[id] = expires
+		}
+	}
+	l.revoked = revoked
+	l.modTime = info.ModTime()
+	return nil
+}
+
+// RevokeJWT refuses the token with id (jti) from now on. expires is when the token
+// expires and the revocation can be forgotten.
+func (am *AuthManager) RevokeJWT(id string, expires time.Time) {
+	am.revoked.add(id, expires)
+}
+
+// WatchRevocations loads the revoked tokens from path, and again whenever the file
+// changes, checking every interval until the returned function is called
+func (am *AuthManager) WatchRevocations(path string, interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		interval = DefaultRevocationInterval
+	}
+	if err := am.revoked.reload(path); err != nil {
+		log.Printf("Failed to load token revocations: %v", err)
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := am.revoked.reload(path); err != nil {
+					log.Printf("Failed to load token revocations: %v", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// TokenClaims returns the id and expiry of a token signed by the broker, for revoking
+// it. Expired tokens are refused, as there is nothing left to revoke.
+func (am *AuthManager) TokenClaims(tokenString string) (id string, expires time.Time, err error) {
+	claims, err := am.parseJWT(tokenString)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if claims.ID == "" {
+		return "", time.Time{}, fmt.Errorf("token has no id, it was issued before tokens could be revoked")
+	}
+	if claims.ExpiresAt == nil {
+		return claims.ID, time.Now().Add(am.config.TokenExpiry), nil
+	}
+	return claims.ID, claims.ExpiresAt.Time, nil
+}
@@ -0,0 +1,38 @@
+package lib
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRevokeToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.revoked.json")
+	expired := time.Now().Add(-time.Minute)
+	if err := RevokeToken(path, "old", expired); err != nil {
+		t.Fatalf("RevokeToken failed: %v", err)
+	}
+	if err := RevokeToken(path, "leaked", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("RevokeToken failed: %v", err)
+	}
+	revoked, err := LoadRevocations(path)
+	if err != nil {
+		t.Fatalf("LoadRevocations failed: %v", err)
+	}
+	// Revocations of expired tokens are dropped
+	if _, ok := revoked["old"]; ok || len(revoked) != 1 {
+		t.Fatalf("expected only the leaked token, got %v", revoked)
+	}
+
+	var l revocationList
+	l.add("manual", time.Now().Add(time.Hour))
+	if err := l.reload(path); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if !l.contains("leaked") || !l.contains("manual") || l.contains("old") {
+		t.Fatalf("unexpected revocations after reload: %v", l.revoked)
+	}
+	if err := l.reload(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Fatalf("expected a missing file to be ignored, got %v", err)
+	}
+}
@@ -0,0 +1,563 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Routing actions
+const (
+	RouteTo   = "route" // send to Destinations instead of the recipient
+	RouteCopy = "copy"  // also send a copy to each of Destinations
+	RouteDrop = "drop"  // accept the message without delivering it
+	// RouteMirror sends a shadow copy to each of Destinations, "<recipient>-shadow" by
+	// default, which does not affect the sender or the primary recipient
+	RouteMirror = "mirror"
+	// RouteConvert converts the payload to Format for the recipients the rule matches
+	// once the other rules applied, and evaluation goes on
+	RouteConvert = "convert"
+)
+
+// MirrorSuffix names the default destination of mirror rules
+const MirrorSuffix = "-shadow"
+
+// RoutingConfig holds the rules evaluated on every Send
+type RoutingConfig struct {
+	Rules []RoutingRule `json:"rules,omitempty"`
+	// Aliases are distribution lists: a message to an alias is sent to each of its
+	// members as an independent copy
+	Aliases map[string][]string `json:"aliases,omitempty"`
+	// Canaries split the messages sent to a service between two destinations
+	Canaries map[string]Canary `json:"canaries,omitempty"`
+	// Enrichments add the headers HTTP endpoints answer to the messages they match,
+	// before the rules are evaluated
+	Enrichments []Enrichment `json:"enrichments,omitempty"`
+}
+
+// RoutingRule redirects, copies or drops the messages it matches. The match fields
+// that are set must all hold; From and To are name patterns such as "billing-*" or
+// "payments.>".
+type RoutingRule struct {
+	Name string `json:"name"`
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	// Type is a payload type such as "JSON"
+	Type string `json:"type,omitempty"`
+	// Headers must all be present with these values; "*" matches any value
+	Headers map[string]string `json:"headers,omitempty"`
+	// Action is "route", "copy", "mirror", "drop" or "convert"
+	Action       string   `json:"action"`
+	Destinations []string `json:"destinations,omitempty"`
+	// Format is what convert rules turn payloads into: "json", "xml", "msgpack", "png"
+	// or "jpg"
+	Format string `json:"format,omitempty"`
+}
+
+// Router evaluates routing rules in order. Copy rules add their destinations and
+// evaluation goes on, the first route or drop rule that matches ends it. Canaries
+// then split the resulting destinations, wildcard addresses among them are replaced
+// by the services they match and aliases by their members.
+type Router struct {
+	rules     []RoutingRule
+	aliases   map[string][]string
+	enrichers []*enricher
+
+	mu sync.RWMutex
+	// canaries are in effect, configured are those of the configuration
+	canaries   map[string]Canary
+	configured map[string]Canary
+}
+
+// NewRouter checks the routing rules and aliases of config
+func NewRouter(config RoutingConfig) (*Router, error) {
+	for i, rule := range config.Rules {
+		if err := rule.check(); err != nil {
+			return nil, fmt.Errorf("routing rule %d: %w", i, err)
+		}
+	}
+	for name, members := range config.Aliases {
+		if err := checkAlias(config.Aliases, name, members); err != nil {
+			return nil, fmt.Errorf("alias %q: %w", name, err)
+		}
+	}
+	for service, c := range config.Canaries {
+		if err := c.check(); err != nil {
+			return nil, fmt.Errorf("canary of %q: %w", service, err)
+		}
+	}
+	names := make(map[string]bool)
+	enrichers := make([]*enricher, 0, len(config.Enrichments))
+	for i, e := range config.Enrichments {
+		if err := e.check(); err != nil {
+			return nil, fmt.Errorf("enrichment %d: %w", i, err)
+		}
+		if names[e.Name] {
+			return nil, fmt.Errorf("enrichment %d: duplicate name %q", i, e.Name)
+		}
+		names[e.Name] = true
+		enrichers = append(enrichers, newEnricher(e))
+	}
+	canaries := maps.Clone(config.Canaries)
+	if canaries == nil {
+		canaries = make(map[string]Canary)
+	}
+	return &Router{
+		rules:      config.Rules,
+		aliases:    config.Aliases,
+		enrichers:  enrichers,
+		canaries:   canaries,
+		configured: config.Canaries,
+	}, nil
+}
+
+// newRouter returns a router without rules
+func newRouter() *Router {
+	return &Router{canaries: make(map[string]Canary)}
+}
+
+// active reports whether the router can change any message
+func (r *Router) active() bool {
+	if len(r.rules) > 0 || len(r.aliases) > 0 {
+		return true
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.canaries) > 0
+}
+
+// checkAlias checks the members of an alias, which cannot be aliases themselves
+func checkAlias(aliases map[string][]string, name string, members []string) error {
+	if name == "" {
+		return fmt.Errorf("empty alias name")
+	}
+	if len(members) == 0 {
+		return fmt.Errorf("no members")
+	}
+	for _, member := range members {
+		if member == "" {
+			return fmt.Errorf("empty member")
+		}
+		if _, ok := aliases[member]; ok {
+			return fmt.Errorf("member %q is an alias", member)
+		}
+	}
+	return nil
+}
+
+func (r RoutingRule) check() error {
+	for _, pattern := range []string{r.From, r.To} {
+		if err := protocol.CheckPattern(pattern); pattern != "" && err != nil {
+			return err
+		}
+	}
+	if _, ok := pb.Type_value[r.Type]; r.Type != "" && !ok {
+		return fmt.Errorf("unknown type %q", r.Type)
+	}
+	switch r.Action {
+	case RouteTo, RouteCopy:
+		if len(r.Destinations) == 0 {
+			return fmt.Errorf("action %q needs destinations", r.Action)
+		}
+		if slices.Contains(r.Destinations, "") {
+			return fmt.Errorf("empty destination")
+		}
+	case RouteMirror:
+		if slices.Contains(r.Destinations, "") {
+			return fmt.Errorf("empty destination")
+		}
+	case RouteDrop, RouteConvert:
+		if len(r.Destinations) > 0 {
+			return fmt.Errorf("action %q takes no destinations", r.Action)
+		}
+	default:
+		return fmt.Errorf("unknown action %q (use 'route', 'copy', 'mirror', 'drop' or 'convert')", r.Action)
+	}
+	if r.Action == RouteConvert {
+		return checkFormat(r.Format)
+	}
+	if r.Format != "" {
+		return fmt.Errorf("action %q takes no format", r.Action)
+	}
+	return nil
+}
+
+// matches reports whether msg satisfies every match field of the rule
+func (r RoutingRule) matches(msg *pb.Message) bool {
+	if r.From != "" && !protocol.MatchName(r.From, msg.From) {
+		return false
+	}
+	if r.To != "" && !protocol.MatchName(r.To, msg.To) {
+		return false
+	}
+	if r.Type != "" && msg.Type.String() != r.Type {
+		return false
+	}
+	for key, want := range r.Headers {
+		got, ok := msg.Headers[key]
+		if !ok || (want != "*" && got != want) {
+			return false
+		}
+	}
+	return true
+}
+
+// routed is what the rules and aliases made of a message
+type routed struct {
+	// msgs are the messages to send, none when the message was dropped
+	msgs []*pb.Message
+	// rules are the names of the rules that matched
+	rules []string
+	// aliases maps the members among the recipients of msgs to the alias they came from
+	aliases map[string]string
+	// mirrors are shadow copies, sent besides msgs without affecting the result
+	mirrors []*pb.Message
+	// canaries maps the destinations canaries picked to the service they split
+	canaries map[string]string
+	// wildcards maps the services among the recipients of msgs to the wildcard address
+	// they matched, unmatched lists the wildcard addresses that matched no service
+	wildcards map[string]string
+	unmatched []string
+	// dropped is set when a drop rule applied
+	dropped bool
+	// subscribers are the copies of msgs for subscriptions, sent besides msgs
+	subscribers []*pb.Message
+}
+
+// changed reports whether a rule, a canary, a wildcard or an alias applied
+func (r routed) changed() bool {
+	return len(r.rules) > 0 || len(r.aliases) > 0 || len(r.canaries) > 0 || len(r.wildcards) > 0 || len(r.unmatched) > 0
+}
+
+// mirror returns the shadow copy of msg for to. It keeps no routing slip, so acking
+// it never moves a workflow on.
+func mirror(msg *pb.Message, to string) *pb.Message {
+	c := proto.Clone(msg).(*pb.Message)
+	c.To = to
+	c.Mirrored = true
+	c.RoutingSlip = nil
+	return c
+}
+
+// route evaluates the rules against msg and expands wildcard addresses, to the
+// services returns, and aliases. A message nothing applies to is returned as is.
+func (r *Router) route(msg *pb.Message, services func() []string) routed {
+	var out routed
+	var destinations, copies []string
+	action := ""
+	for _, rule := range r.rules {
+		// Convert rules match the recipients the other rules leave
+		if rule.Action == RouteConvert || !rule.matches(msg) {
+			continue
+		}
+		out.rules = append(out.rules, rule.Name)
+		switch rule.Action {
+		case RouteCopy:
+			copies = append(copies, rule.Destinations...)
+			continue
+		case RouteMirror:
+			shadows := rule.Destinations
+			if len(shadows) == 0 {
+				shadows = []string{msg.To + MirrorSuffix}
+			}
+			for _, to := range shadows {
+				out.mirrors = append(out.mirrors, mirror(msg, to))
+			}
+			continue
+		}
+		action, destinations = rule.Action, rule.Destinations
+		break
+	}
+	switch action {
+	case "":
+		destinations = []string{msg.To}
+	case RouteDrop:
+		out.dropped = true
+	}
+	// The destinations of rules are shared, the picks go to a copy
+	destinations = slices.Clone(destinations)
+	for i, to := range destinations {
+		c, ok := r.canary(to)
+		if !ok {
+			continue
+		}
+		if picked := c.pick(to, msg); picked != to {
+			if out.canaries == nil {
+				out.canaries = make(map[string]string)
+			}
+			out.canaries[picked] = to
+			destinations[i] = picked
+		}
+	}
+	// Copies and mirrors made before a drop are still sent
+	var candidates []string
+	expanded := make([]string, 0, len(destinations)+len(copies))
+	for _, to := range slices.Concat(destinations, copies) {
+		if !protocol.IsPattern(to) {
+			expanded = append(expanded, to)
+			continue
+		}
+		if candidates == nil {
+			candidates = services()
+		}
+		matched := false
+		for _, service := range candidates {
+			if !protocol.MatchName(to, service) {
+				continue
+			}
+			if out.wildcards == nil {
+				out.wildcards = make(map[string]string)
+			}
+			out.wildcards[service] = to
+			expanded = append(expanded, service)
+			matched = true
+		}
+		if !matched {
+			out.unmatched = append(out.unmatched, to)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, to := range expanded {
+		members, ok := r.aliases[to]
+		if !ok {
+			members = []string{to}
+		}
+		for _, member := range members {
+			if seen[member] {
+				continue
+			}
+			seen[member] = true
+			if ok {
+				if out.aliases == nil {
+					out.aliases = make(map[string]string)
+				}
+				out.aliases[member] = to
+			}
+			if member == msg.To {
+				out.msgs = append(out.msgs, msg)
+				continue
+			}
+			c := proto.Clone(msg).(*pb.Message)
+			c.To = member
+			out.msgs = append(out.msgs, c)
+		}
+	}
+	return out
+}
+
+// WithRouting evaluates the router's rules on every Send and SendBatch
+func WithRouting(r *Router) ServerOption {
+	return func(s *Server) {
+		if r != nil {
+			s.router = r
+		}
+	}
+}
+
+// routeMessage applies the routing rules to a message sent by a client and copies it
+// for subscriptions. Calls forwarded by another shard and federated messages were
+// routed by the broker that took them, quarantined messages are not routed.
+func (s *Server) routeMessage(ctx context.Context, msg *pb.Message) routed {
+	if s.checkedUpstream(ctx, msg) || s.quarantined(msg) {
+		return routed{msgs: []*pb.Message{msg}}
+	}
+	// Only mirror rules make shadow copies
+	msg.Mirrored = false
+	if msg.To == "" || (!s.router.active() && !protocol.IsPattern(msg.To)) {
+		return routed{msgs: []*pb.Message{msg}, subscribers: s.subscriberCopies([]*pb.Message{msg})}
+	}
+	out := s.router.route(msg, s.addressable)
+	s.convertMessages(&out)
+	out.subscribers = s.subscriberCopies(out.msgs)
+	for _, rule := range out.rules {
+		s.metrics.Inc("broker_messages_routed_total", "rule", rule)
+	}
+	for to, service := range out.canaries {
+		s.metrics.Inc("broker_canary_messages_total", "service", service, "to", to)
+	}
+	for service, pattern := range out.wildcards {
+		s.metrics.Inc("broker_wildcard_copies_total", "pattern", pattern, "service", service)
+	}
+	for member, alias := range out.aliases {
+		s.metrics.Inc("broker_alias_copies_total", "alias", alias, "member", member)
+	}
+	if out.changed() {
+		mirrored := ""
+		if len(out.mirrors) > 0 {
+			mirrored = ", mirrored to " + recipients(out.mirrors)
+		}
+		s.infof("Routed message from %s to %s: %s%s (rules: %s, trace %s)", msg.From, msg.To,
+			recipients(out.msgs), mirrored, strings.Join(out.rules, ", "), msg.TraceId)
+	}
+	return out
+}
+
+// sendRouted sends a message the egress matrix, the validation rules, the plugins, the
+// scripts and the registry allow to where the routing rules send it once enriched, and
+// its shadow copies once the message was accepted
+func (s *Server) sendRouted(ctx context.Context, msg *pb.Message) (*pb.Status, error) {
+	if st, err := s.checkEgress(ctx, []*pb.Message{msg}); err != nil {
+		return st, err
+	}
+	if st, err := s.checkValidation(ctx, []*pb.Message{msg}); err != nil {
+		return st, err
+	}
+	kept, droppers, st, err := s.applyPlugins(ctx, []*pb.Message{msg})
+	if err != nil {
+		return st, err
+	}
+	if len(kept) == 0 {
+		return &pb.Status{Message: "Message dropped by plugin " + droppers[0], Success: true, Error: pb.Error_NONE}, nil
+	}
+	kept, filters := s.applyScripts(ctx, kept)
+	if len(kept) == 0 {
+		return &pb.Status{Message: "Message dropped by script " + filters[0], Success: true, Error: pb.Error_NONE}, nil
+	}
+	if st, err := s.checkRegistry(ctx, []*pb.Message{msg}); err != nil {
+		return st, err
+	}
+	if st, err := s.enrich(ctx, []*pb.Message{msg}); err != nil {
+		return st, err
+	}
+	out := s.routeMessage(ctx, msg)
+	if out.changed() {
+		st, err = s.sendDestinations(ctx, out)
+	} else {
+		st, err = s.send(ctx, msg)
+	}
+	if err == nil {
+		s.sendMirrors(ctx, out.mirrors)
+		s.sendSubscribers(ctx, out.subscribers)
+	}
+	return st, err
+}
+
+// noMatch refuses a message whose wildcard addresses matched no service
+func noMatch(patterns []string) (*pb.Status, error) {
+	return failure(codes.NotFound, &pb.Status{Message: "No service matches " + strings.Join(patterns, ", "), Success: false, Error: pb.Error_RECIPIENT_OFFLINE})
+}
+
+// sendDestinations sends the messages of out independently; it fails only when every
+// one of them failed
+func (s *Server) sendDestinations(ctx context.Context, out routed) (*pb.Status, error) {
+	if len(out.msgs) == 0 && !out.dropped {
+		return noMatch(out.unmatched)
+	}
+	if len(out.msgs) == 0 {
+		return &pb.Status{Message: "Message dropped by routing rule " + out.rules[len(out.rules)-1], Success: true, Error: pb.Error_NONE}, nil
+	}
+	if len(out.msgs) == 1 && len(out.aliases) == 0 && len(out.wildcards) == 0 {
+		return s.send(ctx, out.msgs[0])
+	}
+	var st *pb.Status
+	var err error
+	failed := 0
+	outcomes := make([]string, 0, len(out.msgs))
+	for _, m := range out.msgs {
+		mst, merr := s.send(ctx, m)
+		if merr == nil {
+			outcomes = append(outcomes, m.To+": ok")
+			continue
+		}
+		if failed == 0 {
+			st, err = mst, merr
+		}
+		failed++
+		outcomes = append(outcomes, m.To+": "+status.Convert(merr).Message())
+		if alias, ok := out.aliases[m.To]; ok {
+			s.metrics.Inc("broker_alias_failures_total", "alias", alias, "member", m.To)
+			log.Printf("Failed to send message for alias %s to %s (trace %s): %v", alias, m.To, m.TraceId, merr)
+		} else if pattern, ok := out.wildcards[m.To]; ok {
+			log.Printf("Failed to send message for %s to %s (trace %s): %v", pattern, m.To, m.TraceId, merr)
+		}
+	}
+	if failed == len(out.msgs) {
+		return st, err
+	}
+	return &pb.Status{Message: "Message routed to " + strings.Join(outcomes, ", "), Success: true, Error: pb.Error_NONE}, nil
+}
+
+// sendMirrors sends shadow copies, whose failures only count against the mirror
+func (s *Server) sendMirrors(ctx context.Context, mirrors []*pb.Message) {
+	for _, m := range mirrors {
+		if _, err := s.send(ctx, m); err != nil {
+			s.metrics.Inc("broker_mirror_failures_total", "to", m.To)
+			log.Printf("Failed to mirror message to %s (trace %s): %v", m.To, m.TraceId, err)
+			continue
+		}
+		s.metrics.Inc("broker_messages_mirrored_total", "to", m.To)
+	}
+}
+
+// sendBatchRouted sends a batch the egress matrix, the validation rules, the plugins,
+// the scripts and the registry allow, its messages going where the routing rules send
+// them once enriched. The messages plugins and scripts dropped are left out.
+func (s *Server) sendBatchRouted(ctx context.Context, batch *pb.Batch) (*pb.Status, error) {
+	if len(batch.Messages) == 0 {
+		return s.sendBatch(ctx, batch)
+	}
+	if st, err := s.checkEgress(ctx, batch.Messages); err != nil {
+		return st, err
+	}
+	if st, err := s.checkValidation(ctx, batch.Messages); err != nil {
+		return st, err
+	}
+	kept, _, st, err := s.applyPlugins(ctx, batch.Messages)
+	if err != nil {
+		return st, err
+	}
+	kept, _ = s.applyScripts(ctx, kept)
+	if len(kept) == 0 {
+		return &pb.Status{Message: "Batch dropped by plugins and scripts", Success: true, Error: pb.Error_NONE}, nil
+	}
+	if st, err := s.checkRegistry(ctx, kept); err != nil {
+		return st, err
+	}
+	if st, err := s.enrich(ctx, kept); err != nil {
+		return st, err
+	}
+	msgs := make([]*pb.Message, 0, len(kept))
+	var mirrors, subscribers []*pb.Message
+	for _, msg := range kept {
+		out := s.routeMessage(ctx, msg)
+		if len(out.msgs) == 0 && !out.dropped {
+			return noMatch(out.unmatched)
+		}
+		msgs = append(msgs, out.msgs...)
+		mirrors = append(mirrors, out.mirrors...)
+		subscribers = append(subscribers, out.subscribers...)
+	}
+	if len(msgs) == 0 {
+		s.sendMirrors(ctx, mirrors)
+		return &pb.Status{Message: "Batch dropped by routing rules", Success: true, Error: pb.Error_NONE}, nil
+	}
+	st, err = s.sendBatch(ctx, &pb.Batch{Messages: msgs})
+	if err == nil {
+		s.sendMirrors(ctx, mirrors)
+		s.sendSubscribers(ctx, subscribers)
+	}
+	return st, err
+}
+
+// recipients lists the recipients of msgs, "nobody" when there are none
+func recipients(msgs []*pb.Message) string {
+	if len(msgs) == 0 {
+		return "nobody"
+	}
+	to := make([]string, len(msgs))
+	for i, msg := range msgs {
+		to[i] = msg.To
+	}
+	return strings.Join(to, ", ")
+}
@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"context"
+	"sync"
+)
+
+// DefaultDeliveryConcurrency is the number of destinations delivered to at once when not configured
+const DefaultDeliveryConcurrency = 16
+
+// scheduler hands out delivery turns. At most slots delivery rounds run at once; when
+// destinations wait for a turn, the next one is picked by smooth weighted round robin,
+// so a destination with a huge backlog cannot starve the others and a destination of
+// weight 3 gets three turns for every turn of a destination of weight 1.
+type scheduler struct {
+	mu      sync.Mutex
+	slots   int // free turns, unlimited when the scheduler was created with 0
+	limited bool
+	waiting map[string]*destinationQueue
+	// current is the smooth weighted round robin state of every destination seen. It
+	// outlives the queues so that a destination that just had a turn is not favoured
+	// again when it comes back.
+	current map[string]int
+}
+
+// destinationQueue holds the streams of one destination waiting for a turn
+type destinationQueue struct {
+	weight  int
+	waiters []chan struct{}
+}
+
+func newScheduler(slots int) *scheduler {
+	return &scheduler{slots: slots, limited: slots > 0, waiting: make(map[string]*destinationQueue), current: make(map[string]int)}
+}
+
+// acquire waits for a delivery turn of destination. The turn must be given back with release.
+func (sc *scheduler) acquire(ctx context.Context, destination string, weight int) error {
+	if !sc.limited {
+		return nil
+	}
+	if weight <= 0 {
+		weight = 1
+	}
+	sc.mu.Lock()
+	if sc.slots > 0 && len(sc.waiting) == 0 {
+		sc.slots--
+		sc.mu.Unlock()
+		return nil
+	}
+	granted := make(chan struct{})
+	q, ok := sc.waiting[destination]
+	if !ok {
+		q = &destinationQueue{}
+		sc.waiting[destination] = q
+	}
+	q.weight = weight
+	q.waiters = append(q.waiters, granted)
+	sc.mu.Unlock()
+
+	select {
+	case <-granted:
+		return nil
+	case <-ctx.Done():
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	select {
+	case <-granted:
+		// Granted while giving up, pass the turn on
+		sc.grant()
+	default:
+		sc.remove(destination, granted)
+	}
+	return ctx.Err()
+}
+
+// release gives a turn back, handing it to the next waiting destination if any
+func (sc *scheduler) release() {
+	if !sc.limited {
+		return
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.grant()
+}
+
+// grant hands a free turn to the destination picked by smooth weighted round robin,
+// or returns it to the pool; sc.mu must be held
+func (sc *scheduler) grant() {
+	var next *destinationQueue
+	var nextName string
+	total := 0
+	for name, q := range sc.waiting {
+		sc.current[name] += q.weight
+		total += q.weight
+		if next == nil || sc.current[name] > sc.current[nextName] || (sc.current[name] == sc.current[nextName] && name < nextName) {
+			next, nextName = q, name
+		}
+	}
+	if next == nil {
+		sc.slots++
+		return
+	}
+	sc.current[nextName] -= total
+	close(next.waiters[0])
+	next.waiters = next.waiters[1:]
+	if len(next.waiters) == 0 {
+		delete(sc.waiting, nextName)
+	}
+}
+
+// remove drops a waiter that gave up; sc.mu must be held
+func (sc *scheduler) remove(destination string, granted chan struct{}) {
+	q, ok := sc.waiting[destination]
+	if !ok {
+		return
+	}
+	for i, w := range q.waiters {
+		if w == granted {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			break
+		}
+	}
+	if len(q.waiters) == 0 {
+		delete(sc.waiting, destination)
+	}
+}
+
+// waitingDestinations returns the number of destinations waiting for a turn
+func (sc *scheduler) waitingDestinations() int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return len(sc.waiting)
+}
+
+// WithDeliveryConcurrency limits how many destinations are delivered to at once
+// (0 = unlimited); destinations then take turns weighted by their priority
+func WithDeliveryConcurrency(n int) ServerOption {
+	return func(s *Server) {
+		s.scheduler = newScheduler(n)
+	}
+}
+
+// priorityFor returns the scheduling weight of a service
+func (s *Server) priorityFor(serviceName string) int {
+	if svc, ok := s.services[serviceName]; ok && svc.Priority > 0 {
+		return svc.Priority
+	}
+	return 1
+}
@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queueTurns makes n waiters of destination wait for a turn and records the order they get it in
+func queueTurns(t *testing.T, sc *scheduler, destination string, weight, n int, order chan<- string) {
+	t.Helper()
+	for range n {
+		before := sc.waitingCount(destination)
+		go func() {
+			if err := sc.acquire(context.Background(), destination, weight); err == nil {
+				order <- destination
+			}
+		}()
+		deadline := time.Now().Add(time.Second)
+		for sc.waitingCount(destination) == before {
+			if time.Now().After(deadline) {
+				t.Fatalf("waiter of %s did not queue", destination)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// waitingCount returns the number of waiters queued for destination
+func (sc *scheduler) waitingCount(destination string) int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if q, ok := sc.waiting[destination]; ok {
+		return len(q.waiters)
+	}
+	return 0
+}
+
+func TestSchedulerWeightedInterleaving(t *testing.T) {
+	sc := newScheduler(1)
+	if err := sc.acquire(context.Background(), "holder", 1); err != nil {
+		t.Fatal(err)
+	}
+	order := make(chan string, 16)
+	queueTurns(t, sc, "backlog", 3, 6, order)
+	queueTurns(t, sc, "small", 1, 2, order)
+
+	var turns []string
+	for range 8 {
+		sc.release()
+		turns = append(turns, <-order)
+	}
+	// Weight 3 to 1: the small destination gets a turn in every group of four
+	got := strings.Join(turns, ",")
+	for i := 0; i < 8; i += 4 {
+		small := 0
+		for _, turn := range turns[i : i+4] {
+			if turn == "small" {
+				small++
+			}
+		}
+		if small != 1 {
+			t.Fatalf("expected one small turn per four, got %s", got)
+		}
+	}
+}
+
+func TestSchedulerNoStarvation(t *testing.T) {
+	sc := newScheduler(1)
+	if err := sc.acquire(context.Background(), "holder", 1); err != nil {
+		t.Fatal(err)
+	}
+	order := make(chan string, 64)
+	queueTurns(t, sc, "huge", 1, 50, order)
+	queueTurns(t, sc, "tiny", 1, 1, order)
+
+	for i := 0; i < 2; i++ {
+		sc.release()
+		if <-order == "tiny" {
+			return
+		}
+	}
+	t.Fatal("a destination queued behind a huge backlog did not get one of the next two turns")
+}
+
+func TestSchedulerCancelledWaiter(t *testing.T) {
+	sc := newScheduler(1)
+	if err := sc.acquire(context.Background(), "holder", 1); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- sc.acquire(ctx, "gone", 1) }()
+	for sc.waitingCount("gone") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err == nil {
+		t.Fatal("expected the cancelled acquire to fail")
+	}
+	// The turn must not be lost to the departed waiter
+	sc.release()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := sc.acquire(ctx, "next", 1); err != nil {
+		t.Fatalf("turn was lost: %v", err)
+	}
+}
+
+func TestSchedulerUnlimited(t *testing.T) {
+	sc := newScheduler(0)
+	for range 100 {
+		if err := sc.acquire(context.Background(), "a", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sc.release()
+	if sc.waitingDestinations() != 0 {
+		t.Fatal("unlimited scheduler queued a waiter")
+	}
+}
@@ -0,0 +1,194 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"slices"
+	"unicode/utf8"
+)
+
+// jsonSchema is the subset of JSON Schema payloads are validated against: type, enum,
+// required, properties, additionalProperties (a boolean), items, minLength,
+// maxLength, pattern, minimum, maximum, minItems and maxItems. Other keywords are
+// ignored.
+type jsonSchema struct {
+	Type                 schemaTypes            `json:"type"`
+	Enum                 []any                  `json:"enum"`
+	Required             []string               `json:"required"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	AdditionalProperties *bool                  `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+
+	pattern *regexp.Regexp
+}
+
+// schemaTypes is the type keyword, a single type name or a list of them
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*t = schemaTypes{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("type must be a string or a list of strings")
+	}
+	*t = many
+	return nil
+}
+
+var schemaTypeNames = []string{"object", "array", "string", "number", "integer", "boolean", "null"}
+
+// compileSchema parses a JSON schema
+func compileSchema(data []byte) (*jsonSchema, error) {
+	var schema jsonSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	if err := schema.compile("$"); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// compile checks the type names and compiles the patterns of s and its subschemas
+func (s *jsonSchema) compile(path string) error {
+	for _, t := range s.Type {
+		if !slices.Contains(schemaTypeNames, t) {
+			return fmt.Errorf("%s: unknown type %q", path, t)
+		}
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("%s: invalid pattern: %w", path, err)
+		}
+		s.pattern = re
+	}
+	for name, property := range s.Properties {
+		if err := property.compile(path + "." + name); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile(path + "[]")
+	}
+	return nil
+}
+
+// validateJSON decodes data and validates it against s
+func (s *jsonSchema) validateJSON(data []byte) error {
+	var value any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Errorf("payload is not valid JSON: %v", err)
+	}
+	if decoder.More() {
+		return fmt.Errorf("payload is not valid JSON: data after the top-level value")
+	}
+	return s.validate(value, "$")
+}
+
+// schemaType returns the JSON Schema type of a decoded value
+func schemaType(value any) string {
+	switch v := value.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case bool:
+		return "boolean"
+	default:
+		return "null"
+	}
+}
+
+// validate checks a decoded value at path against s
+func (s *jsonSchema) validate(value any, path string) error {
+	if len(s.Type) > 0 {
+		t := schemaType(value)
+		if !slices.Contains(s.Type, t) && !(t == "integer" && slices.Contains(s.Type, "number")) {
+			return fmt.Errorf("%s: expected %s, got %s", path, s.Type.String(), t)
+		}
+	}
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(allowed any) bool { return reflect.DeepEqual(allowed, value) }) {
+		return fmt.Errorf("%s: value is not one of the allowed values", path)
+	}
+	switch v := value.(type) {
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+		for name, property := range v {
+			if schema, ok := s.Properties[name]; ok {
+				if err := schema.validate(property, path+"."+name); err != nil {
+					return err
+				}
+			} else if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+				return fmt.Errorf("%s: unexpected property %q", path, name)
+			}
+		}
+	case []any:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fmt.Errorf("%s: expected at least %d items, got %d", path, *s.MinItems, len(v))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fmt.Errorf("%s: expected at most %d items, got %d", path, *s.MaxItems, len(v))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				if err := s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			return fmt.Errorf("%s: expected at least %d characters, got %d", path, *s.MinLength, n)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fmt.Errorf("%s: expected at most %d characters, got %d", path, *s.MaxLength, n)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fmt.Errorf("%s: does not match %s", path, s.Pattern)
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			return fmt.Errorf("%s: %g is below the minimum of %g", path, v, *s.Minimum)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			return fmt.Errorf("%s: %g is above the maximum of %g", path, v, *s.Maximum)
+		}
+	}
+	return nil
+}
+
+func (t schemaTypes) String() string {
+	if len(t) == 1 {
+		return t[0]
+	}
+	return fmt.Sprintf("one of %v", []string(t))
+}
@@ -0,0 +1,309 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Script limits
+const (
+	DefaultScriptTimeout = 50 * time.Millisecond
+	// DefaultScriptReloadInterval is how often script files are checked for changes
+	DefaultScriptReloadInterval = 5 * time.Second
+)
+
+// ScriptConfig is a Lua script run on the messages sent to some services. The script
+// defines on_message(msg), msg being a table with from, to, type, data and headers;
+// the function may change msg.headers and returns false to drop the message.
+type ScriptConfig struct {
+	Name string `json:"name"`
+	// Path is the .lua file of the script, reloaded when it changes
+	Path string `json:"path"`
+	// Services are the recipients the script sees, names or name patterns; every
+	// recipient when empty
+	Services []string `json:"services,omitempty"`
+	// Timeout bounds each call (default 50ms)
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// script is a loaded script. Lua states are not safe for concurrent use, so calls take
+// turns on its state.
+type script struct {
+	ScriptConfig
+
+	mu      sync.Mutex
+	state   *lua.LState
+	modTime time.Time
+}
+
+// Scripts are the loaded Lua scripts, called in order on Send
+type Scripts struct {
+	scripts []*script
+}
+
+// LoadScripts checks the script configurations and loads their files
+func LoadScripts(configs []ScriptConfig) (*Scripts, error) {
+	s := &Scripts{}
+	names := make(map[string]bool)
+	for i, config := range configs {
+		if err := config.check(); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("script %d: %w", i, err)
+		}
+		if names[config.Name] {
+			s.Close()
+			return nil, fmt.Errorf("script %d: duplicate name %q", i, config.Name)
+		}
+		names[config.Name] = true
+		if config.Timeout == 0 {
+			config.Timeout = DefaultScriptTimeout
+		}
+		loaded := &script{ScriptConfig: config}
+		if _, err := loaded.reload(); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("script %s: %w", config.Name, err)
+		}
+		s.scripts = append(s.scripts, loaded)
+	}
+	return s, nil
+}
+
+func (c ScriptConfig) check() error {
+	if c.Name == "" {
+		return errors.New("name is required")
+	}
+	if c.Path == "" {
+		return errors.New("path is required")
+	}
+	for _, service := range c.Services {
+		if err := protocol.CheckPattern(service); err != nil {
+			return err
+		}
+	}
+	if c.Timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+	return nil
+}
+
+// newScriptState runs the script at path in a state with the base, string, table and
+// math libraries, without access to files
+func newScriptState(path string) (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	if err := L.DoFile(path); err != nil {
+		L.Close()
+		return nil, err
+	}
+	if _, ok := L.GetGlobal("on_message").(*lua.LFunction); !ok {
+		L.Close()
+		return nil, errors.New("script does not define on_message")
+	}
+	return L, nil
+}
+
+// reload loads the script file when it changed since it was last loaded. A script
+// that fails to load keeps running its previous version.
+func (sc *script) reload() (bool, error) {
+	info, err := os.Stat(sc.Path)
+	if err != nil {
+		return false, err
+	}
+	sc.mu.Lock()
+	unchanged := info.ModTime().Equal(sc.modTime)
+	sc.mu.Unlock()
+	if unchanged {
+		return false, nil
+	}
+	L, err := newScriptState(sc.Path)
+	if err != nil {
+		return false, err
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.state != nil {
+		sc.state.Close()
+	}
+	sc.state = L
+	sc.modTime = info.ModTime()
+	return true, nil
+}
+
+// Watch reloads the scripts whose file changed every interval until stop is called
+func (s *Scripts) Watch(interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		interval = DefaultScriptReloadInterval
+	}
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				for _, sc := range s.scripts {
+					if reloaded, err := sc.reload(); err != nil {
+						log.Printf("Failed to reload script %s, keeping the previous version: %v", sc.Name, err)
+					} else if reloaded {
+						log.Printf("Reloaded script %s from %s", sc.Name, sc.Path)
+					}
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// Close closes the states of the scripts
+func (s *Scripts) Close() {
+	if s == nil {
+		return
+	}
+	for _, sc := range s.scripts {
+		sc.mu.Lock()
+		if sc.state != nil {
+			sc.state.Close()
+			sc.state = nil
+		}
+		sc.mu.Unlock()
+	}
+}
+
+// WithScripts calls the scripts of sc on the messages sent to the broker. The server
+// closes sc when it closes.
+func WithScripts(sc *Scripts) ServerOption {
+	return func(s *Server) {
+		if sc != nil && len(sc.scripts) > 0 {
+			s.scripts = sc
+		}
+	}
+}
+
+// applies reports whether the script sees messages sent to service
+func (sc *script) applies(service string) bool {
+	if len(sc.Services) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(sc.Services, func(pattern string) bool {
+		return protocol.MatchName(pattern, service)
+	})
+}
+
+// call runs on_message on msg, sets the headers the script left in msg.headers and
+// reports whether the message is to be delivered
+func (sc *script) call(ctx context.Context, msg *pb.Message) (bool, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	L := sc.state
+	if L == nil {
+		return true, errors.New("script is closed")
+	}
+	ctx, cancel := context.WithTimeout(ctx, sc.Timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	defer L.RemoveContext()
+
+	headers := L.NewTable()
+	for key, value := range msg.Headers {
+		headers.RawSetString(key, lua.LString(value))
+	}
+	table := L.NewTable()
+	table.RawSetString("from", lua.LString(msg.From))
+	table.RawSetString("to", lua.LString(msg.To))
+	table.RawSetString("type", lua.LString(msg.Type.String()))
+	table.RawSetString("data", lua.LString(msg.Data))
+	table.RawSetString("headers", headers)
+	if err := L.CallByParam(lua.P{Fn: L.GetGlobal("on_message"), NRet: 1, Protect: true}, table); err != nil {
+		return true, err
+	}
+	deliver := L.Get(-1) != lua.LFalse
+	L.Pop(1)
+
+	headers, ok := table.RawGetString("headers").(*lua.LTable)
+	if !ok {
+		return true, errors.New("msg.headers is not a table")
+	}
+	changed := make(map[string]string)
+	headers.ForEach(func(key, value lua.LValue) {
+		if k, ok := key.(lua.LString); ok && value != lua.LNil {
+			changed[string(k)] = lua.LVAsString(value)
+		}
+	})
+	msg.Headers = changed
+	return deliver, nil
+}
+
+// applyScripts runs the scripts on msgs in order and returns the messages to send,
+// without those a script dropped, and the scripts that dropped messages. A script that
+// fails leaves the message as it was, so that a broken script never stops traffic.
+// Calls forwarded by another shard and federated messages went through the scripts of
+// the broker that took them.
+func (s *Server) applyScripts(ctx context.Context, msgs []*pb.Message) ([]*pb.Message, []string) {
+	if s.scripts == nil {
+		return msgs, nil
+	}
+	kept := make([]*pb.Message, 0, len(msgs))
+	var droppers []string
+	for _, msg := range msgs {
+		if s.checkedUpstream(ctx, msg) {
+			kept = append(kept, msg)
+			continue
+		}
+		service, _ := protocol.SplitAddress(msg.To)
+		deliver := true
+		for _, sc := range s.scripts.scripts {
+			if !sc.applies(service) {
+				continue
+			}
+			ok, err := sc.call(ctx, msg)
+			if err != nil {
+				s.metrics.Inc("broker_script_failures_total", "script", sc.Name)
+				log.Printf("Script %s failed on message from %s to %s (trace %s): %v", sc.Name, msg.From, msg.To, msg.TraceId, err)
+				continue
+			}
+			if !ok {
+				s.metrics.Inc("broker_messages_filtered_total", "script", sc.Name)
+				droppers = append(droppers, sc.Name)
+				deliver = false
+				break
+			}
+		}
+		if deliver {
+			kept = append(kept, msg)
+		}
+	}
+	return kept, droppers
+}
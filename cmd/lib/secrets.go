@@ -0,0 +1,401 @@
+package lib
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecretProvider resolves secret references of a single URL scheme, e.g. vault://secret/data/broker#jwt_secret
+type SecretProvider interface {
+	Resolve(ctx context.Context, ref *url.URL) (string, error)
+}
+
+// SecretProviderFunc adapts a function to SecretProvider
+type SecretProviderFunc func(ctx context.Context, ref *url.URL) (string, error)
+
+func (f SecretProviderFunc) Resolve(ctx context.Context, ref *url.URL) (string, error) {
+	return f(ctx, ref)
+}
+
+var (
+	secretProvidersMu sync.RWMutex
+	secretProviders   = map[string]SecretProvider{
+		"env":    SecretProviderFunc(resolveEnvSecret),
+		"file":   SecretProviderFunc(resolveFileSecret),
+		"vault":  SecretProviderFunc(resolveVaultSecret),
+		"aws-sm": SecretProviderFunc(resolveAWSSecret),
+	}
+)
+
+// RegisterSecretProvider makes a provider available for references with the given scheme
+func RegisterSecretProvider(scheme string, provider SecretProvider) {
+	secretProvidersMu.Lock()
+	defer secretProvidersMu.Unlock()
+	secretProviders[scheme] = provider
+}
+
+func secretProvider(value string) (SecretProvider, bool) {
+	scheme, _, ok := strings.Cut(value, "://")
+	if !ok {
+		return nil, false
+	}
+	secretProvidersMu.RLock()
+	defer secretProvidersMu.RUnlock()
+	provider, ok := secretProviders[scheme]
+	return provider, ok
+}
+
+// IsSecretRef reports whether value references a registered secret provider
+func IsSecretRef(value string) bool {
+	_, ok := secretProvider(value)
+	return ok
+}
+
+// ResolveSecret returns the secret a reference points to. Values that are not references are returned unchanged.
+func ResolveSecret(ctx context.Context, value string) (string, error) {
+	provider, ok := secretProvider(value)
+	if !ok {
+		return value, nil
+	}
+	ref, err := url.Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid secret reference: %w", err)
+	}
+	secret, err := provider.Resolve(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve secret %s://%s%s: %w", ref.Scheme, ref.Host, ref.Path, err)
+	}
+	return secret, nil
+}
+
+// ResolveSecrets returns a copy of the auth configuration with every secret reference resolved.
+// The original is left untouched so saving the config never writes resolved secrets to disk.
+func (a AuthConfig) ResolveSecrets(ctx context.Context) (*AuthConfig, error) {
+	resolved := a
+	var err error
+	if resolved.JWTSecret, err = ResolveSecret(ctx, a.JWTSecret); err != nil {
+		return nil, err
+	}
+	resolved.APIKeys = make(map[string]string, len(a.APIKeys))
+	resolved.keyRefs = make(map[string]string)
+	for ref, service := range a.APIKeys {
+		key, err := ResolveSecret(ctx, ref)
+		if err != nil {
+			return nil, fmt.Errorf("API key for %s: %w", service, err)
+		}
+		resolved.APIKeys[key] = service
+		if key != ref {
+			resolved.keyRefs[key] = ref
+		}
+	}
+	return &resolved, nil
+}
+
+// ResolveSecrets returns a copy of the alert configuration with the webhook URLs resolved
+func (a AlertsConfig) ResolveSecrets(ctx context.Context) (*AlertsConfig, error) {
+	resolved := a
+	resolved.Rules = make([]AlertRule, len(a.Rules))
+	for i, rule := range a.Rules {
+		var err error
+		if rule.Webhook, err = ResolveSecret(ctx, rule.Webhook); err != nil {
+			return nil, fmt.Errorf("webhook of alert %s: %w", rule.Name, err)
+		}
+		if rule.Slack, err = ResolveSecret(ctx, rule.Slack); err != nil {
+			return nil, fmt.Errorf("slack URL of alert %s: %w", rule.Name, err)
+		}
+		resolved.Rules[i] = rule
+	}
+	return &resolved, nil
+}
+
+// ResolveSecrets returns a copy of the report configuration with the webhook URLs and
+// the SMTP password resolved
+func (r ReportsConfig) ResolveSecrets(ctx context.Context) (*ReportsConfig, error) {
+	resolved := r
+	var err error
+	if resolved.Webhook, err = ResolveSecret(ctx, r.Webhook); err != nil {
+		return nil, fmt.Errorf("report webhook: %w", err)
+	}
+	if resolved.Slack, err = ResolveSecret(ctx, r.Slack); err != nil {
+		return nil, fmt.Errorf("report slack URL: %w", err)
+	}
+	if r.Email != nil {
+		email := *r.Email
+		if email.Password, err = ResolveSecret(ctx, r.Email.Password); err != nil {
+			return nil, fmt.Errorf("report email password: %w", err)
+		}
+		resolved.Email = &email
+	}
+	return &resolved, nil
+}
+
+// ResolveSecrets returns a copy of the federation configuration with the link credentials resolved
+func (f FederationConfig) ResolveSecrets(ctx context.Context) (*FederationConfig, error) {
+	resolved := f
+	resolved.Links = make([]FederationLink, len(f.Links))
+	for i, link := range f.Links {
+		var err error
+		if link.Credential, err = ResolveSecret(ctx, link.Credential); err != nil {
+			return nil, fmt.Errorf("credential of federation link %s: %w", link.Name, err)
+		}
+		resolved.Links[i] = link
+	}
+	return &resolved, nil
+}
+
+// ResolveSecrets returns a copy of the offload configuration with the object store credentials resolved
+func (o OffloadConfig) ResolveSecrets(ctx context.Context) (*OffloadConfig, error) {
+	resolved := o
+	var err error
+	if resolved.AccessKey, err = ResolveSecret(ctx, o.AccessKey); err != nil {
+		return nil, fmt.Errorf("offload access key: %w", err)
+	}
+	if resolved.SecretKey, err = ResolveSecret(ctx, o.SecretKey); err != nil {
+		return nil, fmt.Errorf("offload secret key: %w", err)
+	}
+	return &resolved, nil
+}
+
+// LoadKeyPair loads a TLS certificate pair. Each side is either a file path or a secret reference holding PEM data.
+func LoadKeyPair(ctx context.Context, certRef, keyRef string) (tls.Certificate, error) {
+	if !IsSecretRef(certRef) && !IsSecretRef(keyRef) {
+		return tls.LoadX509KeyPair(certRef, keyRef)
+	}
+	load := func(ref string) ([]byte, error) {
+		if IsSecretRef(ref) {
+			secret, err := ResolveSecret(ctx, ref)
+			return []byte(secret), err
+		}
+		return os.ReadFile(ref)
+	}
+	certPEM, err := load(certRef)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := load(keyRef)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// env://NAME
+func resolveEnvSecret(ctx context.Context, ref *url.URL) (string, error) {
+	value, ok := os.LookupEnv(ref.Host)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", ref.Host)
+	}
+	return value, nil
+}
+
+// file:///path/to/secret
+func resolveFileSecret(ctx context.Context, ref *url.URL) (string, error) {
+	data, err := os.ReadFile(ref.Host + ref.Path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+var secretHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// vault://mount/path#field, using VAULT_ADDR and VAULT_TOKEN. Both KV v1 and v2 responses are understood.
+func resolveVaultSecret(ctx context.Context, ref *url.URL) (string, error) {
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", fmt.Errorf("VAULT_ADDR is not set")
+	}
+	field := ref.Fragment
+	if field == "" {
+		field = "value"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(addr, "/")+"/v1/"+ref.Host+ref.Path, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	body, err := doSecretRequest(req)
+	if err != nil {
+		return "", err
+	}
+
+	var response struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", fmt.Errorf("failed to decode vault response: %w", err)
+	}
+	data := response.Data
+	if nested, ok := data["data"]; ok {
+		var kv2 map[string]json.RawMessage
+		if err := json.Unmarshal(nested, &kv2); err == nil {
+			data = kv2
+		}
+	}
+	return secretField(data, field)
+}
+
+// aws-sm://secret-id#field, using the standard AWS_* environment credentials.
+// Without a field the whole SecretString is returned.
+func resolveAWSSecret(ctx context.Context, ref *url.URL) (string, error) {
+	region := ref.Query().Get("region")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		return "", fmt.Errorf("AWS region is not set")
+	}
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return "", fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_SECRETS_MANAGER")
+	if endpoint == "" {
+		endpoint = "https://secretsmanager." + region + ".amazonaws.com"
+	}
+
+	payload, err := json.Marshal(map[string]string{"SecretId": strings.TrimPrefix(ref.Host+ref.Path, "/")})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/", strings.NewReader(string(payload)))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	signAWSRequest(req, payload, accessKey, secretKey, region, "secretsmanager", time.Now().UTC())
+	body, err := doSecretRequest(req)
+	if err != nil {
+		return "", err
+	}
+
+	var response struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", fmt.Errorf("failed to decode secrets manager response: %w", err)
+	}
+	if ref.Fragment == "" {
+		return response.SecretString, nil
+	}
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(response.SecretString), &data); err != nil {
+		return "", fmt.Errorf("secret is not a JSON object, cannot select field %q", ref.Fragment)
+	}
+	return secretField(data, ref.Fragment)
+}
+
+func doSecretRequest(req *http.Request) ([]byte, error) {
+	resp, err := secretHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", req.URL.Host, resp.Status)
+	}
+	return body, nil
+}
+
+func secretField(data map[string]json.RawMessage, field string) (string, error) {
+	raw, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("field %q not found", field)
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", fmt.Errorf("field %q is not a string", field)
+	}
+	return value, nil
+}
+
+// signAWSRequest adds an AWS Signature Version 4 Authorization header
+func signAWSRequest(req *http.Request, payload []byte, accessKey, secretKey, region, service string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("Host", req.URL.Host)
+
+	var names []string
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(req.Header.Get(name)) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	payloadHash := sha256.Sum256(payload)
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, awsCanonicalQuery(req.URL.Query()), canonicalHeaders.String(), signedHeaders, hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signature := hex.EncodeToString(hmacSHA256(awsSigningKey(secretKey, date, region, service), stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// awsCanonicalQuery encodes query parameters as Signature Version 4 signs them:
+// URI-encoded and sorted by name, then value
+func awsCanonicalQuery(query url.Values) string {
+	var params []string
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, awsEscape(name, false)+"="+awsEscape(value, false))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// awsSigningKey derives the Signature Version 4 key of a day, region and service
+func awsSigningKey(secretKey, date, region, service string) []byte {
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return key
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
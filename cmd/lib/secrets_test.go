@@ -0,0 +1,162 @@
+package lib
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// AWS's Signature Version 4 examples, signed with their example credentials
+const (
+	awsExampleAccessKey = "AKIDEXAMPLE"
+	awsExampleSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+func TestAWSSigningKey(t *testing.T) {
+	// From "Examples of how to derive a signing key for Signature Version 4"
+	got := hex.EncodeToString(awsSigningKey(awsExampleSecretKey, "20120215", "us-east-1", "iam"))
+	if want := "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"; got != want {
+		t.Fatalf("expected signing key %s, got %s", want, got)
+	}
+}
+
+func TestSignAWSRequest(t *testing.T) {
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	for _, c := range []struct {
+		name, method, url, service string
+		headers                    map[string]string
+		signedHeaders, signature   string
+	}{
+		// The get-vanilla, post-vanilla and get-vanilla-query-order-key-case cases of the
+		// Signature Version 4 test suite
+		{"get-vanilla", http.MethodGet, "https://example.amazonaws.com/", "service", nil,
+			"host;x-amz-date", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"post-vanilla", http.MethodPost, "https://example.amazonaws.com/", "service", nil,
+			"host;x-amz-date", "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+		{"get-vanilla-query-order-key-case", http.MethodGet, "https://example.amazonaws.com/?Param2=value2&Param1=value1", "service", nil,
+			"host;x-amz-date", "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+		// The IAM ListUsers example of the signing documentation
+		{"iam-list-users", http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", "iam",
+			map[string]string{"Content-Type": "application/x-www-form-urlencoded; charset=utf-8"},
+			"content-type;host;x-amz-date", "5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"},
+	} {
+		req, err := http.NewRequest(c.method, c.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range c.headers {
+			req.Header.Set(name, value)
+		}
+		signAWSRequest(req, nil, awsExampleAccessKey, awsExampleSecretKey, "us-east-1", c.service, now)
+		want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/" + c.service + "/aws4_request, " +
+			"SignedHeaders=" + c.signedHeaders + ", Signature=" + c.signature
+		if got := req.Header.Get("Authorization"); got != want {
+			t.Errorf("%s: expected\n%s\ngot\n%s", c.name, want, got)
+		}
+	}
+}
+
+func TestResolveVaultSecret(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root-token" || r.Header.Get("X-Vault-Namespace") != "payments" {
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/broker":
+			// KV v2 nests the fields under data.data
+			io.WriteString(w, `{"data":{"data":{"jwt_secret":"kv2-secret","value":"default"},"metadata":{"version":3}}}`)
+		case "/v1/kv/broker":
+			io.WriteString(w, `{"data":{"jwt_secret":"kv1-secret","port":9000}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer vault.Close()
+	t.Setenv("VAULT_ADDR", vault.URL+"/")
+	t.Setenv("VAULT_TOKEN", "root-token")
+	t.Setenv("VAULT_NAMESPACE", "payments")
+	ctx := context.Background()
+
+	for ref, want := range map[string]string{
+		"vault://secret/data/broker#jwt_secret": "kv2-secret",
+		"vault://secret/data/broker":            "default",
+		"vault://kv/broker#jwt_secret":          "kv1-secret",
+	} {
+		if got, err := ResolveSecret(ctx, ref); err != nil || got != want {
+			t.Errorf("%s: expected %q, got %q (%v)", ref, want, got, err)
+		}
+	}
+	for _, ref := range []string{"vault://kv/broker#missing", "vault://kv/broker#port", "vault://kv/unknown#jwt_secret"} {
+		if _, err := ResolveSecret(ctx, ref); err == nil {
+			t.Errorf("%s: expected an error", ref)
+		}
+	}
+	t.Setenv("VAULT_TOKEN", "wrong")
+	if _, err := ResolveSecret(ctx, "vault://kv/broker#jwt_secret"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("expected a refused token to fail with the status, got %v", err)
+	}
+}
+
+func TestResolveAWSSecret(t *testing.T) {
+	aws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(auth, "/eu-west-1/secretsmanager/aws4_request") ||
+			r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" || r.Header.Get("X-Amz-Security-Token") != "session" {
+			http.Error(w, "unsigned request", http.StatusForbidden)
+			return
+		}
+		var req struct{ SecretId string }
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.SecretId != "prod/broker" {
+			http.Error(w, "unknown secret", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"SecretString": `{"api_key":"from-aws"}`})
+	}))
+	defer aws.Close()
+	t.Setenv("AWS_ENDPOINT_URL_SECRETS_MANAGER", aws.URL)
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", awsExampleAccessKey)
+	t.Setenv("AWS_SECRET_ACCESS_KEY", awsExampleSecretKey)
+	t.Setenv("AWS_SESSION_TOKEN", "session")
+	ctx := context.Background()
+
+	if got, err := ResolveSecret(ctx, "aws-sm://prod/broker#api_key"); err != nil || got != "from-aws" {
+		t.Fatalf("expected the field of the secret, got %q (%v)", got, err)
+	}
+	if got, err := ResolveSecret(ctx, "aws-sm://prod/broker"); err != nil || got != `{"api_key":"from-aws"}` {
+		t.Fatalf("expected the whole secret string, got %q (%v)", got, err)
+	}
+	if _, err := ResolveSecret(ctx, "aws-sm://prod/other"); err == nil {
+		t.Fatal("expected an unknown secret to fail")
+	}
+}
+
+func TestResolveLocalSecrets(t *testing.T) {
+	t.Setenv("BROKER_TEST_SECRET", "from-env")
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for ref, want := range map[string]string{
+		"env://BROKER_TEST_SECRET": "from-env",
+		"file://" + path:           "from-file",
+		"plain-value":              "plain-value",
+	} {
+		if got, err := ResolveSecret(ctx, ref); err != nil || got != want {
+			t.Errorf("%s: expected %q, got %q (%v)", ref, want, got, err)
+		}
+	}
+	if _, err := ResolveSecret(ctx, "env://BROKER_TEST_UNSET"); err == nil {
+		t.Error("expected an unset variable to fail")
+	}
+}
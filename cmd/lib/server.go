@@ -1,51 +1,395 @@
 package lib
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ispapp/Microservices-Broker/base/checksum"
 	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
 
 	"go.mills.io/bitcask/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type Server struct {
 	pb.UnimplementedBrokerServer
-	db           *bitcask.Bitcask
-	mu           sync.Mutex
-	tickeSeconds int16
-	maxAge       time.Duration
-	maxStored    int32
-	clients      sync.Map // Changed to sync.Map for atomic operations
+	db             *bitcask.Bitcask
+	mu             contextMutex
+	storage        storageGuard
+	wire           *wireMessages
+	tickeSeconds   int16
+	maxAge         time.Duration
+	maxStored      int32
+	batchSize      int
+	services       map[string]ServiceConfig
+	metrics        *Metrics
+	autoRecovery   bool
+	durability     Durability
+	syncInterval   time.Duration
+	sync           syncer
+	requestTimeout time.Duration
+	streamLifetime time.Duration
+	notifyExpired  bool
+	ackTimeout     time.Duration
+	maxAttempts    uint32
+	// poisonThreshold quarantines messages whose delivery failed this many times in a row
+	poisonThreshold uint32
+	readOnly        atomic.Bool
+	dbPath          string
+	diskHigh        float64
+	diskLow         float64
+	maxDBSize       int64
+	disk            diskState
+	diskProbe       func(path string) (total, free uint64, err error)
+	memory          memoryBudget
+	events          eventHub
+	taps            tapHub
+	logLevel        atomic.Int32
+	slowThreshold   atomic.Int64
+	payloadLogs     payloadLogging
+	deliveries      deliveryTimes
+	redactor        *Redactor
+	alerts          *alerter
+	reports         *reporter
+	rateLimit       *rateLimiter
+	accessLog       *AccessLog
+	validators      *Validators
+	plugins         *Plugins
+	scripts         *Scripts
+	offloader       *Offloader
+	maxFrameSize    int
+	maxValueSize    int
+	quotas          quotas
+	scheduler       *scheduler
+	sharding        *sharding
+	federation      *federation
+	// keepaliveInterval probes registered Receive streams (0 = never), reaping those that
+	// do not accept a probe within keepaliveTimeout
+	keepaliveInterval time.Duration
+	keepaliveTimeout  time.Duration
+	// heartbeatInterval is how long a Receive stream may stay silent before the broker
+	// sends a heartbeat (0 = never)
+	heartbeatInterval time.Duration
+	backlog           backlogMonitor
+	done              chan struct{}
+	closeOnce         sync.Once
+	clients           sync.Map // service -> []*receiver, replaced under registerMu
+	registerMu        sync.Mutex
+	duplicatePolicy   DuplicatePolicy
+	waiters           queueWaiters
+	partitionLocks    partitionLocks
+	router            *Router
+	egress            *EgressConfig
+	registry          *registry
+	subscriptions     subscriptions
+}
+
+// DefaultBatchSize is the number of messages delivered per scan when not configured
+const DefaultBatchSize = 500
+
+// errBatchFull stops a delivery scan once the batch size is reached
+var errBatchFull = errors.New("batch full")
+
+// errNotVisible stops a delivery scan at the first message that is not visible yet
+var errNotVisible = errors.New("not visible yet")
+
+// errReceiverReaped is returned by sends to a Receive stream that was reaped
+var errReceiverReaped = errors.New("receive stream reaped")
+
+// errServerClosed stops background scans during shutdown
+var errServerClosed = errors.New("server closed")
+
+// contextError converts a cancelled context into the matching gRPC status error
+func contextError(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return status.FromContextError(err).Err()
+	}
+	return nil
 }
 
 var Utils = utils{}
 
-func NewServer(dbPath string, TickeSeconds int16, MaxStored int32, MaxAge time.Duration) (*Server, error) {
-	db, err := bitcask.Open(dbPath, bitcask.WithAutoRecovery(false), bitcask.WithDirMode(0700), bitcask.WithFileMode(0600))
+// ServerOption configures optional Server behaviour
+type ServerOption func(*Server)
+
+// WithBatchSize sets the default number of messages delivered per scan
+func WithBatchSize(size int) ServerOption {
+	return func(s *Server) {
+		if size > 0 {
+			s.batchSize = size
+		}
+	}
+}
+
+// WithServices sets per-service overrides
+func WithServices(services map[string]ServiceConfig) ServerOption {
+	return func(s *Server) {
+		s.services = services
+	}
+}
+
+// WithAutoRecovery lets bitcask repair a damaged datafile when opening the database
+func WithAutoRecovery(enabled bool) ServerOption {
+	return func(s *Server) {
+		s.autoRecovery = enabled
+	}
+}
+
+// WithMaxValueSize sets the largest record of the database in bytes, which bounds the
+// size of queued messages (0 keeps the bitcask default of 64KiB)
+func WithMaxValueSize(size int) ServerOption {
+	return func(s *Server) {
+		s.maxValueSize = size
+	}
+}
+
+// OpenDB opens the broker database with the standard permissions. maxValueSize is the
+// largest record in bytes, 0 for the bitcask default.
+func OpenDB(dbPath string, autoRecovery bool, maxValueSize int) (*bitcask.Bitcask, error) {
+	opts := []bitcask.Option{bitcask.WithAutoRecovery(autoRecovery), bitcask.WithDirMode(0700), bitcask.WithFileMode(0600)}
+	if maxValueSize > 0 {
+		opts = append(opts, bitcask.WithMaxValueSize(uint64(maxValueSize)))
+	}
+	return bitcask.Open(dbPath, opts...)
+}
+
+func NewServer(dbPath string, TickeSeconds int16, MaxStored int32, MaxAge time.Duration, opts ...ServerOption) (*Server, error) {
+	s := &Server{
+		tickeSeconds:      TickeSeconds,
+		maxAge:            MaxAge,
+		maxStored:         MaxStored,
+		batchSize:         DefaultBatchSize,
+		durability:        DurabilitySync,
+		syncInterval:      DefaultSyncInterval,
+		ackTimeout:        DefaultAckTimeout,
+		poisonThreshold:   DefaultPoisonThreshold,
+		keepaliveInterval: DefaultKeepaliveInterval,
+		keepaliveTimeout:  DefaultKeepaliveTimeout,
+		wire:              &wireMessages{},
+		diskProbe:         diskUsage,
+		maxFrameSize:      DefaultMaxFrameSize,
+		done:              make(chan struct{}),
+		clients:           sync.Map{},
+		metrics:           NewMetrics(),
+		scheduler:         newScheduler(DefaultDeliveryConcurrency),
+		router:            newRouter(),
+		backlog:           backlogMonitor{interval: DefaultBacklogCheckInterval},
+	}
+	s.registerMetrics()
+	for _, opt := range opts {
+		opt(s)
+	}
+	if err := s.checkSharding(); err != nil {
+		return nil, err
+	}
+	db, err := OpenDB(dbPath, s.autoRecovery, s.maxValueSize)
 	if err != nil {
 		return nil, err
 	}
-	s := &Server{
-		db:           db,
-		tickeSeconds: TickeSeconds,
-		maxAge:       MaxAge,
-		maxStored:    MaxStored,
-		clients:      sync.Map{},
+	s.db = db
+	s.dbPath = dbPath
+	if err := s.loadCanaries(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := s.loadSubscriptions(); err != nil {
+		db.Close()
+		return nil, err
 	}
 	go s.startCronJob()
+	if s.keepaliveInterval > 0 {
+		go s.startKeepalive()
+	}
+	if s.heartbeatInterval > 0 {
+		go s.startHeartbeat()
+	}
+	if s.hasBacklogSLA() {
+		go s.startBacklogMonitor()
+	}
+	if s.diskLimited() {
+		s.checkDisk()
+		go s.startDiskMonitor()
+	}
+	if s.durability == DurabilityGroup {
+		go s.startGroupCommit()
+	}
+	if s.alerts != nil && len(s.alerts.rules) > 0 {
+		go s.startAlerts()
+	}
+	if s.reports != nil {
+		go s.startReports()
+	}
+	if s.federation != nil {
+		s.startFederation()
+	}
 	return s, nil
 }
 
+// Metrics returns the server metrics registry
+func (s *Server) Metrics() *Metrics {
+	return s.metrics
+}
+
+// registerMetrics describes the broker metrics
+func (s *Server) registerMetrics() {
+	s.metrics.Describe("broker_messages_received_total", "Messages accepted by Send and SendBatch")
+	s.metrics.Describe("broker_messages_sent_total", "Messages pushed directly to a connected recipient")
+	s.metrics.Describe("broker_messages_queued_total", "Messages stored for later delivery")
+	s.metrics.Describe("broker_messages_delivered_total", "Queued messages delivered to a recipient")
+	s.metrics.Describe("broker_messages_expired_total", "Queued messages deleted after exceeding the max age")
+	s.metrics.Describe("broker_records_quarantined_total", "Corrupted records moved to quarantine")
+	s.metrics.Describe("broker_messages_poisoned_total", "Messages quarantined after repeatedly failing delivery")
+	s.metrics.Describe("broker_messages_acked_total", "Messages acknowledged by consumers")
+	s.metrics.Describe("broker_messages_nacked_total", "Messages rejected by consumers")
+	s.metrics.Describe("broker_messages_fetched_total", "Messages handed out by Fetch, awaiting ack")
+	s.metrics.Describe("broker_egress_denied_total", "Sends refused by the egress matrix, by sender and destination")
+	s.metrics.Describe("broker_unknown_service_messages_total", "Messages from or to services missing from the registry, by service and action")
+	s.metrics.Describe("broker_validation_failures_total", "Messages that failed a validation rule, by rule and action")
+	s.metrics.Describe("broker_plugin_decisions_total", "Messages seen by a plugin, by plugin and action")
+	s.metrics.Describe("broker_plugin_failures_total", "Plugin calls that failed or ran out of time or memory, by plugin")
+	s.metrics.Describe("broker_messages_filtered_total", "Messages dropped by a script, by script")
+	s.metrics.Describe("broker_script_failures_total", "Script calls that failed or ran out of time, by script")
+	s.metrics.Describe("broker_enrichments_total", "Enrichment calls, by enrichment and outcome (ok, failed or open)")
+	s.metrics.Describe("broker_payloads_offloaded_total", "Payloads moved to the object store behind a claim check")
+	s.metrics.Describe("broker_offloaded_bytes_total", "Bytes of payloads moved to the object store")
+	s.metrics.Describe("broker_offload_failures_total", "Payloads that could not be uploaded to the object store and were queued inline")
+	s.metrics.Describe("broker_messages_routed_total", "Messages matched by a routing rule, by rule")
+	s.metrics.Describe("broker_messages_converted_total", "Payloads converted by convert rules, by rule and format")
+	s.metrics.Describe("broker_conversion_failures_total", "Payloads convert rules could not convert and sent as they were, by rule")
+	s.metrics.Describe("broker_messages_mirrored_total", "Shadow copies made by mirror rules, by destination")
+	s.metrics.Describe("broker_mirror_failures_total", "Shadow copies that could not be sent or queued, by destination")
+	s.metrics.Describe("broker_canary_messages_total", "Messages a canary sent elsewhere than their recipient, by service and destination")
+	s.metrics.Describe("broker_alias_copies_total", "Copies of messages sent to an alias, by alias and member")
+	s.metrics.Describe("broker_wildcard_copies_total", "Copies of messages sent to a wildcard address, by pattern and service")
+	s.metrics.Describe("broker_subscription_copies_total", "Copies of messages made for a subscription, by subscription")
+	s.metrics.Describe("broker_subscription_failures_total", "Copies for a subscription that could not be sent or queued, by subscription")
+	s.metrics.Describe("broker_alias_failures_total", "Copies for alias members that could not be sent or queued, by alias and member")
+	s.metrics.Describe("broker_routing_slip_hops_total", "Messages sent on to the next service of their routing slip")
+	s.metrics.Describe("broker_visibility_extended_total", "In-flight messages kept invisible for longer with ExtendVisibility")
+	s.metrics.Describe("broker_messages_dead_lettered_total", "Messages moved to a dead-letter queue after too many attempts")
+	s.metrics.Describe("broker_expiry_notifications_total", "Expired messages returned to their sender")
+	s.metrics.Describe("broker_deadline_exceeded_total", "Requests and streams ended by a server-side deadline")
+	s.metrics.Describe("broker_grpc_requests_total", "gRPC calls and streams handled, by method and status code")
+	s.metrics.Describe("broker_grpc_panics_total", "gRPC handlers that panicked and were recovered, by method")
+	s.metrics.Describe("broker_profiles_served_total", "Runtime profiles served by the pprof endpoints, by profile")
+	s.metrics.Describe("broker_rate_limited_total", "gRPC calls refused by the rate limit of their caller, by method")
+	s.metrics.Describe("broker_access_log_failures_total", "Calls that could not be written to the access log")
+	s.metrics.Describe("broker_disk_admission_blocked_total", "Times queueing was paused by the disk high watermark")
+	s.metrics.GaugeFunc("broker_disk_used_ratio", "Used fraction of the filesystem holding the database", func() float64 {
+		ratio, _ := s.diskSample()
+		return ratio
+	})
+	s.metrics.GaugeFunc("broker_db_size_bytes", "Size of the database directory", func() float64 {
+		_, size := s.diskSample()
+		return float64(size)
+	})
+	s.metrics.GaugeFunc("broker_disk_full", "1 while queueing is rejected by the disk watermarks", func() float64 {
+		if s.diskFull() {
+			return 1
+		}
+		return 0
+	})
+	s.metrics.Describe("broker_checksum_mismatches_total", "Messages whose data did not match their checksum")
+	s.metrics.Describe("broker_duplicate_connections_total", "Receive streams opened while the service already had one, by policy")
+	s.metrics.GaugeFunc("broker_delivery_waiting_destinations", "Destinations waiting for a delivery turn", func() float64 {
+		return float64(s.scheduler.waitingDestinations())
+	})
+	s.metrics.Describe("broker_shard_forwards_total", "Calls forwarded to the shard owning their service")
+	s.metrics.Describe("broker_shard_rejections_total", "Calls refused because another shard owns their service")
+	s.metrics.Describe("broker_federation_forwarded_total", "Messages accepted by a linked broker, by link")
+	s.metrics.Describe("broker_federation_retries_total", "Forwarded messages a linked broker could not take yet, by link")
+	s.metrics.Describe("broker_federation_rejected_total", "Forwarded messages a linked broker refused and that were dead-lettered, by link")
+	s.metrics.Describe("broker_federation_loops_total", "Forwarded messages refused because they already went through this broker")
+	s.metrics.GaugeFunc("broker_federation_links_up", "Federation links currently connected", func() float64 {
+		if s.federation == nil {
+			return 0
+		}
+		return float64(s.federation.linksUp())
+	})
+	s.metrics.Describe("broker_quota_rejections_total", "Sends rejected because the sender used up its quota")
+	s.metrics.Describe("broker_alerts_fired_total", "Alert rules that started firing")
+	s.metrics.Describe("broker_alert_notifications_failed_total", "Alert webhook and Slack notifications that could not be delivered")
+	s.metrics.Describe("broker_reports_failed_total", "Scheduled reports that could not be written or sent, by target")
+	s.metrics.Describe("broker_tap_dropped_total", "Sampled messages not mirrored to a Tap stream that fell behind")
+	s.metrics.Describe("broker_slow_calls_total", "Unary calls slower than the slow call threshold, by method")
+	s.metrics.Describe(deliveryLatencyMetric, "Time from queueing to first delivery of messages, by destination service")
+	s.metrics.Describe(ackLatencyMetric, "Time from delivery to acknowledgement of manual-ack and fetched messages, by destination service")
+	s.metrics.Describe("broker_events_dropped_total", "Lifecycle events not delivered to a WatchEvents stream that fell behind")
+	s.metrics.Describe("broker_receivers_reaped_total", "Receive streams dropped after a failed keepalive or send")
+	s.metrics.Describe("broker_heartbeats_sent_total", "Heartbeats sent on idle Receive streams")
+	s.metrics.Describe("broker_memory_rejections_total", "Requests rejected by the memory budget")
+	s.metrics.Describe("broker_auth_failures_total", "Calls rejected by authentication, by reason (invalid credentials, locked out, or outside the allowed networks)")
+	s.metrics.Describe("broker_auth_lockouts_total", "Client addresses and credentials locked out after repeated authentication failures")
+	s.metrics.GaugeFunc("broker_inflight_bytes", "Message bytes held by in-flight requests and deliveries", func() float64 {
+		return float64(s.memory.used.Load())
+	})
+	s.metrics.GaugeFunc("broker_read_only", "1 while the broker rejects sends", func() float64 {
+		if s.ReadOnly() {
+			return 1
+		}
+		return 0
+	})
+	s.metrics.GaugeFunc("broker_paused_services", "Services whose delivery is paused", func() float64 {
+		return float64(len(s.PausedServices()))
+	})
+	s.metrics.GaugeFunc("broker_backlog_sla_breaching_services", "Queues whose oldest waiting message is older than their max backlog age", func() float64 {
+		return float64(s.backlog.count.Load())
+	})
+	s.metrics.Describe("broker_backlog_sla_breaches_total", "Times a queue's oldest waiting message got older than its max backlog age, by service")
+	s.metrics.GaugeFunc("broker_connected_clients", "Receive streams currently registered", func() float64 {
+		n := 0
+		s.clients.Range(func(_, value any) bool {
+			n += len(value.([]*receiver))
+			return true
+		})
+		return float64(n)
+	})
+}
+
+// Close stops background jobs, flushes pending writes and closes the database
+func (s *Server) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		if syncErr := s.db.Sync(); syncErr != nil {
+			log.Printf("Final sync failed: %v", syncErr)
+		}
+		err = s.db.Close()
+		if s.sharding != nil {
+			s.sharding.close()
+		}
+		if closeErr := s.accessLog.Close(); closeErr != nil {
+			log.Printf("Failed to close access log: %v", closeErr)
+		}
+		if closeErr := s.plugins.Close(); closeErr != nil {
+			log.Printf("Failed to close plugins: %v", closeErr)
+		}
+		s.scripts.Close()
+	})
+	return err
+}
+
 func (s *Server) startCronJob() {
 	ticker := time.NewTicker(time.Duration(s.tickeSeconds) * time.Second)
-	for range ticker.C {
-		s.checkMessageDelivery()
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.checkMessageDelivery()
+		}
 	}
 }
 
@@ -55,176 +399,695 @@ func (s *Server) checkMessageDelivery() {
 	}
 	defer s.mu.Unlock()
 	err := s.db.Scan(nil, bitcask.KeyFunc(func(key bitcask.Key) error {
+		// Stop walking the keyspace as soon as the server shuts down
+		select {
+		case <-s.done:
+			return errServerClosed
+		default:
+		}
+		if isInternalKey(key) {
+			return nil
+		}
 		value, err := s.db.Get(key)
 		if err != nil {
-			return err
+			return s.quarantine(key, nil, err)
 		}
-		var msg pb.Message
-		if err := proto.Unmarshal(value, &msg); err != nil {
-			return err
+		enqueued, err := storedTime(value)
+		if err != nil {
+			return s.quarantine(key, value, err)
 		}
-		if time.Since(msg.Seq.AsTime()) > s.maxAge {
-			if err := s.db.Delete(key); err != nil {
-				return err
-			}
-			log.Printf("Deleted expired message %s", key)
+		if s.isExpiredAt(enqueued) {
+			return s.expire(key, value)
 		}
 		return nil
 	}))
-	if err != nil {
+	if err != nil && !errors.Is(err, errServerClosed) {
 		log.Printf("Error during message cleanup: %v", err)
 	}
 }
 
+// isExpiredAt reports whether a message enqueued at t is older than the configured max age
+func (s *Server) isExpiredAt(t time.Time) bool {
+	if s.maxAge <= 0 || t.IsZero() {
+		return false
+	}
+	return time.Since(t) > s.maxAge
+}
+
+// Ping reports the broker is up. A read-only broker answers with the READ_ONLY error
+// so clients can prefer a writable one.
 func (s *Server) Ping(ctx context.Context, identity *pb.Identity) (*pb.Status, error) {
+	if s.ReadOnly() {
+		return &pb.Status{Message: "Pong", Success: true, Error: pb.Error_READ_ONLY}, nil
+	}
 	return &pb.Status{Message: "Pong", Success: true, Error: pb.Error_NONE}, nil
 }
 
 func (s *Server) Send(ctx context.Context, msg *pb.Message) (*pb.Status, error) {
+	s.clearHops(ctx, []*pb.Message{msg})
+	id := stampTrace(ctx, msg)
+	refund, err := s.chargeQuota(ctx, []*pb.Message{msg}, time.Now())
+	if err != nil {
+		st, err := s.quotaExceeded(ctx, err)
+		return withTrace(ctx, id, st, err)
+	}
+	st, err := s.sendRouted(ctx, msg)
+	if err != nil || !st.GetSuccess() {
+		refund()
+	}
+	return withTrace(ctx, id, st, err)
+}
+
+// send delivers or queues a message stamped with its trace id
+func (s *Server) send(ctx context.Context, msg *pb.Message) (*pb.Status, error) {
 	if msg.Data == nil || msg.From == "" || msg.To == "" {
-		return &pb.Status{Message: "Invalid message", Success: false, Error: pb.Error_INVALID_REQUEST}, nil
+		return invalidRequest("Invalid message")
+	}
+	if err := checkRoutingSlip(msg); err != nil {
+		return invalidRequest(err.Error())
+	}
+	if err := checksum.Verify(msg); err != nil {
+		s.metrics.Inc("broker_checksum_mismatches_total")
+		return checksumFailed(err)
+	}
+	if remote, st, err := s.routeRemote(ctx, msg.To, func(ctx context.Context, c pb.BrokerClient) (*pb.Status, error) {
+		return c.Send(ctx, msg)
+	}); remote {
+		return st, err
 	}
-	log.Printf("Received message from %s to %s", msg.From, msg.To)
+	if s.ReadOnly() {
+		return readOnly()
+	}
+	size := int64(proto.Size(msg))
+	if !s.memory.acquire(size) {
+		return s.overBudget()
+	}
+	defer s.memory.release(size)
+	s.infof("Received message from %s to %s (trace %s)", msg.From, msg.To, msg.TraceId)
+	s.metrics.Inc("broker_messages_received_total")
+	s.tap(msg)
+	s.logPayload(msg)
 	// Check if recipient exists in clients map and send the message
-	if !s.mu.TryLock() {
-		return &pb.Status{Message: "Server busy", Success: false, Error: pb.Error_SERVER_ERROR}, nil
+	if err := s.mu.LockContext(ctx); err != nil {
+		return serverError(err)
 	}
 	defer s.mu.Unlock()
-	if clientStream, exists := s.clients.Load(msg.To); exists {
-		// does not exist at the moment
-		log.Printf("Sending message to %s", msg.To)
-		if err := clientStream.(pb.Broker_ReceiveServer).Send(msg); err != nil {
-			log.Printf("Failed to send message to %s: %v", msg.To, err)
-			return &pb.Status{Message: err.Error(), Success: false, Error: pb.Error_SERVER_ERROR}, err
+	if link, ok := s.homeLink(msg.To); ok {
+		// The recipient is homed on a linked broker, the link worker forwards it from the outbox
+		if err := s.storeMessage(ctx, FederationOutbox(link), msg); err != nil {
+			log.Printf("Failed to store message for link %s (trace %s): %v", link, msg.TraceId, err)
+			return serverError(err)
 		}
+		return &pb.Status{Message: "Message queued for link " + link, Success: true, Error: pb.Error_NONE}, nil
+	}
+	live, err := false, error(nil)
+	if !s.IsPaused(msg.To) && !skipsLive(msg) {
+		live, err = s.sendLive(msg)
+	}
+	if live {
+		if err != nil {
+			return failure(codes.Unavailable, &pb.Status{Message: err.Error(), Success: false, Error: pb.Error_SERVER_ERROR})
+		}
+		s.infof("Sent message to %s (trace %s)", msg.To, msg.TraceId)
+		s.metrics.Inc("broker_messages_sent_total")
 		return &pb.Status{Message: "Message sent", Success: true, Error: pb.Error_NONE}, nil
 	} else if msg.Queue {
-		log.Printf("Recipient %s not found, queuing message", msg.To)
+		s.infof("Recipient %s not found or paused, queuing message (trace %s)", msg.To, msg.TraceId)
 		// If recipient does not exist and message is marked for queue, store it
-		err := s.storeMessage(msg.To, msg)
-		if err != nil {
-			log.Printf("Failed to store queued message for %s: %v", msg.To, err)
-			return &pb.Status{Message: err.Error(), Success: false, Error: pb.Error_SERVER_ERROR}, err
+		if err := s.storeMessage(ctx, msg.To, msg); err != nil {
+			log.Printf("Failed to store queued message for %s (trace %s): %v", msg.To, msg.TraceId, err)
+			return serverError(err)
 		}
 		return &pb.Status{Message: "Message queued", Success: true, Error: pb.Error_NONE}, nil
 	}
-	return &pb.Status{Message: "Recipient not found", Success: false, Error: pb.Error_NONE}, nil
+	return failure(codes.NotFound, &pb.Status{Message: "Recipient offline", Success: false, Error: pb.Error_RECIPIENT_OFFLINE})
+}
+
+// SendBatch queues several messages and commits them with a single sync. Live
+// recipients still receive their messages directly.
+func (s *Server) SendBatch(ctx context.Context, batch *pb.Batch) (*pb.Status, error) {
+	s.clearHops(ctx, batch.Messages)
+	// Messages without their own trace id share the batch's
+	id := traceID(ctx, "")
+	for _, msg := range batch.Messages {
+		if msg.TraceId == "" {
+			msg.TraceId = id
+		}
+	}
+	refund, err := s.chargeQuota(ctx, batch.Messages, time.Now())
+	if err != nil {
+		st, err := s.quotaExceeded(ctx, err)
+		return withTrace(ctx, id, st, err)
+	}
+	st, err := s.sendBatchRouted(ctx, batch)
+	if err != nil || !st.GetSuccess() {
+		refund()
+	}
+	return withTrace(ctx, id, st, err)
+}
+
+// sendBatch delivers or queues a batch of messages stamped with their trace ids
+func (s *Server) sendBatch(ctx context.Context, batch *pb.Batch) (*pb.Status, error) {
+	if len(batch.Messages) == 0 {
+		return invalidRequest("Empty batch")
+	}
+	for _, msg := range batch.Messages {
+		if msg.Data == nil || msg.From == "" || msg.To == "" {
+			return invalidRequest("Invalid message")
+		}
+		if err := checkRoutingSlip(msg); err != nil {
+			return invalidRequest(err.Error())
+		}
+		if err := checksum.Verify(msg); err != nil {
+			s.metrics.Inc("broker_checksum_mismatches_total")
+			return checksumFailed(err)
+		}
+	}
+	// Messages for services of other shards are forwarded before the local ones are handled
+	local, remote := s.splitBatch(batch.Messages)
+	forwarded := ""
+	if len(remote) > 0 {
+		summary, st, err := s.forwardBatch(ctx, remote)
+		if err != nil {
+			return st, err
+		}
+		if len(local) == 0 {
+			return &pb.Status{Message: "Batch forwarded (" + summary + ")", Success: true, Error: pb.Error_NONE}, nil
+		}
+		forwarded = ", forwarded to " + summary
+		batch = &pb.Batch{Messages: local}
+	}
+	if s.ReadOnly() {
+		return readOnly()
+	}
+	size := int64(proto.Size(batch))
+	if !s.memory.acquire(size) {
+		return s.overBudget()
+	}
+	defer s.memory.release(size)
+	if err := s.mu.LockContext(ctx); err != nil {
+		return serverError(err)
+	}
+	defer s.mu.Unlock()
+	s.metrics.Add("broker_messages_received_total", int64(len(batch.Messages)))
+	for _, msg := range batch.Messages {
+		s.tap(msg)
+		s.logPayload(msg)
+	}
+	var queued []*pb.Message
+	sent := 0
+	for _, msg := range batch.Messages {
+		if _, ok := s.homeLink(msg.To); ok {
+			queued = append(queued, msg)
+			continue
+		}
+		if !s.IsPaused(msg.To) && !skipsLive(msg) {
+			live, err := s.sendLive(msg)
+			if live && err == nil {
+				s.metrics.Inc("broker_messages_sent_total")
+				sent++
+				continue
+			}
+			if live {
+				log.Printf("Failed to send message to %s, falling back to queue (trace %s)", msg.To, msg.TraceId)
+			}
+		}
+		if msg.Queue {
+			queued = append(queued, msg)
+		}
+	}
+	if err := s.storeMessages(ctx, queued); err != nil {
+		log.Printf("Failed to store batch (trace %s): %v", traceIDs(queued), err)
+		return serverError(err)
+	}
+	return &pb.Status{Message: fmt.Sprintf("Batch processed (sent %d, queued %d%s)", sent, len(queued), forwarded), Success: true, Error: pb.Error_NONE}, nil
 }
 
 func (s *Server) Receive(identity *pb.Identity, stream pb.Broker_ReceiveServer) error {
-	log.Printf("Client %s connected", identity.From)
-	if _, exists := s.clients.Load(identity.From); exists {
-		s.clients.Store(identity.From, stream)
+	from, _, err := actingService(stream.Context(), identity.From)
+	if err != nil {
+		return err
 	}
-	for {
-		// Keep the connection alive
-		select {
-		case <-stream.Context().Done():
-			log.Printf("Client %s disconnected", identity.From)
-			s.clients.Delete(identity.From)
+	identity.From = from
+	if strings.Contains(identity.From, protocol.InstanceSeparator) || strings.Contains(identity.Instance, protocol.InstanceSeparator) {
+		return status.Errorf(codes.InvalidArgument, "service and instance names must not contain %q", protocol.InstanceSeparator)
+	}
+	if strings.HasPrefix(identity.From, FederationOutboxPrefix) {
+		return status.Errorf(codes.InvalidArgument, "service names must not start with %q", FederationOutboxPrefix)
+	}
+	if err := s.receiveOwned(identity); err != nil {
+		return err
+	}
+	// A stream receiving for a name pattern subscribes to the services it matches
+	if protocol.IsPattern(identity.From) {
+		if err := protocol.CheckPattern(identity.From); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err := s.subscribe(identity.From); err != nil {
+			return status.Errorf(codes.Internal, "failed to subscribe %s: %v", identity.From, err)
+		}
+	}
+	r := newReceiver(identity, stream, s.maxFrameSize)
+	log.Printf("Client %s connected", r.address())
+	if identity.From != "" {
+		if err := s.register(r); err != nil {
+			return err
+		}
+		defer s.unregister(r)
+		s.emit(pb.BrokerEventType_BROKER_EVENT_TYPE_CONNECTED, r.address(), "", nil, "")
+	}
+	// Deliver from another goroutine so that a send blocked on a dead connection
+	// does not keep this call, and the registration, alive
+	delivered := make(chan error, 1)
+	go func() {
+		delivered <- s.deliver(identity, r)
+	}()
+	select {
+	case <-stream.Context().Done():
+		log.Printf("Client %s disconnected", r.address())
+		r.close(nil)
+	case <-r.done:
+		err = r.reason
+	case err = <-delivered:
+	}
+	if identity.From != "" {
+		detail := "disconnected"
+		if err != nil {
+			detail = status.Convert(err).Message()
+		}
+		s.emit(pb.BrokerEventType_BROKER_EVENT_TYPE_DISCONNECTED, r.address(), "", nil, detail)
+	}
+	return err
+}
 
+// deliver polls the service's queue, and the queue of messages sent to the stream's
+// instance, until the stream ends
+func (s *Server) deliver(identity *pb.Identity, r *receiver) error {
+	ctx := r.Context()
+	identities := []*pb.Identity{identity}
+	if identity.Instance != "" {
+		directed := &pb.Identity{From: r.address(), ManualAck: identity.ManualAck}
+		identities = []*pb.Identity{directed, identity}
+	}
+	for {
+		// Subscribe before scanning, so a message queued in between is not missed
+		queued := s.waiters.wait(identity.From)
+		// Take turns with the other destinations so that one huge backlog cannot starve them
+		if err := s.scheduler.acquire(ctx, identity.From, s.priorityFor(identity.From)); err != nil {
 			return nil
-		default:
-			err := s.GetMessages(identity, stream)
-			if err != nil {
-				log.Printf("Failed to get messages for %s: %v", identity.From, err)
-				stream.Send(&pb.Message{
-					Data: []byte(err.Error()),
-					Type: pb.Type_TEXT,
-					Seq:  timestamppb.Now(),
-					From: "broker", To: identity.From,
-					Event: pb.Event_ERROR})
-				return err
+		}
+		var err error
+		for _, identity := range identities {
+			if err = s.GetMessages(identity, r); err != nil {
+				break
 			}
-			time.Sleep(time.Second)
+		}
+		s.scheduler.release()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil && !errors.Is(err, errReceiverReaped) {
+			log.Printf("Failed to get messages for %s: %v", identity.From, err)
+			r.Send(&pb.Message{
+				Data: []byte(err.Error()),
+				Type: pb.Type_TEXT,
+				Seq:  timestamppb.Now(),
+				From: "broker", To: identity.From,
+				Event: pb.Event_ERROR})
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-r.done:
+			return nil
+		case <-queued:
+		case <-time.After(time.Second):
 		}
 	}
 }
 
 func (s *Server) GetMessages(identity *pb.Identity, stream pb.Broker_ReceiveServer) error {
+	return s.getMessages(identity, stream, s.batchSizeFor(identity.From), s.ackTimeout)
+}
+
+// getMessages sends up to batchSize visible messages of the identity's queue to stream.
+// In manual-ack mode they stay invisible for visibility until acked.
+func (s *Server) getMessages(identity *pb.Identity, stream pb.Broker_ReceiveServer, batchSize int, visibility time.Duration) error {
 	serviceName := identity.From
 	if serviceName == "" {
 		return stream.Send(&pb.Message{Data: []byte("missing service name"), Type: pb.Type_TEXT, Seq: timestamppb.Now(), From: "broker", To: identity.From, Event: pb.Event_ERROR})
 	}
-	// // Check for existing messages in the database
-	// if !s.mu.TryLock() {
-	// 	return fmt.Errorf("Server busy")
-	// }
-	// defer s.mu.Unlock()
-	err := s.db.Scan(bitcask.Key(serviceName+"_"), bitcask.KeyFunc(func(key bitcask.Key) error {
+	if s.IsPaused(serviceName) {
+		// Hold the queue until an operator resumes delivery
+		return nil
+	}
+	// Resume from the stored cursor so large backlogs are walked in bounded batches
+	prefix := messagePrefix(serviceName)
+	start := prefix
+	cursor, _ := s.db.Get(cursorKey(serviceName))
+	if len(cursor) > 0 {
+		start = bitcask.Key(cursor)
+	}
+	ctx := stream.Context()
+	now := time.Now()
+	var last, resume bitcask.Key
+	delivered, skipped := 0, 0
+	err := s.db.Range(start, prefixEnd(prefix), bitcask.KeyFunc(func(key bitcask.Key) error {
+		if err := contextError(ctx); err != nil {
+			return err
+		}
+		if bytes.Equal(key, cursor) {
+			return nil
+		}
+		visibleAt, ok := keyVisibleAt(prefix, key)
+		if !ok {
+			// Another service whose name extends this one
+			return nil
+		}
+		if visibleAt.After(now) {
+			// Keys sort by visibility, everything after this one is in flight or delayed too
+			return errNotVisible
+		}
+		if delivered >= batchSize || skipped >= batchSize*partitionSkipFactor {
+			return errBatchFull
+		}
 		value, err := s.db.Get(key)
 		if err != nil {
-			return err
+			return s.quarantine(key, nil, err)
+		}
+		// Defer the rest of the backlog while the memory budget is exhausted
+		if !s.memory.acquire(int64(len(value))) {
+			return errBatchFull
+		}
+		defer s.memory.release(int64(len(value)))
+		previous := last
+		last = append(bitcask.Key(nil), key...)
+		delivered++
+		enqueued, err := storedTime(value)
+		if err != nil {
+			return s.quarantine(key, value, err)
+		}
+		// Expired messages may still be on disk if the cron has not run yet
+		if s.isExpiredAt(enqueued) {
+			return s.expire(key, value)
 		}
 		var msg pb.Message
-		if err := proto.Unmarshal(value, &msg); err != nil {
-			return err
+		if err := decodeStored(value, &msg); err != nil {
+			return s.quarantine(key, value, err)
+		}
+		// The payloads of claim checks are verified by the client that downloads them
+		if !protocol.IsClaimCheck(msg.Headers) {
+			if err := checksum.Verify(&msg); err != nil {
+				s.metrics.Inc("broker_checksum_mismatches_total")
+				return s.quarantine(key, value, err)
+			}
 		}
-		if err := stream.Send(&msg); err != nil {
+		if s.partitionBlocked(serviceName, stream, key, &msg) {
+			// Leave it to the instance owning its partition, or until the message ahead
+			// of it is acked. The cursor must not move past it.
+			delivered--
+			if skipped == 0 {
+				resume = previous
+			}
+			skipped++
+			return nil
+		}
+		msg.Id = string(key)
+		msg.Attempts++
+		s.presignClaim(&msg)
+		if identity.ManualAck {
+			if s.maxAttempts > 0 && msg.Attempts > s.maxAttempts {
+				return s.deadLetter(key, &msg, serviceName)
+			}
+			// Keep the message invisible until it is acknowledged or the ack timeout lapses
+			inflight, err := s.requeue(key, &msg, serviceName, now.Add(visibility))
+			if err != nil {
+				return err
+			}
+			s.holdPartition(serviceName, inflight)
+			// A redelivered message is measured from its latest delivery
+			s.deliveries.take(string(key))
+			if err := stream.Send(inflight); err != nil {
+				return err
+			}
+			s.deliveries.delivered(inflight.Id, time.Now())
+			if msg.Attempts == 1 {
+				s.observeDelivery(serviceName, time.Since(enqueued))
+			}
+			s.emit(pb.BrokerEventType_BROKER_EVENT_TYPE_DELIVERED, serviceName, inflight.Id, inflight, "awaiting ack")
+			return nil
+		}
+		if err := stream.Send(&msg); errors.Is(err, errReceiverReaped) {
+			// Not the message's fault, it stays queued for the next stream
 			return err
+		} else if err != nil {
+			return s.deliveryFailed(key, &msg, err)
 		} else {
+			// Delivery acknowledges the message, a failed hop leaves it queued
+			if _, err := s.nextHop(ctx, &msg); err != nil {
+				return err
+			}
 			// Delete message from database after sending
 			if err := s.db.Delete(key); err != nil {
 				return err
 			}
-			log.Printf("deleted message %s", key)
+			s.metrics.Inc("broker_messages_delivered_total")
+			if msg.Attempts == 1 {
+				s.observeDelivery(serviceName, time.Since(enqueued))
+			}
+			s.emit(pb.BrokerEventType_BROKER_EVENT_TYPE_DELIVERED, serviceName, msg.Id, &msg, "")
+			s.infof("deleted message %s (trace %s)", key, msg.TraceId)
 		}
 		return nil
 	}))
-	if err != nil {
+	if skipped > 0 {
+		last = resume
+	}
+	if err != nil && !errors.Is(err, errBatchFull) && !errors.Is(err, errNotVisible) {
+		// Keep the progress made before the stream went away
+		if ctx.Err() != nil {
+			s.saveCursor(serviceName, last)
+		}
+		return err
+	}
+	if err := s.saveCursor(serviceName, last); err != nil {
 		return err
 	}
-	// Remove client from map when done
-	defer func() {
-		s.clients.Delete(serviceName)
-	}()
 	return nil
 }
 
+// quarantine moves an unreadable record out of the delivery path so the rest of
+// the queue keeps flowing. The original bytes are kept under the quarantine prefix.
+func (s *Server) quarantine(key bitcask.Key, value []byte, cause error) error {
+	if value == nil {
+		value = []byte(cause.Error())
+	}
+	if err := s.db.Put(quarantineKey(key), value); err != nil {
+		return err
+	}
+	if err := s.db.Delete(key); err != nil {
+		return err
+	}
+	s.metrics.Inc("broker_records_quarantined_total")
+	service, _ := keyService(key)
+	s.emit(pb.BrokerEventType_BROKER_EVENT_TYPE_QUARANTINED, service, string(key), nil, cause.Error())
+	log.Printf("Quarantined corrupted record %s: %v (total quarantined: %d)", key, cause, s.QuarantinedCount())
+	return nil
+}
+
+// QuarantinedCount returns the number of records quarantined since startup
+func (s *Server) QuarantinedCount() int64 {
+	return s.metrics.Counter("broker_records_quarantined_total")
+}
+
+// batchSizeFor returns the delivery batch size for a service
+func (s *Server) batchSizeFor(serviceName string) int {
+	if svc, ok := s.services[serviceName]; ok && svc.BatchSize > 0 {
+		return svc.BatchSize
+	}
+	return s.batchSize
+}
+
+// saveCursor records the last delivered key for a service. An empty key means the
+// scan reached the end of the backlog, so the cursor is reset to rescan from the start.
+func (s *Server) saveCursor(serviceName string, last bitcask.Key) error {
+	if last == nil {
+		if s.db.Has(cursorKey(serviceName)) {
+			return s.db.Delete(cursorKey(serviceName))
+		}
+		return nil
+	}
+	return s.db.Put(cursorKey(serviceName), bitcask.Value(last))
+}
+
 func (s *Server) Cleanup(ctx context.Context, identity *pb.Identity) (*pb.Status, error) {
+	from, st, err := actingService(ctx, identity.From)
+	if err != nil {
+		return st, err
+	}
+	identity.From = from
+	if remote, st, err := s.routeRemote(ctx, identity.From, func(ctx context.Context, c pb.BrokerClient) (*pb.Status, error) {
+		return c.Cleanup(ctx, identity)
+	}); remote {
+		return st, err
+	}
 	// Implement cleanup logic
-	if !s.mu.TryLock() {
-		return &pb.Status{Message: "Server busy", Success: false, Error: pb.Error_SERVER_ERROR}, nil
+	if err := s.mu.LockContext(ctx); err != nil {
+		return serverError(err)
 	}
 	defer s.mu.Unlock()
 	serviceName := identity.From
 	if serviceName == "" {
-		return &pb.Status{Message: "missing service name", Success: false, Error: pb.Error_INVALID_REQUEST}, nil
+		return invalidRequest("missing service name")
 	}
 	var count int
-	err := s.db.Scan(bitcask.Key(serviceName+"_"), bitcask.KeyFunc(func(key bitcask.Key) error {
+	err = s.db.Scan(messagePrefix(serviceName), bitcask.KeyFunc(func(key bitcask.Key) error {
+		if err := contextError(ctx); err != nil {
+			return err
+		}
 		count++
 		return s.db.Delete(key)
 	}))
+	if err == nil {
+		err = s.saveCursor(serviceName, nil)
+	}
+	if err == nil && protocol.IsPattern(serviceName) {
+		err = s.unsubscribe(serviceName)
+	}
 	if err != nil {
-		return &pb.Status{Message: err.Error(), Success: false, Error: pb.Error_SERVER_ERROR}, err
+		return serverError(err)
 	}
 	return &pb.Status{Message: fmt.Sprintf("Cleanup completed (%d)", count), Success: true, Error: pb.Error_NONE}, nil
 }
 
-func (s *Server) storeMessage(serviceName string, msg *pb.Message) error {
+func (s *Server) storeMessage(ctx context.Context, serviceName string, msg *pb.Message) error {
+	// A caller that gave up must not leave a message behind
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	if s.diskFull() {
+		return errDiskFull
+	}
 	// Store message in Bitcast DB
-	key := bitcask.Key(serviceName + "_" + Utils.uid(16))
-	_msg := &pb.Message{
-		Data:  msg.Data,
-		Type:  msg.Type,
-		From:  msg.From,
-		To:    msg.To,
-		Event: pb.Event_MESSAGE,
-		Seq:   timestamppb.Now(),
-	}
-	value, _err := proto.Marshal(_msg)
-	if _err != nil {
-		return _err
-	}
-	if s.db != nil {
+	key := messageKey(serviceName)
+	stored := queuedMessage(msg)
+	s.offload(ctx, serviceName, stored)
+	buf := getBuffer()
+	value, err := s.wire.encode(*buf, msg, stored)
+	if err != nil {
+		putBuffer(buf)
+		return err
+	}
+	*buf = value
+	if s.db == nil {
+		putBuffer(buf)
+		log.Printf("Database not initialized")
+		return nil
+	}
+	if err := contextError(ctx); err != nil {
+		putBuffer(buf)
+		return err
+	}
+	// The buffer goes back to the pool once the write returns, even after ctx ends
+	if err := s.write(ctx, func() error {
+		defer putBuffer(buf)
 		if err := s.db.Put(key, value); err != nil {
 			return err
 		}
-		s.db.Sync()
-	} else {
-		log.Printf("Database not initialized")
+		return s.commit()
+	}); err != nil {
+		return err
 	}
-	log.Printf("Message queued for %s", serviceName)
+	s.metrics.Inc("broker_messages_queued_total")
+	s.emit(pb.BrokerEventType_BROKER_EVENT_TYPE_ENQUEUED, serviceName, string(key), msg, "")
+	s.waiters.notify(serviceName)
+	s.infof("Message queued for %s (trace %s)", serviceName, msg.TraceId)
 	return nil
 }
+
+// storeMessages writes several messages in one bitcask batch followed by a single commit
+func (s *Server) storeMessages(ctx context.Context, msgs []*pb.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	if s.diskFull() {
+		return errDiskFull
+	}
+	// Buffers are referenced by the batch until it is written
+	batch := s.db.Batch()
+	buffers := make([]*[]byte, 0, len(msgs))
+	keys := make([]bitcask.Key, 0, len(msgs))
+	release := func() {
+		for _, buf := range buffers {
+			putBuffer(buf)
+		}
+	}
+	written := false
+	defer func() {
+		if !written {
+			release()
+		}
+	}()
+	for _, msg := range msgs {
+		if err := contextError(ctx); err != nil {
+			return err
+		}
+		queue := s.queueFor(msg.To)
+		stored := queuedMessage(msg)
+		s.offload(ctx, queue, stored)
+		buf := getBuffer()
+		buffers = append(buffers, buf)
+		value, err := s.wire.encode(*buf, msg, stored)
+		if err != nil {
+			return err
+		}
+		*buf = value
+		key := messageKey(queue)
+		if _, err := batch.Put(key, value); err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	// Once written the batch is committed even if the caller goes away
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	written = true
+	if err := s.write(ctx, func() error {
+		defer release()
+		if err := s.db.WriteBatch(batch); err != nil {
+			return err
+		}
+		return s.commit()
+	}); err != nil {
+		return err
+	}
+	s.metrics.Add("broker_messages_queued_total", int64(len(msgs)))
+	for i, msg := range msgs {
+		s.emit(pb.BrokerEventType_BROKER_EVENT_TYPE_ENQUEUED, s.queueFor(msg.To), string(keys[i]), msg, "")
+		s.waiters.notify(msg.To)
+	}
+	s.infof("Queued batch of %d messages (trace %s)", len(msgs), traceIDs(msgs))
+	return nil
+}
+
+// queuedMessage builds the stored form of a message
+func queuedMessage(msg *pb.Message) *pb.Message {
+	return &pb.Message{
+		Data:         msg.Data,
+		Type:         msg.Type,
+		From:         msg.From,
+		To:           msg.To,
+		Event:        pb.Event_MESSAGE,
+		Seq:          timestamppb.Now(),
+		Checksum:     msg.Checksum,
+		ChecksumType: msg.ChecksumType,
+		Headers:      msg.Headers,
+		TraceId:      msg.TraceId,
+		Via:          msg.Via,
+		PartitionKey: msg.PartitionKey,
+		RoutingSlip:  msg.RoutingSlip,
+		Mirrored:     msg.Mirrored,
+	}
+}
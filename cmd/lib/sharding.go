@@ -0,0 +1,253 @@
+package lib
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+	"github.com/ispapp/Microservices-Broker/base/shard"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// ForwardedMetadataKey marks a call forwarded by another shard; it is never forwarded again
+const ForwardedMetadataKey = "x-broker-forwarded"
+
+// ShardSecretMetadataKey carries the shared secret that proves a forwarded call comes
+// from another shard
+const ShardSecretMetadataKey = "x-broker-shard-secret"
+
+// forwardedHeaders are the request metadata passed on to the owning shard
+var forwardedHeaders = []string{"authorization", "x-api-key", TraceMetadataKey,
+	protocol.SignatureKeyIDHeader, protocol.SignatureTimestampHeader, protocol.SignatureNonceHeader, protocol.SignatureHeader}
+
+// sharding holds this broker's place in a sharded deployment
+type sharding struct {
+	shards   *shard.Map
+	self     string
+	proxy    bool
+	secret   string
+	dialOpts []grpc.DialOption
+	mu       sync.Mutex
+	conns    map[string]*grpc.ClientConn
+}
+
+// WithSharding makes this broker the shard called self of shards. Calls about services
+// owned by another shard are forwarded to it when proxy is set and rejected with
+// FailedPrecondition otherwise; opts configure the connections to other shards.
+func WithSharding(shards *shard.Map, self string, proxy bool, opts ...grpc.DialOption) ServerOption {
+	return func(s *Server) {
+		s.sharding = &sharding{shards: shards, self: self, proxy: proxy, dialOpts: opts, conns: make(map[string]*grpc.ClientConn)}
+	}
+}
+
+// WithShardSecret sets the secret shards present when forwarding calls to each other.
+// Only calls carrying it skip the checks the forwarding shard already made.
+func WithShardSecret(secret string) ServerOption {
+	return func(s *Server) {
+		if s.sharding != nil {
+			s.sharding.secret = secret
+		}
+	}
+}
+
+// ServerOption returns the option joining the configured shards, which does nothing
+// when no shards are configured
+func (c ShardingConfig) ServerOption(ctx context.Context) (ServerOption, error) {
+	if len(c.Shards) == 0 {
+		return func(*Server) {}, nil
+	}
+	shards, err := shard.New(c.Shards)
+	if err != nil {
+		return nil, err
+	}
+	creds := insecure.NewCredentials()
+	if c.TLSEnabled {
+		creds = credentials.NewTLS(&tls.Config{})
+		if c.TLSCAFile != "" {
+			if creds, err = credentials.NewClientTLSFromFile(c.TLSCAFile, ""); err != nil {
+				return nil, fmt.Errorf("failed to load shard CA: %w", err)
+			}
+		}
+	}
+	secret, err := ResolveSecret(ctx, c.Secret)
+	if err != nil {
+		return nil, fmt.Errorf("shard secret: %w", err)
+	}
+	join := WithSharding(shards, c.Self, c.Proxy, grpc.WithTransportCredentials(creds))
+	return func(s *Server) {
+		join(s)
+		WithShardSecret(secret)(s)
+	}, nil
+}
+
+// checkSharding reports a sharding configuration this broker cannot serve
+func (s *Server) checkSharding() error {
+	if s.sharding == nil {
+		return nil
+	}
+	if _, ok := s.sharding.shards.Get(s.sharding.self); !ok {
+		return fmt.Errorf("shard %q is not in the shard map", s.sharding.self)
+	}
+	return nil
+}
+
+// owner returns the shard owning address and whether it is this broker
+func (s *Server) owner(address string) (shard.Shard, bool) {
+	if s.sharding == nil {
+		return shard.Shard{}, true
+	}
+	owner := s.sharding.shards.Owner(address)
+	return owner, owner.Name == s.sharding.self
+}
+
+// notOwned rejects a call about a service owned by another shard
+func notOwned(address string, owner shard.Shard) (*pb.Status, error) {
+	return failure(codes.FailedPrecondition, &pb.Status{
+		Message: fmt.Sprintf("%s is owned by shard %s at %s", address, owner.Name, owner.Address),
+		Success: false,
+		Error:   pb.Error_INVALID_REQUEST,
+	})
+}
+
+// routeRemote forwards a call about address to its owning shard. It reports false when
+// address is owned here and the call should be handled locally.
+func (s *Server) routeRemote(ctx context.Context, address string, call func(context.Context, pb.BrokerClient) (*pb.Status, error)) (bool, *pb.Status, error) {
+	owner, local := s.owner(address)
+	if local {
+		return false, nil, nil
+	}
+	st, err := s.forward(ctx, address, owner, call)
+	return true, st, err
+}
+
+// forward calls the owning shard with the caller's credentials and trace id
+func (s *Server) forward(ctx context.Context, address string, owner shard.Shard, call func(context.Context, pb.BrokerClient) (*pb.Status, error)) (*pb.Status, error) {
+	in, _ := metadata.FromIncomingContext(ctx)
+	// A forwarded call for a service this shard does not own means the shard maps disagree
+	if !s.sharding.proxy || len(in.Get(ForwardedMetadataKey)) > 0 {
+		s.metrics.Inc("broker_shard_rejections_total")
+		return notOwned(address, owner)
+	}
+	conn, err := s.sharding.conn(owner)
+	if err != nil {
+		return failure(codes.Unavailable, &pb.Status{Message: fmt.Sprintf("shard %s unreachable: %v", owner.Name, err), Success: false, Error: pb.Error_SERVER_ERROR})
+	}
+	out := metadata.Pairs(ForwardedMetadataKey, s.sharding.self)
+	if s.sharding.secret != "" {
+		out.Set(ShardSecretMetadataKey, s.sharding.secret)
+	}
+	for _, key := range forwardedHeaders {
+		if values := in.Get(key); len(values) > 0 {
+			out.Set(key, values...)
+		}
+	}
+	s.metrics.Inc("broker_shard_forwards_total", "shard", owner.Name)
+	return call(metadata.NewOutgoingContext(ctx, out), pb.NewBrokerClient(conn))
+}
+
+// forwardedByShard reports whether the call in ctx was forwarded by another shard,
+// which proved it with the shard secret. The forwarded marker alone is set by any
+// client that wants to.
+func (s *Server) forwardedByShard(ctx context.Context) bool {
+	if s.sharding == nil || s.sharding.secret == "" {
+		return false
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	from, secret := md.Get(ForwardedMetadataKey), md.Get(ShardSecretMetadataKey)
+	if len(from) != 1 || len(secret) != 1 || from[0] == s.sharding.self {
+		return false
+	}
+	if _, ok := s.sharding.shards.Get(from[0]); !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(secret[0]), []byte(s.sharding.secret)) == 1
+}
+
+// checkedUpstream reports whether msg was already checked by the broker that took
+// it: the call was forwarded by another shard, or msg was federated by a linked
+// broker. Send and SendBatch clear the hop list of messages from anyone else.
+func (s *Server) checkedUpstream(ctx context.Context, msg *pb.Message) bool {
+	return len(msg.Via) > 0 || s.forwardedByShard(ctx)
+}
+
+// conn returns the connection to a shard, dialing it on first use
+func (sh *sharding) conn(owner shard.Shard) (*grpc.ClientConn, error) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if conn, ok := sh.conns[owner.Name]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.NewClient(owner.Address, sh.dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	sh.conns[owner.Name] = conn
+	log.Printf("Connected to shard %s at %s", owner.Name, owner.Address)
+	return conn, nil
+}
+
+// close closes the connections to other shards
+func (sh *sharding) close() {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	for name, conn := range sh.conns {
+		conn.Close()
+		delete(sh.conns, name)
+	}
+}
+
+// splitBatch separates the messages owned here from those of each other shard
+func (s *Server) splitBatch(msgs []*pb.Message) (local []*pb.Message, remote map[string][]*pb.Message) {
+	for _, msg := range msgs {
+		owner, ok := s.owner(msg.To)
+		if ok {
+			local = append(local, msg)
+			continue
+		}
+		if remote == nil {
+			remote = make(map[string][]*pb.Message)
+		}
+		remote[owner.Name] = append(remote[owner.Name], msg)
+	}
+	return local, remote
+}
+
+// forwardBatch forwards the messages of other shards, one batch per shard, and
+// summarizes what they reported
+func (s *Server) forwardBatch(ctx context.Context, remote map[string][]*pb.Message) (string, *pb.Status, error) {
+	var summary []string
+	for name, msgs := range remote {
+		owner, _ := s.sharding.shards.Get(name)
+		st, err := s.forward(ctx, msgs[0].To, owner, func(ctx context.Context, c pb.BrokerClient) (*pb.Status, error) {
+			return c.SendBatch(ctx, &pb.Batch{Messages: msgs})
+		})
+		if err != nil {
+			return "", st, err
+		}
+		summary = append(summary, fmt.Sprintf("%s: %s", name, st.Message))
+	}
+	return strings.Join(summary, "; "), nil, nil
+}
+
+// receiveOwned rejects Receive streams of services owned by another shard. Streams are
+// not proxied: consumers connect to the owning shard, e.g. with client.ShardedClient.
+func (s *Server) receiveOwned(identity *pb.Identity) error {
+	owner, local := s.owner(identity.From)
+	if local || identity.From == "" {
+		return nil
+	}
+	s.metrics.Inc("broker_shard_rejections_total")
+	_, err := notOwned(identity.From, owner)
+	return err
+}
@@ -0,0 +1,61 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+)
+
+// MaxRoutingSlipHops caps the services a routing slip may list
+const MaxRoutingSlipHops = 32
+
+// checkRoutingSlip validates the routing slip of a message being sent
+func checkRoutingSlip(msg *pb.Message) error {
+	if len(msg.RoutingSlip) == 0 {
+		return nil
+	}
+	if !msg.Queue {
+		return errors.New("messages with a routing slip must be queued")
+	}
+	if len(msg.RoutingSlip) > MaxRoutingSlipHops {
+		return fmt.Errorf("routing slip lists more than %d services", MaxRoutingSlipHops)
+	}
+	for _, hop := range msg.RoutingSlip {
+		if hop == "" {
+			return errors.New("routing slip lists an empty service name")
+		}
+	}
+	return nil
+}
+
+// nextHop sends a message whose routing slip is not done on to the slip's next service,
+// from the recipient that just acknowledged it. It runs before the message is deleted,
+// so a hop that cannot be sent leaves the message with its recipient.
+func (s *Server) nextHop(ctx context.Context, msg *pb.Message) (*pb.Status, error) {
+	if len(msg.RoutingSlip) == 0 {
+		return nil, nil
+	}
+	next := &pb.Message{
+		Data:         msg.Data,
+		Type:         msg.Type,
+		From:         msg.To,
+		To:           msg.RoutingSlip[0],
+		Queue:        true,
+		Checksum:     msg.Checksum,
+		ChecksumType: msg.ChecksumType,
+		Headers:      msg.Headers,
+		TraceId:      msg.TraceId,
+		PartitionKey: msg.PartitionKey,
+		RoutingSlip:  msg.RoutingSlip[1:],
+	}
+	if st, err := s.send(ctx, next); err != nil {
+		log.Printf("Failed to route message from %s to %s (trace %s): %v", next.From, next.To, msg.TraceId, err)
+		return st, err
+	}
+	s.metrics.Inc("broker_routing_slip_hops_total")
+	s.infof("Routed message from %s to %s, %d hops left (trace %s)", next.From, next.To, len(next.RoutingSlip), msg.TraceId)
+	return nil, nil
+}
@@ -0,0 +1,136 @@
+package lib
+
+import (
+	"context"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	"go.mills.io/bitcask/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// SubscriptionHeader is set on the copies a subscription gets to the recipient of
+// the original message
+const SubscriptionHeader = "x-broker-to"
+
+// subscriptions are the name patterns Receive streams subscribed to. A subscription
+// gets a copy of every message sent to a service its pattern matches, in a queue of
+// its own named by the pattern.
+type subscriptions struct {
+	mu       sync.RWMutex
+	patterns map[string]bool
+}
+
+// subscriptionKey marks a name pattern a Receive stream subscribed to
+func subscriptionKey(pattern string) bitcask.Key {
+	return bitcask.Key(internalKeyPrefix + "subscription/" + pattern)
+}
+
+// Subscriptions returns the name patterns subscribed to
+func (s *Server) Subscriptions() []string {
+	s.subscriptions.mu.RLock()
+	defer s.subscriptions.mu.RUnlock()
+	patterns := make([]string, 0, len(s.subscriptions.patterns))
+	for pattern := range s.subscriptions.patterns {
+		patterns = append(patterns, pattern)
+	}
+	slices.Sort(patterns)
+	return patterns
+}
+
+// subscribe starts copying the messages of the services pattern matches to its
+// queue. The subscription survives restarts until the queue of pattern is cleaned up.
+func (s *Server) subscribe(pattern string) error {
+	s.subscriptions.mu.Lock()
+	defer s.subscriptions.mu.Unlock()
+	if s.subscriptions.patterns[pattern] {
+		return nil
+	}
+	if err := s.db.Put(subscriptionKey(pattern), []byte(pattern)); err != nil {
+		return err
+	}
+	if err := s.commit(); err != nil {
+		return err
+	}
+	s.subscriptions.patterns[pattern] = true
+	log.Printf("Subscribed %s", pattern)
+	return nil
+}
+
+// unsubscribe stops copying messages to the queue of pattern
+func (s *Server) unsubscribe(pattern string) error {
+	s.subscriptions.mu.Lock()
+	defer s.subscriptions.mu.Unlock()
+	if !s.subscriptions.patterns[pattern] {
+		return nil
+	}
+	if err := s.db.Delete(subscriptionKey(pattern)); err != nil {
+		return err
+	}
+	if err := s.commit(); err != nil {
+		return err
+	}
+	delete(s.subscriptions.patterns, pattern)
+	log.Printf("Unsubscribed %s", pattern)
+	return nil
+}
+
+// loadSubscriptions restores the subscriptions made before the last restart
+func (s *Server) loadSubscriptions() error {
+	prefix := subscriptionKey("")
+	s.subscriptions.patterns = make(map[string]bool)
+	return s.db.Scan(prefix, bitcask.KeyFunc(func(key bitcask.Key) error {
+		s.subscriptions.patterns[strings.TrimPrefix(string(key), string(prefix))] = true
+		return nil
+	}))
+}
+
+// subscriberCopies returns the copies of msgs for the subscriptions matching their
+// recipients. Shadow copies and quarantined messages are not copied.
+func (s *Server) subscriberCopies(msgs []*pb.Message) []*pb.Message {
+	s.subscriptions.mu.RLock()
+	defer s.subscriptions.mu.RUnlock()
+	if len(s.subscriptions.patterns) == 0 {
+		return nil
+	}
+	var copies []*pb.Message
+	for _, msg := range msgs {
+		if msg.Mirrored || s.quarantined(msg) {
+			continue
+		}
+		service, _ := protocol.SplitAddress(msg.To)
+		for pattern := range s.subscriptions.patterns {
+			if pattern == service || !protocol.MatchName(pattern, service) {
+				continue
+			}
+			c := proto.Clone(msg).(*pb.Message)
+			if c.Headers == nil {
+				c.Headers = make(map[string]string)
+			}
+			c.Headers[SubscriptionHeader] = msg.To
+			c.To = pattern
+			c.Queue = true
+			c.RoutingSlip = nil
+			copies = append(copies, c)
+		}
+	}
+	return copies
+}
+
+// sendSubscribers sends the copies of subscriptions, whose failures only count
+// against the subscription
+func (s *Server) sendSubscribers(ctx context.Context, copies []*pb.Message) {
+	for _, c := range copies {
+		if _, err := s.send(ctx, c); err != nil {
+			s.metrics.Inc("broker_subscription_failures_total", "subscription", c.To)
+			log.Printf("Failed to copy message to subscription %s (trace %s): %v", c.To, c.TraceId, err)
+			continue
+		}
+		s.metrics.Inc("broker_subscription_copies_total", "subscription", c.To)
+	}
+}
@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket activation
+const listenFDsStart = 3
+
+// SDNotify sends a state update such as "READY=1" to systemd. It is a no-op when
+// the process was not started by systemd with Type=notify.
+func SDNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to reach systemd notify socket: %w", err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// ActivatedListener is a socket handed over by systemd socket activation
+type ActivatedListener struct {
+	Name     string // FileDescriptorName from the socket unit, if any
+	Listener net.Listener
+}
+
+// ActivatedListeners returns the sockets passed by systemd (LISTEN_FDS), or nil
+// when the broker was not socket activated
+func ActivatedListeners() ([]ActivatedListener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// Children must not inherit the activation environment
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]ActivatedListener, 0, count)
+	for i := 0; i < count; i++ {
+		file := os.NewFile(uintptr(listenFDsStart+i), fmt.Sprintf("listen-fd-%d", i))
+		lis, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket activation fd %d is not a listener: %w", listenFDsStart+i, err)
+		}
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		listeners = append(listeners, ActivatedListener{Name: name, Listener: lis})
+	}
+	return listeners, nil
+}
@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// tapBuffer is the number of mirrored messages a slow tap may fall behind before copies are dropped
+const tapBuffer = 256
+
+// tapHub mirrors a sample of the messages sent to a service to Tap streams. Mirroring
+// never blocks or changes delivery: copies for a tap whose buffer is full are dropped.
+type tapHub struct {
+	mu    sync.RWMutex
+	taps  map[*tap]struct{}
+	count atomic.Int32
+}
+
+// tap is one Tap subscription
+type tap struct {
+	service    string
+	sampleRate float64
+	messages   chan *pb.Message
+}
+
+func (h *tapHub) subscribe(req *pb.TapRequest) *tap {
+	t := &tap{service: req.Service, sampleRate: req.SampleRate, messages: make(chan *pb.Message, tapBuffer)}
+	h.mu.Lock()
+	if h.taps == nil {
+		h.taps = make(map[*tap]struct{})
+	}
+	h.taps[t] = struct{}{}
+	h.mu.Unlock()
+	h.count.Add(1)
+	return t
+}
+
+func (h *tapHub) unsubscribe(t *tap) {
+	h.mu.Lock()
+	delete(h.taps, t)
+	h.mu.Unlock()
+	h.count.Add(-1)
+}
+
+// mirror offers a copy of msg to the taps on its destination and returns the number of
+// sampled copies that were dropped
+func (h *tapHub) mirror(msg *pb.Message) int {
+	service, _ := protocol.SplitAddress(msg.To)
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	dropped := 0
+	for t := range h.taps {
+		if t.service != service || rand.Float64() >= t.sampleRate {
+			continue
+		}
+		select {
+		case t.messages <- proto.Clone(msg).(*pb.Message):
+		default:
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// tap mirrors msg, redacted, to the Tap streams sampling its destination, if there are any
+func (s *Server) tap(msg *pb.Message) {
+	if s.taps.count.Load() == 0 {
+		return
+	}
+	if dropped := s.taps.mirror(s.redacted(msg)); dropped > 0 {
+		s.metrics.Add("broker_tap_dropped_total", int64(dropped))
+	}
+}
+
+// Tap streams copies of a sample of the messages accepted for a service until the
+// operator goes away. The messages themselves are delivered or queued as usual; a tap
+// that falls more than 256 copies behind misses the next ones.
+func (s *Server) Tap(req *pb.TapRequest, stream pb.Broker_TapServer) error {
+	if req.Service == "" {
+		return status.Error(codes.InvalidArgument, "missing service name")
+	}
+	if req.SampleRate <= 0 || req.SampleRate > 1 {
+		return status.Error(codes.InvalidArgument, "sample rate must be above 0 and at most 1")
+	}
+	t := s.taps.subscribe(req)
+	defer s.taps.unsubscribe(t)
+	// Headers tell the operator the tap is in place
+	if err := stream.SendHeader(nil); err != nil {
+		return err
+	}
+	ctx := stream.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.done:
+			return status.Error(codes.Unavailable, errServerClosed.Error())
+		case msg := <-t.messages:
+			if err := stream.Send(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
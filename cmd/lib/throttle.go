@@ -0,0 +1,286 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// Defaults of brute-force protection
+const (
+	DefaultMaxAuthFailures   = 5
+	DefaultAuthFailureWindow = 15 * time.Minute
+	DefaultAuthLockout       = time.Minute
+	DefaultMaxAuthLockout    = time.Hour
+	DefaultAuthFailureDelay  = 100 * time.Millisecond
+	// maxAuthFailureDelay caps how long the answer to a failed attempt is held back
+	maxAuthFailureDelay = 5 * time.Second
+	// maxThrottleEntries bounds the addresses and credentials tracked at once, so that
+	// guessing random keys cannot exhaust memory
+	maxThrottleEntries = 100000
+)
+
+// AuthThrottleConfig slows down and locks out clients that keep presenting invalid
+// credentials. It is on whenever authentication is; zero values take the defaults.
+type AuthThrottleConfig struct {
+	Disabled bool `json:"disabled,omitempty"`
+	// MaxFailures is the number of failures from one address, or with one credential,
+	// that starts a lockout (default 5)
+	MaxFailures int `json:"max_failures,omitempty"`
+	// Window is how long failures are remembered (default 15m)
+	Window time.Duration `json:"window,omitempty"`
+	// Lockout is how long the first lockout lasts (default 1m). It doubles with every
+	// further lockout within Window, up to MaxLockout (default 1h).
+	Lockout    time.Duration `json:"lockout,omitempty"`
+	MaxLockout time.Duration `json:"max_lockout,omitempty"`
+	// Delay holds back the answer to a failed attempt, doubling with every further
+	// failure up to 5s (default 100ms)
+	Delay time.Duration `json:"delay,omitempty"`
+}
+
+// AuthFailure describes a call rejected by authentication
+type AuthFailure struct {
+	Peer  string // client address, without the port
+	KeyID string // KeyID of the presented credential, empty when there was none
+	// Failures counts the recent failures of the address or credential, whichever has more
+	Failures int
+	// Lockout is the lockout this failure started, zero when it started none
+	Lockout time.Duration
+	// Locked is set when the call was refused because of an earlier lockout
+	Locked bool
+	// Network is set when valid credentials were used from outside their networks
+	Network bool
+	// Policy is set when valid credentials called a method their policy does not allow
+	Policy bool
+	Err    error
+}
+
+// LockedOutError refuses a call from a locked out address or with a locked out credential
+type LockedOutError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockedOutError) Error() string {
+	return fmt.Sprintf("too many failed attempts, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+// authThrottle tracks authentication failures by client address and by credential
+type authThrottle struct {
+	config AuthThrottleConfig
+
+	mu        sync.Mutex
+	records   map[string]*failureRecord
+	lastSweep time.Time
+}
+
+// failureRecord holds the recent failures of one address or credential
+type failureRecord struct {
+	failures    int
+	last        time.Time
+	lockouts    int
+	lockedUntil time.Time
+}
+
+func newAuthThrottle(config AuthThrottleConfig) *authThrottle {
+	if config.Disabled {
+		return nil
+	}
+	if config.MaxFailures <= 0 {
+		config.MaxFailures = DefaultMaxAuthFailures
+	}
+	if config.Window <= 0 {
+		config.Window = DefaultAuthFailureWindow
+	}
+	if config.Lockout <= 0 {
+		config.Lockout = DefaultAuthLockout
+	}
+	if config.MaxLockout < config.Lockout {
+		config.MaxLockout = max(DefaultMaxAuthLockout, config.Lockout)
+	}
+	if config.Delay <= 0 {
+		config.Delay = DefaultAuthFailureDelay
+	}
+	return &authThrottle{config: config, records: make(map[string]*failureRecord)}
+}
+
+// locked returns how long the first of keys that is locked out stays so
+func (t *authThrottle) locked(keys []string) time.Duration {
+	if t == nil {
+		return 0
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var wait time.Duration
+	for _, key := range keys {
+		if r, ok := t.records[key]; ok && r.lockedUntil.After(now) {
+			wait = max(wait, r.lockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+// fail records a failure of every key. It returns the highest failure count, the
+// longest lockout started, and how long to hold back the answer.
+func (t *authThrottle) fail(keys []string) (failures int, lockout, delay time.Duration) {
+	if t == nil {
+		return 0, 0, 0
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sweep(now)
+	for _, key := range keys {
+		r, ok := t.records[key]
+		if !ok {
+			if len(t.records) >= maxThrottleEntries {
+				continue
+			}
+			r = &failureRecord{}
+			t.records[key] = r
+		}
+		if now.Sub(r.last) > t.config.Window {
+			r.failures, r.lockouts = 0, 0
+		}
+		r.failures++
+		r.last = now
+		failures = max(failures, r.failures)
+		if r.failures >= t.config.MaxFailures {
+			d := min(t.config.Lockout<<min(r.lockouts, 30), t.config.MaxLockout)
+			r.lockedUntil = now.Add(d)
+			r.lockouts++
+			r.failures = 0
+			lockout = max(lockout, d)
+		}
+	}
+	if failures > 0 {
+		delay = min(t.config.Delay<<min(failures-1, 30), maxAuthFailureDelay)
+	}
+	return failures, lockout, delay
+}
+
+// succeed forgets the failures of a credential that was accepted. Failures of the
+// address are kept, so that a valid key does not let its holder guess others.
+func (t *authThrottle) succeed(key string) {
+	if t == nil || key == "" {
+		return
+	}
+	t.mu.Lock()
+	delete(t.records, key)
+	t.mu.Unlock()
+}
+
+// sweep drops records that no longer matter, at most once a minute
+func (t *authThrottle) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < time.Minute {
+		return
+	}
+	t.lastSweep = now
+	for key, r := range t.records {
+		if now.Sub(r.last) > t.config.Window && now.After(r.lockedUntil) {
+			delete(t.records, key)
+		}
+	}
+}
+
+// throttleKeys returns the records a call counts against: its address and, when it
+// presented one, its credential
+func throttleKeys(remote, keyID string) []string {
+	keys := []string{"peer:" + remote}
+	if keyID != "" {
+		keys = append(keys, "key:"+keyID)
+	}
+	return keys
+}
+
+// presentedKeyID returns the KeyID of the credential a call carries for the auth
+// method, or "" when it carries none
+func (am *AuthManager) presentedKeyID(md metadata.MD) string {
+	get := func(name string) string {
+		if values := md.Get(name); len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	switch am.config.AuthMethod {
+	case AuthMethodAPIKey:
+		if key := get("x-api-key"); key != "" {
+			return KeyID(key)
+		}
+	case AuthMethodHMAC:
+		// Signed requests name their key by its id already
+		return get(protocol.SignatureKeyIDHeader)
+	default:
+		if token := get("authorization"); token != "" {
+			return KeyID(token)
+		}
+	}
+	return ""
+}
+
+// peerAddress returns the address of the client of a gRPC call, without the port
+func peerAddress(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return "unknown"
+	}
+	return hostOnly(p.Addr.String())
+}
+
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// OnFailure sets a function called with every call rejected by authentication
+func (am *AuthManager) OnFailure(f func(AuthFailure)) {
+	am.onFailure = f
+}
+
+// report passes a failure on to the OnFailure function
+func (am *AuthManager) report(failure AuthFailure) {
+	if failure.Lockout > 0 {
+		log.Printf("Locked out %s (key %s) for %s after %d failed authentication attempts",
+			failure.Peer, failure.KeyID, failure.Lockout, am.throttle.config.MaxFailures)
+	}
+	if am.onFailure != nil {
+		am.onFailure(failure)
+	}
+}
+
+// AuditAuth counts the failures of am in the metrics and publishes them as events
+func (s *Server) AuditAuth(am *AuthManager) {
+	am.OnFailure(func(f AuthFailure) {
+		detail := fmt.Sprintf("peer %s", f.Peer)
+		if f.KeyID != "" {
+			detail += ", key " + f.KeyID
+		}
+		switch {
+		case f.Locked:
+			s.metrics.Inc("broker_auth_failures_total", "reason", "locked")
+			return
+		case f.Network:
+			s.metrics.Inc("broker_auth_failures_total", "reason", "network")
+		case f.Policy:
+			s.metrics.Inc("broker_auth_failures_total", "reason", "policy")
+		default:
+			s.metrics.Inc("broker_auth_failures_total", "reason", "invalid")
+		}
+		s.emit(pb.BrokerEventType_BROKER_EVENT_TYPE_AUTH_FAILED, "", "", nil, detail+": "+f.Err.Error())
+		if f.Lockout > 0 {
+			s.metrics.Inc("broker_auth_lockouts_total")
+			s.emit(pb.BrokerEventType_BROKER_EVENT_TYPE_AUTH_LOCKED_OUT, "", "", nil, fmt.Sprintf("%s, for %s", detail, f.Lockout))
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	"google.golang.org/grpc/metadata"
+)
+
+const signedSendMethod = "/base.proto.Broker/Send"
+
+// signedContext returns the incoming context of a call signed with key, or carrying
+// signature instead when it is not empty
+func signedContext(key, keyID, nonce, signature string) context.Context {
+	timestamp := time.Now().Unix()
+	if signature == "" {
+		signature = protocol.Sign(key, signedSendMethod, timestamp, nonce, nil)
+	}
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		protocol.SignatureKeyIDHeader, keyID,
+		protocol.SignatureTimestampHeader, fmt.Sprint(timestamp),
+		protocol.SignatureNonceHeader, nonce,
+		protocol.SignatureHeader, signature,
+	))
+}
+
+func TestThrottleForgedKeyID(t *testing.T) {
+	am := NewAuthManager(&AuthConfig{
+		EnableAuth: true,
+		AuthMethod: AuthMethodHMAC,
+		APIKeys:    map[string]string{"victim-key": "orders"},
+		Throttle:   AuthThrottleConfig{MaxFailures: 3, Lockout: time.Hour, Delay: time.Millisecond},
+	})
+	call := signedCall{method: signedSendMethod}
+	victimID := KeyID("victim-key")
+
+	// Garbage signatures naming the victim's key, from addresses the attacker rotates
+	for i := range 10 {
+		ctx := signedContext("", victimID, fmt.Sprintf("forged-%d", i), "deadbeef")
+		if _, _, err := am.authenticate(ctx, fmt.Sprintf("10.0.0.%d", 100+i), "Send", call); err == nil {
+			t.Fatal("expected a forged signature to be refused")
+		}
+	}
+	if service, _, err := am.authenticate(signedContext("victim-key", victimID, "genuine", ""), "10.0.0.1", "Send", call); err != nil || service != "orders" {
+		t.Fatalf("expected the holder of the key to get through, got %q (%v)", service, err)
+	}
+
+	// The address of the forger is throttled all the same
+	for i := range 3 {
+		am.authenticate(signedContext("", victimID, fmt.Sprintf("again-%d", i), "deadbeef"), "10.0.0.66", "Send", call)
+	}
+	var locked *LockedOutError
+	if _, _, err := am.authenticate(signedContext("victim-key", victimID, "from-forger", ""), "10.0.0.66", "Send", call); !errors.As(err, &locked) {
+		t.Fatalf("expected the forger's address to be locked out, got %v", err)
+	}
+}
+
+func TestThrottleCredential(t *testing.T) {
+	am := NewAuthManager(&AuthConfig{
+		EnableAuth: true,
+		AuthMethod: AuthMethodAPIKey,
+		APIKeys:    map[string]string{"valid-key": "orders"},
+		Throttle:   AuthThrottleConfig{MaxFailures: 3, Lockout: time.Hour, Delay: time.Millisecond},
+	})
+	withKey := func(key string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-api-key", key))
+	}
+
+	// A guessed key is locked out whichever address tries it
+	for i := range 3 {
+		if _, _, err := am.authenticate(withKey("guess"), fmt.Sprintf("10.0.1.%d", i), "Send", signedCall{}); err == nil {
+			t.Fatal("expected an invalid key to be refused")
+		}
+	}
+	var locked *LockedOutError
+	if _, _, err := am.authenticate(withKey("guess"), "10.0.1.99", "Send", signedCall{}); !errors.As(err, &locked) {
+		t.Fatalf("expected the guessed key to be locked out, got %v", err)
+	}
+	if service, _, err := am.authenticate(withKey("valid-key"), "10.0.1.99", "Send", signedCall{}); err != nil || service != "orders" {
+		t.Fatalf("expected a valid key from a fresh address to get through, got %q (%v)", service, err)
+	}
+}
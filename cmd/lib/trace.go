@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// TraceMetadataKey carries a trace id in request metadata (or the X-Trace-Id HTTP
+// header on the gateway) and in the response header
+const TraceMetadataKey = "x-trace-id"
+
+// newTraceID returns a random 128-bit trace id in hex, like W3C trace ids
+func newTraceID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// traceID returns the trace id of a request: the one carried by the message, then
+// the one in the request metadata, else a new one
+func traceID(ctx context.Context, carried string) string {
+	if carried != "" {
+		return carried
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(TraceMetadataKey); len(values) > 0 && values[0] != "" {
+			return values[0]
+		}
+	}
+	return newTraceID()
+}
+
+// stampTrace sets the trace id of msg at ingress and returns it
+func stampTrace(ctx context.Context, msg *pb.Message) string {
+	msg.TraceId = traceID(ctx, msg.TraceId)
+	return msg.TraceId
+}
+
+// withTrace attaches a trace id to the result of a call: the Status, the Status
+// detail of the error, and the response header
+func withTrace(ctx context.Context, id string, st *pb.Status, err error) (*pb.Status, error) {
+	// Outside of a gRPC call, e.g. when the server is embedded, there is no header to set
+	grpc.SetHeader(ctx, metadata.Pairs(TraceMetadataKey, id))
+	if st == nil {
+		return st, err
+	}
+	st.TraceId = id
+	if err == nil {
+		return st, nil
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		return st, err
+	}
+	traced, detailErr := status.New(s.Code(), s.Message()).WithDetails(st)
+	if detailErr != nil {
+		return st, err
+	}
+	return st, traced.Err()
+}
+
+// traceIDs lists the distinct trace ids of msgs for logging
+func traceIDs(msgs []*pb.Message) string {
+	seen := make(map[string]bool, len(msgs))
+	var ids []string
+	for _, msg := range msgs {
+		if !seen[msg.TraceId] {
+			seen[msg.TraceId] = true
+			ids = append(ids, msg.TraceId)
+		}
+	}
+	return strings.Join(ids, ",")
+}
@@ -0,0 +1,249 @@
+package lib
+
+import (
+	"context"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	pbv2 "github.com/ispapp/Microservices-Broker/base/v2/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// V2Server serves the broker.v2 API on top of the v1 implementation. Both versions
+// share field and enum numbers, so requests and replies are converted through the wire format.
+type V2Server struct {
+	pbv2.UnimplementedBrokerServer
+	server *Server
+}
+
+// NewV2Server returns the broker.v2 service backed by server
+func NewV2Server(server *Server) *V2Server {
+	return &V2Server{server: server}
+}
+
+// convert copies src into dst, which must have a wire compatible schema
+func convert(src, dst proto.Message) error {
+	data, err := proto.Marshal(src)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(data, dst)
+}
+
+// relay converts a v2 request to v1, calls the v1 handler and converts its reply into out
+func relay[In, Out proto.Message](ctx context.Context, handler func(context.Context, In) (Out, error), req proto.Message, in In, out proto.Message) error {
+	if err := convert(req, in); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	reply, err := handler(ctx, in)
+	if err != nil {
+		return v2Error(err)
+	}
+	return convert(reply, out)
+}
+
+// v2Error replaces the v1 Status detail of a gRPC error with its v2 equivalent
+func v2Error(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	converted := status.New(st.Code(), st.Message())
+	for _, detail := range st.Details() {
+		v1, ok := detail.(*pb.Status)
+		if !ok {
+			continue
+		}
+		v2 := new(pbv2.Status)
+		if convert(v1, v2) != nil {
+			continue
+		}
+		if withDetail, err := converted.WithDetails(v2); err == nil {
+			converted = withDetail
+		}
+	}
+	return converted.Err()
+}
+
+// statusCall relays a v2 request to a v1 handler that replies with a Status
+func statusCall[In proto.Message](ctx context.Context, handler func(context.Context, In) (*pb.Status, error), req proto.Message, in In) (*pbv2.Status, error) {
+	out := new(pbv2.Status)
+	if err := relay(ctx, handler, req, in, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Receive streams messages converted to v2
+func (v *V2Server) Receive(req *pbv2.Identity, stream pbv2.Broker_ReceiveServer) error {
+	identity := new(pb.Identity)
+	if err := convert(req, identity); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return v.server.Receive(identity, v2ReceiveStream{ServerStream: stream, stream: stream})
+}
+
+// v2ReceiveStream adapts a v2 Receive stream to the v1 server
+type v2ReceiveStream struct {
+	grpc.ServerStream
+	stream pbv2.Broker_ReceiveServer
+}
+
+func (s v2ReceiveStream) Send(msg *pb.Message) error {
+	out := new(pbv2.Message)
+	if err := convert(msg, out); err != nil {
+		return err
+	}
+	return s.stream.Send(out)
+}
+
+func (v *V2Server) WatchEvents(req *pbv2.WatchEventsRequest, stream pbv2.Broker_WatchEventsServer) error {
+	in := new(pb.WatchEventsRequest)
+	if err := convert(req, in); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return v.server.WatchEvents(in, v2EventStream{ServerStream: stream, stream: stream})
+}
+
+// v2EventStream adapts a v2 WatchEvents stream to the v1 server
+type v2EventStream struct {
+	grpc.ServerStream
+	stream pbv2.Broker_WatchEventsServer
+}
+
+func (s v2EventStream) Send(ev *pb.BrokerEvent) error {
+	out := new(pbv2.BrokerEvent)
+	if err := convert(ev, out); err != nil {
+		return err
+	}
+	return s.stream.Send(out)
+}
+
+func (v *V2Server) Federate(stream pbv2.Broker_FederateServer) error {
+	return v.server.Federate(v2FederateStream{ServerStream: stream, stream: stream})
+}
+
+// v2FederateStream adapts a v2 Federate stream to the v1 server
+type v2FederateStream struct {
+	grpc.ServerStream
+	stream pbv2.Broker_FederateServer
+}
+
+func (s v2FederateStream) Send(ack *pb.FederationAck) error {
+	out := new(pbv2.FederationAck)
+	if err := convert(ack, out); err != nil {
+		return err
+	}
+	return s.stream.Send(out)
+}
+
+func (s v2FederateStream) Recv() (*pb.Message, error) {
+	msg, err := s.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+	in := new(pb.Message)
+	if err := convert(msg, in); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return in, nil
+}
+
+func (v *V2Server) Hello(ctx context.Context, req *pbv2.HelloRequest) (*pbv2.HelloResponse, error) {
+	out := new(pbv2.HelloResponse)
+	if err := relay(ctx, v.server.Hello, req, new(pb.HelloRequest), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (v *V2Server) GetQuotaUsage(ctx context.Context, req *pbv2.QuotaUsageRequest) (*pbv2.QuotaUsageResponse, error) {
+	out := new(pbv2.QuotaUsageResponse)
+	if err := relay(ctx, v.server.GetQuotaUsage, req, new(pb.QuotaUsageRequest), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (v *V2Server) GetStats(ctx context.Context, req *pbv2.StatsRequest) (*pbv2.StatsResponse, error) {
+	out := new(pbv2.StatsResponse)
+	if err := relay(ctx, v.server.GetStats, req, new(pb.StatsRequest), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (v *V2Server) Ping(ctx context.Context, req *pbv2.Identity) (*pbv2.Status, error) {
+	return statusCall(ctx, v.server.Ping, req, new(pb.Identity))
+}
+
+func (v *V2Server) Send(ctx context.Context, req *pbv2.Message) (*pbv2.Status, error) {
+	return statusCall(ctx, v.server.Send, req, new(pb.Message))
+}
+
+func (v *V2Server) SendBatch(ctx context.Context, req *pbv2.Batch) (*pbv2.Status, error) {
+	return statusCall(ctx, v.server.SendBatch, req, new(pb.Batch))
+}
+
+func (v *V2Server) Cleanup(ctx context.Context, req *pbv2.Identity) (*pbv2.Status, error) {
+	return statusCall(ctx, v.server.Cleanup, req, new(pb.Identity))
+}
+
+func (v *V2Server) Ack(ctx context.Context, req *pbv2.AckRequest) (*pbv2.Status, error) {
+	return statusCall(ctx, v.server.Ack, req, new(pb.AckRequest))
+}
+
+func (v *V2Server) Nack(ctx context.Context, req *pbv2.NackRequest) (*pbv2.Status, error) {
+	return statusCall(ctx, v.server.Nack, req, new(pb.NackRequest))
+}
+
+func (v *V2Server) PauseDelivery(ctx context.Context, req *pbv2.Identity) (*pbv2.Status, error) {
+	return statusCall(ctx, v.server.PauseDelivery, req, new(pb.Identity))
+}
+
+func (v *V2Server) ResumeDelivery(ctx context.Context, req *pbv2.Identity) (*pbv2.Status, error) {
+	return statusCall(ctx, v.server.ResumeDelivery, req, new(pb.Identity))
+}
+
+func (v *V2Server) SetReadOnly(ctx context.Context, req *pbv2.ReadOnlyRequest) (*pbv2.Status, error) {
+	return statusCall(ctx, v.server.SetReadOnly, req, new(pb.ReadOnlyRequest))
+}
+
+func (v *V2Server) SetLogLevel(ctx context.Context, req *pbv2.LogLevelRequest) (*pbv2.Status, error) {
+	return statusCall(ctx, v.server.SetLogLevel, req, new(pb.LogLevelRequest))
+}
+
+func (v *V2Server) SetPayloadLogging(ctx context.Context, req *pbv2.PayloadLoggingRequest) (*pbv2.Status, error) {
+	return statusCall(ctx, v.server.SetPayloadLogging, req, new(pb.PayloadLoggingRequest))
+}
+
+func (v *V2Server) SetSlowLogging(ctx context.Context, req *pbv2.SlowLoggingRequest) (*pbv2.Status, error) {
+	return statusCall(ctx, v.server.SetSlowLogging, req, new(pb.SlowLoggingRequest))
+}
+
+func (v *V2Server) Fetch(ctx context.Context, req *pbv2.FetchRequest) (*pbv2.FetchResponse, error) {
+	out := new(pbv2.FetchResponse)
+	if err := relay(ctx, v.server.Fetch, req, new(pb.FetchRequest), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (v *V2Server) ExtendVisibility(ctx context.Context, req *pbv2.ExtendVisibilityRequest) (*pbv2.ExtendVisibilityResponse, error) {
+	out := new(pbv2.ExtendVisibilityResponse)
+	if err := relay(ctx, v.server.ExtendVisibility, req, new(pb.ExtendVisibilityRequest), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (v *V2Server) Tap(req *pbv2.TapRequest, stream pbv2.Broker_TapServer) error {
+	in := new(pb.TapRequest)
+	if err := convert(req, in); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return v.server.Tap(in, v2ReceiveStream{ServerStream: stream, stream: stream})
+}
@@ -0,0 +1,610 @@
+package lib
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+	"github.com/ispapp/Microservices-Broker/base/shard"
+)
+
+// Severity classifies configuration issues
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// ConfigIssue is a single problem found while validating a configuration
+type ConfigIssue struct {
+	Severity Severity
+	Field    string
+	Message  string
+}
+
+func (i ConfigIssue) String() string {
+	return fmt.Sprintf("%s: %s: %s", i.Severity, i.Field, i.Message)
+}
+
+// HasErrors reports whether any issue is an error. With strict set, warnings count too.
+func HasErrors(issues []ConfigIssue, strict bool) bool {
+	for _, issue := range issues {
+		if issue.Severity == SeverityError || strict {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the configuration for contradictions and risky settings
+func (c *Config) Validate() []ConfigIssue {
+	var issues []ConfigIssue
+	add := func(severity Severity, field, format string, args ...any) {
+		issues = append(issues, ConfigIssue{Severity: severity, Field: field, Message: fmt.Sprintf(format, args...)})
+	}
+	fileMissing := func(path string) bool {
+		_, err := os.Stat(path)
+		return path == "" || (err != nil && !IsSecretRef(path))
+	}
+
+	// Server
+	if c.Server.TickSeconds <= 0 {
+		add(SeverityError, "server.tick_seconds", "must be positive, got %d", c.Server.TickSeconds)
+	}
+	if c.Server.MaxAge <= 0 {
+		add(SeverityWarning, "server.max_age", "is %s, queued messages will never expire", c.Server.MaxAge)
+	}
+	if c.Server.BatchSize <= 0 {
+		add(SeverityWarning, "server.batch_size", "is %d, the default of %d will be used", c.Server.BatchSize, DefaultBatchSize)
+	}
+	if c.Server.RequestTimeout < 0 {
+		add(SeverityError, "server.request_timeout", "must not be negative")
+	}
+	if c.Server.AckTimeout < 0 {
+		add(SeverityError, "server.ack_timeout", "must not be negative")
+	}
+	if c.Server.StreamLifetime < 0 {
+		add(SeverityError, "server.stream_lifetime", "must not be negative")
+	}
+	if c.Server.DiskHighWatermark < 0 || c.Server.DiskHighWatermark > 1 {
+		add(SeverityError, "server.disk_high_watermark", "must be between 0 and 1")
+	}
+	if c.Server.DiskLowWatermark < 0 || c.Server.DiskLowWatermark > 1 {
+		add(SeverityError, "server.disk_low_watermark", "must be between 0 and 1")
+	} else if c.Server.DiskLowWatermark > c.Server.DiskHighWatermark && c.Server.DiskHighWatermark > 0 {
+		add(SeverityWarning, "server.disk_low_watermark", "is above disk_high_watermark, the high watermark will be used")
+	}
+	if c.Server.MaxDBSize < 0 {
+		add(SeverityError, "server.max_db_size", "must not be negative")
+	}
+	if c.Server.MaxInflightBytes < 0 {
+		add(SeverityError, "server.max_inflight_bytes", "must not be negative")
+	}
+	if c.Server.KeepaliveInterval < 0 {
+		add(SeverityError, "server.keepalive_interval", "must not be negative")
+	}
+	if c.Server.KeepaliveTimeout < 0 {
+		add(SeverityError, "server.keepalive_timeout", "must not be negative")
+	}
+	if c.Server.HeartbeatInterval < 0 {
+		add(SeverityError, "server.heartbeat_interval", "must not be negative")
+	}
+	validateQuota := func(field string, q QuotaConfig) {
+		if q.HourlyMessages < 0 || q.HourlyBytes < 0 || q.DailyMessages < 0 || q.DailyBytes < 0 {
+			add(SeverityError, field, "limits must not be negative")
+		}
+	}
+	validateQuota("server.quota", c.Server.Quota)
+	if c.Server.DeliveryConcurrency < 0 {
+		add(SeverityError, "server.delivery_concurrency", "must not be negative")
+	}
+	if c.Server.BacklogCheckInterval < 0 {
+		add(SeverityError, "server.backlog_check_interval", "must not be negative")
+	}
+	if err := checkInterceptors(c.Server.Interceptors); err != nil {
+		add(SeverityError, "server.interceptors", "%v", err)
+	} else if len(c.Server.Interceptors) > 0 {
+		position := func(name string) int { return slices.Index(c.Server.Interceptors, name) }
+		if c.Auth.EnableAuth && position(InterceptorAuth) < 0 {
+			add(SeverityError, "server.interceptors", "authentication is enabled but the pipeline has no auth interceptor")
+		}
+		if c.Server.RateLimit.PerSecond > 0 && position(InterceptorRateLimit) < 0 {
+			add(SeverityWarning, "server.interceptors", "server.rate_limit is set but the pipeline has no rate_limit interceptor")
+		}
+		if auth, limit := position(InterceptorAuth), position(InterceptorRateLimit); c.Auth.EnableAuth && limit >= 0 && limit < auth {
+			add(SeverityWarning, "server.interceptors", "rate_limit runs before auth, calls are limited by client address instead of service")
+		}
+		if c.Server.AccessLog.File != "" && position(InterceptorAccessLog) < 0 {
+			add(SeverityWarning, "server.interceptors", "server.access_log is set but the pipeline has no access_log interceptor")
+		}
+		if access, auth := position(InterceptorAccessLog), position(InterceptorAuth); access >= 0 && auth >= 0 && access > auth {
+			add(SeverityWarning, "server.interceptors", "access_log runs after auth, calls refused by authentication are not logged")
+		}
+		if recovery := position(InterceptorRecovery); recovery > 0 {
+			add(SeverityWarning, "server.interceptors", "recovery is not first, panics in the interceptors before it crash the broker")
+		}
+	}
+	if c.Server.RateLimit.PerSecond < 0 || c.Server.RateLimit.Burst < 0 {
+		add(SeverityError, "server.rate_limit", "must not be negative")
+	}
+	if err := c.Server.AccessLog.check(); err != nil {
+		add(SeverityError, "server.access_log", "%v", err)
+	}
+	if err := checkLogLevel(c.Server.LogLevel); err != nil {
+		add(SeverityError, "server.log_level", "%v", err)
+	}
+	if c.Server.SlowLogThreshold < 0 {
+		add(SeverityError, "server.slow_log_threshold", "must not be negative")
+	}
+	if _, err := ParseDurability(c.Server.Durability); err != nil {
+		add(SeverityError, "server.durability", "%v", err)
+	}
+	if _, err := ParseDuplicatePolicy(c.Server.DuplicateConnections); err != nil {
+		add(SeverityError, "server.duplicate_connections", "%v", err)
+	}
+
+	// Listeners
+	names := make(map[string]bool)
+	addresses := make(map[string]string)
+	for i, l := range c.Server.EffectiveListeners() {
+		field := fmt.Sprintf("server.listeners[%d]", i)
+		if len(c.Server.Listeners) == 0 {
+			field = "server"
+		}
+		switch l.Kind {
+		case ListenerGRPC, ListenerGRPCTLS, ListenerGRPCQUIC, ListenerHTTPGateway, ListenerMetrics, ListenerAdmin:
+		default:
+			add(SeverityError, field+".kind", "unknown listener kind %q", l.Kind)
+		}
+		if l.Port == "" {
+			add(SeverityError, field+".port", "is required")
+		}
+		if names[l.Name] {
+			add(SeverityError, field+".name", "duplicate listener name %q", l.Name)
+		}
+		names[l.Name] = true
+		// QUIC binds UDP, so it may share a port number with a TCP listener
+		address := l.Address()
+		if l.Kind == ListenerGRPCQUIC {
+			address = "udp/" + address
+		}
+		if other, ok := addresses[address]; ok {
+			add(SeverityError, field+".port", "address %s is already used by listener %q", l.Address(), other)
+		}
+		addresses[address] = l.Name
+		if l.Pprof && l.Kind != ListenerMetrics && l.Kind != ListenerAdmin {
+			add(SeverityError, field+".pprof", "profiles are served on metrics and admin listeners only")
+		} else if l.Pprof && !c.Auth.EnableAuth {
+			add(SeverityError, field+".pprof", "profiles need authentication, which is disabled")
+		} else if l.Pprof && len(c.Auth.Policy.AdminServices) == 0 && len(c.Auth.Policy.AdminKeys) == 0 {
+			add(SeverityError, field+".pprof", "profiles need an admin, but auth.policy has no admin_services or admin_keys")
+		}
+		if l.TLSEnabled {
+			if fileMissing(l.TLSCertFile) {
+				add(SeverityError, field+".tls_cert_file", "TLS is enabled but certificate %q does not exist", l.TLSCertFile)
+			}
+			if fileMissing(l.TLSKeyFile) {
+				add(SeverityError, field+".tls_key_file", "TLS is enabled but key %q does not exist", l.TLSKeyFile)
+			}
+		}
+	}
+
+	// Auth
+	if !c.Auth.EnableAuth {
+		add(SeverityWarning, "auth.EnableAuth", "authentication is disabled")
+	} else {
+		switch c.Auth.AuthMethod {
+		case AuthMethodJWT:
+			if c.Auth.JWTSecret == "" && c.Auth.OIDC == nil {
+				add(SeverityWarning, "auth.JWTSecret", "is empty, a random secret will be generated and issued tokens will not survive a restart")
+			}
+		case AuthMethodAPIKey, AuthMethodHMAC:
+			if len(c.Auth.APIKeys) == 0 {
+				add(SeverityWarning, "auth.APIKeys", "API key authentication is enabled but no keys are configured, every call will be rejected")
+			}
+		default:
+			add(SeverityError, "auth.AuthMethod", "unknown authentication method %d", c.Auth.AuthMethod)
+		}
+	}
+	if oidc := c.Auth.OIDC; oidc != nil {
+		if oidc.Issuer == "" {
+			add(SeverityError, "auth.oidc.issuer", "is required")
+		} else if u, err := url.Parse(oidc.Issuer); err != nil || u.Scheme == "" || u.Host == "" {
+			add(SeverityError, "auth.oidc.issuer", "%q is not a URL", oidc.Issuer)
+		}
+		if oidc.JWKSURL != "" {
+			if u, err := url.Parse(oidc.JWKSURL); err != nil || u.Scheme == "" || u.Host == "" {
+				add(SeverityError, "auth.oidc.jwks_url", "%q is not a URL", oidc.JWKSURL)
+			}
+		}
+		if oidc.RefreshInterval < 0 {
+			add(SeverityError, "auth.oidc.refresh_interval", "must not be negative")
+		}
+		if oidc.Audience == "" {
+			add(SeverityWarning, "auth.oidc.audience", "is empty, tokens the identity provider issued for other applications will be accepted")
+		}
+		if c.Auth.AuthMethod != AuthMethodJWT {
+			add(SeverityWarning, "auth.oidc", "is only used with the JWT authentication method")
+		}
+	}
+	if c.Auth.SignatureWindow < 0 {
+		add(SeverityError, "auth.signature_window", "must not be negative")
+	}
+	if c.Auth.StreamRecheckInterval < 0 {
+		add(SeverityError, "auth.stream_recheck_interval", "must not be negative")
+	}
+	validateNetworks := func(field string, p *NetworkPolicy) {
+		if p == nil {
+			return
+		}
+		for i, entry := range p.Allow {
+			if _, err := parsePrefix(entry); err != nil {
+				add(SeverityError, fmt.Sprintf("%s.allow[%d]", field, i), "%q is not an address or CIDR range", entry)
+			}
+		}
+		for i, entry := range p.Deny {
+			if _, err := parsePrefix(entry); err != nil {
+				add(SeverityError, fmt.Sprintf("%s.deny[%d]", field, i), "%q is not an address or CIDR range", entry)
+			}
+		}
+	}
+	for key, p := range c.Auth.KeyNetworks {
+		field := "auth.key_networks." + KeyID(key)
+		if _, ok := c.Auth.APIKeys[key]; !ok {
+			add(SeverityWarning, field, "is not a configured API key")
+		}
+		validateNetworks(field, p)
+	}
+	for service, p := range c.Auth.ServiceNetworks {
+		validateNetworks("auth.service_networks."+service, p)
+	}
+	methods := KnownMethods()
+	validateMethods := func(field string, p *MethodPolicy) {
+		if p == nil {
+			return
+		}
+		for i, method := range p.Allow {
+			if method != PolicyAllMethods && method != PolicyAdminMethods && !slices.Contains(methods, method) {
+				add(SeverityWarning, fmt.Sprintf("%s.allow[%d]", field, i), "%q is not a broker method", method)
+			}
+		}
+		for i, method := range p.Deny {
+			if method != PolicyAllMethods && method != PolicyAdminMethods && !slices.Contains(methods, method) {
+				add(SeverityWarning, fmt.Sprintf("%s.deny[%d]", field, i), "%q is not a broker method", method)
+			}
+		}
+	}
+	for service, p := range c.Auth.Policy.Services {
+		if err := protocol.CheckPattern(service); protocol.IsPattern(service) && err != nil {
+			add(SeverityError, "auth.policy.services."+service, "%v", err)
+		}
+		validateMethods("auth.policy.services."+service, p)
+	}
+	for key, p := range c.Auth.Policy.Keys {
+		field := "auth.policy.keys." + KeyID(key)
+		if _, ok := c.Auth.APIKeys[key]; !ok {
+			add(SeverityWarning, field, "is not a configured API key")
+		}
+		validateMethods(field, p)
+	}
+	for i, key := range c.Auth.Policy.AdminKeys {
+		if _, ok := c.Auth.APIKeys[key]; !ok {
+			add(SeverityWarning, fmt.Sprintf("auth.policy.admin_keys[%d]", i), "is not a configured API key")
+		}
+	}
+	if throttle := c.Auth.Throttle; throttle.Disabled {
+		if c.Auth.EnableAuth {
+			add(SeverityWarning, "auth.throttle.disabled", "brute-force protection is off, credentials can be guessed at full speed")
+		}
+	} else {
+		if throttle.MaxFailures < 0 {
+			add(SeverityError, "auth.throttle.max_failures", "must not be negative")
+		}
+		if throttle.Window < 0 {
+			add(SeverityError, "auth.throttle.window", "must not be negative")
+		}
+		if throttle.Lockout < 0 {
+			add(SeverityError, "auth.throttle.lockout", "must not be negative")
+		}
+		if throttle.MaxLockout < 0 {
+			add(SeverityError, "auth.throttle.max_lockout", "must not be negative")
+		}
+		if throttle.Delay < 0 {
+			add(SeverityError, "auth.throttle.delay", "must not be negative")
+		}
+		if throttle.MaxLockout > 0 && throttle.MaxLockout < throttle.Lockout {
+			add(SeverityWarning, "auth.throttle.max_lockout", "is shorter than lockout, lockouts will last %s", throttle.Lockout)
+		}
+	}
+
+	// Database
+	if c.DB.Path == "" {
+		add(SeverityError, "database.path", "is required")
+	}
+	if c.DB.MaxValueSize < 0 {
+		add(SeverityError, "database.max_value_size", "must not be negative")
+	}
+	if c.Server.MaxRecvMsgSize < 0 {
+		add(SeverityError, "server.max_recv_msg_size", "must not be negative")
+	}
+	if c.Server.MaxSendMsgSize < 0 {
+		add(SeverityError, "server.max_send_msg_size", "must not be negative")
+	}
+	if maxValue := cmp.Or(c.DB.MaxValueSize, 1<<16); c.Server.MaxRecvMsgSize > maxValue && c.Offload.Threshold == 0 {
+		add(SeverityWarning, "server.max_recv_msg_size", "is larger than database.max_value_size (%d bytes), larger messages cannot be queued", maxValue)
+	}
+
+	// Services
+	for name, svc := range c.Services {
+		if svc.BatchSize < 0 {
+			add(SeverityError, "services."+name+".batch_size", "must not be negative")
+		}
+		if _, err := ParseDuplicatePolicy(svc.DuplicateConnections); err != nil {
+			add(SeverityError, "services."+name+".duplicate_connections", "%v", err)
+		}
+		if svc.Priority < 0 {
+			add(SeverityError, "services."+name+".priority", "must not be negative")
+		}
+		if svc.MaxBacklogAge < 0 {
+			add(SeverityError, "services."+name+".max_backlog_age", "must not be negative")
+		}
+		if svc.Quota != nil {
+			validateQuota("services."+name+".quota", *svc.Quota)
+		}
+	}
+
+	// Sharding
+	if len(c.Sharding.Shards) > 0 {
+		if shards, err := shard.New(c.Sharding.Shards); err != nil {
+			add(SeverityError, "sharding.shards", "%v", err)
+		} else if _, ok := shards.Get(c.Sharding.Self); !ok {
+			add(SeverityError, "sharding.self", "%q is not one of the shards", c.Sharding.Self)
+		}
+		if c.Sharding.TLSCAFile != "" && fileMissing(c.Sharding.TLSCAFile) {
+			add(SeverityError, "sharding.tls_ca_file", "%q does not exist", c.Sharding.TLSCAFile)
+		}
+		if c.Sharding.Proxy && c.Sharding.Secret == "" {
+			add(SeverityWarning, "sharding.secret", "is not set, forwarded calls are checked and routed again by the owning shard")
+		}
+	}
+
+	// Alerts
+	if c.Alerts.Interval < 0 {
+		add(SeverityError, "alerts.interval", "must not be negative")
+	}
+	rules := make(map[string]bool)
+	for i, rule := range c.Alerts.Rules {
+		field := fmt.Sprintf("alerts.rules[%d]", i)
+		if rule.Name == "" {
+			add(SeverityError, field+".name", "is required")
+		} else if rules[rule.Name] {
+			add(SeverityError, field+".name", "duplicate rule name %q", rule.Name)
+		}
+		rules[rule.Name] = true
+		switch rule.Condition {
+		case AlertQueueDepth:
+			if rule.Threshold < 0 {
+				add(SeverityError, field+".threshold", "must not be negative")
+			}
+		case AlertConsumerOffline:
+			if rule.Service == "" {
+				add(SeverityError, field+".service", "is required for consumer_offline")
+			}
+			if rule.For < 0 {
+				add(SeverityError, field+".for", "must not be negative")
+			}
+		case AlertDiskUsage:
+			if rule.Threshold <= 0 || rule.Threshold > 1 {
+				add(SeverityError, field+".threshold", "must be between 0 and 1 for disk_usage")
+			}
+		case AlertBacklogAge:
+			if rule.For < 0 {
+				add(SeverityError, field+".for", "must not be negative")
+			}
+			if rule.For == 0 && rule.Service != "" && c.Services[rule.Service].MaxBacklogAge <= 0 {
+				add(SeverityWarning, field+".for", "is not set and %s has no max_backlog_age, the rule never fires", rule.Service)
+			}
+		case AlertUnknownService:
+			if rule.Threshold < 0 {
+				add(SeverityError, field+".threshold", "must not be negative")
+			}
+			if !c.Registry.Strict {
+				add(SeverityWarning, field+".condition", "unknown_service never fires without a strict registry")
+			}
+		default:
+			add(SeverityError, field+".condition", "unknown condition %q (use 'queue_depth', 'consumer_offline', 'disk_usage', 'unknown_service' or 'backlog_age')", rule.Condition)
+		}
+		if rule.Webhook == "" && rule.Slack == "" {
+			add(SeverityWarning, field, "has neither a webhook nor a slack URL, it will only be logged")
+		}
+	}
+
+	// Reports
+	if c.Reports.Interval < 0 {
+		add(SeverityError, "reports.interval", "must not be negative")
+	} else if c.Reports.Interval > 0 && !c.Reports.enabled() {
+		add(SeverityWarning, "reports", "has no file, webhook, slack or email, no report is made")
+	}
+	if email := c.Reports.Email; email != nil {
+		if _, _, err := net.SplitHostPort(email.Server); err != nil {
+			add(SeverityError, "reports.email.server", "must be host:port: %v", err)
+		}
+		if email.From == "" {
+			add(SeverityError, "reports.email.from", "is required")
+		}
+		if len(email.To) == 0 {
+			add(SeverityError, "reports.email.to", "needs at least one recipient")
+		}
+		if email.Username != "" && email.Password == "" {
+			add(SeverityWarning, "reports.email.password", "is empty while a username is set")
+		}
+	}
+
+	// Egress
+	if err := c.Egress.check(); err != nil {
+		add(SeverityError, "egress.allow", "%v", err)
+	}
+	if len(c.Egress.Allow) > 0 && !c.Auth.EnableAuth {
+		add(SeverityWarning, "egress.allow", "authentication is disabled, senders are taken from the from field of messages")
+	}
+
+	// Validation
+	validations := make(map[string]bool)
+	for i, rule := range c.Validation {
+		field := fmt.Sprintf("validation[%d]", i)
+		if _, err := compileValidationRule(rule); err != nil {
+			add(SeverityError, field, "%v", err)
+		}
+		if validations[rule.Name] {
+			add(SeverityError, field+".name", "duplicate rule name %q", rule.Name)
+		}
+		validations[rule.Name] = true
+	}
+
+	// Plugins
+	plugins := make(map[string]bool)
+	for i, plugin := range c.Plugins {
+		field := fmt.Sprintf("plugins[%d]", i)
+		if err := plugin.check(); err != nil {
+			add(SeverityError, field, "%v", err)
+		} else if _, err := os.Stat(plugin.Path); err != nil {
+			add(SeverityError, field+".path", "%v", err)
+		}
+		if plugins[plugin.Name] {
+			add(SeverityError, field+".name", "duplicate plugin name %q", plugin.Name)
+		}
+		plugins[plugin.Name] = true
+	}
+
+	// Scripts
+	scripts := make(map[string]bool)
+	for i, script := range c.Scripts {
+		field := fmt.Sprintf("scripts[%d]", i)
+		if err := script.check(); err != nil {
+			add(SeverityError, field, "%v", err)
+		} else if L, err := newScriptState(script.Path); err != nil {
+			add(SeverityError, field+".path", "%v", err)
+		} else {
+			L.Close()
+		}
+		if scripts[script.Name] {
+			add(SeverityError, field+".name", "duplicate script name %q", script.Name)
+		}
+		scripts[script.Name] = true
+	}
+
+	// Offload
+	if err := c.Offload.check(); err != nil {
+		add(SeverityError, "offload", "%v", err)
+	}
+
+	// Registry
+	if err := c.Registry.check(); err != nil {
+		add(SeverityError, "registry", "%v", err)
+	}
+	for _, service := range c.KnownServices() {
+		if err := protocol.CheckPattern(service); protocol.IsPattern(service) && err != nil {
+			add(SeverityError, "registry.services", "%v", err)
+		}
+	}
+	if c.Registry.Strict && len(c.KnownServices()) == 0 {
+		add(SeverityWarning, "registry.services", "no service is known, every message will be refused or quarantined")
+	}
+
+	// Routing
+	routes := make(map[string]bool)
+	for i, rule := range c.Routing.Rules {
+		field := fmt.Sprintf("routing.rules[%d]", i)
+		if rule.Name == "" {
+			add(SeverityError, field+".name", "is required")
+		} else if routes[rule.Name] {
+			add(SeverityError, field+".name", "duplicate rule name %q", rule.Name)
+		}
+		routes[rule.Name] = true
+		if err := rule.check(); err != nil {
+			add(SeverityError, field, "%v", err)
+		}
+		if rule.From == "" && rule.To == "" && rule.Type == "" && len(rule.Headers) == 0 {
+			add(SeverityWarning, field, "matches every message")
+		}
+	}
+	for name, members := range c.Routing.Aliases {
+		if err := checkAlias(c.Routing.Aliases, name, members); err != nil {
+			add(SeverityError, "routing.aliases."+name, "%v", err)
+		}
+	}
+	for service, canary := range c.Routing.Canaries {
+		if err := canary.check(); err != nil {
+			add(SeverityError, "routing.canaries."+service, "%v", err)
+		}
+	}
+	enrichments := make(map[string]bool)
+	for i, e := range c.Routing.Enrichments {
+		field := fmt.Sprintf("routing.enrichments[%d]", i)
+		if err := e.check(); err != nil {
+			add(SeverityError, field, "%v", err)
+		}
+		if enrichments[e.Name] {
+			add(SeverityError, field+".name", "duplicate enrichment name %q", e.Name)
+		}
+		enrichments[e.Name] = true
+	}
+
+	// Redaction
+	for i, rule := range c.Redaction {
+		if err := new(Redactor).add(rule); err != nil {
+			add(SeverityError, fmt.Sprintf("redaction[%d]", i), "%v", err)
+		}
+	}
+
+	// Profiles
+	for name, overlay := range c.Profiles {
+		var probe Config
+		if err := json.Unmarshal(overlay, &probe); err != nil {
+			add(SeverityError, "profiles."+name, "is not a valid partial configuration: %v", err)
+		}
+	}
+
+	// Federation
+	if len(c.Federation.Links) > 0 && c.Federation.Name == "" {
+		add(SeverityError, "federation.name", "is required when links are configured")
+	}
+	links := make(map[string]bool)
+	homes := make(map[string]string)
+	for i, link := range c.Federation.Links {
+		field := fmt.Sprintf("federation.links[%d]", i)
+		if link.Name == "" {
+			add(SeverityError, field+".name", "is required")
+		} else if links[link.Name] {
+			add(SeverityError, field+".name", "duplicate link name %q", link.Name)
+		}
+		links[link.Name] = true
+		if link.Address == "" {
+			add(SeverityError, field+".address", "is required")
+		}
+		if len(link.Services) == 0 {
+			add(SeverityWarning, field+".services", "is empty, nothing will be forwarded")
+		}
+		for _, service := range link.Services {
+			if other, ok := homes[service]; ok {
+				add(SeverityError, field+".services", "%q is already homed on link %s", service, other)
+			}
+			homes[service] = link.Name
+		}
+		switch link.AuthMethod {
+		case "", "apikey", "jwt":
+		default:
+			add(SeverityError, field+".auth_method", "unknown method %q (use 'apikey' or 'jwt')", link.AuthMethod)
+		}
+		if link.TLSCAFile != "" && fileMissing(link.TLSCAFile) {
+			add(SeverityError, field+".tls_ca_file", "%q does not exist", link.TLSCAFile)
+		}
+	}
+	return issues
+}
@@ -0,0 +1,275 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	"google.golang.org/grpc/codes"
+)
+
+// What happens to a message that fails a validation rule
+const (
+	ValidationReject   = "reject"   // refuse the send (default)
+	ValidationAnnotate = "annotate" // accept the message with the failure in its ValidationHeader
+)
+
+// ValidationHeader is set on annotated messages to the rules they failed and why
+const ValidationHeader = "x-broker-validation"
+
+// Validator checks a message on Send. A non-nil error fails the rule of the validator,
+// its text being the reason.
+type Validator interface {
+	Validate(ctx context.Context, msg *pb.Message) error
+}
+
+// ValidatorFunc adapts a function to a Validator
+type ValidatorFunc func(ctx context.Context, msg *pb.Message) error
+
+// Validate calls f
+func (f ValidatorFunc) Validate(ctx context.Context, msg *pb.Message) error {
+	return f(ctx, msg)
+}
+
+// ValidationRule checks the messages sent to some services at ingress, so that invalid
+// payloads never reach their consumers
+type ValidationRule struct {
+	Name string `json:"name"`
+	// Services are the recipients the rule applies to, names or name patterns; every
+	// recipient when empty
+	Services []string `json:"services,omitempty"`
+	// Action is "reject" (default) or "annotate"
+	Action string `json:"action,omitempty"`
+	// MaxBytes is the largest payload accepted (0 = unlimited)
+	MaxBytes int `json:"max_bytes,omitempty"`
+	// Types are the message types accepted, e.g. "JSON" or "TEXT"; every type when empty
+	Types []string `json:"types,omitempty"`
+	// CheckContent requires JSON and XML payloads to parse, TEXT and HTML payloads to be
+	// UTF-8 and images to start with their format's signature
+	CheckContent bool `json:"check_content,omitempty"`
+	// Schema is a JSON schema the payload must satisfy, given inline or as SchemaFile
+	Schema     map[string]any `json:"schema,omitempty"`
+	SchemaFile string         `json:"schema_file,omitempty"`
+	// Validator is a custom check, set by programs embedding the broker
+	Validator Validator `json:"-"`
+}
+
+// validationRule is a rule with its checks compiled
+type validationRule struct {
+	ValidationRule
+	schema *jsonSchema
+}
+
+// Validators are the compiled validation rules
+type Validators struct {
+	rules []validationRule
+}
+
+// NewValidators checks and compiles validation rules
+func NewValidators(rules []ValidationRule) (*Validators, error) {
+	v := &Validators{}
+	names := make(map[string]bool)
+	for i, rule := range rules {
+		compiled, err := compileValidationRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("validation rule %d: %w", i, err)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("validation rule %d: duplicate name %q", i, rule.Name)
+		}
+		names[rule.Name] = true
+		v.rules = append(v.rules, compiled)
+	}
+	return v, nil
+}
+
+// compileValidationRule checks a rule and compiles its schema
+func compileValidationRule(rule ValidationRule) (validationRule, error) {
+	compiled := validationRule{ValidationRule: rule}
+	if rule.Name == "" {
+		return compiled, errors.New("name is required")
+	}
+	switch rule.Action {
+	case "", ValidationReject, ValidationAnnotate:
+	default:
+		return compiled, fmt.Errorf("unknown action %q (use 'reject' or 'annotate')", rule.Action)
+	}
+	if rule.MaxBytes < 0 {
+		return compiled, errors.New("max_bytes must not be negative")
+	}
+	for _, service := range rule.Services {
+		if err := protocol.CheckPattern(service); err != nil {
+			return compiled, err
+		}
+	}
+	for _, t := range rule.Types {
+		if _, ok := pb.Type_value[strings.ToUpper(t)]; !ok {
+			return compiled, fmt.Errorf("unknown message type %q", t)
+		}
+	}
+	var schema []byte
+	switch {
+	case rule.Schema != nil && rule.SchemaFile != "":
+		return compiled, errors.New("set either schema or schema_file")
+	case rule.Schema != nil:
+		data, err := json.Marshal(rule.Schema)
+		if err != nil {
+			return compiled, fmt.Errorf("invalid schema: %w", err)
+		}
+		schema = data
+	case rule.SchemaFile != "":
+		data, err := os.ReadFile(rule.SchemaFile)
+		if err != nil {
+			return compiled, fmt.Errorf("failed to read schema: %w", err)
+		}
+		schema = data
+	}
+	if schema != nil {
+		var err error
+		if compiled.schema, err = compileSchema(schema); err != nil {
+			return compiled, err
+		}
+	}
+	if rule.MaxBytes == 0 && len(rule.Types) == 0 && !rule.CheckContent && compiled.schema == nil && rule.Validator == nil {
+		return compiled, errors.New("checks nothing, set max_bytes, types, check_content or a schema")
+	}
+	return compiled, nil
+}
+
+// WithValidation checks the messages sent to the broker against v
+func WithValidation(v *Validators) ServerOption {
+	return func(s *Server) {
+		if v != nil && len(v.rules) > 0 {
+			s.validators = v
+		}
+	}
+}
+
+// applies reports whether the rule checks messages sent to service
+func (r *validationRule) applies(service string) bool {
+	if len(r.Services) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(r.Services, func(pattern string) bool {
+		return protocol.MatchName(pattern, service)
+	})
+}
+
+// check returns why msg fails the rule, nil when it passes
+func (r *validationRule) check(ctx context.Context, msg *pb.Message) error {
+	if r.MaxBytes > 0 && len(msg.Data) > r.MaxBytes {
+		return fmt.Errorf("payload of %d bytes exceeds %d", len(msg.Data), r.MaxBytes)
+	}
+	if len(r.Types) > 0 && !slices.ContainsFunc(r.Types, func(t string) bool { return strings.EqualFold(t, msg.Type.String()) }) {
+		return fmt.Errorf("type %s is not accepted", msg.Type)
+	}
+	if r.CheckContent {
+		if err := checkContent(msg.Type, msg.Data); err != nil {
+			return err
+		}
+	}
+	if r.schema != nil {
+		if err := r.schema.validateJSON(msg.Data); err != nil {
+			return err
+		}
+	}
+	if r.Validator != nil {
+		return r.Validator.Validate(ctx, msg)
+	}
+	return nil
+}
+
+// checkContent reports whether data looks like a payload of type t
+func checkContent(t pb.Type, data []byte) error {
+	switch t {
+	case pb.Type_JSON:
+		if !json.Valid(data) {
+			return errors.New("payload is not valid JSON")
+		}
+	case pb.Type_XML:
+		decoder := xml.NewDecoder(bytes.NewReader(data))
+		for {
+			if _, err := decoder.Token(); err == io.EOF {
+				break
+			} else if err != nil {
+				return fmt.Errorf("payload is not valid XML: %v", err)
+			}
+		}
+	case pb.Type_TEXT, pb.Type_HTML:
+		if !utf8.Valid(data) {
+			return fmt.Errorf("%s payload is not valid UTF-8", t)
+		}
+	case pb.Type_PNG:
+		if !bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")) {
+			return errors.New("payload is not a PNG image")
+		}
+	case pb.Type_JPG:
+		if !bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}) {
+			return errors.New("payload is not a JPEG image")
+		}
+	case pb.Type_MP4:
+		if len(data) < 8 || string(data[4:8]) != "ftyp" {
+			return errors.New("payload is not an MP4 file")
+		}
+	case pb.Type_MP3:
+		if !bytes.HasPrefix(data, []byte("ID3")) && !(len(data) > 1 && data[0] == 0xFF && data[1]&0xE0 == 0xE0) {
+			return errors.New("payload is not an MP3 file")
+		}
+	}
+	return nil
+}
+
+// checkValidation refuses msgs when one of them fails a reject rule of its recipient,
+// and annotates those failing annotate rules. Calls forwarded by another shard and
+// federated messages were checked by the broker that took them.
+func (s *Server) checkValidation(ctx context.Context, msgs []*pb.Message) (*pb.Status, error) {
+	if s.validators == nil {
+		return nil, nil
+	}
+	for _, msg := range msgs {
+		if s.checkedUpstream(ctx, msg) {
+			continue
+		}
+		service, _ := protocol.SplitAddress(msg.To)
+		var annotations []string
+		for i := range s.validators.rules {
+			rule := &s.validators.rules[i]
+			if !rule.applies(service) {
+				continue
+			}
+			err := rule.check(ctx, msg)
+			if err == nil {
+				continue
+			}
+			detail := fmt.Sprintf("%s: %v", rule.Name, err)
+			s.emit(pb.BrokerEventType_BROKER_EVENT_TYPE_VALIDATION_FAILED, service, "", msg, detail)
+			if rule.Action == ValidationAnnotate {
+				s.metrics.Inc("broker_validation_failures_total", "rule", rule.Name, "action", ValidationAnnotate)
+				annotations = append(annotations, detail)
+				continue
+			}
+			s.metrics.Inc("broker_validation_failures_total", "rule", rule.Name, "action", ValidationReject)
+			log.Printf("Rejected message from %s to %s by validation rule %s: %v (trace %s)", msg.From, msg.To, rule.Name, err, msg.TraceId)
+			return failure(codes.InvalidArgument, &pb.Status{Message: "Invalid message: " + detail, Success: false, Error: pb.Error_VALIDATION_FAILED})
+		}
+		if len(annotations) > 0 {
+			if msg.Headers == nil {
+				msg.Headers = make(map[string]string)
+			}
+			msg.Headers[ValidationHeader] = strings.Join(annotations, "; ")
+		}
+	}
+	return nil, nil
+}
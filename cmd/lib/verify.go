@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/checksum"
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+
+	"go.mills.io/bitcask/v2"
+)
+
+// VerifyReport summarises a walk over every record in the database
+type VerifyReport struct {
+	Total       int
+	Services    map[string]int // Recipient -> pending messages
+	Expired     int
+	Corrupted   int
+	Internal    int
+	Quarantined int // records moved to quarantine during this run
+	Merged      bool
+}
+
+// VerifyPath opens the database at dbPath, verifies it and closes it again
+func VerifyPath(dbPath string, maxAge time.Duration, repair, autoRecovery bool, maxValueSize int) (*VerifyReport, error) {
+	db, err := OpenDB(dbPath, autoRecovery, maxValueSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	defer db.Close()
+	s := &Server{db: db, maxAge: maxAge, metrics: NewMetrics()}
+	return s.Verify(repair)
+}
+
+// Verify walks every record and validates it. With repair enabled corrupted
+// records are quarantined and the datafiles are merged to rebuild the index.
+func (s *Server) Verify(repair bool) (*VerifyReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report := &VerifyReport{Services: make(map[string]int)}
+	err := s.db.Scan(nil, bitcask.KeyFunc(func(key bitcask.Key) error {
+		report.Total++
+		if isInternalKey(key) {
+			report.Internal++
+			return nil
+		}
+		value, err := s.db.Get(key)
+		if err == nil {
+			var msg pb.Message
+			if err = decodeStored(value, &msg); err == nil && !protocol.IsClaimCheck(msg.Headers) {
+				err = checksum.Verify(&msg)
+			}
+			if err == nil {
+				report.Services[msg.To]++
+				if s.isExpiredAt(msg.Seq.AsTime()) {
+					report.Expired++
+				}
+				return nil
+			}
+		} else {
+			value = nil
+		}
+		report.Corrupted++
+		log.Printf("Corrupted record %s: %v", key, err)
+		if !repair {
+			return nil
+		}
+		if err := s.quarantine(key, value, err); err != nil {
+			return err
+		}
+		report.Quarantined++
+		return nil
+	}))
+	if err != nil {
+		return report, err
+	}
+	if repair {
+		if err := s.db.Merge(); err != nil {
+			return report, fmt.Errorf("failed to merge datafiles: %w", err)
+		}
+		report.Merged = true
+	}
+	return report, nil
+}
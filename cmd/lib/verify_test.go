@@ -0,0 +1,55 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"go.mills.io/bitcask/v2"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestVerifyFindsAndQuarantinesCorruptRecords(t *testing.T) {
+	dir := t.TempDir()
+	s := newDeliveryServer(t, dir)
+	queueN(t, s, 2)
+	var corrupted bitcask.Key
+	if err := s.db.Scan(messagePrefix("billing"), bitcask.KeyFunc(func(key bitcask.Key) error {
+		if corrupted == nil {
+			corrupted = append(bitcask.Key(nil), key...)
+		}
+		return nil
+	})); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.Put(corrupted, append(appendHeader(nil, timestamppb.Now()), 0xff, 0xff)); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	report, err := VerifyPath(dir, time.Hour, false, false, 0)
+	if err != nil {
+		t.Fatalf("VerifyPath failed: %v", err)
+	}
+	if report.Corrupted != 1 || report.Quarantined != 0 || report.Services["billing"] != 1 || report.Merged {
+		t.Fatalf("unexpected report without repair: %+v", report)
+	}
+
+	report, err = VerifyPath(dir, time.Hour, true, false, 0)
+	if err != nil {
+		t.Fatalf("VerifyPath with repair failed: %v", err)
+	}
+	if report.Corrupted != 1 || report.Quarantined != 1 || report.Services["billing"] != 1 || !report.Merged {
+		t.Fatalf("unexpected report with repair: %+v", report)
+	}
+
+	// The quarantined record is kept aside and no longer reported
+	report, err = VerifyPath(dir, time.Hour, false, false, 0)
+	if err != nil {
+		t.Fatalf("VerifyPath failed: %v", err)
+	}
+	if report.Corrupted != 0 || report.Services["billing"] != 1 {
+		t.Fatalf("unexpected report after repair: %+v", report)
+	}
+}
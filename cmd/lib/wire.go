@@ -0,0 +1,200 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/mem"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// received is the wire form of a message taken by Send or SendBatch with the fields
+// it arrived with, so the message can be stored as received when nothing changed it
+type received struct {
+	raw  []byte
+	want pb.Message
+}
+
+// wireMessages keeps the received form of the messages of the calls in flight
+type wireMessages struct {
+	m sync.Map // *pb.Message -> *received
+}
+
+// wireCodec is the proto codec of the broker. It keeps the bytes of the messages of
+// Send and SendBatch until the call ends, which spares storing them from encoding
+// them again.
+type wireCodec struct {
+	encoding.CodecV2
+	wire *wireMessages
+}
+
+// wireCodecOption serves calls with the codec keeping received bytes
+func (s *Server) wireCodecOption() grpc.ServerOption {
+	return grpc.ForceServerCodecV2(wireCodec{CodecV2: encoding.GetCodecV2("proto"), wire: s.wire})
+}
+
+func (c wireCodec) Unmarshal(data mem.BufferSlice, v any) error {
+	switch v := v.(type) {
+	case *pb.Message:
+		raw := data.Materialize()
+		if err := proto.Unmarshal(raw, v); err != nil {
+			return err
+		}
+		c.wire.keep(v, raw)
+		return nil
+	case *pb.Batch:
+		raw := data.Materialize()
+		if err := proto.Unmarshal(raw, v); err != nil {
+			return err
+		}
+		c.wire.keepBatch(v, raw)
+		return nil
+	}
+	return c.CodecV2.Unmarshal(data, v)
+}
+
+// keep records the received form of msg when storing raw keeps its meaning: the
+// fields the stored form drops are unset and there are no unknown fields
+func (w *wireMessages) keep(msg *pb.Message, raw []byte) {
+	if msg.Seq != nil || msg.Id != "" || msg.Attempts != 0 || msg.Chunk != 0 || msg.Done || len(msg.ProtoReflect().GetUnknown()) > 0 {
+		return
+	}
+	r := &received{raw: raw}
+	r.want = pb.Message{
+		Data:         msg.Data,
+		Type:         msg.Type,
+		From:         msg.From,
+		To:           msg.To,
+		Checksum:     msg.Checksum,
+		ChecksumType: msg.ChecksumType,
+		Headers:      maps.Clone(msg.Headers),
+		TraceId:      msg.TraceId,
+		Via:          slices.Clone(msg.Via),
+		PartitionKey: msg.PartitionKey,
+		RoutingSlip:  slices.Clone(msg.RoutingSlip),
+		Mirrored:     msg.Mirrored,
+	}
+	w.m.Store(msg, r)
+}
+
+// keepBatch records the received form of each message of a batch
+func (w *wireMessages) keepBatch(batch *pb.Batch, raw []byte) {
+	i := 0
+	for len(raw) > 0 {
+		num, typ, n := protowire.ConsumeTag(raw)
+		if n < 0 {
+			return
+		}
+		raw = raw[n:]
+		if num == 1 && typ == protowire.BytesType {
+			value, n := protowire.ConsumeBytes(raw)
+			if n < 0 || i >= len(batch.Messages) {
+				return
+			}
+			w.keep(batch.Messages[i], value)
+			i++
+			raw = raw[n:]
+			continue
+		}
+		if n = protowire.ConsumeFieldValue(num, typ, raw); n < 0 {
+			return
+		}
+		raw = raw[n:]
+	}
+}
+
+// forget drops what was kept of the messages of req
+func (w *wireMessages) forget(req any) {
+	switch req := req.(type) {
+	case *pb.Message:
+		w.m.Delete(req)
+	case *pb.Batch:
+		for _, msg := range req.Messages {
+			w.m.Delete(msg)
+		}
+	}
+}
+
+// encode appends the envelope of stored, the stored form of msg, to buf. A message
+// nothing changed since it was received is written as received followed by the
+// fields the broker sets, which protobuf merges over the received ones.
+func (w *wireMessages) encode(buf []byte, msg, stored *pb.Message) ([]byte, error) {
+	v, ok := w.m.Load(msg)
+	if !ok {
+		return encodeEnvelope(buf, stored)
+	}
+	r := v.(*received)
+	if !r.unchanged(stored) {
+		return encodeEnvelope(buf, stored)
+	}
+	buf = appendHeader(buf, stored.Seq)
+	buf = append(buf, r.raw...)
+	delta := &pb.Message{Event: stored.Event, Seq: stored.Seq}
+	if stored.TraceId != r.want.TraceId {
+		delta.TraceId = stored.TraceId
+	}
+	return proto.MarshalOptions{}.MarshalAppend(buf, delta)
+}
+
+// unchanged reports whether stored holds what was received, but for a trace id the
+// broker stamped
+func (r *received) unchanged(stored *pb.Message) bool {
+	want := &r.want
+	return sameBytes(stored.Data, want.Data) &&
+		stored.Type == want.Type &&
+		stored.From == want.From &&
+		stored.To == want.To &&
+		bytes.Equal(stored.Checksum, want.Checksum) &&
+		stored.ChecksumType == want.ChecksumType &&
+		maps.Equal(stored.Headers, want.Headers) &&
+		(stored.TraceId == want.TraceId || (want.TraceId == "" && stored.TraceId != "")) &&
+		slices.Equal(stored.Via, want.Via) &&
+		stored.PartitionKey == want.PartitionKey &&
+		slices.Equal(stored.RoutingSlip, want.RoutingSlip) &&
+		stored.Mirrored == want.Mirrored &&
+		stored.Event != 0 && stored.Seq != nil
+}
+
+// sameBytes reports whether a and b are the same slice, not merely equal ones
+func sameBytes(a, b []byte) bool {
+	if len(a) != len(b) || (a == nil) != (b == nil) {
+		return false
+	}
+	return len(a) == 0 || &a[0] == &b[0]
+}
+
+// wireUnaryInterceptor drops the received bytes of Send and SendBatch calls once
+// they end
+func (s *Server) wireUnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		defer s.wire.forget(req)
+		return handler(ctx, req)
+	}
+}
+
+// wireStream drops the received bytes of streamed messages, which are not kept
+type wireStream struct {
+	grpc.ServerStream
+	wire *wireMessages
+}
+
+func (ws wireStream) RecvMsg(m any) error {
+	err := ws.ServerStream.RecvMsg(m)
+	ws.wire.forget(m)
+	return err
+}
+
+// wireStreamInterceptor drops the received bytes of the messages of streams
+func (s *Server) wireStreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, wireStream{ServerStream: ss, wire: s.wire})
+	}
+}
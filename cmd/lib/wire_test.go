@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/mem"
+	"google.golang.org/protobuf/proto"
+)
+
+// receiveWire decodes wire bytes into v with the codec of the broker
+func receiveWire(t *testing.T, w *wireMessages, wire []byte, v proto.Message) {
+	t.Helper()
+	codec := wireCodec{CodecV2: encoding.GetCodecV2("proto"), wire: w}
+	if err := codec.Unmarshal(mem.BufferSlice{mem.SliceBuffer(wire)}, v); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+}
+
+// storeWire encodes the stored form of msg like storeMessage and checks it decodes to it
+func storeWire(t *testing.T, w *wireMessages, msg *pb.Message) []byte {
+	t.Helper()
+	stored := queuedMessage(msg)
+	value, err := w.encode(nil, msg, stored)
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+	var got pb.Message
+	if err := decodeStored(value, &got); err != nil {
+		t.Fatalf("decodeStored failed: %v", err)
+	}
+	if !proto.Equal(stored, &got) {
+		t.Fatalf("stored value decodes to %v, want %v", &got, stored)
+	}
+	return value[envelopeHeaderSize:]
+}
+
+func TestWireStoresReceivedBytes(t *testing.T) {
+	sent := &pb.Message{
+		Data:    []byte(`{"order":42}`),
+		Type:    pb.Type_JSON,
+		From:    "orders",
+		To:      "billing",
+		Queue:   true,
+		Headers: map[string]string{"tenant": "acme"},
+	}
+	wire, err := proto.Marshal(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &wireMessages{}
+	var msg pb.Message
+	receiveWire(t, w, wire, &msg)
+	// The broker stamps the trace id of messages sent without one
+	msg.TraceId = "trace-1"
+	if stored := storeWire(t, w, &msg); !bytes.HasPrefix(stored, wire) {
+		t.Fatalf("stored bytes % x do not start with the received bytes % x", stored, wire)
+	}
+
+	w.forget(&msg)
+	if _, ok := w.m.Load(&msg); ok {
+		t.Fatalf("received bytes kept after the call ended")
+	}
+}
+
+func TestWireStoresReceivedBatchBytes(t *testing.T) {
+	sent := &pb.Batch{Messages: []*pb.Message{
+		{Data: []byte("one"), From: "orders", To: "billing", TraceId: "a"},
+		{Data: []byte("two"), From: "orders", To: "shipping", TraceId: "b"},
+	}}
+	wire, err := proto.Marshal(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &wireMessages{}
+	var batch pb.Batch
+	receiveWire(t, w, wire, &batch)
+	for i, msg := range batch.Messages {
+		want, err := proto.Marshal(sent.Messages[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored := storeWire(t, w, msg); !bytes.HasPrefix(stored, want) {
+			t.Fatalf("message %d: stored bytes % x do not start with the received bytes % x", i, stored, want)
+		}
+	}
+}
+
+func TestWireReencodesChangedMessages(t *testing.T) {
+	wire, err := proto.Marshal(&pb.Message{Data: []byte("x"), From: "orders", To: "billing", Headers: map[string]string{"tenant": "acme"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &wireMessages{}
+	var msg pb.Message
+	receiveWire(t, w, wire, &msg)
+	// An enrichment added a header
+	msg.Headers["region"] = "eu"
+	if stored := storeWire(t, w, &msg); bytes.HasPrefix(stored, wire) {
+		t.Fatalf("changed message stored as received")
+	}
+}
@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	pbv2 "github.com/ispapp/Microservices-Broker/base/v2/pb"
+	"github.com/ispapp/Microservices-Broker/cmd/lib"
+	"github.com/ispapp/Microservices-Broker/transport"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// stoppable is a running listener that can be shut down
+type stoppable interface {
+	Stop()
+}
+
+// httpListener adapts http.Server to stoppable
+type httpListener struct {
+	server *http.Server
+}
+
+func (h *httpListener) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	h.server.Shutdown(ctx)
+}
+
+// grpcListener adapts grpc.Server to stoppable with a graceful stop
+type grpcListener struct {
+	server *grpc.Server
+}
+
+// Stop waits for in-flight RPCs, forcing the stop after a grace period because
+// Receive streams only end when their clients disconnect
+func (g *grpcListener) Stop() {
+	done := make(chan struct{})
+	go func() {
+		g.server.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		g.server.Stop()
+	}
+}
+
+// takeActivated removes and returns the activated socket for a listener. Sockets
+// with names (LISTEN_FDNAMES) are matched by FileDescriptorName only, so a socket
+// meant for another listener is never bound to this one; unnamed sockets are taken
+// in order.
+func takeActivated(activated []lib.ActivatedListener, name string) (net.Listener, []lib.ActivatedListener) {
+	if len(activated) == 0 {
+		return nil, activated
+	}
+	index := -1
+	for i, a := range activated {
+		if a.Name == name {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		if slices.ContainsFunc(activated, func(a lib.ActivatedListener) bool { return a.Name != "" }) {
+			return nil, activated
+		}
+		index = 0
+	}
+	lis := activated[index].Listener
+	return lis, append(activated[:index], activated[index+1:]...)
+}
+
+// loadTLSConfig loads the certificate pair for a listener
+func loadTLSConfig(listener lib.ListenerConfig) (*tls.Config, error) {
+	cert, err := lib.LoadKeyPair(context.Background(), listener.TLSCertFile, listener.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS credentials: %w", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// startListener binds a listener and serves it in the background. Serve errors are reported on errCh.
+// An inherited listener (from socket activation) is used instead of binding the address.
+func startListener(listener lib.ListenerConfig, inherited net.Listener, server *lib.Server, authManager *lib.AuthManager, grpcOpts []grpc.ServerOption, errCh chan<- error) (stoppable, error) {
+	var tlsConfig *tls.Config
+	if listener.TLSEnabled {
+		var err error
+		if tlsConfig, err = loadTLSConfig(listener); err != nil {
+			return nil, err
+		}
+	}
+
+	var lis net.Listener
+	var err error
+	if inherited != nil && listener.Kind != lib.ListenerGRPCQUIC {
+		lis = inherited
+	} else if listener.Kind == lib.ListenerGRPCQUIC {
+		// QUIC terminates TLS itself, so gRPC runs without transport credentials
+		lis, err = transport.ListenQUIC(listener.Address(), tlsConfig)
+		tlsConfig = nil
+	} else {
+		lis, err = net.Listen("tcp", listener.Address())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	switch listener.Kind {
+	case lib.ListenerGRPC, lib.ListenerGRPCTLS, lib.ListenerGRPCQUIC, "":
+		opts := append([]grpc.ServerOption{}, grpcOpts...)
+		if tlsConfig != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		s := grpc.NewServer(opts...)
+		pb.RegisterBrokerServer(s, server)
+		pbv2.RegisterBrokerServer(s, lib.NewV2Server(server))
+		log.Printf("Microservices Broker %s listener at %v (TLS: %t)", listener.Name, lis.Addr(), listener.TLSEnabled)
+		go func() {
+			if err := s.Serve(lis); err != nil {
+				errCh <- fmt.Errorf("%s: %w", listener.Name, err)
+			}
+		}()
+		return &grpcListener{server: s}, nil
+	case lib.ListenerHTTPGateway, lib.ListenerMetrics, lib.ListenerAdmin:
+		var handler http.Handler
+		switch listener.Kind {
+		case lib.ListenerHTTPGateway:
+			handler = server.GatewayHandler(authManager)
+		case lib.ListenerMetrics:
+			handler = server.MetricsHandler()
+		default:
+			handler = server.AdminHandler(authManager)
+		}
+		if listener.Pprof {
+			mux := http.NewServeMux()
+			mux.Handle("/", handler)
+			mux.Handle("/debug/pprof/", server.ProfileHandler(authManager))
+			handler = mux
+		}
+		if tlsConfig != nil {
+			lis = tls.NewListener(lis, tlsConfig)
+		}
+		hs := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+		log.Printf("Microservices Broker %s listener at %v (TLS: %t)", listener.Name, lis.Addr(), tlsConfig != nil)
+		go func() {
+			if err := hs.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errCh <- fmt.Errorf("%s: %w", listener.Name, err)
+			}
+		}()
+		return &httpListener{server: hs}, nil
+	default:
+		lis.Close()
+		return nil, fmt.Errorf("unknown listener kind: %s", listener.Kind)
+	}
+}
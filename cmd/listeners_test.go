@@ -0,0 +1,201 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/cmd/lib"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// serveListener starts a listener of kind on a loopback port for the duration of the test
+func serveListener(t *testing.T, kind string, server *lib.Server, authManager *lib.AuthManager) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	l, err := startListener(lib.ListenerConfig{Name: kind, Kind: kind}, lis, server, authManager, nil, make(chan error, 1))
+	if err != nil {
+		t.Fatalf("startListener failed: %v", err)
+	}
+	t.Cleanup(l.Stop)
+	return lis.Addr().String()
+}
+
+// newListenerServer returns a broker and an API key authentication manager for which
+// ops is the admin service
+func newListenerServer(t *testing.T) (*lib.Server, *lib.AuthManager) {
+	t.Helper()
+	server, err := lib.NewServer(filepath.Join(t.TempDir(), "broker.db"), 1, 100, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	t.Cleanup(func() { server.Close() })
+	authManager := lib.NewAuthManager(&lib.AuthConfig{
+		EnableAuth: true,
+		AuthMethod: lib.AuthMethodAPIKey,
+		APIKeys:    map[string]string{},
+		Policy:     lib.AuthPolicy{AdminServices: []string{"ops"}},
+	})
+	return server, authManager
+}
+
+// post sends an HTTP POST with an optional API key and returns the status code
+func post(t *testing.T, url, apiKey, body string) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiKey != "" {
+		req.Header.Set("x-api-key", apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST %s failed: %v", url, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestAdminListenerAuthentication(t *testing.T) {
+	server, authManager := newListenerServer(t)
+	base := "http://" + serveListener(t, lib.ListenerAdmin, server, authManager)
+
+	// Probes need no credentials
+	resp, err := http.Get(base + "/healthz")
+	if err != nil {
+		t.Fatalf("GET /healthz failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected /healthz to answer without credentials, got %d", resp.StatusCode)
+	}
+
+	if code := post(t, base+"/pause?service=billing", "", ""); code != http.StatusUnauthorized {
+		t.Fatalf("expected a pause without credentials to be refused with 401, got %d", code)
+	}
+	if code := post(t, base+"/pause?service=billing", authManager.GenerateAPIKey("billing"), ""); code != http.StatusForbidden {
+		t.Fatalf("expected a pause by a non-admin to be refused with 403, got %d", code)
+	}
+	if code := post(t, base+"/read-only?enabled=true", authManager.GenerateAPIKey("billing"), ""); code != http.StatusForbidden {
+		t.Fatalf("expected read-only by a non-admin to be refused with 403, got %d", code)
+	}
+	if server.IsPaused("billing") || server.ReadOnly() {
+		t.Fatal("refused admin requests changed the broker")
+	}
+	if code := post(t, base+"/pause?service=billing", authManager.GenerateAPIKey("ops"), ""); code != http.StatusOK {
+		t.Fatalf("expected an admin to pause delivery, got %d", code)
+	}
+	if !server.IsPaused("billing") {
+		t.Fatal("expected delivery to billing to be paused")
+	}
+}
+
+func TestGatewayListenerAuthentication(t *testing.T) {
+	server, authManager := newListenerServer(t)
+	base := "http://" + serveListener(t, lib.ListenerHTTPGateway, server, authManager)
+	send := `{"from":"orders","to":"billing","data":"aGk=","queue":true}`
+
+	if code := post(t, base+"/v1/send", "", send); code != http.StatusUnauthorized {
+		t.Fatalf("expected a send without credentials to be refused with 401, got %d", code)
+	}
+	if code := post(t, base+"/v1/send", authManager.GenerateAPIKey("orders"), send); code != http.StatusOK {
+		t.Fatalf("expected an authenticated send to succeed, got %d", code)
+	}
+	if n, err := server.QueueLength("billing"); err != nil || n != 1 {
+		t.Fatalf("expected 1 queued message, got %d (%v)", n, err)
+	}
+}
+
+func TestGRPCListenerAuthentication(t *testing.T) {
+	server, authManager := newListenerServer(t)
+	opts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(authManager.UnaryInterceptor())}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	l, err := startListener(lib.ListenerConfig{Name: lib.ListenerGRPC, Kind: lib.ListenerGRPC}, lis, server, authManager, opts, make(chan error, 1))
+	if err != nil {
+		t.Fatalf("startListener failed: %v", err)
+	}
+	defer l.Stop()
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	c := pb.NewBrokerClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msg := &pb.Message{From: "orders", To: "billing", Data: []byte("hi"), Queue: true}
+	if _, err := c.Send(ctx, msg); err == nil {
+		t.Fatal("expected a Send without credentials to be refused")
+	}
+	authed := metadata.AppendToOutgoingContext(ctx, "x-api-key", authManager.GenerateAPIKey("orders"))
+	if st, err := c.Send(authed, msg); err != nil || !st.Success {
+		t.Fatalf("expected an authenticated Send to succeed, got %v (%v)", st, err)
+	}
+}
+
+// activatedSockets returns loopback listeners named as systemd would pass them
+func activatedSockets(t *testing.T, names ...string) []lib.ActivatedListener {
+	t.Helper()
+	var activated []lib.ActivatedListener
+	for _, name := range names {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		t.Cleanup(func() { lis.Close() })
+		activated = append(activated, lib.ActivatedListener{Name: name, Listener: lis})
+	}
+	return activated
+}
+
+func TestTakeActivatedByName(t *testing.T) {
+	activated := activatedSockets(t, lib.ListenerAdmin, lib.ListenerGRPC)
+	admin, grpcSocket := activated[0].Listener, activated[1].Listener
+
+	lis, rest := takeActivated(activated, lib.ListenerGRPC)
+	if lis != grpcSocket || len(rest) != 1 {
+		t.Fatalf("expected the socket named grpc, got %v and %d left", lis, len(rest))
+	}
+	// A named socket of another listener is never bound in its place
+	if lis, rest = takeActivated(rest, "gateway"); lis != nil || len(rest) != 1 {
+		t.Fatalf("expected no socket for gateway, got %v and %d left", lis, len(rest))
+	}
+	if lis, rest = takeActivated(rest, lib.ListenerAdmin); lis != admin || len(rest) != 0 {
+		t.Fatalf("expected the socket named admin, got %v and %d left", lis, len(rest))
+	}
+	if lis, _ = takeActivated(rest, lib.ListenerGRPC); lis != nil {
+		t.Fatalf("expected no socket once all are taken, got %v", lis)
+	}
+}
+
+func TestTakeActivatedInOrder(t *testing.T) {
+	activated := activatedSockets(t, "", "")
+	first, second := activated[0].Listener, activated[1].Listener
+
+	lis, rest := takeActivated(activated, lib.ListenerGRPC)
+	if lis != first {
+		t.Fatalf("expected the first unnamed socket, got %v", lis)
+	}
+	if lis, rest = takeActivated(rest, lib.ListenerAdmin); lis != second || len(rest) != 0 {
+		t.Fatalf("expected the second unnamed socket, got %v and %d left", lis, len(rest))
+	}
+	if lis, _ = takeActivated(nil, lib.ListenerGRPC); lis != nil {
+		t.Fatalf("expected no socket without activation, got %v", lis)
+	}
+}
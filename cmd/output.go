@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats of the global --output flag
+const (
+	OutputTable = "table"
+	OutputJSON  = "json"
+	OutputYAML  = "yaml"
+)
+
+// OutputFlag selects how commands that report data print it
+var OutputFlag = &cli.StringFlag{
+	Name:  "output",
+	Usage: "Output format of reports: table, json or yaml",
+	Value: OutputTable,
+	Action: func(c *cli.Context, format string) error {
+		switch format {
+		case OutputTable, OutputJSON, OutputYAML:
+			return nil
+		default:
+			return fmt.Errorf("invalid output format %q (use 'table', 'json' or 'yaml')", format)
+		}
+	},
+}
+
+// printOutput writes v as JSON or YAML when --output asks for it, and calls table
+// to print it for people otherwise
+func printOutput(c *cli.Context, v any, table func(w io.Writer)) error {
+	w := c.App.Writer
+	switch c.String("output") {
+	case OutputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case OutputYAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		return enc.Close()
+	default:
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		table(tw)
+		return tw.Flush()
+	}
+}
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+	"github.com/urfave/cli/v2"
+)
+
+// profileTypes are the profiles the capture command can fetch
+var profileTypes = []string{"cpu", "heap", "goroutine", "allocs", "block", "mutex"}
+
+var ProfileCommand = &cli.Command{
+	Name:  "profile",
+	Usage: "Runtime profiling of a running broker",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "capture",
+			Usage: "Download a CPU or memory profile from a listener with pprof enabled",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:    "url",
+					Aliases: []string{"u"},
+					Usage:   "Base URL of the admin or metrics listener",
+					Value:   "http://localhost:9100",
+				},
+				&cli.StringFlag{
+					Name:    "type",
+					Aliases: []string{"t"},
+					Usage:   "Profile to capture (" + strings.Join(profileTypes, ", ") + ")",
+					Value:   "cpu",
+				},
+				&cli.IntFlag{
+					Name:  "seconds",
+					Usage: "Duration of CPU profiles",
+					Value: 30,
+				},
+				&cli.StringFlag{
+					Name:    "output",
+					Aliases: []string{"o"},
+					Usage:   "Output file (defaults to <type>-<timestamp>.pprof)",
+				},
+				&cli.StringFlag{
+					Name:  "auth-method",
+					Usage: "Authentication method (jwt, apikey or hmac)",
+					Value: "apikey",
+				},
+				&cli.StringFlag{
+					Name:  "credential",
+					Usage: "Admin API key or JWT token",
+				},
+				&cli.StringFlag{
+					Name:  "cert",
+					Usage: "TLS CA certificate file of https listeners",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				kind := c.String("type")
+				if !slices.Contains(profileTypes, kind) {
+					return fmt.Errorf("unknown profile type %q, expected one of %s", kind, strings.Join(profileTypes, ", "))
+				}
+				path := "/debug/pprof/" + kind
+				query := ""
+				timeout := time.Minute
+				if kind == "cpu" {
+					if c.Int("seconds") <= 0 {
+						return errors.New("--seconds must be positive")
+					}
+					path = "/debug/pprof/profile"
+					query = "?seconds=" + strconv.Itoa(c.Int("seconds"))
+					timeout += time.Duration(c.Int("seconds")) * time.Second
+				}
+				req, err := http.NewRequestWithContext(c.Context, http.MethodGet, strings.TrimRight(c.String("url"), "/")+path+query, nil)
+				if err != nil {
+					return err
+				}
+				if err := setProfileCredentials(req, c.String("auth-method"), c.String("credential"), path); err != nil {
+					return err
+				}
+				httpClient := &http.Client{Timeout: timeout}
+				if c.IsSet("cert") {
+					pem, err := os.ReadFile(c.String("cert"))
+					if err != nil {
+						return fmt.Errorf("failed to read CA certificate: %w", err)
+					}
+					pool := x509.NewCertPool()
+					if !pool.AppendCertsFromPEM(pem) {
+						return fmt.Errorf("no certificate found in %s", c.String("cert"))
+					}
+					httpClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+				}
+
+				if kind == "cpu" {
+					say(c, "Profiling CPU for %ds...", c.Int("seconds"))
+				}
+				resp, err := httpClient.Do(req)
+				if err != nil {
+					return err
+				}
+				defer resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+					return fmt.Errorf("broker answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+				}
+				output := c.String("output")
+				if output == "" {
+					output = kind + "-" + time.Now().Format("20060102-150405") + ".pprof"
+				}
+				f, err := os.Create(output)
+				if err != nil {
+					return err
+				}
+				if _, err := io.Copy(f, resp.Body); err != nil {
+					f.Close()
+					return fmt.Errorf("failed to download profile: %w", err)
+				}
+				if err := f.Close(); err != nil {
+					return err
+				}
+				result(c, "Profile", output)
+				return nil
+			},
+		},
+	},
+}
+
+// setProfileCredentials authenticates a profile request to path as the gateway and
+// pprof endpoints expect
+func setProfileCredentials(req *http.Request, authMethod, credential, path string) error {
+	if credential == "" {
+		return nil
+	}
+	switch authMethod {
+	case "apikey":
+		req.Header.Set("x-api-key", credential)
+	case "jwt":
+		req.Header.Set("authorization", "Bearer "+credential)
+	case "hmac":
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return fmt.Errorf("failed to create nonce: %w", err)
+		}
+		timestamp := time.Now().Unix()
+		n := hex.EncodeToString(nonce)
+		req.Header.Set(protocol.SignatureKeyIDHeader, protocol.SignatureKeyID(credential))
+		req.Header.Set(protocol.SignatureTimestampHeader, strconv.FormatInt(timestamp, 10))
+		req.Header.Set(protocol.SignatureNonceHeader, n)
+		req.Header.Set(protocol.SignatureHeader, protocol.Sign(credential, http.MethodGet+" "+path, timestamp, n, nil))
+	default:
+		return fmt.Errorf("unknown auth method %q", authMethod)
+	}
+	return nil
+}
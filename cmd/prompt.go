@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// QuietFlag leaves out confirmations of what a command did; the value a command
+// produces, like a generated key, is still printed on its own
+var QuietFlag = &cli.BoolFlag{
+	Name:    "quiet",
+	Aliases: []string{"q"},
+	Usage:   "Only print the values commands produce, not what they did",
+}
+
+// YesFlag answers yes to confirmation prompts, which scripts need since commands
+// that change or delete data refuse to run without a terminal to ask on otherwise
+var YesFlag = &cli.BoolFlag{
+	Name:    "yes",
+	Aliases: []string{"y"},
+	Usage:   "Assume yes for confirmation prompts",
+}
+
+// say prints what a command did, unless --quiet is set
+func say(c *cli.Context, format string, args ...any) {
+	if !c.Bool("quiet") {
+		fmt.Fprintf(c.App.Writer, format+"\n", args...)
+	}
+}
+
+// result prints a value a command produced: with --quiet only the value, otherwise
+// after label
+func result(c *cli.Context, label, value string) {
+	if c.Bool("quiet") {
+		fmt.Fprintln(c.App.Writer, value)
+		return
+	}
+	fmt.Fprintf(c.App.Writer, "%s: %s\n", label, value)
+}
+
+// confirm asks before a command changes or deletes data. --yes skips the question;
+// without it and without a terminal to ask on, confirm fails instead of guessing.
+func confirm(c *cli.Context, question string) error {
+	if c.Bool("yes") {
+		return nil
+	}
+	if f, ok := c.App.Reader.(*os.File); ok {
+		if info, err := f.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			return fmt.Errorf("%s: refusing to continue without a terminal, pass --yes to confirm", question)
+		}
+	}
+	fmt.Fprintf(c.App.ErrWriter, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(c.App.Reader).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	default:
+		return fmt.Errorf("%s: not confirmed", question)
+	}
+}
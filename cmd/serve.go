@@ -1,20 +1,28 @@
 package cmd
 
 import (
-	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/ispapp/Microservices-Broker/base/pb"
 	"github.com/ispapp/Microservices-Broker/cmd/lib"
 
 	"github.com/urfave/cli/v2"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
 )
 
+// profileFlag selects a profile of the configuration file
+func profileFlag() cli.Flag {
+	return &cli.StringFlag{
+		Name:    "profile",
+		Usage:   "Configuration profile to apply (e.g. dev, staging, prod)",
+		EnvVars: []string{lib.ProfileEnv},
+	}
+}
+
 var ServerCommand = &cli.Command{
 	Name:  "serve",
 	Usage: "Start the Microservices Broker server",
@@ -43,28 +51,70 @@ var ServerCommand = &cli.Command{
 			Usage:   "Configuration file path",
 			Value:   "config.json",
 		},
+		profileFlag(),
 		&cli.BoolFlag{
 			Name:  "disable-auth",
 			Usage: "Disable authentication (not recommended for production)",
 			Value: false,
 		},
+		&cli.BoolFlag{
+			Name:  "strict",
+			Usage: "Refuse to start on configuration warnings instead of falling back to defaults",
+		},
+		&cli.BoolFlag{
+			Name:  "read-only",
+			Usage: "Start in read-only mode: reject sends while receives keep draining (SIGUSR1/SIGUSR2 switch it on/off)",
+		},
+		&cli.BoolFlag{
+			Name:  "verify",
+			Usage: "Verify every stored record before serving and quarantine corrupted ones",
+		},
+		&cli.BoolFlag{
+			Name:  "auto-recovery",
+			Usage: "Let bitcask repair damaged datafiles when opening the database",
+		},
 	},
 	Action: func(c *cli.Context) error {
 		configPath := c.String("config")
 		disableAuth := c.Bool("disable-auth")
 
+		strict := c.Bool("strict")
+		if _, err := os.Stat(configPath); err != nil && strict {
+			return fmt.Errorf("strict mode: configuration file '%s' not found", configPath)
+		}
+
 		// Load configuration
-		config, err := lib.LoadConfig(configPath)
+		profile := c.String("profile")
+		config, err := lib.LoadConfigProfile(configPath, profile)
+		if err != nil && strict {
+			return fmt.Errorf("strict mode: failed to load config: %w", err)
+		}
+		if err != nil && profile != "" {
+			// Falling back to defaults would ignore the environment asked for
+			return fmt.Errorf("failed to load config profile %q: %w", profile, err)
+		}
+		loaded := err == nil
 		if err != nil {
 			log.Printf("Warning: Failed to load config file, using defaults: %v", err)
 			config = &lib.Config{
 				Server: lib.ServerConfig{
-					Host:        c.String("host"),
-					Port:        c.String("port"),
-					TLSEnabled:  false,
-					TickSeconds: 60,
-					MaxStored:   100,
-					MaxAge:      time.Hour * 24,
+					Host:                 c.String("host"),
+					Port:                 c.String("port"),
+					TLSEnabled:           false,
+					TickSeconds:          60,
+					MaxStored:            100,
+					MaxAge:               time.Hour * 24,
+					BatchSize:            lib.DefaultBatchSize,
+					Durability:           string(lib.DurabilitySync),
+					RequestTimeout:       lib.DefaultRequestTimeout,
+					PoisonThreshold:      lib.DefaultPoisonThreshold,
+					DiskHighWatermark:    lib.DefaultDiskHighWatermark,
+					DiskLowWatermark:     lib.DefaultDiskLowWatermark,
+					MaxInflightBytes:     lib.DefaultMaxInflightBytes,
+					KeepaliveInterval:    lib.DefaultKeepaliveInterval,
+					KeepaliveTimeout:     lib.DefaultKeepaliveTimeout,
+					DuplicateConnections: string(lib.DuplicateReplace),
+					DeliveryConcurrency:  lib.DefaultDeliveryConcurrency,
 				},
 				Auth: lib.AuthConfig{
 					EnableAuth:  !disableAuth,
@@ -91,58 +141,229 @@ var ServerCommand = &cli.Command{
 		if disableAuth {
 			config.Auth.EnableAuth = false
 		}
+		if c.IsSet("auto-recovery") {
+			config.DB.AutoRecovery = c.Bool("auto-recovery")
+		}
+
+		issues := config.Validate()
+		for _, issue := range issues {
+			log.Printf("Config %s", issue)
+		}
+		if lib.HasErrors(issues, strict) {
+			return fmt.Errorf("refusing to start with an invalid configuration (run 'config validate' for details)")
+		}
+
+		// Resolve secret references (vault://, aws-sm://, env://, file://) before use
+		authConfig, err := config.Auth.ResolveSecrets(c.Context)
+		if err != nil {
+			return fmt.Errorf("failed to resolve auth secrets: %w", err)
+		}
+
+		alerts, err := config.Alerts.ResolveSecrets(c.Context)
+		if err != nil {
+			return fmt.Errorf("failed to resolve alert secrets: %w", err)
+		}
+
+		reports, err := config.Reports.ResolveSecrets(c.Context)
+		if err != nil {
+			return fmt.Errorf("failed to resolve report secrets: %w", err)
+		}
+
+		federation, err := config.Federation.ResolveSecrets(c.Context)
+		if err != nil {
+			return fmt.Errorf("failed to resolve federation secrets: %w", err)
+		}
+
+		offload, err := config.Offload.ResolveSecrets(c.Context)
+		if err != nil {
+			return fmt.Errorf("failed to resolve offload secrets: %w", err)
+		}
 
 		// Initialize authentication manager
-		authManager := lib.NewAuthManager(&config.Auth)
+		authManager := lib.NewAuthManager(authConfig)
+		// Record when API keys are used, for `auth list-keys`
+		stopKeyUsage := authManager.TrackKeyUsage(lib.KeyUsagePath(configPath), lib.DefaultKeyUsageInterval)
+		defer stopKeyUsage()
+		// Refuse the tokens revoked with `auth revoke-jwt`, also while running
+		stopRevocations := authManager.WatchRevocations(lib.RevocationsPath(configPath), lib.DefaultRevocationInterval)
+		defer stopRevocations()
+		// Pick up the API keys added or removed with `auth` commands, also while running
+		if loaded {
+			stopKeys := authManager.WatchAPIKeys(configPath, lib.DefaultKeyReloadInterval, func() (*lib.AuthConfig, error) {
+				reloaded, err := lib.LoadConfigProfile(configPath, profile)
+				if err != nil {
+					return nil, err
+				}
+				return reloaded.Auth.ResolveSecrets(c.Context)
+			})
+			defer stopKeys()
+		}
 
-		// Create server
-		server, err := lib.NewServer(config.DB.Path, config.Server.TickSeconds, config.Server.MaxStored, config.Server.MaxAge)
+		durability, err := lib.ParseDurability(config.Server.Durability)
 		if err != nil {
-			log.Fatalf("failed to create server: %v", err)
+			return err
+		}
+		duplicatePolicy, err := lib.ParseDuplicatePolicy(config.Server.DuplicateConnections)
+		if err != nil {
+			return err
+		}
+		redactor, err := lib.NewRedactor(config.Redaction)
+		if err != nil {
+			return fmt.Errorf("invalid redaction rules: %w", err)
+		}
+		validators, err := lib.NewValidators(config.Validation)
+		if err != nil {
+			return fmt.Errorf("invalid validation rules: %w", err)
+		}
+		plugins, err := lib.LoadPlugins(c.Context, config.Plugins)
+		if err != nil {
+			return fmt.Errorf("invalid plugins: %w", err)
+		}
+		scripts, err := lib.LoadScripts(config.Scripts)
+		if err != nil {
+			return fmt.Errorf("invalid scripts: %w", err)
+		}
+		stopScripts := scripts.Watch(lib.DefaultScriptReloadInterval)
+		defer stopScripts()
+		offloader, err := lib.NewOffloader(*offload)
+		if err != nil {
+			return fmt.Errorf("invalid offload configuration: %w", err)
+		}
+		router, err := lib.NewRouter(config.Routing)
+		if err != nil {
+			return fmt.Errorf("invalid routing configuration: %w", err)
+		}
+		accessLog, err := lib.OpenAccessLog(config.Server.AccessLog)
+		if err != nil {
+			return err
+		}
+		sharding, err := config.Sharding.ServerOption(c.Context)
+		if err != nil {
+			return fmt.Errorf("invalid sharding configuration: %w", err)
 		}
 
-		// Setup listener
-		lis, err := net.Listen("tcp", fmt.Sprintf("%s:%s", config.Server.Host, config.Server.Port))
+		// Create server
+		server, err := lib.NewServer(config.DB.Path, config.Server.TickSeconds, config.Server.MaxStored, config.Server.MaxAge,
+			lib.WithBatchSize(config.Server.BatchSize),
+			lib.WithServices(config.Services),
+			lib.WithDurability(durability, config.Server.SyncInterval),
+			lib.WithAutoRecovery(config.DB.AutoRecovery),
+			lib.WithMaxValueSize(config.DB.MaxValueSize),
+			lib.WithTimeouts(config.Server.RequestTimeout, config.Server.StreamLifetime),
+			lib.WithExpiryNotifications(config.Server.NotifyExpired),
+			lib.WithAcks(config.Server.AckTimeout, config.Server.MaxAttempts),
+			lib.WithPoisonThreshold(config.Server.PoisonThreshold),
+			lib.WithDiskWatermarks(config.Server.DiskHighWatermark, config.Server.DiskLowWatermark, config.Server.MaxDBSize),
+			lib.WithMemoryBudget(config.Server.MaxInflightBytes),
+			lib.WithMaxFrameSize(config.Server.MaxSendMsgSize),
+			lib.WithKeepalive(config.Server.KeepaliveInterval, config.Server.KeepaliveTimeout),
+			lib.WithHeartbeat(config.Server.HeartbeatInterval),
+			lib.WithDuplicatePolicy(duplicatePolicy),
+			lib.WithQuota(config.Server.Quota),
+			lib.WithDeliveryConcurrency(config.Server.DeliveryConcurrency),
+			lib.WithRateLimit(config.Server.RateLimit),
+			lib.WithLogLevel(config.Server.LogLevel),
+			lib.WithSlowLogThreshold(config.Server.SlowLogThreshold),
+			lib.WithAccessLog(accessLog),
+			lib.WithBacklogCheckInterval(config.Server.BacklogCheckInterval),
+			lib.WithAlerts(alerts.Interval, alerts.Rules),
+			lib.WithReports(*reports),
+			lib.WithRedaction(redactor),
+			lib.WithValidation(validators),
+			lib.WithPlugins(plugins),
+			lib.WithScripts(scripts),
+			lib.WithOffload(offloader),
+			lib.WithRouting(router),
+			lib.WithEgress(config.Egress),
+			lib.WithRegistry(config.Registry, config.KnownServices()),
+			sharding,
+			federation.ServerOption(),
+			lib.WithReadOnly(c.Bool("read-only")),
+		)
 		if err != nil {
-			log.Fatalf("failed to listen: %v", err)
+			log.Fatalf("failed to create server: %v", err)
 		}
 
-		// Configure gRPC server options
-		var opts []grpc.ServerOption
+		if c.Bool("verify") {
+			report, err := server.Verify(true)
+			if err != nil {
+				log.Fatalf("database verification failed: %v", err)
+			}
+			log.Printf("Verified %d records (%d corrupted, %d quarantined, %d expired) across %d services",
+				report.Total, report.Corrupted, report.Quarantined, report.Expired, len(report.Services))
+		}
 
-		// Add authentication interceptors
+		// Chain the configured gRPC interceptors
+		var auth *lib.AuthManager
 		if config.Auth.EnableAuth {
-			opts = append(opts,
-				grpc.UnaryInterceptor(authManager.UnaryInterceptor()),
-				grpc.StreamInterceptor(authManager.StreamInterceptor()),
-			)
+			server.AuditAuth(authManager)
+			auth = authManager
 			log.Printf("Authentication enabled (method: %d)", config.Auth.AuthMethod)
 		} else {
 			log.Printf("WARNING: Authentication is disabled!")
 		}
+		opts, err := server.GRPCOptions(config.Server.Interceptors, auth)
+		if err != nil {
+			return fmt.Errorf("invalid interceptor pipeline: %w", err)
+		}
+		opts = append(opts, config.Server.MessageSizeOptions()...)
+
+		// Sockets handed over by systemd replace the matching listeners
+		activated, err := lib.ActivatedListeners()
+		if err != nil {
+			log.Fatalf("failed to use activated sockets: %v", err)
+		}
 
-		// Add TLS if enabled
-		if config.Server.TLSEnabled {
-			cert, err := tls.LoadX509KeyPair(config.Server.TLSCertFile, config.Server.TLSKeyFile)
+		// Bind every configured listener
+		var running []stoppable
+		errCh := make(chan error, len(config.Server.EffectiveListeners()))
+		for _, listener := range config.Server.EffectiveListeners() {
+			var inherited net.Listener
+			inherited, activated = takeActivated(activated, listener.Name)
+			l, err := startListener(listener, inherited, server, authManager, opts, errCh)
 			if err != nil {
-				log.Fatalf("failed to load TLS credentials: %v", err)
+				for _, r := range running {
+					r.Stop()
+				}
+				log.Fatalf("failed to start listener %s: %v", listener.Name, err)
 			}
-			creds := credentials.NewTLS(&tls.Config{
-				Certificates: []tls.Certificate{cert},
-			})
-			opts = append(opts, grpc.Creds(creds))
-			log.Printf("TLS enabled")
+			running = append(running, l)
+		}
+		for _, a := range activated {
+			log.Printf("WARNING: activated socket %q at %v matches no listener", a.Name, a.Listener.Addr())
+			a.Listener.Close()
 		}
 
-		// Create gRPC server
-		s := grpc.NewServer(opts...)
-		pb.RegisterBrokerServer(s, server)
-
-		log.Printf("Microservices Broker server listening at %v", lis.Addr())
 		log.Printf("Database path: %s", config.DB.Path)
 		log.Printf("Configuration: %s", configPath)
+		if config.Profile() != "" {
+			log.Printf("Configuration profile: %s", config.Profile())
+		}
+
+		stopSignals := handleReadOnlySignals(server)
+		defer stopSignals()
 
-		if err := s.Serve(lis); err != nil {
+		// Serve until a listener fails or we are asked to stop
+		serviceStop, ready, stopping := serviceHooks()
+		ready()
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		select {
+		case err = <-errCh:
+			log.Printf("listener failed: %v", err)
+		case sig := <-signals:
+			log.Printf("Received %s, shutting down", sig)
+		case <-serviceStop:
+			log.Printf("Service stop requested, shutting down")
+		}
+		defer stopping()
+		for _, r := range running {
+			r.Stop()
+		}
+		if closeErr := server.Close(); closeErr != nil {
+			log.Printf("failed to close database: %v", closeErr)
+		}
+		if err != nil {
 			log.Fatalf("failed to serve: %v", err)
 		}
 		return nil
@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli/v2"
+)
+
+// defaultServiceName is the name used for the systemd unit or Windows service
+const defaultServiceName = "ms-broker"
+
+// serviceSpec describes how the broker is registered with the OS service manager
+type serviceSpec struct {
+	Name        string
+	Description string
+	Executable  string
+	Args        []string
+	WorkingDir  string
+	User        string // systemd only
+	Socket      string // systemd only: address for socket activation
+	UnitDir     string // systemd only
+	Enable      bool
+}
+
+var serviceNameFlag = &cli.StringFlag{
+	Name:    "name",
+	Aliases: []string{"n"},
+	Usage:   "Service name",
+	Value:   defaultServiceName,
+}
+
+var ServiceCommand = &cli.Command{
+	Name:  "service",
+	Usage: "Register and control the broker as a systemd unit or Windows service",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "install",
+			Usage: "Install the broker as a system service",
+			Flags: []cli.Flag{
+				serviceNameFlag,
+				&cli.StringFlag{
+					Name:    "config",
+					Aliases: []string{"c"},
+					Usage:   "Configuration file path used by the service",
+					Value:   "config.json",
+				},
+				&cli.StringFlag{
+					Name:  "user",
+					Usage: "User the service runs as (systemd only)",
+				},
+				&cli.StringFlag{
+					Name:  "socket",
+					Usage: "Listen address for systemd socket activation, e.g. 0.0.0.0:9000 (systemd only)",
+				},
+				&cli.StringFlag{
+					Name:  "unit-dir",
+					Usage: "Directory for systemd unit files (systemd only)",
+					Value: "/etc/systemd/system",
+				},
+				&cli.BoolFlag{
+					Name:  "no-enable",
+					Usage: "Do not enable the service to start at boot",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				exe, err := os.Executable()
+				if err != nil {
+					return fmt.Errorf("failed to locate broker executable: %w", err)
+				}
+				configPath, err := filepath.Abs(c.String("config"))
+				if err != nil {
+					return fmt.Errorf("failed to resolve config path: %w", err)
+				}
+				spec := serviceSpec{
+					Name:        c.String("name"),
+					Description: "Microservices Broker",
+					Executable:  exe,
+					Args:        []string{"serve", "--config", configPath},
+					WorkingDir:  filepath.Dir(configPath),
+					User:        c.String("user"),
+					Socket:      c.String("socket"),
+					UnitDir:     c.String("unit-dir"),
+					Enable:      !c.Bool("no-enable"),
+				}
+				if err := installService(spec); err != nil {
+					return fmt.Errorf("failed to install service: %w", err)
+				}
+				say(c, "Installed service '%s'", spec.Name)
+				return nil
+			},
+		},
+		{
+			Name:  "uninstall",
+			Usage: "Remove the broker system service",
+			Flags: []cli.Flag{
+				serviceNameFlag,
+				&cli.StringFlag{
+					Name:  "unit-dir",
+					Usage: "Directory for systemd unit files (systemd only)",
+					Value: "/etc/systemd/system",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if err := confirm(c, fmt.Sprintf("Remove the system service '%s'?", c.String("name"))); err != nil {
+					return err
+				}
+				if err := uninstallService(c.String("name"), c.String("unit-dir")); err != nil {
+					return fmt.Errorf("failed to uninstall service: %w", err)
+				}
+				say(c, "Removed service '%s'", c.String("name"))
+				return nil
+			},
+		},
+		{
+			Name:  "start",
+			Usage: "Start the broker system service",
+			Flags: []cli.Flag{serviceNameFlag},
+			Action: func(c *cli.Context) error {
+				return controlService(c.String("name"), "start")
+			},
+		},
+		{
+			Name:  "stop",
+			Usage: "Stop the broker system service",
+			Flags: []cli.Flag{serviceNameFlag},
+			Action: func(c *cli.Context) error {
+				return controlService(c.String("name"), "stop")
+			},
+		},
+	},
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ispapp/Microservices-Broker/cmd/lib"
+)
+
+// installService writes a systemd unit (and optional socket unit) and enables it
+func installService(spec serviceSpec) error {
+	var unit strings.Builder
+	fmt.Fprintf(&unit, "[Unit]\nDescription=%s\nAfter=network-online.target\nWants=network-online.target\n", spec.Description)
+	if spec.Socket != "" {
+		fmt.Fprintf(&unit, "Requires=%s.socket\n", spec.Name)
+	}
+	fmt.Fprintf(&unit, "\n[Service]\nType=notify\nNotifyAccess=main\n")
+	fmt.Fprintf(&unit, "ExecStart=%s\n", systemdCommandLine(spec.Executable, spec.Args))
+	fmt.Fprintf(&unit, "WorkingDirectory=%s\n", spec.WorkingDir)
+	if spec.User != "" {
+		fmt.Fprintf(&unit, "User=%s\n", spec.User)
+	}
+	fmt.Fprintf(&unit, "Restart=on-failure\nRestartSec=2\n\n[Install]\nWantedBy=multi-user.target\n")
+
+	unitPath := filepath.Join(spec.UnitDir, spec.Name+".service")
+	if err := os.WriteFile(unitPath, []byte(unit.String()), 0644); err != nil {
+		return err
+	}
+	enableUnit := spec.Name + ".service"
+
+	if spec.Socket != "" {
+		socket := fmt.Sprintf("[Unit]\nDescription=%s socket\n\n[Socket]\nListenStream=%s\nFileDescriptorName=%s\nService=%s.service\n\n[Install]\nWantedBy=sockets.target\n",
+			spec.Description, spec.Socket, lib.ListenerGRPC, spec.Name)
+		if err := os.WriteFile(filepath.Join(spec.UnitDir, spec.Name+".socket"), []byte(socket), 0644); err != nil {
+			return err
+		}
+		enableUnit = spec.Name + ".socket"
+	}
+
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	if spec.Enable {
+		return systemctl("enable", enableUnit)
+	}
+	return nil
+}
+
+// uninstallService disables and removes the unit files
+func uninstallService(name, unitDir string) error {
+	systemctl("disable", "--now", name+".service")
+	socketPath := filepath.Join(unitDir, name+".socket")
+	if _, err := os.Stat(socketPath); err == nil {
+		systemctl("disable", "--now", name+".socket")
+		if err := os.Remove(socketPath); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(filepath.Join(unitDir, name+".service")); err != nil {
+		return err
+	}
+	return systemctl("daemon-reload")
+}
+
+// controlService starts or stops the unit through systemctl
+func controlService(name, action string) error {
+	return systemctl(action, name+".service")
+}
+
+func systemctl(args ...string) error {
+	cmd := exec.Command("systemctl", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("systemctl %s: %w", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// systemdCommandLine quotes the executable and arguments for ExecStart
+func systemdCommandLine(exe string, args []string) string {
+	parts := []string{strconv.Quote(exe)}
+	for _, arg := range args {
+		parts = append(parts, strconv.Quote(arg))
+	}
+	return strings.Join(parts, " ")
+}
+
+// serviceHooks reports readiness and shutdown to systemd when it started us
+func serviceHooks() (stop <-chan struct{}, ready func(), stopping func()) {
+	return nil, func() {
+			if err := lib.SDNotify("READY=1"); err != nil {
+				fmt.Fprintf(os.Stderr, "sd_notify failed: %v\n", err)
+			}
+		}, func() {
+			lib.SDNotify("STOPPING=1")
+		}
+}
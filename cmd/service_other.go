@@ -0,0 +1,24 @@
+//go:build !linux && !windows
+
+package cmd
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func installService(spec serviceSpec) error {
+	return fmt.Errorf("service installation is not supported on %s", runtime.GOOS)
+}
+
+func uninstallService(name, unitDir string) error {
+	return fmt.Errorf("service installation is not supported on %s", runtime.GOOS)
+}
+
+func controlService(name, action string) error {
+	return fmt.Errorf("service control is not supported on %s", runtime.GOOS)
+}
+
+func serviceHooks() (stop <-chan struct{}, ready func(), stopping func()) {
+	return nil, func() {}, func() {}
+}
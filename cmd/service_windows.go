@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// installService registers the broker with the Windows service control manager
+func installService(spec serviceSpec) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(spec.Name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", spec.Name)
+	}
+	startType := uint32(mgr.StartManual)
+	if spec.Enable {
+		startType = mgr.StartAutomatic
+	}
+	s, err := m.CreateService(spec.Name, spec.Executable, mgr.Config{
+		DisplayName: spec.Description,
+		Description: spec.Description,
+		StartType:   startType,
+	}, spec.Args...)
+	if err != nil {
+		return err
+	}
+	return s.Close()
+}
+
+// uninstallService removes the Windows service
+func uninstallService(name, _ string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed: %w", name, err)
+	}
+	defer s.Close()
+	return s.Delete()
+}
+
+// controlService starts or stops the Windows service
+func controlService(name, action string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed: %w", name, err)
+	}
+	defer s.Close()
+	switch action {
+	case "start":
+		return s.Start()
+	case "stop":
+		_, err := s.Control(svc.Stop)
+		return err
+	default:
+		return fmt.Errorf("unsupported service action: %s", action)
+	}
+}
+
+// brokerService bridges service control requests to the serve loop
+type brokerService struct {
+	stop    chan struct{}
+	ready   chan struct{}
+	stopped chan struct{}
+}
+
+func (b *brokerService) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	select {
+	case <-b.ready:
+	case <-b.stopped:
+		return false, 1
+	}
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				close(b.stop)
+				select {
+				case <-b.stopped:
+				case <-time.After(30 * time.Second):
+				}
+				return false, 0
+			}
+		case <-b.stopped:
+			return false, 0
+		}
+	}
+}
+
+// serviceHooks runs the service control handler when started by the SCM
+func serviceHooks() (stop <-chan struct{}, ready func(), stopping func()) {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return nil, func() {}, func() {}
+	}
+	b := &brokerService{stop: make(chan struct{}), ready: make(chan struct{}), stopped: make(chan struct{})}
+	go func() {
+		if err := svc.Run(defaultServiceName, b); err != nil {
+			log.Printf("service handler failed: %v", err)
+		}
+	}()
+	return b.stop, func() { close(b.ready) }, func() { close(b.stopped) }
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/cmd/lib"
+)
+
+// handleReadOnlySignals enables read-only mode on SIGUSR1 and disables it on SIGUSR2
+func handleReadOnlySignals(server *lib.Server) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				server.SetReadOnly(context.Background(), &pb.ReadOnlyRequest{Enabled: sig == syscall.SIGUSR1})
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
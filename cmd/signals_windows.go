@@ -0,0 +1,9 @@
+package cmd
+
+import "github.com/ispapp/Microservices-Broker/cmd/lib"
+
+// handleReadOnlySignals is a no-op on Windows, which has no SIGUSR1/SIGUSR2;
+// use the admin listener's /read-only endpoint instead
+func handleReadOnlySignals(server *lib.Server) (stop func()) {
+	return func() {}
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ispapp/Microservices-Broker/client"
+
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+var TapCommand = &cli.Command{
+	Name:  "tap",
+	Usage: "Print a sample of the live messages sent to a service",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "address",
+			Aliases: []string{"a"},
+			Usage:   "Broker address",
+			Value:   "localhost:9000",
+		},
+		&cli.StringFlag{
+			Name:     "service",
+			Aliases:  []string{"s"},
+			Usage:    "Service whose messages to sample",
+			Required: true,
+		},
+		&cli.Float64Flag{
+			Name:  "rate",
+			Usage: "Fraction of the messages to print, above 0 and at most 1",
+			Value: 0.1,
+		},
+		&cli.StringFlag{
+			Name:  "auth-method",
+			Usage: "Authentication method (jwt, apikey or hmac)",
+			Value: "apikey",
+		},
+		&cli.StringFlag{
+			Name:  "credential",
+			Usage: "Admin API key or JWT token",
+		},
+		&cli.BoolFlag{
+			Name:  "tls",
+			Usage: "Connect using TLS",
+		},
+		&cli.StringFlag{
+			Name:  "cert",
+			Usage: "TLS CA certificate file",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		ac, err := client.NewAuthenticatedClient(c.String("address"), "broker-tap", c.String("auth-method"), c.Bool("tls"), c.String("cert"))
+		if err != nil {
+			return err
+		}
+		defer ac.Close()
+		ac.SetAPIKey(c.String("credential"))
+		ac.SetJWTToken(c.String("credential"))
+
+		tap, err := ac.Tap(c.Context, c.String("service"), c.Float64("rate"))
+		if err != nil {
+			return err
+		}
+		for {
+			msg, err := tap.Recv()
+			if errors.Is(err, io.EOF) || status.Code(err) == codes.Canceled {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			line, err := protojson.Marshal(msg)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(c.App.Writer, string(line))
+		}
+	},
+}
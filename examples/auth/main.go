@@ -0,0 +1,71 @@
+// Command auth connects two services to a running broker with the broker's
+// authentication method and sends a message from one to the other:
+//
+//	./broker auth generate-key -s service-1
+//	./broker auth generate-key -s service-2
+//	go run ./examples/auth -address localhost:9000 -sender-key <key-1> -receiver-key <key-2>
+//
+// With the jwt method, pass the tokens of `./broker auth generate-jwt` and -method jwt.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/client"
+)
+
+func main() {
+	address := flag.String("address", "localhost:9000", "broker address")
+	method := flag.String("method", "apikey", "authentication method: apikey, jwt or hmac")
+	senderKey := flag.String("sender-key", "", "API key or JWT of service-1")
+	receiverKey := flag.String("receiver-key", "", "API key or JWT of service-2")
+	flag.Parse()
+
+	sender, err := connect(*address, "service-1", *method, *senderKey)
+	if err != nil {
+		log.Fatalf("Failed to create client of service-1: %v", err)
+	}
+	defer sender.Close()
+	receiver, err := connect(*address, "service-2", *method, *receiverKey)
+	if err != nil {
+		log.Fatalf("Failed to create client of service-2: %v", err)
+	}
+	defer receiver.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	status, err := sender.Ping(ctx)
+	if err != nil {
+		log.Fatalf("Ping failed: %v", err)
+	}
+	log.Printf("Ping response: %s", status.Message)
+
+	stream, err := receiver.Receive(ctx)
+	if err != nil {
+		log.Fatalf("Receive failed: %v", err)
+	}
+	if _, err := sender.Send(ctx, "service-2", []byte("Hello from service-1"), pb.Type_TEXT, true); err != nil {
+		log.Fatalf("Send failed: %v", err)
+	}
+	msg, err := stream.Recv()
+	if err != nil {
+		log.Fatalf("Receive stream error: %v", err)
+	}
+	log.Printf("Received message: %s (from: %s, type: %s)", msg.Data, msg.From, msg.Type)
+}
+
+// connect connects service with the credential of method
+func connect(address, service, method, credential string) (*client.AuthenticatedClient, error) {
+	config := client.Config{Address: address, Service: service, AuthMethod: method}
+	if method == "jwt" {
+		config.JWTToken = credential
+	} else {
+		config.APIKey = credential
+	}
+	return client.New(config)
+}
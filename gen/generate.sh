@@ -0,0 +1,44 @@
+#!/usr/bin/env bash
+# Builds the Python and TypeScript client packages from base/v2/broker.proto.
+#
+#   ./gen/generate.sh            generate stubs and build both packages
+#   ./gen/generate.sh python     only the Python package (needs grpcio-tools and build)
+#   ./gen/generate.sh typescript only the TypeScript package (needs node and npm)
+#
+# Packages are written to gen/python/dist and gen/typescript/dist, ready for
+# `twine upload` and `npm publish`.
+set -euo pipefail
+
+GEN_DIR="$(cd "$(dirname "$0")" && pwd)"
+PROTO_DIR="$GEN_DIR/../base"
+PROTO="v2/broker.proto"
+TARGET="${1:-all}"
+
+python_package() {
+    local out="$GEN_DIR/python/ms_broker/_proto"
+    rm -f "$out"/broker_pb2*.py "$out"/broker_pb2*.pyi
+    python3 -m grpc_tools.protoc --proto_path="$PROTO_DIR" \
+        --python_out="$out" --pyi_out="$out" --grpc_python_out="$out" "$PROTO"
+    # protoc keeps the proto directory in the output path and imports
+    mv "$out"/v2/* "$out" && rmdir "$out/v2"
+    sed -i.bak 's/^from v2 import/from . import/' "$out"/broker_pb2_grpc.py && rm -f "$out"/*.bak
+    (cd "$GEN_DIR/python" && python3 -m build)
+}
+
+typescript_package() {
+    cd "$GEN_DIR/typescript"
+    npm install
+    mkdir -p proto src/generated
+    cp "$PROTO_DIR/$PROTO" proto/broker.proto
+    # Types for @grpc/proto-loader; the options must match loadSync in src/index.ts
+    npx proto-loader-gen-types --grpcLib=@grpc/grpc-js --longs=String --enums=String \
+        --defaults --oneofs --includeDirs=proto --outDir=src/generated broker.proto
+    npm run build
+}
+
+case "$TARGET" in
+    python) python_package ;;
+    typescript) typescript_package ;;
+    all) python_package; typescript_package ;;
+    *) echo "usage: $0 [python|typescript|all]" >&2; exit 2 ;;
+esac
@@ -0,0 +1,22 @@
+"""Python client for the Microservices Broker (broker.v2 API)."""
+
+from ._proto.broker_pb2 import (
+    ChecksumType,
+    Error,
+    Event,
+    Message,
+    Status,
+    Type,
+)
+from .client import Client, status_from_error
+
+__all__ = [
+    "ChecksumType",
+    "Client",
+    "Error",
+    "Event",
+    "Message",
+    "Status",
+    "Type",
+    "status_from_error",
+]
@@ -0,0 +1 @@
+"""Stubs generated from base/v2/broker.proto by gen/generate.sh."""
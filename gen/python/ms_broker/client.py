@@ -0,0 +1,144 @@
+"""Authenticated broker client, mirroring the Go AuthenticatedClient."""
+
+from typing import Iterator, Optional, Sequence, Tuple
+
+import grpc
+from google.protobuf import duration_pb2
+from google.rpc import status_pb2
+
+from ._proto import broker_pb2, broker_pb2_grpc
+
+PROTOCOL_VERSION = 1
+FEATURES = ("batch", "manual-ack", "checksum", "pause", "read-only")
+
+
+def status_from_error(error: grpc.RpcError) -> Optional[broker_pb2.Status]:
+    """Returns the broker Status attached to a failed call, if any."""
+    for key, value in error.trailing_metadata() or ():
+        if key != "grpc-status-details-bin":
+            continue
+        details = status_pb2.Status.FromString(value)
+        for detail in details.details:
+            status = broker_pb2.Status()
+            if detail.Unpack(status):
+                return status
+    return None
+
+
+class Client:
+    """A connection to the broker acting as one service.
+
+    auth_method is "apikey" (sends api_key as x-api-key) or "jwt" (sends
+    jwt_token as a bearer token), like the Go client.
+    """
+
+    def __init__(
+        self,
+        address: str,
+        service: str,
+        auth_method: str = "apikey",
+        api_key: str = "",
+        jwt_token: str = "",
+        tls: bool = False,
+        root_certificates: Optional[bytes] = None,
+    ) -> None:
+        if auth_method not in ("apikey", "jwt"):
+            raise ValueError("auth_method must be 'apikey' or 'jwt'")
+        self.service = service
+        self.auth_method = auth_method
+        self.api_key = api_key
+        self.jwt_token = jwt_token
+        if tls:
+            credentials = grpc.ssl_channel_credentials(root_certificates=root_certificates)
+            self._channel = grpc.secure_channel(address, credentials)
+        else:
+            self._channel = grpc.insecure_channel(address)
+        self._stub = broker_pb2_grpc.BrokerStub(self._channel)
+
+    def set_api_key(self, api_key: str) -> None:
+        self.api_key = api_key
+
+    def set_jwt_token(self, token: str) -> None:
+        self.jwt_token = token
+
+    def auth_metadata(self) -> Sequence[Tuple[str, str]]:
+        """Returns the call metadata carrying the configured credentials."""
+        if self.auth_method == "jwt" and self.jwt_token:
+            return (("authorization", "Bearer " + self.jwt_token),)
+        if self.auth_method == "apikey" and self.api_key:
+            return (("x-api-key", self.api_key),)
+        return ()
+
+    def hello(self, timeout: Optional[float] = None) -> broker_pb2.HelloResponse:
+        request = broker_pb2.HelloRequest(
+            protocol_version=PROTOCOL_VERSION, features=FEATURES
+        )
+        setattr(request, "from", self.service)
+        return self._stub.Hello(request, metadata=self.auth_metadata(), timeout=timeout)
+
+    def ping(self, timeout: Optional[float] = None) -> broker_pb2.Status:
+        return self._stub.Ping(self._identity(), metadata=self.auth_metadata(), timeout=timeout)
+
+    def send(
+        self,
+        to: str,
+        data: bytes,
+        type: int = broker_pb2.TYPE_OTHER,
+        queue: bool = False,
+        headers: Optional[dict] = None,
+        timeout: Optional[float] = None,
+    ) -> broker_pb2.Status:
+        return self.send_message(
+            broker_pb2.Message(to=to, data=data, type=type, queue=queue, headers=headers or {}),
+            timeout=timeout,
+        )
+
+    def send_message(self, message: broker_pb2.Message, timeout: Optional[float] = None) -> broker_pb2.Status:
+        if not getattr(message, "from"):
+            setattr(message, "from", self.service)
+        return self._stub.Send(message, metadata=self.auth_metadata(), timeout=timeout)
+
+    def send_batch(self, messages: Sequence[broker_pb2.Message], timeout: Optional[float] = None) -> broker_pb2.Status:
+        for message in messages:
+            if not getattr(message, "from"):
+                setattr(message, "from", self.service)
+        return self._stub.SendBatch(
+            broker_pb2.Batch(messages=messages), metadata=self.auth_metadata(), timeout=timeout
+        )
+
+    def receive(self, manual_ack: bool = False) -> Iterator[broker_pb2.Message]:
+        """Streams messages for this service. With manual_ack, messages stay queued until ack().
+
+        Skip messages whose event is EVENT_KEEPALIVE; they are the broker's liveness probes.
+        """
+        return self._stub.Receive(self._identity(manual_ack), metadata=self.auth_metadata())
+
+    def ack(self, message_id: str, timeout: Optional[float] = None) -> broker_pb2.Status:
+        request = broker_pb2.AckRequest(id=message_id)
+        setattr(request, "from", self.service)
+        return self._stub.Ack(request, metadata=self.auth_metadata(), timeout=timeout)
+
+    def nack(self, message_id: str, delay_seconds: float = 0, timeout: Optional[float] = None) -> broker_pb2.Status:
+        delay = duration_pb2.Duration()
+        delay.FromNanoseconds(int(delay_seconds * 1e9))
+        request = broker_pb2.NackRequest(id=message_id, requeue_delay=delay)
+        setattr(request, "from", self.service)
+        return self._stub.Nack(request, metadata=self.auth_metadata(), timeout=timeout)
+
+    def cleanup(self, timeout: Optional[float] = None) -> broker_pb2.Status:
+        return self._stub.Cleanup(self._identity(), metadata=self.auth_metadata(), timeout=timeout)
+
+    def close(self) -> None:
+        self._channel.close()
+
+    def __enter__(self) -> "Client":
+        return self
+
+    def __exit__(self, *exc) -> None:
+        self.close()
+
+    def _identity(self, manual_ack: bool = False) -> broker_pb2.Identity:
+        # "from" is a Python keyword, so the field is set by name
+        identity = broker_pb2.Identity(manual_ack=manual_ack)
+        setattr(identity, "from", self.service)
+        return identity
@@ -0,0 +1,135 @@
+import * as path from 'path';
+import * as grpc from '@grpc/grpc-js';
+import * as protoLoader from '@grpc/proto-loader';
+
+import type { ProtoGrpcType } from './generated/broker';
+import type { BrokerClient } from './generated/broker/v2/Broker';
+import type { HelloResponse__Output } from './generated/broker/v2/HelloResponse';
+import type { Message, Message__Output } from './generated/broker/v2/Message';
+import type { Status__Output } from './generated/broker/v2/Status';
+
+export type { Message, Message__Output, Status__Output, HelloResponse__Output };
+
+export const PROTOCOL_VERSION = 1;
+export const FEATURES = ['batch', 'manual-ack', 'checksum', 'pause', 'read-only'];
+
+// Must match the options passed to proto-loader-gen-types in gen/generate.sh
+const packageDefinition = protoLoader.loadSync(path.join(__dirname, '..', 'proto', 'broker.proto'), {
+  longs: String,
+  enums: String,
+  defaults: true,
+  oneofs: true,
+});
+const proto = grpc.loadPackageDefinition(packageDefinition) as unknown as ProtoGrpcType;
+
+export interface ClientOptions {
+  /** "apikey" (default) sends apiKey as x-api-key, "jwt" sends jwtToken as a bearer token */
+  authMethod?: 'apikey' | 'jwt';
+  apiKey?: string;
+  jwtToken?: string;
+  /** Connect with TLS, optionally trusting rootCerts (PEM) */
+  tls?: boolean;
+  rootCerts?: Buffer;
+}
+
+export interface SendOptions {
+  type?: Message['type'];
+  queue?: boolean;
+  headers?: Record<string, string>;
+  deadline?: grpc.Deadline;
+}
+
+/** An authenticated connection to the broker acting as one service, mirroring the Go AuthenticatedClient. */
+export class Client {
+  private readonly client: BrokerClient;
+  private readonly authMethod: 'apikey' | 'jwt';
+  private apiKey: string;
+  private jwtToken: string;
+
+  constructor(address: string, readonly service: string, options: ClientOptions = {}) {
+    this.authMethod = options.authMethod ?? 'apikey';
+    this.apiKey = options.apiKey ?? '';
+    this.jwtToken = options.jwtToken ?? '';
+    const credentials = options.tls ? grpc.credentials.createSsl(options.rootCerts) : grpc.credentials.createInsecure();
+    this.client = new proto.broker.v2.Broker(address, credentials);
+  }
+
+  setApiKey(apiKey: string): void {
+    this.apiKey = apiKey;
+  }
+
+  setJwtToken(token: string): void {
+    this.jwtToken = token;
+  }
+
+  /** Returns call metadata carrying the configured credentials */
+  authMetadata(): grpc.Metadata {
+    const metadata = new grpc.Metadata();
+    if (this.authMethod === 'jwt' && this.jwtToken) {
+      metadata.set('authorization', `Bearer ${this.jwtToken}`);
+    } else if (this.authMethod === 'apikey' && this.apiKey) {
+      metadata.set('x-api-key', this.apiKey);
+    }
+    return metadata;
+  }
+
+  hello(deadline?: grpc.Deadline): Promise<HelloResponse__Output> {
+    return this.unary<HelloResponse__Output>('Hello', { from: this.service, protocolVersion: PROTOCOL_VERSION, features: FEATURES }, deadline);
+  }
+
+  ping(deadline?: grpc.Deadline): Promise<Status__Output> {
+    return this.unary<Status__Output>('Ping', { from: this.service }, deadline);
+  }
+
+  send(to: string, data: Buffer | Uint8Array, options: SendOptions = {}): Promise<Status__Output> {
+    return this.sendMessage({ to, data, type: options.type, queue: options.queue, headers: options.headers }, options.deadline);
+  }
+
+  sendMessage(message: Message, deadline?: grpc.Deadline): Promise<Status__Output> {
+    return this.unary<Status__Output>('Send', { ...message, from: message.from || this.service }, deadline);
+  }
+
+  sendBatch(messages: Message[], deadline?: grpc.Deadline): Promise<Status__Output> {
+    const batch = messages.map((message) => ({ ...message, from: message.from || this.service }));
+    return this.unary<Status__Output>('SendBatch', { messages: batch }, deadline);
+  }
+
+  /**
+   * Streams messages for this service. With manualAck, messages stay queued until ack().
+   * Skip messages whose event is EVENT_KEEPALIVE; they are the broker's liveness probes.
+   */
+  receive(options: { manualAck?: boolean } = {}): grpc.ClientReadableStream<Message__Output> {
+    return this.client.Receive({ from: this.service, manualAck: options.manualAck ?? false }, this.authMetadata());
+  }
+
+  ack(id: string, deadline?: grpc.Deadline): Promise<Status__Output> {
+    return this.unary<Status__Output>('Ack', { from: this.service, id }, deadline);
+  }
+
+  /** Rejects a message; it becomes visible again after delayMs */
+  nack(id: string, delayMs = 0, deadline?: grpc.Deadline): Promise<Status__Output> {
+    const requeueDelay = { seconds: String(Math.floor(delayMs / 1000)), nanos: (delayMs % 1000) * 1e6 };
+    return this.unary<Status__Output>('Nack', { from: this.service, id, requeueDelay }, deadline);
+  }
+
+  cleanup(deadline?: grpc.Deadline): Promise<Status__Output> {
+    return this.unary<Status__Output>('Cleanup', { from: this.service }, deadline);
+  }
+
+  close(): void {
+    this.client.close();
+  }
+
+  private unary<T>(method: string, request: object, deadline?: grpc.Deadline): Promise<T> {
+    return new Promise((resolve, reject) => {
+      const call = (this.client as unknown as Record<string, Function>)[method].bind(this.client);
+      call(request, this.authMetadata(), { deadline }, (err: grpc.ServiceError | null, response: T) => {
+        if (err) {
+          reject(err);
+        } else {
+          resolve(response);
+        }
+      });
+    });
+  }
+}
@@ -5,24 +5,10 @@ import (
 	"os"
 
 	"github.com/ispapp/Microservices-Broker/cmd"
-
-	"github.com/urfave/cli/v2"
 )
 
 func main() {
-	app := &cli.App{
-		Name:           "Microservices Broker",
-		Usage:          "Simple Microservices Broker",
-		DefaultCommand: "serve",
-		Commands: []*cli.Command{
-			cmd.ServerCommand,
-			cmd.ConfigCommand,
-			cmd.AuthCommand,
-		},
-	}
-
-	err := app.Run(os.Args)
-	if err != nil {
+	if err := cmd.NewApp().Run(os.Args); err != nil {
 		log.Fatal(err)
 	}
 }
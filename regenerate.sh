@@ -1 +1,21 @@
- protoc --proto_path=base  --go-grpc_out=. --go_out=.  base/base.proto
\ No newline at end of file
+#!/usr/bin/env bash
+# Regenerates the protobuf stubs. Go stubs are always generated; Python and
+# TypeScript stubs of the v2 API are generated when their plugins are installed.
+set -e
+cd "$(dirname "$0")"
+
+# Go: v1 (base.proto, package base.proto) and v2 (v2/broker.proto, package broker.v2)
+protoc --proto_path=base --go-grpc_out=. --go_out=. base/base.proto base/v2/broker.proto
+cp base/base.proto client/node/base.proto
+
+# Python: pip install grpcio-tools
+if python3 -c "import grpc_tools" 2>/dev/null; then
+    mkdir -p base/v2/python
+    python3 -m grpc_tools.protoc --proto_path=base --python_out=base/v2/python --pyi_out=base/v2/python --grpc_python_out=base/v2/python base/v2/broker.proto
+fi
+
+# TypeScript: npm install -g protoc-gen-ts
+if command -v protoc-gen-ts >/dev/null; then
+    mkdir -p base/v2/ts
+    protoc --proto_path=base --ts_out=base/v2/ts base/v2/broker.proto
+fi
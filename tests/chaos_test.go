@@ -0,0 +1,266 @@
+//go:build chaos
+
+package test
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/cmd/lib"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Run with: go test -tags chaos ./tests -run TestChaos -chaos.duration 1m
+var (
+	chaosDuration  = flag.Duration("chaos.duration", 10*time.Second, "how long to run the chaos soak")
+	chaosConsumers = flag.Int("chaos.consumers", 4, "number of consumer services")
+	chaosAckDelay  = flag.Duration("chaos.ack-delay", 200*time.Millisecond, "longest delay before a consumer acks, a fifth of the acks wait past the ack timeout")
+)
+
+// chaosAckTimeout is the broker's redelivery delay for unacknowledged messages
+const chaosAckTimeout = 500 * time.Millisecond
+
+// chaosBroker runs a real broker on a fixed address so it can be restarted underneath clients
+type chaosBroker struct {
+	t      *testing.T
+	dbPath string
+	addr   string
+	mu     sync.Mutex
+	server *lib.Server
+	grpc   *grpc.Server
+}
+
+func (b *chaosBroker) start() {
+	b.t.Helper()
+	server, err := lib.NewServer(b.dbPath, 1, 100, time.Hour, lib.WithAcks(chaosAckTimeout, 0))
+	if err != nil {
+		b.t.Fatalf("failed to create server: %v", err)
+	}
+	var lis net.Listener
+	for i := 0; i < 50; i++ {
+		if lis, err = net.Listen("tcp", b.addr); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		b.t.Fatalf("failed to listen: %v", err)
+	}
+	b.addr = lis.Addr().String()
+	s := grpc.NewServer()
+	pb.RegisterBrokerServer(s, server)
+	go s.Serve(lis)
+	b.mu.Lock()
+	b.server, b.grpc = server, s
+	b.mu.Unlock()
+}
+
+func (b *chaosBroker) stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.grpc.Stop()
+	b.server.Close()
+}
+
+func (b *chaosBroker) restart() {
+	b.stop()
+	b.start()
+}
+
+// chaosLedger tracks accepted, delivered and acknowledged message ids. Accepted
+// messages map to true when they were queued rather than handed to a live stream,
+// and afterAck counts deliveries of messages that were already acknowledged.
+type chaosLedger struct {
+	mu        sync.Mutex
+	accepted  map[uint64]bool
+	delivered map[uint64]int
+	acked     map[uint64]bool
+	afterAck  int
+}
+
+func (l *chaosLedger) accept(id uint64, queued bool) {
+	l.mu.Lock()
+	l.accepted[id] = queued
+	l.mu.Unlock()
+}
+
+func (l *chaosLedger) deliver(id uint64) {
+	l.mu.Lock()
+	l.delivered[id]++
+	if l.acked[id] {
+		l.afterAck++
+	}
+	l.mu.Unlock()
+}
+
+func (l *chaosLedger) ack(id uint64) {
+	l.mu.Lock()
+	l.acked[id] = true
+	l.mu.Unlock()
+}
+
+// TestChaos randomly kills consumer streams, delays acks past the ack timeout and
+// restarts the broker while producers keep sending. Queued messages are delivered
+// until acknowledged, so each must be acked once in the end and never delivered
+// again after its ack. A message handed to a live stream is delivered at most once.
+func TestChaos(t *testing.T) {
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(out)
+
+	broker := &chaosBroker{t: t, dbPath: t.TempDir() + "/broker.db", addr: "127.0.0.1:0"}
+	broker.start()
+
+	conn, err := grpc.NewClient(broker.addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewBrokerClient(conn)
+
+	ledger := &chaosLedger{accepted: map[uint64]bool{}, delivered: map[uint64]int{}, acked: map[uint64]bool{}}
+	ctx, cancel := context.WithTimeout(context.Background(), *chaosDuration)
+	defer cancel()
+	var wg, acks sync.WaitGroup
+
+	// Producer: sends uniquely numbered queued messages
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		payload := make([]byte, 8)
+		for id := uint64(1); ctx.Err() == nil; id++ {
+			binary.BigEndian.PutUint64(payload, id)
+			to := "chaos-" + string(rune('a'+int(id)%*chaosConsumers))
+			status, err := client.Send(ctx, &pb.Message{Data: payload, Type: pb.Type_OTHER, From: "chaos-producer", To: to, Queue: true})
+			if err == nil && status.Success {
+				ledger.accept(id, status.Message != "Message sent")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	// receive records the messages of one stream and acks them after delay, which
+	// outlives the stream so that late acks race redeliveries
+	receive := func(stream pb.Broker_ReceiveClient, name string, delay func() time.Duration) {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			// Live messages keep the event of the Send, queued ones are MESSAGE
+			if (msg.Event != pb.Event_STREAM && msg.Event != pb.Event_MESSAGE) || len(msg.Data) != 8 {
+				continue
+			}
+			id := binary.BigEndian.Uint64(msg.Data)
+			ledger.deliver(id)
+			if msg.Id == "" {
+				// Handed over live, there is nothing to ack
+				continue
+			}
+			acks.Add(1)
+			go func(key string, wait time.Duration) {
+				defer acks.Done()
+				time.Sleep(wait)
+				ackCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				if status, err := client.Ack(ackCtx, &pb.AckRequest{From: name, Id: key}); err == nil && status.Success {
+					ledger.ack(id)
+				}
+			}(msg.Id, delay())
+		}
+	}
+	chaoticDelay := func() time.Duration {
+		if rand.Intn(5) == 0 {
+			return chaosAckTimeout + time.Duration(rand.Int63n(int64(chaosAckTimeout)))
+		}
+		return time.Duration(rand.Int63n(int64(*chaosAckDelay) + 1))
+	}
+
+	// Consumers: reconnect forever, streams are killed at random
+	consume := func(ctx context.Context, name string) {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			streamCtx, kill := context.WithTimeout(ctx, time.Duration(200+rand.Intn(1500))*time.Millisecond)
+			if stream, err := client.Receive(streamCtx, &pb.Identity{From: name, ManualAck: true}); err == nil {
+				receive(stream, name, chaoticDelay)
+			}
+			kill()
+			time.Sleep(time.Duration(rand.Intn(100)) * time.Millisecond)
+		}
+	}
+	for i := 0; i < *chaosConsumers; i++ {
+		wg.Add(1)
+		go consume(ctx, "chaos-"+string(rune('a'+i)))
+	}
+
+	// Chaos monkey: restart the broker at random intervals
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Duration(1+rand.Intn(3)) * time.Second):
+				broker.restart()
+			}
+		}
+	}()
+	wg.Wait()
+	// Let the delayed acks land, the messages they miss are redelivered below
+	acks.Wait()
+
+	// Drain whatever is still queued or in flight with stable consumers that ack at once
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), 3*chaosAckTimeout+5*time.Second)
+	defer drainCancel()
+	var drain sync.WaitGroup
+	for i := 0; i < *chaosConsumers; i++ {
+		drain.Add(1)
+		go func(name string) {
+			defer drain.Done()
+			if stream, err := client.Receive(drainCtx, &pb.Identity{From: name, ManualAck: true}); err == nil {
+				receive(stream, name, func() time.Duration { return 0 })
+			}
+		}("chaos-" + string(rune('a'+i)))
+	}
+	drain.Wait()
+	acks.Wait()
+	broker.stop()
+
+	ledger.mu.Lock()
+	defer ledger.mu.Unlock()
+	lost, duplicated, redelivered := 0, 0, 0
+	for id, queued := range ledger.accepted {
+		n := ledger.delivered[id]
+		switch {
+		case queued && !ledger.acked[id]:
+			lost++
+		case !queued && n > 1:
+			duplicated++
+		case n > 1:
+			redelivered++
+		}
+	}
+	t.Logf("accepted=%d delivered=%d acked=%d lost=%d redelivered=%d duplicated=%d delivered-after-ack=%d",
+		len(ledger.accepted), len(ledger.delivered), len(ledger.acked), lost, redelivered, duplicated, ledger.afterAck)
+	if lost > 0 {
+		t.Errorf("%d queued messages were never acknowledged", lost)
+	}
+	if duplicated > 0 {
+		t.Errorf("%d messages handed to live streams were delivered more than once", duplicated)
+	}
+	if ledger.afterAck > 0 {
+		t.Errorf("%d deliveries were of messages already acknowledged", ledger.afterAck)
+	}
+}
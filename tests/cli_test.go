@@ -0,0 +1,383 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/broker"
+	"github.com/ispapp/Microservices-Broker/brokertest"
+	"github.com/ispapp/Microservices-Broker/client"
+	"github.com/ispapp/Microservices-Broker/cmd"
+	"github.com/ispapp/Microservices-Broker/cmd/lib"
+
+	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc/codes"
+)
+
+// runCLI runs the broker command line with args and stdin, returning its output
+func runCLI(t *testing.T, stdin string, args ...string) (string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	app := cmd.NewApp()
+	app.Reader = strings.NewReader(stdin)
+	app.Writer = &out
+	app.ErrWriter = &out
+	// Errors are returned to the test instead of exiting
+	app.ExitErrHandler = func(*cli.Context, error) {}
+	err := app.Run(append([]string{"broker"}, args...))
+	return out.String(), err
+}
+
+// cliConfig writes a default config with an API key for billing and returns its path and the key
+func cliConfig(t *testing.T) (string, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if _, err := runCLI(t, "", "config", "init-config", "-c", path); err != nil {
+		t.Fatalf("init-config failed: %v", err)
+	}
+	key, err := runCLI(t, "", "--quiet", "auth", "generate-key", "-s", "billing", "-c", path)
+	if err != nil {
+		t.Fatalf("generate-key failed: %v", err)
+	}
+	return path, strings.TrimSpace(key)
+}
+
+func TestCLIQuietPrintsOnlyValues(t *testing.T) {
+	path, key := cliConfig(t)
+	config, err := lib.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if config.Auth.APIKeys[key] != "billing" {
+		t.Fatalf("expected --quiet to print only the generated key, got %q", key)
+	}
+	out, err := runCLI(t, "", "--quiet", "config", "set-auth-method", "-m", "apikey", "-c", path)
+	if err != nil || out != "" {
+		t.Fatalf("expected no output, got %q (%v)", out, err)
+	}
+}
+
+func TestCLIRemoveKey(t *testing.T) {
+	path, key := cliConfig(t)
+
+	if _, err := runCLI(t, "", "auth", "remove-key", "-k", "unknown", "-c", path); err == nil {
+		t.Fatal("expected removing an unknown key to fail")
+	}
+	if _, err := runCLI(t, "n\n", "auth", "remove-key", "-k", key, "-c", path); err == nil {
+		t.Fatal("expected a declined removal to fail")
+	}
+	if _, err := runCLI(t, "y\n", "auth", "remove-key", "-k", key, "-c", path); err != nil {
+		t.Fatalf("remove-key failed: %v", err)
+	}
+	config, err := lib.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if _, ok := config.Auth.APIKeys[key]; ok {
+		t.Fatal("expected the key to be removed")
+	}
+}
+
+func TestCLIRefusesWithoutTerminal(t *testing.T) {
+	path, key := cliConfig(t)
+	// Input piped in by a script, which a prompt must not wait on
+	stdin, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	defer w.Close()
+
+	app := cmd.NewApp()
+	app.Reader = stdin
+	app.Writer, app.ErrWriter = new(bytes.Buffer), new(bytes.Buffer)
+	app.ExitErrHandler = func(*cli.Context, error) {}
+	if err := app.Run([]string{"broker", "auth", "remove-key", "-k", key, "-c", path}); err == nil || !strings.Contains(err.Error(), "--yes") {
+		t.Fatalf("expected remove-key to ask for --yes, got %v", err)
+	}
+	if _, err := runCLI(t, "", "--yes", "auth", "remove-key", "-k", key, "-c", path); err != nil {
+		t.Fatalf("remove-key --yes failed: %v", err)
+	}
+	if _, err := runCLI(t, "", "config", "init-config", "-c", path); err == nil {
+		t.Fatal("expected init-config to refuse overwriting without --yes")
+	}
+}
+
+func TestCLIProvisionWithBrokenConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(path, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err := runCLI(t, "", "auth", "provision-broker-yaml", "-n", "billing", "-o", filepath.Join(dir, "billing.yml"), "-c", path)
+	if err == nil {
+		t.Fatal("expected provisioning with an unreadable config to fail")
+	}
+}
+
+func TestCLIOutputJSON(t *testing.T) {
+	path, key := cliConfig(t)
+	out, err := runCLI(t, "", "--output", "json", "auth", "list-keys", "-c", path)
+	if err != nil {
+		t.Fatalf("list-keys failed: %v", err)
+	}
+	var keys []struct{ Service, Key string }
+	if err := json.Unmarshal([]byte(out), &keys); err != nil {
+		t.Fatalf("expected JSON, got %q: %v", out, err)
+	}
+	found := false
+	for _, k := range keys {
+		found = found || (k.Service == "billing" && k.Key == key)
+	}
+	if !found {
+		t.Fatalf("billing key missing from %s", out)
+	}
+	if _, err := runCLI(t, "", "--output", "xml", "auth", "list-keys", "-c", path); err == nil {
+		t.Fatal("expected an unknown output format to fail")
+	}
+}
+
+func TestCLIAuthExportImport(t *testing.T) {
+	source, key := cliConfig(t)
+	target, own := cliConfig(t)
+	export := filepath.Join(t.TempDir(), "keys.json")
+	t.Setenv(lib.EnvExportPassphrase, "correct horse")
+
+	if _, err := runCLI(t, "", "auth", "export", "--out", export, "--passphrase", "-c", source); err != nil {
+		t.Fatalf("export failed: %v", err)
+	}
+	if data, err := os.ReadFile(export); err != nil || strings.Contains(string(data), key) {
+		t.Fatalf("expected an encrypted export (%v)", err)
+	}
+
+	t.Setenv(lib.EnvExportPassphrase, "wrong")
+	if _, err := runCLI(t, "", "auth", "import", "--in", export, "-c", target); err == nil {
+		t.Fatal("expected the wrong passphrase to fail")
+	}
+	t.Setenv(lib.EnvExportPassphrase, "correct horse")
+	if _, err := runCLI(t, "", "auth", "import", "--in", export, "-c", target); err != nil {
+		t.Fatalf("import failed: %v", err)
+	}
+	config, err := lib.LoadConfig(target)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if config.Auth.APIKeys[key] != "billing" || config.Auth.APIKeys[own] != "billing" {
+		t.Fatalf("expected merged keys, got %v", config.Auth.APIKeys)
+	}
+
+	if _, err := runCLI(t, "", "--yes", "auth", "import", "--in", export, "--mode", "replace", "-c", target); err != nil {
+		t.Fatalf("import --mode replace failed: %v", err)
+	}
+	if config, err = lib.LoadConfig(target); err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if _, ok := config.Auth.APIKeys[own]; ok {
+		t.Fatal("expected replace to drop the target's own keys")
+	}
+}
+
+func TestCLIListKeysUsage(t *testing.T) {
+	quietLogs(t)
+	path, used := cliConfig(t)
+	out, err := runCLI(t, "", "--quiet", "auth", "generate-key", "-s", "billing", "-c", path,
+		"--owner", "payments", "--description", "nightly export", "--label", "env=prod")
+	if err != nil {
+		t.Fatalf("generate-key failed: %v", err)
+	}
+	idle := strings.TrimSpace(out)
+
+	// The broker records the use of a key
+	config, err := lib.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	config.Auth.EnableAuth, config.Auth.AuthMethod = true, lib.AuthMethodAPIKey
+	b := brokertest.NewWithOptions(t, broker.Options{Auth: &config.Auth})
+	stop := b.AuthManager().TrackKeyUsage(lib.KeyUsagePath(path), time.Hour)
+	c, err := client.NewAuthenticatedClientWithOptions("passthrough:///bufconn", "billing", "apikey", b.DialOptions()...)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetAPIKey(used)
+	if _, err := c.Send(testContext(t), "orders", []byte("x"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	stop()
+
+	out, err = runCLI(t, "", "--output", "json", "auth", "list-keys", "-c", path)
+	if err != nil {
+		t.Fatalf("list-keys failed: %v", err)
+	}
+	var keys []struct {
+		Key, Owner, Description string
+		Labels                  map[string]string
+		LastUsed                *time.Time `json:"last_used"`
+	}
+	if err := json.Unmarshal([]byte(out), &keys); err != nil {
+		t.Fatalf("expected JSON, got %q: %v", out, err)
+	}
+	for _, k := range keys {
+		switch k.Key {
+		case used:
+			if k.LastUsed == nil {
+				t.Fatal("expected the used key to have a last use")
+			}
+		case idle:
+			if k.LastUsed != nil || k.Owner != "payments" || k.Description != "nightly export" || k.Labels["env"] != "prod" {
+				t.Fatalf("unexpected metadata of the idle key: %+v", k)
+			}
+		}
+	}
+
+	// A key created two days ago and never used is stale after a day
+	if config, err = lib.LoadConfig(path); err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	config.Auth.KeyInfo[idle].CreatedAt = time.Now().Add(-48 * time.Hour)
+	if err := config.SaveConfig(path); err != nil {
+		t.Fatalf("SaveConfig failed: %v", err)
+	}
+	out, err = runCLI(t, "", "--output", "json", "auth", "list-keys", "-c", path, "--unused-for", "24h")
+	if err != nil || !strings.Contains(out, idle) || strings.Contains(out, used) {
+		t.Fatalf("expected only the idle key, got %s (%v)", out, err)
+	}
+}
+
+func TestCLIRevokeJWT(t *testing.T) {
+	quietLogs(t)
+	path, _ := cliConfig(t)
+	out, err := runCLI(t, "", "--quiet", "auth", "generate-jwt", "-s", "billing", "-c", path)
+	if err != nil {
+		t.Fatalf("generate-jwt failed: %v", err)
+	}
+	token := strings.TrimSpace(out)
+
+	config, err := lib.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	config.Auth.EnableAuth, config.Auth.AuthMethod = true, lib.AuthMethodJWT
+	b := brokertest.NewWithOptions(t, broker.Options{Auth: &config.Auth})
+	stop := b.AuthManager().WatchRevocations(lib.RevocationsPath(path), 10*time.Millisecond)
+	defer stop()
+	c, err := client.NewAuthenticatedClientWithOptions("passthrough:///bufconn", "billing", "jwt", b.DialOptions()...)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetJWTToken(token)
+	ctx := testContext(t)
+	if _, err := c.Send(ctx, "orders", []byte("x"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	if _, err := runCLI(t, "", "auth", "revoke-jwt", "-c", path); err == nil {
+		t.Fatal("expected revoke-jwt without a token or id to fail")
+	}
+	if _, err := runCLI(t, "", "auth", "revoke-jwt", "-t", token, "-c", path); err != nil {
+		t.Fatalf("revoke-jwt failed: %v", err)
+	}
+	// The running broker picks the revocation up
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err = c.Send(ctx, "orders", []byte("x"), pb.Type_TEXT, true)
+		if err != nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertCode(t, err, codes.Unauthenticated)
+
+	// Other tokens of the service keep working
+	fresh, err := b.AuthManager().GenerateJWT("billing")
+	if err != nil {
+		t.Fatalf("GenerateJWT failed: %v", err)
+	}
+	c.SetJWTToken(fresh)
+	if _, err := c.Send(ctx, "orders", []byte("x"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send with another token failed: %v", err)
+	}
+}
+
+func TestCLIProvisionedClient(t *testing.T) {
+	quietLogs(t)
+	path, _ := cliConfig(t)
+	yml := filepath.Join(filepath.Dir(path), "services.yml")
+	if _, err := runCLI(t, "", "auth", "provision-broker-yaml", "-n", "orders", "-o", yml, "-c", path); err != nil {
+		t.Fatalf("provision-broker-yaml failed: %v", err)
+	}
+	data, err := os.ReadFile(yml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without --address the first gRPC listener of the config is provisioned
+	if !strings.Contains(string(data), "address: localhost:") {
+		t.Fatalf("expected the broker address in the provisioned YAML, got:\n%s", data)
+	}
+	if _, err := runCLI(t, "", "auth", "provision-broker-yaml", "-n", "orders", "-o", yml, "-c", path,
+		"--address", "passthrough:///bufconn"); err != nil {
+		t.Fatalf("provision-broker-yaml failed: %v", err)
+	}
+
+	config, err := lib.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	config.Auth.EnableAuth, config.Auth.AuthMethod = true, lib.AuthMethodAPIKey
+	b := brokertest.NewWithOptions(t, broker.Options{Auth: &config.Auth})
+	c, err := client.NewFromYAML(yml, "orders", client.WithDialOptions(b.DialOptions()...))
+	if err != nil {
+		t.Fatalf("NewFromYAML failed: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Send(testContext(t), "billing", []byte("x"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send with the provisioned key failed: %v", err)
+	}
+	if _, err := client.NewFromYAML(yml, "billing"); err == nil {
+		t.Fatal("expected a service that was not provisioned to be refused")
+	}
+}
+
+func TestCLIProfileCapture(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.NewWithOptions(t, broker.Options{Auth: &lib.AuthConfig{
+		EnableAuth: true,
+		AuthMethod: lib.AuthMethodAPIKey,
+		Policy:     lib.AuthPolicy{AdminServices: []string{"ops"}},
+	}})
+	listener := httptest.NewServer(b.Server().ProfileHandler(b.AuthManager()))
+	defer listener.Close()
+	output := filepath.Join(t.TempDir(), "heap.pprof")
+
+	_, err := runCLI(t, "", "profile", "capture", "--url", listener.URL, "--type", "heap", "-o", output,
+		"--credential", b.AuthManager().GenerateAPIKey("billing"))
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("expected a profile capture by a non-admin service to be forbidden, got %v", err)
+	}
+
+	out, err := runCLI(t, "", "--quiet", "profile", "capture", "--url", listener.URL, "--type", "heap", "-o", output,
+		"--credential", b.AuthManager().GenerateAPIKey("ops"))
+	if err != nil {
+		t.Fatalf("profile capture failed: %v\n%s", err, out)
+	}
+	if strings.TrimSpace(out) != output {
+		t.Fatalf("expected the profile path, got %q", out)
+	}
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("failed to read profile: %v", err)
+	}
+	// Profiles are gzipped protocol buffers
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		t.Fatalf("expected a gzipped profile, got %d bytes", len(data))
+	}
+}
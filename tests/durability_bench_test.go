@@ -0,0 +1,66 @@
+package test
+
+import (
+	"context"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/cmd/lib"
+)
+
+// Durability tradeoffs, measured by queueing 1KB messages for an offline recipient:
+//   - sync:  one fsync per message; every acknowledged Send survives a crash.
+//   - group: fsync every SyncInterval; a crash may lose the last interval of writes.
+//   - async: no explicit fsync; the OS decides when data reaches disk.
+// SendBatch amortises the fsync across the whole batch in every mode.
+
+func newBenchServer(b *testing.B, mode lib.Durability) *lib.Server {
+	b.Helper()
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(out) })
+	server, err := lib.NewServer(b.TempDir()+"/broker.db", 60, 100, time.Hour,
+		lib.WithDurability(mode, 10*time.Millisecond))
+	if err != nil {
+		b.Fatalf("failed to create server: %v", err)
+	}
+	b.Cleanup(func() { server.Close() })
+	return server
+}
+
+func benchmarkSend(b *testing.B, mode lib.Durability) {
+	server := newBenchServer(b, mode)
+	msg := &pb.Message{Data: make([]byte, 1024), Type: pb.Type_OTHER, From: "bench", To: "offline", Queue: true}
+	b.SetBytes(int64(len(msg.Data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := server.Send(context.Background(), msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkSendBatch(b *testing.B, mode lib.Durability) {
+	server := newBenchServer(b, mode)
+	batch := &pb.Batch{}
+	for i := 0; i < 100; i++ {
+		batch.Messages = append(batch.Messages, &pb.Message{Data: make([]byte, 1024), Type: pb.Type_OTHER, From: "bench", To: "offline", Queue: true})
+	}
+	b.SetBytes(int64(len(batch.Messages) * 1024))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := server.SendBatch(context.Background(), batch); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSendSync(b *testing.B)       { benchmarkSend(b, lib.DurabilitySync) }
+func BenchmarkSendGroup(b *testing.B)      { benchmarkSend(b, lib.DurabilityGroup) }
+func BenchmarkSendAsync(b *testing.B)      { benchmarkSend(b, lib.DurabilityAsync) }
+func BenchmarkSendBatchSync(b *testing.B)  { benchmarkSendBatch(b, lib.DurabilitySync) }
+func BenchmarkSendBatchGroup(b *testing.B) { benchmarkSendBatch(b, lib.DurabilityGroup) }
+func BenchmarkSendBatchAsync(b *testing.B) { benchmarkSendBatch(b, lib.DurabilityAsync) }
@@ -0,0 +1,3867 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	pngenc "image/png"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ispapp/Microservices-Broker/base/pb"
+	"github.com/ispapp/Microservices-Broker/base/protocol"
+	"github.com/ispapp/Microservices-Broker/base/shard"
+	pbv2 "github.com/ispapp/Microservices-Broker/base/v2/pb"
+	"github.com/ispapp/Microservices-Broker/broker"
+	"github.com/ispapp/Microservices-Broker/brokertest"
+	"github.com/ispapp/Microservices-Broker/client"
+	"github.com/ispapp/Microservices-Broker/cmd/lib"
+	"github.com/ispapp/Microservices-Broker/transport"
+
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// End-to-end tests of the Broker service over an in-memory connection.
+// Run with -race to check the server's concurrency.
+
+// quietLogs silences the broker's per-message logging for the duration of the test
+func quietLogs(t *testing.T) {
+	out := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(out) })
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// receiveN reads n messages from service's Receive stream
+func receiveN(t *testing.T, ctx context.Context, c *client.AuthenticatedClient, n int) []*pb.Message {
+	t.Helper()
+	stream, err := c.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	msgs := make([]*pb.Message, 0, n)
+	for len(msgs) < n {
+		msg, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed after %d of %d messages: %v", len(msgs), n, err)
+		}
+		if msg.Event == pb.Event_ERROR {
+			t.Fatalf("Receive reported an error: %s", msg.Data)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func assertCode(t *testing.T, err error, want codes.Code) {
+	t.Helper()
+	if got := status.Code(err); got != want {
+		t.Fatalf("expected %s, got %s (%v)", want, got, err)
+	}
+}
+
+// rawSend sends msg over a connection of its own with the metadata pairs kv
+func rawSend(t *testing.T, b *brokertest.Broker, msg *pb.Message, kv ...string) (*pb.Status, error) {
+	t.Helper()
+	conn, err := grpc.NewClient("passthrough:///bufconn", b.DialOptions()...)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	return pb.NewBrokerClient(conn).Send(metadata.AppendToOutgoingContext(testContext(t), kv...), msg)
+}
+
+// forwardedBy returns the metadata of a call forwarded by shard "b" with secret
+func forwardedBy(secret string) []string {
+	return []string{lib.ForwardedMetadataKey, "b", lib.ShardSecretMetadataKey, secret}
+}
+
+// shardedBroker starts shard "a" of shards a and b, sharing secret, with opts. It
+// returns the broker and a service it owns.
+func shardedBroker(t *testing.T, secret string, opts ...lib.ServerOption) (*brokertest.Broker, string) {
+	t.Helper()
+	shards, err := shard.New([]shard.Shard{{Name: "a", Address: "passthrough:///a"}, {Name: "b", Address: "passthrough:///b"}})
+	if err != nil {
+		t.Fatalf("shard.New failed: %v", err)
+	}
+	owned := ""
+	for i := 0; owned == ""; i++ {
+		if name := fmt.Sprintf("svc-%d", i); shards.Owner(name).Name == "a" {
+			owned = name
+		}
+	}
+	return brokertest.New(t, append(opts, lib.WithSharding(shards, "a", false), lib.WithShardSecret(secret))...), owned
+}
+
+func TestServerPing(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t)
+	status, err := b.Client(t, "orders").Ping(testContext(t))
+	if err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	if !status.Success || status.Message != "Pong" {
+		t.Fatalf("unexpected Ping status: %v", status)
+	}
+}
+
+func TestServerSendValidation(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t)
+	ctx := testContext(t)
+	orders := b.Client(t, "orders")
+
+	_, err := orders.Send(ctx, "billing", nil, pb.Type_TEXT, true)
+	assertCode(t, err, codes.InvalidArgument)
+
+	_, err = orders.Send(ctx, "", []byte("x"), pb.Type_TEXT, true)
+	assertCode(t, err, codes.InvalidArgument)
+}
+
+func TestServerSendOffline(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t)
+	ctx := testContext(t)
+
+	st, err := b.Client(t, "orders").Send(ctx, "billing", []byte("x"), pb.Type_TEXT, false)
+	assertCode(t, err, codes.NotFound)
+	if !errors.Is(err, client.ErrRecipientOffline) {
+		t.Fatalf("expected ErrRecipientOffline, got %v", err)
+	}
+	if st == nil || st.Error != pb.Error_RECIPIENT_OFFLINE {
+		t.Fatalf("expected a RECIPIENT_OFFLINE status, got %v", st)
+	}
+	if n, _ := b.QueueLength("billing"); n != 0 {
+		t.Fatalf("non-queued message was stored, queue length %d", n)
+	}
+}
+
+func TestServerQueuedDelivery(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t)
+	ctx := testContext(t)
+	orders := b.Client(t, "orders")
+
+	for i := 0; i < 3; i++ {
+		if _, err := orders.Send(ctx, "billing", []byte(fmt.Sprintf("m%d", i)), pb.Type_TEXT, true); err != nil {
+			t.Fatalf("Send %d failed: %v", i, err)
+		}
+	}
+	if n, err := b.QueueLength("billing"); err != nil || n != 3 {
+		t.Fatalf("expected 3 queued messages, got %d (%v)", n, err)
+	}
+
+	msgs := receiveN(t, ctx, b.Client(t, "billing"), 3)
+	for i, msg := range msgs {
+		if want := fmt.Sprintf("m%d", i); string(msg.Data) != want {
+			t.Fatalf("message %d: expected %q, got %q", i, want, msg.Data)
+		}
+		if msg.From != "orders" || msg.To != "billing" || msg.Type != pb.Type_TEXT {
+			t.Fatalf("message %d: unexpected envelope %v", i, msg)
+		}
+		if msg.Id == "" || msg.Attempts != 1 {
+			t.Fatalf("message %d: expected an id and one attempt, got %q/%d", i, msg.Id, msg.Attempts)
+		}
+	}
+	if n, _ := b.QueueLength("billing"); n != 0 {
+		t.Fatalf("delivered messages are still queued: %d", n)
+	}
+}
+
+func TestServerQueueIsolation(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t)
+	ctx := testContext(t)
+	orders := b.Client(t, "orders")
+
+	for _, to := range []string{"billing", "billing-eu", "shipping"} {
+		if _, err := orders.Send(ctx, to, []byte(to), pb.Type_TEXT, true); err != nil {
+			t.Fatalf("Send to %s failed: %v", to, err)
+		}
+	}
+	msgs := receiveN(t, ctx, b.Client(t, "billing"), 1)
+	if string(msgs[0].Data) != "billing" {
+		t.Fatalf("billing received %q", msgs[0].Data)
+	}
+	queues, err := b.Queues()
+	if err != nil {
+		t.Fatalf("Queues failed: %v", err)
+	}
+	if queues["billing-eu"] != 1 || queues["shipping"] != 1 || queues["billing"] != 0 {
+		t.Fatalf("unexpected queues after delivery: %v", queues)
+	}
+}
+
+func TestServerCleanup(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t)
+	ctx := testContext(t)
+	orders := b.Client(t, "orders")
+
+	for _, to := range []string{"billing", "billing", "shipping"} {
+		if _, err := orders.Send(ctx, to, []byte("x"), pb.Type_TEXT, true); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	st, err := b.Client(t, "billing").Cleanup(ctx)
+	if err != nil || !st.Success {
+		t.Fatalf("Cleanup failed: %v %v", st, err)
+	}
+	if n, _ := b.QueueLength("billing"); n != 0 {
+		t.Fatalf("Cleanup left %d messages", n)
+	}
+	if n, _ := b.QueueLength("shipping"); n != 1 {
+		t.Fatalf("Cleanup removed another service's messages, shipping has %d", n)
+	}
+}
+
+func TestServerExpiry(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.NewWithOptions(t, broker.Options{TickSeconds: 3600, MaxAge: 200 * time.Millisecond})
+	ctx := testContext(t)
+
+	if _, err := b.Client(t, "orders").Send(ctx, "billing", []byte("stale"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	recvCtx, cancel := context.WithTimeout(ctx, 1500*time.Millisecond)
+	defer cancel()
+	stream, err := b.Client(t, "billing").Receive(recvCtx)
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	if msg, err := stream.Recv(); err == nil {
+		t.Fatalf("expired message was delivered: %v", msg)
+	}
+	if n, _ := b.QueueLength("billing"); n != 0 {
+		t.Fatalf("expired message is still queued")
+	}
+}
+
+func TestServerExpiryNotification(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.NewWithOptions(t, broker.Options{TickSeconds: 3600, MaxAge: time.Second,
+		ServerOptions: []lib.ServerOption{lib.WithExpiryNotifications(true)}})
+	ctx := testContext(t)
+	orders := b.Client(t, "orders")
+
+	if _, err := orders.Send(ctx, "billing", []byte("stale"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	// The scan of billing's queue expires the message
+	recvCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	stream, err := b.Client(t, "billing").Receive(recvCtx)
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	if msg, err := stream.Recv(); err == nil {
+		t.Fatalf("expired message was delivered: %v", msg)
+	}
+
+	// The sender gets it back as an EXPIRED event, which is not expired itself
+	notices, err := orders.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	notice := recvMessage(t, notices)
+	if notice.Event != pb.Event_EXPIRED || notice.From != "billing" || notice.To != "orders" || string(notice.Data) != "stale" {
+		t.Fatalf("unexpected expiry notice %v", notice)
+	}
+	if n := b.Server().Metrics().Counter("broker_expiry_notifications_total"); n != 1 {
+		t.Fatalf("expected 1 expiry notification, got %d", n)
+	}
+}
+
+func TestServerAPIKeyAuth(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.NewWithOptions(t, broker.Options{Auth: &lib.AuthConfig{EnableAuth: true, AuthMethod: lib.AuthMethodAPIKey}})
+	ctx := testContext(t)
+
+	orders := b.Client(t, "orders")
+	if _, err := orders.Send(ctx, "billing", []byte("x"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("authenticated Send failed: %v", err)
+	}
+
+	anonymous, err := client.NewAuthenticatedClientWithOptions("passthrough:///bufconn", "intruder", "apikey", b.DialOptions()...)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer anonymous.Close()
+	if _, err := anonymous.Ping(ctx); err != nil {
+		t.Fatalf("Ping should not require authentication: %v", err)
+	}
+	_, err = anonymous.Send(ctx, "billing", []byte("x"), pb.Type_TEXT, true)
+	assertCode(t, err, codes.Unauthenticated)
+
+	anonymous.SetAPIKey("not-a-key")
+	_, err = anonymous.Cleanup(ctx)
+	assertCode(t, err, codes.Unauthenticated)
+	stream, err := anonymous.Receive(ctx)
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	assertCode(t, err, codes.Unauthenticated)
+
+	if n, _ := b.QueueLength("billing"); n != 1 {
+		t.Fatalf("expected only the authenticated message to be queued, got %d", n)
+	}
+}
+
+func TestServerJWTAuth(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.NewWithOptions(t, broker.Options{Auth: &lib.AuthConfig{EnableAuth: true, AuthMethod: lib.AuthMethodJWT}})
+	ctx := testContext(t)
+	token, err := b.AuthManager().GenerateJWT("orders")
+	if err != nil {
+		t.Fatalf("GenerateJWT failed: %v", err)
+	}
+
+	c, err := client.NewAuthenticatedClientWithOptions("passthrough:///bufconn", "orders", "jwt", b.DialOptions()...)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	_, err = c.Send(ctx, "billing", []byte("x"), pb.Type_TEXT, true)
+	assertCode(t, err, codes.Unauthenticated)
+
+	c.SetJWTToken(token + "tampered")
+	_, err = c.Send(ctx, "billing", []byte("x"), pb.Type_TEXT, true)
+	assertCode(t, err, codes.Unauthenticated)
+
+	c.SetJWTToken(token)
+	if _, err := c.Send(ctx, "billing", []byte("x"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send with a valid token failed: %v", err)
+	}
+}
+
+func TestServerOIDCAuth(t *testing.T) {
+	quietLogs(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "idp-1", "use": "sig", "alg": "RS256",
+			"n": encode(key.N.Bytes()), "e": encode(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	defer jwks.Close()
+	oidc := &lib.OIDCConfig{Issuer: "https://idp.example.com/realms/prod", JWKSURL: jwks.URL, Audience: "broker", ServiceClaim: "azp"}
+	b := brokertest.NewWithOptions(t, broker.Options{Auth: &lib.AuthConfig{EnableAuth: true, AuthMethod: lib.AuthMethodJWT, OIDC: oidc}})
+	ctx := testContext(t)
+
+	issue := func(audience string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss": oidc.Issuer, "aud": audience, "azp": "orders", "sub": "a1b2c3",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+		token.Header["kid"] = "idp-1"
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	c, err := client.NewAuthenticatedClientWithOptions("passthrough:///bufconn", "orders", "jwt", b.DialOptions()...)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+
+	c.SetJWTToken(issue("another-app"))
+	_, err = c.Send(ctx, "billing", []byte("x"), pb.Type_TEXT, true)
+	assertCode(t, err, codes.Unauthenticated)
+
+	c.SetJWTToken(issue("broker"))
+	if _, err := c.Send(ctx, "billing", []byte("x"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send with an identity provider token failed: %v", err)
+	}
+
+	// Tokens the broker signs itself keep working
+	own, err := b.AuthManager().GenerateJWT("orders")
+	if err != nil {
+		t.Fatalf("GenerateJWT failed: %v", err)
+	}
+	c.SetJWTToken(own)
+	if _, err := c.Send(ctx, "billing", []byte("x"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send with a broker token failed: %v", err)
+	}
+}
+
+func TestServerAuthLockout(t *testing.T) {
+	quietLogs(t)
+	throttle := lib.AuthThrottleConfig{MaxFailures: 3, Lockout: time.Hour, Delay: time.Millisecond}
+	b := brokertest.NewWithOptions(t, broker.Options{Auth: &lib.AuthConfig{
+		EnableAuth: true, AuthMethod: lib.AuthMethodAPIKey, Throttle: throttle,
+		Policy: lib.AuthPolicy{AdminServices: []string{"ops"}},
+	}})
+	ctx := testContext(t)
+
+	events, err := b.Client(t, "ops").WatchEvents(ctx, nil,
+		pb.BrokerEventType_BROKER_EVENT_TYPE_AUTH_FAILED, pb.BrokerEventType_BROKER_EVENT_TYPE_AUTH_LOCKED_OUT)
+	if err != nil {
+		t.Fatalf("WatchEvents failed: %v", err)
+	}
+	if _, err := events.Header(); err != nil {
+		t.Fatalf("WatchEvents failed: %v", err)
+	}
+
+	c, err := client.NewAuthenticatedClientWithOptions("passthrough:///bufconn", "orders", "apikey", b.DialOptions()...)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	for i := 0; i < throttle.MaxFailures; i++ {
+		c.SetAPIKey(fmt.Sprintf("guess-%d", i))
+		_, err := c.Send(ctx, "billing", []byte("x"), pb.Type_TEXT, true)
+		assertCode(t, err, codes.Unauthenticated)
+	}
+
+	// Once locked out, even a valid key is refused from the same address
+	c.SetAPIKey(b.AuthManager().GenerateAPIKey("orders"))
+	_, err = c.Send(ctx, "billing", []byte("x"), pb.Type_TEXT, true)
+	assertCode(t, err, codes.Unauthenticated)
+	if !strings.Contains(err.Error(), "too many failed attempts") {
+		t.Fatalf("expected a lockout, got %v", err)
+	}
+
+	metrics := b.Server().Metrics()
+	if n := metrics.Counter("broker_auth_failures_total", "reason", "invalid"); n != int64(throttle.MaxFailures) {
+		t.Fatalf("expected %d failures, got %d", throttle.MaxFailures, n)
+	}
+	if n := metrics.Counter("broker_auth_lockouts_total"); n != 1 {
+		t.Fatalf("expected one lockout, got %d", n)
+	}
+	var got []pb.BrokerEventType
+	for len(got) < throttle.MaxFailures+1 {
+		ev, err := events.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		got = append(got, ev.Type)
+	}
+	if got[len(got)-1] != pb.BrokerEventType_BROKER_EVENT_TYPE_AUTH_LOCKED_OUT {
+		t.Fatalf("expected the failures to end in a lockout, got %v", got)
+	}
+}
+
+func TestServerCredentialNetworks(t *testing.T) {
+	quietLogs(t)
+	auth := &lib.AuthConfig{
+		EnableAuth: true,
+		AuthMethod: lib.AuthMethodAPIKey,
+		APIKeys:    map[string]string{"office-key": "orders", "vpn-key": "orders", "reports-key": "reports"},
+		KeyNetworks: map[string]*lib.NetworkPolicy{
+			"office-key": {Allow: []string{"127.0.0.0/8"}},
+			"vpn-key":    {Allow: []string{"10.8.0.0/16"}},
+		},
+		ServiceNetworks: map[string]*lib.NetworkPolicy{
+			"reports": {Allow: []string{"0.0.0.0/0"}, Deny: []string{"127.0.0.1"}},
+		},
+	}
+	// Addresses are only known on a real network listener
+	b := broker.New(broker.Options{DBPath: t.TempDir(), Address: "127.0.0.1:0", Auth: auth})
+	if err := b.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start broker: %v", err)
+	}
+	defer b.Stop()
+	ctx := testContext(t)
+
+	send := func(service, key string) error {
+		c, err := client.NewAuthenticatedClient(b.Addr().String(), service, "apikey", false, "")
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		defer c.Close()
+		c.SetAPIKey(key)
+		_, err = c.Send(ctx, "billing", []byte("x"), pb.Type_TEXT, true)
+		return err
+	}
+	if err := send("orders", "office-key"); err != nil {
+		t.Fatalf("Send from an allowed network failed: %v", err)
+	}
+	assertCode(t, send("orders", "vpn-key"), codes.PermissionDenied)
+	assertCode(t, send("reports", "reports-key"), codes.PermissionDenied)
+	if n := b.Server().Metrics().Counter("broker_auth_failures_total", "reason", "network"); n != 2 {
+		t.Fatalf("expected 2 network rejections, got %d", n)
+	}
+}
+
+func TestServerHMACAuth(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.NewWithOptions(t, broker.Options{Auth: &lib.AuthConfig{EnableAuth: true, AuthMethod: lib.AuthMethodHMAC}})
+	ctx := testContext(t)
+	key := b.AuthManager().GenerateAPIKey("orders")
+
+	c, err := client.NewAuthenticatedClientWithOptions("passthrough:///bufconn", "orders", "hmac", b.DialOptions()...)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer c.Close()
+	c.SetAPIKey(key)
+	if _, err := c.Send(ctx, "orders", []byte("signed"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("signed Send failed: %v", err)
+	}
+	receiveCtx, stop := context.WithCancel(ctx)
+	receiveN(t, receiveCtx, c, 1)
+	stop()
+
+	c.SetAPIKey("not-a-key")
+	_, err = c.Send(ctx, "orders", []byte("x"), pb.Type_TEXT, true)
+	assertCode(t, err, codes.Unauthenticated)
+
+	// A captured signature is refused for another body and when replayed
+	conn, err := grpc.NewClient("passthrough:///bufconn", b.DialOptions()...)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	raw := pb.NewBrokerClient(conn)
+	msg := &pb.Message{From: "orders", To: "orders", Data: []byte("once"), Queue: true}
+	body, err := protocol.SignedBody(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	timestamp := time.Now().Unix()
+	signed := metadata.NewOutgoingContext(ctx, metadata.Pairs(
+		protocol.SignatureKeyIDHeader, lib.KeyID(key),
+		protocol.SignatureTimestampHeader, fmt.Sprint(timestamp),
+		protocol.SignatureNonceHeader, "n1",
+		protocol.SignatureHeader, protocol.Sign(key, "/base.proto.Broker/Send", timestamp, "n1", body),
+	))
+	_, err = raw.Send(signed, &pb.Message{From: "orders", To: "orders", Data: []byte("tampered"), Queue: true})
+	assertCode(t, err, codes.Unauthenticated)
+	if _, err := raw.Send(signed, msg); err != nil {
+		t.Fatalf("Send with a valid signature failed: %v", err)
+	}
+	_, err = raw.Send(signed, msg)
+	assertCode(t, err, codes.Unauthenticated)
+	if !strings.Contains(err.Error(), "replayed") {
+		t.Fatalf("expected a replay to be refused, got %v", err)
+	}
+}
+
+func TestServerReceiveUsesAuthenticatedIdentity(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.NewWithOptions(t, broker.Options{Auth: &lib.AuthConfig{EnableAuth: true, AuthMethod: lib.AuthMethodAPIKey}})
+	ctx := testContext(t)
+	if _, err := b.Client(t, "orders").Send(ctx, "billing", []byte("invoice"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	// A client claiming to be billing with the credentials of orders
+	impostor, err := client.NewAuthenticatedClientWithOptions("passthrough:///bufconn", "billing", "apikey", b.DialOptions()...)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer impostor.Close()
+	impostor.SetAPIKey(b.AuthManager().GenerateAPIKey("orders"))
+	stream, err := impostor.Receive(ctx)
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	assertCode(t, err, codes.PermissionDenied)
+	_, err = impostor.Fetch(ctx, 10, time.Minute)
+	assertCode(t, err, codes.PermissionDenied)
+	if !errors.Is(err, client.ErrPermissionDenied) {
+		t.Fatalf("expected ErrPermissionDenied, got %v", err)
+	}
+
+	// Without a name, the stream receives for the service of the credentials
+	conn, err := grpc.NewClient("passthrough:///bufconn", b.DialOptions()...)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	billingKey := b.AuthManager().GenerateAPIKey("billing")
+	receiveCtx, stop := context.WithCancel(metadata.AppendToOutgoingContext(ctx, "x-api-key", billingKey))
+	defer stop()
+	raw, err := pb.NewBrokerClient(conn).Receive(receiveCtx, &pb.Identity{})
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	msg, err := raw.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if string(msg.Data) != "invoice" || msg.To != "billing" {
+		t.Fatalf("expected billing's invoice, got %q to %s", msg.Data, msg.To)
+	}
+}
+
+func TestServerMethodPolicy(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.NewWithOptions(t, broker.Options{Auth: &lib.AuthConfig{
+		EnableAuth: true,
+		AuthMethod: lib.AuthMethodAPIKey,
+		Policy: lib.AuthPolicy{
+			Services:      map[string]*lib.MethodPolicy{"orders": {Deny: []string{"Cleanup"}}},
+			AdminServices: []string{"ops"},
+		},
+	}})
+	ctx := testContext(t)
+
+	orders := b.Client(t, "orders")
+	if _, err := orders.Send(ctx, "billing", []byte("invoice"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	_, err := orders.Cleanup(ctx)
+	assertCode(t, err, codes.PermissionDenied)
+	_, err = orders.PauseDelivery(ctx, "billing")
+	assertCode(t, err, codes.PermissionDenied)
+
+	if _, err := b.Client(t, "ops").PauseDelivery(ctx, "billing"); err != nil {
+		t.Fatalf("PauseDelivery by an admin service failed: %v", err)
+	}
+	if _, err := b.Client(t, "billing").Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup without a policy failed: %v", err)
+	}
+}
+
+func TestServerStreamRecheck(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.NewWithOptions(t, broker.Options{Auth: &lib.AuthConfig{
+		EnableAuth:            true,
+		AuthMethod:            lib.AuthMethodJWT,
+		StreamRecheckInterval: 20 * time.Millisecond,
+	}})
+	ctx := testContext(t)
+	token, err := b.AuthManager().GenerateJWT("billing")
+	if err != nil {
+		t.Fatalf("GenerateJWT failed: %v", err)
+	}
+	conn, err := grpc.NewClient("passthrough:///bufconn", b.DialOptions()...)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	stream, err := pb.NewBrokerClient(conn).Receive(metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token), &pb.Identity{})
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+
+	// The open stream ends once its token is revoked
+	id, expires, err := b.AuthManager().TokenClaims(token)
+	if err != nil {
+		t.Fatalf("TokenClaims failed: %v", err)
+	}
+	b.AuthManager().RevokeJWT(id, expires)
+	for {
+		if _, err = stream.Recv(); err != nil {
+			break
+		}
+	}
+	assertCode(t, err, codes.Unauthenticated)
+}
+
+func TestServerAPIKeyReload(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.NewWithOptions(t, broker.Options{Auth: &lib.AuthConfig{
+		EnableAuth:            true,
+		AuthMethod:            lib.AuthMethodAPIKey,
+		StreamRecheckInterval: 20 * time.Millisecond,
+	}})
+	ctx := testContext(t)
+	key := b.AuthManager().GenerateAPIKey("billing")
+	other := b.AuthManager().GenerateAPIKey("orders")
+
+	// The config file the running broker watches, as `auth` commands edit it
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := &lib.Config{Auth: lib.AuthConfig{
+		EnableAuth: true,
+		AuthMethod: lib.AuthMethodAPIKey,
+		APIKeys:    map[string]string{key: "billing", other: "orders"},
+	}}
+	if err := config.SaveConfig(path); err != nil {
+		t.Fatalf("SaveConfig failed: %v", err)
+	}
+	stop := b.AuthManager().WatchAPIKeys(path, 10*time.Millisecond, func() (*lib.AuthConfig, error) {
+		reloaded, err := lib.LoadConfig(path)
+		if err != nil {
+			return nil, err
+		}
+		return reloaded.Auth.ResolveSecrets(ctx)
+	})
+	defer stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufconn", b.DialOptions()...)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	stream, err := pb.NewBrokerClient(conn).Receive(metadata.AppendToOutgoingContext(ctx, "x-api-key", key), &pb.Identity{})
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	waitFor(t, "billing to connect", func() bool { return b.Server().Connected("billing") })
+
+	// The open stream ends once its key is removed from the file, and the key is refused
+	delete(config.Auth.APIKeys, key)
+	if err := config.SaveConfig(path); err != nil {
+		t.Fatalf("SaveConfig failed: %v", err)
+	}
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err = stream.Recv(); err != nil {
+			break
+		}
+	}
+	assertCode(t, err, codes.Unauthenticated)
+	if _, err := b.AuthManager().ValidateAPIKey(key); err == nil {
+		t.Fatal("expected the removed key to be refused")
+	}
+	if service, err := b.AuthManager().ValidateAPIKey(other); err != nil || service != "orders" {
+		t.Fatalf("expected the remaining key to stay valid, got %q (%v)", service, err)
+	}
+}
+
+func TestServerConcurrentSends(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t)
+	ctx := testContext(t)
+	const producers, perProducer = 8, 25
+
+	// Concurrent calls may be refused with "server busy", which clients retry
+	policy := client.DefaultRetryPolicy
+	policy.RetryNonIdempotent = true
+	policy.MaxAttempts = 20
+	policy.InitialBackoff = 5 * time.Millisecond
+	policy.MaxBackoff = 50 * time.Millisecond
+
+	var wg sync.WaitGroup
+	errs := make(chan error, producers)
+	for p := 0; p < producers; p++ {
+		c := b.Client(t, fmt.Sprintf("producer-%d", p))
+		c.SetRetryPolicy(policy)
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < perProducer; i++ {
+				if _, err := c.Send(ctx, "sink", []byte(fmt.Sprintf("%d/%d", p, i)), pb.Type_TEXT, true); err != nil {
+					errs <- fmt.Errorf("producer %d send %d: %w", p, i, err)
+					return
+				}
+			}
+		}(p)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	msgs := receiveN(t, ctx, b.Client(t, "sink"), producers*perProducer)
+	seen := make(map[string]bool, len(msgs))
+	for _, msg := range msgs {
+		if seen[string(msg.Data)] {
+			t.Fatalf("message %s delivered twice", msg.Data)
+		}
+		seen[string(msg.Data)] = true
+	}
+	if n, _ := b.QueueLength("sink"); n != 0 {
+		t.Fatalf("%d messages left after delivery", n)
+	}
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerLiveDelivery(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t)
+	ctx := testContext(t)
+
+	stream, err := b.Client(t, "billing").Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	waitFor(t, "billing to connect", func() bool { return b.Server().Connected("billing") })
+
+	st, err := b.Client(t, "orders").Send(ctx, "billing", []byte("live"), pb.Type_TEXT, false)
+	if err != nil || st.Message != "Message sent" {
+		t.Fatalf("live Send failed: %v %v", st, err)
+	}
+	msg, err := stream.Recv()
+	if err != nil || string(msg.Data) != "live" {
+		t.Fatalf("expected the live message, got %v (%v)", msg, err)
+	}
+}
+
+// recvKeepalive reads from a raw stream until the broker probes it, which proves the stream is registered
+func recvKeepalive(t *testing.T, stream pb.Broker_ReceiveClient) {
+	t.Helper()
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if msg.Event == pb.Event_KEEPALIVE {
+			return
+		}
+	}
+}
+
+// rawClient connects a generated client, which unlike client.AuthenticatedClient shows keepalives
+func rawClient(t *testing.T, b *brokertest.Broker) pb.BrokerClient {
+	t.Helper()
+	conn, err := grpc.NewClient("passthrough:///bufconn", b.DialOptions()...)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewBrokerClient(conn)
+}
+
+func TestServerReconnectReplacesStaleStream(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t, lib.WithKeepalive(20*time.Millisecond, time.Second))
+	ctx := testContext(t)
+	raw := rawClient(t, b)
+
+	staleCtx, cancelStale := context.WithCancel(ctx)
+	stale, err := raw.Receive(staleCtx, &pb.Identity{From: "billing"})
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	recvKeepalive(t, stale)
+
+	fresh, err := raw.Receive(ctx, &pb.Identity{From: "billing"})
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	recvKeepalive(t, fresh)
+
+	// The replaced stream is ended, and its going away must not unregister its replacement
+	for {
+		if _, err = stale.Recv(); err != nil {
+			break
+		}
+	}
+	assertCode(t, err, codes.Aborted)
+	cancelStale()
+	time.Sleep(200 * time.Millisecond)
+	if !b.Server().Connected("billing") {
+		t.Fatalf("closing the stale stream unregistered the new one")
+	}
+	if _, err := b.Client(t, "orders").Send(ctx, "billing", []byte("after reconnect"), pb.Type_TEXT, false); err != nil {
+		t.Fatalf("live Send after reconnect failed: %v", err)
+	}
+	if msg := recvMessage(t, fresh); string(msg.Data) != "after reconnect" {
+		t.Fatalf("unexpected message %q", msg.Data)
+	}
+}
+
+// halfOpenStream is a Receive stream whose connection is gone without its context
+// being cancelled: every Send blocks until the test ends
+type halfOpenStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	blocked chan struct{}
+}
+
+func (s *halfOpenStream) Context() context.Context { return s.ctx }
+
+func (s *halfOpenStream) Send(*pb.Message) error {
+	<-s.blocked
+	return io.ErrClosedPipe
+}
+
+func TestServerReapsHalfOpenStream(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t, lib.WithKeepalive(20*time.Millisecond, 50*time.Millisecond))
+	ctx := testContext(t)
+	stream := &halfOpenStream{ctx: ctx, blocked: make(chan struct{})}
+	defer close(stream.blocked)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- b.Server().Receive(&pb.Identity{From: "billing"}, stream)
+	}()
+	select {
+	case err := <-result:
+		assertCode(t, err, codes.Unavailable)
+	case <-ctx.Done():
+		t.Fatalf("half-open stream was never reaped")
+	}
+	if b.Server().Connected("billing") {
+		t.Fatalf("reaped stream is still registered")
+	}
+	if n := b.Server().Metrics().Counter("broker_receivers_reaped_total"); n != 1 {
+		t.Fatalf("expected one reaped stream, got %d", n)
+	}
+	_, err := b.Client(t, "orders").Send(ctx, "billing", []byte("x"), pb.Type_TEXT, false)
+	assertCode(t, err, codes.NotFound)
+}
+
+func TestServerHeartbeat(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t, lib.WithHeartbeat(50*time.Millisecond))
+	ctx := testContext(t)
+	raw, err := rawClient(t, b).Receive(ctx, &pb.Identity{From: "billing"})
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	msg, err := raw.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if msg.Event != pb.Event_STREAM || msg.From != "broker" || msg.Id != "" || len(msg.Data) != 0 {
+		t.Fatalf("expected a heartbeat on the idle stream, got %v", msg)
+	}
+
+	// Heartbeats keep an idle stream alive and are not handed to the consumer
+	reports := b.Client(t, "reports")
+	reports.SetHeartbeatTimeout(200 * time.Millisecond)
+	stream, err := reports.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	waitFor(t, "reports to connect", func() bool { return b.Server().Connected("reports") })
+	received := make(chan *pb.Message, 1)
+	go func() {
+		msg, err := stream.Recv()
+		if err != nil {
+			t.Errorf("Recv on the idle stream failed: %v", err)
+		}
+		received <- msg
+	}()
+	time.Sleep(500 * time.Millisecond)
+	if _, err := b.Client(t, "orders").Send(ctx, "reports", []byte("after idle"), pb.Type_TEXT, false); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if msg := <-received; msg == nil || string(msg.Data) != "after idle" {
+		t.Fatalf("expected the message after the idle period, got %v", msg)
+	}
+	if n := b.Server().Metrics().Counter("broker_heartbeats_sent_total"); n == 0 {
+		t.Fatalf("no heartbeats were counted")
+	}
+
+	// Without heartbeats the client gives up on the silent stream
+	silent := brokertest.New(t).Client(t, "reports")
+	silent.SetHeartbeatTimeout(100 * time.Millisecond)
+	stream, err = silent.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	_, err = stream.Recv()
+	if !errors.Is(err, client.ErrHeartbeatMissed) {
+		t.Fatalf("expected ErrHeartbeatMissed, got %v", err)
+	}
+	assertCode(t, err, codes.Unavailable)
+}
+
+func TestServerDuplicateReject(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t,
+		lib.WithKeepalive(20*time.Millisecond, time.Second),
+		lib.WithServices(map[string]lib.ServiceConfig{"billing": {DuplicateConnections: string(lib.DuplicateReject)}}))
+	ctx := testContext(t)
+	raw := rawClient(t, b)
+
+	first, err := raw.Receive(ctx, &pb.Identity{From: "billing"})
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	recvKeepalive(t, first)
+
+	second, err := raw.Receive(ctx, &pb.Identity{From: "billing"})
+	if err == nil {
+		_, err = second.Recv()
+	}
+	assertCode(t, err, codes.AlreadyExists)
+
+	// The first stream keeps working
+	if _, err := b.Client(t, "orders").Send(ctx, "billing", []byte("still here"), pb.Type_TEXT, false); err != nil {
+		t.Fatalf("live Send failed: %v", err)
+	}
+	if msg := recvMessage(t, first); string(msg.Data) != "still here" {
+		t.Fatalf("unexpected message %q", msg.Data)
+	}
+}
+
+func TestServerDuplicateFanOut(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t,
+		lib.WithKeepalive(20*time.Millisecond, time.Second),
+		lib.WithDuplicatePolicy(lib.DuplicateFanOut))
+	ctx := testContext(t)
+	raw := rawClient(t, b)
+
+	streams := make([]pb.Broker_ReceiveClient, 2)
+	for i := range streams {
+		stream, err := raw.Receive(ctx, &pb.Identity{From: "billing"})
+		if err != nil {
+			t.Fatalf("Receive failed: %v", err)
+		}
+		recvKeepalive(t, stream)
+		streams[i] = stream
+	}
+	if _, err := b.Client(t, "orders").Send(ctx, "billing", []byte("to all"), pb.Type_TEXT, false); err != nil {
+		t.Fatalf("live Send failed: %v", err)
+	}
+	for i, stream := range streams {
+		if msg := recvMessage(t, stream); string(msg.Data) != "to all" {
+			t.Fatalf("stream %d: unexpected message %q", i, msg.Data)
+		}
+	}
+}
+
+// recvMessage returns the next message of a raw stream that is not a keepalive
+func recvMessage(t *testing.T, stream pb.Broker_ReceiveClient) *pb.Message {
+	t.Helper()
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if msg.Event != pb.Event_KEEPALIVE {
+			return msg
+		}
+	}
+}
+
+func TestServerDirectedReplies(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t, lib.WithKeepalive(20*time.Millisecond, time.Second))
+	ctx := testContext(t)
+	raw := rawClient(t, b)
+
+	instances := make(map[string]pb.Broker_ReceiveClient)
+	for _, instance := range []string{"a", "b"} {
+		stream, err := raw.Receive(ctx, &pb.Identity{From: "billing", Instance: instance})
+		if err != nil {
+			t.Fatalf("Receive failed: %v", err)
+		}
+		recvKeepalive(t, stream)
+		instances[instance] = stream
+	}
+
+	orders := b.Client(t, "orders")
+	orders.SetInstance("o1")
+	for _, instance := range []string{"b", "a"} {
+		if _, err := orders.Send(ctx, "billing@"+instance, []byte("for "+instance), pb.Type_TEXT, false); err != nil {
+			t.Fatalf("directed Send failed: %v", err)
+		}
+	}
+	var request *pb.Message
+	for _, instance := range []string{"a", "b"} {
+		msg := recvMessage(t, instances[instance])
+		if string(msg.Data) != "for "+instance {
+			t.Fatalf("instance %s received %q", instance, msg.Data)
+		}
+		if msg.From != "orders@o1" {
+			t.Fatalf("expected the sender's instance address, got %q", msg.From)
+		}
+		request = msg
+	}
+
+	// The requester is offline, so the reply waits in its instance's queue
+	reply := b.Client(t, "billing")
+	if _, err := reply.Send(ctx, request.From, []byte("reply"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("reply failed: %v", err)
+	}
+	other := b.Client(t, "orders")
+	other.SetInstance("o2")
+	if _, err := other.Send(ctx, "orders", []byte("shared"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	msgs := receiveN(t, ctx, orders, 2)
+	if string(msgs[0].Data) != "reply" || string(msgs[1].Data) != "shared" {
+		t.Fatalf("expected the directed reply, then the shared queue, got %q and %q", msgs[0].Data, msgs[1].Data)
+	}
+}
+
+func TestServerTraceIDs(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t)
+	ctx := testContext(t)
+	orders := b.Client(t, "orders")
+
+	assigned, err := orders.Send(ctx, "billing", []byte("a"), pb.Type_TEXT, true)
+	if err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if len(assigned.TraceId) != 32 {
+		t.Fatalf("expected a broker-assigned trace id, got %q", assigned.TraceId)
+	}
+	chosen, err := orders.Send(client.WithTraceID(ctx, "req-42"), "billing", []byte("b"), pb.Type_TEXT, true)
+	if err != nil || chosen.TraceId != "req-42" {
+		t.Fatalf("expected the caller's trace id, got %v (%v)", chosen, err)
+	}
+	failed, err := orders.Send(ctx, "offline", []byte("c"), pb.Type_TEXT, false)
+	if err == nil || failed == nil || failed.TraceId == "" {
+		t.Fatalf("expected a failed Status with a trace id, got %v (%v)", failed, err)
+	}
+
+	msgs := receiveN(t, ctx, b.Client(t, "billing"), 2)
+	if msgs[0].TraceId != assigned.TraceId || msgs[1].TraceId != "req-42" {
+		t.Fatalf("delivered trace ids %q, %q do not match the Status", msgs[0].TraceId, msgs[1].TraceId)
+	}
+}
+
+func TestServerDirectedAck(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t)
+	ctx := testContext(t)
+
+	if _, err := b.Client(t, "orders").Send(ctx, "billing@a", []byte("directed"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	billing := b.Client(t, "billing")
+	billing.SetInstance("a")
+	stream, err := billing.ReceiveWithAck(ctx)
+	if err != nil {
+		t.Fatalf("ReceiveWithAck failed: %v", err)
+	}
+	msg, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if _, err := billing.Nack(ctx, msg.Id, 0); err != nil {
+		t.Fatalf("Nack of a directed message failed: %v", err)
+	}
+	if n, _ := b.QueueLength("billing@a"); n != 1 {
+		t.Fatalf("nacked message left its instance queue")
+	}
+	if msg, err = stream.Recv(); err != nil {
+		t.Fatalf("Recv after Nack failed: %v", err)
+	}
+	if _, err := billing.Ack(ctx, msg.Id); err != nil {
+		t.Fatalf("Ack of a directed message failed: %v", err)
+	}
+	if n, _ := b.QueueLength("billing@a"); n != 0 {
+		t.Fatalf("acknowledged message is still queued")
+	}
+}
+
+func TestServerNackDeadLetters(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t, lib.WithAcks(time.Minute, 2))
+	ctx := testContext(t)
+	orders := b.Client(t, "orders")
+	for _, data := range []string{"poison", "slow"} {
+		if _, err := orders.Send(ctx, "billing", []byte(data), pb.Type_TEXT, true); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	billing := b.Client(t, "billing")
+	stream, err := billing.ReceiveWithAck(ctx)
+	if err != nil {
+		t.Fatalf("ReceiveWithAck failed: %v", err)
+	}
+
+	// The first rejection requeues the message behind the rest of the queue
+	msg := recvMessage(t, stream)
+	if string(msg.Data) != "poison" || msg.Attempts != 1 {
+		t.Fatalf("expected the first message on its first attempt, got %v", msg)
+	}
+	if st, err := billing.Nack(ctx, msg.Id, 0); err != nil || !strings.Contains(st.Message, "requeued") {
+		t.Fatalf("expected the message to be requeued, got %v, %v", st, err)
+	}
+
+	// Requeue delays are capped like visibility extensions
+	msg = recvMessage(t, stream)
+	if string(msg.Data) != "slow" {
+		t.Fatalf("expected the second message, got %v", msg)
+	}
+	_, err = billing.Nack(ctx, msg.Id, lib.MaxVisibilityExtension+time.Second)
+	assertCode(t, err, codes.InvalidArgument)
+	st, err := billing.Nack(ctx, msg.Id, lib.MaxVisibilityExtension)
+	if err != nil || !strings.Contains(st.Message, "visible in 12h0m0s") {
+		t.Fatalf("expected a requeue at the cap, got %v, %v", st, err)
+	}
+
+	// Rejecting the message on its last attempt dead-letters it
+	msg = recvMessage(t, stream)
+	if string(msg.Data) != "poison" || msg.Attempts != 2 {
+		t.Fatalf("expected the first message on its second attempt, got %v", msg)
+	}
+	st, err = billing.Nack(ctx, msg.Id, 0)
+	if err != nil || st.Message != "Message dead-lettered to "+lib.DeadLetterQueue("billing") {
+		t.Fatalf("expected the message to be dead-lettered, got %v, %v", st, err)
+	}
+	if n, _ := b.QueueLength(lib.DeadLetterQueue("billing")); n != 1 {
+		t.Fatalf("expected 1 dead-lettered message, got %d", n)
+	}
+	if n, _ := b.QueueLength("billing"); n != 1 {
+		t.Fatalf("expected only the delayed message to stay queued, %d are", n)
+	}
+}
+
+func TestServerFetch(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t)
+	ctx := testContext(t)
+	orders := b.Client(t, "orders")
+	for _, data := range []string{"first", "second", "third"} {
+		if _, err := orders.Send(ctx, "billing", []byte(data), pb.Type_TEXT, true); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+
+	billing := b.Client(t, "billing")
+	batch, err := billing.Fetch(ctx, 2, 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if len(batch) != 2 || string(batch[0].Data) != "first" || string(batch[1].Data) != "second" {
+		t.Fatalf("expected the first two messages, got %v", batch)
+	}
+	// Fetched messages are invisible until their visibility timeout lapses
+	rest, err := billing.Fetch(ctx, 10, time.Minute)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if len(rest) != 1 || string(rest[0].Data) != "third" {
+		t.Fatalf("expected only the unfetched message, got %v", rest)
+	}
+	if _, err := billing.Ack(ctx, batch[0].Id); err != nil {
+		t.Fatalf("Ack of a fetched message failed: %v", err)
+	}
+
+	// The unacked message comes back once its visibility timeout lapses
+	var redelivered []*pb.Message
+	waitFor(t, "the unacked message to be redelivered", func() bool {
+		redelivered, err = billing.Fetch(ctx, 10, time.Minute)
+		return err == nil && len(redelivered) > 0
+	})
+	if len(redelivered) != 1 || string(redelivered[0].Data) != "second" || redelivered[0].Attempts != 2 {
+		t.Fatalf("expected the second message on its second attempt, got %v", redelivered)
+	}
+	if n, _ := b.QueueLength("billing"); n != 2 {
+		t.Fatalf("expected the two unacked messages to stay queued, %d are", n)
+	}
+
+	_, err = rawClient(t, b).Fetch(ctx, &pb.FetchRequest{From: "billing", MaxMessages: lib.MaxFetchMessages + 1})
+	assertCode(t, err, codes.InvalidArgument)
+}
+
+func TestServerFetchLongPoll(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t)
+	ctx := testContext(t)
+	billing := b.Client(t, "billing")
+
+	// An empty fetch is held until a message is queued
+	type fetched struct {
+		msgs []*pb.Message
+		err  error
+	}
+	result := make(chan fetched, 1)
+	start := time.Now()
+	go func() {
+		msgs, err := billing.FetchWait(ctx, 10, time.Minute, 10*time.Second)
+		result <- fetched{msgs, err}
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if _, err := b.Client(t, "orders").Send(ctx, "billing", []byte("late"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	r := <-result
+	if r.err != nil {
+		t.Fatalf("FetchWait failed: %v", r.err)
+	}
+	if len(r.msgs) != 1 || string(r.msgs[0].Data) != "late" {
+		t.Fatalf("expected the queued message, got %v", r.msgs)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("long poll returned after %s instead of when the message arrived", elapsed)
+	}
+
+	// With nothing queued it answers empty once the wait is over
+	start = time.Now()
+	msgs, err := billing.FetchWait(ctx, 10, time.Minute, time.Second)
+	if err != nil || len(msgs) != 0 {
+		t.Fatalf("expected an empty batch, got %v, %v", msgs, err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Fatalf("empty long poll returned after %s", elapsed)
+	}
+
+	_, err = rawClient(t, b).Fetch(ctx, &pb.FetchRequest{From: "billing", WaitSeconds: 21})
+	assertCode(t, err, codes.InvalidArgument)
+}
+
+func TestServerExtendVisibility(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t)
+	ctx := testContext(t)
+	orders := b.Client(t, "orders")
+	if _, err := orders.Send(ctx, "billing", []byte("slow"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	billing := b.Client(t, "billing")
+	batch, err := billing.Fetch(ctx, 1, 300*time.Millisecond)
+	if err != nil || len(batch) != 1 {
+		t.Fatalf("Fetch failed: %v, %v", batch, err)
+	}
+	id, err := billing.ExtendVisibility(ctx, batch[0].Id, time.Minute)
+	if err != nil {
+		t.Fatalf("ExtendVisibility failed: %v", err)
+	}
+	if id == batch[0].Id {
+		t.Fatalf("expected a new id for the extended message")
+	}
+	// The original visibility timeout lapses without the message coming back
+	time.Sleep(500 * time.Millisecond)
+	if msgs, err := billing.Fetch(ctx, 10, time.Minute); err != nil || len(msgs) != 0 {
+		t.Fatalf("extended message was redelivered: %v, %v", msgs, err)
+	}
+	_, err = billing.Ack(ctx, batch[0].Id)
+	assertCode(t, err, codes.NotFound)
+	if _, err := billing.Ack(ctx, id); err != nil {
+		t.Fatalf("Ack by the new id failed: %v", err)
+	}
+	if n, _ := b.QueueLength("billing"); n != 0 {
+		t.Fatalf("acknowledged message is still queued")
+	}
+
+	// Once the visibility timeout lapsed the message is back in the queue for good
+	if _, err := orders.Send(ctx, "billing", []byte("lapsed"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if batch, err = billing.Fetch(ctx, 1, 50*time.Millisecond); err != nil || len(batch) != 1 {
+		t.Fatalf("Fetch failed: %v, %v", batch, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	_, err = billing.ExtendVisibility(ctx, batch[0].Id, time.Minute)
+	assertCode(t, err, codes.FailedPrecondition)
+
+	_, err = billing.ExtendVisibility(ctx, batch[0].Id, 0)
+	assertCode(t, err, codes.InvalidArgument)
+}
+
+func TestServerPartitionKeys(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t)
+	ctx := testContext(t)
+	orders := b.Client(t, "orders")
+	send := func(to, key, data string) {
+		t.Helper()
+		if _, err := orders.SendPartitioned(ctx, to, key, []byte(data), pb.Type_TEXT, true); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+
+	// The next message of a partition waits until the one in flight is acked
+	send("billing", "alice", "alice-1")
+	send("billing", "alice", "alice-2")
+	send("billing", "bob", "bob-1")
+	billing := b.Client(t, "billing")
+	batch, err := billing.Fetch(ctx, 10, time.Minute)
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if len(batch) != 2 || string(batch[0].Data) != "alice-1" || string(batch[1].Data) != "bob-1" {
+		t.Fatalf("expected the head of each partition, got %v", batch)
+	}
+	if msgs, err := billing.Fetch(ctx, 10, time.Minute); err != nil || len(msgs) != 0 {
+		t.Fatalf("expected alice-2 to wait for alice-1, got %v, %v", msgs, err)
+	}
+	// A nacked message stays ahead of the rest of its partition
+	if _, err := billing.Nack(ctx, batch[0].Id, 0); err != nil {
+		t.Fatalf("Nack failed: %v", err)
+	}
+	next, err := billing.Fetch(ctx, 10, time.Minute)
+	if err != nil || len(next) != 1 || string(next[0].Data) != "alice-1" {
+		t.Fatalf("expected alice-1 again, got %v, %v", next, err)
+	}
+	if _, err := billing.Ack(ctx, next[0].Id); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+	next, err = billing.Fetch(ctx, 10, time.Minute)
+	if err != nil || len(next) != 1 || string(next[0].Data) != "alice-2" {
+		t.Fatalf("expected alice-2 after alice-1 was acked, got %v, %v", next, err)
+	}
+
+	// Each partition goes to a single instance, in order
+	received := make(chan *pb.Message, 64)
+	instances := make(map[string]string) // data -> instance
+	var mu sync.Mutex
+	for _, instance := range []string{"a", "b", "c"} {
+		c := b.Client(t, "reports")
+		c.SetInstance(instance)
+		stream, err := c.Receive(ctx)
+		if err != nil {
+			t.Fatalf("Receive failed: %v", err)
+		}
+		go func() {
+			for {
+				msg, err := stream.Recv()
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				instances[string(msg.Data)] = instance
+				mu.Unlock()
+				received <- msg
+			}
+		}()
+	}
+	for _, instance := range []string{"a", "b", "c"} {
+		waitFor(t, "the instances to connect", func() bool {
+			_, err := orders.Send(ctx, "reports@"+instance, []byte("ready"), pb.Type_TEXT, false)
+			return err == nil
+		})
+		<-received
+	}
+	keys := []string{"k0", "k1", "k2", "k3", "k4", "k5"}
+	for i := range 4 {
+		for _, key := range keys {
+			send("reports", key, fmt.Sprintf("%s/%d", key, i))
+		}
+	}
+	expected := make(map[string]int)
+	for range 4 * len(keys) {
+		msg := <-received
+		var key string
+		var seq int
+		fmt.Sscanf(strings.Replace(string(msg.Data), "/", " ", 1), "%s %d", &key, &seq)
+		if seq != expected[key] {
+			t.Fatalf("partition %s delivered %d before %d", key, seq, expected[key])
+		}
+		expected[key]++
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, key := range keys {
+		owner := instances[key+"/0"]
+		for i := 1; i < 4; i++ {
+			if got := instances[fmt.Sprintf("%s/%d", key, i)]; got != owner {
+				t.Fatalf("partition %s went to instances %s and %s", key, owner, got)
+			}
+		}
+	}
+}
+
+func TestServerRoutingSlip(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t)
+	ctx := testContext(t)
+	if _, err := b.Client(t, "orders").SendRouted(ctx, []string{"validate", "charge", "ship"}, []byte("order-1"), pb.Type_TEXT); err != nil {
+		t.Fatalf("SendRouted failed: %v", err)
+	}
+
+	// Nothing moves on until the current step acks
+	validate := b.Client(t, "validate")
+	batch, err := validate.Fetch(ctx, 1, time.Minute)
+	if err != nil || len(batch) != 1 {
+		t.Fatalf("Fetch failed: %v, %v", batch, err)
+	}
+	if got := batch[0].RoutingSlip; len(got) != 2 || got[0] != "charge" || got[1] != "ship" {
+		t.Fatalf("unexpected routing slip %v", got)
+	}
+	if n, _ := b.QueueLength("charge"); n != 0 {
+		t.Fatalf("message moved on before it was acked")
+	}
+	if _, err := validate.Ack(ctx, batch[0].Id); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+
+	// Delivery to a plain Receive stream counts as the ack
+	charged := receiveN(t, ctx, b.Client(t, "charge"), 1)
+	if string(charged[0].Data) != "order-1" || charged[0].From != "validate" {
+		t.Fatalf("unexpected message at the second step: %v", charged[0])
+	}
+	var shipped []*pb.Message
+	waitFor(t, "the last step to get the message", func() bool {
+		shipped, err = b.Client(t, "ship").Fetch(ctx, 1, time.Minute)
+		return err == nil && len(shipped) == 1
+	})
+	if shipped[0].From != "charge" || len(shipped[0].RoutingSlip) != 0 || shipped[0].TraceId != batch[0].TraceId {
+		t.Fatalf("unexpected message at the last step: %v", shipped[0])
+	}
+
+	_, err = rawClient(t, b).Send(ctx, &pb.Message{Data: []byte("x"), From: "orders", To: "validate", RoutingSlip: []string{"charge"}})
+	assertCode(t, err, codes.InvalidArgument)
+}
+
+func TestServerWatchEvents(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t)
+	ctx := testContext(t)
+
+	events, err := b.Client(t, "ops").WatchEvents(ctx, []string{"billing"})
+	if err != nil {
+		t.Fatalf("WatchEvents failed: %v", err)
+	}
+	if _, err := events.Header(); err != nil {
+		t.Fatalf("WatchEvents failed: %v", err)
+	}
+	orders := b.Client(t, "orders")
+	if _, err := orders.Send(ctx, "billing", []byte("queued"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if _, err := orders.Send(ctx, "shipping", []byte("filtered"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	receiveCtx, stop := context.WithCancel(ctx)
+	receiveN(t, receiveCtx, b.Client(t, "billing"), 1)
+	stop()
+
+	want := []pb.BrokerEventType{
+		pb.BrokerEventType_BROKER_EVENT_TYPE_ENQUEUED,
+		pb.BrokerEventType_BROKER_EVENT_TYPE_CONNECTED,
+		pb.BrokerEventType_BROKER_EVENT_TYPE_DELIVERED,
+		pb.BrokerEventType_BROKER_EVENT_TYPE_DISCONNECTED,
+	}
+	for _, eventType := range want {
+		ev, err := events.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if ev.Type != eventType || ev.Service != "billing" {
+			t.Fatalf("expected %s for billing, got %s for %s", eventType, ev.Type, ev.Service)
+		}
+		if eventType == pb.BrokerEventType_BROKER_EVENT_TYPE_ENQUEUED && (ev.From != "orders" || ev.TraceId == "") {
+			t.Fatalf("enqueue event lacks message details: %v", ev)
+		}
+	}
+}
+
+func TestServerTap(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t)
+	ctx := testContext(t)
+	ops := b.Client(t, "ops")
+
+	tap, err := ops.Tap(ctx, "billing", 1)
+	if err != nil {
+		t.Fatalf("Tap failed: %v", err)
+	}
+	if _, err := tap.Header(); err != nil {
+		t.Fatalf("Tap failed: %v", err)
+	}
+	orders := b.Client(t, "orders")
+	if _, err := orders.Send(ctx, "shipping", []byte("filtered"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if _, err := orders.Send(ctx, "billing", []byte("mirrored"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	msg, err := tap.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if string(msg.Data) != "mirrored" || msg.From != "orders" {
+		t.Fatalf("unexpected tapped message: %v", msg)
+	}
+	// The tap does not take the message from its recipient
+	if got := receiveN(t, ctx, b.Client(t, "billing"), 1); string(got[0].Data) != "mirrored" {
+		t.Fatalf("expected the tapped message to be delivered, got %q", got[0].Data)
+	}
+
+	bad, err := ops.Tap(ctx, "billing", 1.5)
+	if err == nil {
+		_, err = bad.Recv()
+	}
+	assertCode(t, err, codes.InvalidArgument)
+}
+
+func TestServerTapRedaction(t *testing.T) {
+	quietLogs(t)
+	redactor, err := lib.NewRedactor([]lib.RedactionRule{{Path: "$.email"}})
+	if err != nil {
+		t.Fatalf("NewRedactor failed: %v", err)
+	}
+	b := brokertest.New(t, lib.WithRedaction(redactor))
+	ctx := testContext(t)
+
+	tap, err := b.Client(t, "ops").Tap(ctx, "billing", 1)
+	if err != nil {
+		t.Fatalf("Tap failed: %v", err)
+	}
+	if _, err := tap.Header(); err != nil {
+		t.Fatalf("Tap failed: %v", err)
+	}
+	payload := `{"email":"a@example.com"}`
+	if _, err := b.Client(t, "orders").Send(ctx, "billing", []byte(payload), pb.Type_JSON, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	msg, err := tap.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if string(msg.Data) != `{"email":"[REDACTED]"}` {
+		t.Fatalf("expected a redacted payload, got %s", msg.Data)
+	}
+	// Only the tap's copy is redacted
+	if got := receiveN(t, ctx, b.Client(t, "billing"), 1); string(got[0].Data) != payload {
+		t.Fatalf("expected the original payload to be delivered, got %s", got[0].Data)
+	}
+}
+
+func TestServerRoutingRules(t *testing.T) {
+	quietLogs(t)
+	router, err := lib.NewRouter(lib.RoutingConfig{Rules: []lib.RoutingRule{
+		{Name: "audit-orders", From: "orders", Type: "JSON", Action: lib.RouteCopy, Destinations: []string{"audit"}},
+		{Name: "drop-spam", From: "spam-*", Action: lib.RouteDrop},
+		{Name: "billing-v2", To: "billing", Headers: map[string]string{"region": "*"}, Action: lib.RouteTo, Destinations: []string{"billing-v2"}},
+	}})
+	if err != nil {
+		t.Fatalf("NewRouter failed: %v", err)
+	}
+	b := brokertest.New(t, lib.WithRouting(router))
+	ctx := testContext(t)
+	orders := b.Client(t, "orders")
+	raw := rawClient(t, b)
+
+	// Routed to billing-v2 and copied to audit
+	msg := &pb.Message{From: "orders", To: "billing", Data: []byte("routed"), Type: pb.Type_JSON, Queue: true, Headers: map[string]string{"region": "eu"}}
+	if _, err := raw.Send(ctx, msg); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	// Without the header only the copy rule matches
+	if _, err := orders.Send(ctx, "billing", []byte("kept"), pb.Type_JSON, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	st, err := b.Client(t, "spam-bot").Send(ctx, "billing", []byte("spam"), pb.Type_TEXT, true)
+	if err != nil || !strings.Contains(st.Message, "dropped") {
+		t.Fatalf("expected the message to be dropped, got %v, %v", st, err)
+	}
+	// Batches are routed message by message
+	if _, err := raw.SendBatch(ctx, &pb.Batch{Messages: []*pb.Message{
+		{From: "orders", To: "billing", Data: []byte("batched"), Type: pb.Type_TEXT, Queue: true, Headers: map[string]string{"region": "us"}},
+	}}); err != nil {
+		t.Fatalf("SendBatch failed: %v", err)
+	}
+
+	got := receiveN(t, ctx, b.Client(t, "billing-v2"), 2)
+	if string(got[0].Data) != "routed" || got[0].To != "billing-v2" || string(got[1].Data) != "batched" {
+		t.Fatalf("unexpected messages for billing-v2: %v", got)
+	}
+	got = receiveN(t, ctx, b.Client(t, "audit"), 2)
+	if string(got[0].Data) != "routed" || string(got[1].Data) != "kept" {
+		t.Fatalf("expected copies of both messages in audit, got %s and %s", got[0].Data, got[1].Data)
+	}
+	if got := receiveN(t, ctx, b.Client(t, "billing"), 1); string(got[0].Data) != "kept" {
+		t.Fatalf("expected only the unrouted message in billing, got %s", got[0].Data)
+	}
+	if n := b.Server().Metrics().Counter("broker_messages_routed_total", "rule", "drop-spam"); n != 1 {
+		t.Fatalf("expected 1 message routed by drop-spam, got %d", n)
+	}
+}
+
+func TestServerRoutingForwarded(t *testing.T) {
+	quietLogs(t)
+	router, err := lib.NewRouter(lib.RoutingConfig{Rules: []lib.RoutingRule{{Name: "drop-spam", From: "spam-*", Action: lib.RouteDrop}}})
+	if err != nil {
+		t.Fatalf("NewRouter failed: %v", err)
+	}
+	b, _ := shardedBroker(t, "shard-secret", lib.WithRouting(router))
+	msg := &pb.Message{From: "spam-bot", To: "billing", Data: []byte("spam"), Type: pb.Type_TEXT, Queue: true, Via: []string{"east"}}
+
+	// A forged forwarded marker or hop list does not skip the rules
+	for _, md := range [][]string{forwardedBy("guess"), nil} {
+		st, err := rawSend(t, b, msg, md...)
+		if err != nil || !strings.Contains(st.Message, "dropped") {
+			t.Fatalf("expected the message to be dropped, got %v, %v", st, err)
+		}
+	}
+}
+
+func TestServerAliases(t *testing.T) {
+	quietLogs(t)
+	router, err := lib.NewRouter(lib.RoutingConfig{Aliases: map[string][]string{"notifications": {"email", "sms", "push"}}})
+	if err != nil {
+		t.Fatalf("NewRouter failed: %v", err)
+	}
+	b := brokertest.New(t, lib.WithRouting(router))
+	ctx := testContext(t)
+	orders := b.Client(t, "orders")
+
+	// Each member gets its own copy, acked independently
+	st, err := orders.Send(ctx, "notifications", []byte("shipped"), pb.Type_TEXT, true)
+	if err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if !strings.Contains(st.Message, "email: ok") || !strings.Contains(st.Message, "push: ok") {
+		t.Fatalf("expected the outcome of every member, got %q", st.Message)
+	}
+	email, err := b.Client(t, "email").ReceiveWithAck(ctx)
+	if err != nil {
+		t.Fatalf("ReceiveWithAck failed: %v", err)
+	}
+	msg, err := email.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if msg.To != "email" || string(msg.Data) != "shipped" {
+		t.Fatalf("unexpected message for email: %v", msg)
+	}
+	smsCtx, disconnectSMS := context.WithCancel(ctx)
+	if got := receiveN(t, smsCtx, b.Client(t, "sms"), 1); got[0].To != "sms" {
+		t.Fatalf("unexpected message for sms: %v", got[0])
+	}
+	if got := receiveN(t, ctx, b.Client(t, "push"), 1); got[0].To != "push" {
+		t.Fatalf("unexpected message for push: %v", got[0])
+	}
+	if n, _ := b.Server().QueueLength("email"); n != 1 {
+		t.Fatalf("expected the unacked copy for email to stay queued, got %d", n)
+	}
+
+	// Members that are offline fail alone
+	disconnectSMS()
+	waitFor(t, "sms to disconnect", func() bool { return !b.Server().Connected("sms") })
+	st, err = orders.Send(ctx, "notifications", []byte("live"), pb.Type_TEXT, false)
+	if err != nil {
+		t.Fatalf("expected the send to succeed for the connected member, got %v", err)
+	}
+	if !strings.Contains(st.Message, "sms: Recipient offline") {
+		t.Fatalf("expected the offline member in the status, got %q", st.Message)
+	}
+	if n := b.Server().Metrics().Counter("broker_alias_failures_total", "alias", "notifications", "member", "sms"); n != 1 {
+		t.Fatalf("expected 1 failure for sms, got %d", n)
+	}
+	if n := b.Server().Metrics().Counter("broker_alias_copies_total", "alias", "notifications", "member", "email"); n != 2 {
+		t.Fatalf("expected 2 copies for email, got %d", n)
+	}
+}
+
+func TestServerMirroring(t *testing.T) {
+	quietLogs(t)
+	router, err := lib.NewRouter(lib.RoutingConfig{Rules: []lib.RoutingRule{
+		{Name: "billing-shadow", To: "billing", Action: lib.RouteMirror},
+	}})
+	if err != nil {
+		t.Fatalf("NewRouter failed: %v", err)
+	}
+	b := brokertest.New(t, lib.WithRouting(router), lib.WithQuota(lib.QuotaConfig{HourlyMessages: 2}))
+	ctx := testContext(t)
+	raw := rawClient(t, b)
+
+	msg := &pb.Message{From: "orders", To: "billing", Data: []byte("charge"), Type: pb.Type_JSON, Queue: true, RoutingSlip: []string{"shipping"}}
+	if _, err := raw.Send(ctx, msg); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	shadow, err := b.Client(t, "billing-shadow").ReceiveWithAck(ctx)
+	if err != nil {
+		t.Fatalf("ReceiveWithAck failed: %v", err)
+	}
+	copied, err := shadow.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if !copied.Mirrored || copied.To != "billing-shadow" || len(copied.RoutingSlip) != 0 {
+		t.Fatalf("unexpected shadow copy: %v", copied)
+	}
+	// Acking the shadow copy neither moves the workflow on nor touches the primary
+	if _, err := b.Client(t, "billing-shadow").Ack(ctx, copied.Id); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+	if n, _ := b.Server().QueueLength("shipping"); n != 0 {
+		t.Fatalf("expected no hop from the shadow copy, got %d messages for shipping", n)
+	}
+	if n, _ := b.Server().QueueLength("billing"); n != 1 {
+		t.Fatalf("expected the primary message to stay queued, got %d", n)
+	}
+
+	// Shadow copies do not count against the sender's quota, and clients cannot mark
+	// their own messages as such
+	msg = &pb.Message{From: "orders", To: "billing", Data: []byte("refund"), Type: pb.Type_JSON, Queue: true, Mirrored: true}
+	if _, err := raw.Send(ctx, msg); err != nil {
+		t.Fatalf("expected the second message within the quota, got %v", err)
+	}
+	_, err = raw.Send(ctx, &pb.Message{From: "orders", To: "billing", Data: []byte("over"), Queue: true})
+	assertCode(t, err, codes.ResourceExhausted)
+	if n := b.Server().Metrics().Counter("broker_messages_mirrored_total", "to", "billing-shadow"); n != 2 {
+		t.Fatalf("expected 2 shadow copies, got %d", n)
+	}
+}
+
+func TestServerCanary(t *testing.T) {
+	quietLogs(t)
+	router, err := lib.NewRouter(lib.RoutingConfig{Canaries: map[string]lib.Canary{
+		"billing": {Primary: "billing-v1", Canary: "billing-v2", Weight: 0},
+	}})
+	if err != nil {
+		t.Fatalf("NewRouter failed: %v", err)
+	}
+	b := brokertest.New(t, lib.WithRouting(router))
+	admin := httptest.NewServer(b.Server().AdminHandler(nil))
+	defer admin.Close()
+	ctx := testContext(t)
+	orders := b.Client(t, "orders")
+	send := func(n int, partition string) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			if _, err := orders.SendPartitioned(ctx, "billing", partition, []byte("charge"), pb.Type_JSON, true); err != nil {
+				t.Fatalf("Send failed: %v", err)
+			}
+		}
+	}
+	queued := func(service string) int {
+		t.Helper()
+		n, err := b.Server().QueueLength(service)
+		if err != nil {
+			t.Fatalf("QueueLength failed: %v", err)
+		}
+		return n
+	}
+	call := func(method, query string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, admin.URL+"/canary?"+query, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s /canary failed: %v", method, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s /canary?%s returned %s", method, query, resp.Status)
+		}
+	}
+
+	send(2, "")
+	if queued("billing-v1") != 2 || queued("billing") != 0 {
+		t.Fatalf("expected everything on billing-v1, got %d", queued("billing-v1"))
+	}
+
+	// Changed at runtime, messages of a partition all go the same way
+	call(http.MethodPost, "service=billing&primary=billing-v1&canary=billing-v2&weight=50")
+	send(10, "customer-42")
+	if v1, v2 := queued("billing-v1"), queued("billing-v2"); v1 != 12 && v2 != 10 {
+		t.Fatalf("expected the partition on one side, got %d on billing-v1 and %d on billing-v2", v1-2, v2)
+	}
+	call(http.MethodPost, "service=billing&primary=billing-v1&canary=billing-v2&weight=100")
+	v2 := queued("billing-v2")
+	send(3, "")
+	if got := queued("billing-v2"); got != v2+3 {
+		t.Fatalf("expected everything on billing-v2, got %d new messages", got-v2)
+	}
+	if got := b.Server().Canaries()["billing"]; got.Weight != 100 {
+		t.Fatalf("expected the runtime canary, got %+v", got)
+	}
+
+	// Clearing the runtime canary restores the configured one
+	call(http.MethodDelete, "service=billing")
+	if got := b.Server().Canaries()["billing"]; got.Weight != 0 {
+		t.Fatalf("expected the configured canary, got %+v", got)
+	}
+	req, _ := http.NewRequest(http.MethodPost, admin.URL+"/canary?service=billing&canary=billing&primary=billing&weight=10", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST /canary failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected an invalid canary to be refused, got %s", resp.Status)
+	}
+}
+
+func TestServerCanaryRestart(t *testing.T) {
+	quietLogs(t)
+	dbPath := filepath.Join(t.TempDir(), "broker.db")
+	server, err := lib.NewServer(dbPath, 60, 100, time.Hour)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	if err := server.SetCanary("billing", lib.Canary{Canary: "billing-v2", Weight: 25}); err != nil {
+		t.Fatalf("SetCanary failed: %v", err)
+	}
+	server.Close()
+
+	server, err = lib.NewServer(dbPath, 60, 100, time.Hour)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	defer server.Close()
+	if got := server.Canaries()["billing"]; got.Canary != "billing-v2" || got.Weight != 25 {
+		t.Fatalf("expected the canary to survive the restart, got %+v", got)
+	}
+}
+
+func TestServerEgress(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t, lib.WithEgress(lib.EgressConfig{Allow: map[string][]string{
+		"orders": {"billing", "shipping-*"},
+		"*":      {"audit"},
+	}}))
+	ctx := testContext(t)
+	events, err := b.Client(t, "ops").WatchEvents(ctx, nil, pb.BrokerEventType_BROKER_EVENT_TYPE_EGRESS_DENIED)
+	if err != nil {
+		t.Fatalf("WatchEvents failed: %v", err)
+	}
+	if _, err := events.Header(); err != nil {
+		t.Fatalf("WatchEvents failed: %v", err)
+	}
+	orders := b.Client(t, "orders")
+
+	for _, to := range []string{"billing", "billing@pod-1", "shipping-eu", "audit"} {
+		if _, err := orders.Send(ctx, to, []byte("ok"), pb.Type_TEXT, true); err != nil {
+			t.Fatalf("Send to %s failed: %v", to, err)
+		}
+	}
+	_, err = orders.Send(ctx, "payroll", []byte("no"), pb.Type_TEXT, true)
+	if !errors.Is(err, client.ErrPermissionDenied) {
+		t.Fatalf("expected ErrPermissionDenied, got %v", err)
+	}
+	// Senders that are not listed only get the destinations of "*"
+	_, err = b.Client(t, "reports").Send(ctx, "billing", []byte("no"), pb.Type_TEXT, true)
+	assertCode(t, err, codes.PermissionDenied)
+	// Routing slips are checked too
+	_, err = orders.SendRouted(ctx, []string{"billing", "payroll"}, []byte("no"), pb.Type_TEXT)
+	assertCode(t, err, codes.PermissionDenied)
+
+	ev, err := events.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if ev.Service != "payroll" || ev.From != "orders" {
+		t.Fatalf("unexpected event %v", ev)
+	}
+	if n, _ := b.Server().QueueLength("payroll"); n != 0 {
+		t.Fatalf("expected nothing queued for payroll, got %d", n)
+	}
+	if n := b.Server().Metrics().Counter("broker_egress_denied_total", "from", "orders", "to", "payroll"); n != 2 {
+		t.Fatalf("expected 2 denied sends from orders to payroll, got %d", n)
+	}
+}
+
+func TestServerEgressForwarded(t *testing.T) {
+	quietLogs(t)
+	b, owned := shardedBroker(t, "shard-secret", lib.WithEgress(lib.EgressConfig{Allow: map[string][]string{"orders": {"billing"}}}))
+	msg := func() *pb.Message {
+		return &pb.Message{From: "orders", To: owned, Data: []byte("x"), Type: pb.Type_TEXT, Queue: true, Via: []string{"east"}}
+	}
+
+	// A client setting the forwarded marker or a hop list is checked all the same
+	_, err := rawSend(t, b, msg(), forwardedBy("guess")...)
+	assertCode(t, err, codes.PermissionDenied)
+	_, err = rawSend(t, b, msg())
+	assertCode(t, err, codes.PermissionDenied)
+	// A shard proves itself with the secret, the call was checked where it was taken
+	if _, err := rawSend(t, b, msg(), forwardedBy("shard-secret")...); err != nil {
+		t.Fatalf("Send forwarded by a shard failed: %v", err)
+	}
+	if n, _ := b.Server().QueueLength(owned); n != 1 {
+		t.Fatalf("expected only the forwarded message queued, got %d", n)
+	}
+}
+
+func TestServerWildcards(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t, lib.WithRegistry(lib.RegistryConfig{}, []string{"payments.eu.billing", "payments.eu.ledger", "payments.us.billing"}))
+	ctx := testContext(t)
+	orders := b.Client(t, "orders")
+
+	// A Receive stream for a name pattern subscribes to the services it matches
+	subCtx, unsubscribe := context.WithCancel(ctx)
+	sub, err := b.Client(t, "payments.eu.*").Receive(subCtx)
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	waitFor(t, "the subscription", func() bool { return b.Server().Connected("payments.eu.*") })
+
+	st, err := orders.Send(ctx, "payments.eu.*", []byte("settle"), pb.Type_TEXT, true)
+	if err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if !strings.Contains(st.Message, "payments.eu.billing: ok") || !strings.Contains(st.Message, "payments.eu.ledger: ok") {
+		t.Fatalf("expected the outcome of every matching service, got %q", st.Message)
+	}
+	if _, err := orders.Send(ctx, "payments.us.billing", []byte("invoice"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	for _, service := range []string{"payments.eu.billing", "payments.eu.ledger", "payments.us.billing"} {
+		if n, _ := b.Server().QueueLength(service); n != 1 {
+			t.Fatalf("expected 1 message queued for %s, got %d", service, n)
+		}
+	}
+	copied := make(map[string]bool)
+	for range 2 {
+		msg, err := sub.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if msg.To != "payments.eu.*" || string(msg.Data) != "settle" {
+			t.Fatalf("unexpected copy %v", msg)
+		}
+		copied[msg.Headers[lib.SubscriptionHeader]] = true
+	}
+	if !copied["payments.eu.billing"] || !copied["payments.eu.ledger"] {
+		t.Fatalf("expected a copy for each eu service, got %v", copied)
+	}
+
+	_, err = orders.Send(ctx, "payments.asia.*", []byte("lost"), pb.Type_TEXT, true)
+	assertCode(t, err, codes.NotFound)
+
+	// Subscriptions outlive their streams until their queue is cleaned up
+	unsubscribe()
+	waitFor(t, "the subscriber to disconnect", func() bool { return !b.Server().Connected("payments.eu.*") })
+	if _, err := orders.Send(ctx, "payments.eu.billing", []byte("later"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if n, _ := b.Server().QueueLength("payments.eu.*"); n != 1 {
+		t.Fatalf("expected the copy to be queued for the subscription, got %d", n)
+	}
+	if _, err := b.Client(t, "payments.eu.*").Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	if subs := b.Server().Subscriptions(); len(subs) != 0 {
+		t.Fatalf("expected no subscription left, got %v", subs)
+	}
+}
+
+func TestServerPrefixCredentials(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.NewWithOptions(t, broker.Options{Auth: &lib.AuthConfig{EnableAuth: true, AuthMethod: lib.AuthMethodAPIKey}})
+	ctx := testContext(t)
+	key := b.AuthManager().GenerateAPIKey("payments.>")
+	connect := func(service string) *client.AuthenticatedClient {
+		c, err := client.NewAuthenticatedClientWithOptions("passthrough:///bufconn", service, "apikey", b.DialOptions()...)
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		c.SetAPIKey(key)
+		return c
+	}
+
+	// Credentials of a prefix act for every service under it
+	if _, err := b.Client(t, "orders").Send(ctx, "payments.eu.billing", []byte("x"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if got := receiveN(t, ctx, connect("payments.eu.billing"), 1); string(got[0].Data) != "x" {
+		t.Fatalf("unexpected message %v", got[0])
+	}
+	_, err := connect("orders").Cleanup(ctx)
+	assertCode(t, err, codes.PermissionDenied)
+	_, err = connect("payments").Cleanup(ctx)
+	assertCode(t, err, codes.PermissionDenied)
+}
+
+func TestServerRegistry(t *testing.T) {
+	quietLogs(t)
+	known := []string{"orders", "billing", "ops"}
+	router, err := lib.NewRouter(lib.RoutingConfig{Aliases: map[string][]string{"finance": {"billing"}}})
+	if err != nil {
+		t.Fatalf("NewRouter failed: %v", err)
+	}
+	b := brokertest.New(t, lib.WithRouting(router), lib.WithRegistry(lib.RegistryConfig{Strict: true}, known))
+	ctx := testContext(t)
+	orders := b.Client(t, "orders")
+
+	for _, to := range []string{"billing", "billing@pod-1", "finance"} {
+		if _, err := orders.Send(ctx, to, []byte("ok"), pb.Type_TEXT, true); err != nil {
+			t.Fatalf("Send to %s failed: %v", to, err)
+		}
+	}
+	_, err = orders.Send(ctx, "bilings", []byte("typo"), pb.Type_TEXT, true)
+	if !errors.Is(err, client.ErrUnknownService) {
+		t.Fatalf("expected ErrUnknownService, got %v", err)
+	}
+	assertCode(t, err, codes.NotFound)
+	_, err = b.Client(t, "intruder").Send(ctx, "billing", []byte("no"), pb.Type_TEXT, true)
+	assertCode(t, err, codes.NotFound)
+	_, err = orders.SendRouted(ctx, []string{"billing", "bilings"}, []byte("no"), pb.Type_TEXT)
+	assertCode(t, err, codes.NotFound)
+	// The message to billing@pod-1 waits in the queue of the instance
+	if n, _ := b.Server().QueueLength("billing"); n != 2 {
+		t.Fatalf("expected 2 messages queued for billing, got %d", n)
+	}
+
+	// In quarantine mode the messages are kept for operators, who are alerted
+	alerts := make(chan lib.Alert, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert lib.Alert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Errorf("invalid alert body: %v", err)
+		}
+		alerts <- alert
+	}))
+	defer hook.Close()
+	q := brokertest.New(t,
+		lib.WithRegistry(lib.RegistryConfig{Strict: true, Unknown: lib.UnknownQuarantine}, known),
+		lib.WithAlerts(10*time.Millisecond, []lib.AlertRule{{Name: "strangers", Condition: lib.AlertUnknownService, Webhook: hook.URL}}),
+	)
+	if _, err := q.Client(t, "orders").Send(ctx, "bilings", []byte("typo"), pb.Type_TEXT, false); err != nil {
+		t.Fatalf("expected the message to be quarantined, got %v", err)
+	}
+	msgs := receiveN(t, ctx, q.Client(t, lib.DefaultQuarantineQueue), 1)
+	if string(msgs[0].Data) != "typo" || msgs[0].Headers[lib.QuarantineHeader] != "unknown destination 'bilings'" {
+		t.Fatalf("unexpected quarantined message %v", msgs[0])
+	}
+	for _, state := range []string{"firing", "resolved"} {
+		select {
+		case alert := <-alerts:
+			if alert.Rule != "strangers" || alert.Service != "bilings" || alert.State != state {
+				t.Fatalf("expected strangers to be %s for bilings, got %+v", state, alert)
+			}
+		case <-ctx.Done():
+			t.Fatalf("no %s alert", state)
+		}
+	}
+	if n := q.Server().Metrics().Counter("broker_unknown_service_messages_total", "service", "bilings", "action", lib.UnknownQuarantine); n != 1 {
+		t.Fatalf("expected 1 quarantined message, got %d", n)
+	}
+}
+
+func TestServerRegistryForwarded(t *testing.T) {
+	quietLogs(t)
+	b, _ := shardedBroker(t, "shard-secret", lib.WithRegistry(lib.RegistryConfig{Strict: true}, []string{"orders", "billing"}))
+	msg := &pb.Message{From: "orders", To: "bilings", Data: []byte("typo"), Type: pb.Type_TEXT, Queue: true, Via: []string{"east"}}
+
+	// A forged forwarded marker or hop list does not skip the registry
+	_, err := rawSend(t, b, msg, forwardedBy("guess")...)
+	assertCode(t, err, codes.NotFound)
+	_, err = rawSend(t, b, msg)
+	assertCode(t, err, codes.NotFound)
+}
+
+func TestServerBacklogAge(t *testing.T) {
+	quietLogs(t)
+	alerts := make(chan lib.Alert, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert lib.Alert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Errorf("invalid alert body: %v", err)
+		}
+		alerts <- alert
+	}))
+	defer hook.Close()
+	b := brokertest.New(t,
+		lib.WithServices(map[string]lib.ServiceConfig{"billing": {MaxBacklogAge: 50 * time.Millisecond}}),
+		lib.WithBacklogCheckInterval(10*time.Millisecond),
+		lib.WithAlerts(10*time.Millisecond, []lib.AlertRule{{Name: "billing-sla", Condition: lib.AlertBacklogAge, Webhook: hook.URL}}),
+	)
+	ctx := testContext(t)
+
+	orders := b.Client(t, "orders")
+	for _, to := range []string{"billing", "shipping"} {
+		if _, err := orders.Send(ctx, to, []byte("late"), pb.Type_TEXT, true); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	expect := func(state string) {
+		t.Helper()
+		select {
+		case alert := <-alerts:
+			if alert.Rule != "billing-sla" || alert.Service != "billing" || alert.State != state {
+				t.Fatalf("expected billing-sla to be %s for billing, got %+v", state, alert)
+			}
+		case <-ctx.Done():
+			t.Fatalf("no %s alert", state)
+		}
+	}
+	// shipping has no max backlog age, only billing breaches
+	expect("firing")
+	waitFor(t, "the breach to be counted", func() bool {
+		return b.Server().Metrics().Counter("broker_backlog_sla_breaches_total", "service", "billing") == 1
+	})
+	ages, err := b.Server().BacklogAges(time.Now())
+	if err != nil {
+		t.Fatalf("BacklogAges failed: %v", err)
+	}
+	if ages["billing"] < 50*time.Millisecond || ages["shipping"] == 0 {
+		t.Fatalf("unexpected backlog ages %v", ages)
+	}
+
+	receiveN(t, ctx, b.Client(t, "billing"), 1)
+	expect("resolved")
+}
+
+func TestServerAlerts(t *testing.T) {
+	quietLogs(t)
+	alerts := make(chan lib.Alert, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert lib.Alert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Errorf("invalid alert body: %v", err)
+		}
+		alerts <- alert
+	}))
+	defer hook.Close()
+	b := brokertest.New(t, lib.WithAlerts(10*time.Millisecond, []lib.AlertRule{
+		{Name: "billing-backlog", Condition: lib.AlertQueueDepth, Service: "billing", Threshold: 1, Webhook: hook.URL},
+	}))
+	ctx := testContext(t)
+
+	orders := b.Client(t, "orders")
+	for _, data := range []string{"a", "b"} {
+		if _, err := orders.Send(ctx, "billing", []byte(data), pb.Type_TEXT, true); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	expect := func(state string) {
+		t.Helper()
+		select {
+		case alert := <-alerts:
+			if alert.Rule != "billing-backlog" || alert.Service != "billing" || alert.State != state {
+				t.Fatalf("expected billing-backlog to be %s, got %+v", state, alert)
+			}
+		case <-ctx.Done():
+			t.Fatalf("no %s alert", state)
+		}
+	}
+	expect("firing")
+	receiveN(t, ctx, b.Client(t, "billing"), 2)
+	expect("resolved")
+}
+
+func TestServerReports(t *testing.T) {
+	quietLogs(t)
+	reports := make(chan lib.Report, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report lib.Report
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			t.Errorf("invalid report body: %v", err)
+		}
+		reports <- report
+	}))
+	defer hook.Close()
+	file := filepath.Join(t.TempDir(), "reports.jsonl")
+	b := brokertest.New(t, lib.WithReports(lib.ReportsConfig{Interval: 50 * time.Millisecond, File: file, Webhook: hook.URL}))
+	ctx := testContext(t)
+
+	orders := b.Client(t, "orders")
+	for _, data := range []string{"a", "b"} {
+		if _, err := orders.Send(ctx, "billing", []byte(data), pb.Type_TEXT, true); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	// The sends may straddle two reports
+	var received, queued int64
+	for received < 2 {
+		select {
+		case report := <-reports:
+			if !report.To.After(report.From) {
+				t.Fatalf("report covers no interval: %+v", report)
+			}
+			received += report.Throughput["received"]
+			queued += report.Throughput["queued"]
+			if received == 2 && report.Queues["billing"] != 2 {
+				t.Fatalf("expected 2 messages queued for billing, got %v", report.Queues)
+			}
+		case <-ctx.Done():
+			t.Fatalf("no report of the sends")
+		}
+	}
+	if queued != 2 {
+		t.Fatalf("expected 2 queued messages over the reports, got %d", queued)
+	}
+	waitFor(t, "reports to be appended to the file", func() bool {
+		data, err := os.ReadFile(file)
+		return err == nil && strings.Count(string(data), "\n") >= 1
+	})
+}
+
+func TestServerInterceptors(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.NewWithOptions(t, broker.Options{
+		Auth:          &lib.AuthConfig{EnableAuth: true, AuthMethod: lib.AuthMethodAPIKey},
+		Interceptors:  []string{lib.InterceptorRecovery, lib.InterceptorMetrics, lib.InterceptorAuth, lib.InterceptorRateLimit, lib.InterceptorDeadline},
+		ServerOptions: []lib.ServerOption{lib.WithRateLimit(lib.RateLimitConfig{PerSecond: 0.01, Burst: 2})},
+	})
+	ctx := testContext(t)
+	raw := rawClient(t, b)
+	as := func(service string) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, "x-api-key", b.AuthManager().GenerateAPIKey(service))
+	}
+
+	send := func(ctx context.Context, from string) error {
+		_, err := raw.Send(ctx, &pb.Message{From: from, To: "billing", Data: []byte("x"), Type: pb.Type_TEXT, Queue: true})
+		return err
+	}
+	orders := as("orders")
+	for i := 0; i < 2; i++ {
+		if err := send(orders, "orders"); err != nil {
+			t.Fatalf("Send within the burst failed: %v", err)
+		}
+	}
+	assertCode(t, send(orders, "orders"), codes.ResourceExhausted)
+	// The limit runs after auth, so it is per service
+	if err := send(as("shipping"), "shipping"); err != nil {
+		t.Fatalf("Send of another service failed: %v", err)
+	}
+	// Pings are never limited
+	for i := 0; i < 3; i++ {
+		if _, err := raw.Ping(orders, &pb.Identity{From: "orders"}); err != nil {
+			t.Fatalf("Ping failed: %v", err)
+		}
+	}
+
+	metrics := b.Server().Metrics()
+	if n := metrics.Counter("broker_grpc_requests_total", "method", "Send", "code", "OK"); n != 3 {
+		t.Fatalf("expected 3 successful sends, got %d", n)
+	}
+	if n := metrics.Counter("broker_grpc_requests_total", "method", "Send", "code", "ResourceExhausted"); n != 1 {
+		t.Fatalf("expected 1 rate limited send, got %d", n)
+	}
+	if n := metrics.Counter("broker_rate_limited_total", "method", "Send"); n != 1 {
+		t.Fatalf("expected 1 rate limited call, got %d", n)
+	}
+
+	bad := broker.New(broker.Options{DBPath: t.TempDir(), Interceptors: []string{"tracing"}})
+	if err := bad.Start(ctx); err == nil {
+		bad.Stop()
+		t.Fatalf("expected an unknown interceptor to be refused")
+	}
+}
+
+func TestServerAccessLog(t *testing.T) {
+	quietLogs(t)
+	file := filepath.Join(t.TempDir(), "access.log")
+	accessLog, err := lib.OpenAccessLog(lib.AccessLogConfig{File: file, Format: lib.AccessLogJSON})
+	if err != nil {
+		t.Fatalf("OpenAccessLog failed: %v", err)
+	}
+	b := brokertest.NewWithOptions(t, broker.Options{
+		Auth:          &lib.AuthConfig{EnableAuth: true, AuthMethod: lib.AuthMethodAPIKey},
+		ServerOptions: []lib.ServerOption{lib.WithAccessLog(accessLog)},
+	})
+	ctx := testContext(t)
+	raw := rawClient(t, b)
+
+	orders := metadata.AppendToOutgoingContext(ctx, "x-api-key", b.AuthManager().GenerateAPIKey("orders"))
+	if _, err := raw.Send(orders, &pb.Message{From: "orders", To: "billing", Data: []byte("hello"), Type: pb.Type_TEXT, Queue: true}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	_, err = raw.Send(ctx, &pb.Message{From: "orders", To: "billing", Data: []byte("hello"), Type: pb.Type_TEXT, Queue: true})
+	assertCode(t, err, codes.Unauthenticated)
+	billing, stop := context.WithCancel(metadata.AppendToOutgoingContext(ctx, "x-api-key", b.AuthManager().GenerateAPIKey("billing")))
+	stream, err := raw.Receive(billing, &pb.Identity{From: "billing"})
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	// Streams are logged once they end
+	stop()
+
+	var entries []lib.AccessEntry
+	waitFor(t, "the Receive stream to be logged", func() bool {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return false
+		}
+		entries = nil
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var entry lib.AccessEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("invalid access log line %q: %v", line, err)
+			}
+			entries = append(entries, entry)
+		}
+		return len(entries) == 3
+	})
+	sent, refused, received := entries[0], entries[1], entries[2]
+	if sent.Method != "/base.proto.Broker/Send" || sent.Service != "orders" || sent.Code != "OK" || sent.RequestBytes == 0 || sent.ResponseBytes == 0 || sent.Peer == "" {
+		t.Fatalf("unexpected entry for the send: %+v", sent)
+	}
+	if refused.Service != "" || refused.Code != "Unauthenticated" || refused.ResponseBytes != 0 {
+		t.Fatalf("unexpected entry for the refused send: %+v", refused)
+	}
+	if received.Method != "/base.proto.Broker/Receive" || received.Service != "billing" || received.ResponseBytes == 0 {
+		t.Fatalf("unexpected entry for the stream: %+v", received)
+	}
+}
+
+func TestServerValidation(t *testing.T) {
+	quietLogs(t)
+	validators, err := lib.NewValidators([]lib.ValidationRule{
+		{Name: "billing-size", Services: []string{"billing"}, MaxBytes: 64},
+		{Name: "billing-invoice", Services: []string{"billing"}, Types: []string{"json"}, Schema: map[string]any{
+			"type":       "object",
+			"required":   []any{"amount"},
+			"properties": map[string]any{"amount": map[string]any{"type": "number", "minimum": 0}},
+		}},
+		{Name: "text", Services: []string{"logs.>"}, Action: lib.ValidationAnnotate, CheckContent: true},
+		{Name: "no-secrets", Validator: lib.ValidatorFunc(func(ctx context.Context, msg *pb.Message) error {
+			if strings.Contains(string(msg.Data), "password") {
+				return errors.New("payload mentions a password")
+			}
+			return nil
+		})},
+	})
+	if err != nil {
+		t.Fatalf("NewValidators failed: %v", err)
+	}
+	b := brokertest.New(t, lib.WithValidation(validators))
+	ctx := testContext(t)
+	orders := b.Client(t, "orders")
+
+	for _, tc := range []struct {
+		to   string
+		data string
+		typ  pb.Type
+		ok   bool
+	}{
+		{"billing", `{"amount": 12.5}`, pb.Type_JSON, true},
+		{"billing", `{"amount": -1}`, pb.Type_JSON, false},
+		{"billing", `{"total": 1}`, pb.Type_JSON, false},
+		{"billing", `{"amount": 1}`, pb.Type_TEXT, false},
+		{"billing", `{"amount": 1, "note": "` + strings.Repeat("x", 64) + `"}`, pb.Type_JSON, false},
+		{"shipping", "any password", pb.Type_TEXT, false},
+		{"shipping", "anything else", pb.Type_OTHER, true},
+	} {
+		_, err := orders.Send(ctx, tc.to, []byte(tc.data), tc.typ, true)
+		if tc.ok && err != nil {
+			t.Fatalf("Send of %s to %s failed: %v", tc.data, tc.to, err)
+		}
+		if !tc.ok {
+			assertCode(t, err, codes.InvalidArgument)
+			if !errors.Is(err, client.ErrValidationFailed) {
+				t.Fatalf("expected ErrValidationFailed for %s to %s, got %v", tc.data, tc.to, err)
+			}
+		}
+	}
+	if n, _ := b.QueueLength("billing"); n != 1 {
+		t.Fatalf("expected only the valid invoice to be queued, got %d", n)
+	}
+	if n := b.Server().Metrics().Counter("broker_validation_failures_total", "rule", "billing-invoice", "action", lib.ValidationReject); n != 3 {
+		t.Fatalf("expected 3 messages rejected by billing-invoice, got %d", n)
+	}
+
+	// A batch with an invalid message is refused whole
+	raw := rawClient(t, b)
+	_, err = raw.SendBatch(ctx, &pb.Batch{Messages: []*pb.Message{
+		{From: "orders", To: "billing", Data: []byte(`{"amount": 3}`), Type: pb.Type_JSON, Queue: true},
+		{From: "orders", To: "billing", Data: []byte(`{}`), Type: pb.Type_JSON, Queue: true},
+	}})
+	assertCode(t, err, codes.InvalidArgument)
+	if n, _ := b.QueueLength("billing"); n != 1 {
+		t.Fatalf("expected the refused batch not to be queued, got %d messages", n)
+	}
+
+	// Annotate rules let the message through with the failure in a header
+	if _, err := orders.Send(ctx, "logs.app", []byte{0xff, 0xfe}, pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send to an annotate rule failed: %v", err)
+	}
+	msg := receiveN(t, ctx, b.Client(t, "logs.app"), 1)[0]
+	if got := msg.Headers[lib.ValidationHeader]; got != "text: TEXT payload is not valid UTF-8" {
+		t.Fatalf("unexpected validation header %q", got)
+	}
+
+	for _, rule := range []lib.ValidationRule{
+		{Name: "empty"},
+		{Name: "bad-action", MaxBytes: 1, Action: "drop"},
+		{Name: "bad-type", Types: []string{"gif"}},
+		{Name: "bad-schema", Schema: map[string]any{"type": "decimal"}},
+	} {
+		if _, err := lib.NewValidators([]lib.ValidationRule{rule}); err == nil {
+			t.Fatalf("expected rule %s to be refused", rule.Name)
+		}
+	}
+}
+
+func TestServerValidationForwarded(t *testing.T) {
+	quietLogs(t)
+	validators, err := lib.NewValidators([]lib.ValidationRule{{Name: "billing-size", Services: []string{"billing"}, MaxBytes: 4}})
+	if err != nil {
+		t.Fatalf("NewValidators failed: %v", err)
+	}
+	b, _ := shardedBroker(t, "shard-secret", lib.WithValidation(validators))
+	msg := &pb.Message{From: "orders", To: "billing", Data: []byte("too large"), Type: pb.Type_TEXT, Queue: true, Via: []string{"east"}}
+
+	// A forged forwarded marker or hop list does not skip the rules
+	_, err = rawSend(t, b, msg, forwardedBy("guess")...)
+	assertCode(t, err, codes.InvalidArgument)
+	_, err = rawSend(t, b, msg)
+	assertCode(t, err, codes.InvalidArgument)
+	if n, _ := b.Server().QueueLength("billing"); n != 0 {
+		t.Fatalf("expected nothing queued, got %d", n)
+	}
+}
+
+// wasmPlugin writes a plugin module whose on_message returns decision, or accepts the
+// message as is when decision is empty, after looping forever when spin is set
+func wasmPlugin(t *testing.T, decision string, spin bool) string {
+	t.Helper()
+	uleb := func(n int) []byte {
+		var out []byte
+		for {
+			b := byte(n & 0x7f)
+			if n >>= 7; n == 0 {
+				return append(out, b)
+			}
+			out = append(out, b|0x80)
+		}
+	}
+	sleb := func(n int64) []byte {
+		var out []byte
+		for {
+			b := byte(n & 0x7f)
+			n >>= 7
+			if (n == 0 && b&0x40 == 0) || (n == -1 && b&0x40 != 0) {
+				return append(out, b)
+			}
+			out = append(out, b|0x80)
+		}
+	}
+	section := func(id byte, content ...[]byte) []byte {
+		body := slices.Concat(content...)
+		return slices.Concat([]byte{id}, uleb(len(body)), body)
+	}
+	name := func(s string) []byte { return append(uleb(len(s)), s...) }
+	const offset = 16
+	packed := int64(0)
+	if decision != "" {
+		packed = offset<<32 | int64(len(decision))
+	}
+	alloc := []byte{0x00, 0x41, 0x80, 0x08, 0x0b} // i32.const 1024
+	onMessage := []byte{0x00}
+	if spin {
+		onMessage = append(onMessage, 0x03, 0x40, 0x0c, 0x00, 0x0b) // loop br 0 end
+	}
+	onMessage = slices.Concat(onMessage, []byte{0x42}, sleb(packed), []byte{0x0b})
+	module := slices.Concat(
+		[]byte("\x00asm\x01\x00\x00\x00"),
+		section(1, []byte{0x02, 0x60, 0x01, 0x7f, 0x01, 0x7f, 0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e}),
+		section(3, []byte{0x02, 0x00, 0x01}),
+		section(5, []byte{0x01, 0x00, 0x01}),
+		section(7, []byte{0x03}, name("memory"), []byte{0x02, 0x00}, name("alloc"), []byte{0x00, 0x00}, name("on_message"), []byte{0x00, 0x01}),
+		section(10, []byte{0x02}, uleb(len(alloc)), alloc, uleb(len(onMessage)), onMessage),
+		section(11, []byte{0x01, 0x00, 0x41, offset, 0x0b}, name(decision)),
+	)
+	path := filepath.Join(t.TempDir(), "plugin.wasm")
+	if err := os.WriteFile(path, module, 0o600); err != nil {
+		t.Fatalf("failed to write plugin: %v", err)
+	}
+	return path
+}
+
+func TestServerPlugins(t *testing.T) {
+	quietLogs(t)
+	ctx := testContext(t)
+	plugins, err := lib.LoadPlugins(ctx, []lib.PluginConfig{
+		{Name: "redirect", Path: wasmPlugin(t, `{"to": "billing"}`, false), Services: []string{"invoices"}},
+		{Name: "tag", Path: wasmPlugin(t, `{"headers": {"x-plugin": "seen"}, "type": "JSON"}`, false), Services: []string{"billing"}},
+		{Name: "block", Path: wasmPlugin(t, `{"action": "reject", "reason": "no secrets"}`, false), Services: []string{"secrets"}},
+		{Name: "sink", Path: wasmPlugin(t, `{"action": "drop"}`, false), Services: []string{"audit.>"}},
+		{Name: "noop", Path: wasmPlugin(t, "", false)},
+		{Name: "spin", Path: wasmPlugin(t, "", true), Services: []string{"slow"}, Timeout: 20 * time.Millisecond, OnError: lib.PluginAccept},
+		{Name: "spin-strict", Path: wasmPlugin(t, "", true), Services: []string{"strict"}, Timeout: 20 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("LoadPlugins failed: %v", err)
+	}
+	b := brokertest.New(t, lib.WithPlugins(plugins))
+	orders := b.Client(t, "orders")
+
+	// Plugins run in order, so the redirected message is tagged too
+	for _, to := range []string{"billing", "invoices"} {
+		if _, err := orders.Send(ctx, to, []byte(`{"amount": 1}`), pb.Type_TEXT, true); err != nil {
+			t.Fatalf("Send to %s failed: %v", to, err)
+		}
+	}
+	for _, msg := range receiveN(t, ctx, b.Client(t, "billing"), 2) {
+		if msg.Headers["x-plugin"] != "seen" || msg.Type != pb.Type_JSON {
+			t.Fatalf("expected the plugin to tag the message, got headers %v and type %s", msg.Headers, msg.Type)
+		}
+	}
+
+	_, err = orders.Send(ctx, "secrets", []byte("hunter2"), pb.Type_TEXT, true)
+	assertCode(t, err, codes.InvalidArgument)
+	if !errors.Is(err, client.ErrValidationFailed) || !strings.Contains(err.Error(), "no secrets") {
+		t.Fatalf("expected the plugin's reason, got %v", err)
+	}
+
+	if _, err := orders.Send(ctx, "audit.orders", []byte("x"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send to a dropping plugin failed: %v", err)
+	}
+	if n, _ := b.QueueLength("audit.orders"); n != 0 {
+		t.Fatalf("expected the dropped message not to be queued, got %d", n)
+	}
+
+	// A plugin running out of time fails, which passes the message or refuses it
+	// depending on its policy
+	if _, err := orders.Send(ctx, "slow", []byte("x"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send past a failing accept plugin failed: %v", err)
+	}
+	_, err = orders.Send(ctx, "strict", []byte("x"), pb.Type_TEXT, true)
+	assertCode(t, err, codes.InvalidArgument)
+	metrics := b.Server().Metrics()
+	if n := metrics.Counter("broker_plugin_failures_total", "plugin", "spin"); n != 1 {
+		t.Fatalf("expected 1 failure of the spinning plugin, got %d", n)
+	}
+	if n := metrics.Counter("broker_plugin_decisions_total", "plugin", "sink", "action", lib.PluginDrop); n != 1 {
+		t.Fatalf("expected 1 message dropped by the sink plugin, got %d", n)
+	}
+
+	for _, config := range []lib.PluginConfig{
+		{Name: "missing", Path: filepath.Join(t.TempDir(), "missing.wasm")},
+		{Name: "bad-policy", Path: wasmPlugin(t, "", false), OnError: "retry"},
+		{Path: wasmPlugin(t, "", false)},
+	} {
+		if _, err := lib.LoadPlugins(ctx, []lib.PluginConfig{config}); err == nil {
+			t.Fatalf("expected plugin %q to be refused", config.Name)
+		}
+	}
+	garbage := filepath.Join(t.TempDir(), "garbage.wasm")
+	if err := os.WriteFile(garbage, []byte("not wasm"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lib.LoadPlugins(ctx, []lib.PluginConfig{{Name: "garbage", Path: garbage}}); err == nil {
+		t.Fatal("expected an invalid module to be refused")
+	}
+}
+
+func TestServerPluginsForwarded(t *testing.T) {
+	quietLogs(t)
+	plugins, err := lib.LoadPlugins(testContext(t), []lib.PluginConfig{
+		{Name: "block", Path: wasmPlugin(t, `{"action": "reject", "reason": "no secrets"}`, false), Services: []string{"secrets"}},
+	})
+	if err != nil {
+		t.Fatalf("LoadPlugins failed: %v", err)
+	}
+	b, _ := shardedBroker(t, "shard-secret", lib.WithPlugins(plugins))
+	msg := &pb.Message{From: "orders", To: "secrets", Data: []byte("hunter2"), Type: pb.Type_TEXT, Queue: true, Via: []string{"east"}}
+
+	// A forged forwarded marker or hop list does not skip the plugins
+	_, err = rawSend(t, b, msg, forwardedBy("guess")...)
+	assertCode(t, err, codes.InvalidArgument)
+	_, err = rawSend(t, b, msg)
+	assertCode(t, err, codes.InvalidArgument)
+}
+
+func TestServerScripts(t *testing.T) {
+	quietLogs(t)
+	ctx := testContext(t)
+	dir := t.TempDir()
+	write := func(name, source string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(source), 0o600); err != nil {
+			t.Fatalf("failed to write script: %v", err)
+		}
+		return path
+	}
+	env := write("env.lua", `function on_message(msg) msg.headers["x-env"] = "prod"; msg.headers["debug"] = nil end`)
+	scripts, err := lib.LoadScripts([]lib.ScriptConfig{
+		{Name: "env", Path: env, Services: []string{"tagged"}},
+		{Name: "spam", Path: write("spam.lua", `function on_message(msg) return not string.find(msg.data, "spam", 1, true) end`), Services: []string{"inbox"}},
+		{Name: "spin", Path: write("spin.lua", `function on_message(msg) while true do end end`), Services: []string{"slow"}, Timeout: 20 * time.Millisecond},
+		{Name: "broken", Path: write("broken.lua", `function on_message(msg) error("boom") end`), Services: []string{"slow"}},
+	})
+	if err != nil {
+		t.Fatalf("LoadScripts failed: %v", err)
+	}
+	stop := scripts.Watch(10 * time.Millisecond)
+	t.Cleanup(stop)
+	b := brokertest.New(t, lib.WithScripts(scripts))
+	orders := b.Client(t, "orders")
+	raw := rawClient(t, b)
+
+	send := func(to, data string, headers map[string]string) {
+		t.Helper()
+		if _, err := raw.Send(ctx, &pb.Message{From: "orders", To: to, Data: []byte(data), Type: pb.Type_TEXT, Queue: true, Headers: headers}); err != nil {
+			t.Fatalf("Send to %s failed: %v", to, err)
+		}
+	}
+	tagged, err := b.Client(t, "tagged").Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	waitFor(t, "tagged to connect", func() bool { return b.Server().Connected("tagged") })
+	send("tagged", "x", map[string]string{"debug": "1", "keep": "yes"})
+	msg := recvMessage(t, tagged)
+	if msg.Headers["x-env"] != "prod" || msg.Headers["keep"] != "yes" || msg.Headers["debug"] != "" {
+		t.Fatalf("expected the script to change the headers, got %v", msg.Headers)
+	}
+
+	send("inbox", "buy spam now", nil)
+	send("inbox", "hello", nil)
+	if n, _ := b.QueueLength("inbox"); n != 1 {
+		t.Fatalf("expected the spam to be filtered out, got %d queued messages", n)
+	}
+	if n := b.Server().Metrics().Counter("broker_messages_filtered_total", "script", "spam"); n != 1 {
+		t.Fatalf("expected 1 filtered message, got %d", n)
+	}
+
+	// Scripts that fail or run out of time let the message through unchanged
+	if _, err := orders.Send(ctx, "slow", []byte("x"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send past failing scripts failed: %v", err)
+	}
+	for _, name := range []string{"spin", "broken"} {
+		if n := b.Server().Metrics().Counter("broker_script_failures_total", "script", name); n != 1 {
+			t.Fatalf("expected 1 failure of script %s, got %d", name, n)
+		}
+	}
+
+	// Changed scripts are reloaded while the broker runs, broken ones are not
+	write("env.lua", `function on_message(msg) msg.headers["x-env"] = "staging" end`)
+	later := time.Now().Add(time.Second)
+	if err := os.Chtimes(env, later, later); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the script to be reloaded", func() bool {
+		send("tagged", "x", nil)
+		return recvMessage(t, tagged).Headers["x-env"] == "staging"
+	})
+	write("env.lua", `function on_message(msg`)
+	if err := os.Chtimes(env, later.Add(time.Second), later.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	send("tagged", "x", nil)
+	if got := recvMessage(t, tagged).Headers["x-env"]; got != "staging" {
+		t.Fatalf("expected the previous version to keep running, got x-env %q", got)
+	}
+
+	for _, config := range []lib.ScriptConfig{
+		{Name: "missing", Path: filepath.Join(dir, "missing.lua")},
+		{Name: "no-handler", Path: write("empty.lua", `x = 1`)},
+		{Name: "syntax", Path: write("syntax.lua", `function on_message(`)},
+		{Name: "files", Path: write("files.lua", `dofile("/etc/passwd")`)},
+	} {
+		if _, err := lib.LoadScripts([]lib.ScriptConfig{config}); err == nil {
+			t.Fatalf("expected script %s to be refused", config.Name)
+		}
+	}
+}
+
+func TestServerScriptsForwarded(t *testing.T) {
+	quietLogs(t)
+	path := filepath.Join(t.TempDir(), "spam.lua")
+	if err := os.WriteFile(path, []byte(`function on_message(msg) return not string.find(msg.data, "spam", 1, true) end`), 0o600); err != nil {
+		t.Fatalf("failed to write script: %v", err)
+	}
+	scripts, err := lib.LoadScripts([]lib.ScriptConfig{{Name: "spam", Path: path, Services: []string{"inbox"}}})
+	if err != nil {
+		t.Fatalf("LoadScripts failed: %v", err)
+	}
+	b, _ := shardedBroker(t, "shard-secret", lib.WithScripts(scripts))
+	msg := &pb.Message{From: "orders", To: "inbox", Data: []byte("buy spam now"), Type: pb.Type_TEXT, Queue: true, Via: []string{"east"}}
+
+	// A forged forwarded marker or hop list does not skip the scripts
+	for _, md := range [][]string{forwardedBy("guess"), nil} {
+		if _, err := rawSend(t, b, msg, md...); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+	if n := b.Server().Metrics().Counter("broker_messages_filtered_total", "script", "spam"); n != 2 {
+		t.Fatalf("expected both messages filtered, got %d", n)
+	}
+	if n, _ := b.QueueLength("inbox"); n != 0 {
+		t.Fatalf("expected nothing queued, got %d", n)
+	}
+}
+
+func TestServerEnrichment(t *testing.T) {
+	quietLogs(t)
+	ctx := testContext(t)
+	var calls sync.Map
+	decisions := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			From    string            `json:"from"`
+			To      string            `json:"to"`
+			Headers map[string]string `json:"headers"`
+			Size    int               `json:"size"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		calls.Store(req.To, req.Size)
+		tier := "standard"
+		if req.Headers["customer"] == "acme" {
+			tier = "gold"
+		}
+		json.NewEncoder(w).Encode(map[string]any{"headers": map[string]string{"tier": tier, "customer": ""}})
+	}))
+	t.Cleanup(decisions.Close)
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(down.Close)
+
+	router, err := lib.NewRouter(lib.RoutingConfig{
+		Enrichments: []lib.Enrichment{
+			{Name: "tier", To: "orders", URL: decisions.URL},
+			{Name: "flaky", To: "audit", URL: down.URL, FailureThreshold: 2, OpenTimeout: time.Hour},
+			{Name: "strict", To: "payments", URL: down.URL, OnError: lib.EnrichReject},
+		},
+		// Rules see the enriched headers
+		Rules: []lib.RoutingRule{{Name: "gold", To: "orders", Headers: map[string]string{"tier": "gold"}, Action: lib.RouteTo, Destinations: []string{"orders-priority"}}},
+	})
+	if err != nil {
+		t.Fatalf("NewRouter failed: %v", err)
+	}
+	b := brokertest.New(t, lib.WithRouting(router))
+	raw := rawClient(t, b)
+	send := func(to string, headers map[string]string) error {
+		_, err := raw.Send(ctx, &pb.Message{From: "shop", To: to, Data: []byte("order"), Type: pb.Type_TEXT, Queue: true, Headers: headers})
+		return err
+	}
+
+	if err := send("orders", map[string]string{"customer": "acme"}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if err := send("orders", nil); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if size, _ := calls.Load("orders"); size != len("order") {
+		t.Fatalf("expected the endpoint to get the payload size, got %v", size)
+	}
+	msg := receiveN(t, ctx, b.Client(t, "orders-priority"), 1)[0]
+	if msg.Headers["tier"] != "gold" || msg.Headers["customer"] != "" {
+		t.Fatalf("expected the answered headers to be merged, got %v", msg.Headers)
+	}
+	msg = receiveN(t, ctx, b.Client(t, "orders"), 1)[0]
+	if msg.Headers["tier"] != "standard" {
+		t.Fatalf("expected the standard tier, got %v", msg.Headers)
+	}
+
+	// Failures let messages through by default, until the circuit breaker opens
+	for range 3 {
+		if err := send("audit", nil); err != nil {
+			t.Fatalf("Send past a failing enrichment failed: %v", err)
+		}
+	}
+	metrics := b.Server().Metrics()
+	if n := metrics.Counter("broker_enrichments_total", "enrichment", "flaky", "outcome", "failed"); n != 2 {
+		t.Fatalf("expected 2 failed calls before the breaker opened, got %d", n)
+	}
+	if n := metrics.Counter("broker_enrichments_total", "enrichment", "flaky", "outcome", "open"); n != 1 {
+		t.Fatalf("expected 1 call skipped by the open breaker, got %d", n)
+	}
+	assertCode(t, send("payments", nil), codes.Unavailable)
+
+	for _, e := range []lib.Enrichment{
+		{Name: "no-url"},
+		{Name: "bad-url", URL: "ftp://example.com"},
+		{Name: "bad-policy", URL: decisions.URL, OnError: "retry"},
+	} {
+		if _, err := lib.NewRouter(lib.RoutingConfig{Enrichments: []lib.Enrichment{e}}); err == nil {
+			t.Fatalf("expected enrichment %s to be refused", e.Name)
+		}
+	}
+}
+
+func TestServerEnrichmentForwarded(t *testing.T) {
+	quietLogs(t)
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(down.Close)
+	router, err := lib.NewRouter(lib.RoutingConfig{
+		Enrichments: []lib.Enrichment{{Name: "strict", To: "payments", URL: down.URL, OnError: lib.EnrichReject}},
+	})
+	if err != nil {
+		t.Fatalf("NewRouter failed: %v", err)
+	}
+	b, _ := shardedBroker(t, "shard-secret", lib.WithRouting(router))
+	msg := &pb.Message{From: "shop", To: "payments", Data: []byte("order"), Type: pb.Type_TEXT, Queue: true,
+		Headers: map[string]string{"tier": "gold"}, Via: []string{"east"}}
+
+	// A forged forwarded marker or hop list does not skip the enrichments
+	_, err = rawSend(t, b, msg, forwardedBy("guess")...)
+	assertCode(t, err, codes.Unavailable)
+	_, err = rawSend(t, b, msg)
+	assertCode(t, err, codes.Unavailable)
+}
+
+func TestServerConvert(t *testing.T) {
+	quietLogs(t)
+	ctx := testContext(t)
+	router, err := lib.NewRouter(lib.RoutingConfig{Rules: []lib.RoutingRule{
+		{Name: "copy-legacy", To: "orders", Action: lib.RouteCopy, Destinations: []string{"legacy", "compact"}},
+		{Name: "legacy-xml", To: "legacy*", Action: lib.RouteConvert, Format: lib.ConvertXML},
+		{Name: "compact", To: "compact", Action: lib.RouteConvert, Format: lib.ConvertMsgPack},
+		{Name: "modern-json", To: "modern", Action: lib.RouteConvert, Format: lib.ConvertJSON},
+		{Name: "thumbs", To: "thumbs", Action: lib.RouteConvert, Format: lib.ConvertJPG},
+	}})
+	if err != nil {
+		t.Fatalf("NewRouter failed: %v", err)
+	}
+	b := brokertest.New(t, lib.WithRouting(router))
+	shop := b.Client(t, "shop")
+	send := func(to string, data []byte, typ pb.Type) {
+		t.Helper()
+		if _, err := shop.Send(ctx, to, data, typ, true); err != nil {
+			t.Fatalf("Send to %s failed: %v", to, err)
+		}
+	}
+
+	// Only the recipients of convert rules get the converted payload
+	send("orders", []byte(`{"id": 7, "items": ["a", "b"], "paid": true}`), pb.Type_JSON)
+	if msg := receiveN(t, ctx, b.Client(t, "orders"), 1)[0]; msg.Type != pb.Type_JSON {
+		t.Fatalf("expected orders to get JSON, got %s", msg.Type)
+	}
+	msg := receiveN(t, ctx, b.Client(t, "legacy"), 1)[0]
+	want := xml.Header + "<root><id>7</id><items>a</items><items>b</items><paid>true</paid></root>"
+	if msg.Type != pb.Type_XML || string(msg.Data) != want || msg.Headers[lib.ConvertedHeader] != "JSON" {
+		t.Fatalf("unexpected XML conversion: %s %q %v", msg.Type, msg.Data, msg.Headers)
+	}
+	msg = receiveN(t, ctx, b.Client(t, "compact"), 1)[0]
+	wantPack := []byte("\x83\xa2id\x07\xa5items\x92\xa1a\xa1b\xa4paid\xc3")
+	if msg.Type != pb.Type_OTHER || string(msg.Data) != string(wantPack) || msg.Headers[lib.ContentTypeHeader] != lib.MsgPackContentType {
+		t.Fatalf("unexpected MessagePack conversion: %s %x %v", msg.Type, msg.Data, msg.Headers)
+	}
+
+	send("modern", []byte(`<order id="7"><item>a</item><item>b</item><note>hi</note></order>`), pb.Type_XML)
+	msg = receiveN(t, ctx, b.Client(t, "modern"), 1)[0]
+	var doc map[string]any
+	if err := json.Unmarshal(msg.Data, &doc); err != nil || msg.Type != pb.Type_JSON {
+		t.Fatalf("expected JSON, got %s %q (%v)", msg.Type, msg.Data, err)
+	}
+	if doc["@id"] != "7" || doc["note"] != "hi" || len(doc["item"].([]any)) != 2 {
+		t.Fatalf("unexpected JSON conversion: %v", doc)
+	}
+
+	var png bytes.Buffer
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	if err := pngenc.Encode(&png, img); err != nil {
+		t.Fatal(err)
+	}
+	send("thumbs", png.Bytes(), pb.Type_PNG)
+	msg = receiveN(t, ctx, b.Client(t, "thumbs"), 1)[0]
+	if decoded, err := jpeg.Decode(bytes.NewReader(msg.Data)); err != nil || msg.Type != pb.Type_JPG || decoded.Bounds().Dx() != 4 {
+		t.Fatalf("expected a 4px JPEG, got %s (%v)", msg.Type, err)
+	}
+
+	// Payloads that do not convert are sent as they were
+	send("legacy-v2", []byte(`{"broken`), pb.Type_JSON)
+	msg = receiveN(t, ctx, b.Client(t, "legacy-v2"), 1)[0]
+	if msg.Type != pb.Type_JSON || string(msg.Data) != `{"broken` {
+		t.Fatalf("expected the payload unchanged, got %s %q", msg.Type, msg.Data)
+	}
+	if n := b.Server().Metrics().Counter("broker_conversion_failures_total", "rule", "legacy-xml"); n != 1 {
+		t.Fatalf("expected 1 conversion failure, got %d", n)
+	}
+
+	for _, rule := range []lib.RoutingRule{
+		{Name: "no-format", Action: lib.RouteConvert},
+		{Name: "bad-format", Action: lib.RouteConvert, Format: "yaml"},
+		{Name: "format-on-copy", Action: lib.RouteCopy, Destinations: []string{"x"}, Format: lib.ConvertXML},
+	} {
+		if _, err := lib.NewRouter(lib.RoutingConfig{Rules: []lib.RoutingRule{rule}}); err == nil {
+			t.Fatalf("expected rule %s to be refused", rule.Name)
+		}
+	}
+}
+
+func TestServerOffload(t *testing.T) {
+	quietLogs(t)
+	ctx := testContext(t)
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") || r.Header.Get("X-Amz-Content-Sha256") == "" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			objects[r.URL.Path], _ = io.ReadAll(r.Body)
+		case http.MethodGet:
+			data, ok := objects[r.URL.Path]
+			if r.URL.Query().Get("X-Amz-Signature") == "" || r.URL.Query().Get("X-Amz-Expires") != "600" {
+				w.WriteHeader(http.StatusForbidden)
+			} else if !ok {
+				w.WriteHeader(http.StatusNotFound)
+			} else {
+				w.Write(data)
+			}
+		}
+	}))
+	defer store.Close()
+	offloader, err := lib.NewOffloader(lib.OffloadConfig{
+		Threshold: 1024, Endpoint: store.URL, Bucket: "payloads", Prefix: "broker/",
+		AccessKey: "AKID", SecretKey: "secret", URLExpiry: 10 * time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("NewOffloader failed: %v", err)
+	}
+	b := brokertest.New(t, lib.WithOffload(offloader))
+	shop := b.Client(t, "shop")
+	shop.SetChecksum(pb.ChecksumType_SHA256)
+	large := bytes.Repeat([]byte("x"), 4096)
+	for _, data := range [][]byte{large, []byte("small")} {
+		if _, err := shop.Send(ctx, "archive", data, pb.Type_OTHER, true); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+
+	// Only the large payload is offloaded, the queue holds its claim check
+	mu.Lock()
+	stored := len(objects)
+	mu.Unlock()
+	if stored != 1 {
+		t.Fatalf("expected 1 object, got %d", stored)
+	}
+	queued, err := b.Server().QueuedMessages("archive", 0)
+	if err != nil || len(queued) != 2 {
+		t.Fatalf("expected 2 queued messages, got %d (%v)", len(queued), err)
+	}
+	if key := queued[0].Headers[protocol.ClaimCheckKeyHeader]; len(queued[0].Data) != 0 || !strings.HasPrefix(key, "broker/archive/") {
+		t.Fatalf("expected a claim check, got %d bytes and key %q", len(queued[0].Data), key)
+	}
+	if protocol.IsClaimCheck(queued[1].Headers) {
+		t.Fatal("expected the small payload to be queued inline")
+	}
+	if n := b.Server().Metrics().Counter("broker_payloads_offloaded_total"); n != 1 {
+		t.Fatalf("expected 1 offloaded payload, got %d", n)
+	}
+
+	// The client downloads the payload and verifies its checksum
+	msgs := receiveN(t, ctx, b.Client(t, "archive"), 2)
+	if !bytes.Equal(msgs[0].Data, large) || len(msgs[0].Headers) != 0 {
+		t.Fatalf("expected the large payload without claim check headers, got %d bytes and %v", len(msgs[0].Data), msgs[0].Headers)
+	}
+	if string(msgs[1].Data) != "small" {
+		t.Fatalf("unexpected small payload %q", msgs[1].Data)
+	}
+
+	// A payload that is gone cannot be redeemed
+	if _, err := shop.Send(ctx, "billing", large, pb.Type_OTHER, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	mu.Lock()
+	clear(objects)
+	mu.Unlock()
+	if _, err := b.Client(t, "billing").Fetch(ctx, 1, time.Minute); !errors.Is(err, client.ErrClaimCheck) {
+		t.Fatalf("expected ErrClaimCheck, got %v", err)
+	}
+
+	for _, config := range []lib.OffloadConfig{
+		{Threshold: -1},
+		{Threshold: 1, Endpoint: "minio:9000", Bucket: "b", AccessKey: "a", SecretKey: "s"},
+		{Threshold: 1, Endpoint: store.URL, AccessKey: "a", SecretKey: "s"},
+		{Threshold: 1, Endpoint: store.URL, Bucket: "b"},
+	} {
+		if _, err := lib.NewOffloader(config); err == nil {
+			t.Fatalf("expected %+v to be refused", config)
+		}
+	}
+}
+
+func TestServerStalledStore(t *testing.T) {
+	quietLogs(t)
+	ctx := testContext(t)
+	// An object store that takes uploads and never answers
+	stalled := make(chan struct{}, 1)
+	store := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		stalled <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer store.Close()
+	offloader, err := lib.NewOffloader(lib.OffloadConfig{
+		Threshold: 1024, Endpoint: store.URL, Bucket: "payloads", AccessKey: "AKID", SecretKey: "secret",
+	})
+	if err != nil {
+		t.Fatalf("NewOffloader failed: %v", err)
+	}
+	b := brokertest.New(t, lib.WithOffload(offloader))
+	conn, err := grpc.NewClient("passthrough:///bufconn", b.DialOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	raw := pb.NewBrokerClient(conn)
+
+	large := &pb.Message{From: "shop", To: "archive", Data: bytes.Repeat([]byte("x"), 4096), Queue: true}
+	timedOut := make(chan error, 1)
+	go func() {
+		sendCtx, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+		defer cancel()
+		_, err := raw.Send(sendCtx, large)
+		timedOut <- err
+	}()
+	<-stalled
+
+	// The next send waits for the stalled one to give up at its deadline instead of
+	// being turned away while the lock is held
+	start := time.Now()
+	if _, err := raw.Send(ctx, &pb.Message{From: "shop", To: "billing", Data: []byte("small"), Queue: true}); err != nil {
+		t.Fatalf("expected the next Send to succeed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("expected the next Send to go through once the stalled one timed out, took %s", elapsed)
+	}
+	assertCode(t, <-timedOut, codes.DeadlineExceeded)
+
+	// The timed-out send has stopped and never queues its message
+	time.Sleep(100 * time.Millisecond)
+	if n, err := b.Server().QueueLength("archive"); err != nil || n != 0 {
+		t.Fatalf("expected the timed-out message not to be queued, got %d (%v)", n, err)
+	}
+	if n, err := b.Server().QueueLength("billing"); err != nil || n != 1 {
+		t.Fatalf("expected 1 queued message, got %d (%v)", n, err)
+	}
+}
+
+func TestServerChunkedDelivery(t *testing.T) {
+	quietLogs(t)
+	ctx := testContext(t)
+	b := brokertest.New(t, lib.WithMaxFrameSize(64<<10), lib.WithMaxValueSize(1<<20))
+	shop := b.Client(t, "shop")
+	shop.SetChecksum(pb.ChecksumType_CRC32C)
+	large := make([]byte, 200<<10)
+	rand.Read(large)
+	for _, data := range [][]byte{large, []byte("small")} {
+		if _, err := shop.Send(ctx, "archive", data, pb.Type_OTHER, true); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+	}
+
+	// The client library reassembles the parts
+	msgs := receiveN(t, ctx, b.Client(t, "archive"), 2)
+	if !bytes.Equal(msgs[0].Data, large) || msgs[0].Chunk != 0 || msgs[0].Done {
+		t.Fatalf("expected the large payload reassembled, got %d bytes (chunk %d)", len(msgs[0].Data), msgs[0].Chunk)
+	}
+	if string(msgs[1].Data) != "small" {
+		t.Fatalf("unexpected small payload %q", msgs[1].Data)
+	}
+
+	// On the wire, each part fits in a frame and the last one is marked done
+	if _, err := shop.Send(ctx, "billing", large, pb.Type_OTHER, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	stream, err := rawClient(t, b).Receive(ctx, &pb.Identity{From: "billing"})
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	var data []byte
+	for i := uint32(1); ; i++ {
+		part := recvMessage(t, stream)
+		if part.Chunk != i || proto.Size(part) > 64<<10 {
+			t.Fatalf("expected part %d within the frame, got part %d of %d bytes", i, part.Chunk, proto.Size(part))
+		}
+		data = append(data, part.Data...)
+		if part.Done {
+			break
+		}
+	}
+	if !bytes.Equal(data, large) {
+		t.Fatalf("expected the parts to add up to the payload, got %d bytes", len(data))
+	}
+}
+
+func TestServerMessageSizes(t *testing.T) {
+	quietLogs(t)
+	ctx := testContext(t)
+	video := make([]byte, 6<<20)
+	rand.Read(video)
+
+	// The gRPC defaults refuse messages above 4MiB
+	small := brokertest.New(t)
+	_, err := small.Client(t, "camera").Send(ctx, "media", video, pb.Type_MP4, true)
+	assertCode(t, err, codes.ResourceExhausted)
+
+	sizes := lib.ServerConfig{MaxRecvMsgSize: 8 << 20, MaxSendMsgSize: 8 << 20}
+	b := brokertest.NewWithOptions(t, broker.Options{
+		ServerOptions: []lib.ServerOption{lib.WithMaxFrameSize(sizes.MaxSendMsgSize), lib.WithMaxValueSize(16 << 20)},
+		GRPCOptions:   sizes.MessageSizeOptions(),
+	})
+	if _, err := b.Client(t, "camera").Send(ctx, "media", video, pb.Type_MP4, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	connect := func(recv int) *client.AuthenticatedClient {
+		c, err := client.New(client.Config{Address: "passthrough:///bufconn", Service: "media"},
+			client.WithDialOptions(b.DialOptions()...), client.WithMaxMessageSizes(recv, 0))
+		if err != nil {
+			t.Fatalf("New failed: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+
+	big := connect(8 << 20)
+	msg := receiveN(t, ctx, big, 1)[0]
+	if !bytes.Equal(msg.Data, video) {
+		t.Fatalf("expected the video, got %d bytes", len(msg.Data))
+	}
+	big.Close()
+
+	// A client keeping the default limit cannot take it
+	if _, err := b.Client(t, "camera").Send(ctx, "media", video, pb.Type_MP4, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	stream, err := connect(0).Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	_, err = stream.Recv()
+	assertCode(t, err, codes.ResourceExhausted)
+
+	if _, err := client.New(client.Config{Address: "localhost:9000", Service: "media", MaxRecvMsgSize: -1}); err == nil {
+		t.Fatal("expected a negative message size to be refused")
+	}
+	t.Setenv(client.EnvMaxRecvMsgSize, "big")
+	if _, err := client.ConfigFromEnv(); err == nil {
+		t.Fatal("expected an invalid message size to be refused")
+	}
+}
+
+// countingConn counts the bytes read from and written to a connection
+type countingConn struct {
+	net.Conn
+	read, written *atomic.Int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func TestServerCompression(t *testing.T) {
+	quietLogs(t)
+	ctx := testContext(t)
+	b := brokertest.New(t, lib.WithMaxValueSize(1<<20))
+	connect := func(service string) (*client.AuthenticatedClient, *atomic.Int64, *atomic.Int64) {
+		var read, written atomic.Int64
+		c, err := client.NewAuthenticatedClientWithOptions("passthrough:///bufconn", service, "apikey",
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				conn, err := b.Dial(ctx)
+				return countingConn{Conn: conn, read: &read, written: &written}, err
+			}))
+		if err != nil {
+			t.Fatalf("connect failed: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c, &read, &written
+	}
+	var doc strings.Builder
+	for i := 0; doc.Len() < 256<<10; i++ {
+		fmt.Fprintf(&doc, `{"order": %d, "status": "shipped", "carrier": "postal"},`, i)
+	}
+	payload := []byte("[" + strings.TrimSuffix(doc.String(), ",") + "]")
+
+	shop, _, written := connect("shop")
+	sent := func(ctx context.Context) int64 {
+		t.Helper()
+		before := written.Load()
+		if _, err := shop.Send(ctx, "orders", payload, pb.Type_JSON, true); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		return written.Load() - before
+	}
+	plain := sent(ctx)
+	if err := shop.SetCompression(transport.Zstd); err != nil {
+		t.Fatalf("SetCompression failed: %v", err)
+	}
+	zstd := sent(ctx)
+	gzip := sent(client.WithCallCompression(ctx, transport.Gzip))
+	if zstd > plain/5 || gzip > plain/5 {
+		t.Fatalf("expected compressed sends, wrote %d bytes plain, %d with zstd and %d with gzip", plain, zstd, gzip)
+	}
+	if err := shop.SetCompression("brotli"); err == nil {
+		t.Fatal("expected an unknown compressor to be refused")
+	}
+
+	// The broker answers a compressed Receive call with compressed messages
+	orders, read, _ := connect("orders")
+	if err := orders.SetCompression(transport.Gzip); err != nil {
+		t.Fatalf("SetCompression failed: %v", err)
+	}
+	for _, msg := range receiveN(t, ctx, orders, 3) {
+		if !bytes.Equal(msg.Data, payload) {
+			t.Fatalf("expected the payload, got %d bytes", len(msg.Data))
+		}
+	}
+	if n := read.Load(); n > int64(len(payload)) {
+		t.Fatalf("expected compressed deliveries, read %d bytes for 3 payloads of %d", n, len(payload))
+	}
+}
+
+// lockedBuffer collects the broker log written by concurrent handlers
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// take returns and clears what was logged so far
+func (b *lockedBuffer) take() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	defer b.buf.Reset()
+	return b.buf.String()
+}
+
+func TestServerDebugToggles(t *testing.T) {
+	b := brokertest.NewWithOptions(t, broker.Options{Auth: &lib.AuthConfig{
+		EnableAuth: true,
+		AuthMethod: lib.AuthMethodAPIKey,
+		Policy:     lib.AuthPolicy{AdminServices: []string{"ops"}},
+	}})
+	logs := &lockedBuffer{}
+	out := log.Writer()
+	log.SetOutput(logs)
+	t.Cleanup(func() { log.SetOutput(out) })
+	ctx := testContext(t)
+	orders := b.Client(t, "orders")
+	ops := b.Client(t, "ops")
+	send := func(data string) string {
+		t.Helper()
+		logs.take()
+		if _, err := orders.Send(ctx, "billing", []byte(data), pb.Type_TEXT, true); err != nil {
+			t.Fatalf("Send failed: %v", err)
+		}
+		return logs.take()
+	}
+
+	_, err := orders.SetLogLevel(ctx, lib.LogLevelDebug)
+	assertCode(t, err, codes.PermissionDenied)
+	_, err = ops.SetLogLevel(ctx, "verbose")
+	assertCode(t, err, codes.InvalidArgument)
+
+	if _, err := ops.SetLogLevel(ctx, lib.LogLevelWarn); err != nil {
+		t.Fatalf("SetLogLevel failed: %v", err)
+	}
+	if logged := send("quiet"); strings.Contains(logged, "Received message") {
+		t.Fatalf("expected no line per message at the warn level, got %q", logged)
+	}
+	if _, err := ops.SetLogLevel(ctx, lib.LogLevelDebug); err != nil {
+		t.Fatalf("SetLogLevel failed: %v", err)
+	}
+	if logged := send("loud"); !strings.Contains(logged, "Received message from orders to billing") || !strings.Contains(logged, "Send from orders: OK") {
+		t.Fatalf("expected message and call lines at the debug level, got %q", logged)
+	}
+	if got := b.Server().LogLevel(); got != lib.LogLevelDebug {
+		t.Fatalf("expected the debug log level, got %s", got)
+	}
+	if _, err := ops.SetLogLevel(ctx, lib.LogLevelInfo); err != nil {
+		t.Fatalf("SetLogLevel failed: %v", err)
+	}
+
+	_, err = ops.LogPayloads(ctx, "billing", 48*time.Hour)
+	assertCode(t, err, codes.InvalidArgument)
+	if _, err := ops.LogPayloads(ctx, "billing", time.Minute); err != nil {
+		t.Fatalf("LogPayloads failed: %v", err)
+	}
+	if logged := send("invoice-42"); !strings.Contains(logged, `Payload of message from orders to billing (TEXT, 10 bytes`) || !strings.Contains(logged, `"invoice-42"`) {
+		t.Fatalf("expected the payload to be logged, got %q", logged)
+	}
+	if _, err := ops.LogPayloads(ctx, "billing", 0); err != nil {
+		t.Fatalf("LogPayloads failed: %v", err)
+	}
+	if logged := send("invoice-43"); strings.Contains(logged, "invoice-43") {
+		t.Fatalf("expected payload logging to stop, got %q", logged)
+	}
+
+	if _, err := ops.SetSlowLogging(ctx, time.Nanosecond); err != nil {
+		t.Fatalf("SetSlowLogging failed: %v", err)
+	}
+	if logged := send("slow"); !strings.Contains(logged, "Slow call Send from orders: OK") {
+		t.Fatalf("expected the send to be logged as slow, got %q", logged)
+	}
+	if _, err := ops.SetSlowLogging(ctx, 0); err != nil {
+		t.Fatalf("SetSlowLogging failed: %v", err)
+	}
+	if logged := send("fast"); strings.Contains(logged, "Slow call") {
+		t.Fatalf("expected slow call logging to stop, got %q", logged)
+	}
+	if n := b.Server().Metrics().Counter("broker_slow_calls_total", "method", "Send"); n != 1 {
+		t.Fatalf("expected 1 slow Send, got %d", n)
+	}
+}
+
+func TestServerDeliveryLatency(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t)
+	ctx := testContext(t)
+	orders := b.Client(t, "orders")
+	billing := b.Client(t, "billing")
+	if _, err := orders.Send(ctx, "billing", []byte("invoice"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	stream, err := billing.ReceiveWithAck(ctx)
+	if err != nil {
+		t.Fatalf("ReceiveWithAck failed: %v", err)
+	}
+	msg, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := billing.Ack(ctx, msg.Id); err != nil {
+		t.Fatalf("Ack failed: %v", err)
+	}
+
+	stats, err := b.Client(t, "ops").Stats(ctx)
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if len(stats) != 1 || stats[0].Service != "billing" {
+		t.Fatalf("expected the stats of billing, got %v", stats)
+	}
+	deliver, ack := stats[0].EnqueueToDeliver, stats[0].DeliverToAck
+	if deliver.Count != 1 || deliver.Sum.AsDuration() < 20*time.Millisecond {
+		t.Fatalf("expected one delivery after at least 20ms, got %v", deliver)
+	}
+	if ack.Count != 1 || ack.Sum.AsDuration() < 30*time.Millisecond {
+		t.Fatalf("expected one ack after at least 30ms, got %v", ack)
+	}
+	if p50 := ack.P50.AsDuration(); p50 <= 10*time.Millisecond || p50 > 50*time.Millisecond {
+		t.Fatalf("expected the median ack latency in the (10ms, 50ms] bucket, got %s", p50)
+	}
+	if stats, err := b.Client(t, "ops").Stats(ctx, "orders"); err != nil || stats[0].EnqueueToDeliver.Count != 0 {
+		t.Fatalf("expected no deliveries to orders, got %v (%v)", stats, err)
+	}
+
+	rec := httptest.NewRecorder()
+	b.Server().MetricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, line := range []string{
+		"# TYPE broker_delivery_latency_seconds histogram",
+		`broker_delivery_latency_seconds_count{service="billing"} 1`,
+		`broker_ack_latency_seconds_bucket{service="billing",le="+Inf"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), line) {
+			t.Fatalf("expected %q in the metrics", line)
+		}
+	}
+}
+
+// selfSignedCert writes a self-signed certificate for 127.0.0.1 and returns its TLS
+// config with the path of the certificate
+func selfSignedCert(t *testing.T) (*tls.Config, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "broker"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(t.TempDir(), "broker.crt")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, certFile
+}
+
+func TestServerQUIC(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t)
+	tlsConfig, certFile := selfSignedCert(t)
+	lis, err := transport.ListenQUIC("127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatalf("ListenQUIC failed: %v", err)
+	}
+	s := grpc.NewServer()
+	pb.RegisterBrokerServer(s, b.Server())
+	go s.Serve(lis)
+	defer s.Stop()
+	ctx := testContext(t)
+
+	dial := func(service string) *client.AuthenticatedClient {
+		t.Helper()
+		c, err := client.NewAuthenticatedQUICClient(lis.Addr().String(), service, "", certFile)
+		if err != nil {
+			t.Fatalf("NewAuthenticatedQUICClient failed: %v", err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	orders, billing := dial("orders"), dial("billing")
+	if _, err := orders.Send(ctx, "billing", []byte("over quic"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send over QUIC failed: %v", err)
+	}
+	queuedCtx, stop := context.WithCancel(ctx)
+	msgs := receiveN(t, queuedCtx, billing, 1)
+	stop()
+	if string(msgs[0].Data) != "over quic" || msgs[0].From != "orders" {
+		t.Fatalf("unexpected message over QUIC: %v", msgs[0])
+	}
+	waitFor(t, "the first stream to close", func() bool { return !b.Server().Connected("billing") })
+
+	// Live messages reach the open stream over the same connection
+	stream, err := billing.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive over QUIC failed: %v", err)
+	}
+	waitFor(t, "billing to connect over QUIC", func() bool { return b.Server().Connected("billing") })
+	if _, err := orders.Send(ctx, "billing", []byte("live"), pb.Type_TEXT, false); err != nil {
+		t.Fatalf("live Send over QUIC failed: %v", err)
+	}
+	msg, err := stream.Recv()
+	if err != nil || string(msg.Data) != "live" {
+		t.Fatalf("expected the live message, got %v (%v)", msg, err)
+	}
+}
+
+func TestServerQuota(t *testing.T) {
+	quietLogs(t)
+	router, err := lib.NewRouter(lib.RoutingConfig{Rules: []lib.RoutingRule{
+		{Name: "audit", To: "billing", Action: lib.RouteCopy, Destinations: []string{"audit"}},
+	}})
+	if err != nil {
+		t.Fatalf("NewRouter failed: %v", err)
+	}
+	b := brokertest.NewWithOptions(t, broker.Options{
+		Auth:          &lib.AuthConfig{EnableAuth: true, AuthMethod: lib.AuthMethodAPIKey},
+		ServerOptions: []lib.ServerOption{lib.WithRouting(router), lib.WithQuota(lib.QuotaConfig{HourlyMessages: 2})},
+	})
+	ctx := testContext(t)
+	orders := b.Client(t, "orders")
+
+	// A message copied by a routing rule is charged once
+	if _, err := orders.Send(ctx, "billing", []byte("a"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send within the quota failed: %v", err)
+	}
+	if n, _ := b.Server().QueueLength("audit"); n != 1 {
+		t.Fatalf("expected the copy for audit, got %d messages", n)
+	}
+	// A message the broker refuses is not charged
+	if _, err := b.Server().SetReadOnly(ctx, &pb.ReadOnlyRequest{Enabled: true}); err != nil {
+		t.Fatalf("SetReadOnly failed: %v", err)
+	}
+	_, err = orders.Send(ctx, "billing", []byte("refused"), pb.Type_TEXT, true)
+	assertCode(t, err, codes.Unavailable)
+	if _, err := b.Server().SetReadOnly(ctx, &pb.ReadOnlyRequest{Enabled: false}); err != nil {
+		t.Fatalf("SetReadOnly failed: %v", err)
+	}
+	if _, err := orders.Send(ctx, "billing", []byte("b"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send within the quota failed: %v", err)
+	}
+	_, err = orders.Send(ctx, "billing", []byte("c"), pb.Type_TEXT, true)
+	assertCode(t, err, codes.ResourceExhausted)
+	if !errors.Is(err, client.ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+	// Quotas are per credential: naming another sender does not reset them
+	key := b.AuthManager().GenerateAPIKey("orders")
+	_, err = rawSend(t, b, &pb.Message{From: "shipping", To: "billing", Data: []byte("d"), Queue: true}, "x-api-key", key)
+	assertCode(t, err, codes.ResourceExhausted)
+	if _, err := b.Client(t, "shipping").Send(ctx, "billing", []byte("e"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send of another service failed: %v", err)
+	}
+
+	resp, err := b.Server().GetQuotaUsage(ctx, &pb.QuotaUsageRequest{Services: []string{"orders"}})
+	if err != nil {
+		t.Fatalf("GetQuotaUsage failed: %v", err)
+	}
+	if usage := resp.Usage; len(usage) != 1 || usage[0].HourMessages != 2 || usage[0].HourBytes != 2 || usage[0].Limits.HourlyMessages != 2 {
+		t.Fatalf("unexpected usage %v", usage)
+	}
+}
+
+func TestServerQuotaUnauthenticated(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t, lib.WithQuota(lib.QuotaConfig{HourlyMessages: 2}))
+	ctx := testContext(t)
+	raw := rawClient(t, b)
+
+	// Without authentication the client address is charged, whatever sender it names
+	for _, from := range []string{"orders", "shipping"} {
+		if _, err := raw.Send(ctx, &pb.Message{From: from, To: "billing", Data: []byte("x"), Queue: true}); err != nil {
+			t.Fatalf("Send within the quota failed: %v", err)
+		}
+	}
+	_, err := raw.Send(ctx, &pb.Message{From: "inventory", To: "billing", Data: []byte("x"), Queue: true})
+	assertCode(t, err, codes.ResourceExhausted)
+
+	usage, err := b.Client(t, "orders").QuotaUsage(ctx, "bufconn")
+	if err != nil {
+		t.Fatalf("QuotaUsage failed: %v", err)
+	}
+	if len(usage) != 1 || usage[0].HourMessages != 2 || usage[0].Limits.HourlyMessages != 2 {
+		t.Fatalf("unexpected usage %v", usage)
+	}
+}
+
+func TestServerSharding(t *testing.T) {
+	quietLogs(t)
+	ctx := testContext(t)
+	shards, err := shard.New([]shard.Shard{{Name: "a", Address: "passthrough:///a"}, {Name: "b", Address: "passthrough:///b"}})
+	if err != nil {
+		t.Fatalf("shard.New failed: %v", err)
+	}
+	// Route the shard addresses to the in-memory brokers
+	brokers := make(map[string]*brokertest.Broker)
+	dial := []grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+			return brokers[address].Dial(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}
+	brokers["a"] = brokertest.New(t, lib.WithSharding(shards, "a", true, dial...))
+	brokers["b"] = brokertest.New(t, lib.WithSharding(shards, "b", true, dial...))
+
+	// A service owned by b
+	remote := ""
+	for i := 0; remote == ""; i++ {
+		if name := fmt.Sprintf("svc-%d", i); shards.Owner(name).Name == "b" {
+			remote = name
+		}
+	}
+
+	if _, err := brokers["a"].Client(t, "orders").Send(ctx, remote, []byte("forwarded"), pb.Type_TEXT, true); err != nil {
+		t.Fatalf("Send through the other shard failed: %v", err)
+	}
+	if n, _ := brokers["b"].QueueLength(remote); n != 1 {
+		t.Fatalf("expected the message on the owning shard, it has %d", n)
+	}
+	if n, _ := brokers["a"].QueueLength(remote); n != 0 {
+		t.Fatalf("the forwarding shard kept %d messages", n)
+	}
+
+	// Streams are not proxied
+	stream, err := brokers["a"].Client(t, remote).Receive(ctx)
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	assertCode(t, err, codes.FailedPrecondition)
+
+	consumer, err := client.NewShardedClient(shards, remote, "apikey", dial...)
+	if err != nil {
+		t.Fatalf("NewShardedClient failed: %v", err)
+	}
+	defer consumer.Close()
+	stream, err = consumer.Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	msg, err := stream.Recv()
+	if err != nil || string(msg.Data) != "forwarded" {
+		t.Fatalf("expected the forwarded message, got %v (%v)", msg, err)
+	}
+}
+
+func TestServerFederation(t *testing.T) {
+	quietLogs(t)
+	ctx := testContext(t)
+	// The west broker starts after a message for it is sent, as if across a WAN partition
+	var mu sync.Mutex
+	brokers := make(map[string]*brokertest.Broker)
+	dial := grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+		mu.Lock()
+		b, ok := brokers[address]
+		mu.Unlock()
+		if !ok {
+			return nil, errors.New("unreachable")
+		}
+		return b.Dial(ctx)
+	})
+	east := brokertest.New(t, lib.WithFederation("east", []lib.FederationLink{{Name: "west", Address: "passthrough:///west", Services: []string{"billing"}}}, nil, dial))
+
+	st, err := east.Client(t, "orders").Send(ctx, "billing", []byte("cross-dc"), pb.Type_TEXT, true)
+	if err != nil || !st.Success {
+		t.Fatalf("Send to a federated service failed: %v (%v)", st, err)
+	}
+	if n, _ := east.QueueLength(lib.FederationOutbox("west")); n != 1 {
+		t.Fatalf("expected the message in the outbox, it has %d", n)
+	}
+
+	west := brokertest.New(t, lib.WithFederation("west", nil, nil))
+	mu.Lock()
+	brokers["west"] = west
+	mu.Unlock()
+	waitFor(t, "the outbox to drain", func() bool {
+		n, _ := west.QueueLength("billing")
+		return n == 1
+	})
+	waitFor(t, "the forwarded message to be acknowledged", func() bool {
+		n, _ := east.QueueLength(lib.FederationOutbox("west"))
+		return n == 0
+	})
+	stream, err := west.Client(t, "billing").Receive(ctx)
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	msg, err := stream.Recv()
+	if err != nil || string(msg.Data) != "cross-dc" || len(msg.Via) != 1 || msg.Via[0] != "east" {
+		t.Fatalf("expected the forwarded message via east, got %v (%v)", msg, err)
+	}
+
+	// A message that already went through west is refused
+	link, err := rawClient(t, west).Federate(ctx)
+	if err != nil {
+		t.Fatalf("Federate failed: %v", err)
+	}
+	if err := link.Send(&pb.Message{Id: "1", From: "orders", To: "billing", Data: []byte("loop"), Via: []string{"west", "east"}}); err != nil {
+		t.Fatalf("Send on the link failed: %v", err)
+	}
+	ack, err := link.Recv()
+	if err != nil || ack.Id != "1" || ack.Status.Success || ack.Status.Error != pb.Error_INVALID_REQUEST {
+		t.Fatalf("expected the loop to be refused, got %v (%v)", ack, err)
+	}
+
+	// Outboxes cannot be consumed directly
+	stream, err = east.Client(t, lib.FederationOutbox("west")).Receive(ctx)
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	assertCode(t, err, codes.InvalidArgument)
+}
+
+func TestServerHello(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t)
+	ctx := testContext(t)
+
+	// The client announces its version and features and keeps what the broker agreed to
+	c := b.Client(t, "orders")
+	if c.Supports(protocol.FeatureFetch) {
+		t.Fatalf("feature reported as supported before Hello")
+	}
+	resp, err := c.Hello(ctx)
+	if err != nil {
+		t.Fatalf("Hello failed: %v", err)
+	}
+	if resp.ProtocolVersion != protocol.Version || resp.MinProtocolVersion != protocol.MinVersion {
+		t.Fatalf("expected version %d (min %d), got %d (min %d)", protocol.Version, protocol.MinVersion, resp.ProtocolVersion, resp.MinProtocolVersion)
+	}
+	if !slices.Equal(resp.Features, protocol.Features) || !c.Supports(protocol.FeatureFetch) {
+		t.Fatalf("expected every feature to be agreed, got %v", resp.Features)
+	}
+
+	// A newer client settles for the broker's version and the features they share
+	raw := rawClient(t, b)
+	resp, err = raw.Hello(ctx, &pb.HelloRequest{From: "orders", ProtocolVersion: protocol.Version + 1, Features: []string{"zstd", protocol.FeatureFetch, protocol.FeatureBatch}})
+	if err != nil {
+		t.Fatalf("Hello failed: %v", err)
+	}
+	if resp.ProtocolVersion != protocol.Version {
+		t.Fatalf("expected version %d, got %d", protocol.Version, resp.ProtocolVersion)
+	}
+	if want := []string{protocol.FeatureBatch, protocol.FeatureFetch}; !slices.Equal(resp.Features, want) {
+		t.Fatalf("expected features %v, got %v", want, resp.Features)
+	}
+
+	// Clients older than the minimum version are refused
+	_, err = raw.Hello(ctx, &pb.HelloRequest{From: "orders", ProtocolVersion: protocol.MinVersion - 1})
+	assertCode(t, err, codes.FailedPrecondition)
+}
+
+func TestServerV2Interop(t *testing.T) {
+	quietLogs(t)
+	b := brokertest.New(t)
+	ctx := testContext(t)
+	conn, err := grpc.NewClient("passthrough:///bufconn", b.DialOptions()...)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	v2 := pbv2.NewBrokerClient(conn)
+
+	// A v2 client sends to a v1 one, headers and partition key included
+	st, err := v2.Send(ctx, &pbv2.Message{
+		Data:         []byte("from v2"),
+		Type:         pbv2.Type_TYPE_TEXT,
+		From:         "orders",
+		To:           "billing",
+		Queue:        true,
+		Headers:      map[string]string{"tenant": "acme"},
+		PartitionKey: "alice",
+	})
+	if err != nil || st.Error != pbv2.Error_ERROR_NONE {
+		t.Fatalf("v2 Send failed: %v, %v", st, err)
+	}
+	billing := b.Client(t, "billing")
+	msgs := receiveN(t, ctx, billing, 1)
+	if got := msgs[0]; string(got.Data) != "from v2" || got.Type != pb.Type_TEXT || got.From != "orders" ||
+		got.Headers["tenant"] != "acme" || got.PartitionKey != "alice" {
+		t.Fatalf("v1 client received %v", got)
+	}
+
+	// and receives the v1 reply
+	stream, err := v2.Receive(ctx, &pbv2.Identity{From: "orders"})
+	if err != nil {
+		t.Fatalf("v2 Receive failed: %v", err)
+	}
+	if _, err := billing.Send(ctx, "orders", []byte("from v1"), pb.Type_JSON, true); err != nil {
+		t.Fatalf("v1 Send failed: %v", err)
+	}
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("v2 Recv failed: %v", err)
+		}
+		if msg.Event == pbv2.Event_EVENT_KEEPALIVE {
+			continue
+		}
+		if string(msg.Data) != "from v1" || msg.Type != pbv2.Type_TYPE_JSON || msg.From != "billing" || msg.Event != pbv2.Event_EVENT_MESSAGE {
+			t.Fatalf("v2 client received %v", msg)
+		}
+		break
+	}
+
+	// Errors carry the v2 Status
+	_, err = v2.Send(ctx, &pbv2.Message{From: "orders", To: "billing"})
+	assertCode(t, err, codes.InvalidArgument)
+	details := status.Convert(err).Details()
+	if len(details) != 1 {
+		t.Fatalf("expected a Status detail, got %v", details)
+	}
+	if detail, ok := details[0].(*pbv2.Status); !ok || detail.Error != pbv2.Error_ERROR_INVALID_REQUEST {
+		t.Fatalf("expected a v2 Status detail, got %T %v", details[0], details[0])
+	}
+}
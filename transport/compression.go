@@ -0,0 +1,89 @@
+package transport
+
+import (
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/gzip"
+)
+
+// Compressors registered on the gRPC layer by this package, for grpc.UseCompressor.
+// They compress messages on the wire only, queued payloads are stored as sent.
+const (
+	Gzip = gzip.Name
+	Zstd = "zstd"
+)
+
+func init() {
+	encoding.RegisterCompressor(&zstdCompressor{})
+}
+
+// zstdCompressor is the gRPC compressor of Zstandard, reusing encoders and decoders
+// across messages
+type zstdCompressor struct {
+	encoders sync.Pool
+	decoders sync.Pool
+}
+
+func (c *zstdCompressor) Name() string {
+	return Zstd
+}
+
+func (c *zstdCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	if enc, ok := c.encoders.Get().(*zstd.Encoder); ok {
+		enc.Reset(w)
+		return &zstdWriter{Encoder: enc, pool: &c.encoders}, nil
+	}
+	enc, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1), zstd.WithEncoderLevel(zstd.SpeedFastest))
+	if err != nil {
+		return nil, err
+	}
+	return &zstdWriter{Encoder: enc, pool: &c.encoders}, nil
+}
+
+func (c *zstdCompressor) Decompress(r io.Reader) (io.Reader, error) {
+	if dec, ok := c.decoders.Get().(*zstd.Decoder); ok {
+		if err := dec.Reset(r); err != nil {
+			c.decoders.Put(dec)
+			return nil, err
+		}
+		return &zstdReader{Decoder: dec, pool: &c.decoders}, nil
+	}
+	dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &zstdReader{Decoder: dec, pool: &c.decoders}, nil
+}
+
+// zstdWriter returns its encoder to the pool once closed
+type zstdWriter struct {
+	*zstd.Encoder
+	pool *sync.Pool
+}
+
+func (w *zstdWriter) Close() error {
+	err := w.Encoder.Close()
+	w.pool.Put(w.Encoder)
+	return err
+}
+
+// zstdReader returns its decoder to the pool once the message is read
+type zstdReader struct {
+	*zstd.Decoder
+	pool *sync.Pool
+}
+
+func (r *zstdReader) Read(p []byte) (int, error) {
+	if r.Decoder == nil {
+		return 0, io.EOF
+	}
+	n, err := r.Decoder.Read(p)
+	if err == io.EOF {
+		r.pool.Put(r.Decoder)
+		r.Decoder = nil
+	}
+	return n, err
+}
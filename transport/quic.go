@@ -0,0 +1,140 @@
+// Package transport provides alternative network transports for the broker's
+// gRPC protocol.
+//
+// The QUIC transport carries the regular gRPC (HTTP/2) byte stream over a
+// single bidirectional QUIC stream per connection. It is not HTTP/3, but it
+// gives clients on flaky networks QUIC's connection migration and faster
+// recovery from packet loss without changing the broker protocol.
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUICALPN is the ALPN protocol negotiated by broker QUIC connections
+const QUICALPN = "ms-broker-grpc"
+
+// quicConfig keeps idle connections alive across short network outages
+var quicConfig = &quic.Config{
+	MaxIdleTimeout:  30 * time.Second,
+	KeepAlivePeriod: 10 * time.Second,
+}
+
+// quicConn exposes the first stream of a QUIC connection as a net.Conn
+type quicConn struct {
+	*quic.Stream
+	conn *quic.Conn
+}
+
+func (c *quicConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *quicConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// Close closes the stream and the underlying QUIC connection
+func (c *quicConn) Close() error {
+	c.Stream.Close()
+	return c.conn.CloseWithError(0, "")
+}
+
+// quicListener adapts a QUIC listener to net.Listener for grpc.Server.Serve
+type quicListener struct {
+	ln        *quic.Listener
+	conns     chan net.Conn
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+}
+
+// ListenQUIC listens for broker QUIC connections on addr. The TLS config must
+// contain a server certificate; QUIC always encrypts.
+func ListenQUIC(addr string, tlsConf *tls.Config) (net.Listener, error) {
+	if tlsConf == nil || len(tlsConf.Certificates) == 0 {
+		return nil, errors.New("QUIC transport requires a TLS certificate")
+	}
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{QUICALPN}
+	ln, err := quic.ListenAddr(addr, tlsConf, quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &quicListener{ln: ln, conns: make(chan net.Conn), ctx: ctx, cancel: cancel}
+	go l.acceptLoop()
+	return l, nil
+}
+
+// acceptLoop accepts connections and waits for each client's stream in the background
+// so one slow handshake cannot block the others
+func (l *quicListener) acceptLoop() {
+	for {
+		conn, err := l.ln.Accept(l.ctx)
+		if err != nil {
+			return
+		}
+		go func() {
+			stream, err := conn.AcceptStream(l.ctx)
+			if err != nil {
+				conn.CloseWithError(0, "no stream")
+				return
+			}
+			select {
+			case l.conns <- &quicConn{Stream: stream, conn: conn}:
+			case <-l.ctx.Done():
+				conn.CloseWithError(0, "listener closed")
+			}
+		}()
+	}
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *quicListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		l.cancel()
+		err = l.ln.Close()
+	})
+	return err
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// DialQUIC opens a QUIC connection to a broker and returns its stream as a
+// net.Conn, suitable for grpc.WithContextDialer
+func DialQUIC(ctx context.Context, addr string, tlsConf *tls.Config) (net.Conn, error) {
+	if tlsConf == nil {
+		tlsConf = &tls.Config{}
+	}
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{QUICALPN}
+	if tlsConf.ServerName == "" {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			tlsConf.ServerName = host
+		}
+	}
+	conn, err := quic.DialAddr(ctx, addr, tlsConf, quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		conn.CloseWithError(0, "")
+		return nil, err
+	}
+	return &quicConn{Stream: stream, conn: conn}, nil
+}